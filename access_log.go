@@ -0,0 +1,194 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	_ Listener = (*accessLogPeerListener)(nil)
+	_ PeerConn = (*accessLogTCPConn)(nil)
+)
+
+// meshTCPConn is a TCP connection accepted from the mesh (possibly traced).
+type meshTCPConn interface {
+	PeerConn
+	halfCloser
+	io.ReaderFrom
+	io.WriterTo
+	WriteBuffers(bufs net.Buffers) (int64, error)
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+	SetNoDelay(noDelay bool) error
+	SetLinger(sec int) error
+}
+
+// NewAccessLogListener wraps a listener, so that every connection it accepts
+// is logged when it is closed, giving services an audit trail of who connected.
+// Each entry records the peer's name and public key (for listeners on the
+// mesh), the remote address, the local port, how long the connection was open,
+// and the bytes sent and received.
+//
+// Connections keep the features of the underlying listener's connections (eg.
+// PeerConn), and if the listener implements Listener, so does the wrapper.
+func NewAccessLogListener(logger *slog.Logger, lis net.Listener) net.Listener {
+	l := &accessLogListener{Listener: lis, logger: logger}
+
+	if peerLis, ok := lis.(Listener); ok {
+		return &accessLogPeerListener{accessLogListener: l, peerLis: peerLis}
+	}
+
+	return l
+}
+
+type accessLogListener struct {
+	net.Listener
+	logger *slog.Logger
+}
+
+func (l *accessLogListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return l.logConn(conn), nil
+}
+
+func (l *accessLogListener) logConn(conn net.Conn) net.Conn {
+	al := &accessLog{logger: l.logger, conn: conn, start: time.Now()}
+
+	if c, ok := conn.(meshTCPConn); ok {
+		return &accessLogTCPConn{meshTCPConn: c, accessLog: al}
+	}
+
+	return &accessLogConn{Conn: conn, accessLog: al}
+}
+
+// accessLogPeerListener is an access logging listener for a Listener.
+type accessLogPeerListener struct {
+	*accessLogListener
+	peerLis Listener
+}
+
+func (l *accessLogPeerListener) AcceptContext(ctx context.Context) (net.Conn, error) {
+	conn, err := l.peerLis.AcceptContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return l.logConn(conn), nil
+}
+
+func (l *accessLogPeerListener) SetDeadline(t time.Time) error {
+	return l.peerLis.SetDeadline(t)
+}
+
+// accessLog is the access log entry of a connection.
+type accessLog struct {
+	logger        *slog.Logger
+	conn          net.Conn
+	start         time.Time
+	bytesSent     atomic.Uint64
+	bytesReceived atomic.Uint64
+	logOnce       sync.Once
+}
+
+func (al *accessLog) log() {
+	al.logOnce.Do(func() {
+		attrs := []any{"remoteAddr", al.conn.RemoteAddr().String()}
+
+		if peerConn, ok := al.conn.(PeerConn); ok {
+			attrs = append(attrs, "peer", peerConn.PeerName(), "publicKey", peerConn.PeerPublicKey())
+		}
+
+		if addr, ok := al.conn.LocalAddr().(*net.TCPAddr); ok {
+			attrs = append(attrs, "port", addr.Port)
+		}
+
+		attrs = append(attrs,
+			"duration", time.Since(al.start),
+			"bytesSent", al.bytesSent.Load(),
+			"bytesReceived", al.bytesReceived.Load())
+
+		al.logger.Info("Connection closed", attrs...)
+	})
+}
+
+// accessLogTCPConn is a TCP connection from the mesh that is access logged.
+// It still implements PeerConn, CloseRead, CloseWrite, the copy fast paths,
+// and socket options of tcpConn.
+type accessLogTCPConn struct {
+	meshTCPConn
+	*accessLog
+}
+
+func (c *accessLogTCPConn) Read(b []byte) (int, error) {
+	n, err := c.meshTCPConn.Read(b)
+	c.bytesReceived.Add(uint64(n))
+	return n, err
+}
+
+func (c *accessLogTCPConn) Write(b []byte) (int, error) {
+	n, err := c.meshTCPConn.Write(b)
+	c.bytesSent.Add(uint64(n))
+	return n, err
+}
+
+func (c *accessLogTCPConn) ReadFrom(r io.Reader) (int64, error) {
+	n, err := c.meshTCPConn.ReadFrom(r)
+	c.bytesSent.Add(uint64(n))
+	return n, err
+}
+
+func (c *accessLogTCPConn) WriteTo(w io.Writer) (int64, error) {
+	n, err := c.meshTCPConn.WriteTo(w)
+	c.bytesReceived.Add(uint64(n))
+	return n, err
+}
+
+func (c *accessLogTCPConn) WriteBuffers(bufs net.Buffers) (int64, error) {
+	n, err := c.meshTCPConn.WriteBuffers(bufs)
+	c.bytesSent.Add(uint64(n))
+	return n, err
+}
+
+func (c *accessLogTCPConn) Close() error {
+	err := c.meshTCPConn.Close()
+	c.log()
+	return err
+}
+
+// accessLogConn is any other connection that is access logged.
+type accessLogConn struct {
+	net.Conn
+	*accessLog
+}
+
+func (c *accessLogConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.bytesReceived.Add(uint64(n))
+	return n, err
+}
+
+func (c *accessLogConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.bytesSent.Add(uint64(n))
+	return n, err
+}
+
+func (c *accessLogConn) Close() error {
+	err := c.Conn.Close()
+	c.log()
+	return err
+}
@@ -0,0 +1,126 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoisySocket_AccessLog(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverSocket, clientSocket, err := noisysockets.Pipe(logger, &v1alpha1.Config{
+		Name:       "server",
+		PrivateKey: serverPrivateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{{
+			Name:      "client",
+			PublicKey: clientPrivateKey.PublicKey().String(),
+			IPs:       []string{"10.7.0.2"},
+		}},
+	}, &v1alpha1.Config{
+		Name:       "client",
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{{
+			Name:      "server",
+			PublicKey: serverPrivateKey.PublicKey().String(),
+			IPs:       []string{"10.7.0.1"},
+		}},
+	}, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+		require.NoError(t, clientSocket.Close())
+	})
+
+	var logBuf bytes.Buffer
+	accessLogger := slog.New(slog.NewJSONHandler(&logBuf, nil))
+
+	lis, err := serverSocket.Listen("tcp", ":80")
+	require.NoError(t, err)
+
+	lis = noisysockets.NewAccessLogListener(accessLogger, lis)
+	t.Cleanup(func() {
+		_ = lis.Close()
+	})
+
+	_, ok := lis.(noisysockets.Listener)
+	require.True(t, ok)
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// Accepted connections still identify the peer.
+		if _, ok := conn.(noisysockets.PeerConn); !ok {
+			return
+		}
+
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	conn, err := clientSocket.Dial("tcp", "server:80")
+	require.NoError(t, err)
+
+	_, err = conn.Write([]byte("Hello, server!"))
+	require.NoError(t, err)
+
+	buf := make([]byte, len("Hello, server!"))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+
+	require.NoError(t, conn.(interface{ CloseWrite() error }).CloseWrite())
+	_, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	// The connection is logged once the server closes it.
+	<-closed
+
+	var entry struct {
+		Msg           string `json:"msg"`
+		RemoteAddr    string `json:"remoteAddr"`
+		Peer          string `json:"peer"`
+		PublicKey     string `json:"publicKey"`
+		Port          int    `json:"port"`
+		Duration      int64  `json:"duration"`
+		BytesSent     uint64 `json:"bytesSent"`
+		BytesReceived uint64 `json:"bytesReceived"`
+	}
+	require.NoError(t, json.Unmarshal(logBuf.Bytes(), &entry))
+
+	require.Equal(t, "Connection closed", entry.Msg)
+	require.Equal(t, "client", entry.Peer)
+	require.Equal(t, clientPrivateKey.PublicKey().String(), entry.PublicKey)
+	require.Equal(t, 80, entry.Port)
+	require.Contains(t, entry.RemoteAddr, "10.7.0.2:")
+	require.Greater(t, entry.Duration, int64(0))
+	require.Equal(t, uint64(len("Hello, server!")), entry.BytesSent)
+	require.Equal(t, uint64(len("Hello, server!")), entry.BytesReceived)
+}
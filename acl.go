@@ -0,0 +1,471 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+const (
+	// aclUDPFlowTimeout is how long replies are permitted after the last
+	// outbound packet of a UDP flow.
+	aclUDPFlowTimeout = 2 * time.Minute
+	// aclMaxUDPFlows is the number of tracked UDP flows above which expired
+	// flows are pruned.
+	aclMaxUDPFlows = 4096
+)
+
+var errACLDenied = errors.New("denied by acl")
+
+type aclDirection int
+
+const (
+	aclInbound aclDirection = 1 << iota
+	aclOutbound
+)
+
+type aclRule struct {
+	allow     bool
+	peer      string // empty for all peers
+	tag       string // set for rules applying to all peers with the tag
+	direction aclDirection
+	protocols []uint8 // nil for any protocol
+	firstPort uint16  // zero for any port
+	lastPort  uint16
+}
+
+func (r *aclRule) matches(direction aclDirection, protocol uint8, port uint16) bool {
+	if r.direction&direction == 0 {
+		return false
+	}
+
+	if r.protocols != nil {
+		var found bool
+		for _, p := range r.protocols {
+			if p == protocol {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if r.firstPort != 0 {
+		// Port ranges only apply to protocols with ports.
+		if protocol != uint8(header.TCPProtocolNumber) && protocol != uint8(header.UDPProtocolNumber) {
+			return false
+		}
+
+		if port < r.firstPort || port > r.lastPort {
+			return false
+		}
+	}
+
+	return true
+}
+
+// acl is an immutable, ordered, set of rules. The first matching rule decides
+// whether traffic is allowed, if no rule matches traffic is allowed.
+type acl struct {
+	rules    []aclRule
+	byPeer   map[transport.NoisePublicKey][]*aclRule
+	wildcard []*aclRule
+}
+
+func newACL(rulesConf []v1alpha1.ACLRuleConfig) (*acl, error) {
+	a := &acl{}
+
+	for i, ruleConf := range rulesConf {
+		rule, err := parseACLRule(ruleConf)
+		if err != nil {
+			return nil, fmt.Errorf("invalid acl rule %d: %w", i, err)
+		}
+
+		a.rules = append(a.rules, rule)
+	}
+
+	return a, nil
+}
+
+// resolve returns a copy of the acl with rules indexed by peer public key.
+func (a *acl) resolve(peerNames map[string]transport.NoisePublicKey, peerTags map[transport.NoisePublicKey][]string) *acl {
+	resolved := &acl{rules: a.rules}
+
+	// Rules for a peer must be interleaved with the wildcard rules to preserve ordering.
+	peerRules := make(map[transport.NoisePublicKey][]*aclRule)
+	for i := range a.rules {
+		rule := &a.rules[i]
+		if rule.tag != "" {
+			for pk, tags := range peerTags {
+				if !slices.Contains(tags, rule.tag) {
+					continue
+				}
+
+				if _, ok := peerRules[pk]; !ok {
+					peerRules[pk] = append([]*aclRule(nil), resolved.wildcard...)
+				}
+				peerRules[pk] = append(peerRules[pk], rule)
+			}
+			continue
+		}
+
+		if rule.peer == "" {
+			resolved.wildcard = append(resolved.wildcard, rule)
+			for pk := range peerRules {
+				peerRules[pk] = append(peerRules[pk], rule)
+			}
+			continue
+		}
+
+		pk, ok := peerNames[rule.peer]
+		if !ok {
+			if err := pk.FromString(rule.peer); err != nil {
+				// The peer might be added later.
+				continue
+			}
+		}
+
+		if _, ok := peerRules[pk]; !ok {
+			peerRules[pk] = append([]*aclRule(nil), resolved.wildcard...)
+		}
+		peerRules[pk] = append(peerRules[pk], rule)
+	}
+
+	resolved.byPeer = peerRules
+
+	return resolved
+}
+
+func (a *acl) allowed(publicKey transport.NoisePublicKey, direction aclDirection, protocol uint8, port uint16) bool {
+	rules, ok := a.byPeer[publicKey]
+	if !ok {
+		rules = a.wildcard
+	}
+
+	for _, rule := range rules {
+		if rule.matches(direction, protocol, port) {
+			return rule.allow
+		}
+	}
+
+	return true
+}
+
+func parseACLRule(ruleConf v1alpha1.ACLRuleConfig) (aclRule, error) {
+	var rule aclRule
+
+	switch strings.ToLower(ruleConf.Action) {
+	case "allow":
+		rule.allow = true
+	case "deny":
+	default:
+		return rule, fmt.Errorf("unknown action %q", ruleConf.Action)
+	}
+
+	if ruleConf.Peer != "*" {
+		if ruleConf.Peer == "" {
+			return rule, fmt.Errorf("missing peer")
+		}
+
+		if tag, ok := strings.CutPrefix(ruleConf.Peer, "tag:"); ok {
+			if tag == "" {
+				return rule, fmt.Errorf("missing tag")
+			}
+
+			rule.tag = tag
+		} else {
+			rule.peer = ruleConf.Peer
+		}
+	}
+
+	switch strings.ToLower(ruleConf.Direction) {
+	case "":
+		rule.direction = aclInbound | aclOutbound
+	case "inbound":
+		rule.direction = aclInbound
+	case "outbound":
+		rule.direction = aclOutbound
+	default:
+		return rule, fmt.Errorf("unknown direction %q", ruleConf.Direction)
+	}
+
+	switch strings.ToLower(ruleConf.Protocol) {
+	case "":
+	case "tcp":
+		rule.protocols = []uint8{uint8(header.TCPProtocolNumber)}
+	case "udp":
+		rule.protocols = []uint8{uint8(header.UDPProtocolNumber)}
+	case "icmp":
+		rule.protocols = []uint8{uint8(header.ICMPv4ProtocolNumber), uint8(header.ICMPv6ProtocolNumber)}
+	default:
+		return rule, fmt.Errorf("unsupported protocol %q", ruleConf.Protocol)
+	}
+
+	if ruleConf.Ports != "" {
+		if rule.protocols != nil && rule.protocols[0] != uint8(header.TCPProtocolNumber) && rule.protocols[0] != uint8(header.UDPProtocolNumber) {
+			return rule, fmt.Errorf("ports are only supported for tcp and udp")
+		}
+
+		first, last, isRange := strings.Cut(ruleConf.Ports, "-")
+		if !isRange {
+			last = first
+		}
+
+		firstPort, err := strconv.ParseUint(first, 10, 16)
+		if err != nil || firstPort == 0 {
+			return rule, fmt.Errorf("invalid port %q", first)
+		}
+
+		lastPort, err := strconv.ParseUint(last, 10, 16)
+		if err != nil || lastPort < firstPort {
+			return rule, fmt.Errorf("invalid port range %q", ruleConf.Ports)
+		}
+
+		rule.firstPort, rule.lastPort = uint16(firstPort), uint16(lastPort)
+	}
+
+	return rule, nil
+}
+
+// udpFlow identifies a UDP flow between a local port and a remote address.
+type udpFlow struct {
+	publicKey transport.NoisePublicKey
+	localPort uint16
+	remote    netip.AddrPort
+}
+
+// SetACL replaces the access control rules applied to traffic exchanged with
+// peers. Inbound connections (and packets) initiated by peers are checked
+// against rules with an inbound direction, dials to peers are checked against
+// rules with an outbound direction. Replies to permitted traffic are always
+// allowed. An empty set of rules allows all traffic.
+func (ss *sourceSink) SetACL(rulesConf []v1alpha1.ACLRuleConfig) error {
+	if len(rulesConf) == 0 {
+		ss.peersMu.Lock()
+		ss.acl.Store(nil)
+		ss.peersMu.Unlock()
+		return nil
+	}
+
+	a, err := newACL(rulesConf)
+	if err != nil {
+		return err
+	}
+
+	ss.peersMu.Lock()
+	defer ss.peersMu.Unlock()
+
+	ss.acl.Store(a.resolve(ss.peerNames, ss.peerTags))
+
+	return nil
+}
+
+// SetPeerTags replaces the tags of a peer, that access control rules can refer
+// to.
+func (ss *sourceSink) SetPeerTags(publicKey transport.NoisePublicKey, tags []string) {
+	ss.peersMu.Lock()
+	defer ss.peersMu.Unlock()
+
+	if len(tags) == 0 {
+		delete(ss.peerTags, publicKey)
+	} else {
+		ss.peerTags[publicKey] = slices.Clone(tags)
+	}
+
+	ss.resolveACLLocked()
+}
+
+// resolveACLLocked re-indexes the acl after peers have changed.
+// Must hold ss.peersMu.
+func (ss *sourceSink) resolveACLLocked() {
+	if a := ss.acl.Load(); a != nil {
+		ss.acl.Store(a.resolve(ss.peerNames, ss.peerTags))
+	}
+}
+
+// allowInbound reports whether a packet received from a peer is permitted.
+func (ss *sourceSink) allowInbound(a *acl, publicKey transport.NoisePublicKey, protoNumber tcpip.NetworkProtocolNumber, pkt []byte) bool {
+	src, protocol, payload, ok := parseACLPacket(protoNumber, pkt)
+	if !ok {
+		return false
+	}
+
+	// Only the first fragment carries the transport header, without which the
+	// remaining fragments can't be reassembled.
+	if payload == nil {
+		return true
+	}
+
+	var port uint16
+	switch protocol {
+	case uint8(header.TCPProtocolNumber):
+		if len(payload) < header.TCPMinimumSize {
+			return false
+		}
+
+		tcpHdr := header.TCP(payload)
+
+		// Only connection attempts are subject to the acl, the stack will reset
+		// any segments that don't belong to a permitted connection.
+		if tcpHdr.Flags()&(header.TCPFlagSyn|header.TCPFlagAck) != header.TCPFlagSyn {
+			return true
+		}
+
+		port = tcpHdr.DestinationPort()
+	case uint8(header.UDPProtocolNumber):
+		if len(payload) < header.UDPMinimumSize {
+			return false
+		}
+
+		udpHdr := header.UDP(payload)
+		port = udpHdr.DestinationPort()
+
+		if ss.isUDPReply(udpFlow{
+			publicKey: publicKey,
+			localPort: port,
+			remote:    netip.AddrPortFrom(src, udpHdr.SourcePort()),
+		}) {
+			return true
+		}
+	case uint8(header.ICMPv4ProtocolNumber):
+		// Errors and replies are permitted, only requests are subject to the acl.
+		if len(payload) < header.ICMPv4MinimumSize || header.ICMPv4(payload).Type() != header.ICMPv4Echo {
+			return true
+		}
+	case uint8(header.ICMPv6ProtocolNumber):
+		if len(payload) < header.ICMPv6MinimumSize || header.ICMPv6(payload).Type() != header.ICMPv6EchoRequest {
+			return true
+		}
+	}
+
+	return a.allowed(publicKey, aclInbound, protocol, port)
+}
+
+// trackOutbound records outbound UDP flows so that replies will be permitted.
+func (ss *sourceSink) trackOutbound(publicKey transport.NoisePublicKey, protoNumber tcpip.NetworkProtocolNumber, pkt []byte) {
+	_, protocol, payload, ok := parseACLPacket(protoNumber, pkt)
+	if !ok || protocol != uint8(header.UDPProtocolNumber) || len(payload) < header.UDPMinimumSize {
+		return
+	}
+
+	var dst netip.Addr
+	if protoNumber == header.IPv4ProtocolNumber {
+		dst = netip.AddrFrom4(header.IPv4(pkt).DestinationAddress().As4())
+	} else {
+		dst = netip.AddrFrom16(header.IPv6(pkt).DestinationAddress().As16())
+	}
+
+	udpHdr := header.UDP(payload)
+	flow := udpFlow{
+		publicKey: publicKey,
+		localPort: udpHdr.SourcePort(),
+		remote:    netip.AddrPortFrom(dst, udpHdr.DestinationPort()),
+	}
+
+	now := time.Now()
+
+	ss.udpFlowsMu.Lock()
+	defer ss.udpFlowsMu.Unlock()
+
+	if _, ok := ss.udpFlows[flow]; !ok && len(ss.udpFlows) >= aclMaxUDPFlows {
+		for f, lastSeen := range ss.udpFlows {
+			if now.Sub(lastSeen) > aclUDPFlowTimeout {
+				delete(ss.udpFlows, f)
+			}
+		}
+	}
+
+	ss.udpFlows[flow] = now
+}
+
+func (ss *sourceSink) isUDPReply(flow udpFlow) bool {
+	ss.udpFlowsMu.Lock()
+	defer ss.udpFlowsMu.Unlock()
+
+	lastSeen, ok := ss.udpFlows[flow]
+	return ok && time.Since(lastSeen) <= aclUDPFlowTimeout
+}
+
+// allowDial reports whether a dial to the given address is permitted.
+func (n *noisyNet) allowDial(addr netip.AddrPort, isUDP bool) bool {
+	a := n.acl.Load()
+	if a == nil {
+		return true
+	}
+
+	n.peersMu.RLock()
+	publicKey, ok := n.fromPeerAddress.Lookup(addr.Addr())
+	n.peersMu.RUnlock()
+	if !ok {
+		return true
+	}
+
+	protocol := uint8(header.TCPProtocolNumber)
+	if isUDP {
+		protocol = uint8(header.UDPProtocolNumber)
+	}
+
+	return a.allowed(publicKey, aclOutbound, protocol, addr.Port())
+}
+
+// parseACLPacket extracts the source address, transport protocol, and
+// transport payload of an IP packet. The payload is nil for non-initial
+// fragments.
+func parseACLPacket(protoNumber tcpip.NetworkProtocolNumber, pkt []byte) (netip.Addr, uint8, []byte, bool) {
+	switch protoNumber {
+	case header.IPv4ProtocolNumber:
+		hdr := header.IPv4(pkt)
+		if !hdr.IsValid(len(pkt)) {
+			return netip.Addr{}, 0, nil, false
+		}
+
+		src := netip.AddrFrom4(hdr.SourceAddress().As4())
+		if hdr.FragmentOffset() != 0 {
+			return src, hdr.Protocol(), nil, true
+		}
+
+		return src, hdr.Protocol(), hdr.Payload(), true
+	case header.IPv6ProtocolNumber:
+		hdr := header.IPv6(pkt)
+		if !hdr.IsValid(len(pkt)) {
+			return netip.Addr{}, 0, nil, false
+		}
+
+		src := netip.AddrFrom16(hdr.SourceAddress().As16())
+		protocol, payload := hdr.NextHeader(), hdr.Payload()
+
+		if protocol == uint8(header.IPv6FragmentHeader) {
+			if len(payload) < header.IPv6FragmentHeaderSize {
+				return netip.Addr{}, 0, nil, false
+			}
+
+			fragHdr := header.IPv6Fragment(payload)
+			if fragHdr.FragmentOffset() != 0 {
+				return src, fragHdr.NextHeader(), nil, true
+			}
+
+			return src, fragHdr.NextHeader(), payload[header.IPv6FragmentHeaderSize:], true
+		}
+
+		return src, protocol, payload, true
+	default:
+		return netip.Addr{}, 0, nil, false
+	}
+}
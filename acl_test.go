@@ -0,0 +1,188 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+func TestACL_ParseRules(t *testing.T) {
+	for _, rule := range []v1alpha1.ACLRuleConfig{
+		{Action: "maybe", Peer: "*"},
+		{Action: "allow"},
+		{Action: "allow", Peer: "*", Direction: "sideways"},
+		{Action: "allow", Peer: "*", Protocol: "sctp"},
+		{Action: "allow", Peer: "*", Protocol: "icmp", Ports: "80"},
+		{Action: "allow", Peer: "*", Ports: "0"},
+		{Action: "allow", Peer: "*", Ports: "9000-8000"},
+		{Action: "allow", Peer: "*", Ports: "http"},
+		{Action: "allow", Peer: "tag:"},
+	} {
+		_, err := newACL([]v1alpha1.ACLRuleConfig{rule})
+		require.Error(t, err, rule)
+	}
+
+	a, err := newACL([]v1alpha1.ACLRuleConfig{
+		{Action: "allow", Peer: "*", Protocol: "tcp", Ports: "8000-8999"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint16(8000), a.rules[0].firstPort)
+	require.Equal(t, uint16(8999), a.rules[0].lastPort)
+}
+
+func TestACL_Tags(t *testing.T) {
+	dbPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+	dbPublicKey := dbPrivateKey.PublicKey()
+
+	webPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+	webPublicKey := webPrivateKey.PublicKey()
+
+	adminPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+	adminPublicKey := adminPrivateKey.PublicKey()
+
+	a, err := newACL([]v1alpha1.ACLRuleConfig{
+		{Action: "allow", Peer: "admin", Direction: "inbound"},
+		{Action: "allow", Peer: "tag:role=web", Direction: "inbound", Protocol: "tcp", Ports: "5432"},
+		{Action: "deny", Peer: "tag:env=prod", Direction: "inbound"},
+	})
+	require.NoError(t, err)
+
+	peerNames := map[string]transport.NoisePublicKey{
+		"db":    dbPublicKey,
+		"web":   webPublicKey,
+		"admin": adminPublicKey,
+	}
+	peerTags := map[transport.NoisePublicKey][]string{
+		dbPublicKey:    {"role=db", "env=prod"},
+		webPublicKey:   {"role=web", "env=prod"},
+		adminPublicKey: {"env=prod"},
+	}
+
+	resolved := a.resolve(peerNames, peerTags)
+
+	tcp := uint8(header.TCPProtocolNumber)
+	require.False(t, resolved.allowed(dbPublicKey, aclInbound, tcp, 5432))
+	require.True(t, resolved.allowed(dbPublicKey, aclOutbound, tcp, 5432))
+	require.True(t, resolved.allowed(webPublicKey, aclInbound, tcp, 5432))
+	require.False(t, resolved.allowed(webPublicKey, aclInbound, tcp, 22))
+	// Earlier rules for an individual peer take precedence over later tag rules.
+	require.True(t, resolved.allowed(adminPublicKey, aclInbound, tcp, 22))
+
+	// Peers without tags aren't affected by tag rules.
+	delete(peerTags, dbPublicKey)
+	resolved = a.resolve(peerNames, peerTags)
+	require.True(t, resolved.allowed(dbPublicKey, aclInbound, tcp, 5432))
+}
+
+func TestSourceSink_ACL(t *testing.T) {
+	localAddr := netip.MustParseAddr("10.7.0.1")
+	runnerAddr := netip.MustParseAddr("10.7.0.2")
+	otherAddr := netip.MustParseAddr("10.7.0.3")
+	lateAddr := netip.MustParseAddr("10.7.0.4")
+
+	ss, n := newTestSourceSink(t, []netip.Addr{localAddr})
+
+	runnerPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+	runnerPublicKey := runnerPrivateKey.PublicKey()
+
+	otherPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+	otherPublicKey := otherPrivateKey.PublicKey()
+
+	latePrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+	latePublicKey := latePrivateKey.PublicKey()
+
+	require.NoError(t, ss.AddPeer("ci-runner", runnerPublicKey, []netip.Prefix{netip.PrefixFrom(runnerAddr, runnerAddr.BitLen())}))
+	require.NoError(t, ss.AddPeer("other", otherPublicKey, []netip.Prefix{netip.PrefixFrom(otherAddr, otherAddr.BitLen())}))
+
+	require.NoError(t, ss.SetACL([]v1alpha1.ACLRuleConfig{
+		{Action: "allow", Peer: "ci-runner", Direction: "inbound", Protocol: "tcp", Ports: "443"},
+		{Action: "deny", Peer: "ci-runner", Direction: "inbound"},
+		{Action: "deny", Peer: "other", Direction: "outbound", Protocol: "tcp", Ports: "22"},
+		{Action: "deny", Peer: "late", Protocol: "tcp"},
+	}))
+
+	// Packets are addressed to an address we don't own, so the stack silently drops
+	// any packets that are permitted.
+	dst := netip.MustParseAddr("10.7.0.99")
+
+	allowed := func(src netip.Addr, publicKey transport.NoisePublicKey, protocol tcpip.TransportProtocolNumber, payload []byte) bool {
+		dropped := ss.writeDropped.Load()
+
+		pkt := newIPv4Packet(tcpip.AddrFrom4(src.As4()), tcpip.AddrFrom4(dst.As4()), protocol, payload)
+		_, err := ss.Write([][]byte{pkt}, []transport.NoisePublicKey{publicKey}, 0)
+		require.NoError(t, err)
+
+		return ss.writeDropped.Load() == dropped
+	}
+
+	require.True(t, allowed(runnerAddr, runnerPublicKey, header.TCPProtocolNumber, newTCPSegment(40000, 443, header.TCPFlagSyn)))
+	require.False(t, allowed(runnerAddr, runnerPublicKey, header.TCPProtocolNumber, newTCPSegment(40000, 22, header.TCPFlagSyn)))
+	// Segments of an existing connection are always allowed.
+	require.True(t, allowed(runnerAddr, runnerPublicKey, header.TCPProtocolNumber, newTCPSegment(22, 40000, header.TCPFlagSyn|header.TCPFlagAck)))
+	require.True(t, allowed(otherAddr, otherPublicKey, header.TCPProtocolNumber, newTCPSegment(40000, 22, header.TCPFlagSyn)))
+
+	echoRequest := make([]byte, header.ICMPv4MinimumSize)
+	header.ICMPv4(echoRequest).SetType(header.ICMPv4Echo)
+	require.False(t, allowed(runnerAddr, runnerPublicKey, header.ICMPv4ProtocolNumber, echoRequest))
+	require.True(t, allowed(otherAddr, otherPublicKey, header.ICMPv4ProtocolNumber, echoRequest))
+
+	require.False(t, allowed(runnerAddr, runnerPublicKey, header.UDPProtocolNumber, newUDPDatagram(53, 5000)))
+
+	// Replies to an outbound flow are permitted.
+	ss.trackOutbound(runnerPublicKey, header.IPv4ProtocolNumber,
+		newIPv4Packet(tcpip.AddrFrom4(dst.As4()), tcpip.AddrFrom4(runnerAddr.As4()), header.UDPProtocolNumber, newUDPDatagram(5000, 53)))
+	require.True(t, allowed(runnerAddr, runnerPublicKey, header.UDPProtocolNumber, newUDPDatagram(53, 5000)))
+
+	// Rules are applied to peers added after the acl.
+	require.NoError(t, ss.AddPeer("late", latePublicKey, []netip.Prefix{netip.PrefixFrom(lateAddr, lateAddr.BitLen())}))
+	require.False(t, allowed(lateAddr, latePublicKey, header.TCPProtocolNumber, newTCPSegment(40000, 80, header.TCPFlagSyn)))
+
+	_, err = n.DialContext(context.Background(), "tcp", "10.7.0.3:22")
+	require.True(t, errors.Is(err, errACLDenied), err)
+
+	// Removing the rules allows everything.
+	require.NoError(t, ss.SetACL(nil))
+	require.True(t, allowed(runnerAddr, runnerPublicKey, header.TCPProtocolNumber, newTCPSegment(40000, 22, header.TCPFlagSyn)))
+}
+
+func newTCPSegment(srcPort, dstPort uint16, flags header.TCPFlags) []byte {
+	payload := make([]byte, header.TCPMinimumSize)
+	header.TCP(payload).Encode(&header.TCPFields{
+		SrcPort:    srcPort,
+		DstPort:    dstPort,
+		DataOffset: header.TCPMinimumSize,
+		Flags:      flags,
+		WindowSize: 65535,
+	})
+
+	return payload
+}
+
+func newUDPDatagram(srcPort, dstPort uint16) []byte {
+	payload := make([]byte, header.UDPMinimumSize)
+	header.UDP(payload).Encode(&header.UDPFields{
+		SrcPort: srcPort,
+		DstPort: dstPort,
+		Length:  header.UDPMinimumSize,
+	})
+
+	return payload
+}
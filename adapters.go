@@ -0,0 +1,167 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+var (
+	_ proxy.Dialer        = (*Dialer)(nil)
+	_ proxy.ContextDialer = (*Dialer)(nil)
+	_ Resolver            = (*NetResolver)(nil)
+	_ addrResolver        = (*NetResolver)(nil)
+	_ srvResolver         = (*NetResolver)(nil)
+	_ txtResolver         = (*NetResolver)(nil)
+)
+
+// Dialer returns a dialer that connects through the mesh, for code written
+// against proxy.Dialer or proxy.ContextDialer (of golang.org/x/net/proxy), or
+// that takes a DialContext function (eg. http.Transport).
+func (n *noisyNet) Dialer() *Dialer {
+	return &Dialer{n: n}
+}
+
+// Dialer connects to addresses through the mesh. Its Dial and DialContext
+// methods have the same signatures as those of net.Dialer.
+type Dialer struct {
+	// Timeout is the maximum amount of time a dial will wait for a connection
+	// to be established, including name resolution. Zero means no timeout.
+	Timeout time.Duration
+
+	n *noisyNet
+}
+
+// Dial connects to an address through the mesh.
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext is like Dial, but allows the dial to be cancelled.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+
+	return d.n.DialContext(ctx, network, address)
+}
+
+// NetResolver returns a resolver, with the lookup methods of *net.Resolver, that
+// resolves the names of the local node and peers (falling back to the socket's
+// resolver for other names). Code written against an interface satisfied by
+// net.DefaultResolver can use it instead to resolve names on the mesh.
+func (n *noisyNet) NetResolver() *NetResolver {
+	return &NetResolver{n: n}
+}
+
+// NetResolver resolves names, and addresses, as the socket does. Its methods
+// have the same signatures as those of *net.Resolver.
+type NetResolver struct {
+	n *noisyNet
+}
+
+// LookupHost returns the addresses of a host.
+func (r *NetResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return r.n.LookupHostContext(ctx, host)
+}
+
+// LookupNetIP returns the addresses of a host, network is "ip", "ip4" or "ip6",
+// and filters the addresses to those of the family.
+func (r *NetResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	var acceptV4, acceptV6 bool
+	switch network {
+	case "ip":
+		acceptV4, acceptV6 = true, true
+	case "ip4":
+		acceptV4 = true
+	case "ip6":
+		acceptV6 = true
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+
+	hostAddrs, err := r.n.LookupHostContext(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []netip.Addr
+	for _, hostAddr := range hostAddrs {
+		addr, err := netip.ParseAddr(hostAddr)
+		if err != nil {
+			continue
+		}
+		addr = addr.Unmap()
+
+		if (addr.Is4() && acceptV4) || (addr.Is6() && acceptV6) {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no suitable address found", Name: host, IsNotFound: true}
+	}
+
+	return addrs, nil
+}
+
+// LookupIP is like LookupNetIP, but returns net.IPs.
+func (r *NetResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	addrs, err := r.LookupNetIP(ctx, network, host)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.AsSlice())
+	}
+
+	return ips, nil
+}
+
+// LookupIPAddr is like LookupNetIP (of any family), but returns net.IPAddrs.
+func (r *NetResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, err := r.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+
+	ipAddrs := make([]net.IPAddr, 0, len(addrs))
+	for _, addr := range addrs {
+		ipAddrs = append(ipAddrs, net.IPAddr{IP: addr.AsSlice(), Zone: addr.Zone()})
+	}
+
+	return ipAddrs, nil
+}
+
+// LookupAddr returns the names of an address.
+func (r *NetResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return r.n.LookupAddrContext(ctx, addr)
+}
+
+// LookupSRV returns the SRV records of a service.
+func (r *NetResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	return r.n.LookupSRVContext(ctx, service, proto, name)
+}
+
+// LookupTXT returns the TXT records of a name.
+func (r *NetResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return r.n.LookupTXTContext(ctx, name)
+}
+
+// LookupPort returns the port of a service (eg. "https"). Ports are local
+// knowledge, so are looked up as net.DefaultResolver does.
+func (r *NetResolver) LookupPort(ctx context.Context, network, service string) (int, error) {
+	return net.DefaultResolver.LookupPort(ctx, network, service)
+}
@@ -0,0 +1,136 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+)
+
+func TestNoisySocket_Adapters(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverSocket, clientSocket, err := noisysockets.Pipe(logger, &v1alpha1.Config{
+		Name:       "server",
+		PrivateKey: serverPrivateKey.String(),
+		IPs:        []string{"10.7.0.1", "fd00::1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{{
+			Name:      "client",
+			PublicKey: clientPrivateKey.PublicKey().String(),
+			IPs:       []string{"10.7.0.2"},
+		}},
+	}, &v1alpha1.Config{
+		Name:       "client",
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{{
+			Name:      "server",
+			PublicKey: serverPrivateKey.PublicKey().String(),
+			IPs:       []string{"10.7.0.1", "fd00::1"},
+		}},
+	}, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+		require.NoError(t, clientSocket.Close())
+	})
+
+	t.Run("Dialer", func(t *testing.T) {
+		lis, err := serverSocket.Listen("tcp", "10.7.0.1:80")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = lis.Close()
+		})
+
+		go func() {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			_, _ = conn.Write([]byte("Hello, client!"))
+		}()
+
+		var dialer proxy.ContextDialer = clientSocket.Dialer()
+
+		conn, err := dialer.DialContext(context.Background(), "tcp", "server:80")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+
+		buf, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		require.Equal(t, "Hello, client!", string(buf))
+	})
+
+	t.Run("Resolver", func(t *testing.T) {
+		// The lookup methods used by third-party code, that net.DefaultResolver has.
+		type netResolver interface {
+			LookupHost(ctx context.Context, host string) ([]string, error)
+			LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+			LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+			LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+			LookupAddr(ctx context.Context, addr string) ([]string, error)
+			LookupPort(ctx context.Context, network, service string) (int, error)
+		}
+
+		var _ netResolver = net.DefaultResolver
+		var resolver netResolver = clientSocket.NetResolver()
+
+		ctx := context.Background()
+
+		addrs, err := resolver.LookupHost(ctx, "server")
+		require.NoError(t, err)
+		require.Equal(t, []string{"10.7.0.1", "fd00::1"}, addrs)
+
+		ips, err := resolver.LookupIP(ctx, "ip4", "server")
+		require.NoError(t, err)
+		require.Len(t, ips, 1)
+		require.True(t, ips[0].Equal(net.ParseIP("10.7.0.1")))
+
+		netIPs, err := resolver.LookupNetIP(ctx, "ip6", "server")
+		require.NoError(t, err)
+		require.Equal(t, []netip.Addr{netip.MustParseAddr("fd00::1")}, netIPs)
+
+		ipAddrs, err := resolver.LookupIPAddr(ctx, "server")
+		require.NoError(t, err)
+		require.Len(t, ipAddrs, 2)
+
+		_, err = resolver.LookupNetIP(ctx, "ip6", "client")
+		var dnsErr *net.DNSError
+		require.ErrorAs(t, err, &dnsErr)
+		require.True(t, dnsErr.IsNotFound)
+
+		_, err = resolver.LookupNetIP(ctx, "tcp", "server")
+		require.Error(t, err)
+
+		names, err := resolver.LookupAddr(ctx, "10.7.0.1")
+		require.NoError(t, err)
+		require.Equal(t, []string{"server"}, names)
+
+		port, err := resolver.LookupPort(ctx, "tcp", "8080")
+		require.NoError(t, err)
+		require.Equal(t, 8080, port)
+	})
+}
@@ -0,0 +1,138 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+// addressConflicts is how the prefixes of a peer, that conflict with those of
+// another peer, are handled.
+type addressConflicts int
+
+const (
+	// addressConflictsReject rejects prefixes already claimed by another peer.
+	// Overlapping prefixes are routed to the most specific.
+	addressConflictsReject addressConflicts = iota
+	// addressConflictsStrict also rejects prefixes that overlap those of
+	// another peer, or that contain a local address.
+	addressConflictsStrict
+	// addressConflictsReplace hands prefixes already claimed by another peer
+	// over to the peer that claimed them last.
+	addressConflictsReplace
+)
+
+func parseAddressConflicts(s string) (addressConflicts, error) {
+	switch s {
+	case "", "reject":
+		return addressConflictsReject, nil
+	case "strict":
+		return addressConflictsStrict, nil
+	case "replace":
+		return addressConflictsReplace, nil
+	default:
+		return 0, fmt.Errorf("unsupported address conflicts policy %q", s)
+	}
+}
+
+// prefixOwner returns the peer that owns a prefix, if it is claimed.
+// Must hold ss.peersMu.
+func (ss *sourceSink) prefixOwner(prefix netip.Prefix) (transport.NoisePublicKey, bool) {
+	owner, ok := ss.fromPeerAddress.Get(prefix)
+	if routedOwner, routedVia := ss.viaPrefixes[prefix.Masked()]; routedVia {
+		owner = routedOwner
+	}
+
+	return owner, ok
+}
+
+// checkOverlapLocked returns an error if a prefix overlaps a local address, or
+// the prefixes of another peer. The default route (eg. of a default gateway)
+// overlaps everything, so is allowed.
+// Must hold ss.peersMu.
+func (ss *sourceSink) checkOverlapLocked(name string, publicKey transport.NoisePublicKey, prefix netip.Prefix) error {
+	if prefix.Bits() == 0 {
+		return nil
+	}
+
+	for _, localAddr := range ss.localAddrs.load() {
+		if prefix.Contains(localAddr) {
+			return fmt.Errorf("peer %s prefix %s contains local address %s", ss.peerDisplayName(name, publicKey), prefix, localAddr)
+		}
+	}
+
+	for otherPublicKey, otherPrefixes := range ss.peerPrefixes {
+		if otherPublicKey == publicKey {
+			continue
+		}
+
+		for _, otherPrefix := range otherPrefixes {
+			if otherPrefix.Bits() == 0 || !prefix.Overlaps(otherPrefix) {
+				continue
+			}
+
+			return fmt.Errorf("peer %s prefix %s overlaps prefix %s of peer %s",
+				ss.peerDisplayName(name, publicKey), prefix, otherPrefix, ss.peerDisplayName("", otherPublicKey))
+		}
+	}
+
+	return nil
+}
+
+// takeOverPrefixLocked removes a (masked) prefix from the peer that owns it,
+// so that it can be claimed by another peer. It reports the previous owner, if
+// the prefix was claimed by another peer.
+// Must hold ss.peersMu.
+func (ss *sourceSink) takeOverPrefixLocked(publicKey transport.NoisePublicKey, prefix netip.Prefix) (transport.NoisePublicKey, bool) {
+	owner, ok := ss.prefixOwner(prefix)
+	if !ok || owner == publicKey {
+		return transport.NoisePublicKey{}, false
+	}
+
+	ss.peerPrefixes[owner] = slices.DeleteFunc(ss.peerPrefixes[owner], func(p netip.Prefix) bool {
+		return p == prefix
+	})
+
+	if prefix.IsSingleIP() {
+		ss.peerAddresses[owner] = slices.DeleteFunc(ss.peerAddresses[owner], func(addr netip.Addr) bool {
+			return addr == prefix.Addr()
+		})
+	}
+
+	ss.fromPeerAddress.Delete(prefix)
+	delete(ss.viaPrefixes, prefix)
+
+	// The new owner adds its own route.
+	subnet := prefixToSubnet(prefix)
+	ss.stack.RemoveRoutes(func(r tcpip.Route) bool {
+		return r.Destination == subnet && r.Gateway.Len() == 0
+	})
+
+	return owner, true
+}
+
+// addressTakenOver publishes a prefix of a peer being taken over by another.
+func (s *NoisySocket) addressTakenOver(prefix netip.Prefix, from, to transport.NoisePublicKey) {
+	fromName := s.sourceSink.peerName(from)
+
+	s.logger.Warn("Address taken over by another peer",
+		"address", prefix.String(), "peer", fromName, "publicKey", from.String(),
+		"newPeer", s.sourceSink.peerName(to), "newPublicKey", to.String())
+
+	s.events.publish(Event{
+		Timestamp:     time.Now(),
+		Type:          PeerAddressTakenOver,
+		PeerName:      fromName,
+		PeerPublicKey: from.String(),
+		Address:       prefix.String(),
+	})
+}
@@ -0,0 +1,273 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// CaptureDirection is the direction of a captured packet.
+type CaptureDirection int
+
+const (
+	// CaptureInbound is a packet received from a peer.
+	CaptureInbound CaptureDirection = iota
+	// CaptureOutbound is a packet sent to a peer.
+	CaptureOutbound
+)
+
+func (d CaptureDirection) String() string {
+	switch d {
+	case CaptureInbound:
+		return "inbound"
+	case CaptureOutbound:
+		return "outbound"
+	default:
+		return fmt.Sprintf("CaptureDirection(%d)", int(d))
+	}
+}
+
+// CapturedPacket is a cleartext IP packet exchanged with a peer.
+type CapturedPacket struct {
+	// Timestamp is when the packet was captured.
+	Timestamp time.Time
+	// Direction is whether the packet was sent to, or received from, the peer.
+	Direction CaptureDirection
+	// PeerPublicKey is the encoded public key of the peer.
+	PeerPublicKey string
+	// Data is the raw IP packet, it is only valid for the duration of the callback.
+	Data []byte
+}
+
+// CaptureFilter restricts which packets are captured.
+type CaptureFilter struct {
+	// Peers limits capture to packets exchanged with the given peers, identified
+	// by their names or encoded public keys. If empty, all peers are captured.
+	Peers []string
+	// Protocols limits capture to the given transport protocols, one of "tcp",
+	// "udp", or "icmp" (which includes ICMPv6). If empty, all protocols are captured.
+	Protocols []string
+}
+
+// Capture registers a callback that will be invoked with every cleartext
+// packet, matching the filter, that is exchanged with peers. The callback is
+// invoked synchronously on the data path, so it must be fast and safe for
+// concurrent use. The returned function removes the callback.
+func (s *NoisySocket) Capture(filter CaptureFilter, fn func(pkt CapturedPacket)) (func(), error) {
+	c := &capture{fn: fn}
+
+	if len(filter.Protocols) > 0 {
+		c.protocols = make(map[uint8]struct{})
+		for _, protocol := range filter.Protocols {
+			switch strings.ToLower(protocol) {
+			case "tcp":
+				c.protocols[uint8(header.TCPProtocolNumber)] = struct{}{}
+			case "udp":
+				c.protocols[uint8(header.UDPProtocolNumber)] = struct{}{}
+			case "icmp":
+				c.protocols[uint8(header.ICMPv4ProtocolNumber)] = struct{}{}
+				c.protocols[uint8(header.ICMPv6ProtocolNumber)] = struct{}{}
+			default:
+				return nil, fmt.Errorf("unsupported protocol %q", protocol)
+			}
+		}
+	}
+
+	if len(filter.Peers) > 0 {
+		c.peers = make(map[transport.NoisePublicKey]struct{})
+
+		s.sourceSink.peersMu.RLock()
+		for _, peer := range filter.Peers {
+			pk, ok := s.sourceSink.peerNames[peer]
+			if !ok {
+				if err := pk.FromString(peer); err != nil {
+					s.sourceSink.peersMu.RUnlock()
+					return nil, fmt.Errorf("%w %q", ErrUnknownPeer, peer)
+				}
+			}
+
+			c.peers[pk] = struct{}{}
+		}
+		s.sourceSink.peersMu.RUnlock()
+	}
+
+	s.sourceSink.addCapture(c)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.sourceSink.removeCapture(c)
+		})
+	}, nil
+}
+
+type capture struct {
+	peers     map[transport.NoisePublicKey]struct{}
+	protocols map[uint8]struct{}
+	fn        func(pkt CapturedPacket)
+}
+
+func (c *capture) matches(publicKey transport.NoisePublicKey, pkt []byte) bool {
+	if c.peers != nil {
+		if _, ok := c.peers[publicKey]; !ok {
+			return false
+		}
+	}
+
+	if c.protocols != nil {
+		var protocol uint8
+		switch pkt[0] >> 4 {
+		case 4:
+			if len(pkt) < header.IPv4MinimumSize {
+				return false
+			}
+			protocol = header.IPv4(pkt).Protocol()
+		case 6:
+			if len(pkt) < header.IPv6MinimumSize {
+				return false
+			}
+			protocol = header.IPv6(pkt).NextHeader()
+		default:
+			return false
+		}
+
+		if _, ok := c.protocols[protocol]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (ss *sourceSink) addCapture(c *capture) {
+	ss.capturesMu.Lock()
+	defer ss.capturesMu.Unlock()
+
+	var captures []*capture
+	if existing := ss.captures.Load(); existing != nil {
+		captures = append(captures, *existing...)
+	}
+	captures = append(captures, c)
+
+	ss.captures.Store(&captures)
+}
+
+func (ss *sourceSink) removeCapture(c *capture) {
+	ss.capturesMu.Lock()
+	defer ss.capturesMu.Unlock()
+
+	existing := ss.captures.Load()
+	if existing == nil {
+		return
+	}
+
+	var captures []*capture
+	for _, other := range *existing {
+		if other != c {
+			captures = append(captures, other)
+		}
+	}
+
+	if len(captures) == 0 {
+		ss.captures.Store(nil)
+		return
+	}
+
+	ss.captures.Store(&captures)
+}
+
+// capturePacket passes the packet to any registered captures.
+func (ss *sourceSink) capturePacket(direction CaptureDirection, publicKey transport.NoisePublicKey, pkt []byte) {
+	captures := ss.captures.Load()
+	if captures == nil || len(pkt) == 0 {
+		return
+	}
+
+	var captured *CapturedPacket
+	for _, c := range *captures {
+		if !c.matches(publicKey, pkt) {
+			continue
+		}
+
+		if captured == nil {
+			captured = &CapturedPacket{
+				Timestamp:     time.Now(),
+				Direction:     direction,
+				PeerPublicKey: publicKey.String(),
+				Data:          pkt,
+			}
+		}
+
+		c.fn(*captured)
+	}
+}
+
+const (
+	pcapMagic         = 0xa1b2c3d4
+	pcapVersionMajor  = 2
+	pcapVersionMinor  = 4
+	pcapSnapLen       = 65535
+	pcapLinkTypeRaw   = 101 // Raw IPv4/IPv6 packets, no link layer header.
+	pcapRecordHdrSize = 16
+)
+
+// PcapWriter writes captured packets in the libpcap file format, suitable for
+// analysis with tools such as Wireshark or tcpdump. It is safe for concurrent use.
+type PcapWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewPcapWriter creates a new PcapWriter, writing the file header to w.
+func NewPcapWriter(w io.Writer) (*PcapWriter, error) {
+	var hdr [24]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], pcapMagic)
+	binary.LittleEndian.PutUint16(hdr[4:6], pcapVersionMajor)
+	binary.LittleEndian.PutUint16(hdr[6:8], pcapVersionMinor)
+	binary.LittleEndian.PutUint32(hdr[16:20], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:24], pcapLinkTypeRaw)
+
+	if _, err := w.Write(hdr[:]); err != nil {
+		return nil, fmt.Errorf("could not write pcap header: %w", err)
+	}
+
+	return &PcapWriter{w: w}, nil
+}
+
+// WritePacket writes a captured packet.
+func (pw *PcapWriter) WritePacket(pkt CapturedPacket) error {
+	data := pkt.Data
+	if len(data) > pcapSnapLen {
+		data = data[:pcapSnapLen]
+	}
+
+	var hdr [pcapRecordHdrSize]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], uint32(pkt.Timestamp.Unix()))
+	binary.LittleEndian.PutUint32(hdr[4:8], uint32(pkt.Timestamp.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(hdr[8:12], uint32(len(data)))
+	binary.LittleEndian.PutUint32(hdr[12:16], uint32(len(pkt.Data)))
+
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	if _, err := pw.w.Write(hdr[:]); err != nil {
+		return fmt.Errorf("could not write pcap record header: %w", err)
+	}
+
+	if _, err := pw.w.Write(data); err != nil {
+		return fmt.Errorf("could not write pcap record: %w", err)
+	}
+
+	return nil
+}
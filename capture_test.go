@@ -0,0 +1,96 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+func TestCapture(t *testing.T) {
+	localAddr := netip.MustParseAddr("10.7.0.1")
+	peerAddr := netip.MustParseAddr("10.7.0.2")
+
+	ss, n := newTestSourceSink(t, []netip.Addr{localAddr})
+	s := &NoisySocket{noisyNet: n, sourceSink: ss}
+
+	peerPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	peerPublicKey := peerPrivateKey.PublicKey()
+	require.NoError(t, ss.AddPeer("peer", peerPublicKey, []netip.Prefix{netip.PrefixFrom(peerAddr, peerAddr.BitLen())}))
+
+	_, err = s.Capture(CaptureFilter{Protocols: []string{"sctp"}}, func(pkt CapturedPacket) {})
+	require.ErrorContains(t, err, "unsupported protocol")
+
+	_, err = s.Capture(CaptureFilter{Peers: []string{"unknown"}}, func(pkt CapturedPacket) {})
+	require.ErrorContains(t, err, "unknown peer")
+
+	var mu sync.Mutex
+	var tcpPackets []CapturedPacket
+	stopTCP, err := s.Capture(CaptureFilter{Peers: []string{"peer"}, Protocols: []string{"tcp"}}, func(pkt CapturedPacket) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		pkt.Data = append([]byte(nil), pkt.Data...)
+		tcpPackets = append(tcpPackets, pkt)
+	})
+	require.NoError(t, err)
+	t.Cleanup(stopTCP)
+
+	var pcap bytes.Buffer
+	pw, err := NewPcapWriter(&pcap)
+	require.NoError(t, err)
+
+	stopAll, err := s.Capture(CaptureFilter{}, func(pkt CapturedPacket) {
+		require.NoError(t, pw.WritePacket(pkt))
+	})
+	require.NoError(t, err)
+
+	// Destined for an address we don't own, so the stack silently drops them.
+	otherAddr := tcpip.AddrFrom4(netip.MustParseAddr("10.7.0.99").As4())
+	tcpPkt := newIPv4Packet(tcpip.AddrFrom4(peerAddr.As4()), otherAddr, header.TCPProtocolNumber, make([]byte, header.TCPMinimumSize))
+	udpPkt := newIPv4Packet(tcpip.AddrFrom4(peerAddr.As4()), otherAddr, header.UDPProtocolNumber, make([]byte, header.UDPMinimumSize))
+
+	_, err = ss.Write([][]byte{tcpPkt, udpPkt}, []transport.NoisePublicKey{peerPublicKey, peerPublicKey}, 0)
+	require.NoError(t, err)
+
+	wait := readPacket(ss)
+	writeOutboundPacket(ss, newTestOutboundPacket(localAddr, peerAddr))
+	outboundPkt, _, err := wait(time.Second)
+	require.NoError(t, err)
+
+	mu.Lock()
+	require.Len(t, tcpPackets, 1)
+	require.Equal(t, CaptureInbound, tcpPackets[0].Direction)
+	require.Equal(t, peerPublicKey.String(), tcpPackets[0].PeerPublicKey)
+	require.Equal(t, tcpPkt, tcpPackets[0].Data)
+	mu.Unlock()
+
+	expectedLen := 24
+	for _, pkt := range [][]byte{tcpPkt, udpPkt, outboundPkt} {
+		expectedLen += 16 + len(pkt)
+	}
+	require.Equal(t, expectedLen, pcap.Len())
+	require.Equal(t, uint32(0xa1b2c3d4), binary.LittleEndian.Uint32(pcap.Bytes()[0:4]))
+	require.Equal(t, uint32(101), binary.LittleEndian.Uint32(pcap.Bytes()[20:24]))
+
+	stopAll()
+
+	_, err = ss.Write([][]byte{udpPkt}, []transport.NoisePublicKey{peerPublicKey}, 0)
+	require.NoError(t, err)
+
+	require.Equal(t, expectedLen, pcap.Len())
+}
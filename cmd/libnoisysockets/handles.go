@@ -0,0 +1,158 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config"
+)
+
+// errInvalidHandle is returned when a handle doesn't refer to an open object
+// of the expected type (eg. it has already been closed).
+var errInvalidHandle = errors.New("invalid handle")
+
+var (
+	handlesMu sync.Mutex
+	// handles are the open networks, listeners, and connections.
+	handles    = make(map[int64]io.Closer)
+	nextHandle int64
+)
+
+// Embedding applications shouldn't have their stderr flooded.
+var logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+	Level: slog.LevelWarn,
+}))
+
+func openNetwork(confBytes []byte) (int64, error) {
+	conf, err := config.FromYAMLBytes(confBytes)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse config: %w", err)
+	}
+
+	socket, err := noisysockets.NewNoisySocket(logger, conf)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create noisy socket: %w", err)
+	}
+
+	return newHandle(socket), nil
+}
+
+func dial(h int64, network, address string) (int64, error) {
+	socket, err := lookup[*noisysockets.NoisySocket](h)
+	if err != nil {
+		return 0, err
+	}
+
+	conn, err := socket.DialContext(context.Background(), network, address)
+	if err != nil {
+		return 0, err
+	}
+
+	return newHandle(conn), nil
+}
+
+func listen(h int64, network, address string) (int64, error) {
+	socket, err := lookup[*noisysockets.NoisySocket](h)
+	if err != nil {
+		return 0, err
+	}
+
+	lis, err := socket.Listen(network, address)
+	if err != nil {
+		return 0, err
+	}
+
+	return newHandle(lis), nil
+}
+
+func accept(h int64) (int64, error) {
+	lis, err := lookup[net.Listener](h)
+	if err != nil {
+		return 0, err
+	}
+
+	conn, err := lis.Accept()
+	if err != nil {
+		return 0, err
+	}
+
+	return newHandle(conn), nil
+}
+
+// read reads from a connection, returning 0 at the end of the stream.
+func read(h int64, buf []byte) (int, error) {
+	c, err := lookup[net.Conn](h)
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		n, err := c.Read(buf)
+		if n > 0 || len(buf) == 0 {
+			return n, nil
+		}
+
+		if errors.Is(err, io.EOF) {
+			return 0, nil
+		} else if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func write(h int64, buf []byte) (int, error) {
+	c, err := lookup[net.Conn](h)
+	if err != nil {
+		return 0, err
+	}
+
+	return c.Write(buf)
+}
+
+func closeHandle(h int64) error {
+	handlesMu.Lock()
+	closer, ok := handles[h]
+	delete(handles, h)
+	handlesMu.Unlock()
+
+	if !ok {
+		return errInvalidHandle
+	}
+
+	return closer.Close()
+}
+
+func newHandle(closer io.Closer) int64 {
+	handlesMu.Lock()
+	defer handlesMu.Unlock()
+
+	nextHandle++
+	handles[nextHandle] = closer
+
+	return nextHandle
+}
+
+// lookup returns the object referred to by a handle.
+func lookup[T io.Closer](h int64) (T, error) {
+	handlesMu.Lock()
+	defer handlesMu.Unlock()
+
+	v, ok := handles[h].(T)
+	if !ok {
+		return v, errInvalidHandle
+	}
+
+	return v, nil
+}
@@ -0,0 +1,103 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandles(t *testing.T) {
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	server, err := openNetwork([]byte(fmt.Sprintf(`apiVersion: noisysockets.github.com/v1alpha1
+kind: Config
+name: server
+listenPort: 12429
+privateKey: %s
+ips:
+- 10.7.0.1
+peers:
+- name: client
+  publicKey: %s
+  ips:
+  - 10.7.0.2
+`, serverPrivateKey, clientPrivateKey.PublicKey())))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, closeHandle(server))
+	})
+
+	// JSON is a subset of YAML, so configs can be given in either.
+	client, err := openNetwork([]byte(fmt.Sprintf(`{
+  "apiVersion": "noisysockets.github.com/v1alpha1",
+  "kind": "Config",
+  "name": "client",
+  "listenPort": 12430,
+  "privateKey": %q,
+  "ips": ["10.7.0.2"],
+  "peers": [{"name": "server", "publicKey": %q, "endpoint": "localhost:12429", "ips": ["10.7.0.1"]}]
+}`, clientPrivateKey, serverPrivateKey.PublicKey())))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, closeHandle(client))
+	})
+
+	lis, err := listen(server, "tcp", ":8080")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, closeHandle(lis))
+	})
+
+	// Handles are checked against the type of object they refer to.
+	_, err = dial(lis, "tcp", "server:8080")
+	require.ErrorIs(t, err, errInvalidHandle)
+
+	accepted := make(chan int64, 1)
+	go func() {
+		conn, err := accept(lis)
+		if err != nil {
+			t.Log(err)
+		}
+		accepted <- conn
+	}()
+
+	conn, err := dial(client, "tcp", "server:8080")
+	require.NoError(t, err)
+
+	n, err := write(conn, []byte("Hello, world!"))
+	require.NoError(t, err)
+	require.Equal(t, len("Hello, world!"), n)
+
+	serverConn := <-accepted
+	require.NotZero(t, serverConn)
+
+	buf := make([]byte, 1024)
+	n, err = read(serverConn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "Hello, world!", string(buf[:n]))
+
+	require.NoError(t, closeHandle(conn))
+
+	// The end of the stream is reported as a zero length read.
+	n, err = read(serverConn, buf)
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	require.NoError(t, closeHandle(serverConn))
+
+	// Closed handles are released.
+	require.ErrorIs(t, closeHandle(serverConn), errInvalidHandle)
+	_, err = write(conn, []byte("Hello, world!"))
+	require.ErrorIs(t, err, errInvalidHandle)
+}
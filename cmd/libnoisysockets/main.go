@@ -0,0 +1,141 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+// Command libnoisysockets is a C shared library, that lets applications written
+// in other languages (eg. Python, Rust, or C++) embed a noisy sockets network
+// without running a sidecar process. To build it (along with its header):
+//
+//	go build -buildmode=c-shared -o libnoisysockets.so ./cmd/libnoisysockets
+//
+// Networks, listeners, and connections are referred to by opaque handles
+// (greater than zero). Functions that can fail take an optional char **err,
+// which on failure is set to a message that must be released with
+// noisysockets_free().
+package main
+
+/*
+#include <stdint.h>
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"unsafe"
+)
+
+func main() {}
+
+// noisysockets_network_open brings up a network from a YAML (or JSON) encoded
+// config. It returns a handle to the network, or 0 on failure.
+//
+//export noisysockets_network_open
+func noisysockets_network_open(config *C.char, err **C.char) C.int64_t {
+	h, openErr := openNetwork([]byte(C.GoString(config)))
+	if openErr != nil {
+		setError(err, openErr)
+		return 0
+	}
+
+	return C.int64_t(h)
+}
+
+// noisysockets_dial connects to an address on the network (eg. "tcp",
+// "server:80"). It returns a handle to the connection, or 0 on failure.
+//
+//export noisysockets_dial
+func noisysockets_dial(net C.int64_t, network, address *C.char, err **C.char) C.int64_t {
+	h, dialErr := dial(int64(net), C.GoString(network), C.GoString(address))
+	if dialErr != nil {
+		setError(err, dialErr)
+		return 0
+	}
+
+	return C.int64_t(h)
+}
+
+// noisysockets_listen listens for connections on an address of the network (eg.
+// "tcp", ":8080"). It returns a handle to the listener, or 0 on failure.
+//
+//export noisysockets_listen
+func noisysockets_listen(net C.int64_t, network, address *C.char, err **C.char) C.int64_t {
+	h, listenErr := listen(int64(net), C.GoString(network), C.GoString(address))
+	if listenErr != nil {
+		setError(err, listenErr)
+		return 0
+	}
+
+	return C.int64_t(h)
+}
+
+// noisysockets_accept waits for the next connection to a listener. It returns a
+// handle to the connection, or 0 on failure.
+//
+//export noisysockets_accept
+func noisysockets_accept(listener C.int64_t, err **C.char) C.int64_t {
+	h, acceptErr := accept(int64(listener))
+	if acceptErr != nil {
+		setError(err, acceptErr)
+		return 0
+	}
+
+	return C.int64_t(h)
+}
+
+// noisysockets_read reads up to size bytes from a connection into buf. It
+// returns the number of bytes read, 0 at the end of the stream, or -1 on
+// failure.
+//
+//export noisysockets_read
+func noisysockets_read(conn C.int64_t, buf unsafe.Pointer, size C.size_t, err **C.char) C.int64_t {
+	n, readErr := read(int64(conn), unsafe.Slice((*byte)(buf), int(size)))
+	if readErr != nil {
+		setError(err, readErr)
+		return -1
+	}
+
+	return C.int64_t(n)
+}
+
+// noisysockets_write writes size bytes from buf to a connection. It returns the
+// number of bytes written, or -1 on failure.
+//
+//export noisysockets_write
+func noisysockets_write(conn C.int64_t, buf unsafe.Pointer, size C.size_t, err **C.char) C.int64_t {
+	n, writeErr := write(int64(conn), unsafe.Slice((*byte)(buf), int(size)))
+	if writeErr != nil {
+		setError(err, writeErr)
+		return -1
+	}
+
+	return C.int64_t(n)
+}
+
+// noisysockets_close closes a network, listener, or connection, and releases its
+// handle. It returns 0, or -1 on failure.
+//
+//export noisysockets_close
+func noisysockets_close(handle C.int64_t, err **C.char) C.int {
+	if closeErr := closeHandle(int64(handle)); closeErr != nil {
+		setError(err, closeErr)
+		return -1
+	}
+
+	return 0
+}
+
+// noisysockets_free releases memory allocated by the library (eg. an error
+// message).
+//
+//export noisysockets_free
+func noisysockets_free(p unsafe.Pointer) {
+	C.free(p)
+}
+
+// setError sets the caller's error message, if they asked for one.
+func setError(dst **C.char, err error) {
+	if dst != nil {
+		*dst = C.CString(err.Error())
+	}
+}
@@ -0,0 +1,313 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config"
+	"github.com/noisysockets/noisysockets/portforward"
+	"github.com/noisysockets/noisysockets/proxy"
+)
+
+// shutdownTimeout is how long to wait for connections (eg. forwarded ones) to
+// finish when the network is brought down.
+const shutdownTimeout = 10 * time.Second
+
+type daemonOptions struct {
+	configPath      string
+	controlSocket   string
+	socks5Address   string
+	httpProxy       string
+	localForwards   []string
+	reverseForwards []string
+	hostsFile       string
+	proxyProtocol   bool
+}
+
+// runDaemon brings the network up, along with any proxies and forwards, and
+// runs until it is brought down (or interrupted).
+func runDaemon(logger *slog.Logger, opts daemonOptions) error {
+	conf, err := config.FromYAML(opts.configPath)
+	if err != nil {
+		return fmt.Errorf("failed to read config: %w", err)
+	}
+
+	controlLis, err := listenControlSocket(opts.controlSocket)
+	if err != nil {
+		return err
+	}
+	defer controlLis.Close()
+
+	socket, err := noisysockets.NewNoisySocket(logger, conf)
+	if err != nil {
+		return fmt.Errorf("failed to create noisy socket: %w", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		if err := socket.Shutdown(ctx); err != nil {
+			logger.Warn("Failed to shut down network gracefully", "error", err)
+		}
+	}()
+
+	// Closed when the network is brought down via the control socket.
+	down := make(chan struct{})
+
+	var mux http.ServeMux
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(socket.PeerStatuses()); err != nil {
+			logger.Warn("Failed to write status", "error", err)
+		}
+	})
+	mux.HandleFunc("/connections", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(socket.Connections()); err != nil {
+			logger.Warn("Failed to write connections", "error", err)
+		}
+	})
+	mux.HandleFunc("/down", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		select {
+		case <-down:
+		default:
+			close(down)
+		}
+	})
+
+	controlSrv := &http.Server{Handler: &mux}
+	go func() {
+		if err := controlSrv.Serve(controlLis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Failed to serve control socket", "error", err)
+		}
+	}()
+	defer controlSrv.Close()
+
+	if opts.socks5Address != "" {
+		socks5Srv := proxy.NewSOCKS5Server(logger, socket)
+
+		lis, err := net.Listen("tcp", opts.socks5Address)
+		if err != nil {
+			return fmt.Errorf("failed to listen for SOCKS5 connections: %w", err)
+		}
+
+		go func() {
+			if err := socks5Srv.Serve(lis); err != nil && !errors.Is(err, net.ErrClosed) {
+				logger.Error("Failed to serve SOCKS5 proxy", "error", err)
+			}
+		}()
+		defer socks5Srv.Close()
+
+		logger.Info("Serving SOCKS5 proxy", "address", lis.Addr())
+	}
+
+	if opts.httpProxy != "" {
+		lis, err := net.Listen("tcp", opts.httpProxy)
+		if err != nil {
+			return fmt.Errorf("failed to listen for HTTP proxy connections: %w", err)
+		}
+
+		httpProxySrv := &http.Server{Handler: proxy.NewHTTPConnectHandler(logger, socket, nil)}
+		go func() {
+			if err := httpProxySrv.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("Failed to serve HTTP proxy", "error", err)
+			}
+		}()
+		defer httpProxySrv.Close()
+
+		logger.Info("Serving HTTP proxy", "address", lis.Addr())
+	}
+
+	if opts.hostsFile != "" {
+		stopHostsSync, err := socket.SyncHostsFile(opts.hostsFile)
+		if err != nil {
+			return fmt.Errorf("failed to sync hosts file: %w", err)
+		}
+		defer stopHostsSync()
+	}
+
+	forwards := portforward.NewManager(logger, socket)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		if err := forwards.Shutdown(ctx); err != nil {
+			logger.Warn("Failed to shut down forwards", "error", err)
+		}
+	}()
+
+	for direction, specs := range map[portforward.Direction][]string{
+		portforward.Local:   opts.localForwards,
+		portforward.Reverse: opts.reverseForwards,
+	} {
+		for i, spec := range specs {
+			listenAddress, targetAddress, err := parseForward(spec)
+			if err != nil {
+				return err
+			}
+
+			addr, err := forwards.Add(portforward.Config{
+				Name:          direction.String() + "-" + strconv.Itoa(i),
+				Direction:     direction,
+				ListenAddress: listenAddress,
+				TargetAddress: targetAddress,
+				ProxyProtocol: opts.proxyProtocol,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to add forward %q: %w", spec, err)
+			}
+
+			logger.Info("Forwarding", "direction", direction, "address", addr, "target", targetAddress)
+		}
+	}
+
+	logger.Info("Network is up", "name", conf.Name, "controlSocket", opts.controlSocket)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGHUP, os.Interrupt)
+	defer signal.Stop(sig)
+
+	// When run by systemd, report once the network is up (so that dependent
+	// units can use it), and while it is being reloaded or brought down.
+	notifier := newSDNotifier()
+	if err := notifier.notify(sdNotifyReady); err != nil {
+		logger.Warn("Failed to notify systemd", "error", err)
+	}
+	defer func() {
+		if err := notifier.notify(sdNotifyStopping); err != nil {
+			logger.Warn("Failed to notify systemd", "error", err)
+		}
+	}()
+
+	var watchdog <-chan time.Time
+	if interval := notifier.watchdogInterval(); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		watchdog = ticker.C
+	}
+
+	for {
+		select {
+		case <-down:
+			logger.Info("Bringing network down")
+			return nil
+		case <-watchdog:
+			if err := notifier.notify(sdNotifyWatchdog); err != nil {
+				logger.Warn("Failed to notify systemd", "error", err)
+			}
+		case s := <-sig:
+			if s != syscall.SIGHUP {
+				logger.Info("Received signal, bringing network down", "signal", s)
+				return nil
+			}
+
+			if err := notifier.reloading(); err != nil {
+				logger.Warn("Failed to notify systemd", "error", err)
+			}
+
+			reloadConfig(logger, socket, opts.configPath)
+
+			if err := notifier.notify(sdNotifyReady); err != nil {
+				logger.Warn("Failed to notify systemd", "error", err)
+			}
+		}
+	}
+}
+
+// reloadConfig rereads the configuration file, and applies it to the running
+// network. A configuration that can't be read, or applied, is logged and the
+// network carries on with its current configuration.
+func reloadConfig(logger *slog.Logger, socket *noisysockets.NoisySocket, configPath string) {
+	logger.Info("Reloading configuration", "path", configPath)
+
+	conf, err := config.FromYAML(configPath)
+	if err != nil {
+		logger.Error("Failed to read config", "error", err)
+		return
+	}
+
+	if err := socket.Reload(conf); err != nil {
+		logger.Error("Failed to reload config", "error", err)
+		return
+	}
+
+	logger.Info("Reloaded configuration")
+}
+
+// listenControlSocket listens on the control socket, replacing the socket of
+// a network that is no longer running (eg. because it crashed).
+func listenControlSocket(path string) (net.Listener, error) {
+	if conn, err := net.Dial("unix", path); err == nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("a network is already running (control socket %s is in use)", path)
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to remove stale control socket: %w", err)
+	}
+
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on control socket: %w", err)
+	}
+
+	// Only the user running the network can control it.
+	if err := os.Chmod(path, 0o600); err != nil {
+		_ = lis.Close()
+		return nil, fmt.Errorf("failed to set permissions of control socket: %w", err)
+	}
+
+	return lis, nil
+}
+
+// controlRequest makes a request to a running network over its control socket.
+func controlRequest(path, method, endpoint string) (*http.Response, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+		Timeout: 10 * time.Second,
+	}
+
+	req, err := http.NewRequest(method, "http://noisysockets"+endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to network (is it up?): %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,72 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+
+	"github.com/noisysockets/noisysockets/portforward"
+)
+
+// runForward forwards connections between the host and the mesh, until
+// interrupted (much like `kubectl port-forward`).
+func runForward(logger *slog.Logger, configPath string, direction portforward.Direction, listenAddress, targetAddress string, proxyProtocol bool) error {
+	socket, err := newSocket(logger, configPath)
+	if err != nil {
+		return err
+	}
+	defer socket.Close()
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	forwards := portforward.NewManager(logger, socket)
+
+	addr, err := forwards.Add(portforward.Config{
+		Name:          "forward",
+		Direction:     direction,
+		ListenAddress: forwardListenAddress(direction, listenAddress),
+		TargetAddress: targetAddress,
+		ProxyProtocol: proxyProtocol,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add forward: %w", err)
+	}
+
+	logger.Info("Forwarding", "direction", direction, "address", addr, "target", targetAddress)
+
+	<-ctx.Done()
+
+	stats, err := forwards.Stats("forward")
+	if err == nil {
+		logger.Info("Stopped forwarding", "connections", stats.Connections,
+			"bytesSent", stats.BytesSent, "bytesReceived", stats.BytesReceived)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	return forwards.Shutdown(shutdownCtx)
+}
+
+// forwardListenAddress expands a bare port into a listen address. Local
+// forwards only listen on the host's loopback interface, unless an address is
+// given, reverse forwards listen on all of the socket's addresses.
+func forwardListenAddress(direction portforward.Direction, listenAddress string) string {
+	if strings.Contains(listenAddress, ":") {
+		return listenAddress
+	}
+
+	if direction == portforward.Local {
+		return net.JoinHostPort("127.0.0.1", listenAddress)
+	}
+
+	return net.JoinHostPort("", listenAddress)
+}
@@ -0,0 +1,381 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+// Command noisysockets brings a noisy sockets network up (or down) from a
+// configuration file, so that the mesh can be used without writing any Go.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/portforward"
+	"github.com/urfave/cli/v2"
+)
+
+func main() {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	sharedFlags := []cli.Flag{
+		&cli.GenericFlag{
+			Name:    "log-level",
+			Aliases: []string{"l"},
+			Usage:   "Set the log level",
+			Value:   fromLogLevel(slog.LevelInfo),
+		},
+		&cli.StringFlag{
+			Name:    "control-socket",
+			Aliases: []string{"s"},
+			Usage:   "The unix socket used to control a running network",
+			Value:   filepath.Join(os.TempDir(), "noisysockets.sock"),
+		},
+	}
+
+	configFlag := &cli.StringFlag{
+		Name:    "config",
+		Aliases: []string{"c"},
+		Usage:   "The configuration file to use",
+		Value:   "noisysockets.yaml",
+	}
+
+	proxyProtocolFlag := &cli.BoolFlag{
+		Name:  "proxy-protocol",
+		Usage: "Send a PROXY protocol v2 header, with the original source address (and peer), to the targets of forwards",
+	}
+
+	before := func(c *cli.Context) error {
+		logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+			Level: (*slog.Level)(c.Generic("log-level").(*logLevelFlag)),
+		}))
+
+		return nil
+	}
+
+	app := &cli.App{
+		Name:  "noisysockets",
+		Usage: "Bring a Noisy Sockets network up, or down, from a configuration file",
+		Commands: []*cli.Command{
+			{
+				Name:  "up",
+				Usage: "Bring the network up, running until it is brought down (or interrupted)",
+				Description: "The configuration file is reloaded on SIGHUP, peers are added, removed,\n" +
+					"and updated without interrupting connections to the others. When run as a\n" +
+					"systemd service (Type=notify-reload), readiness, reloads, and watchdog pings\n" +
+					"are reported to systemd.",
+				Flags: append([]cli.Flag{
+					configFlag,
+					&cli.StringFlag{
+						Name:  "socks5",
+						Usage: "Serve a SOCKS5 proxy into the network on the given host address, eg. 127.0.0.1:1080",
+					},
+					&cli.StringFlag{
+						Name:  "http-proxy",
+						Usage: "Serve an HTTP CONNECT proxy into the network on the given host address, eg. 127.0.0.1:3128",
+					},
+					&cli.StringSliceFlag{
+						Name:  "local-forward",
+						Usage: "Forward connections from the host to the network, eg. 127.0.0.1:8080=web:80",
+					},
+					&cli.StringSliceFlag{
+						Name:  "reverse-forward",
+						Usage: "Forward connections from the network to the host, eg. :2222=127.0.0.1:22",
+					},
+					&cli.StringFlag{
+						Name:  "hosts-file",
+						Usage: "Keep the names of peers in the given hosts file, eg. /etc/hosts",
+					},
+					proxyProtocolFlag,
+				}, sharedFlags...),
+				Before: before,
+				Action: func(c *cli.Context) error {
+					opts := daemonOptions{
+						configPath:      c.String("config"),
+						controlSocket:   c.String("control-socket"),
+						socks5Address:   c.String("socks5"),
+						httpProxy:       c.String("http-proxy"),
+						localForwards:   c.StringSlice("local-forward"),
+						reverseForwards: c.StringSlice("reverse-forward"),
+						hostsFile:       c.String("hosts-file"),
+						proxyProtocol:   c.Bool("proxy-protocol"),
+					}
+
+					return runDaemon(logger, opts)
+				},
+			},
+			{
+				Name:      "nc",
+				Usage:     "Connect to a TCP port of a peer, copying stdin to it and its output to stdout",
+				ArgsUsage: "<peer>:<port>",
+				Flags:     append([]cli.Flag{configFlag}, sharedFlags...),
+				Before:    before,
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						return fmt.Errorf("expected a single address, eg. server:80")
+					}
+
+					return runDial(logger, c.String("config"), c.Args().First())
+				},
+			},
+			{
+				Name:      "listen",
+				Usage:     "Accept a TCP connection on a port of the network, copying stdin to it and its output to stdout",
+				ArgsUsage: "<port>",
+				Flags:     append([]cli.Flag{configFlag}, sharedFlags...),
+				Before:    before,
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						return fmt.Errorf("expected a single port, eg. 8080")
+					}
+
+					return runListen(logger, c.String("config"), c.Args().First())
+				},
+			},
+			{
+				Name:  "forward",
+				Usage: "Forward a port between the host and the network, until interrupted",
+				Description: "For example, to reach port 80 of the peer web on localhost:8080:\n\n" +
+					"  noisysockets forward --local 8080 --to web:80\n\n" +
+					"Or to expose the host's SSH server on port 2222 of the network:\n\n" +
+					"  noisysockets forward --reverse 2222 --to 127.0.0.1:22",
+				Flags: append([]cli.Flag{
+					configFlag,
+					&cli.StringFlag{
+						Name:  "local",
+						Usage: "The host port (or address) to accept connections on, forwarding them to the network",
+					},
+					&cli.StringFlag{
+						Name:  "reverse",
+						Usage: "The network port (or address) to accept connections on, forwarding them to the host",
+					},
+					&cli.StringFlag{
+						Name:     "to",
+						Usage:    "The address to forward connections to, eg. web:80",
+						Required: true,
+					},
+					proxyProtocolFlag,
+				}, sharedFlags...),
+				Before: before,
+				Action: func(c *cli.Context) error {
+					direction, listenAddress := portforward.Local, c.String("local")
+					if c.IsSet("reverse") {
+						if c.IsSet("local") {
+							return fmt.Errorf("only one of --local or --reverse can be used")
+						}
+
+						direction, listenAddress = portforward.Reverse, c.String("reverse")
+					} else if listenAddress == "" {
+						return fmt.Errorf("one of --local or --reverse is required")
+					}
+
+					return runForward(logger, c.String("config"), direction, listenAddress, c.String("to"), c.Bool("proxy-protocol"))
+				},
+			},
+			{
+				Name:  "tun",
+				Usage: "Expose the network as a network interface of the host, until interrupted",
+				Description: "Peers are reachable by any program on the host, the prefixes of peers are\n" +
+					"routed via the interface, as are DNS queries for the domain of the network\n" +
+					"(when plain DNS servers are configured). This requires elevated privileges,\n" +
+					"and on Windows, wintun.dll (https://www.wintun.net) alongside the executable.",
+				Flags: append([]cli.Flag{
+					configFlag,
+					&cli.StringFlag{
+						Name:  "name",
+						Usage: "The name of the network interface (chosen by the operating system if empty)",
+					},
+				}, sharedFlags...),
+				Before: before,
+				Action: func(c *cli.Context) error {
+					return runTUN(logger, c.String("config"), c.String("name"))
+				},
+			},
+			{
+				Name:   "down",
+				Usage:  "Bring a running network down",
+				Flags:  sharedFlags,
+				Before: before,
+				Action: func(c *cli.Context) error {
+					resp, err := controlRequest(c.String("control-socket"), "POST", "/down")
+					if err != nil {
+						return err
+					}
+					defer resp.Body.Close()
+
+					logger.Info("Network is going down")
+
+					return nil
+				},
+			},
+			{
+				Name:  "status",
+				Usage: "Show the status of the peers of a running network",
+				Flags: append([]cli.Flag{
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "Output the status as JSON",
+					},
+				}, sharedFlags...),
+				Before: before,
+				Action: func(c *cli.Context) error {
+					resp, err := controlRequest(c.String("control-socket"), "GET", "/status")
+					if err != nil {
+						return err
+					}
+					defer resp.Body.Close()
+
+					if c.Bool("json") {
+						_, err := io.Copy(os.Stdout, resp.Body)
+						return err
+					}
+
+					var statuses []noisysockets.PeerStatus
+					if err := json.NewDecoder(resp.Body).Decode(&statuses); err != nil {
+						return fmt.Errorf("failed to decode status: %w", err)
+					}
+
+					return printStatus(os.Stdout, statuses)
+				},
+			},
+			{
+				Name:  "connections",
+				Usage: "Show the TCP and UDP connections of a running network (much like ss)",
+				Flags: append([]cli.Flag{
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "Output the connections as JSON",
+					},
+				}, sharedFlags...),
+				Before: before,
+				Action: func(c *cli.Context) error {
+					resp, err := controlRequest(c.String("control-socket"), "GET", "/connections")
+					if err != nil {
+						return err
+					}
+					defer resp.Body.Close()
+
+					if c.Bool("json") {
+						_, err := io.Copy(os.Stdout, resp.Body)
+						return err
+					}
+
+					var conns []noisysockets.ConnectionStats
+					if err := json.NewDecoder(resp.Body).Decode(&conns); err != nil {
+						return fmt.Errorf("failed to decode connections: %w", err)
+					}
+
+					return printConnections(os.Stdout, conns)
+				},
+			},
+		},
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		logger.Error("Failed to run app", "error", err)
+		os.Exit(1)
+	}
+}
+
+// printStatus prints a table of peer statuses (much like `wg show`).
+func printStatus(w io.Writer, statuses []noisysockets.PeerStatus) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "NAME\tPUBLIC KEY\tENDPOINT\tALLOWED IPS\tLAST HANDSHAKE\tRX\tTX\tKEEPALIVE\tHEALTH")
+	for _, status := range statuses {
+		name := status.Name
+		if name == "" {
+			name = "-"
+		}
+
+		endpoint := status.Endpoint
+		if endpoint == "" {
+			endpoint = "-"
+		} else if status.Relayed {
+			endpoint += " (relayed)"
+		}
+
+		allowedIPs := "-"
+		if len(status.AllowedIPs) > 0 {
+			prefixes := make([]string, len(status.AllowedIPs))
+			for i, prefix := range status.AllowedIPs {
+				prefixes[i] = prefix.String()
+			}
+			allowedIPs = strings.Join(prefixes, ",")
+		}
+
+		lastHandshake := "never"
+		if !status.LastHandshake.IsZero() {
+			lastHandshake = time.Since(status.LastHandshake).Round(time.Second).String() + " ago"
+		}
+
+		keepalive := "off"
+		if status.PersistentKeepalive > 0 {
+			keepalive = status.PersistentKeepalive.String()
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\t%s\n", name, status.PublicKey, endpoint,
+			allowedIPs, lastHandshake, status.RxBytes, status.TxBytes, keepalive, status.Health)
+	}
+
+	return tw.Flush()
+}
+
+// printConnections prints a table of connections (much like `ss`).
+func printConnections(w io.Writer, conns []noisysockets.ConnectionStats) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "NETWORK\tSTATE\tLOCAL\tREMOTE\tPEER\tRX BYTES\tTX BYTES")
+	for _, conn := range conns {
+		remoteAddr := "*"
+		if conn.RemoteAddr.IsValid() {
+			remoteAddr = conn.RemoteAddr.String()
+		}
+
+		peer := conn.PeerName
+		if peer == "" {
+			peer = conn.PeerPublicKey
+		}
+		if peer == "" {
+			peer = "-"
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%d\n", conn.Network, conn.State, conn.LocalAddr,
+			remoteAddr, peer, conn.BytesReceived, conn.BytesSent)
+	}
+
+	return tw.Flush()
+}
+
+// parseForward parses a forward of the form "listen=target".
+func parseForward(forward string) (listenAddress, targetAddress string, err error) {
+	listenAddress, targetAddress, ok := strings.Cut(forward, "=")
+	if !ok || listenAddress == "" || targetAddress == "" {
+		return "", "", fmt.Errorf("invalid forward %q, expected listen=target", forward)
+	}
+
+	return listenAddress, targetAddress, nil
+}
+
+type logLevelFlag slog.Level
+
+func fromLogLevel(l slog.Level) *logLevelFlag {
+	f := logLevelFlag(l)
+	return &f
+}
+
+func (f *logLevelFlag) Set(value string) error {
+	return (*slog.Level)(f).UnmarshalText([]byte(value))
+}
+
+func (f *logLevelFlag) String() string {
+	return (*slog.Level)(f).String()
+}
@@ -0,0 +1,151 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config"
+)
+
+// lingerTimeout is how long to wait, after a connection is closed, before the
+// socket is closed, so that the final segments (eg. our FIN) have a chance to
+// be delivered.
+const lingerTimeout = 500 * time.Millisecond
+
+// runDial connects to an address on the mesh (eg. "server:80"), and copies
+// stdin to the connection, and the connection to stdout.
+func runDial(logger *slog.Logger, configPath, address string) error {
+	socket, err := newSocket(logger, configPath)
+	if err != nil {
+		return err
+	}
+	defer socket.Close()
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	conn, err := socket.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to dial %s: %w", address, err)
+	}
+	defer closeConn(conn)
+
+	logger.Debug("Connected", "address", conn.RemoteAddr())
+
+	return pipe(ctx, conn, os.Stdin, os.Stdout)
+}
+
+// runListen accepts a single connection on a port of the mesh, and copies
+// stdin to the connection, and the connection to stdout.
+func runListen(logger *slog.Logger, configPath string, port string) error {
+	socket, err := newSocket(logger, configPath)
+	if err != nil {
+		return err
+	}
+	defer socket.Close()
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	lis, err := socket.Listen("tcp", net.JoinHostPort("", port))
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	defer lis.Close()
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = lis.Close()
+	})
+	defer stop()
+
+	logger.Debug("Listening", "address", lis.Addr())
+
+	conn, err := lis.Accept()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return fmt.Errorf("failed to accept connection: %w", err)
+	}
+	defer closeConn(conn)
+
+	logger.Debug("Accepted connection", "address", conn.RemoteAddr())
+
+	return pipe(ctx, conn, os.Stdin, os.Stdout)
+}
+
+func newSocket(logger *slog.Logger, configPath string) (*noisysockets.NoisySocket, error) {
+	conf, err := config.FromYAML(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	socket, err := noisysockets.NewNoisySocket(logger, conf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create noisy socket: %w", err)
+	}
+
+	return socket, nil
+}
+
+// closeConn closes a connection, and lingers so that the final segments can be
+// delivered before the socket itself is closed.
+func closeConn(conn net.Conn) {
+	_ = conn.Close()
+	time.Sleep(lingerTimeout)
+}
+
+// signalContext returns a context that is canceled on SIGTERM or an interrupt.
+func signalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+}
+
+// pipe copies in to the connection, and the connection to out, until both
+// directions are finished (or the context is done). When in reaches EOF, the
+// write side of the connection is shut down, so that the remote end sees EOF.
+func pipe(ctx context.Context, conn net.Conn, in io.Reader, out io.Writer) error {
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+
+		if _, err := io.Copy(conn, in); err != nil {
+			_ = conn.Close()
+			return
+		}
+
+		if hc, ok := conn.(interface{ CloseWrite() error }); ok {
+			_ = hc.CloseWrite()
+		}
+	}()
+
+	_, err := io.Copy(out, conn)
+	if err != nil && ctx.Err() == nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+
+	select {
+	case <-sent:
+	case <-ctx.Done():
+	}
+
+	return nil
+}
@@ -0,0 +1,93 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Messages understood by systemd (see sd_notify(3)).
+const (
+	sdNotifyReady    = "READY=1"
+	sdNotifyStopping = "STOPPING=1"
+	sdNotifyWatchdog = "WATCHDOG=1"
+)
+
+// sdNotifier reports the state of the daemon to systemd, when it is run as a
+// service of Type=notify (or notify-reload). Without NOTIFY_SOCKET set, it
+// does nothing.
+type sdNotifier struct {
+	socket string
+}
+
+func newSDNotifier() *sdNotifier {
+	return &sdNotifier{socket: os.Getenv("NOTIFY_SOCKET")}
+}
+
+// notify sends a state change to systemd.
+func (n *sdNotifier) notify(state string) error {
+	if n.socket == "" {
+		return nil
+	}
+
+	addr := &net.UnixAddr{Name: n.socket, Net: "unixgram"}
+	// Abstract namespace sockets are prefixed with '@'.
+	if addr.Name[0] == '@' {
+		addr.Name = "\x00" + addr.Name[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to notify socket: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("failed to notify systemd: %w", err)
+	}
+
+	return nil
+}
+
+// reloading tells systemd that the configuration is being reloaded, it must
+// be followed by ready once the reload is complete.
+func (n *sdNotifier) reloading() error {
+	if n.socket == "" {
+		return nil
+	}
+
+	now, err := monotonicNow()
+	if err != nil {
+		return fmt.Errorf("failed to read monotonic clock: %w", err)
+	}
+
+	usec := now / int64(time.Microsecond)
+	return n.notify("RELOADING=1\nMONOTONIC_USEC=" + strconv.FormatInt(usec, 10))
+}
+
+// watchdogInterval returns how often the watchdog should be pinged, or zero
+// if the service has no watchdog (or it is meant for another process).
+func (n *sdNotifier) watchdogInterval() time.Duration {
+	if n.socket == "" {
+		return 0
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	// Ping twice per timeout, so a late ping doesn't kill the service.
+	return time.Duration(usec) * time.Microsecond / 2
+}
@@ -0,0 +1,58 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSDNotifier(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	t.Setenv("NOTIFY_SOCKET", path)
+	t.Setenv("WATCHDOG_USEC", "2000000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+
+	notifier := newSDNotifier()
+	require.Equal(t, time.Second, notifier.watchdogInterval())
+
+	read := func() string {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+		buf := make([]byte, 256)
+		n, err := conn.Read(buf)
+		require.NoError(t, err)
+
+		return string(buf[:n])
+	}
+
+	require.NoError(t, notifier.notify(sdNotifyReady))
+	require.Equal(t, sdNotifyReady, read())
+
+	require.NoError(t, notifier.reloading())
+	require.True(t, strings.HasPrefix(read(), "RELOADING=1\nMONOTONIC_USEC="))
+
+	// The watchdog belongs to another process.
+	t.Setenv("WATCHDOG_PID", "1")
+	require.Zero(t, notifier.watchdogInterval())
+
+	// Not running under systemd.
+	require.NoError(t, (&sdNotifier{}).notify(sdNotifyReady))
+}
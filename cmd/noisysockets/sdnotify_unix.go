@@ -0,0 +1,21 @@
+//go:build !windows
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// monotonicNow returns the time of the monotonic clock, as used by systemd, in
+// nanoseconds.
+func monotonicNow() (int64, error) {
+	var now unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &now); err != nil {
+		return 0, err
+	}
+
+	return now.Nano(), nil
+}
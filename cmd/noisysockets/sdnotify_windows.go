@@ -0,0 +1,13 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package main
+
+import "errors"
+
+// monotonicNow is never needed on Windows, as there is no systemd.
+func monotonicNow() (int64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,68 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/netip"
+
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config"
+)
+
+// runTUN exposes the mesh as a network interface of the host, routing the
+// prefixes of peers (and DNS queries for the domain of the mesh) via it,
+// until interrupted.
+func runTUN(logger *slog.Logger, configPath, name string) error {
+	conf, err := config.FromYAML(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to read config: %w", err)
+	}
+
+	bridge, err := noisysockets.NewTUNBridge(logger, conf, name)
+	if err != nil {
+		return fmt.Errorf("failed to create tun bridge: %w", err)
+	}
+	defer bridge.Close()
+
+	if err := bridge.RoutePeers(); err != nil {
+		return err
+	}
+
+	// The host's resolver only understands plain DNS servers.
+	var dnsServers []netip.Addr
+	for _, server := range conf.DNSServers {
+		addr, err := netip.ParseAddr(server)
+		if err != nil {
+			logger.Warn("Ignoring DNS server not supported by the host", "server", server)
+			continue
+		}
+		dnsServers = append(dnsServers, addr)
+	}
+
+	if len(dnsServers) > 0 {
+		var domains []string
+		if conf.Domain != "" {
+			domains = append(domains, conf.Domain)
+		}
+
+		if err := bridge.SetDNS(dnsServers, domains...); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	logger.Info("Network is up", "name", conf.Name, "interface", bridge.Name())
+
+	<-ctx.Done()
+
+	logger.Info("Bringing network down")
+
+	return nil
+}
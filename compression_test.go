@@ -0,0 +1,144 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoisySocket_Compression(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	newConfs := func(serverCompression, clientCompression string) (*v1alpha1.Config, *v1alpha1.Config) {
+		serverConf := &v1alpha1.Config{
+			Name:       "server",
+			PrivateKey: serverPrivateKey.String(),
+			IPs:        []string{"10.7.0.1"},
+			Peers: []v1alpha1.WireGuardPeerConfig{
+				{
+					Name:        "client",
+					PublicKey:   clientPrivateKey.PublicKey().String(),
+					IPs:         []string{"10.7.0.2"},
+					Compression: serverCompression,
+				},
+			},
+		}
+
+		clientConf := &v1alpha1.Config{
+			Name:       "client",
+			PrivateKey: clientPrivateKey.String(),
+			IPs:        []string{"10.7.0.2"},
+			Peers: []v1alpha1.WireGuardPeerConfig{
+				{
+					Name:        "server",
+					PublicKey:   serverPrivateKey.PublicKey().String(),
+					IPs:         []string{"10.7.0.1"},
+					Compression: clientCompression,
+				},
+			},
+		}
+
+		return serverConf, clientConf
+	}
+
+	// Very compressible.
+	data := bytes.Repeat([]byte("noisysockets "), 32*1024)
+
+	transfer := func(t *testing.T, serverConf, clientConf *v1alpha1.Config) (*noisysockets.NoisySocket, *noisysockets.NoisySocket) {
+		serverSocket, clientSocket, err := noisysockets.Pipe(logger, serverConf, clientConf, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, serverSocket.Close())
+			require.NoError(t, clientSocket.Close())
+		})
+
+		lis, err := serverSocket.Listen("tcp", ":80")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, lis.Close())
+		})
+
+		go func() {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			_, _ = conn.Write(data)
+		}()
+
+		conn, err := clientSocket.DialTimeout("tcp", "server:80", 20*time.Second)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, conn.Close())
+		})
+
+		require.NoError(t, conn.SetDeadline(time.Now().Add(30*time.Second)))
+
+		buf, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(data, buf))
+
+		return serverSocket, clientSocket
+	}
+
+	t.Run("Enabled", func(t *testing.T) {
+		serverConf, clientConf := newConfs("snappy", "snappy")
+		serverSocket, clientSocket := transfer(t, serverConf, clientConf)
+
+		serverStatus, err := serverSocket.PeerStatus("client")
+		require.NoError(t, err)
+		require.Greater(t, serverStatus.Compression.TxRatio(), 2.0)
+
+		clientStatus, err := clientSocket.PeerStatus("server")
+		require.NoError(t, err)
+		require.Greater(t, clientStatus.Compression.RxRatio(), 2.0)
+	})
+
+	t.Run("One Sided", func(t *testing.T) {
+		serverConf, clientConf := newConfs("", "snappy")
+		serverSocket, clientSocket := transfer(t, serverConf, clientConf)
+
+		serverStatus, err := serverSocket.PeerStatus("client")
+		require.NoError(t, err)
+		require.Zero(t, serverStatus.Compression)
+
+		clientStatus, err := clientSocket.PeerStatus("server")
+		require.NoError(t, err)
+		require.Zero(t, clientStatus.Compression)
+	})
+
+	t.Run("Unsupported", func(t *testing.T) {
+		serverConf, clientConf := newConfs("lz4", "")
+
+		_, _, err := noisysockets.Pipe(logger, serverConf, clientConf, nil)
+		require.ErrorContains(t, err, "unsupported compression algorithm")
+	})
+
+	t.Run("Strict Interop", func(t *testing.T) {
+		serverConf, clientConf := newConfs("snappy", "")
+		serverConf.StrictInterop = true
+
+		_, _, err := noisysockets.Pipe(logger, serverConf, clientConf, nil)
+		require.ErrorContains(t, err, "not supported in strict interop mode")
+	})
+}
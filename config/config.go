@@ -14,12 +14,22 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
-func FromYAML(configPath string) (conf *latest.Config, err error) {
+func FromYAML(configPath string) (*latest.Config, error) {
 	confBytes, err := os.ReadFile(configPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read config file %q: %w", configPath, err)
 	}
 
+	return fromYAMLBytes(configPath, confBytes)
+}
+
+// FromYAMLBytes parses a YAML encoded config (eg. one that was embedded in an
+// application, rather than read from a file).
+func FromYAMLBytes(confBytes []byte) (*latest.Config, error) {
+	return fromYAMLBytes("<bytes>", confBytes)
+}
+
+func fromYAMLBytes(configPath string, confBytes []byte) (conf *latest.Config, err error) {
 	var typeMeta types.TypeMeta
 	if err := yaml.Unmarshal(confBytes, &typeMeta); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal type meta from config file %q: %w", configPath, err)
@@ -0,0 +1,306 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (c) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+
+	latest "github.com/noisysockets/noisysockets/config/v1alpha1"
+)
+
+// iniNameComment is the comment used to record the name of a peer, or of the
+// interface, as WireGuard configs have no notion of names.
+const iniNameComment = "Name"
+
+// iniIgnoredKeys are wg-quick settings that have no equivalent in a noisy socket.
+var iniIgnoredKeys = map[string]struct{}{
+	"table":      {},
+	"fwmark":     {},
+	"preup":      {},
+	"postup":     {},
+	"predown":    {},
+	"postdown":   {},
+	"saveconfig": {},
+}
+
+// FromINI loads a WireGuard (wg or wg-quick) INI config file. Interface
+// addresses have their prefix lengths discarded, DNS search domains are
+// ignored, as are wg-quick settings that only apply to kernel interfaces (eg.
+// Table and PostUp). Names can be given to the interface and peers, using a
+// "# Name = <name>" comment in their section.
+func FromINI(configPath string) (*latest.Config, error) {
+	f, err := os.Open(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file %q: %w", configPath, err)
+	}
+	defer f.Close()
+
+	conf, err := parseINI(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file %q: %w", configPath, err)
+	}
+
+	return conf, nil
+}
+
+func parseINI(r io.Reader) (*latest.Config, error) {
+	conf := &latest.Config{}
+	conf.Kind = "Config"
+	conf.APIVersion = latest.ApiVersion
+
+	var section string
+	var peer *latest.WireGuardPeerConfig
+
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(line[1 : len(line)-1])
+			switch section {
+			case "interface":
+			case "peer":
+				conf.Peers = append(conf.Peers, latest.WireGuardPeerConfig{})
+				peer = &conf.Peers[len(conf.Peers)-1]
+			default:
+				return nil, fmt.Errorf("line %d: unknown section %q", lineNumber, line)
+			}
+			continue
+		}
+
+		var isComment bool
+		if strings.HasPrefix(line, "#") {
+			line = strings.TrimSpace(strings.TrimPrefix(line, "#"))
+			isComment = true
+		}
+
+		if line == "" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			if isComment {
+				continue
+			}
+			return nil, fmt.Errorf("line %d: expected key = value", lineNumber)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+
+		if isComment {
+			if !strings.EqualFold(key, iniNameComment) {
+				continue
+			}
+
+			switch section {
+			case "interface":
+				conf.Name = value
+			case "peer":
+				peer.Name = value
+			}
+			continue
+		}
+
+		var err error
+		switch section {
+		case "interface":
+			err = parseINIInterfaceKey(conf, key, value)
+		case "peer":
+			err = parseINIPeerKey(peer, key, value)
+		default:
+			err = fmt.Errorf("%q is not in a section", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return conf, nil
+}
+
+func parseINIInterfaceKey(conf *latest.Config, key, value string) error {
+	switch strings.ToLower(key) {
+	case "privatekey":
+		conf.PrivateKey = value
+	case "listenport":
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid listen port %q: %w", value, err)
+		}
+		conf.ListenPort = uint16(port)
+	case "mtu":
+		mtu, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid mtu %q: %w", value, err)
+		}
+		conf.MTU = int(mtu)
+	case "address":
+		for _, addr := range splitINIList(value) {
+			prefix, err := netip.ParsePrefix(addr)
+			if err != nil {
+				ip, err := netip.ParseAddr(addr)
+				if err != nil {
+					return fmt.Errorf("invalid address %q: %w", addr, err)
+				}
+				prefix = netip.PrefixFrom(ip, ip.BitLen())
+			}
+			conf.IPs = append(conf.IPs, prefix.Addr().String())
+		}
+	case "dns":
+		for _, server := range splitINIList(value) {
+			// Anything that isn't an address is a search domain.
+			if _, err := netip.ParseAddr(server); err == nil {
+				conf.DNSServers = append(conf.DNSServers, server)
+			}
+		}
+	default:
+		if _, ok := iniIgnoredKeys[strings.ToLower(key)]; !ok {
+			return fmt.Errorf("unknown interface key %q", key)
+		}
+	}
+
+	return nil
+}
+
+func parseINIPeerKey(peer *latest.WireGuardPeerConfig, key, value string) error {
+	switch strings.ToLower(key) {
+	case "publickey":
+		peer.PublicKey = value
+	case "presharedkey":
+		peer.PresharedKey = value
+	case "endpoint":
+		peer.Endpoint = value
+	case "allowedips":
+		for _, allowedIP := range splitINIList(value) {
+			prefix, err := netip.ParsePrefix(allowedIP)
+			if err != nil {
+				return fmt.Errorf("invalid allowed ip %q: %w", allowedIP, err)
+			}
+
+			if prefix.IsSingleIP() {
+				peer.IPs = append(peer.IPs, prefix.Addr().String())
+			} else {
+				peer.IPs = append(peer.IPs, prefix.Masked().String())
+			}
+		}
+	case "persistentkeepalive":
+		if value == "off" {
+			peer.PersistentKeepalive = 0
+			return nil
+		}
+
+		interval, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid persistent keepalive %q: %w", value, err)
+		}
+		peer.PersistentKeepalive = uint16(interval)
+	default:
+		return fmt.Errorf("unknown peer key %q", key)
+	}
+
+	return nil
+}
+
+func splitINIList(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// ToINI writes the config in the wg-quick INI format. Names are recorded
+// using comments, and settings that have no WireGuard equivalent (eg. rate
+// limits and access control rules) are omitted.
+func ToINI(w io.Writer, conf *latest.Config) error {
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintln(bw, "[Interface]")
+	if conf.Name != "" {
+		fmt.Fprintf(bw, "# %s = %s\n", iniNameComment, conf.Name)
+	}
+	fmt.Fprintf(bw, "PrivateKey = %s\n", conf.PrivateKey)
+	if conf.ListenPort != 0 {
+		fmt.Fprintf(bw, "ListenPort = %d\n", conf.ListenPort)
+	}
+
+	var addrs []string
+	for _, ip := range conf.IPs {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			return fmt.Errorf("could not parse address %q: %w", ip, err)
+		}
+		addrs = append(addrs, netip.PrefixFrom(addr, addr.BitLen()).String())
+	}
+	if len(addrs) > 0 {
+		fmt.Fprintf(bw, "Address = %s\n", strings.Join(addrs, ", "))
+	}
+	var dnsServers []string
+	for _, server := range conf.DNSServers {
+		// wg-quick only supports plain DNS servers.
+		if _, err := netip.ParseAddr(server); err == nil {
+			dnsServers = append(dnsServers, server)
+		}
+	}
+	if len(dnsServers) > 0 {
+		fmt.Fprintf(bw, "DNS = %s\n", strings.Join(dnsServers, ", "))
+	}
+	if conf.MTU != 0 {
+		fmt.Fprintf(bw, "MTU = %d\n", conf.MTU)
+	}
+
+	for _, peer := range conf.Peers {
+		fmt.Fprintln(bw)
+		fmt.Fprintln(bw, "[Peer]")
+		if peer.Name != "" {
+			fmt.Fprintf(bw, "# %s = %s\n", iniNameComment, peer.Name)
+		}
+		fmt.Fprintf(bw, "PublicKey = %s\n", peer.PublicKey)
+		if peer.PresharedKey != "" {
+			fmt.Fprintf(bw, "PresharedKey = %s\n", peer.PresharedKey)
+		}
+
+		var allowedIPs []string
+		for _, ip := range peer.IPs {
+			prefix, err := netip.ParsePrefix(ip)
+			if err != nil {
+				addr, err := netip.ParseAddr(ip)
+				if err != nil {
+					return fmt.Errorf("could not parse peer address %q: %w", ip, err)
+				}
+				prefix = netip.PrefixFrom(addr, addr.BitLen())
+			}
+			allowedIPs = append(allowedIPs, prefix.String())
+		}
+		if peer.DefaultGateway || (peer.Name != "" && peer.Name == conf.DefaultGatewayPeerName) {
+			allowedIPs = append(allowedIPs, "0.0.0.0/0", "::/0")
+		}
+		if len(allowedIPs) > 0 {
+			fmt.Fprintf(bw, "AllowedIPs = %s\n", strings.Join(allowedIPs, ", "))
+		}
+
+		if peer.Endpoint != "" {
+			fmt.Fprintf(bw, "Endpoint = %s\n", peer.Endpoint)
+		}
+		if peer.PersistentKeepalive != 0 {
+			fmt.Fprintf(bw, "PersistentKeepalive = %d\n", peer.PersistentKeepalive)
+		}
+	}
+
+	return bw.Flush()
+}
@@ -0,0 +1,89 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (c) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/noisysockets/noisysockets/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFromINI(t *testing.T) {
+	conf, err := config.FromINI("testdata/wg0.conf")
+	require.NoError(t, err)
+
+	require.Equal(t, "Config", conf.GetKind())
+	require.Equal(t, "noisysockets.github.com/v1alpha1", conf.GetAPIVersion())
+
+	require.Equal(t, "client", conf.Name)
+	require.Equal(t, "SFN1gntnAutVFefwrPDlM1W2/LGWaRSn2hq06TvL2GY=", conf.PrivateKey)
+	require.Equal(t, uint16(12346), conf.ListenPort)
+	require.Equal(t, []string{"10.7.0.2", "fd00::2"}, conf.IPs)
+	require.Equal(t, []string{"10.7.0.1"}, conf.DNSServers)
+	require.Equal(t, 1420, conf.MTU)
+
+	require.Len(t, conf.Peers, 2)
+
+	require.Equal(t, "server", conf.Peers[0].Name)
+	require.Equal(t, "6cvvZyj+EVL4DHjUKeVF7EUBfgR2mJO4php2Gdv9FVw=", conf.Peers[0].PublicKey)
+	require.Equal(t, "/UwcSPg38hW/D9Y3tcS1FOV0K1wuURMbS0sesJEP5ak=", conf.Peers[0].PresharedKey)
+	require.Equal(t, "127.0.0.1:12345", conf.Peers[0].Endpoint)
+	require.Equal(t, []string{"10.7.0.1", "10.8.0.0/16"}, conf.Peers[0].IPs)
+	require.Equal(t, uint16(25), conf.Peers[0].PersistentKeepalive)
+
+	require.Empty(t, conf.Peers[1].Name)
+	require.Equal(t, []string{"0.0.0.0/0", "::/0"}, conf.Peers[1].IPs)
+
+	t.Run("Unknown Key", func(t *testing.T) {
+		configPath := filepath.Join(t.TempDir(), "wg0.conf")
+		require.NoError(t, os.WriteFile(configPath, []byte("[Interface]\nBogus = 1\n"), 0o600))
+
+		_, err := config.FromINI(configPath)
+		require.ErrorContains(t, err, "line 2")
+	})
+}
+
+func TestToINI(t *testing.T) {
+	conf, err := config.FromYAML("testdata/config.yaml")
+	require.NoError(t, err)
+
+	conf.Peers[0].PersistentKeepalive = 25
+	conf.DefaultGatewayPeerName = "server"
+
+	var sb strings.Builder
+	require.NoError(t, config.ToINI(&sb, conf))
+
+	expected := `[Interface]
+PrivateKey = SFN1gntnAutVFefwrPDlM1W2/LGWaRSn2hq06TvL2GY=
+ListenPort = 12346
+Address = 10.7.0.2/32
+
+[Peer]
+# Name = server
+PublicKey = 6cvvZyj+EVL4DHjUKeVF7EUBfgR2mJO4php2Gdv9FVw=
+AllowedIPs = 10.7.0.1/32, 0.0.0.0/0, ::/0
+Endpoint = 127.0.0.1:12345
+PersistentKeepalive = 25
+`
+	require.Equal(t, expected, sb.String())
+
+	// Should round trip.
+	configPath := filepath.Join(t.TempDir(), "wg0.conf")
+	require.NoError(t, os.WriteFile(configPath, []byte(sb.String()), 0o600))
+
+	imported, err := config.FromINI(configPath)
+	require.NoError(t, err)
+
+	require.Equal(t, conf.PrivateKey, imported.PrivateKey)
+	require.Equal(t, conf.ListenPort, imported.ListenPort)
+	require.Equal(t, conf.IPs, imported.IPs)
+	require.Equal(t, "server", imported.Peers[0].Name)
+	require.Equal(t, []string{"10.7.0.1", "0.0.0.0/0", "::/0"}, imported.Peers[0].IPs)
+}
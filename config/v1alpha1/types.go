@@ -19,31 +19,546 @@ type Config struct {
 	types.TypeMeta `yaml:",inline" mapstructure:",squash"`
 	// Name is the hostname of this socket.
 	Name string `yaml:"name" mapstructure:"name"`
-	// ListenPort is an optional port on which to listen for incoming packets.
+	// ListenPort is an optional port on which to listen for incoming packets. If it is zero, an
+	// ephemeral port is chosen (see NoisySocket.ListenPort).
 	ListenPort uint16 `yaml:"listenPort" mapstructure:"listenPort"`
+	// Backend optionally selects the data plane used by kernel.Open, either "userspace" (the
+	// default), "kernel" for a kernel WireGuard interface (Linux only, requires CAP_NET_ADMIN), or
+	// "auto" to use a kernel interface when it is supported, and otherwise fall back to userspace.
+	// It is ignored by NewNoisySocket, which always uses the userspace data plane.
+	Backend string `yaml:"backend,omitempty" mapstructure:"backend,omitempty"`
+	// Listeners is an optional list of addresses on which to accept connections from peers over
+	// other transports, eg. "tcp://0.0.0.0:51820", "ws://0.0.0.0:8080/wireguard", or
+	// "quic://0.0.0.0:443". TCP and WebSockets are useful on networks that block UDP, and QUIC
+	// where only QUIC is let through. Packets are still received on ListenPort.
+	Listeners []string `yaml:"listeners,omitempty" mapstructure:"listeners,omitempty"`
+	// SocketOptions optionally sets options of the underlying UDP socket, eg. to pin the tunnel to
+	// a specific uplink, or to exclude its packets from the routes that send traffic via it.
+	SocketOptions *SocketOptionsConfig `yaml:"socketOptions,omitempty" mapstructure:"socketOptions,omitempty"`
+	// RelayURL is the optional URL of a relay server, eg. "wss://relay.example.com/relay", through
+	// which packets are sent to peers that have no known endpoint, or that can't be reached directly.
+	// See the relay package for the server implementation.
+	RelayURL string `yaml:"relayURL,omitempty" mapstructure:"relayURL,omitempty"`
+	// STUNServers is an optional list of STUN servers (host:port), used to discover the public
+	// endpoint of this socket (eg. when it is behind a NAT). Discovered endpoints are shared with
+	// peers, through the tunnel on UDP port 51821, so that relayed peers can establish a direct
+	// path by hole punching. Sockets using STUN, or a relay, accept endpoints from their peers.
+	STUNServers []string `yaml:"stunServers,omitempty" mapstructure:"stunServers,omitempty"`
+	// IntroducePeers lets peers, that have marked this socket as an introducer, ask it to
+	// introduce them to other peers it has sessions with. Both peers are told each other's
+	// endpoints, through the tunnel on UDP port 51822, so that they can punch holes through their
+	// NATs, and establish a direct path, without going through a relay.
+	IntroducePeers bool `yaml:"introducePeers,omitempty" mapstructure:"introducePeers,omitempty"`
+	// LANDiscovery optionally announces this socket's public key, and endpoint, to the local network
+	// (using UDP multicast), and adds any peers that are announced by other sockets, so that a mesh
+	// of hosts on the same network can be formed without configuring peers. It should only be
+	// enabled on trusted networks, as any host on the network can announce itself as a peer.
+	LANDiscovery *LANDiscoveryConfig `yaml:"lanDiscovery,omitempty" mapstructure:"lanDiscovery,omitempty"`
+	// Obfuscation optionally disguises the packets exchanged with peers, so that they aren't
+	// recognized as WireGuard by deep packet inspection (eg. on networks that block VPNs). Every
+	// peer must be configured with the same settings, so it can't be used with stock WireGuard
+	// implementations.
+	Obfuscation *ObfuscationConfig `yaml:"obfuscation,omitempty" mapstructure:"obfuscation,omitempty"`
+	// Roaming optionally watches the host's network interfaces and, when their addresses change (eg.
+	// moving from Wi-Fi to LTE), re-binds the socket and re-initiates handshakes with peers, so that
+	// sessions survive the change.
+	Roaming *RoamingConfig `yaml:"roaming,omitempty" mapstructure:"roaming,omitempty"`
+	// MTU is the optional maximum transmission unit of the tunnel, it defaults to 1420. It should
+	// be lowered if the underlying network has a smaller MTU than usual (eg. PPPoE).
+	MTU int `yaml:"mtu,omitempty" mapstructure:"mtu,omitempty"`
+	// PathMTUDiscovery periodically probes the path MTU to each peer (using pings through the
+	// tunnel), so that packets too large for a peer's path are rejected with an ICMP error,
+	// rather than silently dropped by the underlying network. Peers must reply to pings.
+	PathMTUDiscovery bool `yaml:"pathMTUDiscovery,omitempty" mapstructure:"pathMTUDiscovery,omitempty"`
+	// HealthCheck optionally pings each peer periodically (through the tunnel), marking peers as
+	// unhealthy once they stop replying, so that applications can fail over before connections
+	// time out. Peers must reply to pings.
+	HealthCheck *HealthCheckConfig `yaml:"healthCheck,omitempty" mapstructure:"healthCheck,omitempty"`
+	// PeerIdleTimeoutSeconds is an optional default for the IdleTimeoutSeconds of peers, eg. so that
+	// gateways with many mostly idle peers don't hold their keys and timers.
+	PeerIdleTimeoutSeconds int `yaml:"peerIdleTimeoutSeconds,omitempty" mapstructure:"peerIdleTimeoutSeconds,omitempty"`
+	// Timers optionally adjusts the handshake, and rekey, timers, eg. so that constrained deployments
+	// (satellite links, battery powered devices) can trade latency for fewer packets.
+	Timers *TimersConfig `yaml:"timers,omitempty" mapstructure:"timers,omitempty"`
+	// HandshakeLimits optionally adjusts the protection against floods of handshake messages, eg. so
+	// that public facing gateways can withstand them.
+	HandshakeLimits *HandshakeLimitsConfig `yaml:"handshakeLimits,omitempty" mapstructure:"handshakeLimits,omitempty"`
+	// Tuning optionally adjusts the sizes of the socket's packet queues and batches, eg. to reduce
+	// memory usage on small devices, or to increase throughput on busy servers.
+	Tuning *TuningConfig `yaml:"tuning,omitempty" mapstructure:"tuning,omitempty"`
+	// QoS optionally prioritizes latency sensitive outbound traffic (eg. SSH, DNS, and VoIP) over bulk
+	// transfers sharing the tunnel.
+	QoS *QoSConfig `yaml:"qos,omitempty" mapstructure:"qos,omitempty"`
+	// Stack optionally adjusts the TCP behavior of the socket's network stack, eg. larger buffers
+	// and cubic congestion control improve throughput over links with a high bandwidth-delay product.
+	Stack *StackConfig `yaml:"stack,omitempty" mapstructure:"stack,omitempty"`
 	// PrivateKey is the private key for this socket.
 	PrivateKey string `yaml:"privateKey" mapstructure:"privateKey"`
+	// SessionStateFile is an optional path to a file in which the sessions of peers are saved when
+	// the socket is closed, and from which they are restored when it is next created, so that a
+	// brief restart doesn't force every peer to handshake again. The file is encrypted using a key
+	// derived from PrivateKey, and removed once it has been read.
+	SessionStateFile string `yaml:"sessionStateFile,omitempty" mapstructure:"sessionStateFile,omitempty"`
 	// IPs is a list of IP addresses assigned to this socket.
 	IPs []string `yaml:"ips" mapstructure:"ips"`
+	// IPAM optionally assigns addresses from a pool, to this socket if it has no IPs, and to any
+	// peers that have no IPs. Addresses are derived from public keys, so sockets sharing a pool
+	// will usually agree on each other's addresses without them having to be configured.
+	IPAM *IPAMConfig `yaml:"ipam,omitempty" mapstructure:"ipam,omitempty"`
+	// DeriveIPv6Addresses assigns a stable IPv6 unique local address (within fd00::/8), derived
+	// from its public key, to this socket if it has no IPs, and to any peers that have no IPs. As
+	// every socket derives the same addresses, IPv6 only meshes need no address configuration.
+	// It can be combined with IPAM, eg. to also allocate IPv4 addresses.
+	DeriveIPv6Addresses bool `yaml:"deriveIPv6Addresses,omitempty" mapstructure:"deriveIPv6Addresses,omitempty"`
+	// Domain is an optional DNS domain of the mesh (eg. "my-net.internal"), so that this socket and
+	// its peers can also be resolved by their fully qualified names (eg. "web.my-net.internal").
+	// Names within the domain, that aren't the names of peers, are never resolved using DNSServers
+	// (or the host's resolver), names outside of it still are.
+	Domain string `yaml:"domain,omitempty" mapstructure:"domain,omitempty"`
+	// AddressConflicts is how the IPs of a peer, that conflict with those of another peer, are
+	// handled. Either "reject" (the default), which rejects peers claiming IPs already claimed by
+	// another peer, "strict", which also rejects IPs that overlap those of another peer, or that
+	// contain one of this socket's IPs, or "replace", which hands IPs claimed by another peer
+	// over to the peer that claimed them last (publishing a PeerAddressTakenOver event). The
+	// default route, of a default gateway, never conflicts.
+	AddressConflicts string `yaml:"addressConflicts,omitempty" mapstructure:"addressConflicts,omitempty"`
 	// DefaultGatewayPeerName is the optional hostname of the peer to use as the default gateway for traffic.
 	DefaultGatewayPeerName string `yaml:"defaultGatewayPeerName" mapstructure:"defaultGatewayPeerName"`
 	// DNSServers is an optional list of DNS servers to use for host resolution.
+	// The DNS servers are queried through the tunnel (or the host's network, see DNS).
+	// Each server is either an IP address (queried over TCP), "tls://host[:port]" for
+	// DNS over TLS, or an "https://" URL for DNS over HTTPS (eg. "https://1.1.1.1/dns-query").
 	DNSServers []string `yaml:"dnsServers" mapstructure:"dnsServers"`
+	// DNS is optional configuration for how DNSServers (and those of DNSRoutes) are queried.
+	DNS *DNSConfig `yaml:"dns,omitempty" mapstructure:"dns,omitempty"`
+	// DNSRoutes resolves names within specific domains using their own DNS servers, rather than
+	// DNSServers (or the host's resolver), eg. to resolve a corporate domain using a DNS server
+	// hosted by a peer. The route with the longest matching domain is used.
+	DNSRoutes []DNSRouteConfig `yaml:"dnsRoutes,omitempty" mapstructure:"dnsRoutes,omitempty"`
+	// UseHostResolver resolves host names, that aren't the names of peers, using the host's resolver.
+	// It cannot be combined with DNSServers.
+	UseHostResolver bool `yaml:"useHostResolver,omitempty" mapstructure:"useHostResolver,omitempty"`
+	// EnableDNSServer starts a DNS server, listening on port 53 of this socket's addresses,
+	// that answers queries for the names of this socket and its peers.
+	EnableDNSServer bool `yaml:"enableDNSServer,omitempty" mapstructure:"enableDNSServer,omitempty"`
+	// EnableMeasurementServer starts a server, listening on TCP and UDP port 5201 of this socket's
+	// addresses, that answers throughput and latency measurements (eg. MeasureThroughput) from peers.
+	EnableMeasurementServer bool `yaml:"enableMeasurementServer,omitempty" mapstructure:"enableMeasurementServer,omitempty"`
+	// LoadBalancing is how connections dialed to a service served by several peers (see
+	// WireGuardPeerConfig.Services) are distributed among them, either "round-robin" (the default)
+	// or "least-connections". Enable HealthCheck to skip peers that are down.
+	LoadBalancing string `yaml:"loadBalancing,omitempty" mapstructure:"loadBalancing,omitempty"`
+	// FloatingIPs are optional virtual addresses shared by several peers. Each is routed to the
+	// first of its peers that isn't unhealthy (see HealthCheck), failing over to the next when it
+	// goes down.
+	FloatingIPs []FloatingIPConfig `yaml:"floatingIPs,omitempty" mapstructure:"floatingIPs,omitempty"`
+	// ReverseProxies optionally serves HTTP reverse proxies on this socket's addresses, exposing
+	// services on the host's network (eg. a development server) to peers.
+	ReverseProxies []ReverseProxyConfig `yaml:"reverseProxies,omitempty" mapstructure:"reverseProxies,omitempty"`
+	// DisableEchoReply disables responding to ICMP echo requests (pings).
+	DisableEchoReply bool `yaml:"disableEchoReply,omitempty" mapstructure:"disableEchoReply,omitempty"`
+	// EnableForwarding turns this socket into a router, forwarding packets between peers.
+	EnableForwarding bool `yaml:"enableForwarding,omitempty" mapstructure:"enableForwarding,omitempty"`
+	// ForwardToHostNetwork forwards TCP and UDP traffic from peers, that is not destined for
+	// this socket or another peer, to the host's network. Requires EnableForwarding.
+	ForwardToHostNetwork bool `yaml:"forwardToHostNetwork,omitempty" mapstructure:"forwardToHostNetwork,omitempty"`
+	// DisableDNSForwarder stops an exit node (see ForwardToHostNetwork) from answering DNS queries
+	// from peers, on port 53 of this socket's addresses, using the host's name servers.
+	DisableDNSForwarder bool `yaml:"disableDNSForwarder,omitempty" mapstructure:"disableDNSForwarder,omitempty"`
+	// NAT64Prefix lets IPv6 only peers reach IPv4 only hosts on the host's network. TCP and UDP
+	// traffic to an address within the prefix (eg. "64:ff9b::/96", the well known prefix) is
+	// forwarded to the IPv4 address embedded in its last 32 bits. If the DNS server is enabled, it
+	// also answers queries for other names, synthesizing AAAA records within the prefix for names
+	// that only have IPv4 addresses (DNS64). The prefix must be a /96. Requires ForwardToHostNetwork.
+	NAT64Prefix string `yaml:"nat64Prefix,omitempty" mapstructure:"nat64Prefix,omitempty"`
+	// ClampMSS lowers the maximum segment size advertised by TCP connections through the tunnel,
+	// so that their segments fit within the MTU of the path to each peer. This is useful when
+	// forwarding traffic for hosts that aren't aware of the tunnel's (smaller) MTU.
+	ClampMSS bool `yaml:"clampMSS,omitempty" mapstructure:"clampMSS,omitempty"`
+	// EnableMulticast delivers packets sent to the IPv4 broadcast address, or to a multicast group,
+	// to every peer (eg. for service discovery with mDNS or SSDP), rather than routing them. To
+	// receive packets sent to a group, the socket must join it (see NoisySocket.JoinGroup).
+	EnableMulticast bool `yaml:"enableMulticast,omitempty" mapstructure:"enableMulticast,omitempty"`
+	// RateLimit is an optional limit on the combined rate of inbound traffic from all peers.
+	// It is applied after any per peer limits.
+	RateLimit *RateLimitConfig `yaml:"rateLimit,omitempty" mapstructure:"rateLimit,omitempty"`
+	// OutboundRateLimit is an optional limit on the combined rate of outbound traffic to all peers.
+	// It is applied after any per peer limits.
+	OutboundRateLimit *RateLimitConfig `yaml:"outboundRateLimit,omitempty" mapstructure:"outboundRateLimit,omitempty"`
+	// StrictInterop disables noisysockets specific protocol extensions (eg. accepting handshakes
+	// addressed to a rotated private key), so that the socket behaves exactly like a stock
+	// WireGuard implementation.
+	StrictInterop bool `yaml:"strictInterop,omitempty" mapstructure:"strictInterop,omitempty"`
+	// ACL is an optional, ordered, list of rules controlling the traffic exchanged with peers.
+	// The first matching rule decides whether traffic is allowed, if no rule matches it is allowed.
+	ACL []ACLRuleConfig `yaml:"acl,omitempty" mapstructure:"acl,omitempty"`
 	// Peers is a list of known peers to which this socket can send and receive packets.
 	Peers []WireGuardPeerConfig `yaml:"peers" mapstructure:"peers"`
 }
 
+// ACLRuleConfig is an access control rule. For example, to only allow the peer
+// "ci-runner" to reach tcp/443, allow inbound tcp traffic from ci-runner to
+// port 443, followed by a rule denying all other inbound traffic from ci-runner.
+type ACLRuleConfig struct {
+	// Action is either "allow" or "deny".
+	Action string `yaml:"action" mapstructure:"action"`
+	// Peer is the name or public key of the peer the rule applies to, "tag:" followed by a tag
+	// (eg. "tag:role=db") for all peers with that tag, or "*" for all peers.
+	Peer string `yaml:"peer" mapstructure:"peer"`
+	// Direction is either "inbound" (traffic initiated by the peer), "outbound" (connections
+	// dialed to the peer), or empty for both. Replies to permitted traffic are always allowed.
+	Direction string `yaml:"direction,omitempty" mapstructure:"direction,omitempty"`
+	// Protocol is one of "tcp", "udp", "icmp", or empty for any protocol.
+	Protocol string `yaml:"protocol,omitempty" mapstructure:"protocol,omitempty"`
+	// Ports is an optional destination port, or inclusive port range (eg. "8000-8999").
+	// Rules with ports only match TCP and UDP traffic.
+	Ports string `yaml:"ports,omitempty" mapstructure:"ports,omitempty"`
+}
+
+// SRVRecordConfig is a service published by a peer.
+type SRVRecordConfig struct {
+	// Service is the name of the service (eg. "api").
+	Service string `yaml:"service" mapstructure:"service"`
+	// Protocol is the transport protocol of the service, either "tcp" (the default) or "udp".
+	Protocol string `yaml:"protocol,omitempty" mapstructure:"protocol,omitempty"`
+	// Port is the port the service listens on.
+	Port uint16 `yaml:"port" mapstructure:"port"`
+	// Metadata is optional information about the service (eg. its version), that is answered as
+	// a TXT record.
+	Metadata map[string]string `yaml:"metadata,omitempty" mapstructure:"metadata,omitempty"`
+}
+
 // WireGuardPeerConfig is the configuration for a known peer.
 type WireGuardPeerConfig struct {
 	// Name is the hostname of the peer.
 	Name string `yaml:"name" mapstructure:"name"`
 	// PublicKey is the public key of the peer.
 	PublicKey string `yaml:"publicKey" mapstructure:"publicKey"`
+	// PresharedKey is an optional base64 encoded symmetric key, shared with the peer, that is mixed
+	// into the handshake. It provides an additional layer of protection, eg. against future quantum
+	// computers. Both peers must be configured with the same key.
+	PresharedKey string `yaml:"presharedKey,omitempty" mapstructure:"presharedKey,omitempty"`
+	// Tags are optional labels (eg. "role=db" or "env=prod"), that access control rules can refer
+	// to instead of individual peers.
+	Tags []string `yaml:"tags,omitempty" mapstructure:"tags,omitempty"`
+	// Services are the optional names of services the peer serves (eg. "api"), that resolve to the
+	// addresses of every peer serving them. Connections dialed to a service are distributed among
+	// its peers (see LoadBalancing), skipping any that are unhealthy. Peer names take precedence.
+	Services []string `yaml:"services,omitempty" mapstructure:"services,omitempty"`
+	// SRVRecords are optional services the peer publishes, that the DNS server answers as SRV
+	// records (eg. "_api._tcp"), so that standard service discovery clients can find them.
+	SRVRecords []SRVRecordConfig `yaml:"srvRecords,omitempty" mapstructure:"srvRecords,omitempty"`
+	// TXTRecords are optional strings (eg. "version=1.2"), that the DNS server answers as the TXT
+	// records of the peer's name.
+	TXTRecords []string `yaml:"txtRecords,omitempty" mapstructure:"txtRecords,omitempty"`
 	// Endpoint is an optional endpoint to which the peer's packets should be sent.
 	// If not specified, we will attempt to discover the peer's endpoint from its packets.
+	// A host:port is reached over UDP, other transports are selected by using a URL,
+	// eg. "tcp://host:port", "ws://host:port/path", "wss://host/path", or "quic://host:port".
 	Endpoint string `yaml:"endpoint" mapstructure:"endpoint"`
-	// IPs is a list of IP addresses assigned to the peer.
+	// Endpoints are optional additional endpoints of the peer (eg. its IPv6 address, or a backup
+	// server). Handshake initiations are sent to each of the peer's endpoints, and packets are sent
+	// to whichever responds first, so the fastest working endpoint is preferred, and traffic fails
+	// over to another if it stops working.
+	Endpoints []string `yaml:"endpoints,omitempty" mapstructure:"endpoints,omitempty"`
+	// Via is the optional name, or public key, of another peer through which this peer is reached,
+	// eg. when there is no direct connectivity between them. Packets for the peer are sent through
+	// the tunnel to the intermediate peer, which must enable forwarding (see EnableForwarding) and
+	// be configured with this peer, and re-encrypts them for this peer. The peer should likewise
+	// reach this socket via the intermediate peer. It cannot be combined with Endpoint(s).
+	Via string `yaml:"via,omitempty" mapstructure:"via,omitempty"`
+	// Introducer asks the peer (which must set IntroducePeers) to introduce this socket to any
+	// peer it can't reach, so that they can establish a direct path by hole punching. Introductions
+	// are only accepted from introducers, and a socket must be created with at least one introducer
+	// for introductions to be requested.
+	Introducer bool `yaml:"introducer,omitempty" mapstructure:"introducer,omitempty"`
+	// IPs is a list of IP addresses assigned to the peer. CIDR prefixes (e.g. 10.8.0.0/24)
+	// may also be given to route a whole subnet through the peer.
 	IPs []string `yaml:"ips" mapstructure:"ips"`
+	// PersistentKeepalive is an optional interval, in seconds, at which keepalive packets are sent
+	// to the peer, eg. to keep NAT mappings alive. A value of 25 is a sensible default if required.
+	PersistentKeepalive uint16 `yaml:"persistentKeepalive,omitempty" mapstructure:"persistentKeepalive,omitempty"`
+	// IdleTimeoutSeconds is how long a session with the peer may go without any data being exchanged
+	// (keepalives don't count), before it is torn down and its keys and handshake state are freed.
+	// The peer's configuration is retained, and a new handshake is made when there is traffic for it.
+	// Defaults to PeerIdleTimeoutSeconds, and sessions never expire if neither is set. Both peers
+	// should use the same timeout, as packets the peer sends using an expired session are dropped
+	// until it makes a new handshake.
+	IdleTimeoutSeconds int `yaml:"idleTimeoutSeconds,omitempty" mapstructure:"idleTimeoutSeconds,omitempty"`
+	// DefaultGateway routes all traffic not destined for another peer via this peer (eg. an exit node).
+	// This is equivalent to including 0.0.0.0/0 and ::/0 in the peer's IPs.
+	DefaultGateway bool `yaml:"defaultGateway,omitempty" mapstructure:"defaultGateway,omitempty"`
+	// DisableMulticast stops broadcast and multicast packets from being delivered to the peer,
+	// when multicast is enabled (eg. for an exit node that has no interest in service discovery).
+	DisableMulticast bool `yaml:"disableMulticast,omitempty" mapstructure:"disableMulticast,omitempty"`
+	// RateLimit is an optional limit on the rate of inbound traffic from the peer.
+	RateLimit *RateLimitConfig `yaml:"rateLimit,omitempty" mapstructure:"rateLimit,omitempty"`
+	// OutboundRateLimit is an optional limit on the rate of outbound traffic to the peer.
+	OutboundRateLimit *RateLimitConfig `yaml:"outboundRateLimit,omitempty" mapstructure:"outboundRateLimit,omitempty"`
+	// Compression is an optional algorithm (currently only "snappy") used to compress packets
+	// exchanged with the peer, eg. over low bandwidth links. Packets are only compressed if the
+	// peer has also enabled compression, so this is safe to enable for other WireGuard
+	// implementations, which will simply never agree to it.
+	Compression string `yaml:"compression,omitempty" mapstructure:"compression,omitempty"`
+	// PostQuantum enables a hybrid post-quantum key exchange with the peer, an ML-KEM-768 shared
+	// secret is exchanged and mixed into the preshared key of subsequent handshakes. Both peers
+	// must enable it.
+	PostQuantum bool `yaml:"postQuantum,omitempty" mapstructure:"postQuantum,omitempty"`
+	// RequirePostQuantum refuses to exchange data with the peer using a session that doesn't have
+	// a post-quantum shared secret mixed in (eg. the first session, which is only used to exchange
+	// one). It requires PostQuantum to be enabled.
+	RequirePostQuantum bool `yaml:"requirePostQuantum,omitempty" mapstructure:"requirePostQuantum,omitempty"`
+	// ExpiresAt is an optional time, in RFC 3339 format (eg. "2024-06-01T00:00:00Z"), after which
+	// the peer is automatically removed (eg. for short-lived contractor access). Expired peers are
+	// refused, and skipped when the socket is created or its configuration is reloaded.
+	ExpiresAt string `yaml:"expiresAt,omitempty" mapstructure:"expiresAt,omitempty"`
+}
+
+// IPAMConfig is the configuration for automatic address assignment.
+type IPAMConfig struct {
+	// Prefix is the pool from which addresses are allocated, eg. "10.7.0.0/16".
+	Prefix string `yaml:"prefix" mapstructure:"prefix"`
+	// StatePath is an optional file in which allocations are persisted, so that addresses
+	// remain stable even when they had to differ from the derived address (eg. due to a collision).
+	StatePath string `yaml:"statePath,omitempty" mapstructure:"statePath,omitempty"`
+}
+
+// DNSConfig is the configuration for querying DNS servers.
+type DNSConfig struct {
+	// ViaHostNetwork queries the DNS servers using the host's network, rather than through
+	// the tunnel.
+	ViaHostNetwork bool `yaml:"viaHostNetwork,omitempty" mapstructure:"viaHostNetwork,omitempty"`
+	// BootstrapServers is an optional list of IP addresses of DNS servers used to resolve the
+	// host names of DNS over TLS and HTTPS servers. They are queried in the same way as the
+	// DNS servers. Defaults to the host's resolver.
+	BootstrapServers []string `yaml:"bootstrapServers,omitempty" mapstructure:"bootstrapServers,omitempty"`
+	// CacheSize is the maximum number of responses to cache, each is cached for its TTL.
+	// Zero disables caching.
+	CacheSize int `yaml:"cacheSize,omitempty" mapstructure:"cacheSize,omitempty"`
+}
+
+// DNSRouteConfig is the configuration for resolving the names within a domain.
+type DNSRouteConfig struct {
+	// Domain is the DNS domain (eg. "corp.internal", or "*.corp.internal") the route applies to,
+	// names within it, and the domain itself, are resolved using the route. Reverse lookups can
+	// be routed using the reverse domain (eg. "10.in-addr.arpa").
+	Domain string `yaml:"domain" mapstructure:"domain"`
+	// Servers is the list of DNS servers of the domain, in the same format as DNSServers.
+	Servers []string `yaml:"servers,omitempty" mapstructure:"servers,omitempty"`
+	// UseHostResolver resolves names within the domain using the host's resolver.
+	// It cannot be combined with Servers.
+	UseHostResolver bool `yaml:"useHostResolver,omitempty" mapstructure:"useHostResolver,omitempty"`
+}
+
+// ReverseProxyConfig is the configuration for an HTTP reverse proxy.
+type ReverseProxyConfig struct {
+	// ListenAddress is the address on which to serve, eg. ":80" (or ":443" with TLS).
+	ListenAddress string `yaml:"listenAddress" mapstructure:"listenAddress"`
+	// Routes maps patterns, of the form "[host]/[path]" (eg. "/" or "api.dev/v1/"), to the URLs
+	// of upstreams, eg. "http://127.0.0.1:3000". The most specific matching pattern is used.
+	// Forwarded requests identify the peer they are from with the X-Noisysockets-Peer-Name and
+	// X-Noisysockets-Peer-Public-Key headers.
+	Routes map[string]string `yaml:"routes" mapstructure:"routes"`
+	// CertFile and KeyFile optionally serve HTTPS using the given certificate, and key.
+	CertFile string `yaml:"certFile,omitempty" mapstructure:"certFile,omitempty"`
+	KeyFile  string `yaml:"keyFile,omitempty" mapstructure:"keyFile,omitempty"`
+}
+
+// FloatingIPConfig is the configuration for a virtual address, claimed by one
+// of several peers at a time.
+type FloatingIPConfig struct {
+	// IP is the virtual address (eg. "10.7.0.100"), or prefix. It must not be within the IPs of
+	// any peer.
+	IP string `yaml:"ip" mapstructure:"ip"`
+	// Peers are the names (or public keys) of the peers that can claim the address, in order of
+	// preference, the first is the primary and the rest are standbys. The peers themselves must
+	// accept packets for the address (eg. by listing it in their own IPs).
+	Peers []string `yaml:"peers" mapstructure:"peers"`
+}
+
+// HealthCheckConfig is the configuration for actively checking the health of
+// peers. A zero value for any setting means the default.
+type HealthCheckConfig struct {
+	// IntervalSeconds is how often each peer is pinged. Defaults to 10.
+	IntervalSeconds int `yaml:"intervalSeconds,omitempty" mapstructure:"intervalSeconds,omitempty"`
+	// TimeoutSeconds is how long to wait for a reply to each ping. Defaults to 2.
+	TimeoutSeconds int `yaml:"timeoutSeconds,omitempty" mapstructure:"timeoutSeconds,omitempty"`
+	// UnhealthyThreshold is the number of consecutive pings that must go unanswered before a peer
+	// is considered unhealthy. Defaults to 3.
+	UnhealthyThreshold int `yaml:"unhealthyThreshold,omitempty" mapstructure:"unhealthyThreshold,omitempty"`
+	// HealthyThreshold is the number of consecutive pings that must be answered before a peer is
+	// considered healthy (again). Defaults to 1.
+	HealthyThreshold int `yaml:"healthyThreshold,omitempty" mapstructure:"healthyThreshold,omitempty"`
+}
+
+// TimersConfig adjusts the timers of the Noise protocol. A zero value for any
+// setting means the default (that of WireGuard). Peers should use the same
+// timers, as sessions are rejected once they are older than RejectAfterSeconds.
+type TimersConfig struct {
+	// HandshakeRetrySeconds is how long to wait for a response to a handshake initiation before it
+	// is retried. Defaults to 5, and must be between 1 and 60.
+	HandshakeRetrySeconds int `yaml:"handshakeRetrySeconds,omitempty" mapstructure:"handshakeRetrySeconds,omitempty"`
+	// RekeyAfterSeconds is how old a session can get before a new handshake is made. Defaults to
+	// 120, and must be between 30 and 3600.
+	RekeyAfterSeconds int `yaml:"rekeyAfterSeconds,omitempty" mapstructure:"rekeyAfterSeconds,omitempty"`
+	// RejectAfterSeconds is how old a session can get before its keys are no longer used. Defaults
+	// to 180, it must exceed RekeyAfterSeconds by at least 10 seconds plus HandshakeRetrySeconds
+	// (so that the new handshake can complete), and by at most 3600.
+	RejectAfterSeconds int `yaml:"rejectAfterSeconds,omitempty" mapstructure:"rejectAfterSeconds,omitempty"`
+}
+
+// HandshakeLimitsConfig adjusts how handshake messages are limited, a zero value
+// for any setting means the default. When under load (or always, if
+// AlwaysRequireCookie is set), handshakes are only processed once the initiator
+// has proven that it owns its source address, by replying with a cookie, and
+// are then rate limited per source address.
+type HandshakeLimitsConfig struct {
+	// AlwaysRequireCookie requires handshakes to carry a cookie even when the socket isn't under
+	// load, at the cost of an extra round trip for initiators.
+	AlwaysRequireCookie bool `yaml:"alwaysRequireCookie,omitempty" mapstructure:"alwaysRequireCookie,omitempty"`
+	// UnderLoadThreshold is the number of queued handshake messages at which the socket is
+	// considered under load. Defaults to 128, and must not exceed 1024.
+	UnderLoadThreshold int `yaml:"underLoadThreshold,omitempty" mapstructure:"underLoadThreshold,omitempty"`
+	// PerSourceHandshakesPerSecond is the number of handshake messages per second accepted from
+	// each source address, when cookies are required. Defaults to 20.
+	PerSourceHandshakesPerSecond int `yaml:"perSourceHandshakesPerSecond,omitempty" mapstructure:"perSourceHandshakesPerSecond,omitempty"`
+	// PerSourceBurst is the number of handshake messages from each source address that can be
+	// accepted in a burst, when cookies are required. Defaults to 5.
+	PerSourceBurst int `yaml:"perSourceBurst,omitempty" mapstructure:"perSourceBurst,omitempty"`
+	// MaxConcurrentHandshakes is the number of handshake messages that can be queued, or be
+	// processed, at once. Any more are dropped. Defaults to 1024, and must not exceed it.
+	MaxConcurrentHandshakes int `yaml:"maxConcurrentHandshakes,omitempty" mapstructure:"maxConcurrentHandshakes,omitempty"`
+}
+
+// LANDiscoveryConfig is the configuration for discovering peers on the local
+// network. A zero value for any setting means the default.
+type LANDiscoveryConfig struct {
+	// Group is the multicast group (host:port) to which announcements are sent, and on which they
+	// are received. Defaults to "239.255.78.83:51822".
+	Group string `yaml:"group,omitempty" mapstructure:"group,omitempty"`
+	// IntervalSeconds is how often this socket is announced. Defaults to 5.
+	IntervalSeconds int `yaml:"intervalSeconds,omitempty" mapstructure:"intervalSeconds,omitempty"`
+}
+
+// ObfuscationConfig is the configuration for disguising the packets exchanged with peers.
+type ObfuscationConfig struct {
+	// JunkPackets is the number of packets of random data sent before each handshake initiation
+	// (at most 128), so that the handshake doesn't appear at the start of a flow.
+	JunkPackets int `yaml:"junkPackets,omitempty" mapstructure:"junkPackets,omitempty"`
+	// JunkPacketMinSize, and JunkPacketMaxSize, are the bounds of the size of the junk packets,
+	// in bytes (at most 1280).
+	JunkPacketMinSize int `yaml:"junkPacketMinSize,omitempty" mapstructure:"junkPacketMinSize,omitempty"`
+	JunkPacketMaxSize int `yaml:"junkPacketMaxSize,omitempty" mapstructure:"junkPacketMaxSize,omitempty"`
+	// InitiationPadding, and ResponsePadding, are the number of random bytes (at most 1024)
+	// prepended to handshake initiations and responses, so that they don't have their well known
+	// sizes.
+	InitiationPadding int `yaml:"initiationPadding,omitempty" mapstructure:"initiationPadding,omitempty"`
+	ResponsePadding   int `yaml:"responsePadding,omitempty" mapstructure:"responsePadding,omitempty"`
+	// InitiationMagic, ResponseMagic, CookieReplyMagic, and TransportMagic replace the message
+	// types that WireGuard messages start with (1 to 4), they must be distinct. Zero keeps the
+	// usual value, but randomly chosen values are recommended.
+	InitiationMagic  uint32 `yaml:"initiationMagic,omitempty" mapstructure:"initiationMagic,omitempty"`
+	ResponseMagic    uint32 `yaml:"responseMagic,omitempty" mapstructure:"responseMagic,omitempty"`
+	CookieReplyMagic uint32 `yaml:"cookieReplyMagic,omitempty" mapstructure:"cookieReplyMagic,omitempty"`
+	TransportMagic   uint32 `yaml:"transportMagic,omitempty" mapstructure:"transportMagic,omitempty"`
+}
+
+// RoamingConfig is the configuration for re-binding when the host's network changes.
+type RoamingConfig struct {
+	// IntervalSeconds is how often the host's network interfaces are checked for changes.
+	// Defaults to 2.
+	IntervalSeconds int `yaml:"intervalSeconds,omitempty" mapstructure:"intervalSeconds,omitempty"`
+}
+
+// TuningConfig adjusts the sizes of a socket's packet queues and batches, and how
+// packets are exchanged with the network stack. A zero value for any setting
+// means the default.
+type TuningConfig struct {
+	// QueueSize is the number of outbound packets the network stack can queue (in each queue),
+	// before they are picked up by the transport. Packets sent when the queue is full are dropped.
+	// Defaults to 1024.
+	QueueSize int `yaml:"queueSize,omitempty" mapstructure:"queueSize,omitempty"`
+	// Queues is the number of outbound queues, each is read by its own goroutine so that sending
+	// to several peers can make use of multiple cores. Each peer is assigned to a single queue, so
+	// its packets stay in order. Defaults to 1, and can't exceed 64.
+	Queues int `yaml:"queues,omitempty" mapstructure:"queues,omitempty"`
+	// BatchSize is the maximum number of packets exchanged with the network stack at once, and
+	// the number of datagrams sent, or received, per syscall on the UDP socket (on Linux).
+	// Defaults to, and can't exceed, 128.
+	BatchSize int `yaml:"batchSize,omitempty" mapstructure:"batchSize,omitempty"`
+	// DisableOffload disables segmentation, and receive, offload. By default the network stack
+	// sends, and receives, TCP segments larger than the MTU, that are split into (or merged from)
+	// MTU sized packets on their way to (or from) the transport.
+	DisableOffload bool `yaml:"disableOffload,omitempty" mapstructure:"disableOffload,omitempty"`
+}
+
+// QoSConfig classifies outbound traffic, packets of a class are only sent once there are no packets
+// of a higher priority class waiting. As priority traffic is always sent first, it should be kept to
+// traffic that is light (eg. interactive sessions) and can't starve everything else.
+type QoSConfig struct {
+	// PriorityPorts are the TCP and UDP ports (source or destination) of traffic that is sent ahead of
+	// everything else. Defaults to SSH (22), DNS (53), NTP (123), STUN (3478), and SIP (5060, 5061).
+	PriorityPorts []uint16 `yaml:"priorityPorts,omitempty" mapstructure:"priorityPorts,omitempty"`
+	// BulkPorts are the ports of traffic that is only sent when there is nothing else to send (eg. 873
+	// for rsync).
+	BulkPorts []uint16 `yaml:"bulkPorts,omitempty" mapstructure:"bulkPorts,omitempty"`
+	// IgnoreDSCP classifies traffic by port alone. Otherwise packets marked with DSCP EF, CS5-7, or
+	// AF41-43 are prioritized, and packets marked CS1 (lower effort) are treated as bulk.
+	IgnoreDSCP bool `yaml:"ignoreDSCP,omitempty" mapstructure:"ignoreDSCP,omitempty"`
+}
+
+// StackConfig adjusts the TCP behavior of a socket's network stack. A zero value
+// for any setting means the default. Window scaling and timestamps are always
+// negotiated, the window scale is chosen to fit the receive buffer.
+type StackConfig struct {
+	// SendBufferSize is the size, in bytes, of each TCP connection's send buffer. Defaults to 1MiB.
+	SendBufferSize int `yaml:"sendBufferSize,omitempty" mapstructure:"sendBufferSize,omitempty"`
+	// ReceiveBufferSize is the size, in bytes, that each TCP connection's receive buffer can grow
+	// to (buffers start small and grow with the connection's throughput). Defaults to 4MiB.
+	ReceiveBufferSize int `yaml:"receiveBufferSize,omitempty" mapstructure:"receiveBufferSize,omitempty"`
+	// CongestionControl is the TCP congestion control algorithm, either "reno" (the default) or "cubic".
+	CongestionControl string `yaml:"congestionControl,omitempty" mapstructure:"congestionControl,omitempty"`
+	// DisableSACK disables TCP selective acknowledgements, which are enabled by default.
+	DisableSACK bool `yaml:"disableSACK,omitempty" mapstructure:"disableSACK,omitempty"`
+	// MaxEndpoints is the maximum number of TCP and UDP endpoints (connections, listeners,
+	// and packet conns) that can be open at once. Beyond it, dialing and listening fail with
+	// ErrEndpointLimit, and incoming connections are reset. Defaults to unlimited.
+	MaxEndpoints int `yaml:"maxEndpoints,omitempty" mapstructure:"maxEndpoints,omitempty"`
+	// MaxConnections is the maximum number of TCP connections with peers (accepted, forwarded,
+	// or dialed) that can be open at once. Beyond it, connection attempts from peers are reset.
+	// Defaults to unlimited.
+	MaxConnections int `yaml:"maxConnections,omitempty" mapstructure:"maxConnections,omitempty"`
+	// MaxConnectionsPerPeer is the maximum number of TCP connections with each peer that can be
+	// open at once, so that a single peer can't exhaust the stack's endpoints. Beyond it, the
+	// peer's connection attempts are reset. Defaults to unlimited.
+	MaxConnectionsPerPeer int `yaml:"maxConnectionsPerPeer,omitempty" mapstructure:"maxConnectionsPerPeer,omitempty"`
+	// MemoryLimit is the budget, in bytes, for the buffers of the stack's endpoints. Each
+	// endpoint is assumed to fill its send and receive buffers, so the budget caps the
+	// number of endpoints (as MaxEndpoints does), and connections can no longer grow their
+	// send buffers beyond SendBufferSize. Defaults to unlimited.
+	MemoryLimit int `yaml:"memoryLimit,omitempty" mapstructure:"memoryLimit,omitempty"`
+}
+
+// SocketOptionsConfig is the configuration of the underlying UDP socket.
+type SocketOptionsConfig struct {
+	// BindToDevice binds the socket to a network interface (eg. "eth0"), so that packets are only
+	// sent, and received, via that interface (Linux only, requires CAP_NET_RAW).
+	BindToDevice string `yaml:"bindToDevice,omitempty" mapstructure:"bindToDevice,omitempty"`
+	// FirewallMark marks the socket's packets (SO_MARK), so that policy routing rules can route
+	// them differently from the traffic they carry (Linux only, requires CAP_NET_ADMIN).
+	FirewallMark uint32 `yaml:"firewallMark,omitempty" mapstructure:"firewallMark,omitempty"`
+	// DSCP is the differentiated services code point (0-63) of the socket's packets, eg. 46 for
+	// expedited forwarding.
+	DSCP int `yaml:"dscp,omitempty" mapstructure:"dscp,omitempty"`
+}
+
+// RateLimitConfig is the configuration for a token bucket rate limit.
+// A zero value for either limit means unlimited.
+type RateLimitConfig struct {
+	// PacketsPerSecond is the maximum number of packets per second.
+	PacketsPerSecond uint64 `yaml:"packetsPerSecond,omitempty" mapstructure:"packetsPerSecond,omitempty"`
+	// BytesPerSecond is the maximum number of bytes per second.
+	BytesPerSecond uint64 `yaml:"bytesPerSecond,omitempty" mapstructure:"bytesPerSecond,omitempty"`
 }
 
 func (c Config) GetKind() string {
@@ -0,0 +1,73 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (c) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package config
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"time"
+
+	latest "github.com/noisysockets/noisysockets/config/v1alpha1"
+)
+
+// DefaultWatchInterval is how often the config file is checked for changes,
+// if no interval is specified.
+const DefaultWatchInterval = 5 * time.Second
+
+// Watch checks the config file for changes, at the given interval, invoking
+// onChange with each new config. It blocks until the context is cancelled.
+// Configs that fail to load, or are rejected by onChange, are logged and
+// skipped. For example, to hot reload a socket:
+//
+//	go config.Watch(ctx, logger, configPath, 0, socket.Reload)
+func Watch(ctx context.Context, logger *slog.Logger, configPath string, interval time.Duration, onChange func(conf *latest.Config) error) error {
+	if interval <= 0 {
+		interval = DefaultWatchInterval
+	}
+
+	// Changes are detected by content, as modification times can be coarse,
+	// and some tools (eg. Kubernetes config maps) replace files via symlinks.
+	lastConfBytes, err := os.ReadFile(configPath)
+	if err != nil {
+		logger.Warn("Failed to read config file", "path", configPath, "error", err)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		confBytes, err := os.ReadFile(configPath)
+		if err != nil {
+			logger.Warn("Failed to read config file", "path", configPath, "error", err)
+			continue
+		}
+
+		if bytes.Equal(confBytes, lastConfBytes) {
+			continue
+		}
+		lastConfBytes = confBytes
+
+		conf, err := fromYAMLBytes(configPath, confBytes)
+		if err != nil {
+			logger.Warn("Failed to load config", "path", configPath, "error", err)
+			continue
+		}
+
+		logger.Info("Config changed, reloading", "path", configPath)
+
+		if err := onChange(conf); err != nil {
+			logger.Warn("Failed to apply config", "path", configPath, "error", err)
+		}
+	}
+}
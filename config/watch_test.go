@@ -0,0 +1,71 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (c) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package config_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets/config"
+	latest "github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatch(t *testing.T) {
+	confBytes, err := os.ReadFile("testdata/config.yaml")
+	require.NoError(t, err)
+
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, confBytes, 0o600))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	changes := make(chan *latest.Config, 1)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- config.Watch(ctx, slogt.New(t), configPath, 10*time.Millisecond, func(conf *latest.Config) error {
+			changes <- conf
+			return nil
+		})
+	}()
+
+	// Unchanged configs shouldn't be reported.
+	select {
+	case <-changes:
+		t.Fatal("unexpected config change")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Invalid configs should be skipped.
+	require.NoError(t, os.WriteFile(configPath, []byte("apiVersion: unknown\n"), 0o600))
+
+	select {
+	case <-changes:
+		t.Fatal("unexpected config change")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	updatedConfBytes := strings.ReplaceAll(string(confBytes), "12346", "12347")
+	require.NoError(t, os.WriteFile(configPath, []byte(updatedConfBytes), 0o600))
+
+	select {
+	case conf := <-changes:
+		require.Equal(t, uint16(12347), conf.ListenPort)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for config change")
+	}
+
+	cancel()
+
+	err = <-errCh
+	require.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,194 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+// allowConnection reports whether a packet received from a peer fits within
+// the connection limits. Only connection attempts are limited, those beyond
+// the limits are reset, so that the peer doesn't keep retrying them.
+func (ss *sourceSink) allowConnection(publicKey transport.NoisePublicKey, protoNumber tcpip.NetworkProtocolNumber, pkt []byte) bool {
+	if ss.maxConnections == 0 && ss.maxConnectionsPerPeer == 0 {
+		return true
+	}
+
+	_, protocol, payload, ok := parseACLPacket(protoNumber, pkt)
+	if !ok || protocol != uint8(header.TCPProtocolNumber) || len(payload) < header.TCPMinimumSize {
+		return true
+	}
+
+	syn := header.TCP(payload)
+	if syn.Flags()&(header.TCPFlagSyn|header.TCPFlagAck) != header.TCPFlagSyn {
+		return true
+	}
+
+	id := stack.TransportEndpointID{
+		LocalPort:     syn.DestinationPort(),
+		RemotePort:    syn.SourcePort(),
+		LocalAddress:  inboundDestination(protoNumber, pkt),
+		RemoteAddress: inboundSourceAddress(protoNumber, pkt),
+	}
+
+	conns, peerConns, existing := ss.countConnections(publicKey, id)
+	// Retransmitted SYNs belong to a connection that was already allowed.
+	if existing {
+		return true
+	}
+
+	if (ss.maxConnectionsPerPeer == 0 || peerConns < ss.maxConnectionsPerPeer) &&
+		(ss.maxConnections == 0 || conns < ss.maxConnections) {
+		return true
+	}
+
+	ss.rejectedConnections.Add(1)
+
+	ss.peersMu.RLock()
+	if rejected, ok := ss.peerRejectedConnections[publicKey]; ok {
+		rejected.Add(1)
+	}
+	ss.peersMu.RUnlock()
+
+	ss.sendReset(protoNumber, pkt, syn)
+
+	return false
+}
+
+// countConnections counts the open TCP connections (that aren't closing) with
+// peers, and those with the given peer. It also reports whether there is
+// already a connection with the given ID (eg. one that is being established).
+func (ss *sourceSink) countConnections(publicKey transport.NoisePublicKey, id stack.TransportEndpointID) (int, int, bool) {
+	perPeer, found := ss.connectionsPerPeer(&id)
+	if found {
+		return 0, 0, true
+	}
+
+	var conns int
+	for _, n := range perPeer {
+		conns += n
+	}
+
+	return conns, perPeer[publicKey], false
+}
+
+// connectionsPerPeer counts the open TCP connections (that aren't closing) of
+// each peer. If find is set, counting stops once a connection with that ID is
+// found, and it reports true.
+func (ss *sourceSink) connectionsPerPeer(find *stack.TransportEndpointID) (map[transport.NoisePublicKey]int, bool) {
+	ss.peersMu.RLock()
+	defer ss.peersMu.RUnlock()
+
+	conns := make(map[transport.NoisePublicKey]int)
+	for _, ep := range ss.stack.RegisteredEndpoints() {
+		tep, ok := ep.(tcpip.Endpoint)
+		if !ok {
+			continue
+		}
+
+		info, ok := tep.Info().(*stack.TransportEndpointInfo)
+		if !ok || info.TransProto != tcp.ProtocolNumber || info.ID.RemotePort == 0 {
+			continue
+		}
+
+		switch tcp.EndpointState(tep.State()) {
+		case tcp.StateEstablished, tcp.StateSynSent, tcp.StateSynRecv, tcp.StateCloseWait:
+		default:
+			continue
+		}
+
+		if find != nil && info.ID == *find {
+			return nil, true
+		}
+
+		remoteAddr := endpointAddrPort(info.NetProto, info.ID.RemoteAddress, info.ID.RemotePort)
+		if pk, ok := ss.fromPeerAddress.Lookup(remoteAddr.Addr()); ok {
+			conns[pk]++
+		}
+	}
+
+	return conns, false
+}
+
+// inboundDestination returns the destination address of an inbound packet.
+func inboundDestination(protoNumber tcpip.NetworkProtocolNumber, pkt []byte) tcpip.Address {
+	if protoNumber == header.IPv4ProtocolNumber {
+		return header.IPv4(pkt).DestinationAddress()
+	}
+
+	return header.IPv6(pkt).DestinationAddress()
+}
+
+// inboundSourceAddress returns the source address of an inbound packet.
+func inboundSourceAddress(protoNumber tcpip.NetworkProtocolNumber, pkt []byte) tcpip.Address {
+	if protoNumber == header.IPv4ProtocolNumber {
+		return header.IPv4(pkt).SourceAddress()
+	}
+
+	return header.IPv6(pkt).SourceAddress()
+}
+
+// sendReset queues a TCP RST, in reply to a SYN, to be sent back to its
+// source.
+func (ss *sourceSink) sendReset(protoNumber tcpip.NetworkProtocolNumber, pkt []byte, syn header.TCP) {
+	src, dst := inboundDestination(protoNumber, pkt), inboundSourceAddress(protoNumber, pkt)
+
+	hdrLen := header.IPv4MinimumSize
+	if protoNumber == header.IPv6ProtocolNumber {
+		hdrLen = header.IPv6MinimumSize
+	}
+
+	reply := make([]byte, hdrLen+header.TCPMinimumSize)
+	if protoNumber == header.IPv4ProtocolNumber {
+		replyHdr := header.IPv4(reply)
+		replyHdr.Encode(&header.IPv4Fields{
+			TotalLength: uint16(len(reply)),
+			TTL:         defaultProbeTTL,
+			Protocol:    uint8(header.TCPProtocolNumber),
+			SrcAddr:     src,
+			DstAddr:     dst,
+		})
+		replyHdr.SetChecksum(^replyHdr.CalculateChecksum())
+	} else {
+		replyHdr := header.IPv6(reply)
+		replyHdr.Encode(&header.IPv6Fields{
+			PayloadLength:     header.TCPMinimumSize,
+			TransportProtocol: header.TCPProtocolNumber,
+			HopLimit:          defaultProbeTTL,
+			SrcAddr:           src,
+			DstAddr:           dst,
+		})
+	}
+
+	// The SYN (and any data it carries) is acknowledged, so that the reset is
+	// accepted (RFC 9293, 3.10.7.1).
+	var synLen int
+	if dataOffset := int(syn.DataOffset()); dataOffset >= header.TCPMinimumSize && dataOffset <= len(syn) {
+		synLen = len(syn) - dataOffset
+	}
+
+	tcpHdr := header.TCP(reply[hdrLen:])
+	tcpHdr.Encode(&header.TCPFields{
+		SrcPort:    syn.DestinationPort(),
+		DstPort:    syn.SourcePort(),
+		AckNum:     syn.SequenceNumber() + 1 + uint32(synLen),
+		DataOffset: header.TCPMinimumSize,
+		Flags:      header.TCPFlagRst | header.TCPFlagAck,
+	})
+	tcpHdr.SetChecksum(^tcpHdr.CalculateChecksum(header.PseudoHeaderChecksum(header.TCPProtocolNumber, src, dst, header.TCPMinimumSize)))
+
+	replyPkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(reply)})
+	replyPkt.NetworkProtocolNumber = protoNumber
+	_, _ = replyPkt.NetworkHeader().Consume(hdrLen)
+
+	ss.queueOutbound(replyPkt)
+	replyPkt.DecRef()
+}
@@ -0,0 +1,114 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets_test
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoisySocket_ConnectionLimits(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverSocket, clientSocket, err := noisysockets.Pipe(logger, &v1alpha1.Config{
+		Name:       "server",
+		PrivateKey: serverPrivateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{{
+			Name:      "client",
+			PublicKey: clientPrivateKey.PublicKey().String(),
+			IPs:       []string{"10.7.0.2"},
+		}},
+		Stack: &v1alpha1.StackConfig{
+			MaxConnectionsPerPeer: 2,
+		},
+	}, &v1alpha1.Config{
+		Name:       "client",
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{{
+			Name:      "server",
+			PublicKey: serverPrivateKey.PublicKey().String(),
+			IPs:       []string{"10.7.0.1"},
+		}},
+	}, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+		require.NoError(t, clientSocket.Close())
+	})
+
+	lis, err := serverSocket.Listen("tcp", ":80")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = lis.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := clientSocket.Dial("tcp", "server:80")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+
+		conns = append(conns, conn)
+	}
+
+	// The connection attempt beyond the limit is reset.
+	_, err = clientSocket.Dial("tcp", "server:80")
+	require.ErrorContains(t, err, "connection refused")
+
+	status, err := serverSocket.PeerStatus("client")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), status.RejectedConnections)
+
+	stackStats := serverSocket.StackStats()
+	require.Equal(t, uint64(1), stackStats.TCP.RejectedConnections)
+
+	// Once a connection is closed, there is room for another.
+	require.NoError(t, conns[0].Close())
+
+	require.Eventually(t, func() bool {
+		conn, err := clientSocket.Dial("tcp", "server:80")
+		if err != nil {
+			return false
+		}
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+
+		return true
+	}, 5*time.Second, 100*time.Millisecond)
+}
@@ -0,0 +1,201 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// Connections returns the TCP and UDP endpoints of the socket's network stack,
+// much like `ss` or `netstat`. This includes connections with peers, flows
+// forwarded to the host's network, and listeners. They are ordered by network,
+// then local, and remote address.
+func (n *noisyNet) Connections() []ConnectionStats {
+	return n.connections(func(tcpip.TransportProtocolNumber, uint32) bool {
+		return true
+	})
+}
+
+// connections returns the TCP and UDP endpoints, of the given protocol and
+// state, that the include function returns true for.
+func (n *noisyNet) connections(include func(transProto tcpip.TransportProtocolNumber, state uint32) bool) []ConnectionStats {
+	var conns []ConnectionStats
+	for _, ep := range n.stack.RegisteredEndpoints() {
+		tep, ok := ep.(tcpip.Endpoint)
+		if !ok {
+			continue
+		}
+
+		info, ok := tep.Info().(*stack.TransportEndpointInfo)
+		if !ok {
+			continue
+		}
+
+		state := tep.State()
+		if !include(info.TransProto, state) {
+			continue
+		}
+
+		var conn ConnectionStats
+		switch info.TransProto {
+		case tcp.ProtocolNumber:
+			conn.Network = "tcp"
+			conn.State = tcpStateString(tcp.EndpointState(state))
+
+			var tcpInfo tcpip.TCPInfoOption
+			if err := tep.GetSockOpt(&tcpInfo); err == nil {
+				conn.RTT = tcpInfo.RTT
+			}
+		case udp.ProtocolNumber:
+			conn.Network = "udp"
+			conn.State = udpStateString(transport.DatagramEndpointState(state))
+		default:
+			continue
+		}
+
+		conn.BytesReceived, conn.BytesSent = n.connBytes.get(tep)
+
+		conn.LocalAddr = endpointAddrPort(info.NetProto, info.ID.LocalAddress, info.ID.LocalPort)
+
+		if info.ID.RemotePort != 0 {
+			conn.RemoteAddr = endpointAddrPort(info.NetProto, info.ID.RemoteAddress, info.ID.RemotePort)
+
+			identity := n.peerIdentity(net.TCPAddrFromAddrPort(conn.RemoteAddr))
+			conn.PeerName = identity.PeerName()
+			conn.PeerPublicKey = identity.PeerPublicKey()
+		}
+
+		conns = append(conns, conn)
+	}
+
+	slices.SortFunc(conns, func(a, b ConnectionStats) int {
+		if c := strings.Compare(a.Network, b.Network); c != 0 {
+			return c
+		}
+		if c := compareAddrPort(a.LocalAddr, b.LocalAddr); c != 0 {
+			return c
+		}
+		return compareAddrPort(a.RemoteAddr, b.RemoteAddr)
+	})
+
+	return conns
+}
+
+// connBytes counts the bytes read from, and written to, the stack's TCP and
+// UDP endpoints by the socket's connections. The stack only counts segments.
+type connBytes struct {
+	mu       sync.Mutex
+	counters map[tcpip.Endpoint]*byteCounters
+}
+
+type byteCounters struct {
+	sent     atomic.Uint64
+	received atomic.Uint64
+}
+
+// track starts counting the bytes of an endpoint, until it is closed. The
+// returned endpoint must be used to read from, and write to, the endpoint.
+func (c *connBytes) track(ep tcpip.Endpoint, wq *waiter.Queue) tcpip.Endpoint {
+	counters := &byteCounters{}
+
+	c.mu.Lock()
+	if c.counters == nil {
+		c.counters = make(map[tcpip.Endpoint]*byteCounters)
+	}
+	c.counters[ep] = counters
+	c.mu.Unlock()
+
+	entry := waiter.NewFunctionEntry(waiter.EventHUp, func(waiter.EventMask) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		delete(c.counters, ep)
+	})
+	wq.EventRegister(&entry)
+
+	return &countingEndpoint{Endpoint: ep, counters: counters}
+}
+
+// get returns the number of bytes received, and sent, by an endpoint.
+func (c *connBytes) get(ep tcpip.Endpoint) (received, sent uint64) {
+	c.mu.Lock()
+	counters, ok := c.counters[ep]
+	c.mu.Unlock()
+
+	if !ok {
+		return 0, 0
+	}
+
+	return counters.received.Load(), counters.sent.Load()
+}
+
+// countingEndpoint is an endpoint that counts the bytes read from, and
+// written to, it.
+type countingEndpoint struct {
+	tcpip.Endpoint
+	counters *byteCounters
+}
+
+func (e *countingEndpoint) Read(w io.Writer, opts tcpip.ReadOptions) (tcpip.ReadResult, tcpip.Error) {
+	res, err := e.Endpoint.Read(w, opts)
+	if !opts.Peek {
+		e.counters.received.Add(uint64(res.Count))
+	}
+	return res, err
+}
+
+func (e *countingEndpoint) Write(p tcpip.Payloader, opts tcpip.WriteOptions) (int64, tcpip.Error) {
+	n, err := e.Endpoint.Write(p, opts)
+	e.counters.sent.Add(uint64(n))
+	return n, err
+}
+
+// endpointAddrPort converts the address of an endpoint, endpoints that aren't
+// bound to an address have the unspecified address.
+func endpointAddrPort(netProto tcpip.NetworkProtocolNumber, addr tcpip.Address, port uint16) netip.AddrPort {
+	ip, ok := netip.AddrFromSlice(addr.AsSlice())
+	if !ok {
+		if netProto == ipv6.ProtocolNumber {
+			ip = netip.IPv6Unspecified()
+		} else {
+			ip = netip.IPv4Unspecified()
+		}
+	}
+
+	return netip.AddrPortFrom(ip.Unmap(), port)
+}
+
+// The String methods of the stack's endpoint states panic on unknown states.
+
+func tcpStateString(state tcp.EndpointState) string {
+	if state < tcp.StateEstablished || state > tcp.StateError {
+		return "UNKNOWN"
+	}
+
+	return state.String()
+}
+
+func udpStateString(state transport.DatagramEndpointState) string {
+	if state < transport.DatagramEndpointStateInitial || state > transport.DatagramEndpointStateClosed {
+		return "UNKNOWN"
+	}
+
+	return state.String()
+}
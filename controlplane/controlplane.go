@@ -0,0 +1,319 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+// Package controlplane implements a client, and a reference server, for
+// synchronizing the peers of a socket with an authoritative peer list held by
+// a coordination server.
+//
+// The client long-polls the server for new versions of the peer list, and
+// applies the differences using the socket's AddPeer, UpdatePeer, and
+// RemovePeer methods. Peer lists are signed by the server with an Ed25519 key,
+// and clients reject lists that aren't signed by the expected key, or that are
+// older than the list they already have, so that the channel between the
+// client and server doesn't have to be trusted.
+//
+// Peer lists can also be distributed out of band as manifests (eg. baked into
+// an image, or downloaded from a bucket), signed by the network's CA key. See
+// AddPeersFromManifest.
+package controlplane
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+)
+
+const (
+	// defaultWait is how long the server is asked to hold a poll open, waiting
+	// for the peer list to change.
+	defaultWait = 30 * time.Second
+	// maxWait is the longest the server will hold a poll open.
+	maxWait = 2 * time.Minute
+	// minRetryDelay is how long to wait before polling again after a failure,
+	// it is doubled after each consecutive failure.
+	minRetryDelay = time.Second
+	// maxRetryDelay is the upper bound on the retry delay.
+	maxRetryDelay = time.Minute
+	// maxResponseSize is the largest response accepted from the server.
+	maxResponseSize = 16 << 20
+)
+
+var (
+	// ErrInvalidSignature is returned when a peer list isn't signed by the
+	// expected key.
+	ErrInvalidSignature = errors.New("invalid peer list signature")
+	// ErrStaleVersion is returned when a peer list is older than the list that
+	// has already been applied (eg. it is being replayed).
+	ErrStaleVersion = errors.New("stale peer list version")
+)
+
+// PeerList is the authoritative list of peers.
+type PeerList struct {
+	// Version increases whenever the list changes.
+	Version uint64 `json:"version"`
+	// Peers are the peers that sockets should have.
+	Peers []v1alpha1.WireGuardPeerConfig `json:"peers"`
+}
+
+// SignedPeerList is a peer list, along with the server's signature of it.
+type SignedPeerList struct {
+	// PeerList is the JSON encoded PeerList.
+	PeerList json.RawMessage `json:"peerList"`
+	// Signature is the Ed25519 signature of PeerList.
+	Signature []byte `json:"signature"`
+}
+
+// Sign encodes and signs a peer list.
+func Sign(privateKey ed25519.PrivateKey, peerList *PeerList) (*SignedPeerList, error) {
+	payload, err := json.Marshal(peerList)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal peer list: %w", err)
+	}
+
+	return &SignedPeerList{
+		PeerList:  payload,
+		Signature: ed25519.Sign(privateKey, payload),
+	}, nil
+}
+
+// Verify checks the signature of a peer list, and returns the decoded list.
+func (s *SignedPeerList) Verify(publicKey ed25519.PublicKey) (*PeerList, error) {
+	if !ed25519.Verify(publicKey, s.PeerList, s.Signature) {
+		return nil, ErrInvalidSignature
+	}
+
+	var peerList PeerList
+	if err := json.Unmarshal(s.PeerList, &peerList); err != nil {
+		return nil, fmt.Errorf("could not unmarshal peer list: %w", err)
+	}
+
+	return &peerList, nil
+}
+
+// PeerManager is implemented by sockets (eg. *noisysockets.NoisySocket) whose
+// peers are synchronized with the peer list.
+type PeerManager interface {
+	AddPeer(peerConf v1alpha1.WireGuardPeerConfig) error
+	UpdatePeer(peerConf v1alpha1.WireGuardPeerConfig) error
+	RemovePeer(publicKey string) error
+}
+
+// ClientOption configures a Client.
+type ClientOption func(*Client)
+
+// WithHTTPClient sets the HTTP client used to poll the server, eg. to dial the
+// server through the mesh. It defaults to http.DefaultClient.
+func WithHTTPClient(httpClient *http.Client) ClientOption {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithWait sets how long the server is asked to hold each poll open, waiting
+// for the peer list to change. It defaults to 30 seconds.
+func WithWait(wait time.Duration) ClientOption {
+	return func(c *Client) {
+		c.wait = wait
+	}
+}
+
+// Client synchronizes the peers of a socket with the peer list held by a
+// coordination server.
+type Client struct {
+	logger     *slog.Logger
+	url        string
+	publicKey  ed25519.PublicKey
+	peers      PeerManager
+	httpClient *http.Client
+	wait       time.Duration
+	// version is the version of the most recently applied peer list.
+	version uint64
+	// installed are the peers that have been added by the client, keyed by
+	// their public key.
+	installed map[string]v1alpha1.WireGuardPeerConfig
+}
+
+// NewClient creates a new control plane client, that polls the server at the
+// given URL for peer lists signed by the given public key, and applies them
+// to peers.
+func NewClient(logger *slog.Logger, url string, publicKey ed25519.PublicKey, peers PeerManager, opts ...ClientOption) *Client {
+	c := &Client{
+		logger:     logger,
+		url:        url,
+		publicKey:  publicKey,
+		peers:      peers,
+		httpClient: http.DefaultClient,
+		wait:       defaultWait,
+		installed:  make(map[string]v1alpha1.WireGuardPeerConfig),
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// Run polls the server for changes to the peer list, and applies them, until
+// the context is done. Failures are retried with an exponential backoff.
+func (c *Client) Run(ctx context.Context) error {
+	delay := minRetryDelay
+	for {
+		if err := c.Sync(ctx); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			c.logger.Warn("Failed to synchronize peers", "delay", delay, "error", err)
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+
+			delay = min(2*delay, maxRetryDelay)
+			continue
+		}
+
+		delay = minRetryDelay
+	}
+}
+
+// Sync polls the server once, waiting for the peer list to change if it is
+// already up to date, and applies the new list (if any).
+func (c *Client) Sync(ctx context.Context) error {
+	peerList, err := c.poll(ctx)
+	if err != nil {
+		return err
+	}
+
+	// The peer list hasn't changed.
+	if peerList == nil {
+		return nil
+	}
+
+	if c.version != 0 && peerList.Version <= c.version {
+		return fmt.Errorf("%w: %d", ErrStaleVersion, peerList.Version)
+	}
+
+	if err := c.apply(peerList.Peers); err != nil {
+		return err
+	}
+
+	c.version = peerList.Version
+
+	return nil
+}
+
+// poll fetches the peer list from the server, or returns nil if it didn't
+// change within the wait.
+func (c *Client) poll(ctx context.Context) (*PeerList, error) {
+	u, err := url.Parse(c.url)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse url: %w", err)
+	}
+
+	query := u.Query()
+	query.Set("version", strconv.FormatUint(c.version, 10))
+	query.Set("wait", strconv.Itoa(int(c.wait.Seconds())))
+	u.RawQuery = query.Encode()
+
+	// Allow the server some slack, beyond the wait, to respond.
+	ctx, cancel := context.WithTimeout(ctx, c.wait+10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %w", err)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not poll server: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	var signed SignedPeerList
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&signed); err != nil {
+		return nil, fmt.Errorf("could not decode response: %w", err)
+	}
+
+	return signed.Verify(c.publicKey)
+}
+
+// apply adds, updates, and removes peers so that they match the peer list.
+func (c *Client) apply(peers []v1alpha1.WireGuardPeerConfig) error {
+	desired := make(map[string]v1alpha1.WireGuardPeerConfig, len(peers))
+	for _, peerConf := range peers {
+		if _, ok := desired[peerConf.PublicKey]; ok {
+			return fmt.Errorf("duplicate peer %s", peerConf.PublicKey)
+		}
+		desired[peerConf.PublicKey] = peerConf
+	}
+
+	var errs []error
+
+	// Removals come first, so that addresses are freed up for other peers.
+	for publicKey := range c.installed {
+		if _, ok := desired[publicKey]; ok {
+			continue
+		}
+
+		if err := c.peers.RemovePeer(publicKey); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove peer %s: %w", publicKey, err))
+			continue
+		}
+		delete(c.installed, publicKey)
+
+		c.logger.Debug("Removed peer", "peer", publicKey)
+	}
+
+	for _, peerConf := range peers {
+		installed, ok := c.installed[peerConf.PublicKey]
+		if ok && reflect.DeepEqual(installed, peerConf) {
+			continue
+		}
+
+		if ok {
+			if err := c.peers.UpdatePeer(peerConf); err != nil {
+				errs = append(errs, fmt.Errorf("failed to update peer %s: %w", peerConf.PublicKey, err))
+				continue
+			}
+
+			c.logger.Debug("Updated peer", "peer", peerConf.PublicKey)
+		} else {
+			if err := c.peers.AddPeer(peerConf); err != nil {
+				errs = append(errs, fmt.Errorf("failed to add peer %s: %w", peerConf.PublicKey, err))
+				continue
+			}
+
+			c.logger.Debug("Added peer", "peer", peerConf.PublicKey)
+		}
+
+		c.installed[peerConf.PublicKey] = peerConf
+	}
+
+	return errors.Join(errs...)
+}
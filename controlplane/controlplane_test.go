@@ -0,0 +1,278 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package controlplane
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestControlPlane(t *testing.T) {
+	logger := slogt.New(t)
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	srv, err := NewServer(logger, privateKey)
+	require.NoError(t, err)
+
+	ts := httptest.NewServer(srv)
+	t.Cleanup(ts.Close)
+
+	alice := v1alpha1.WireGuardPeerConfig{Name: "alice", PublicKey: "alice-key", IPs: []string{"10.7.0.2"}}
+	bob := v1alpha1.WireGuardPeerConfig{Name: "bob", PublicKey: "bob-key", IPs: []string{"10.7.0.3"}}
+
+	require.NoError(t, srv.SetPeers([]v1alpha1.WireGuardPeerConfig{alice, bob}))
+
+	peers := newFakePeerManager()
+	c := NewClient(logger, ts.URL, publicKey, peers, WithWait(time.Second))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	t.Cleanup(cancel)
+
+	require.NoError(t, c.Sync(ctx))
+	require.Equal(t, map[string]v1alpha1.WireGuardPeerConfig{
+		"alice-key": alice,
+		"bob-key":   bob,
+	}, peers.snapshot())
+
+	t.Run("Not Modified", func(t *testing.T) {
+		start := time.Now()
+		require.NoError(t, c.Sync(ctx))
+		require.GreaterOrEqual(t, time.Since(start), time.Second)
+		require.Len(t, peers.snapshot(), 2)
+	})
+
+	t.Run("Long Poll", func(t *testing.T) {
+		c.wait = 10 * time.Second
+
+		alice.Endpoint = "192.0.2.2:51820"
+
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			_ = srv.SetPeers([]v1alpha1.WireGuardPeerConfig{alice})
+		}()
+
+		start := time.Now()
+		require.NoError(t, c.Sync(ctx))
+		require.Less(t, time.Since(start), 5*time.Second)
+
+		require.Equal(t, map[string]v1alpha1.WireGuardPeerConfig{
+			"alice-key": alice,
+		}, peers.snapshot())
+	})
+
+	t.Run("Run", func(t *testing.T) {
+		peers := newFakePeerManager()
+		c := NewClient(logger, ts.URL, publicKey, peers, WithWait(time.Second))
+
+		ctx, cancel := context.WithCancel(ctx)
+		done := make(chan error, 1)
+		go func() {
+			done <- c.Run(ctx)
+		}()
+
+		require.Eventually(t, func() bool {
+			return len(peers.snapshot()) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+
+		require.NoError(t, srv.SetPeers([]v1alpha1.WireGuardPeerConfig{alice, bob}))
+
+		require.Eventually(t, func() bool {
+			return len(peers.snapshot()) == 2
+		}, 5*time.Second, 10*time.Millisecond)
+
+		cancel()
+		require.ErrorIs(t, <-done, context.Canceled)
+	})
+
+	t.Run("Invalid Signature", func(t *testing.T) {
+		otherPublicKey, _, err := ed25519.GenerateKey(nil)
+		require.NoError(t, err)
+
+		peers := newFakePeerManager()
+		c := NewClient(logger, ts.URL, otherPublicKey, peers)
+
+		require.ErrorIs(t, c.Sync(ctx), ErrInvalidSignature)
+		require.Empty(t, peers.snapshot())
+	})
+
+	t.Run("Tampered", func(t *testing.T) {
+		signed, err := Sign(privateKey, &PeerList{Version: 1, Peers: []v1alpha1.WireGuardPeerConfig{alice}})
+		require.NoError(t, err)
+
+		var peerList PeerList
+		require.NoError(t, json.Unmarshal(signed.PeerList, &peerList))
+		peerList.Peers = append(peerList.Peers, v1alpha1.WireGuardPeerConfig{Name: "mallory", PublicKey: "mallory-key"})
+
+		signed.PeerList, err = json.Marshal(&peerList)
+		require.NoError(t, err)
+
+		_, err = signed.Verify(publicKey)
+		require.ErrorIs(t, err, ErrInvalidSignature)
+	})
+
+	t.Run("Stale Version", func(t *testing.T) {
+		signed, err := Sign(privateKey, &PeerList{Version: 1})
+		require.NoError(t, err)
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_ = json.NewEncoder(w).Encode(signed)
+		}))
+		t.Cleanup(ts.Close)
+
+		peers := newFakePeerManager()
+		c := NewClient(logger, ts.URL, publicKey, peers)
+		c.version = 2
+
+		require.ErrorIs(t, c.Sync(ctx), ErrStaleVersion)
+	})
+}
+
+func TestAddPeersFromManifest(t *testing.T) {
+	caPublicKey, caPrivateKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	alice := v1alpha1.WireGuardPeerConfig{Name: "alice", PublicKey: "alice-key", IPs: []string{"10.7.0.2"}}
+	bob := v1alpha1.WireGuardPeerConfig{Name: "bob", PublicKey: "bob-key", IPs: []string{"10.7.0.3"}}
+
+	manifest, err := NewManifest(caPrivateKey, 1, []v1alpha1.WireGuardPeerConfig{alice, bob})
+	require.NoError(t, err)
+
+	t.Run("Signed", func(t *testing.T) {
+		peers := newFakePeerManager()
+		require.NoError(t, AddPeersFromManifest(peers, manifest, caPublicKey))
+
+		require.Equal(t, map[string]v1alpha1.WireGuardPeerConfig{
+			"alice-key": alice,
+			"bob-key":   bob,
+		}, peers.snapshot())
+	})
+
+	t.Run("Unsigned", func(t *testing.T) {
+		var signed SignedPeerList
+		require.NoError(t, json.Unmarshal(manifest, &signed))
+		signed.Signature = nil
+
+		unsigned, err := json.Marshal(&signed)
+		require.NoError(t, err)
+
+		peers := newFakePeerManager()
+		require.ErrorIs(t, AddPeersFromManifest(peers, unsigned, caPublicKey), ErrInvalidSignature)
+		require.Empty(t, peers.snapshot())
+	})
+
+	t.Run("Tampered", func(t *testing.T) {
+		var signed SignedPeerList
+		require.NoError(t, json.Unmarshal(manifest, &signed))
+
+		var peerList PeerList
+		require.NoError(t, json.Unmarshal(signed.PeerList, &peerList))
+		peerList.Peers[1].IPs = []string{"0.0.0.0/0"}
+
+		signed.PeerList, err = json.Marshal(&peerList)
+		require.NoError(t, err)
+
+		tampered, err := json.Marshal(&signed)
+		require.NoError(t, err)
+
+		peers := newFakePeerManager()
+		require.ErrorIs(t, AddPeersFromManifest(peers, tampered, caPublicKey), ErrInvalidSignature)
+		require.Empty(t, peers.snapshot())
+	})
+
+	t.Run("Wrong CA", func(t *testing.T) {
+		otherPublicKey, _, err := ed25519.GenerateKey(nil)
+		require.NoError(t, err)
+
+		peers := newFakePeerManager()
+		require.ErrorIs(t, AddPeersFromManifest(peers, manifest, otherPublicKey), ErrInvalidSignature)
+		require.Empty(t, peers.snapshot())
+	})
+
+	t.Run("Rolled Back", func(t *testing.T) {
+		peers := newFakePeerManager()
+		require.NoError(t, peers.AddPeer(bob))
+
+		require.Error(t, AddPeersFromManifest(peers, manifest, caPublicKey))
+		require.Equal(t, map[string]v1alpha1.WireGuardPeerConfig{
+			"bob-key": bob,
+		}, peers.snapshot())
+	})
+}
+
+var _ PeerManager = (*noisysockets.NoisySocket)(nil)
+
+type fakePeerManager struct {
+	mu    sync.Mutex
+	peers map[string]v1alpha1.WireGuardPeerConfig
+}
+
+func newFakePeerManager() *fakePeerManager {
+	return &fakePeerManager{
+		peers: make(map[string]v1alpha1.WireGuardPeerConfig),
+	}
+}
+
+func (m *fakePeerManager) AddPeer(peerConf v1alpha1.WireGuardPeerConfig) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.peers[peerConf.PublicKey]; ok {
+		return fmt.Errorf("peer %s already exists", peerConf.PublicKey)
+	}
+	m.peers[peerConf.PublicKey] = peerConf
+
+	return nil
+}
+
+func (m *fakePeerManager) UpdatePeer(peerConf v1alpha1.WireGuardPeerConfig) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.peers[peerConf.PublicKey]; !ok {
+		return fmt.Errorf("unknown peer %s", peerConf.PublicKey)
+	}
+	m.peers[peerConf.PublicKey] = peerConf
+
+	return nil
+}
+
+func (m *fakePeerManager) RemovePeer(publicKey string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.peers[publicKey]; !ok {
+		return fmt.Errorf("unknown peer %s", publicKey)
+	}
+	delete(m.peers, publicKey)
+
+	return nil
+}
+
+func (m *fakePeerManager) snapshot() map[string]v1alpha1.WireGuardPeerConfig {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	peers := make(map[string]v1alpha1.WireGuardPeerConfig, len(m.peers))
+	for publicKey, peerConf := range m.peers {
+		peers[publicKey] = peerConf
+	}
+
+	return peers
+}
@@ -0,0 +1,68 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package controlplane
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+)
+
+// NewManifest creates a manifest of peers, signed with the network's CA key.
+func NewManifest(caPrivateKey ed25519.PrivateKey, version uint64, peers []v1alpha1.WireGuardPeerConfig) ([]byte, error) {
+	signed, err := Sign(caPrivateKey, &PeerList{
+		Version: version,
+		Peers:   peers,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(signed)
+}
+
+// VerifyManifest checks that a manifest is signed by the network's CA key, and
+// returns its peers. Unsigned, or tampered with, manifests are rejected with
+// ErrInvalidSignature.
+func VerifyManifest(manifest []byte, caPublicKey ed25519.PublicKey) (*PeerList, error) {
+	var signed SignedPeerList
+	if err := json.Unmarshal(manifest, &signed); err != nil {
+		return nil, fmt.Errorf("could not unmarshal manifest: %w", err)
+	}
+
+	return signed.Verify(caPublicKey)
+}
+
+// AddPeersFromManifest verifies a manifest, and only if it is signed by the
+// network's CA key, adds its peers. Either all of the peers are added, or none
+// of them are.
+func AddPeersFromManifest(peers PeerManager, manifest []byte, caPublicKey ed25519.PublicKey) error {
+	peerList, err := VerifyManifest(manifest, caPublicKey)
+	if err != nil {
+		return err
+	}
+
+	var added []string
+	for _, peerConf := range peerList.Peers {
+		if err := peers.AddPeer(peerConf); err != nil {
+			errs := []error{fmt.Errorf("failed to add peer %s: %w", peerConf.PublicKey, err)}
+			for _, publicKey := range added {
+				if err := peers.RemovePeer(publicKey); err != nil {
+					errs = append(errs, fmt.Errorf("failed to remove peer %s: %w", publicKey, err))
+				}
+			}
+
+			return errors.Join(errs...)
+		}
+
+		added = append(added, peerConf.PublicKey)
+	}
+
+	return nil
+}
@@ -0,0 +1,137 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package controlplane
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+)
+
+// Server is a reference coordination server, it serves the peer list to
+// clients over HTTP, holding polls open until the list changes.
+type Server struct {
+	logger     *slog.Logger
+	privateKey ed25519.PrivateKey
+
+	mu      sync.Mutex // protects all fields below
+	version uint64
+	signed  []byte
+	// changed is closed, and replaced, whenever the peer list changes.
+	changed chan struct{}
+}
+
+// NewServer creates a new coordination server, that signs peer lists with the
+// given private key. The server has an empty peer list until SetPeers is
+// called.
+func NewServer(logger *slog.Logger, privateKey ed25519.PrivateKey) (*Server, error) {
+	s := &Server{
+		logger:     logger,
+		privateKey: privateKey,
+		changed:    make(chan struct{}),
+	}
+
+	if err := s.SetPeers(nil); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// SetPeers replaces the peer list, waking up any clients waiting for it to
+// change.
+func (s *Server) SetPeers(peers []v1alpha1.WireGuardPeerConfig) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Versions are derived from the clock, so that they keep increasing across
+	// restarts of the server (clients reject versions that go backwards).
+	version := max(s.version+1, uint64(time.Now().UnixMicro()))
+
+	signed, err := Sign(s.privateKey, &PeerList{
+		Version: version,
+		Peers:   slices.Clone(peers),
+	})
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(signed)
+	if err != nil {
+		return err
+	}
+
+	s.version = version
+	s.signed = payload
+
+	close(s.changed)
+	s.changed = make(chan struct{})
+
+	return nil
+}
+
+// ServeHTTP serves the signed peer list. If the client's version (from the
+// "version" query parameter) is current, the request is held open for up to
+// "wait" seconds, and 304 Not Modified is returned if the list doesn't change.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var clientVersion uint64
+	if v := r.URL.Query().Get("version"); v != "" {
+		var err error
+		clientVersion, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid version", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var wait time.Duration
+	if v := r.URL.Query().Get("wait"); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds < 0 {
+			http.Error(w, "invalid wait", http.StatusBadRequest)
+			return
+		}
+		wait = min(time.Duration(seconds)*time.Second, maxWait)
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		s.mu.Lock()
+		version, signed, changed := s.version, s.signed, s.changed
+		s.mu.Unlock()
+
+		if version != clientVersion {
+			w.Header().Set("Content-Type", "application/json")
+			if _, err := w.Write(signed); err != nil {
+				s.logger.Debug("Failed to write peer list", "error", err)
+			}
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			w.WriteHeader(http.StatusNotModified)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
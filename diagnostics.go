@@ -0,0 +1,228 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+// Diagnostics is a point in time snapshot of the state of a socket, for
+// troubleshooting. It can be serialized as JSON, eg. to publish it with expvar:
+//
+//	expvar.Publish("noisysockets", expvar.Func(func() any {
+//		return socket.Diagnostics()
+//	}))
+type Diagnostics struct {
+	// Timestamp is when the snapshot was taken.
+	Timestamp time.Time
+	// Name is the hostname of the socket.
+	Name string
+	// PublicKey is the socket's (encoded) public key.
+	PublicKey string
+	// Addresses are the socket's addresses on the mesh.
+	Addresses []netip.Addr
+	// ConfigHash is a hash (hex encoded SHA-256) of the socket's current
+	// configuration, excluding its private key. It can be compared across
+	// snapshots, or sockets, to tell whether their configuration differs.
+	ConfigHash string
+	// Peers is the status of each peer.
+	Peers []PeerStatus
+	// Traffic contains the traffic counters of each peer, and active TCP
+	// connection.
+	Traffic Stats
+	// Routes are the prefixes routed to each peer.
+	Routes []RouteDiagnostics
+	// Listeners are the sockets listening for TCP connections, or receiving UDP
+	// datagrams from any address.
+	Listeners []ListenerDiagnostics
+	// Stack contains the counters of the userspace network stack.
+	Stack StackStats
+	// Queues is the number of packets waiting in each of the socket's queues.
+	Queues QueueDiagnostics
+	// RateLimits contains the number of packets dropped by rate limiting.
+	RateLimits RateLimitStats
+}
+
+// RouteDiagnostics is a prefix that is routed to a peer.
+type RouteDiagnostics struct {
+	// Prefix is the destination prefix.
+	Prefix netip.Prefix
+	// PeerName is the name of the peer, if it has one.
+	PeerName string
+	// PeerPublicKey is the (encoded) public key of the peer.
+	PeerPublicKey string
+}
+
+// ListenerDiagnostics is a socket that is listening on the mesh.
+type ListenerDiagnostics struct {
+	// Network is either "tcp" or "udp".
+	Network string
+	// LocalAddr is the address being listened on, the address is unspecified if
+	// listening on all of the socket's addresses.
+	LocalAddr netip.AddrPort
+}
+
+// QueueDiagnostics is the number of packets waiting in each of the socket's
+// queues.
+type QueueDiagnostics struct {
+	// Outbound is the number of packets sent by the stack, that are waiting to
+	// be read by the transport.
+	Outbound int
+	// OutboundCapacity is the number of packets the outbound queues can hold,
+	// between them, before the stack starts dropping them.
+	OutboundCapacity int
+	// Encryption is the number of batches of packets waiting to be encrypted.
+	Encryption int
+	// Decryption is the number of batches of packets waiting to be decrypted.
+	Decryption int
+	// Handshake is the number of handshake messages waiting to be processed.
+	Handshake int
+}
+
+// Diagnostics returns a snapshot of the state of the socket.
+func (s *NoisySocket) Diagnostics() Diagnostics {
+	stats := s.Stats()
+	queueDepths := s.transport.QueueDepths()
+
+	return Diagnostics{
+		Timestamp:  time.Now(),
+		Name:       s.localName,
+		PublicKey:  s.sourceSink.publicKey.String(),
+		Addresses:  slices.Clone(s.localAddrs.load()),
+		ConfigHash: s.configHash(),
+		Peers:      s.PeerStatuses(),
+		Traffic:    stats,
+		Routes:     s.sourceSink.routes(),
+		Listeners:  s.noisyNet.listeners(),
+		Stack:      s.StackStats(),
+		Queues: QueueDiagnostics{
+			Outbound:         s.ep.NumQueued(),
+			OutboundCapacity: s.sourceSink.queueSize * s.sourceSink.Queues(),
+			Encryption:       queueDepths.Encryption,
+			Decryption:       queueDepths.Decryption,
+			Handshake:        queueDepths.Handshake,
+		},
+		RateLimits: s.RateLimitStats(),
+	}
+}
+
+// configHash returns the hex encoded SHA-256 hash of the socket's current
+// configuration, with its private key removed.
+func (s *NoisySocket) configHash() string {
+	conf := s.Config()
+	conf.PrivateKey = ""
+
+	// Configs only contain types that can always be marshalled.
+	data, _ := json.Marshal(conf)
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// routes returns the prefixes routed to each peer, ordered by prefix.
+func (ss *sourceSink) routes() []RouteDiagnostics {
+	ss.peersMu.RLock()
+	defer ss.peersMu.RUnlock()
+
+	var routes []RouteDiagnostics
+	for publicKey, prefixes := range ss.peerPrefixes {
+		var name string
+		for peerName, pk := range ss.peerNames {
+			if pk == publicKey {
+				name = peerName
+				break
+			}
+		}
+
+		for _, prefix := range prefixes {
+			routes = append(routes, RouteDiagnostics{
+				Prefix:        prefix,
+				PeerName:      name,
+				PeerPublicKey: publicKey.String(),
+			})
+		}
+	}
+
+	slices.SortFunc(routes, func(a, b RouteDiagnostics) int {
+		if c := a.Prefix.Addr().Compare(b.Prefix.Addr()); c != 0 {
+			return c
+		}
+		if a.Prefix.Bits() != b.Prefix.Bits() {
+			return a.Prefix.Bits() - b.Prefix.Bits()
+		}
+		return strings.Compare(a.PeerPublicKey, b.PeerPublicKey)
+	})
+
+	return routes
+}
+
+// listeners returns the stack's TCP listeners, and unconnected UDP sockets,
+// ordered by network and then address.
+func (n *noisyNet) listeners() []ListenerDiagnostics {
+	var listeners []ListenerDiagnostics
+	for _, ep := range n.stack.RegisteredEndpoints() {
+		tcpipEP, ok := ep.(tcpip.Endpoint)
+		if !ok {
+			continue
+		}
+
+		info, ok := tcpipEP.Info().(*stack.TransportEndpointInfo)
+		if !ok {
+			continue
+		}
+
+		var network string
+		switch info.TransProto {
+		case tcp.ProtocolNumber:
+			if tcp.EndpointState(tcpipEP.State()) != tcp.StateListen {
+				continue
+			}
+			network = "tcp"
+		case udp.ProtocolNumber:
+			// Connected sockets are dialed, not listening.
+			if info.ID.LocalPort == 0 || info.ID.RemotePort != 0 {
+				continue
+			}
+			network = "udp"
+		default:
+			continue
+		}
+
+		localAddr, ok := netip.AddrFromSlice(info.ID.LocalAddress.AsSlice())
+		if !ok {
+			localAddr = netip.IPv4Unspecified()
+			if info.NetProto == header.IPv6ProtocolNumber {
+				localAddr = netip.IPv6Unspecified()
+			}
+		}
+
+		listeners = append(listeners, ListenerDiagnostics{
+			Network:   network,
+			LocalAddr: netip.AddrPortFrom(localAddr, info.ID.LocalPort),
+		})
+	}
+
+	slices.SortFunc(listeners, func(a, b ListenerDiagnostics) int {
+		if c := strings.Compare(a.Network, b.Network); c != 0 {
+			return c
+		}
+		return compareAddrPort(a.LocalAddr, b.LocalAddr)
+	})
+
+	return listeners
+}
@@ -0,0 +1,113 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets_test
+
+import (
+	"encoding/json"
+	"net/netip"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoisySocket_Diagnostics(t *testing.T) {
+	logger := slogt.New(t)
+
+	privateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	peerPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	socket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "server",
+		ListenPort: 12416,
+		PrivateKey: privateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "client",
+				PublicKey: peerPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.2", "10.8.0.0/24"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, socket.Close())
+	})
+
+	lis, err := socket.Listen("tcp", ":80")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = lis.Close()
+	})
+
+	pc, err := socket.ListenPacket("udp", "10.7.0.1:53")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = pc.Close()
+	})
+
+	diag := socket.Diagnostics()
+
+	require.Equal(t, "server", diag.Name)
+	require.Equal(t, privateKey.PublicKey().String(), diag.PublicKey)
+	require.Equal(t, []netip.Addr{netip.MustParseAddr("10.7.0.1")}, diag.Addresses)
+	require.Len(t, diag.ConfigHash, 64)
+
+	require.Len(t, diag.Peers, 1)
+	require.Equal(t, "client", diag.Peers[0].Name)
+	require.Len(t, diag.Traffic.Peers, 1)
+
+	require.Equal(t, []noisysockets.RouteDiagnostics{
+		{
+			Prefix:        netip.MustParsePrefix("10.7.0.2/32"),
+			PeerName:      "client",
+			PeerPublicKey: peerPrivateKey.PublicKey().String(),
+		},
+		{
+			Prefix:        netip.MustParsePrefix("10.8.0.0/24"),
+			PeerName:      "client",
+			PeerPublicKey: peerPrivateKey.PublicKey().String(),
+		},
+	}, diag.Routes)
+
+	require.Contains(t, diag.Listeners, noisysockets.ListenerDiagnostics{
+		Network:   "tcp",
+		LocalAddr: netip.MustParseAddrPort("10.7.0.1:80"),
+	})
+	require.Contains(t, diag.Listeners, noisysockets.ListenerDiagnostics{
+		Network:   "udp",
+		LocalAddr: netip.MustParseAddrPort("10.7.0.1:53"),
+	})
+
+	require.Zero(t, diag.Queues.Outbound)
+	require.NotZero(t, diag.Queues.OutboundCapacity)
+
+	_, err = json.Marshal(diag)
+	require.NoError(t, err)
+
+	t.Run("Config Hash", func(t *testing.T) {
+		// The hash is stable, until the configuration changes.
+		require.Equal(t, diag.ConfigHash, socket.Diagnostics().ConfigHash)
+
+		otherPrivateKey, err := transport.NewPrivateKey()
+		require.NoError(t, err)
+
+		require.NoError(t, socket.AddPeer(v1alpha1.WireGuardPeerConfig{
+			Name:      "other",
+			PublicKey: otherPrivateKey.PublicKey().String(),
+			IPs:       []string{"10.7.0.3"},
+		}))
+
+		require.NotEqual(t, diag.ConfigHash, socket.Diagnostics().ConfigHash)
+	})
+}
@@ -6,29 +6,78 @@
 package noisysockets
 
 import (
+	"context"
 	"fmt"
 	"net"
-	"net/netip"
+	"slices"
+	"strings"
 
 	"github.com/hashicorp/go-multierror"
 	"github.com/miekg/dns"
 )
 
-func resolveHost(dnsServers []netip.Addr, host string, dialContext DialContextFn) ([]string, error) {
-	client := dns.Client{
-		Net:                 "tcp",
-		DialContextOverride: dialContext,
+// Resolver resolves host names, that aren't the names of peers, to IP addresses.
+// A *net.Resolver can be used to resolve names using the host's resolver.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// addrResolver is implemented by resolvers that support reverse lookups.
+type addrResolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// srvResolver is implemented by resolvers that support SRV lookups.
+type srvResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// txtResolver is implemented by resolvers that support TXT lookups.
+type txtResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+var (
+	_ Resolver     = (*net.Resolver)(nil)
+	_ Resolver     = (*dnsResolver)(nil)
+	_ addrResolver = (*net.Resolver)(nil)
+	_ addrResolver = (*dnsResolver)(nil)
+	_ srvResolver  = (*net.Resolver)(nil)
+	_ srvResolver  = (*dnsResolver)(nil)
+	_ txtResolver  = (*net.Resolver)(nil)
+	_ txtResolver  = (*dnsResolver)(nil)
+)
+
+// dnsResolver resolves host names by querying DNS servers over the given dialer,
+// typically through the tunnel.
+type dnsResolver struct {
+	upstreams []dnsUpstream
+	// cache is nil if caching is disabled.
+	cache *dnsCache
+}
+
+func newDNSResolver(upstreams []dnsUpstream, cache *dnsCache) *dnsResolver {
+	return &dnsResolver{
+		upstreams: upstreams,
+		cache:     cache,
 	}
+}
 
+func (r *dnsResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
 	var addrs []string
 	var queryResult *multierror.Error
 
-	for _, server := range dnsServers {
+	for _, upstream := range r.upstreams {
 		queries := []uint16{dns.TypeA, dns.TypeAAAA}
 
 		for _, qtype := range queries {
-			in, err := queryDNS(server, host, qtype, &client)
+			in, err := r.query(ctx, upstream, host, qtype)
 			if err != nil {
+				// Don't bother trying the remaining servers if we've been cancelled.
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+
 				queryResult = multierror.Append(queryResult, err)
 				continue
 			}
@@ -55,18 +104,148 @@ func resolveHost(dnsServers []netip.Addr, host string, dialContext DialContextFn
 	return nil, &net.DNSError{Err: "no such host", Name: host}
 }
 
-func queryDNS(server netip.Addr, host string, qtype uint16, client *dns.Client) (*dns.Msg, error) {
+// LookupAddr performs a reverse (PTR) lookup for the given address.
+func (r *dnsResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	arpa, err := dns.ReverseAddr(addr)
+	if err != nil {
+		return nil, &net.DNSError{Err: "unrecognized address", Name: addr}
+	}
+
+	var queryResult *multierror.Error
+
+	for _, upstream := range r.upstreams {
+		in, err := r.query(ctx, upstream, arpa, dns.TypePTR)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			queryResult = multierror.Append(queryResult, err)
+			continue
+		}
+
+		var names []string
+		for _, rr := range in.Answer {
+			if rr, ok := rr.(*dns.PTR); ok {
+				names = append(names, rr.Ptr)
+			}
+		}
+
+		if len(names) > 0 {
+			return names, nil
+		}
+	}
+
+	if queryResult != nil {
+		return nil, &net.DNSError{Err: queryResult.Error(), Name: addr}
+	}
+
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+// LookupSRV looks up the SRV records of a service, or of name, if service and
+// proto are empty. Records are sorted by priority, and then by weight.
+func (r *dnsResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	target := name
+	if service != "" || proto != "" {
+		target = "_" + service + "._" + proto + "." + name
+	}
+
+	records, err := r.lookupRecords(ctx, target, dns.TypeSRV)
+	if err != nil {
+		return "", nil, err
+	}
+
+	srvs := make([]*net.SRV, 0, len(records))
+	for _, rr := range records {
+		rr := rr.(*dns.SRV)
+		srvs = append(srvs, &net.SRV{Target: rr.Target, Port: rr.Port, Priority: rr.Priority, Weight: rr.Weight})
+	}
+
+	slices.SortStableFunc(srvs, func(a, b *net.SRV) int {
+		if a.Priority != b.Priority {
+			return int(a.Priority) - int(b.Priority)
+		}
+		return int(b.Weight) - int(a.Weight)
+	})
+
+	return records[0].Header().Name, srvs, nil
+}
+
+// LookupTXT looks up the TXT records of a name, the strings of each record are
+// joined together.
+func (r *dnsResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	records, err := r.lookupRecords(ctx, name, dns.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+
+	txt := make([]string, 0, len(records))
+	for _, rr := range records {
+		txt = append(txt, strings.Join(rr.(*dns.TXT).Txt, ""))
+	}
+
+	return txt, nil
+}
+
+// lookupRecords returns the records of a type, from the first server that
+// answers with any.
+func (r *dnsResolver) lookupRecords(ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	var queryResult *multierror.Error
+
+	for _, upstream := range r.upstreams {
+		in, err := r.query(ctx, upstream, name, qtype)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			queryResult = multierror.Append(queryResult, err)
+			continue
+		}
+
+		var records []dns.RR
+		for _, rr := range in.Answer {
+			if rr.Header().Rrtype == qtype {
+				records = append(records, rr)
+			}
+		}
+
+		if len(records) > 0 {
+			return records, nil
+		}
+	}
+
+	if queryResult != nil {
+		return nil, &net.DNSError{Err: queryResult.Error(), Name: name}
+	}
+
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *dnsResolver) query(ctx context.Context, upstream dnsUpstream, host string, qtype uint16) (*dns.Msg, error) {
+	name := dns.Fqdn(host)
+
+	if r.cache != nil {
+		if in, ok := r.cache.get(upstream.String(), name, qtype); ok {
+			return in, nil
+		}
+	}
+
 	msg := new(dns.Msg)
-	msg.SetQuestion(dns.Fqdn(host), qtype)
+	msg.SetQuestion(name, qtype)
 
-	serverAddr := fmt.Sprintf("%s:53", server.String())
-	r, _, err := client.Exchange(msg, serverAddr)
+	in, err := upstream.exchange(ctx, msg)
 	if err != nil {
 		return nil, &net.DNSError{
-			Err:  fmt.Errorf("could not query DNS server %s: %w", serverAddr, err).Error(),
+			Err:  fmt.Errorf("could not query DNS server %s: %w", upstream, err).Error(),
 			Name: host,
 		}
 	}
 
-	return r, nil
+	if r.cache != nil {
+		r.cache.put(upstream.String(), name, qtype, in)
+	}
+
+	return in, nil
 }
@@ -0,0 +1,108 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type dnsCacheKey struct {
+	upstream string
+	name     string
+	qtype    uint16
+}
+
+type dnsCacheEntry struct {
+	key     dnsCacheKey
+	msg     *dns.Msg
+	expires time.Time
+}
+
+// dnsCache is a least recently used cache of DNS responses.
+type dnsCache struct {
+	mu      sync.Mutex
+	size    int
+	now     func() time.Time
+	order   *list.List
+	entries map[dnsCacheKey]*list.Element
+}
+
+func newDNSCache(size int, now func() time.Time) *dnsCache {
+	return &dnsCache{
+		size:    size,
+		now:     now,
+		order:   list.New(),
+		entries: make(map[dnsCacheKey]*list.Element),
+	}
+}
+
+func (c *dnsCache) get(upstream, name string, qtype uint16) (*dns.Msg, bool) {
+	key := dnsCacheKey{upstream: upstream, name: strings.ToLower(name), qtype: qtype}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := elem.Value.(*dnsCacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+
+	c.order.MoveToFront(elem)
+
+	return entry.msg.Copy(), true
+}
+
+// put caches a response until the lowest TTL of its records expires. Responses
+// without any records, and unsuccessful responses, aren't cached.
+func (c *dnsCache) put(upstream, name string, qtype uint16, msg *dns.Msg) {
+	if msg.Rcode != dns.RcodeSuccess || len(msg.Answer) == 0 {
+		return
+	}
+
+	ttl := msg.Answer[0].Header().Ttl
+	for _, rr := range msg.Answer[1:] {
+		ttl = min(ttl, rr.Header().Ttl)
+	}
+	if ttl == 0 {
+		return
+	}
+
+	key := dnsCacheKey{upstream: upstream, name: strings.ToLower(name), qtype: qtype}
+	entry := &dnsCacheEntry{
+		key:     key,
+		msg:     msg.Copy(),
+		expires: c.now().Add(time.Duration(ttl) * time.Second),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(entry)
+
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*dnsCacheEntry).key)
+	}
+}
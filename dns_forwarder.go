@@ -0,0 +1,145 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/miekg/dns"
+)
+
+// dnsForwarderTimeout is how long to wait for the host's name servers, when
+// forwarding a query.
+const dnsForwarderTimeout = 5 * time.Second
+
+// hostResolvConf is the host's resolver configuration, queries are forwarded
+// to the name servers it lists.
+var hostResolvConf = "/etc/resolv.conf"
+
+// dnsForwarder relays DNS queries from peers to the host's name servers, so
+// that clients routing all of their traffic through an exit node also get
+// working DNS.
+type dnsForwarder struct {
+	// servers are the addresses (host:port) of the host's name servers.
+	servers []string
+}
+
+// newDNSForwarder creates a forwarder for the name servers listed in a
+// resolv.conf file.
+func newDNSForwarder(path string) (*dnsForwarder, error) {
+	conf, err := dns.ClientConfigFromFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read host resolver configuration: %w", err)
+	}
+
+	if len(conf.Servers) == 0 {
+		return nil, fmt.Errorf("host resolver configuration has no name servers")
+	}
+
+	f := &dnsForwarder{}
+	for _, server := range conf.Servers {
+		// Link local IPv6 name servers include a zone (eg. "fe80::1%eth0").
+		f.servers = append(f.servers, net.JoinHostPort(server, conf.Port))
+	}
+
+	return f, nil
+}
+
+// forward relays a query to each of the host's name servers in turn, until
+// one responds. Truncated responses are retried over TCP.
+func (f *dnsForwarder) forward(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	var result *multierror.Error
+
+	for _, server := range f.servers {
+		resp, err := f.exchange(ctx, "udp", req, server)
+		if err == nil && resp.Truncated {
+			resp, err = f.exchange(ctx, "tcp", req, server)
+		}
+		if err != nil {
+			// Don't bother trying the remaining servers if we've run out of time.
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			result = multierror.Append(result, fmt.Errorf("could not query DNS server %s: %w", server, err))
+			continue
+		}
+
+		return resp, nil
+	}
+
+	return nil, result.ErrorOrNil()
+}
+
+func (f *dnsForwarder) exchange(ctx context.Context, network string, req *dns.Msg, server string) (*dns.Msg, error) {
+	client := dns.Client{Net: network}
+
+	resp, _, err := client.ExchangeContext(ctx, req, server)
+	return resp, err
+}
+
+// forwardable reports whether a query should be forwarded to the host's name
+// servers, rather than being answered by the DNS server itself. Queries for
+// the names of the local node and its peers, advertised services, names within
+// the mesh's domain, and names that DNS64 synthesizes records for, never are.
+func (s *dnsServer) forwardable(req *dns.Msg) bool {
+	if s.forwarder == nil || len(req.Question) != 1 {
+		return false
+	}
+
+	q := req.Question[0]
+
+	if q.Qtype == dns.TypePTR {
+		if addr, ok := parseReverseName(q.Name); ok {
+			if _, ok := s.n.lookupMeshAddr(addr); ok {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	if _, inDomain := s.n.trimDomain(q.Name); inDomain {
+		return false
+	}
+
+	if _, ok := s.n.lookupMeshHost(strings.TrimSuffix(q.Name, ".")); ok {
+		return false
+	}
+
+	if len(s.n.lookupServiceRecords(q.Name)) > 0 {
+		return false
+	}
+
+	if s.n.dns64Prefix.IsValid() && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA) {
+		return false
+	}
+
+	return true
+}
+
+// forward answers a query using the host's name servers.
+func (s *dnsServer) forward(w dns.ResponseWriter, req *dns.Msg) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsForwarderTimeout)
+	defer cancel()
+
+	resp, err := s.forwarder.forward(ctx, req)
+	if err != nil {
+		s.logger.Debug("Failed to forward DNS query", "name", req.Question[0].Name, "error", err)
+
+		resp = new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeServerFailure)
+	}
+
+	if err := w.WriteMsg(resp); err != nil {
+		s.logger.Debug("Failed to write DNS response", "error", err)
+	}
+}
@@ -0,0 +1,71 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSForwarder(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			resp := new(dns.Msg)
+			resp.SetReply(req)
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IPv4(93, 184, 216, 34),
+			})
+			_ = w.WriteMsg(resp)
+		}),
+	}
+	go func() {
+		_ = server.ActivateAndServe()
+	}()
+	t.Cleanup(func() {
+		_ = server.Shutdown()
+	})
+
+	_, port, err := net.SplitHostPort(pc.LocalAddr().String())
+	require.NoError(t, err)
+
+	resolvConf := filepath.Join(t.TempDir(), "resolv.conf")
+	require.NoError(t, os.WriteFile(resolvConf, []byte("nameserver 127.0.0.1\noptions ndots:1\n"), 0o644))
+
+	f, err := newDNSForwarder(resolvConf)
+	require.NoError(t, err)
+
+	// ClientConfigFromFile always uses port 53, so point it at our test server.
+	f.servers = []string{net.JoinHostPort("127.0.0.1", port)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	resp, err := f.forward(ctx, req)
+	require.NoError(t, err)
+	require.Len(t, resp.Answer, 1)
+	require.Equal(t, "93.184.216.34", resp.Answer[0].(*dns.A).A.String())
+
+	empty := filepath.Join(t.TempDir(), "resolv.conf")
+	require.NoError(t, os.WriteFile(empty, []byte("options ndots:1\n"), 0o644))
+
+	_, err = newDNSForwarder(empty)
+	require.Error(t, err)
+}
@@ -0,0 +1,286 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/miekg/dns"
+)
+
+const (
+	// dnsServerTTL is the time to live, in seconds, of answers served by the DNS server.
+	dnsServerTTL = 60
+	// dnsServerLookupTimeout is how long to wait for the resolver, when answering
+	// queries for names outside of the mesh.
+	dnsServerLookupTimeout = 5 * time.Second
+)
+
+// dnsServer is a DNS server, listening on the mesh, that answers A and AAAA
+// queries for the names of the local node and its peers, PTR queries for
+// their addresses, SRV and TXT queries for the services advertised by the local
+// node and published by peers, and TXT queries for the names of peers. With
+// DNS64, queries for other names are answered using the socket's resolver.
+// With a forwarder (eg. on an exit node), other queries are relayed to the
+// host's name servers.
+type dnsServer struct {
+	logger    *slog.Logger
+	n         *noisyNet
+	forwarder *dnsForwarder
+	udpServer *dns.Server
+	tcpServer *dns.Server
+}
+
+func newDNSServer(logger *slog.Logger, n *noisyNet, forwarder *dnsForwarder) (*dnsServer, error) {
+	pc, err := n.ListenPacket("udp", ":53")
+	if err != nil {
+		return nil, fmt.Errorf("could not listen on udp port 53: %w", err)
+	}
+
+	lis, err := n.Listen("tcp", ":53")
+	if err != nil {
+		_ = pc.Close()
+		return nil, fmt.Errorf("could not listen on tcp port 53: %w", err)
+	}
+
+	s := &dnsServer{
+		logger:    logger,
+		n:         n,
+		forwarder: forwarder,
+	}
+
+	var started sync.WaitGroup
+	started.Add(2)
+
+	s.udpServer = &dns.Server{PacketConn: pc, Handler: s, NotifyStartedFunc: started.Done}
+	s.tcpServer = &dns.Server{Listener: lis, Handler: s, NotifyStartedFunc: started.Done}
+
+	for _, srv := range []*dns.Server{s.udpServer, s.tcpServer} {
+		srv := srv
+		go func() {
+			if err := srv.ActivateAndServe(); err != nil && !errors.Is(err, net.ErrClosed) {
+				logger.Warn("DNS server stopped", "error", err)
+			}
+		}()
+	}
+
+	// Shutdown will fail if the servers haven't started yet.
+	started.Wait()
+
+	return s, nil
+}
+
+func (s *dnsServer) Close() error {
+	var result *multierror.Error
+
+	if err := s.udpServer.Shutdown(); err != nil {
+		result = multierror.Append(result, err)
+	}
+
+	if err := s.tcpServer.Shutdown(); err != nil {
+		result = multierror.Append(result, err)
+	}
+
+	return result.ErrorOrNil()
+}
+
+func (s *dnsServer) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	if s.forwardable(req) {
+		s.forward(w, req)
+		return
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Authoritative = true
+
+	for _, q := range req.Question {
+		if q.Qtype == dns.TypePTR {
+			s.answerPTR(req, resp, q)
+			continue
+		}
+
+		if q.Qtype == dns.TypeSRV {
+			if services := s.n.lookupServiceRecords(q.Name); len(services) > 0 {
+				s.answerSRV(resp, q, services)
+				continue
+			}
+		}
+
+		if q.Qtype == dns.TypeTXT {
+			if records, ok := s.n.lookupMeshTXT(q.Name); ok {
+				s.answerTXT(resp, q, records)
+				continue
+			}
+		}
+
+		addrs, ok := s.n.lookupMeshHost(strings.TrimSuffix(q.Name, "."))
+		if !ok {
+			if s.n.dns64Prefix.IsValid() {
+				s.answerDNS64(req, resp, q)
+			} else {
+				resp.SetRcode(req, dns.RcodeNameError)
+			}
+			continue
+		}
+
+		hdr := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: dnsServerTTL}
+		for _, addr := range addrs {
+			switch {
+			case q.Qtype == dns.TypeA && addr.Is4():
+				hdr.Rrtype = dns.TypeA
+				resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: addr.AsSlice()})
+			case q.Qtype == dns.TypeAAAA && addr.Is6():
+				hdr.Rrtype = dns.TypeAAAA
+				resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: addr.AsSlice()})
+			}
+		}
+	}
+
+	if err := w.WriteMsg(resp); err != nil {
+		s.logger.Debug("Failed to write DNS response", "error", err)
+	}
+}
+
+// answerPTR answers a reverse lookup for the address of the local node or a
+// peer.
+func (s *dnsServer) answerPTR(req, resp *dns.Msg, q dns.Question) {
+	addr, ok := parseReverseName(q.Name)
+	if !ok {
+		resp.SetRcode(req, dns.RcodeNameError)
+		return
+	}
+
+	name, ok := s.n.lookupMeshAddr(addr)
+	if !ok {
+		resp.SetRcode(req, dns.RcodeNameError)
+		return
+	}
+
+	resp.Answer = append(resp.Answer, &dns.PTR{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: dnsServerTTL},
+		Ptr: dns.Fqdn(s.n.qualifyName(name)),
+	})
+}
+
+// answerDNS64 answers an A or AAAA query for a name outside of the mesh, using
+// the socket's resolver. Names without any IPv6 addresses are given AAAA
+// records, within the NAT64 prefix, for their IPv4 addresses (RFC 6147).
+func (s *dnsServer) answerDNS64(req, resp *dns.Msg, q dns.Question) {
+	if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dnsServerLookupTimeout)
+	defer cancel()
+
+	results, err := s.n.LookupHostContext(ctx, strings.TrimSuffix(q.Name, "."))
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			resp.SetRcode(req, dns.RcodeNameError)
+		} else {
+			s.logger.Debug("Failed to resolve name", "name", q.Name, "error", err)
+			resp.SetRcode(req, dns.RcodeServerFailure)
+		}
+		return
+	}
+
+	var addrs4, addrs6 []netip.Addr
+	for _, result := range results {
+		addr, err := netip.ParseAddr(result)
+		if err != nil {
+			continue
+		}
+		addr = addr.Unmap()
+
+		if addr.Is4() {
+			addrs4 = append(addrs4, addr)
+		} else {
+			addrs6 = append(addrs6, addr)
+		}
+	}
+
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: dnsServerTTL}
+
+	if q.Qtype == dns.TypeA {
+		for _, addr := range addrs4 {
+			resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: addr.AsSlice()})
+		}
+		return
+	}
+
+	if len(addrs6) == 0 {
+		for _, addr := range addrs4 {
+			if addr.IsGlobalUnicast() {
+				addrs6 = append(addrs6, nat64Embed(s.n.dns64Prefix, addr))
+			}
+		}
+	}
+
+	for _, addr := range addrs6 {
+		resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: addr.AsSlice()})
+	}
+}
+
+// parseReverseName parses the address from a reverse lookup name, eg.
+// "2.0.7.10.in-addr.arpa." or "<32 nibbles>.ip6.arpa.".
+func parseReverseName(name string) (netip.Addr, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	if labels, ok := strings.CutSuffix(name, ".in-addr.arpa"); ok {
+		octets := strings.Split(labels, ".")
+		if len(octets) != 4 {
+			return netip.Addr{}, false
+		}
+		slices.Reverse(octets)
+
+		addr, err := netip.ParseAddr(strings.Join(octets, "."))
+		if err != nil || !addr.Is4() {
+			return netip.Addr{}, false
+		}
+
+		return addr, true
+	}
+
+	if labels, ok := strings.CutSuffix(name, ".ip6.arpa"); ok {
+		nibbles := strings.Split(labels, ".")
+		if len(nibbles) != 32 {
+			return netip.Addr{}, false
+		}
+
+		var b [16]byte
+		for i, nibble := range nibbles {
+			v, err := strconv.ParseUint(nibble, 16, 4)
+			if err != nil || len(nibble) != 1 {
+				return netip.Addr{}, false
+			}
+
+			// Nibbles are ordered from least to most significant.
+			pos := 31 - i
+			if pos%2 == 0 {
+				b[pos/2] |= byte(v) << 4
+			} else {
+				b[pos/2] |= byte(v)
+			}
+		}
+
+		return netip.AddrFrom16(b), true
+	}
+
+	return netip.Addr{}, false
+}
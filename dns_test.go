@@ -0,0 +1,266 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+)
+
+type staticResolver struct {
+	hosts   map[string][]string
+	lookups []string
+}
+
+func (r *staticResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.lookups = append(r.lookups, host)
+
+	addrs, ok := r.hosts[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host}
+	}
+
+	return addrs, nil
+}
+
+func TestNoisyNet_Resolver(t *testing.T) {
+	ss, n := newTestSourceSink(t, []netip.Addr{netip.MustParseAddr("10.7.0.1")})
+
+	peerPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	require.NoError(t, ss.AddPeer("peer", peerPrivateKey.PublicKey(), []netip.Prefix{netip.MustParsePrefix("10.7.0.2/32")}))
+
+	t.Run("No Resolver", func(t *testing.T) {
+		_, err := n.LookupHost("example.com")
+		require.Error(t, err)
+	})
+
+	resolver := &staticResolver{
+		hosts: map[string][]string{
+			"example.com": {"93.184.216.34"},
+		},
+	}
+	n.SetResolver(resolver)
+
+	t.Run("Peer Name", func(t *testing.T) {
+		addrs, err := n.LookupHost("peer")
+		require.NoError(t, err)
+		require.Equal(t, []string{"10.7.0.2"}, addrs)
+
+		// Peer names should never be forwarded to the resolver.
+		require.Empty(t, resolver.lookups)
+	})
+
+	t.Run("Upstream", func(t *testing.T) {
+		addrs, err := n.LookupHost("example.com")
+		require.NoError(t, err)
+		require.Equal(t, []string{"93.184.216.34"}, addrs)
+
+		_, err = n.LookupHost("unknown.example.com")
+		require.Error(t, err)
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := n.LookupHostContext(ctx, "example.com")
+		require.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+func (r *staticResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	for host, addrs := range r.hosts {
+		if slices.Contains(addrs, addr) {
+			return []string{host + "."}, nil
+		}
+	}
+
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+func TestNoisyNet_LookupAddr(t *testing.T) {
+	ss, n := newTestSourceSink(t, []netip.Addr{netip.MustParseAddr("10.7.0.1")})
+	n.localName = "local"
+
+	peerPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	require.NoError(t, ss.AddPeer("peer", peerPrivateKey.PublicKey(), []netip.Prefix{
+		netip.MustParsePrefix("10.7.0.2/32"),
+		netip.MustParsePrefix("10.8.0.0/24"),
+	}))
+
+	names, err := n.LookupAddr("10.7.0.2")
+	require.NoError(t, err)
+	require.Equal(t, []string{"peer"}, names)
+
+	names, err = n.LookupAddr("10.7.0.1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"local"}, names)
+
+	// Addresses within a routed subnet don't belong to the peer.
+	_, err = n.LookupAddr("10.8.0.1")
+	require.Error(t, err)
+
+	_, err = n.LookupAddr("invalid")
+	require.Error(t, err)
+
+	t.Run("Upstream", func(t *testing.T) {
+		n.SetResolver(&staticResolver{
+			hosts: map[string][]string{
+				"example.com": {"93.184.216.34"},
+			},
+		})
+		t.Cleanup(func() {
+			n.SetResolver(nil)
+		})
+
+		names, err := n.LookupAddr("93.184.216.34")
+		require.NoError(t, err)
+		require.Equal(t, []string{"example.com"}, names)
+	})
+}
+
+func TestParseReverseName(t *testing.T) {
+	for _, addr := range []string{"10.7.0.2", "fd00::3", "2001:db8::abcd:1"} {
+		name, err := dns.ReverseAddr(addr)
+		require.NoError(t, err)
+
+		parsed, ok := parseReverseName(name)
+		require.True(t, ok)
+		require.Equal(t, netip.MustParseAddr(addr), parsed)
+	}
+
+	for _, name := range []string{"example.com.", "1.2.3.in-addr.arpa.", "x.0.7.10.in-addr.arpa.", "3.0.ip6.arpa."} {
+		_, ok := parseReverseName(name)
+		require.False(t, ok, name)
+	}
+}
+
+func TestNoisyNet_Domain(t *testing.T) {
+	ss, n := newTestSourceSink(t, []netip.Addr{netip.MustParseAddr("10.7.0.1")})
+	n.domain = "my-net.internal"
+
+	peerPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	require.NoError(t, ss.AddPeer("web", peerPrivateKey.PublicKey(), []netip.Prefix{netip.MustParsePrefix("10.7.0.2/32")}))
+
+	resolver := &staticResolver{
+		hosts: map[string][]string{
+			"example.com":          {"93.184.216.34"},
+			"db.my-net.internal":   {"10.9.0.1"},
+			"my-net.internal.test": {"10.9.0.2"},
+		},
+	}
+	n.SetResolver(resolver)
+
+	for _, host := range []string{"web", "web.my-net.internal", "web.my-net.internal.", "web.MY-NET.internal"} {
+		addrs, err := n.LookupHost(host)
+		require.NoError(t, err, host)
+		require.Equal(t, []string{"10.7.0.2"}, addrs, host)
+	}
+
+	// Names within the domain are never resolved upstream.
+	_, err = n.LookupHost("db.my-net.internal")
+	require.Error(t, err)
+
+	_, err = n.LookupHost("my-net.internal")
+	require.Error(t, err)
+
+	require.Empty(t, resolver.lookups)
+
+	// Names outside of the domain still are.
+	for _, host := range []string{"example.com", "my-net.internal.test"} {
+		_, err := n.LookupHost(host)
+		require.NoError(t, err, host)
+	}
+	require.Equal(t, []string{"example.com", "my-net.internal.test"}, resolver.lookups)
+
+	names, err := n.LookupAddr("10.7.0.2")
+	require.NoError(t, err)
+	require.Equal(t, []string{"web.my-net.internal"}, names)
+}
+
+func TestNoisyNet_DomainResolver(t *testing.T) {
+	_, n := newTestSourceSink(t, []netip.Addr{netip.MustParseAddr("10.7.0.1")})
+
+	defaultResolver := &staticResolver{
+		hosts: map[string][]string{
+			"example.com":        {"93.184.216.34"},
+			"web.corp.internal":  {"198.51.100.1"},
+			"corp.internal.test": {"198.51.100.2"},
+		},
+	}
+	n.SetResolver(defaultResolver)
+
+	corpResolver := &staticResolver{
+		hosts: map[string][]string{
+			"web.corp.internal": {"100.64.0.10"},
+			"corp.internal":     {"100.64.0.11"},
+			"db.eu.corp.internal": {
+				"100.64.0.12",
+			},
+		},
+	}
+	n.SetDomainResolver("corp.internal.", corpResolver)
+
+	euResolver := &staticResolver{
+		hosts: map[string][]string{
+			"db.eu.corp.internal": {"100.64.1.12"},
+		},
+	}
+	n.SetDomainResolver("eu.corp.internal", euResolver)
+
+	for host, expected := range map[string]string{
+		"web.corp.internal":   "100.64.0.10",
+		"corp.internal":       "100.64.0.11",
+		"db.eu.corp.internal": "100.64.1.12",
+		"example.com":         "93.184.216.34",
+		"corp.internal.test":  "198.51.100.2",
+	} {
+		addrs, err := n.LookupHost(host)
+		require.NoError(t, err, host)
+		require.Equal(t, []string{expected}, addrs, host)
+	}
+
+	require.ElementsMatch(t, []string{"example.com", "corp.internal.test"}, defaultResolver.lookups)
+
+	// Domains are matched case insensitively.
+	_, _ = n.LookupHost("WEB.Corp.Internal.")
+	require.Contains(t, corpResolver.lookups, "WEB.Corp.Internal.")
+
+	// Reverse lookups are routed by their reverse domain.
+	n.SetDomainResolver("100.in-addr.arpa", corpResolver)
+
+	names, err := n.LookupAddr("100.64.0.10")
+	require.NoError(t, err)
+	require.Equal(t, []string{"web.corp.internal"}, names)
+
+	names, err = n.LookupAddr("93.184.216.34")
+	require.NoError(t, err)
+	require.Equal(t, []string{"example.com"}, names)
+
+	// Removing the route falls back to the default resolver.
+	n.SetDomainResolver("corp.internal", nil)
+
+	addrs, err := n.LookupHost("web.corp.internal")
+	require.NoError(t, err)
+	require.Equal(t, []string{"198.51.100.1"}, addrs)
+}
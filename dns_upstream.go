@@ -0,0 +1,259 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/miekg/dns"
+)
+
+const (
+	// dnsOverTLSPort is the default port of DNS over TLS servers (RFC 7858).
+	dnsOverTLSPort = 853
+	// dnsMessageContentType is the media type of DNS over HTTPS messages (RFC 8484).
+	dnsMessageContentType = "application/dns-message"
+)
+
+// dnsUpstream sends queries to a DNS server.
+type dnsUpstream interface {
+	exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error)
+	// String describes the server in errors.
+	String() string
+}
+
+var (
+	_ dnsUpstream = (*plainDNSUpstream)(nil)
+	_ dnsUpstream = (*tlsDNSUpstream)(nil)
+	_ dnsUpstream = (*httpsDNSUpstream)(nil)
+)
+
+// dnsServerSpec is a parsed DNS server, either the IP address of a plain DNS
+// server, "tls://host[:port]" for DNS over TLS, or an "https://" URL for DNS
+// over HTTPS.
+type dnsServerSpec struct {
+	// addr is the address of a plain DNS server.
+	addr netip.Addr
+	// tlsAddress is the host and port of a DNS over TLS server.
+	tlsAddress string
+	// httpsURL is the URL of a DNS over HTTPS server.
+	httpsURL string
+}
+
+func parseDNSServer(server string) (dnsServerSpec, error) {
+	if addr, err := netip.ParseAddr(server); err == nil {
+		return dnsServerSpec{addr: addr.Unmap()}, nil
+	}
+
+	u, err := url.Parse(server)
+	if err != nil || u.Host == "" {
+		return dnsServerSpec{}, fmt.Errorf("could not parse DNS server %q: must be an IP address, or a tls:// or https:// URL", server)
+	}
+
+	switch u.Scheme {
+	case "tls":
+		port := u.Port()
+		if port == "" {
+			port = strconv.Itoa(dnsOverTLSPort)
+		}
+
+		return dnsServerSpec{tlsAddress: net.JoinHostPort(u.Hostname(), port)}, nil
+	case "https":
+		return dnsServerSpec{httpsURL: u.String()}, nil
+	default:
+		return dnsServerSpec{}, fmt.Errorf("unsupported DNS server scheme %q", u.Scheme)
+	}
+}
+
+// newDNSUpstream creates an upstream for a server, dialed using dialContext.
+// Host names (of DNS over TLS and HTTPS servers) are resolved using the
+// bootstrap resolver.
+func newDNSUpstream(spec dnsServerSpec, dialContext DialContextFn, bootstrap Resolver) dnsUpstream {
+	dialer := &bootstrapDialer{dialContext: dialContext, bootstrap: bootstrap}
+
+	switch {
+	case spec.tlsAddress != "":
+		return &tlsDNSUpstream{address: spec.tlsAddress, dialContext: dialer.DialContext}
+	case spec.httpsURL != "":
+		return &httpsDNSUpstream{
+			url: spec.httpsURL,
+			client: &http.Client{
+				Transport: &http.Transport{
+					DialContext:       dialer.DialContext,
+					ForceAttemptHTTP2: true,
+				},
+			},
+		}
+	default:
+		return &plainDNSUpstream{addr: netip.AddrPortFrom(spec.addr, 53), dialContext: dialContext}
+	}
+}
+
+// plainDNSUpstream queries a DNS server over TCP.
+type plainDNSUpstream struct {
+	addr        netip.AddrPort
+	dialContext DialContextFn
+}
+
+func (u *plainDNSUpstream) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	client := dns.Client{
+		Net:                 "tcp",
+		DialContextOverride: u.dialContext,
+	}
+
+	resp, _, err := client.ExchangeContext(ctx, msg, u.addr.String())
+	return resp, err
+}
+
+func (u *plainDNSUpstream) String() string {
+	return u.addr.String()
+}
+
+// tlsDNSUpstream queries a DNS over TLS server (RFC 7858).
+type tlsDNSUpstream struct {
+	address     string
+	dialContext DialContextFn
+}
+
+func (u *tlsDNSUpstream) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	host, _, err := net.SplitHostPort(u.address)
+	if err != nil {
+		return nil, err
+	}
+
+	client := dns.Client{
+		Net: "tcp",
+		// The client doesn't use TLS when the dialer is overridden.
+		DialContextOverride: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := u.dialContext(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+
+			tlsConn := tls.Client(conn, &tls.Config{
+				ServerName: host,
+				MinVersion: tls.VersionTLS12,
+			})
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				_ = conn.Close()
+				return nil, fmt.Errorf("tls handshake failed: %w", err)
+			}
+
+			return tlsConn, nil
+		},
+	}
+
+	resp, _, err := client.ExchangeContext(ctx, msg, u.address)
+	return resp, err
+}
+
+func (u *tlsDNSUpstream) String() string {
+	return "tls://" + u.address
+}
+
+// httpsDNSUpstream queries a DNS over HTTPS server (RFC 8484).
+type httpsDNSUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func (u *httpsDNSUpstream) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	// The ID should be zero, so that responses can be cached by HTTP caches.
+	query := msg.Copy()
+	query.Id = 0
+
+	buf, err := query.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("could not pack query: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dnsMessageContentType)
+	req.Header.Set("Accept", dnsMessageContentType)
+
+	httpResp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", httpResp.Status)
+	}
+
+	buf, err = io.ReadAll(io.LimitReader(httpResp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, fmt.Errorf("could not read response: %w", err)
+	}
+
+	var resp dns.Msg
+	if err := resp.Unpack(buf); err != nil {
+		return nil, fmt.Errorf("could not unpack response: %w", err)
+	}
+	resp.Id = msg.Id
+
+	return &resp, nil
+}
+
+func (u *httpsDNSUpstream) String() string {
+	return u.url
+}
+
+// bootstrapDialer dials DNS servers, resolving host names using the bootstrap
+// resolver (as the resolver the servers belong to can't be used).
+type bootstrapDialer struct {
+	dialContext DialContextFn
+	bootstrap   Resolver
+}
+
+func (d *bootstrapDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := netip.ParseAddr(host); err == nil {
+		return d.dialContext(ctx, network, address)
+	}
+
+	addrs, err := d.bootstrap.LookupHost(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve DNS server %q: %w", host, err)
+	}
+
+	var result *multierror.Error
+	for _, addr := range addrs {
+		conn, err := d.dialContext(ctx, network, net.JoinHostPort(addr, port))
+		if err == nil {
+			return conn, nil
+		}
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		result = multierror.Append(result, err)
+	}
+
+	if result == nil {
+		return nil, fmt.Errorf("DNS server %q has no addresses", host)
+	}
+
+	return nil, result.ErrorOrNil()
+}
@@ -0,0 +1,178 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDNSServer(t *testing.T) {
+	spec, err := parseDNSServer("::ffff:10.7.0.1")
+	require.NoError(t, err)
+	require.Equal(t, "10.7.0.1", spec.addr.String())
+
+	spec, err = parseDNSServer("tls://dns.example")
+	require.NoError(t, err)
+	require.Equal(t, "dns.example:853", spec.tlsAddress)
+
+	spec, err = parseDNSServer("tls://1.1.1.1:8853")
+	require.NoError(t, err)
+	require.Equal(t, "1.1.1.1:8853", spec.tlsAddress)
+
+	spec, err = parseDNSServer("https://dns.example/dns-query")
+	require.NoError(t, err)
+	require.Equal(t, "https://dns.example/dns-query", spec.httpsURL)
+
+	for _, server := range []string{"dns.example", "udp://1.1.1.1", "https:///dns-query"} {
+		_, err := parseDNSServer(server)
+		require.Error(t, err, server)
+	}
+}
+
+func TestDNSResolver_HTTPS(t *testing.T) {
+	var queries atomic.Int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != dnsMessageContentType {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		buf, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var req dns.Msg
+		if err := req.Unpack(buf); err != nil || req.Id != 0 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		queries.Add(1)
+
+		var resp dns.Msg
+		resp.SetReply(&req)
+		if req.Question[0].Name == "example.com." && req.Question[0].Qtype == dns.TypeA {
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP("93.184.216.34"),
+			})
+		}
+
+		buf, err = resp.Pack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", dnsMessageContentType)
+		_, _ = w.Write(buf)
+	}))
+	t.Cleanup(srv.Close)
+
+	srvURL, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+
+	// The test server's certificate is valid for example.com, which the
+	// bootstrap resolver resolves to the test server.
+	bootstrap := &staticResolver{
+		hosts: map[string][]string{
+			"example.com": {srvURL.Hostname()},
+		},
+	}
+
+	var d net.Dialer
+	upstream := newDNSUpstream(dnsServerSpec{
+		httpsURL: "https://example.com:" + srvURL.Port() + "/dns-query",
+	}, d.DialContext, bootstrap)
+	upstream.(*httpsDNSUpstream).client.Transport.(*http.Transport).TLSClientConfig =
+		srv.Client().Transport.(*http.Transport).TLSClientConfig
+
+	now := time.Now()
+	cache := newDNSCache(10, func() time.Time { return now })
+
+	r := newDNSResolver([]dnsUpstream{upstream}, cache)
+
+	addrs, err := r.LookupHost(context.Background(), "example.com")
+	require.NoError(t, err)
+	require.Equal(t, []string{"93.184.216.34"}, addrs)
+	require.Equal(t, []string{"example.com"}, bootstrap.lookups)
+	require.Equal(t, int32(2), queries.Load())
+
+	// The A record is cached, the empty AAAA response isn't.
+	addrs, err = r.LookupHost(context.Background(), "EXAMPLE.com")
+	require.NoError(t, err)
+	require.Equal(t, []string{"93.184.216.34"}, addrs)
+	require.Equal(t, int32(3), queries.Load())
+
+	// Until its TTL expires.
+	now = now.Add(time.Minute)
+
+	_, err = r.LookupHost(context.Background(), "example.com")
+	require.NoError(t, err)
+	require.Equal(t, int32(5), queries.Load())
+
+	_, err = r.LookupHost(context.Background(), "unknown.example.com")
+	require.Error(t, err)
+}
+
+func TestDNSCache(t *testing.T) {
+	cache := newDNSCache(2, time.Now)
+
+	answer := func(name string) *dns.Msg {
+		var msg dns.Msg
+		msg.SetQuestion(name, dns.TypeA)
+		msg.Answer = append(msg.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("10.7.0.1"),
+		})
+		return &msg
+	}
+
+	cache.put("server", "a.example.", dns.TypeA, answer("a.example."))
+	cache.put("server", "b.example.", dns.TypeA, answer("b.example."))
+
+	_, ok := cache.get("server", "a.example.", dns.TypeA)
+	require.True(t, ok)
+
+	// Responses are cached per server, and query type.
+	_, ok = cache.get("other", "a.example.", dns.TypeA)
+	require.False(t, ok)
+
+	_, ok = cache.get("server", "a.example.", dns.TypeAAAA)
+	require.False(t, ok)
+
+	// The least recently used response is evicted.
+	cache.put("server", "c.example.", dns.TypeA, answer("c.example."))
+
+	_, ok = cache.get("server", "b.example.", dns.TypeA)
+	require.False(t, ok)
+
+	for _, name := range []string{"a.example.", "c.example."} {
+		msg, ok := cache.get("server", name, dns.TypeA)
+		require.True(t, ok, name)
+		require.Equal(t, name, msg.Answer[0].Header().Name)
+	}
+
+	// Unsuccessful responses aren't cached.
+	failed := answer("d.example.")
+	failed.Rcode = dns.RcodeServerFailure
+	cache.put("server", "d.example.", dns.TypeA, failed)
+
+	_, ok = cache.get("server", "d.example.", dns.TypeA)
+	require.False(t, ok)
+}
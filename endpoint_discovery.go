@@ -0,0 +1,290 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/noisysockets/noisysockets/internal/conn"
+	"github.com/noisysockets/noisysockets/internal/transport"
+)
+
+const (
+	// endpointExchangePort is the UDP port, on each socket's addresses, on which
+	// peers tell each other about their candidate endpoints.
+	endpointExchangePort = 51821
+	// endpointDiscoveryInterval is how often the STUN servers are queried, this
+	// also keeps the NAT mapping alive.
+	endpointDiscoveryInterval = 30 * time.Second
+	// endpointAnnounceInterval is how often we check for peers that need to be
+	// told about our candidate endpoints.
+	endpointAnnounceInterval = 5 * time.Second
+	// endpointAnnounceRefresh is how often candidate endpoints are re-announced
+	// to a peer, even when they haven't changed.
+	endpointAnnounceRefresh = 2 * time.Minute
+	// stunTimeout is how long to wait for a response from a STUN server.
+	stunTimeout = 3 * time.Second
+	// maxCandidateEndpoints is the maximum number of candidate endpoints
+	// accepted from a peer.
+	maxCandidateEndpoints = 8
+)
+
+// endpointAnnouncement is sent to peers, through the tunnel, to tell them
+// about our candidate endpoints.
+type endpointAnnouncement struct {
+	Endpoints []string `json:"endpoints"`
+}
+
+// endpointDiscovery discovers the socket's public endpoints using STUN (if
+// configured), and exchanges them with peers, so that NATs can be traversed
+// (by hole punching).
+type endpointDiscovery struct {
+	logger  *slog.Logger
+	s       *NoisySocket
+	stun    *conn.STUNBind
+	servers []string
+	pc      net.PacketConn
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+
+	mu        sync.Mutex // protects endpoints and announced
+	endpoints []netip.AddrPort
+	announced map[transport.NoisePublicKey]time.Time
+}
+
+func newEndpointDiscovery(logger *slog.Logger, s *NoisySocket, stun *conn.STUNBind, servers []string) (*endpointDiscovery, error) {
+	pc, err := s.ListenPacket("udp", net.JoinHostPort("", strconv.Itoa(endpointExchangePort)))
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	d := &endpointDiscovery{
+		logger:    logger,
+		s:         s,
+		stun:      stun,
+		servers:   servers,
+		pc:        pc,
+		cancel:    cancel,
+		announced: make(map[transport.NoisePublicKey]time.Time),
+	}
+
+	d.wg.Add(2)
+	go d.run(ctx)
+	go d.receive()
+
+	return d, nil
+}
+
+// Close stops discovering and exchanging endpoints.
+func (d *endpointDiscovery) Close() error {
+	d.cancel()
+	err := d.pc.Close()
+	d.wg.Wait()
+	return err
+}
+
+// Endpoints returns the socket's most recently discovered public endpoints.
+func (d *endpointDiscovery) Endpoints() []netip.AddrPort {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return slices.Clone(d.endpoints)
+}
+
+func (d *endpointDiscovery) run(ctx context.Context) {
+	defer d.wg.Done()
+
+	d.discover(ctx)
+	lastDiscovery := time.Now()
+
+	ticker := time.NewTicker(endpointAnnounceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if time.Since(lastDiscovery) >= endpointDiscoveryInterval {
+			d.discover(ctx)
+			lastDiscovery = time.Now()
+		}
+
+		d.announce()
+	}
+}
+
+// discover queries each of the STUN servers for our public endpoint.
+func (d *endpointDiscovery) discover(ctx context.Context) {
+	if d.stun == nil {
+		return
+	}
+
+	var endpoints []netip.AddrPort
+	for _, server := range d.servers {
+		serverAddr, err := net.ResolveUDPAddr("udp", server)
+		if err != nil {
+			d.logger.Warn("Failed to resolve STUN server", "server", server, "error", err)
+			continue
+		}
+
+		discoverCtx, cancel := context.WithTimeout(ctx, stunTimeout)
+		endpoint, err := d.stun.Discover(discoverCtx, netip.AddrPortFrom(serverAddr.AddrPort().Addr().Unmap(), serverAddr.AddrPort().Port()))
+		cancel()
+		if err != nil {
+			d.logger.Warn("Failed to discover public endpoint", "server", server, "error", err)
+			continue
+		}
+
+		if !slices.Contains(endpoints, endpoint) {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Endpoints are kept if discovery fails, as it is likely temporary.
+	if len(endpoints) == 0 || slices.Equal(endpoints, d.endpoints) {
+		return
+	}
+
+	d.logger.Info("Discovered public endpoints", "endpoints", endpoints)
+
+	d.endpoints = endpoints
+	// Tell everyone about the new endpoints.
+	clear(d.announced)
+}
+
+// announce tells each peer, with which we have a session, about our
+// candidate endpoints, if they haven't been told recently.
+func (d *endpointDiscovery) announce() {
+	d.s.peerConfigsMu.Lock()
+	publicKeys := make([]transport.NoisePublicKey, 0, len(d.s.peerConfigs))
+	for pk := range d.s.peerConfigs {
+		publicKeys = append(publicKeys, pk)
+	}
+	d.s.peerConfigsMu.Unlock()
+
+	for _, pk := range publicKeys {
+		peer := d.s.transport.LookupPeer(pk)
+		if peer == nil {
+			continue
+		}
+
+		// Don't trigger handshakes with peers we aren't talking to.
+		if time.Since(peer.Stats().LastHandshake) > d.s.transport.Timers().RejectAfter {
+			continue
+		}
+
+		d.mu.Lock()
+		due := time.Since(d.announced[pk]) >= endpointAnnounceRefresh
+		d.mu.Unlock()
+
+		if due {
+			d.announceTo(pk)
+		}
+	}
+}
+
+func (d *endpointDiscovery) announceTo(pk transport.NoisePublicKey) {
+	d.mu.Lock()
+	var msg endpointAnnouncement
+	for _, endpoint := range d.endpoints {
+		msg.Endpoints = append(msg.Endpoints, endpoint.String())
+	}
+	d.mu.Unlock()
+
+	if len(msg.Endpoints) == 0 {
+		return
+	}
+
+	d.s.peersMu.RLock()
+	addrs := d.s.peerAddresses[pk]
+	d.s.peersMu.RUnlock()
+
+	if len(addrs) == 0 {
+		return
+	}
+
+	buf, err := json.Marshal(&msg)
+	if err != nil {
+		return
+	}
+
+	dst := net.UDPAddrFromAddrPort(netip.AddrPortFrom(addrs[0], endpointExchangePort))
+	if _, err := d.pc.WriteTo(buf, dst); err != nil {
+		d.logger.Debug("Failed to announce endpoints", "peer", dst, "error", err)
+		return
+	}
+
+	d.mu.Lock()
+	d.announced[pk] = time.Now()
+	d.mu.Unlock()
+}
+
+// receive handles announcements from peers.
+func (d *endpointDiscovery) receive() {
+	defer d.wg.Done()
+
+	buf := make([]byte, transport.DefaultMTU)
+	for {
+		n, addr, err := d.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		identity := d.s.peerIdentity(addr)
+		if identity.publicKey.IsZero() {
+			continue
+		}
+
+		var msg endpointAnnouncement
+		if err := json.Unmarshal(buf[:n], &msg); err != nil {
+			d.logger.Debug("Ignoring invalid endpoint announcement", "peer", addr, "error", err)
+			continue
+		}
+
+		candidates := parseCandidateEndpoints(msg.Endpoints)
+
+		peer := d.s.transport.LookupPeer(identity.publicKey)
+		if peer == nil {
+			continue
+		}
+
+		d.logger.Debug("Received candidate endpoints", "peer", addr, "endpoints", candidates)
+
+		peer.SetCandidateEndpoints(candidates)
+
+		// Let them know about ours, so they can punch through our NAT too.
+		d.mu.Lock()
+		_, announced := d.announced[identity.publicKey]
+		d.mu.Unlock()
+
+		if !announced {
+			d.announceTo(identity.publicKey)
+		}
+
+		// If the peer is relayed, try to establish a direct path right away.
+		if peer.Stats().Relayed {
+			if err := peer.SendHandshakeInitiation(false); err != nil {
+				d.logger.Debug("Failed to send handshake initiation", "peer", addr, "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,47 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// newEndpoint creates a transport endpoint, unless the stack already has as
+// many open endpoints as it allows. Errors are mapped to their net package
+// equivalents.
+func (n *noisyNet) newEndpoint(transProto tcpip.TransportProtocolNumber, netProto tcpip.NetworkProtocolNumber, wq *waiter.Queue) (tcpip.Endpoint, error) {
+	if n.maxEndpoints != 0 && n.openEndpoints() >= n.maxEndpoints {
+		return nil, ErrEndpointLimit
+	}
+
+	ep, tcpErr := n.stack.NewEndpoint(transProto, netProto, wq)
+	if tcpErr != nil {
+		return nil, mapTCPIPErr(tcpErr)
+	}
+
+	return ep, nil
+}
+
+// overEndpointLimit returns whether the stack has more open endpoints than it
+// allows, eg. after accepting a connection.
+func (n *noisyNet) overEndpointLimit() bool {
+	return n.maxEndpoints != 0 && n.openEndpoints() > n.maxEndpoints
+}
+
+// openEndpoints returns the number of endpoints registered with the stack
+// (ie. bound, or connected). Endpoints registered for both IPv4 and IPv6 are
+// only counted once. Concurrent dials are counted once they are connected, so
+// the limit can briefly be exceeded by a burst of them.
+func (n *noisyNet) openEndpoints() int {
+	endpoints := make(map[stack.TransportEndpoint]struct{})
+	for _, ep := range n.stack.RegisteredEndpoints() {
+		endpoints[ep] = struct{}{}
+	}
+
+	return len(endpoints)
+}
@@ -0,0 +1,146 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets_test
+
+import (
+	"io"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+func TestNoisySocket_EndpointLimit(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	// The server's buffers only fit two endpoints, its listener and a single
+	// connection.
+	serverSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "server",
+		ListenPort: 12460,
+		PrivateKey: serverPrivateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+		Stack: &v1alpha1.StackConfig{
+			SendBufferSize:    64 << 10,
+			ReceiveBufferSize: 64 << 10,
+			MemoryLimit:       256 << 10,
+		},
+		Peers: []v1alpha1.WireGuardPeerConfig{{
+			Name:      "client",
+			PublicKey: clientPrivateKey.PublicKey().String(),
+			IPs:       []string{"10.7.0.2"},
+		}},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+	})
+
+	lis, err := serverSocket.Listen("tcp", ":80")
+	require.NoError(t, err)
+
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	clientSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "client",
+		ListenPort: 12461,
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.2"},
+		Stack: &v1alpha1.StackConfig{
+			MaxEndpoints: 2,
+		},
+		Peers: []v1alpha1.WireGuardPeerConfig{{
+			Name:      "server",
+			PublicKey: serverPrivateKey.PublicKey().String(),
+			Endpoint:  "localhost:12460",
+			IPs:       []string{"10.7.0.1"},
+		}},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, clientSocket.Close())
+	})
+
+	echo := func(conn io.ReadWriter) error {
+		if _, err := conn.Write([]byte("Hello, server!")); err != nil {
+			return err
+		}
+
+		buf := make([]byte, len("Hello, server!"))
+		_, err := io.ReadFull(conn, buf)
+		return err
+	}
+
+	conn, err := clientSocket.Dial("tcp", "server:80")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	require.NoError(t, echo(conn))
+
+	t.Run("Dial", func(t *testing.T) {
+		pc, err := clientSocket.ListenPacket("udp", ":0")
+		require.NoError(t, err)
+		defer pc.Close()
+
+		_, err = clientSocket.Dial("tcp", "server:80")
+		require.ErrorIs(t, err, noisysockets.ErrEndpointLimit)
+		require.ErrorIs(t, err, syscall.ENOBUFS)
+	})
+
+	t.Run("Accept", func(t *testing.T) {
+		conn, err := clientSocket.Dial("tcp", "server:80")
+		require.NoError(t, err)
+		defer conn.Close()
+
+		require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+		require.ErrorContains(t, echo(conn), "connection reset by peer")
+	})
+
+	t.Run("Send Buffer", func(t *testing.T) {
+		var sendBufferSize tcpip.TCPSendBufferSizeRangeOption
+		require.Nil(t, serverSocket.Stack().TransportProtocolOption(tcp.ProtocolNumber, &sendBufferSize))
+		require.Equal(t, 64<<10, sendBufferSize.Max)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+			PrivateKey: clientPrivateKey.String(),
+			Stack: &v1alpha1.StackConfig{
+				MemoryLimit: 1 << 20,
+			},
+		})
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,115 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+var (
+	// ErrUnknownPeer is returned when a peer, identified by its name or public
+	// key, isn't configured.
+	ErrUnknownPeer = errors.New("unknown peer")
+	// ErrPeerExpired is returned when adding a peer whose expiry time (see
+	// WireGuardPeerConfig.ExpiresAt) has passed.
+	ErrPeerExpired = errors.New("peer expired")
+	// ErrNoRouteToPeer is returned when dialing an address that doesn't belong
+	// to the local node, or any peer (eg. it isn't within a peer's addresses, or
+	// the prefixes routed to it). It also matches syscall.EHOSTUNREACH.
+	ErrNoRouteToPeer error = &unreachableError{msg: "no route to peer"}
+	// ErrPeerNotConnected is returned when dialing an address that belongs to a
+	// configured peer, that can't be reached as it has no known endpoint (and
+	// no active session). It also matches syscall.EHOSTUNREACH.
+	ErrPeerNotConnected error = &unreachableError{msg: "peer not connected"}
+	// ErrEndpointLimit is returned when dialing, or listening, would open more
+	// endpoints than the network stack allows (see StackConfig.MaxEndpoints and
+	// StackConfig.MemoryLimit). It also matches syscall.ENOBUFS.
+	ErrEndpointLimit error = &endpointLimitError{}
+)
+
+// unreachableError is returned when a peer can't be reached, it matches
+// syscall.EHOSTUNREACH, so that it is handled like any other unreachable host.
+type unreachableError struct {
+	msg string
+}
+
+func (e *unreachableError) Error() string { return e.msg }
+
+func (e *unreachableError) Is(err error) bool {
+	return err == syscall.EHOSTUNREACH
+}
+
+// endpointLimitError is returned when the network stack's endpoint limit is
+// reached, it matches syscall.ENOBUFS (as the kernel returns when it is out of
+// socket buffers).
+type endpointLimitError struct{}
+
+func (e *endpointLimitError) Error() string { return "endpoint limit reached" }
+
+func (e *endpointLimitError) Is(err error) bool {
+	return err == syscall.ENOBUFS
+}
+
+// mapTCPIPErr converts a network stack error into its syscall equivalent, so
+// that it matches the errors returned by the net package (eg. errors.Is(err,
+// syscall.ECONNREFUSED)). Timeouts implement net.Error. Errors without an
+// equivalent are returned as plain errors.
+func mapTCPIPErr(err tcpip.Error) error {
+	switch err.(type) {
+	case nil:
+		return nil
+	case *tcpip.ErrConnectionRefused:
+		return syscall.ECONNREFUSED
+	case *tcpip.ErrConnectionReset:
+		return syscall.ECONNRESET
+	case *tcpip.ErrConnectionAborted:
+		return syscall.ECONNABORTED
+	case *tcpip.ErrTimeout:
+		return syscall.ETIMEDOUT
+	case *tcpip.ErrNetworkUnreachable:
+		return syscall.ENETUNREACH
+	case *tcpip.ErrHostUnreachable:
+		return syscall.EHOSTUNREACH
+	case *tcpip.ErrPortInUse:
+		return syscall.EADDRINUSE
+	case *tcpip.ErrBadLocalAddress:
+		return syscall.EADDRNOTAVAIL
+	case *tcpip.ErrNoPortAvailable:
+		return syscall.EAGAIN
+	case *tcpip.ErrAlreadyConnected:
+		return syscall.EISCONN
+	case *tcpip.ErrNotConnected:
+		return syscall.ENOTCONN
+	case *tcpip.ErrClosedForSend, *tcpip.ErrAborted:
+		return syscall.EPIPE
+	case *tcpip.ErrMessageTooLong:
+		return syscall.EMSGSIZE
+	case *tcpip.ErrNoBufferSpace:
+		return syscall.ENOBUFS
+	case *tcpip.ErrAddressFamilyNotSupported:
+		return syscall.EAFNOSUPPORT
+	case *tcpip.ErrNotPermitted:
+		return syscall.EPERM
+	case *tcpip.ErrInvalidEndpointState, *tcpip.ErrAlreadyBound, *tcpip.ErrInvalidOptionValue:
+		return syscall.EINVAL
+	default:
+		return errors.New(err.String())
+	}
+}
+
+// mapAcceptErr is like mapTCPIPErr, but accepting from a closed listener
+// returns net.ErrClosed (as the net package does).
+func mapAcceptErr(err tcpip.Error) error {
+	if _, ok := err.(*tcpip.ErrInvalidEndpointState); ok {
+		return net.ErrClosed
+	}
+
+	return mapTCPIPErr(err)
+}
@@ -0,0 +1,210 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/noisysockets/noisysockets/internal/transport"
+)
+
+// eventBufferSize is the number of events that can be queued for a subscriber.
+const eventBufferSize = 64
+
+// EventType is the type of a change in the state of a peer.
+type EventType int
+
+const (
+	// PeerAdded is a peer being added to the socket.
+	PeerAdded EventType = iota
+	// PeerRemoved is a peer being removed from the socket.
+	PeerRemoved
+	// HandshakeCompleted is a handshake with a peer completing, the tunnel to
+	// the peer is usable (again).
+	HandshakeCompleted
+	// PeerUnreachable is the socket giving up on a handshake with a peer, after
+	// it failed to complete multiple times. Packets to the peer are dropped,
+	// until it is heard from or more packets are sent to it.
+	PeerUnreachable
+	// EndpointChanged is packets starting to be sent to a different endpoint of
+	// a peer (eg. it has roamed, or is now reached via the relay).
+	EndpointChanged
+	// PeerHealthy is a peer starting to reply to health check pings (again),
+	// see HealthCheckConfig.
+	PeerHealthy
+	// PeerUnhealthy is a peer that has stopped replying to health check pings.
+	PeerUnhealthy
+	// PeerUpdated is the configuration of a peer (eg. its name, or addresses)
+	// being updated.
+	PeerUpdated
+	// PeerExpired is a peer reaching its expiry time, it is followed by the
+	// peer being removed (PeerRemoved).
+	PeerExpired
+	// PeerAddressTakenOver is an address of a peer being claimed by another
+	// peer, which packets to the address are now routed to (see
+	// Config.AddressConflicts).
+	PeerAddressTakenOver
+)
+
+func (t EventType) String() string {
+	switch t {
+	case PeerAdded:
+		return "peerAdded"
+	case PeerRemoved:
+		return "peerRemoved"
+	case HandshakeCompleted:
+		return "handshakeCompleted"
+	case PeerUnreachable:
+		return "peerUnreachable"
+	case EndpointChanged:
+		return "endpointChanged"
+	case PeerHealthy:
+		return "peerHealthy"
+	case PeerUnhealthy:
+		return "peerUnhealthy"
+	case PeerUpdated:
+		return "peerUpdated"
+	case PeerExpired:
+		return "peerExpired"
+	case PeerAddressTakenOver:
+		return "peerAddressTakenOver"
+	default:
+		return fmt.Sprintf("EventType(%d)", int(t))
+	}
+}
+
+// Event is a change in the state of a peer.
+type Event struct {
+	// Timestamp is when the event occurred.
+	Timestamp time.Time
+	// Type is the type of the event.
+	Type EventType
+	// PeerName is the name of the peer, if it has one.
+	PeerName string
+	// PeerPublicKey is the encoded public key of the peer.
+	PeerPublicKey string
+	// Endpoint is the endpoint packets are sent to, if any. It is not set for
+	// PeerAdded, PeerRemoved, PeerUpdated, PeerExpired, PeerHealthy,
+	// PeerUnhealthy, or PeerAddressTakenOver events.
+	Endpoint string
+	// Address is the address (or prefix) the peer lost, it is only set for
+	// PeerAddressTakenOver events.
+	Address string
+}
+
+// Subscribe returns a channel on which changes in the state of peers are
+// delivered, so that they can be acted upon without polling PeerStatuses().
+// Events are dropped, rather than delaying the socket, if the subscriber
+// falls behind. The returned function unsubscribes, the channel is closed once
+// unsubscribed or the socket is closed.
+func (s *NoisySocket) Subscribe() (<-chan Event, func()) {
+	return s.events.subscribe()
+}
+
+// handlePeerEvent publishes a change in the state of a peer, reported by the
+// transport.
+func (s *NoisySocket) handlePeerEvent(ev transport.PeerEvent) {
+	s.traceHandshake(ev)
+
+	// A peer we can't reach might be reachable with an introduction.
+	if in := s.introductions.Load(); in != nil && ev.Type == transport.PeerEventHandshakeInitiated {
+		in.handshakeInitiated(ev.PublicKey)
+	}
+
+	var typ EventType
+	switch ev.Type {
+	case transport.PeerEventHandshakeCompleted:
+		typ = HandshakeCompleted
+	case transport.PeerEventUnreachable:
+		typ = PeerUnreachable
+	case transport.PeerEventEndpointChanged:
+		typ = EndpointChanged
+	default:
+		// Handshake initiations are only traced.
+		return
+	}
+
+	s.events.publish(Event{
+		Timestamp:     time.Now(),
+		Type:          typ,
+		PeerName:      s.sourceSink.peerName(ev.PublicKey),
+		PeerPublicKey: ev.PublicKey.String(),
+		Endpoint:      ev.Endpoint,
+	})
+}
+
+// peerName returns the name of a peer, or an empty string if it has no name.
+func (ss *sourceSink) peerName(publicKey transport.NoisePublicKey) string {
+	ss.peersMu.RLock()
+	defer ss.peersMu.RUnlock()
+
+	for name, pk := range ss.peerNames {
+		if pk == publicKey {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// eventBus delivers events to subscribers.
+type eventBus struct {
+	mu          sync.Mutex // protects subscribers and closed
+	subscribers map[chan Event]struct{}
+	closed      bool
+}
+
+func (b *eventBus) subscribe() (<-chan Event, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan Event, eventBufferSize)
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+
+	if b.subscribers == nil {
+		b.subscribers = make(map[chan Event]struct{})
+	}
+	b.subscribers[ch] = struct{}{}
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		if _, ok := b.subscribers[ch]; ok {
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+func (b *eventBus) publish(ev Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// close closes the channels of all subscribers.
+func (b *eventBus) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for ch := range b.subscribers {
+		close(ch)
+	}
+	b.subscribers = nil
+}
@@ -0,0 +1,228 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoisySocket_Subscribe(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "server",
+		ListenPort: 12410,
+		PrivateKey: serverPrivateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "client",
+				PublicKey: clientPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.2"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+	})
+
+	lis, err := serverSocket.Listen("tcp", ":80")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = lis.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+
+	clientSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "client",
+		ListenPort: 12411,
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.2"},
+	})
+	require.NoError(t, err)
+
+	serverEvents, unsubscribeServer := serverSocket.Subscribe()
+	t.Cleanup(unsubscribeServer)
+
+	clientEvents, _ := clientSocket.Subscribe()
+
+	next := func(t *testing.T, events <-chan noisysockets.Event) noisysockets.Event {
+		select {
+		case ev, ok := <-events:
+			require.True(t, ok, "events channel closed")
+			return ev
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "timed out waiting for event")
+			return noisysockets.Event{}
+		}
+	}
+
+	invalidPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	// Peers that can't be added aren't announced, or left half configured.
+	err = clientSocket.AddPeer(v1alpha1.WireGuardPeerConfig{
+		Name:               "invalid",
+		PublicKey:          invalidPrivateKey.PublicKey().String(),
+		IPs:                []string{"10.7.0.3"},
+		IdleTimeoutSeconds: -1,
+	})
+	require.ErrorContains(t, err, "idle timeout")
+
+	err = clientSocket.RemovePeer(invalidPrivateKey.PublicKey().String())
+	require.ErrorIs(t, err, noisysockets.ErrUnknownPeer)
+
+	require.NoError(t, clientSocket.AddPeer(v1alpha1.WireGuardPeerConfig{
+		Name:      "server",
+		PublicKey: serverPrivateKey.PublicKey().String(),
+		Endpoint:  "localhost:12410",
+		IPs:       []string{"10.7.0.1"},
+	}))
+
+	ev := next(t, clientEvents)
+	require.Equal(t, noisysockets.PeerAdded, ev.Type)
+	require.Equal(t, "server", ev.PeerName)
+	require.Equal(t, serverPrivateKey.PublicKey().String(), ev.PeerPublicKey)
+
+	ev = next(t, clientEvents)
+	require.Equal(t, noisysockets.EndpointChanged, ev.Type)
+	require.Equal(t, "127.0.0.1:12410", ev.Endpoint)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	conn, err := clientSocket.DialContext(ctx, "tcp", "server:80")
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	ev = next(t, clientEvents)
+	require.Equal(t, noisysockets.HandshakeCompleted, ev.Type)
+	require.Equal(t, "server", ev.PeerName)
+	require.Equal(t, "127.0.0.1:12410", ev.Endpoint)
+
+	// The server learns the client's endpoint from the handshake.
+	ev = next(t, serverEvents)
+	require.Equal(t, noisysockets.EndpointChanged, ev.Type)
+	require.Equal(t, "client", ev.PeerName)
+	require.Equal(t, "127.0.0.1:12411", ev.Endpoint)
+
+	ev = next(t, serverEvents)
+	require.Equal(t, noisysockets.HandshakeCompleted, ev.Type)
+	require.Equal(t, "client", ev.PeerName)
+
+	require.NoError(t, clientSocket.UpdatePeer(v1alpha1.WireGuardPeerConfig{
+		Name:      "server",
+		PublicKey: serverPrivateKey.PublicKey().String(),
+		IPs:       []string{"10.7.0.1", "10.7.1.0/24"},
+	}))
+
+	ev = next(t, clientEvents)
+	require.Equal(t, noisysockets.PeerUpdated, ev.Type)
+	require.Equal(t, "server", ev.PeerName)
+
+	require.NoError(t, clientSocket.RemovePeer(serverPrivateKey.PublicKey().String()))
+
+	ev = next(t, clientEvents)
+	require.Equal(t, noisysockets.PeerRemoved, ev.Type)
+	require.Equal(t, "server", ev.PeerName)
+
+	// Closing the socket closes the channels of subscribers.
+	require.NoError(t, clientSocket.Close())
+
+	_, ok := <-clientEvents
+	require.False(t, ok)
+}
+
+func TestNoisySocket_AddressTakenOver(t *testing.T) {
+	logger := slogt.New(t)
+
+	privateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	alicePrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	bobPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	conf := &v1alpha1.Config{
+		Name:             "local",
+		ListenPort:       12462,
+		PrivateKey:       privateKey.String(),
+		IPs:              []string{"10.7.0.1"},
+		AddressConflicts: "replace",
+		Peers: []v1alpha1.WireGuardPeerConfig{{
+			Name:      "alice",
+			PublicKey: alicePrivateKey.PublicKey().String(),
+			IPs:       []string{"10.7.0.2"},
+		}},
+	}
+
+	socket, err := noisysockets.NewNoisySocket(logger, conf)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, socket.Close())
+	})
+
+	events, unsubscribe := socket.Subscribe()
+	t.Cleanup(unsubscribe)
+
+	require.NoError(t, socket.AddPeer(v1alpha1.WireGuardPeerConfig{
+		Name:      "bob",
+		PublicKey: bobPrivateKey.PublicKey().String(),
+		IPs:       []string{"10.7.0.2"},
+	}))
+
+	select {
+	case ev := <-events:
+		require.Equal(t, noisysockets.PeerAddressTakenOver, ev.Type)
+		require.Equal(t, "alice", ev.PeerName)
+		require.Equal(t, "10.7.0.2/32", ev.Address)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+
+	status, err := socket.PeerStatus("alice")
+	require.NoError(t, err)
+	require.Empty(t, status.AllowedIPs)
+
+	status, err = socket.PeerStatus("bob")
+	require.NoError(t, err)
+	require.Len(t, status.AllowedIPs, 1)
+
+	t.Run("Invalid Policy", func(t *testing.T) {
+		invalidConf := *conf
+		invalidConf.ListenPort = 0
+		invalidConf.AddressConflicts = "invalid"
+
+		_, err := noisysockets.NewNoisySocket(logger, &invalidConf)
+		require.ErrorContains(t, err, "unsupported address conflicts policy")
+	})
+}
@@ -137,11 +137,7 @@ func main() {
 					}
 					defer socket.Close()
 
-					client := &http.Client{
-						Transport: &http.Transport{
-							Dial: socket.Dial,
-						},
-					}
+					client := socket.HTTPClient()
 
 					// Peers can be resolved by name.
 					url := "http://server/"
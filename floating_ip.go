@@ -0,0 +1,130 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+// floatingIP is a virtual address, claimed by one of several peers at a time.
+type floatingIP struct {
+	prefix netip.Prefix
+	// peers are the names (or public keys) of the peers that can claim the
+	// address, in order of preference.
+	peers []string
+}
+
+func parseFloatingIPs(confs []v1alpha1.FloatingIPConfig) ([]floatingIP, error) {
+	var floatingIPs []floatingIP
+	for _, fipConf := range confs {
+		prefix, err := parseAddrOrPrefix(fipConf.IP)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse floating IP %q: %w", fipConf.IP, err)
+		}
+
+		if len(fipConf.Peers) == 0 {
+			return nil, fmt.Errorf("floating IP %s must have at least one peer", prefix)
+		}
+
+		floatingIPs = append(floatingIPs, floatingIP{prefix: prefix.Masked(), peers: fipConf.Peers})
+	}
+
+	return floatingIPs, nil
+}
+
+// failoverFloatingIPs routes each floating IP to the first of its peers that
+// isn't unhealthy. If every peer is unhealthy, the first that is configured
+// keeps it. It is called whenever peers are added, removed, or change health.
+func (s *NoisySocket) failoverFloatingIPs() {
+	s.floatingIPsMu.Lock()
+	defer s.floatingIPsMu.Unlock()
+
+	for _, fip := range s.floatingIPs {
+		var candidates, unhealthy []transport.NoisePublicKey
+		for _, peer := range fip.peers {
+			pk, err := s.lookupPeer(peer)
+			if err != nil {
+				continue
+			}
+
+			if s.peerHealth(pk) == Unhealthy {
+				unhealthy = append(unhealthy, pk)
+			} else {
+				candidates = append(candidates, pk)
+			}
+		}
+
+		owner, changed, err := s.sourceSink.SetFloatingIP(fip.prefix, append(candidates, unhealthy...))
+		if err != nil {
+			s.logger.Warn("Failed to route floating IP", "ip", fip.prefix, "error", err)
+			continue
+		}
+
+		if changed {
+			s.logger.Info("Floating IP claimed by peer",
+				"ip", fip.prefix, "peer", s.sourceSink.peerName(owner), "publicKey", owner.String())
+		}
+	}
+}
+
+// SetFloatingIP routes a floating IP to the first of the candidate peers that
+// is known (or to the peer it is reached via), replacing the peer that
+// previously claimed it. It returns the peer now claiming the address, and
+// whether it changed. If none of the candidates are known, the route is left
+// unchanged.
+func (ss *sourceSink) SetFloatingIP(prefix netip.Prefix, candidates []transport.NoisePublicKey) (transport.NoisePublicKey, bool, error) {
+	ss.peersMu.Lock()
+	defer ss.peersMu.Unlock()
+
+	previous, claimed := ss.floatingIPs[prefix]
+	if !claimed {
+		if existing, ok := ss.fromPeerAddress.Get(prefix); ok {
+			return transport.NoisePublicKey{}, false, fmt.Errorf("floating IP %s is already claimed by peer %s",
+				prefix, ss.peerDisplayName("", existing))
+		}
+
+		if prefix.IsSingleIP() {
+			for _, localAddr := range ss.localAddrs.load() {
+				if prefix.Addr() == localAddr {
+					return transport.NoisePublicKey{}, false, fmt.Errorf("floating IP %s collides with a local address", prefix)
+				}
+			}
+		}
+	}
+
+	for _, pk := range candidates {
+		if _, ok := ss.peerAddresses[pk]; !ok {
+			continue
+		}
+
+		nextHop := pk
+		if via, ok := ss.peerVia[pk]; ok {
+			nextHop = via
+		}
+
+		// Replacing the entry switches the route in one step, so that no
+		// packets are routed to neither peer.
+		ss.fromPeerAddress.Insert(prefix, nextHop)
+		ss.floatingIPs[prefix] = pk
+
+		if !claimed {
+			ss.stack.AddRoute(tcpip.Route{
+				Destination: prefixToSubnet(prefix),
+				NIC:         1,
+			})
+		}
+
+		return pk, !claimed || previous != pk, nil
+	}
+
+	// None of the peers have been added yet.
+	return previous, false, nil
+}
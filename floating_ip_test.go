@@ -0,0 +1,148 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets_test
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoisySocket_FloatingIP(t *testing.T) {
+	logger := slogt.New(t)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	primaryPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	standbyPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	// Both servers accept packets for the floating IP.
+	newServer := func(t *testing.T, name string, listenPort uint16, privateKey transport.NoisePrivateKey, ip string) *noisysockets.NoisySocket {
+		socket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+			Name:       name,
+			ListenPort: listenPort,
+			PrivateKey: privateKey.String(),
+			IPs:        []string{ip, "10.7.0.100"},
+			Peers: []v1alpha1.WireGuardPeerConfig{{
+				Name:      "client",
+				PublicKey: clientPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.1"},
+			}},
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = socket.Close()
+		})
+
+		lis, err := socket.Listen("tcp", "10.7.0.100:80")
+		require.NoError(t, err)
+
+		go func() {
+			for {
+				conn, err := lis.Accept()
+				if err != nil {
+					return
+				}
+
+				_, _ = conn.Write([]byte(name))
+				_ = conn.Close()
+			}
+		}()
+
+		return socket
+	}
+
+	primarySocket := newServer(t, "primary", 12456, primaryPrivateKey, "10.7.0.2")
+	_ = newServer(t, "standby", 12457, standbyPrivateKey, "10.7.0.3")
+
+	clientSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "client",
+		ListenPort: 12455,
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+		HealthCheck: &v1alpha1.HealthCheckConfig{
+			IntervalSeconds:    1,
+			TimeoutSeconds:     1,
+			UnhealthyThreshold: 1,
+		},
+		FloatingIPs: []v1alpha1.FloatingIPConfig{{
+			IP:    "10.7.0.100",
+			Peers: []string{"primary", standbyPrivateKey.PublicKey().String()},
+		}},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "primary",
+				PublicKey: primaryPrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12456",
+				IPs:       []string{"10.7.0.2"},
+			},
+			{
+				Name:      "standby",
+				PublicKey: standbyPrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12457",
+				IPs:       []string{"10.7.0.3"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, clientSocket.Close())
+	})
+
+	// dial returns the name of the server claiming the floating IP.
+	dial := func() string {
+		conn, err := clientSocket.Dial("tcp", "10.7.0.100:80")
+		if err != nil {
+			return ""
+		}
+		defer conn.Close()
+
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+
+		name, _ := io.ReadAll(conn)
+		return string(name)
+	}
+
+	t.Run("Primary", func(t *testing.T) {
+		require.Equal(t, "primary", dial())
+	})
+
+	t.Run("Failover", func(t *testing.T) {
+		require.NoError(t, primarySocket.Close())
+
+		require.Eventually(t, func() bool {
+			return dial() == "standby"
+		}, 10*time.Second, 100*time.Millisecond)
+	})
+
+	t.Run("Collides With Peer", func(t *testing.T) {
+		peerPrivateKey, err := transport.NewPrivateKey()
+		require.NoError(t, err)
+
+		require.Error(t, clientSocket.AddPeer(v1alpha1.WireGuardPeerConfig{
+			PublicKey: peerPrivateKey.PublicKey().String(),
+			IPs:       []string{"10.7.0.100"},
+		}))
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+			PrivateKey:  clientPrivateKey.String(),
+			FloatingIPs: []v1alpha1.FloatingIPConfig{{IP: "10.7.0.100"}},
+		})
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,393 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+const (
+	// hostForwarderMaxInFlight is the maximum number of pending TCP connection attempts.
+	hostForwarderMaxInFlight = 1024
+	// hostForwarderDialTimeout is how long to wait for a host connection to be established.
+	hostForwarderDialTimeout = 10 * time.Second
+	// hostForwarderUDPIdleTimeout is how long a UDP flow can be idle before it is closed.
+	hostForwarderUDPIdleTimeout = 2 * time.Minute
+)
+
+// hostForwarder forwards TCP and UDP traffic from peers to the host's network.
+// Connections are terminated in a dedicated promiscuous network stack and then
+// proxied through sockets on the host.
+type hostForwarder struct {
+	logger  *slog.Logger
+	stack   *stack.Stack
+	ep      *channel.Endpoint
+	deliver func(pkts []*stack.PacketBuffer)
+	// notified counts the write notifications yet to be handled, the first
+	// notifier drains the endpoint, so that packets are delivered in order.
+	notified atomic.Int64
+	// batch holds the packets being delivered, only accessed by the drainer.
+	batch []*stack.PacketBuffer
+	// nat64Prefix is the NAT64 prefix, if enabled.
+	nat64Prefix netip.Prefix
+	ctx         context.Context
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
+}
+
+func newHostForwarder(logger *slog.Logger, mtu, queueSize, batchSize int, deliver func(pkts []*stack.PacketBuffer)) (*hostForwarder, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	f := &hostForwarder{
+		logger: logger,
+		stack: stack.New(stack.Options{
+			NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+			TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+		}),
+		ep:      channel.New(queueSize, uint32(mtu), ""),
+		deliver: deliver,
+		batch:   make([]*stack.PacketBuffer, 0, batchSize),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+
+	f.ep.AddNotify(f)
+
+	if err := f.stack.CreateNIC(1, f.ep); err != nil {
+		cancel()
+		return nil, fmt.Errorf("could not create NIC: %v", err)
+	}
+
+	// Accept packets for, and send packets from, any address.
+	if err := f.stack.SetPromiscuousMode(1, true); err != nil {
+		cancel()
+		return nil, fmt.Errorf("could not enable promiscuous mode: %v", err)
+	}
+
+	if err := f.stack.SetSpoofing(1, true); err != nil {
+		cancel()
+		return nil, fmt.Errorf("could not enable spoofing: %v", err)
+	}
+
+	f.stack.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: 1},
+		{Destination: header.IPv6EmptySubnet, NIC: 1},
+	})
+
+	tcpForwarder := tcp.NewForwarder(f.stack, 0, hostForwarderMaxInFlight, f.handleTCP)
+	f.stack.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpForwarder.HandlePacket)
+
+	udpForwarder := udp.NewForwarder(f.stack, f.handleUDP)
+	f.stack.SetTransportProtocolHandler(udp.ProtocolNumber, udpForwarder.HandlePacket)
+
+	return f, nil
+}
+
+func (f *hostForwarder) Close() error {
+	f.cancel()
+
+	f.stack.RemoveNIC(1)
+	f.stack.Close()
+	f.ep.Close()
+
+	f.wg.Wait()
+
+	return nil
+}
+
+// InjectInbound queues a packet, received from a peer, for forwarding to the host network.
+func (f *hostForwarder) InjectInbound(protoNumber tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) {
+	f.ep.InjectInbound(protoNumber, pkt)
+}
+
+// WriteNotify is called whenever the stack writes a packet to the endpoint. The
+// first caller drains every packet available, in batches, while those that
+// are notified in the meantime leave their packets to it.
+func (f *hostForwarder) WriteNotify() {
+	if f.notified.Add(1) != 1 {
+		return
+	}
+
+	for {
+		notified := f.notified.Load()
+		f.drain()
+
+		// Packets written since the load are drained by another pass.
+		if f.notified.Add(-notified) == 0 {
+			return
+		}
+	}
+}
+
+// drain delivers every packet available from the endpoint. Once the forwarder
+// is closing, packets are released rather than delivered.
+func (f *hostForwarder) drain() {
+	for {
+		for len(f.batch) < cap(f.batch) {
+			pkt := f.ep.Read()
+			if pkt.IsNil() {
+				break
+			}
+			f.batch = append(f.batch, pkt)
+		}
+
+		if len(f.batch) == 0 {
+			return
+		}
+
+		if f.ctx.Err() == nil {
+			f.deliver(f.batch)
+		}
+
+		for i, pkt := range f.batch {
+			pkt.DecRef()
+			f.batch[i] = nil
+		}
+
+		full := len(f.batch) == cap(f.batch)
+		f.batch = f.batch[:0]
+
+		if !full {
+			return
+		}
+	}
+}
+
+func (f *hostForwarder) handleTCP(r *tcp.ForwarderRequest) {
+	dst, ok := f.hostAddress(r.ID())
+	if !ok {
+		r.Complete(true)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(f.ctx, hostForwarderDialTimeout)
+	defer cancel()
+
+	var d net.Dialer
+	hostConn, err := d.DialContext(ctx, "tcp", dst)
+	if err != nil {
+		f.logger.Debug("Failed to dial host", "address", dst, "error", err)
+		r.Complete(true)
+		return
+	}
+
+	var wq waiter.Queue
+	ep, tcpErr := r.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		f.logger.Debug("Failed to create endpoint", "address", dst, "error", tcpErr)
+		r.Complete(true)
+		_ = hostConn.Close()
+		return
+	}
+	r.Complete(false)
+
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+
+		f.splice(newTCPConn(&wq, ep), hostConn)
+	}()
+}
+
+func (f *hostForwarder) handleUDP(r *udp.ForwarderRequest) {
+	dst, ok := f.hostAddress(r.ID())
+	if !ok {
+		return
+	}
+
+	var wq waiter.Queue
+	ep, tcpErr := r.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		f.logger.Debug("Failed to create endpoint", "address", dst, "error", tcpErr)
+		return
+	}
+
+	peerConn := gonet.NewUDPConn(&wq, ep)
+
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+
+		hostConn, err := net.Dial("udp", dst)
+		if err != nil {
+			f.logger.Debug("Failed to dial host", "address", dst, "error", err)
+			_ = peerConn.Close()
+			return
+		}
+
+		f.splice(&idleTimeoutConn{Conn: peerConn, timeout: hostForwarderUDPIdleTimeout},
+			&idleTimeoutConn{Conn: hostConn, timeout: hostForwarderUDPIdleTimeout})
+	}()
+}
+
+// hostAddress returns the address, on the host's network, that a connection
+// is forwarded to. Connections to the NAT64 prefix are forwarded to the IPv4
+// address embedded within it, or rejected if it can't be forwarded to.
+func (f *hostForwarder) hostAddress(id stack.TransportEndpointID) (string, bool) {
+	addr, _ := netip.AddrFromSlice(id.LocalAddress.AsSlice())
+
+	if f.nat64Prefix.IsValid() && f.nat64Prefix.Contains(addr) {
+		var ok bool
+		addr, ok = nat64Extract(f.nat64Prefix, addr)
+		if !ok {
+			f.logger.Debug("Rejecting NAT64 connection to unreachable address",
+				"address", id.LocalAddress.String())
+			return "", false
+		}
+	}
+
+	return netip.AddrPortFrom(addr, id.LocalPort).String(), true
+}
+
+// splice copies data between the two connections until both directions are
+// finished, either side fails, or the forwarder is shut down. When one side
+// finishes writing, the write half of the other is closed (if it supports
+// half-closes), so the end of the stream is passed on.
+func (f *hostForwarder) splice(a, b net.Conn) {
+	ctx, cancel := context.WithCancel(f.ctx)
+	defer cancel()
+
+	go func() {
+		<-ctx.Done()
+		_ = a.Close()
+		_ = b.Close()
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	copyConn := func(dst, src net.Conn) {
+		defer wg.Done()
+
+		if _, err := io.Copy(dst, src); err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				f.logger.Debug("Failed to forward", "error", err)
+			}
+			cancel()
+			return
+		}
+
+		if hc, ok := dst.(halfCloser); ok {
+			_ = hc.CloseWrite()
+		} else {
+			cancel()
+		}
+	}
+
+	go copyConn(a, b)
+	go copyConn(b, a)
+
+	wg.Wait()
+}
+
+// idleTimeoutConn is a net.Conn that closes reads after a period of inactivity.
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleTimeoutConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+
+	return c.Conn.Read(b)
+}
+
+// forwardToHostLocked reports whether a packet received from a peer should be
+// forwarded to the host network rather than handled by the network stack.
+// Must hold ss.peersMu.
+func (ss *sourceSink) forwardToHostLocked(protoNumber tcpip.NetworkProtocolNumber, pkt []byte) bool {
+	var src, dst netip.Addr
+	switch protoNumber {
+	case header.IPv4ProtocolNumber:
+		hdr := header.IPv4(pkt)
+		src = netip.AddrFrom4(hdr.SourceAddress().As4())
+		dst = netip.AddrFrom4(hdr.DestinationAddress().As4())
+	case header.IPv6ProtocolNumber:
+		hdr := header.IPv6(pkt)
+		src = netip.AddrFrom16(hdr.SourceAddress().As16())
+		dst = netip.AddrFrom16(hdr.DestinationAddress().As16())
+	default:
+		return false
+	}
+
+	for _, localAddr := range ss.localAddrs.load() {
+		if dst == localAddr {
+			return false
+		}
+	}
+
+	// Broadcast and multicast packets are never forwarded beyond the mesh.
+	if isGroupAddress(dst) {
+		return false
+	}
+
+	// Only forward traffic from known peers, otherwise we'd have nowhere to send the replies.
+	if _, ok := ss.fromPeerAddress.Lookup(src); !ok {
+		return false
+	}
+
+	_, ok := ss.fromPeerAddress.Lookup(dst)
+	return !ok
+}
+
+// deliverFromHost queues a batch of replies from the host network to be sent
+// to peers, dropping those whose destination isn't routable, or that there is
+// no room for. The caller keeps its references to the packets.
+func (ss *sourceSink) deliverFromHost(pkts []*stack.PacketBuffer) {
+	batch := packetBufferListPool.Get().(*stack.PacketBufferList)
+	defer packetBufferListPool.Put(batch)
+
+	for _, pkt := range pkts {
+		dstAddr := pkt.Network().DestinationAddress()
+		dst, _ := netip.AddrFromSlice(dstAddr.AsSlice())
+
+		ss.peersMu.RLock()
+		_, ok := ss.fromPeerAddress.Lookup(dst)
+		ss.peersMu.RUnlock()
+		if !ok {
+			ss.readDropped.Add(1)
+			ss.logDropped("Dropping reply from host to unknown destination", "destination", dst)
+			continue
+		}
+
+		// The list releases a reference when it is reset.
+		batch.PushBack(pkt.IncRef())
+	}
+
+	if batch.Len() == 0 {
+		return
+	}
+
+	// Like a NIC, writing stops at the first packet there is no room for.
+	n, _ := ss.nic.WritePackets(*batch)
+	if dropped := batch.Len() - n; dropped > 0 {
+		ss.readDropped.Add(uint64(dropped))
+		ss.logDropped("Dropping replies from host, outbound queue is full", "count", dropped)
+	}
+	batch.Reset()
+}
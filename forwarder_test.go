@@ -0,0 +1,109 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+func TestHostForwarder_WriteNotify(t *testing.T) {
+	const (
+		writers   = 4
+		perWriter = 2000
+		batchSize = 8
+	)
+
+	var (
+		mu           sync.Mutex
+		delivered    = make([][]uint32, writers)
+		maxBatchSize int
+	)
+
+	f, err := newHostForwarder(slog.Default(), 1420, 64, batchSize, func(pkts []*stack.PacketBuffer) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		maxBatchSize = max(maxBatchSize, len(pkts))
+
+		for _, pkt := range pkts {
+			data := pkt.ToBuffer()
+			b := data.Flatten()
+			data.Release()
+
+			writer, seq := binary.BigEndian.Uint32(b), binary.BigEndian.Uint32(b[4:])
+			delivered[writer] = append(delivered[writer], seq)
+		}
+	})
+	require.NoError(t, err)
+
+	// write queues a packet, as the forwarder's stack does. It reports whether
+	// there was room for it.
+	write := func(writer, seq uint32) (bool, tcpip.Error) {
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint32(b, writer)
+		binary.BigEndian.PutUint32(b[4:], seq)
+
+		pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(b)})
+		defer pkt.DecRef()
+
+		var pkts stack.PacketBufferList
+		pkts.PushBack(pkt.IncRef())
+		defer pkts.Reset()
+
+		n, err := f.ep.WritePackets(pkts)
+		return n == 1, err
+	}
+
+	var wg sync.WaitGroup
+	for writer := uint32(0); writer < writers; writer++ {
+		writer := writer
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for seq := uint32(0); seq < perWriter; seq++ {
+				// Retry until there is room in the queue.
+				for {
+					written, err := write(writer, seq)
+					if err != nil {
+						t.Errorf("could not write packet: %s", err)
+						return
+					}
+					if written {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	mu.Lock()
+	// Every packet is delivered once, in the order it was written.
+	for writer := range delivered {
+		require.Len(t, delivered[writer], perWriter)
+		for seq, delivered := range delivered[writer] {
+			require.Equal(t, uint32(seq), delivered)
+		}
+	}
+	require.LessOrEqual(t, maxBatchSize, batchSize)
+	mu.Unlock()
+
+	require.NoError(t, f.Close())
+
+	// Once closed, packets are no longer delivered.
+	_, tcpipErr := write(0, perWriter)
+	require.IsType(t, &tcpip.ErrClosedForSend{}, tcpipErr)
+}
@@ -0,0 +1,159 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// Packets written to the source sink come straight from peers, any one of
+// which may be hostile, so none of these paths may panic, whatever the packet.
+
+var (
+	fuzzLocalAddr4 = netip.MustParseAddr("10.7.0.1")
+	fuzzPeerAddr4  = netip.MustParseAddr("10.7.0.2")
+	fuzzLocalAddr6 = netip.MustParseAddr("fd00::1")
+	fuzzPeerAddr6  = netip.MustParseAddr("fd00::2")
+)
+
+func FuzzInboundProtocol(f *testing.F) {
+	addPacketSeeds(f)
+
+	f.Fuzz(func(t *testing.T, pkt []byte) {
+		protoNumber, err := inboundProtocol(pkt)
+		if err != nil {
+			return
+		}
+
+		// Everything after relies on the lengths in the header.
+		switch protoNumber {
+		case header.IPv4ProtocolNumber:
+			require.True(t, header.IPv4(pkt).IsValid(len(pkt)))
+		case header.IPv6ProtocolNumber:
+			require.True(t, header.IPv6(pkt).IsValid(len(pkt)))
+		default:
+			t.Fatalf("unexpected network protocol %d", protoNumber)
+		}
+	})
+}
+
+func FuzzOutboundDestination(f *testing.F) {
+	addPacketSeeds(f)
+
+	f.Fuzz(func(t *testing.T, pkt []byte) {
+		for _, protoNumber := range []tcpip.NetworkProtocolNumber{header.IPv4ProtocolNumber, header.IPv6ProtocolNumber} {
+			addr, err := outboundDestination(protoNumber, pkt, len(pkt))
+			if err != nil {
+				continue
+			}
+
+			require.Equal(t, protoNumber == header.IPv4ProtocolNumber, addr.Is4())
+		}
+	})
+}
+
+func FuzzParseACLPacket(f *testing.F) {
+	addPacketSeeds(f)
+
+	f.Fuzz(func(t *testing.T, pkt []byte) {
+		protoNumber, err := inboundProtocol(pkt)
+		if err != nil {
+			return
+		}
+
+		_, _, payload, ok := parseACLPacket(protoNumber, pkt)
+		if ok {
+			require.LessOrEqual(t, len(payload), len(pkt))
+		}
+	})
+}
+
+func FuzzClampMSS(f *testing.F) {
+	addPacketSeeds(f)
+
+	f.Fuzz(func(t *testing.T, pkt []byte) {
+		protoNumber, err := inboundProtocol(pkt)
+		if err != nil {
+			return
+		}
+
+		size := len(pkt)
+		if clampMSS(protoNumber, pkt, 1240) {
+			// Clamping is done in place, and only ever lowers the MSS.
+			require.Len(t, pkt, size)
+			require.False(t, clampMSS(protoNumber, pkt, 1240))
+		}
+	})
+}
+
+func FuzzSourceSinkWrite(f *testing.F) {
+	addPacketSeeds(f)
+
+	privateKey, err := transport.NewPrivateKey()
+	require.NoError(f, err)
+
+	ss, _, err := newSourceSink("local", privateKey.PublicKey(), []netip.Addr{fuzzLocalAddr4, fuzzLocalAddr6}, sourceSinkOptions{})
+	require.NoError(f, err)
+	f.Cleanup(func() {
+		_ = ss.Close()
+	})
+
+	peerPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(f, err)
+	peerPublicKey := peerPrivateKey.PublicKey()
+
+	require.NoError(f, ss.AddPeer("peer", peerPublicKey, []netip.Prefix{
+		netip.PrefixFrom(fuzzPeerAddr4, fuzzPeerAddr4.BitLen()),
+		netip.PrefixFrom(fuzzPeerAddr6, fuzzPeerAddr6.BitLen()),
+	}))
+
+	// Exercise every optional stage of the inbound path.
+	require.NoError(f, ss.SetACL([]v1alpha1.ACLRuleConfig{
+		{Action: "allow", Peer: "peer", Direction: "inbound", Protocol: "tcp", Ports: "80"},
+		{Action: "deny", Peer: "peer", Direction: "inbound", Protocol: "udp"},
+	}))
+	require.NoError(f, ss.SetForwarding(true))
+	ss.SetMSSClamping(true)
+	ss.SetEchoReply(false)
+
+	sources := []transport.NoisePublicKey{peerPublicKey}
+
+	f.Fuzz(func(t *testing.T, pkt []byte) {
+		n, err := ss.Write([][]byte{pkt}, sources, 0)
+		require.NoError(t, err)
+		require.Equal(t, 1, n)
+	})
+}
+
+// addPacketSeeds seeds the corpus with well formed packets, and a few that
+// are truncated, so that fuzzing starts from packets that get past the header
+// checks.
+func addPacketSeeds(f *testing.F) {
+	icmpPayload := make([]byte, header.ICMPv4MinimumSize)
+	header.ICMPv4(icmpPayload).SetType(header.ICMPv4Echo)
+
+	seeds := [][]byte{
+		newTestTCPSegment(fuzzPeerAddr4, fuzzLocalAddr4, header.TCPFlagSyn, 1460),
+		newTestTCPSegment(fuzzPeerAddr6, fuzzLocalAddr6, header.TCPFlagSyn, 1440),
+		newIPv4Packet(tcpip.AddrFrom4(fuzzPeerAddr4.As4()), tcpip.AddrFrom4(fuzzLocalAddr4.As4()), header.UDPProtocolNumber, make([]byte, header.UDPMinimumSize)),
+		newIPv4Packet(tcpip.AddrFrom4(fuzzPeerAddr4.As4()), tcpip.AddrFrom4(fuzzLocalAddr4.As4()), header.ICMPv4ProtocolNumber, icmpPayload),
+		newIPv4Fragment(tcpip.AddrFrom4(fuzzPeerAddr4.As4()), tcpip.AddrFrom4(fuzzLocalAddr4.As4()), 1, 8, false, make([]byte, 8)),
+		{0x45, 0x00},
+		{0x60},
+		{},
+	}
+
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+}
@@ -0,0 +1,266 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+)
+
+const (
+	// defaultHealthCheckInterval is how often each peer is pinged by default.
+	defaultHealthCheckInterval = 10 * time.Second
+	// defaultHealthCheckTimeout is how long to wait for a reply by default.
+	defaultHealthCheckTimeout = 2 * time.Second
+	// defaultUnhealthyThreshold is how many consecutive pings must go
+	// unanswered, by default, before a peer is unhealthy.
+	defaultUnhealthyThreshold = 3
+	// defaultHealthyThreshold is how many consecutive pings must be answered,
+	// by default, before a peer is healthy.
+	defaultHealthyThreshold = 1
+)
+
+// Health is the result of actively checking the health of a peer.
+type Health int
+
+const (
+	// HealthUnknown is a peer that hasn't been checked enough times yet, or
+	// health checking is disabled.
+	HealthUnknown Health = iota
+	// Healthy is a peer that is replying to pings.
+	Healthy
+	// Unhealthy is a peer that has stopped replying to pings.
+	Unhealthy
+)
+
+func (h Health) String() string {
+	switch h {
+	case HealthUnknown:
+		return "unknown"
+	case Healthy:
+		return "healthy"
+	case Unhealthy:
+		return "unhealthy"
+	default:
+		return fmt.Sprintf("Health(%d)", int(h))
+	}
+}
+
+// healthCheckOptions are the parsed health check configuration.
+type healthCheckOptions struct {
+	interval           time.Duration
+	timeout            time.Duration
+	unhealthyThreshold int
+	healthyThreshold   int
+}
+
+func parseHealthCheckConfig(conf *v1alpha1.HealthCheckConfig) (healthCheckOptions, error) {
+	opts := healthCheckOptions{
+		interval:           defaultHealthCheckInterval,
+		timeout:            defaultHealthCheckTimeout,
+		unhealthyThreshold: defaultUnhealthyThreshold,
+		healthyThreshold:   defaultHealthyThreshold,
+	}
+
+	if conf.IntervalSeconds < 0 || conf.TimeoutSeconds < 0 || conf.UnhealthyThreshold < 0 || conf.HealthyThreshold < 0 {
+		return healthCheckOptions{}, fmt.Errorf("health check settings must not be negative")
+	}
+
+	if conf.IntervalSeconds > 0 {
+		opts.interval = time.Duration(conf.IntervalSeconds) * time.Second
+	}
+	if conf.TimeoutSeconds > 0 {
+		opts.timeout = time.Duration(conf.TimeoutSeconds) * time.Second
+	}
+	if conf.UnhealthyThreshold > 0 {
+		opts.unhealthyThreshold = conf.UnhealthyThreshold
+	}
+	if conf.HealthyThreshold > 0 {
+		opts.healthyThreshold = conf.HealthyThreshold
+	}
+
+	if opts.timeout > opts.interval {
+		return healthCheckOptions{}, fmt.Errorf("health check timeout must not exceed its interval")
+	}
+
+	return opts, nil
+}
+
+// peerHealth is the health check state of a peer.
+type peerHealth struct {
+	health Health
+	// successes and failures are the number of consecutive pings that were,
+	// or weren't, answered.
+	successes int
+	failures  int
+	// rtt is the round trip time of the most recently answered ping.
+	rtt time.Duration
+}
+
+// healthChecker periodically pings each peer, and tracks whether they are
+// healthy.
+type healthChecker struct {
+	logger *slog.Logger
+	s      *NoisySocket
+	opts   healthCheckOptions
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	mu     sync.Mutex // protects peers
+	peers  map[transport.NoisePublicKey]*peerHealth
+}
+
+func newHealthChecker(logger *slog.Logger, s *NoisySocket, opts healthCheckOptions) *healthChecker {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c := &healthChecker{
+		logger: logger,
+		s:      s,
+		opts:   opts,
+		cancel: cancel,
+		peers:  make(map[transport.NoisePublicKey]*peerHealth),
+	}
+
+	c.wg.Add(1)
+	go c.run(ctx)
+
+	return c
+}
+
+// Close stops health checking.
+func (c *healthChecker) Close() {
+	c.cancel()
+	c.wg.Wait()
+}
+
+// status returns the health of a peer, and the round trip time of the most
+// recently answered ping.
+func (c *healthChecker) status(pk transport.NoisePublicKey) (Health, time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	h, ok := c.peers[pk]
+	if !ok {
+		return HealthUnknown, 0
+	}
+
+	return h.health, h.rtt
+}
+
+func (c *healthChecker) run(ctx context.Context) {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.opts.interval)
+	defer ticker.Stop()
+
+	for {
+		c.s.peerConfigsMu.Lock()
+		publicKeys := make(map[transport.NoisePublicKey]struct{}, len(c.s.peerConfigs))
+		for pk := range c.s.peerConfigs {
+			publicKeys[pk] = struct{}{}
+		}
+		c.s.peerConfigsMu.Unlock()
+
+		// Forget about peers that have been removed.
+		c.mu.Lock()
+		for pk := range c.peers {
+			if _, ok := publicKeys[pk]; !ok {
+				delete(c.peers, pk)
+			}
+		}
+		c.mu.Unlock()
+
+		// Peers are pinged concurrently, so that unresponsive peers don't delay
+		// checking the rest.
+		var wg sync.WaitGroup
+		for pk := range publicKeys {
+			wg.Add(1)
+			go func(pk transport.NoisePublicKey) {
+				defer wg.Done()
+
+				c.checkPeer(ctx, pk)
+			}(pk)
+		}
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkPeer pings a peer, and updates its health accordingly.
+func (c *healthChecker) checkPeer(ctx context.Context, pk transport.NoisePublicKey) {
+	ss := c.s.sourceSink
+
+	src, dst, ok := ss.probeAddrs(pk)
+	if !ok {
+		// Peers that only route subnets have no address to ping.
+		return
+	}
+
+	start := time.Now()
+	replied := ss.probe(ctx, src, dst, 0, c.opts.timeout)
+	rtt := time.Since(start)
+
+	if ctx.Err() != nil {
+		return
+	}
+
+	c.mu.Lock()
+	h, ok := c.peers[pk]
+	if !ok {
+		h = &peerHealth{}
+		c.peers[pk] = h
+	}
+
+	previous := h.health
+	if replied {
+		h.successes++
+		h.failures = 0
+		h.rtt = rtt
+
+		if h.successes >= c.opts.healthyThreshold {
+			h.health = Healthy
+		}
+	} else {
+		h.failures++
+		h.successes = 0
+
+		if h.failures >= c.opts.unhealthyThreshold {
+			h.health = Unhealthy
+		}
+	}
+	health := h.health
+	c.mu.Unlock()
+
+	if health == previous {
+		return
+	}
+
+	c.logger.Debug("Peer health changed", "peer", dst, "health", health)
+
+	typ := PeerHealthy
+	if health == Unhealthy {
+		typ = PeerUnhealthy
+	}
+
+	c.s.events.publish(Event{
+		Timestamp:     time.Now(),
+		Type:          typ,
+		PeerName:      ss.peerName(pk),
+		PeerPublicKey: pk.String(),
+	})
+
+	c.s.failoverFloatingIPs()
+}
@@ -0,0 +1,119 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoisySocket_HealthCheck(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "server",
+		ListenPort: 12417,
+		PrivateKey: serverPrivateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "client",
+				PublicKey: clientPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.2"},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	clientSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "client",
+		ListenPort: 12418,
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.2"},
+		HealthCheck: &v1alpha1.HealthCheckConfig{
+			IntervalSeconds:    1,
+			TimeoutSeconds:     1,
+			UnhealthyThreshold: 2,
+		},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "server",
+				PublicKey: serverPrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12417",
+				IPs:       []string{"10.7.0.1"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, clientSocket.Close())
+	})
+
+	events, unsubscribe := clientSocket.Subscribe()
+	t.Cleanup(unsubscribe)
+
+	nextHealthEvent := func() noisysockets.Event {
+		timeout := time.After(10 * time.Second)
+		for {
+			select {
+			case ev := <-events:
+				if ev.Type == noisysockets.PeerHealthy || ev.Type == noisysockets.PeerUnhealthy {
+					return ev
+				}
+			case <-timeout:
+				t.Fatal("timed out waiting for health event")
+			}
+		}
+	}
+
+	ev := nextHealthEvent()
+	require.Equal(t, noisysockets.PeerHealthy, ev.Type)
+	require.Equal(t, "server", ev.PeerName)
+
+	status, err := clientSocket.PeerStatus("server")
+	require.NoError(t, err)
+	require.Equal(t, noisysockets.Healthy, status.Health)
+	require.NotZero(t, status.HealthCheckRTT)
+
+	// Peers without health checking enabled don't know the health of their peers.
+	status, err = serverSocket.PeerStatus("client")
+	require.NoError(t, err)
+	require.Equal(t, noisysockets.HealthUnknown, status.Health)
+
+	require.NoError(t, serverSocket.Close())
+
+	ev = nextHealthEvent()
+	require.Equal(t, noisysockets.PeerUnhealthy, ev.Type)
+	require.Equal(t, serverPrivateKey.PublicKey().String(), ev.PeerPublicKey)
+
+	status, err = clientSocket.PeerStatus("server")
+	require.NoError(t, err)
+	require.Equal(t, noisysockets.Unhealthy, status.Health)
+
+	t.Run("Invalid Config", func(t *testing.T) {
+		_, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+			PrivateKey: clientPrivateKey.String(),
+			IPs:        []string{"10.7.0.2"},
+			HealthCheck: &v1alpha1.HealthCheckConfig{
+				IntervalSeconds: 1,
+				TimeoutSeconds:  5,
+			},
+		})
+		require.Error(t, err)
+	})
+}
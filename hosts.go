@@ -0,0 +1,163 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// The entries of a synced hosts file are kept between these markers, so that
+// the rest of the file (eg. the system's own entries) is left alone.
+const (
+	hostsFileBeginMarker = "# BEGIN noisysockets"
+	hostsFileEndMarker   = "# END noisysockets"
+)
+
+// Hosts renders the names, and addresses, of the socket and its named peers
+// as hosts file (see hosts(5)) entries. Names are qualified with the mesh's
+// domain, if any, and the unqualified names are aliases.
+func (n *noisyNet) Hosts() []byte {
+	type host struct {
+		name  string
+		addrs []netip.Addr
+	}
+
+	hosts := []host{{name: n.localName, addrs: n.localAddrs.load()}}
+
+	n.peersMu.RLock()
+	for name, pk := range n.peerNames {
+		hosts = append(hosts, host{name: name, addrs: slices.Clone(n.peerAddresses[pk])})
+	}
+	n.peersMu.RUnlock()
+
+	slices.SortFunc(hosts, func(a, b host) int {
+		return strings.Compare(a.name, b.name)
+	})
+
+	var buf bytes.Buffer
+	for _, h := range hosts {
+		if h.name == "" {
+			continue
+		}
+
+		names := h.name
+		if qualified := n.qualifyName(h.name); qualified != h.name {
+			names = qualified + " " + h.name
+		}
+
+		for _, addr := range h.addrs {
+			fmt.Fprintf(&buf, "%s\t%s\n", addr, names)
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// SyncHostsFile keeps the entries of the socket and its peers (see Hosts) in a
+// hosts file, eg. /etc/hosts, so that tools outside of this process (eg. when
+// the socket is bridged to a TUN device) can resolve the names of peers. The
+// entries are updated whenever peers are added, removed, or updated, any
+// other lines in the file are left as they are. The returned function stops
+// syncing, and removes the entries, as does closing the socket.
+func (s *NoisySocket) SyncHostsFile(path string) (func(), error) {
+	entries := s.Hosts()
+	if err := updateHostsFile(path, entries); err != nil {
+		return nil, err
+	}
+
+	events, unsubscribe := s.Subscribe()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for ev := range events {
+			switch ev.Type {
+			case PeerAdded, PeerRemoved, PeerUpdated:
+			default:
+				continue
+			}
+
+			updated := s.Hosts()
+			if bytes.Equal(updated, entries) {
+				continue
+			}
+			entries = updated
+
+			if err := updateHostsFile(path, entries); err != nil {
+				s.logger.Warn("Failed to update hosts file", "path", path, "error", err)
+			}
+		}
+
+		if err := updateHostsFile(path, nil); err != nil {
+			s.logger.Warn("Failed to remove entries from hosts file", "path", path, "error", err)
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			unsubscribe()
+			wg.Wait()
+		})
+	}, nil
+}
+
+// updateHostsFile replaces the entries between the markers in a hosts file,
+// creating it if it doesn't exist. The file is rewritten in place, rather than
+// replaced, as /etc/hosts is often a bind mount (eg. in containers).
+func updateHostsFile(path string, entries []byte) error {
+	existing, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("could not read hosts file: %w", err)
+	}
+
+	var buf bytes.Buffer
+	var inBlock bool
+	for _, line := range strings.SplitAfter(string(existing), "\n") {
+		switch strings.TrimSpace(line) {
+		case hostsFileBeginMarker:
+			inBlock = true
+			continue
+		case hostsFileEndMarker:
+			inBlock = false
+			continue
+		}
+
+		if !inBlock {
+			buf.WriteString(line)
+		}
+	}
+
+	if len(entries) > 0 {
+		if buf.Len() > 0 && !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+			buf.WriteByte('\n')
+		}
+
+		buf.WriteString(hostsFileBeginMarker + "\n")
+		buf.Write(entries)
+		buf.WriteString(hostsFileEndMarker + "\n")
+	}
+
+	if bytes.Equal(buf.Bytes(), existing) {
+		return nil
+	}
+
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("could not write hosts file: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoisySocket_Hosts(t *testing.T) {
+	logger := slogt.New(t)
+
+	privateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	webPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	dbPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	socket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "client",
+		PrivateKey: privateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+		Domain:     "my-net.internal",
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "web",
+				PublicKey: webPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.2", "fdff:7061:ac89::2", "10.8.0.0/16"},
+			},
+			{
+				// Peers without names can't be resolved.
+				PublicKey: dbPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.3"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, socket.Close())
+	})
+
+	require.Equal(t, "10.7.0.1\tclient.my-net.internal client\n"+
+		"10.7.0.2\tweb.my-net.internal web\n"+
+		"fdff:7061:ac89::2\tweb.my-net.internal web\n", string(socket.Hosts()))
+
+	t.Run("Sync", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "hosts")
+
+		systemEntries := "127.0.0.1\tlocalhost\n::1\tlocalhost\n"
+		require.NoError(t, os.WriteFile(path, []byte(systemEntries), 0o644))
+
+		stop, err := socket.SyncHostsFile(path)
+		require.NoError(t, err)
+
+		readHosts := func() string {
+			buf, err := os.ReadFile(path)
+			require.NoError(t, err)
+			return string(buf)
+		}
+
+		require.Equal(t, systemEntries+"# BEGIN noisysockets\n"+string(socket.Hosts())+"# END noisysockets\n", readHosts())
+
+		require.NoError(t, socket.UpdatePeer(v1alpha1.WireGuardPeerConfig{
+			Name:      "db",
+			PublicKey: dbPrivateKey.PublicKey().String(),
+			IPs:       []string{"10.7.0.3"},
+		}))
+
+		require.Eventually(t, func() bool {
+			return readHosts() == systemEntries+"# BEGIN noisysockets\n"+
+				"10.7.0.1\tclient.my-net.internal client\n"+
+				"10.7.0.3\tdb.my-net.internal db\n"+
+				"10.7.0.2\tweb.my-net.internal web\n"+
+				"fdff:7061:ac89::2\tweb.my-net.internal web\n"+
+				"# END noisysockets\n"
+		}, 5*time.Second, 10*time.Millisecond)
+
+		require.NoError(t, socket.RemovePeer(webPrivateKey.PublicKey().String()))
+
+		require.Eventually(t, func() bool {
+			return readHosts() == systemEntries+"# BEGIN noisysockets\n"+
+				"10.7.0.1\tclient.my-net.internal client\n"+
+				"10.7.0.3\tdb.my-net.internal db\n"+
+				"# END noisysockets\n"
+		}, 5*time.Second, 10*time.Millisecond)
+
+		// Stopping removes the entries.
+		stop()
+		require.Equal(t, systemEntries, readHosts())
+	})
+}
@@ -0,0 +1,41 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// httpDialTimeout is how long HTTP connections through the mesh can take to be
+// established, it matches the dialer of http.DefaultTransport.
+const httpDialTimeout = 30 * time.Second
+
+// HTTPTransport returns a new HTTP transport that connects to servers through
+// the mesh, so that peers can be addressed by name (eg. "http://server/"). It
+// has the same timeouts and connection pooling as http.DefaultTransport, but
+// ignores any proxy configured in the environment.
+func (n *noisyNet) HTTPTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	t.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(ctx, httpDialTimeout)
+		defer cancel()
+
+		return n.DialContext(ctx, network, address)
+	}
+
+	return t
+}
+
+// HTTPClient returns a new HTTP client that makes requests through the mesh,
+// using a transport returned by HTTPTransport(). Requests have no overall
+// timeout, set the client's Timeout (or use a request context) to add one.
+func (n *noisyNet) HTTPClient() *http.Client {
+	return &http.Client{Transport: n.HTTPTransport()}
+}
@@ -0,0 +1,102 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoisySocket_HTTPClient(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "server",
+		ListenPort: 12404,
+		PrivateKey: serverPrivateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				PublicKey: clientPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.2"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+	})
+
+	lis, err := serverSocket.Listen("tcp", ":80")
+	require.NoError(t, err)
+
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "Hello, world!")
+		}),
+	}
+	t.Cleanup(func() {
+		_ = srv.Close()
+	})
+
+	go func() {
+		_ = srv.Serve(lis)
+	}()
+
+	clientSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "client",
+		ListenPort: 12405,
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "server",
+				PublicKey: serverPrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12404",
+				IPs:       []string{"10.7.0.1"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, clientSocket.Close())
+	})
+
+	// Proxies configured for the host network don't apply to the mesh.
+	t.Setenv("HTTP_PROXY", "http://127.0.0.1:1")
+
+	client := clientSocket.HTTPClient()
+	client.Timeout = 5 * time.Second
+	t.Cleanup(client.CloseIdleConnections)
+
+	resp, err := client.Get("http://server/")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, resp.Body.Close())
+	})
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	require.Equal(t, "Hello, world!", string(body))
+}
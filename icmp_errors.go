@@ -0,0 +1,211 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// udpConns are the stack's UDP endpoints, and the wait queues they notify, so
+// that ICMP errors the stack doesn't report itself can be delivered to them.
+type udpConns struct {
+	mu     sync.Mutex
+	queues map[tcpip.Endpoint]*waiter.Queue
+}
+
+func (c *udpConns) add(ep tcpip.Endpoint, wq *waiter.Queue) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.queues == nil {
+		c.queues = make(map[tcpip.Endpoint]*waiter.Queue)
+	}
+	c.queues[ep] = wq
+}
+
+func (c *udpConns) remove(ep tcpip.Endpoint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.queues, ep)
+}
+
+func (c *udpConns) get(ep tcpip.Endpoint) *waiter.Queue {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.queues[ep]
+}
+
+// newUDPConn returns a conn for a UDP endpoint that notifies wq. Like Linux,
+// an ICMP error (eg. port unreachable) for a connected endpoint fails its next
+// read, or write. A pending read is woken by the error, rather than waiting
+// for a reply that will never come.
+func (n *noisyNet) newUDPConn(wq *waiter.Queue, ep tcpip.Endpoint) *gonet.UDPConn {
+	// The stack only notifies errors with EventErr, which gonet doesn't wait
+	// for, so the conn waits on its own queue, that errors are relayed to as
+	// readable (and writable) events.
+	var connWQ waiter.Queue
+	entry := waiter.NewFunctionEntry(waiter.EventIn|waiter.EventOut|waiter.EventErr|waiter.EventHUp, func(mask waiter.EventMask) {
+		if mask&waiter.EventErr != 0 {
+			mask |= waiter.ReadableEvents | waiter.WritableEvents
+		}
+
+		connWQ.Notify(mask)
+
+		// The endpoint has been closed.
+		if mask&waiter.EventHUp != 0 {
+			n.udpConns.remove(ep)
+		}
+	})
+	wq.EventRegister(&entry)
+
+	n.udpConns.add(ep, wq)
+
+	return gonet.NewUDPConn(&connWQ, n.connBytes.track(ep, wq))
+}
+
+// handleICMPError delivers an inbound ICMP destination unreachable message,
+// for a datagram sent by a connected UDP endpoint, to the endpoint. The stack
+// only reports port unreachable errors itself, this covers the others (eg.
+// host unreachable). The message is still delivered to the stack.
+func (ss *sourceSink) handleICMPError(protoNumber tcpip.NetworkProtocolNumber, pkt []byte) {
+	id, tcpipErr, ok := parseDestinationUnreachable(protoNumber, pkt)
+	if !ok {
+		return
+	}
+
+	tep := ss.stack.FindTransportEndpoint(protoNumber, udp.ProtocolNumber, id, 1)
+	ep, ok := tep.(tcpip.Endpoint)
+	if !ok {
+		return
+	}
+
+	// Unconnected endpoints don't report errors (as on Linux).
+	if _, err := ep.GetRemoteAddress(); err != nil {
+		return
+	}
+
+	wq := ss.udpConns.get(ep)
+	if wq == nil {
+		return
+	}
+
+	ep.SocketOptions().SetLastError(tcpipErr)
+	wq.Notify(waiter.EventErr)
+}
+
+// parseDestinationUnreachable returns the endpoint that sent the UDP datagram
+// quoted by an ICMP destination unreachable message, and the error reported.
+// Port unreachable (and fragmentation needed) messages are ignored, as the
+// stack handles them.
+func parseDestinationUnreachable(protoNumber tcpip.NetworkProtocolNumber, pkt []byte) (stack.TransportEndpointID, tcpip.Error, bool) {
+	var id stack.TransportEndpointID
+	var tcpipErr tcpip.Error
+	var udpHdr header.UDP
+	switch protoNumber {
+	case header.IPv4ProtocolNumber:
+		hdr := header.IPv4(pkt)
+		if !hdr.IsValid(len(pkt)) || hdr.TransportProtocol() != header.ICMPv4ProtocolNumber || hdr.FragmentOffset() != 0 {
+			return stack.TransportEndpointID{}, nil, false
+		}
+
+		payload := hdr.Payload()
+		if len(payload) < header.ICMPv4MinimumSize || header.ICMPv4(payload).Type() != header.ICMPv4DstUnreachable {
+			return stack.TransportEndpointID{}, nil, false
+		}
+
+		switch header.ICMPv4(payload).Code() {
+		case header.ICMPv4PortUnreachable, header.ICMPv4FragmentationNeeded:
+			return stack.TransportEndpointID{}, nil, false
+		case header.ICMPv4NetUnreachable, header.ICMPv4DestinationNetworkUnknown,
+			header.ICMPv4NetProhibited, header.ICMPv4NetUnreachableForTos:
+			tcpipErr = &tcpip.ErrNetworkUnreachable{}
+		default:
+			tcpipErr = &tcpip.ErrHostUnreachable{}
+		}
+
+		// The original packet is truncated, so its payload is found using its
+		// header length rather than its total length.
+		original := header.IPv4(payload[header.ICMPv4MinimumSize:])
+		if len(original) < header.IPv4MinimumSize || len(original) < int(original.HeaderLength()) ||
+			original.TransportProtocol() != header.UDPProtocolNumber {
+			return stack.TransportEndpointID{}, nil, false
+		}
+
+		id.LocalAddress, id.RemoteAddress = original.SourceAddress(), original.DestinationAddress()
+		udpHdr = header.UDP(original[original.HeaderLength():])
+	case header.IPv6ProtocolNumber:
+		hdr := header.IPv6(pkt)
+		if !hdr.IsValid(len(pkt)) || hdr.TransportProtocol() != header.ICMPv6ProtocolNumber {
+			return stack.TransportEndpointID{}, nil, false
+		}
+
+		payload := hdr.Payload()
+		if len(payload) < header.ICMPv6ErrorHeaderSize || header.ICMPv6(payload).Type() != header.ICMPv6DstUnreachable {
+			return stack.TransportEndpointID{}, nil, false
+		}
+
+		switch header.ICMPv6(payload).Code() {
+		case header.ICMPv6PortUnreachable:
+			return stack.TransportEndpointID{}, nil, false
+		case header.ICMPv6NetworkUnreachable:
+			tcpipErr = &tcpip.ErrNetworkUnreachable{}
+		default:
+			tcpipErr = &tcpip.ErrHostUnreachable{}
+		}
+
+		original := header.IPv6(payload[header.ICMPv6ErrorHeaderSize:])
+		if len(original) < header.IPv6MinimumSize || original.TransportProtocol() != header.UDPProtocolNumber {
+			return stack.TransportEndpointID{}, nil, false
+		}
+
+		id.LocalAddress, id.RemoteAddress = original.SourceAddress(), original.DestinationAddress()
+		udpHdr = header.UDP(original[header.IPv6MinimumSize:])
+	default:
+		return stack.TransportEndpointID{}, nil, false
+	}
+
+	if len(udpHdr) < header.UDPMinimumSize {
+		return stack.TransportEndpointID{}, nil, false
+	}
+
+	id.LocalPort, id.RemotePort = udpHdr.SourcePort(), udpHdr.DestinationPort()
+
+	return id, tcpipErr, true
+}
+
+// icmpErrors are the syscall equivalents of the errors reported by ICMP
+// messages, keyed by the text that gonet returns them as.
+var icmpErrors = map[string]error{
+	(&tcpip.ErrConnectionRefused{}).String():  syscall.ECONNREFUSED,
+	(&tcpip.ErrHostUnreachable{}).String():    syscall.EHOSTUNREACH,
+	(&tcpip.ErrNetworkUnreachable{}).String(): syscall.ENETUNREACH,
+}
+
+// mapICMPErr converts an error reported by an ICMP message, that gonet
+// returns as plain text, into its syscall equivalent (eg. so that
+// errors.Is(err, syscall.ECONNREFUSED)).
+func mapICMPErr(err error) error {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Err != nil {
+		if errno, ok := icmpErrors[opErr.Err.Error()]; ok {
+			opErr.Err = errno
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,101 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets_test
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoisySocket_ICMPErrors(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	// The client routes 10.7.0.3 via the server, which has nowhere to forward
+	// it to.
+	serverSocket, clientSocket, err := noisysockets.Pipe(logger, &v1alpha1.Config{
+		Name:             "server",
+		PrivateKey:       serverPrivateKey.String(),
+		IPs:              []string{"10.7.0.1"},
+		EnableForwarding: true,
+		Peers: []v1alpha1.WireGuardPeerConfig{{
+			Name:      "client",
+			PublicKey: clientPrivateKey.PublicKey().String(),
+			IPs:       []string{"10.7.0.2"},
+		}},
+	}, &v1alpha1.Config{
+		Name:       "client",
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{{
+			Name:      "server",
+			PublicKey: serverPrivateKey.PublicKey().String(),
+			IPs:       []string{"10.7.0.1", "10.7.0.3"},
+		}},
+	}, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+		require.NoError(t, clientSocket.Close())
+	})
+
+	// exchange sends a query, and waits for the reply, much like a DNS client.
+	exchange := func(t *testing.T, address string) (time.Duration, error) {
+		conn, err := clientSocket.Dial("udp", address)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+		start := time.Now()
+
+		_, err = conn.Write([]byte("query"))
+		require.NoError(t, err)
+
+		_, err = conn.Read(make([]byte, 512))
+		return time.Since(start), err
+	}
+
+	t.Run("Port Unreachable", func(t *testing.T) {
+		elapsed, err := exchange(t, "server:53")
+		require.ErrorIs(t, err, syscall.ECONNREFUSED)
+		require.Less(t, elapsed, time.Second)
+	})
+
+	t.Run("Network Unreachable", func(t *testing.T) {
+		elapsed, err := exchange(t, "10.7.0.3:53")
+		require.ErrorIs(t, err, syscall.ENETUNREACH)
+		require.Less(t, elapsed, time.Second)
+	})
+
+	t.Run("Next Write", func(t *testing.T) {
+		conn, err := clientSocket.Dial("udp", "server:53")
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("query"))
+		require.NoError(t, err)
+
+		// The error fails the next write, once the ICMP message arrives.
+		require.Eventually(t, func() bool {
+			_, err := conn.Write([]byte("query"))
+			return errors.Is(err, syscall.ECONNREFUSED)
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+}
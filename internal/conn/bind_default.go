@@ -0,0 +1,14 @@
+//go:build !js
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (c) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package conn
+
+// NewDefaultBind returns the bind used to reach peers at UDP endpoints, its
+// sockets are created with the given options.
+func NewDefaultBind(opts SocketOptions) Bind {
+	return NewStdNetBindWithOptions(opts)
+}
@@ -0,0 +1,48 @@
+//go:build js
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (c) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package conn
+
+import (
+	"errors"
+	"fmt"
+)
+
+// NewDefaultBind returns a bind without any UDP sockets, as browsers can't send
+// (or receive) UDP datagrams. Peers must be reached via WebSocket (or relay)
+// endpoints instead.
+func NewDefaultBind(opts SocketOptions) Bind {
+	return &nullBind{sockOpts: opts}
+}
+
+type nullBind struct {
+	sockOpts SocketOptions
+}
+
+func (b *nullBind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
+	if b.sockOpts != (SocketOptions{}) {
+		return nil, 0, errors.New("socket options are not supported on this platform")
+	}
+
+	return nil, port, nil
+}
+
+func (*nullBind) Close() error {
+	return nil
+}
+
+func (*nullBind) Send(bufs [][]byte, ep Endpoint) error {
+	return fmt.Errorf("%w: udp is not supported on this platform", ErrUnsupportedTransport)
+}
+
+func (*nullBind) ParseEndpoint(s string) (Endpoint, error) {
+	return nil, fmt.Errorf("%w: udp is not supported on this platform", ErrUnsupportedTransport)
+}
+
+func (*nullBind) BatchSize() int {
+	return IdealBatchSize
+}
@@ -0,0 +1,118 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (c) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package conn
+
+import (
+	"errors"
+	"strings"
+)
+
+var _ Bind = (*MuxBind)(nil)
+
+// MuxBind combines a UDP bind with a stream bind, a QUIC bind, and optionally
+// a relay bind, so that peers can be reached over any of them. QUIC endpoints
+// (eg. "quic://host:port") are handled by the QUIC bind, relay endpoints by
+// the relay bind, other endpoints with a URL scheme (eg. "tcp://host:port") by
+// the stream bind, and all others by the UDP bind.
+type MuxBind struct {
+	udp    Bind
+	stream *StreamBind
+	quic   *QUICBind
+	relay  *RelayBind
+}
+
+// NewMuxBind creates a new MuxBind, relay may be nil.
+func NewMuxBind(udp Bind, stream *StreamBind, quic *QUICBind, relay *RelayBind) *MuxBind {
+	return &MuxBind{
+		udp:    udp,
+		stream: stream,
+		quic:   quic,
+		relay:  relay,
+	}
+}
+
+func (b *MuxBind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
+	fns, actualPort, err := b.udp.Open(port)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	streamFns, _, err := b.stream.Open(actualPort)
+	if err != nil {
+		_ = b.udp.Close()
+		return nil, 0, err
+	}
+
+	fns = append(fns, streamFns...)
+
+	quicFns, _, err := b.quic.Open(actualPort)
+	if err != nil {
+		_ = b.udp.Close()
+		_ = b.stream.Close()
+		return nil, 0, err
+	}
+
+	fns = append(fns, quicFns...)
+
+	if b.relay != nil {
+		relayFns, _, err := b.relay.Open(actualPort)
+		if err != nil {
+			_ = b.udp.Close()
+			_ = b.stream.Close()
+			_ = b.quic.Close()
+			return nil, 0, err
+		}
+
+		fns = append(fns, relayFns...)
+	}
+
+	return fns, actualPort, nil
+}
+
+func (b *MuxBind) Close() error {
+	errs := []error{b.udp.Close(), b.stream.Close(), b.quic.Close()}
+	if b.relay != nil {
+		errs = append(errs, b.relay.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+func (b *MuxBind) Send(bufs [][]byte, ep Endpoint) error {
+	switch ep.(type) {
+	case *StreamEndpoint:
+		return b.stream.Send(bufs, ep)
+	case *QUICEndpoint:
+		return b.quic.Send(bufs, ep)
+	case *RelayEndpoint:
+		if b.relay == nil {
+			return ErrWrongEndpointType
+		}
+		return b.relay.Send(bufs, ep)
+	}
+
+	return b.udp.Send(bufs, ep)
+}
+
+func (b *MuxBind) ParseEndpoint(s string) (Endpoint, error) {
+	if strings.HasPrefix(s, "relay://") && b.relay != nil {
+		return b.relay.ParseEndpoint(s)
+	}
+
+	if strings.HasPrefix(s, "quic://") {
+		return b.quic.ParseEndpoint(s)
+	}
+
+	if strings.Contains(s, "://") {
+		return b.stream.ParseEndpoint(s)
+	}
+
+	return b.udp.ParseEndpoint(s)
+}
+
+func (b *MuxBind) BatchSize() int {
+	return b.udp.BatchSize()
+}
@@ -0,0 +1,285 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (c) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package conn
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+)
+
+// The WireGuard messages, as sent by the transport.
+const (
+	messageInitiationType  = 1
+	messageResponseType    = 2
+	messageCookieReplyType = 3
+	messageTransportType   = 4
+
+	messageInitiationSize      = 148
+	messageResponseSize        = 92
+	messageCookieReplySize     = 64
+	messageTransportHeaderSize = 16
+)
+
+const (
+	// MaxObfuscationJunkPackets is the largest number of junk packets that can
+	// be sent before each handshake initiation.
+	MaxObfuscationJunkPackets = 128
+	// MaxObfuscationJunkPacketSize is the size of the largest junk packet.
+	MaxObfuscationJunkPacketSize = 1280
+	// MaxObfuscationPadding is the largest amount of padding that can be
+	// added to a handshake message.
+	MaxObfuscationPadding = 1024
+)
+
+var _ Bind = (*ObfuscatedBind)(nil)
+
+// ObfuscationOptions configures how the packets of an ObfuscatedBind are
+// disguised, both ends must be configured with the same options.
+type ObfuscationOptions struct {
+	// JunkPackets is the number of packets of random data sent before each
+	// handshake initiation.
+	JunkPackets int
+	// JunkPacketMinSize, and JunkPacketMaxSize, are the (inclusive) bounds of
+	// the size of the junk packets.
+	JunkPacketMinSize int
+	JunkPacketMaxSize int
+	// InitiationPadding, and ResponsePadding, are the number of random bytes
+	// prepended to handshake initiations and responses, so that they don't
+	// have their usual sizes.
+	InitiationPadding int
+	ResponsePadding   int
+	// InitiationMagic, ResponseMagic, CookieReplyMagic, and TransportMagic
+	// replace the message types that WireGuard messages start with. Zero keeps
+	// the usual value.
+	InitiationMagic  uint32
+	ResponseMagic    uint32
+	CookieReplyMagic uint32
+	TransportMagic   uint32
+}
+
+// Validate checks that the options are within bounds, and that the messages
+// they produce can be told apart.
+func (o *ObfuscationOptions) Validate() error {
+	if o.JunkPackets < 0 || o.JunkPackets > MaxObfuscationJunkPackets {
+		return fmt.Errorf("junk packets must be between 0 and %d", MaxObfuscationJunkPackets)
+	}
+
+	if o.JunkPackets > 0 {
+		if o.JunkPacketMinSize < 1 || o.JunkPacketMaxSize > MaxObfuscationJunkPacketSize || o.JunkPacketMinSize > o.JunkPacketMaxSize {
+			return fmt.Errorf("junk packet sizes must be between 1 and %d bytes, and the minimum no more than the maximum", MaxObfuscationJunkPacketSize)
+		}
+	}
+
+	if o.InitiationPadding < 0 || o.InitiationPadding > MaxObfuscationPadding ||
+		o.ResponsePadding < 0 || o.ResponsePadding > MaxObfuscationPadding {
+		return fmt.Errorf("handshake padding must be between 0 and %d bytes", MaxObfuscationPadding)
+	}
+
+	magics := o.magics()
+	for i := range magics {
+		for j := i + 1; j < len(magics); j++ {
+			if magics[i] == magics[j] {
+				return fmt.Errorf("message magic values must be distinct")
+			}
+		}
+	}
+
+	return nil
+}
+
+// magics returns the first 4 bytes of initiations, responses, cookie replies,
+// and transport messages.
+func (o *ObfuscationOptions) magics() [4]uint32 {
+	magics := [4]uint32{messageInitiationType, messageResponseType, messageCookieReplyType, messageTransportType}
+	for i, magic := range []uint32{o.InitiationMagic, o.ResponseMagic, o.CookieReplyMagic, o.TransportMagic} {
+		if magic != 0 {
+			magics[i] = magic
+		}
+	}
+
+	return magics
+}
+
+// ObfuscatedBind wraps a bind, disguising the WireGuard messages it exchanges
+// so that they aren't recognized (and blocked) by deep packet inspection.
+// Message types are replaced, handshake messages are padded (so they don't
+// have their well known sizes), and handshake initiations are preceded by
+// packets of junk. Received packets that aren't disguised messages are
+// dropped.
+type ObfuscatedBind struct {
+	Bind
+	opts ObfuscationOptions
+	// initiationMagic etc. are the message types that are sent.
+	initiationMagic  uint32
+	responseMagic    uint32
+	cookieReplyMagic uint32
+	transportMagic   uint32
+}
+
+// NewObfuscatedBind wraps the bind, the options must be valid.
+func NewObfuscatedBind(bind Bind, opts ObfuscationOptions) *ObfuscatedBind {
+	magics := opts.magics()
+
+	return &ObfuscatedBind{
+		Bind:             bind,
+		opts:             opts,
+		initiationMagic:  magics[0],
+		responseMagic:    magics[1],
+		cookieReplyMagic: magics[2],
+		transportMagic:   magics[3],
+	}
+}
+
+// Open opens the wrapped bind, received messages are restored to their usual
+// form.
+func (b *ObfuscatedBind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
+	fns, actualPort, err := b.Bind.Open(port)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for i := range fns {
+		fn := fns[i]
+		fns[i] = func(packets [][]byte, sizes []int, eps []Endpoint) (int, error) {
+			n, err := fn(packets, sizes, eps)
+			for j := 0; j < n; j++ {
+				sizes[j] = b.reveal(packets[j][:sizes[j]])
+			}
+			return n, err
+		}
+	}
+
+	return fns, actualPort, nil
+}
+
+// Send disguises the messages, and sends them.
+func (b *ObfuscatedBind) Send(bufs [][]byte, ep Endpoint) error {
+	disguised := make([][]byte, len(bufs))
+
+	var restore []int
+	for i, buf := range bufs {
+		switch {
+		case len(buf) == messageInitiationSize && messageType(buf) == messageInitiationType:
+			if err := b.sendJunk(ep); err != nil {
+				return err
+			}
+
+			disguised[i] = b.pad(buf, b.opts.InitiationPadding, b.initiationMagic)
+		case len(buf) == messageResponseSize && messageType(buf) == messageResponseType:
+			disguised[i] = b.pad(buf, b.opts.ResponsePadding, b.responseMagic)
+		case len(buf) == messageCookieReplySize && messageType(buf) == messageCookieReplyType:
+			disguised[i] = b.pad(buf, 0, b.cookieReplyMagic)
+		case len(buf) >= messageTransportHeaderSize && messageType(buf) == messageTransportType:
+			// Transport messages are disguised in place, to avoid copying them,
+			// and restored once they have been sent.
+			binary.LittleEndian.PutUint32(buf, b.transportMagic)
+			restore = append(restore, i)
+			disguised[i] = buf
+		default:
+			disguised[i] = buf
+		}
+	}
+
+	err := b.Bind.Send(disguised, ep)
+
+	for _, i := range restore {
+		binary.LittleEndian.PutUint32(bufs[i], messageTransportType)
+	}
+
+	return err
+}
+
+// sendJunk sends the configured number of packets of random data.
+func (b *ObfuscatedBind) sendJunk(ep Endpoint) error {
+	if b.opts.JunkPackets == 0 {
+		return nil
+	}
+
+	junk := make([][]byte, 0, b.opts.JunkPackets)
+	for i := 0; i < b.opts.JunkPackets; i++ {
+		size := b.opts.JunkPacketMinSize
+		if spread := b.opts.JunkPacketMaxSize - b.opts.JunkPacketMinSize; spread > 0 {
+			n, err := rand.Int(rand.Reader, big.NewInt(int64(spread+1)))
+			if err != nil {
+				return err
+			}
+			size += int(n.Int64())
+		}
+
+		packet := make([]byte, size)
+		if _, err := rand.Read(packet); err != nil {
+			return err
+		}
+		junk = append(junk, packet)
+	}
+
+	// The wrapped bind can't necessarily send them all at once.
+	for len(junk) > 0 {
+		n := min(len(junk), b.Bind.BatchSize())
+		if err := b.Bind.Send(junk[:n], ep); err != nil {
+			return err
+		}
+		junk = junk[n:]
+	}
+
+	return nil
+}
+
+// pad returns a copy of the handshake message, with its magic, preceded by
+// padding bytes of random data.
+func (b *ObfuscatedBind) pad(buf []byte, padding int, magic uint32) []byte {
+	padded := make([]byte, padding+len(buf))
+	// Should it fail, zeroes are still padding.
+	_, _ = rand.Read(padded[:padding])
+
+	copy(padded[padding:], buf)
+	binary.LittleEndian.PutUint32(padded[padding:], magic)
+
+	return padded
+}
+
+// reveal restores a disguised message in place, and returns its size, or zero
+// if the packet isn't a disguised message.
+func (b *ObfuscatedBind) reveal(packet []byte) int {
+	unpad := func(padding, size int, magic uint32, msgType uint32) int {
+		if len(packet) != padding+size || messageType(packet[padding:]) != magic {
+			return 0
+		}
+
+		copy(packet, packet[padding:])
+		binary.LittleEndian.PutUint32(packet, msgType)
+
+		return size
+	}
+
+	// Handshake messages have fixed sizes, so are identified first (their
+	// padding might happen to start with the transport magic).
+	if n := unpad(b.opts.InitiationPadding, messageInitiationSize, b.initiationMagic, messageInitiationType); n > 0 {
+		return n
+	}
+
+	if n := unpad(b.opts.ResponsePadding, messageResponseSize, b.responseMagic, messageResponseType); n > 0 {
+		return n
+	}
+
+	if n := unpad(0, messageCookieReplySize, b.cookieReplyMagic, messageCookieReplyType); n > 0 {
+		return n
+	}
+
+	if len(packet) >= messageTransportHeaderSize && messageType(packet) == b.transportMagic {
+		binary.LittleEndian.PutUint32(packet, messageTransportType)
+		return len(packet)
+	}
+
+	// Eg. junk.
+	return 0
+}
+
+func messageType(packet []byte) uint32 {
+	return binary.LittleEndian.Uint32(packet)
+}
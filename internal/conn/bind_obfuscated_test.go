@@ -0,0 +1,139 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (c) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package conn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestObfuscatedBind(t *testing.T) {
+	addrA := netip.MustParseAddrPort("198.18.0.1:51820")
+	addrB := netip.MustParseAddrPort("198.18.0.2:51820")
+
+	opts := ObfuscationOptions{
+		JunkPackets:       3,
+		JunkPacketMinSize: 40,
+		JunkPacketMaxSize: 70,
+		InitiationPadding: 17,
+		ResponsePadding:   33,
+		InitiationMagic:   0x6b1f0a53,
+		ResponseMagic:     0x2d44c9e1,
+		CookieReplyMagic:  0x93a6e07c,
+		TransportMagic:    0x51c2b8f4,
+	}
+	require.NoError(t, opts.Validate())
+
+	newMessage := func(msgType uint32, size int) []byte {
+		msg := bytes.Repeat([]byte{0xab}, size)
+		binary.LittleEndian.PutUint32(msg, msgType)
+		return msg
+	}
+
+	messages := [][]byte{
+		newMessage(messageInitiationType, messageInitiationSize),
+		newMessage(messageResponseType, messageResponseSize),
+		newMessage(messageCookieReplyType, messageCookieReplySize),
+		newMessage(messageTransportType, messageTransportHeaderSize),
+		newMessage(messageTransportType, 1000),
+	}
+
+	// Only the receiving end reveals messages, so that those on the wire can be
+	// inspected.
+	a, b := NewPipe(addrA, addrB, PipeOptions{})
+	obfuscatedA := NewObfuscatedBind(a, opts)
+	obfuscatedB := NewObfuscatedBind(b, opts)
+
+	_, _, err := obfuscatedA.Open(0)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, obfuscatedA.Close())
+	})
+
+	fns, _, err := obfuscatedB.Open(0)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, obfuscatedB.Close())
+	})
+
+	sent := make([][]byte, len(messages))
+	for i, msg := range messages {
+		sent[i] = bytes.Clone(msg)
+	}
+	require.NoError(t, obfuscatedA.Send(sent, &StdNetEndpoint{AddrPort: addrB}))
+
+	// Messages are left as they were.
+	require.Equal(t, messages, sent)
+
+	// Junk, and then the messages.
+	require.Equal(t, opts.JunkPackets+len(messages), b.queue.len())
+
+	var received [][]byte
+	for b.queue.len() > 0 {
+		packets := [][]byte{make([]byte, 1500)}
+		sizes := make([]int, 1)
+
+		n, err := fns[0](packets, sizes, make([]Endpoint, 1))
+		require.NoError(t, err)
+		require.Equal(t, 1, n)
+
+		if sizes[0] > 0 {
+			received = append(received, packets[0][:sizes[0]])
+		}
+	}
+	require.Equal(t, messages, received)
+
+	t.Run("Disguised", func(t *testing.T) {
+		require.NoError(t, obfuscatedA.Send([][]byte{bytes.Clone(messages[0])}, &StdNetEndpoint{AddrPort: addrB}))
+		require.Equal(t, opts.JunkPackets+1, b.queue.len())
+
+		for i := 0; i < opts.JunkPackets; i++ {
+			junk := popPipePacket(t, b)
+			require.GreaterOrEqual(t, len(junk), opts.JunkPacketMinSize)
+			require.LessOrEqual(t, len(junk), opts.JunkPacketMaxSize)
+		}
+
+		initiation := popPipePacket(t, b)
+		require.Len(t, initiation, opts.InitiationPadding+messageInitiationSize)
+		require.Equal(t, opts.InitiationMagic, binary.LittleEndian.Uint32(initiation[opts.InitiationPadding:]))
+	})
+
+	t.Run("Undisguised", func(t *testing.T) {
+		// Eg. from a peer that isn't obfuscating.
+		require.NoError(t, a.Send([][]byte{bytes.Clone(messages[0]), bytes.Clone(messages[3])}, nil))
+
+		for i := 0; i < 2; i++ {
+			packets := [][]byte{make([]byte, 1500)}
+			sizes := make([]int, 1)
+
+			n, err := fns[0](packets, sizes, make([]Endpoint, 1))
+			require.NoError(t, err)
+			require.Equal(t, 1, n)
+			require.Zero(t, sizes[0])
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		require.Error(t, (&ObfuscationOptions{JunkPackets: 1}).Validate())
+		require.Error(t, (&ObfuscationOptions{JunkPackets: 1, JunkPacketMinSize: 100, JunkPacketMaxSize: 50}).Validate())
+		require.Error(t, (&ObfuscationOptions{InitiationPadding: MaxObfuscationPadding + 1}).Validate())
+		// Collides with the usual transport message type.
+		require.Error(t, (&ObfuscationOptions{InitiationMagic: messageTransportType}).Validate())
+	})
+}
+
+// popPipePacket removes the next packet sent to an end of a pipe, without
+// receiving it.
+func popPipePacket(t *testing.T, b *PipeBind) []byte {
+	pkt, ok, _ := b.queue.pop(b.opts.Clock.Now())
+	require.True(t, ok)
+
+	return pkt.data
+}
@@ -0,0 +1,317 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (c) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package conn
+
+import (
+	"container/heap"
+	"math/rand"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+// pipeQueueSize is the number of packets that can be in flight, in each
+// direction of a pipe, before packets are dropped.
+const pipeQueueSize = 1024
+
+var _ Bind = (*PipeBind)(nil)
+
+// PipeOptions configures the link between the two ends of a pipe.
+type PipeOptions struct {
+	// Latency is how long packets take to reach the other end.
+	Latency time.Duration
+	// Jitter is the most that the latency of each packet varies by, either
+	// way, at random. Packets can be reordered, by overtaking each other.
+	Jitter time.Duration
+	// Loss is the fraction of packets (between 0 and 1) that are dropped.
+	Loss float64
+	// Duplicate is the fraction of packets (between 0 and 1) that are
+	// delivered twice.
+	Duplicate float64
+	// Reorder is the fraction of packets (between 0 and 1) that are delivered
+	// straight away, ahead of the packets sent before them that are still
+	// delayed by the latency.
+	Reorder float64
+	// Seed seeds the random choices (eg. which packets are dropped), so that
+	// runs can be repeated. Zero picks a random seed.
+	Seed int64
+	// Clock, if set, is used to time the latency (eg. a fake clock).
+	Clock tcpip.Clock
+}
+
+// PipeBind is one end of an in-memory pipe, that exchanges packets with the
+// other end without using any sockets (eg. for hermetic tests).
+type PipeBind struct {
+	local netip.AddrPort
+	opts  PipeOptions
+	// queue holds the packets sent to this end.
+	queue *pipeQueue
+	other *PipeBind
+
+	mu     sync.Mutex // protects closed, and rand
+	closed chan struct{}
+	rand   *rand.Rand
+}
+
+// pipePacket is a packet in flight through a pipe.
+type pipePacket struct {
+	data      []byte
+	deliverAt time.Time
+	// seq orders packets that are due at the same time, by when they were sent.
+	seq uint64
+}
+
+// pipePackets is a heap of packets, ordered by when they are due.
+type pipePackets []pipePacket
+
+func (p pipePackets) Len() int { return len(p) }
+
+func (p pipePackets) Less(i, j int) bool {
+	if p[i].deliverAt.Equal(p[j].deliverAt) {
+		return p[i].seq < p[j].seq
+	}
+	return p[i].deliverAt.Before(p[j].deliverAt)
+}
+
+func (p pipePackets) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
+func (p *pipePackets) Push(x any) { *p = append(*p, x.(pipePacket)) }
+
+func (p *pipePackets) Pop() any {
+	old := *p
+	pkt := old[len(old)-1]
+	*p = old[:len(old)-1]
+	return pkt
+}
+
+// pipeQueue holds the packets in flight to one end of a pipe.
+type pipeQueue struct {
+	mu      sync.Mutex // protects packets, and nextSeq
+	packets pipePackets
+	nextSeq uint64
+	// pushed is signalled whenever a packet is queued.
+	pushed chan struct{}
+}
+
+func newPipeQueue() *pipeQueue {
+	return &pipeQueue{pushed: make(chan struct{}, 1)}
+}
+
+// push queues a packet, it reports false if the queue is full.
+func (q *pipeQueue) push(data []byte, deliverAt time.Time) bool {
+	q.mu.Lock()
+	if len(q.packets) >= pipeQueueSize {
+		q.mu.Unlock()
+		return false
+	}
+
+	heap.Push(&q.packets, pipePacket{data: data, deliverAt: deliverAt, seq: q.nextSeq})
+	q.nextSeq++
+	q.mu.Unlock()
+
+	select {
+	case q.pushed <- struct{}{}:
+	default:
+	}
+
+	return true
+}
+
+// pop removes the packet that is due soonest, if it is due by now. Otherwise,
+// it returns when the next packet is due (if there is one).
+func (q *pipeQueue) pop(now time.Time) (pkt pipePacket, ok bool, nextAt time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.packets) == 0 {
+		return pipePacket{}, false, time.Time{}
+	}
+
+	if q.packets[0].deliverAt.After(now) {
+		return pipePacket{}, false, q.packets[0].deliverAt
+	}
+
+	return heap.Pop(&q.packets).(pipePacket), true, time.Time{}
+}
+
+func (q *pipeQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.packets)
+}
+
+// NewPipe creates the two ends of a pipe, a and b are their addresses. Every
+// packet is delivered to the other end, regardless of its endpoint.
+func NewPipe(a, b netip.AddrPort, opts PipeOptions) (*PipeBind, *PipeBind) {
+	if opts.Clock == nil {
+		opts.Clock = tcpip.NewStdClock()
+	}
+
+	seed := opts.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	endA := &PipeBind{
+		local: a,
+		opts:  opts,
+		queue: newPipeQueue(),
+		rand:  rand.New(rand.NewSource(seed)),
+	}
+
+	endB := &PipeBind{
+		local: b,
+		opts:  opts,
+		queue: newPipeQueue(),
+		rand:  rand.New(rand.NewSource(seed + 1)),
+	}
+
+	endA.other = endB
+	endB.other = endA
+
+	return endA, endB
+}
+
+// Addr returns the address of this end of the pipe, that packets it sends
+// appear to come from.
+func (b *PipeBind) Addr() netip.AddrPort {
+	return b.local
+}
+
+// Open opens this end of the pipe. Pipes don't have ports, so the port is
+// always reported as that of the end's address.
+func (b *PipeBind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed != nil {
+		return nil, 0, ErrBindAlreadyOpen
+	}
+
+	b.closed = make(chan struct{})
+
+	return []ReceiveFunc{b.makeReceiveFunc(b.closed)}, b.local.Port(), nil
+}
+
+func (b *PipeBind) makeReceiveFunc(closed chan struct{}) ReceiveFunc {
+	from := &StdNetEndpoint{AddrPort: b.other.local}
+
+	return func(packets [][]byte, sizes []int, eps []Endpoint) (int, error) {
+		for {
+			select {
+			case <-closed:
+				return 0, net.ErrClosed
+			default:
+			}
+
+			pkt, ok, nextAt := b.queue.pop(b.opts.Clock.Now())
+			if ok {
+				sizes[0] = copy(packets[0], pkt.data)
+				eps[0] = from
+
+				return 1, nil
+			}
+
+			// Wait for the next packet to be due, or for a packet to be queued
+			// (that might be due sooner).
+			var due chan struct{}
+			var timer tcpip.Timer
+			if !nextAt.IsZero() {
+				due = make(chan struct{})
+				timer = b.opts.Clock.AfterFunc(nextAt.Sub(b.opts.Clock.Now()), func() {
+					close(due)
+				})
+			}
+
+			select {
+			case <-closed:
+			case <-b.queue.pushed:
+			case <-due:
+			}
+
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	}
+}
+
+// Close closes this end of the pipe. Packets sent to it while it is closed are
+// still queued (up to a limit), as they would be by a socket's buffers.
+func (b *PipeBind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed != nil {
+		close(b.closed)
+		b.closed = nil
+	}
+
+	return nil
+}
+
+// Send sends packets to the other end of the pipe, whatever the endpoint.
+func (b *PipeBind) Send(bufs [][]byte, _ Endpoint) error {
+	b.mu.Lock()
+	if b.closed == nil {
+		b.mu.Unlock()
+		return net.ErrClosed
+	}
+
+	now := b.opts.Clock.Now()
+	for _, buf := range bufs {
+		if b.opts.Loss > 0 && b.rand.Float64() < b.opts.Loss {
+			continue
+		}
+
+		copies := 1
+		if b.opts.Duplicate > 0 && b.rand.Float64() < b.opts.Duplicate {
+			copies = 2
+		}
+
+		for i := 0; i < copies; i++ {
+			// If the other end isn't keeping up, the packet is dropped.
+			_ = b.other.queue.push(append([]byte(nil), buf...), now.Add(b.delay()))
+		}
+	}
+	b.mu.Unlock()
+
+	return nil
+}
+
+// delay returns how long a packet takes to reach the other end.
+// Must hold b.mu.
+func (b *PipeBind) delay() time.Duration {
+	if b.opts.Reorder > 0 && b.rand.Float64() < b.opts.Reorder {
+		return 0
+	}
+
+	delay := b.opts.Latency
+	if b.opts.Jitter > 0 {
+		delay += time.Duration((2*b.rand.Float64() - 1) * float64(b.opts.Jitter))
+	}
+
+	return max(delay, 0)
+}
+
+// ParseEndpoint parses an ip:port endpoint.
+func (b *PipeBind) ParseEndpoint(s string) (Endpoint, error) {
+	addrPort, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StdNetEndpoint{AddrPort: addrPort}, nil
+}
+
+// BatchSize returns the number of packets sent at a time.
+func (b *PipeBind) BatchSize() int {
+	return IdealBatchSize
+}
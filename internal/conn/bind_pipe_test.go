@@ -0,0 +1,151 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (c) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package conn
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipe(t *testing.T) {
+	addrA := netip.MustParseAddrPort("198.18.0.1:51820")
+	addrB := netip.MustParseAddrPort("198.18.0.2:51820")
+
+	receive := func(fn ReceiveFunc) (string, Endpoint) {
+		packets := [][]byte{make([]byte, 1500)}
+		sizes := make([]int, 1)
+		eps := make([]Endpoint, 1)
+
+		n, err := fn(packets, sizes, eps)
+		require.NoError(t, err)
+		require.Equal(t, 1, n)
+
+		return string(packets[0][:sizes[0]]), eps[0]
+	}
+
+	t.Run("Latency", func(t *testing.T) {
+		a, b := NewPipe(addrA, addrB, PipeOptions{Latency: 100 * time.Millisecond})
+
+		_, port, err := a.Open(0)
+		require.NoError(t, err)
+		require.Equal(t, addrA.Port(), port)
+
+		bFns, _, err := b.Open(0)
+		require.NoError(t, err)
+
+		start := time.Now()
+		require.NoError(t, a.Send([][]byte{[]byte("hello"), []byte("world")}, &StdNetEndpoint{AddrPort: addrB}))
+
+		msg, ep := receive(bFns[0])
+		require.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+		require.Equal(t, "hello", msg)
+		require.Equal(t, addrA.String(), ep.DstToString())
+
+		msg, _ = receive(bFns[0])
+		require.Equal(t, "world", msg)
+
+		require.NoError(t, b.Close())
+
+		_, err = bFns[0](make([][]byte, 1), make([]int, 1), make([]Endpoint, 1))
+		require.ErrorIs(t, err, net.ErrClosed)
+
+		require.NoError(t, a.Close())
+		require.ErrorIs(t, a.Send([][]byte{[]byte("hello")}, nil), net.ErrClosed)
+	})
+
+	t.Run("Loss", func(t *testing.T) {
+		a, b := NewPipe(addrA, addrB, PipeOptions{Loss: 0.5})
+
+		_, _, err := a.Open(0)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, a.Close())
+		})
+
+		for i := 0; i < 1000; i++ {
+			require.NoError(t, a.Send([][]byte{[]byte("hello")}, nil))
+		}
+
+		// Roughly half the packets should have been dropped.
+		require.InDelta(t, 500, b.queue.len(), 100)
+	})
+	// sendNumbered sends count packets, numbered in the order they were sent,
+	// and returns the numbers of the packets received, in order.
+	sendNumbered := func(t *testing.T, opts PipeOptions, count int) []int {
+		a, b := NewPipe(addrA, addrB, opts)
+
+		_, _, err := a.Open(0)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, a.Close())
+		})
+
+		bFns, _, err := b.Open(0)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, b.Close())
+		})
+
+		for i := 0; i < count; i++ {
+			require.NoError(t, a.Send([][]byte{[]byte(strconv.Itoa(i))}, nil))
+		}
+
+		var received []int
+		for b.queue.len() > 0 {
+			msg, _ := receive(bFns[0])
+
+			i, err := strconv.Atoi(msg)
+			require.NoError(t, err)
+
+			received = append(received, i)
+		}
+
+		return received
+	}
+
+	t.Run("Jitter", func(t *testing.T) {
+		received := sendNumbered(t, PipeOptions{Latency: 50 * time.Millisecond, Jitter: 50 * time.Millisecond, Seed: 1}, 100)
+		require.Len(t, received, 100)
+
+		// Packets overtake each other.
+		require.False(t, slices.IsSorted(received))
+		slices.Sort(received)
+		for i := range received {
+			require.Equal(t, i, received[i])
+		}
+	})
+
+	t.Run("Duplicate", func(t *testing.T) {
+		received := sendNumbered(t, PipeOptions{Duplicate: 1}, 10)
+
+		var expected []int
+		for i := 0; i < 10; i++ {
+			expected = append(expected, i, i)
+		}
+		require.Equal(t, expected, received)
+	})
+
+	t.Run("Reorder", func(t *testing.T) {
+		received := sendNumbered(t, PipeOptions{Latency: 50 * time.Millisecond, Reorder: 0.25, Seed: 1}, 100)
+		require.Len(t, received, 100)
+
+		// The reordered packets arrive first, in the order they were sent,
+		// followed by the rest.
+		reordered := slices.IndexFunc(received[1:], func(i int) bool {
+			return i < received[0]
+		}) + 1
+		require.Greater(t, reordered, 1)
+		require.Less(t, reordered, 100)
+		require.True(t, slices.IsSorted(received[:reordered]))
+		require.True(t, slices.IsSorted(received[reordered:]))
+	})
+}
@@ -0,0 +1,476 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (c) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package conn
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/netip"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// quicALPN is the application protocol negotiated by QUIC connections.
+	quicALPN = "noisysockets"
+	// quicMaxDatagramSize is the largest message sent as a QUIC datagram, it
+	// fits in the smallest packets QUIC sends (before path MTU discovery).
+	// Larger messages are sent on a stream instead.
+	quicMaxDatagramSize = 1200
+	// quicKeepAlivePeriod keeps idle connections to peers open.
+	quicKeepAlivePeriod = 15 * time.Second
+)
+
+var (
+	_ Bind     = (*QUICBind)(nil)
+	_ Endpoint = (*QUICEndpoint)(nil)
+)
+
+// QUICBind implements Bind for QUIC, sending messages as unreliable QUIC
+// datagrams (RFC 9221). Messages too large for a datagram are framed on a
+// stream, in the same way as StreamBind. Like StreamBind, connections to peers
+// are established on demand, and connections accepted from peers are used for
+// sending replies.
+//
+// Peers are authenticated by the WireGuard handshake, so QUIC's TLS handshake
+// is only used to set up the connection, listeners present a self-signed
+// certificate, which is not verified.
+type QUICBind struct {
+	logger      *slog.Logger
+	listenAddrs []*url.URL
+	tlsConfig   *tls.Config
+
+	mu        sync.Mutex // protects all fields below
+	open      bool
+	closed    chan struct{}
+	listeners []*quic.Listener
+	conns     map[string]*quicConn
+	recv      chan streamMessage
+}
+
+type quicConn struct {
+	quic.Connection
+	writeMu sync.Mutex // protects stream
+	// stream carries the messages that are too large for a datagram, it is
+	// opened when first needed.
+	stream quic.SendStream
+}
+
+// NewQUICBind creates a new QUICBind. It will accept connections from peers
+// on each of the given listen addresses, eg. "quic://0.0.0.0:51820", whenever
+// it is open.
+func NewQUICBind(logger *slog.Logger, listenAddrs []string) (*QUICBind, error) {
+	b := &QUICBind{
+		logger: logger,
+		conns:  make(map[string]*quicConn),
+	}
+
+	if len(listenAddrs) > 0 && !streamListenersSupported {
+		return nil, fmt.Errorf("%w: listeners are not supported on this platform", ErrUnsupportedTransport)
+	}
+
+	for _, listenAddr := range listenAddrs {
+		u, err := url.Parse(listenAddr)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse listen address %q: %w", listenAddr, err)
+		}
+
+		if u.Scheme != "quic" {
+			return nil, fmt.Errorf("%w: %q", ErrUnsupportedTransport, u.Scheme)
+		}
+
+		b.listenAddrs = append(b.listenAddrs, u)
+	}
+
+	if len(b.listenAddrs) > 0 {
+		cert, err := selfSignedCertificate()
+		if err != nil {
+			return nil, fmt.Errorf("could not generate certificate: %w", err)
+		}
+
+		b.tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{quicALPN},
+		}
+	}
+
+	return b, nil
+}
+
+// QUICEndpoint is a peer reachable over QUIC.
+type QUICEndpoint struct {
+	// key uniquely identifies the endpoint, it is the URL of dialable endpoints.
+	key string
+	// u is the URL to dial, it is nil for endpoints of accepted connections.
+	u     *url.URL
+	dstIP netip.Addr
+}
+
+// ParseQUICEndpoint parses a QUIC endpoint URL, eg. "quic://host:port".
+func ParseQUICEndpoint(s string) (*QUICEndpoint, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "quic" {
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedTransport, u.Scheme)
+	}
+
+	if u.Host == "" || u.Port() == "" {
+		return nil, fmt.Errorf("missing host or port in endpoint %q", s)
+	}
+
+	ep := &QUICEndpoint{key: u.String(), u: u}
+	if addr, err := netip.ParseAddr(u.Hostname()); err == nil {
+		ep.dstIP = addr
+	}
+
+	return ep, nil
+}
+
+func (e *QUICEndpoint) DstIP() netip.Addr {
+	return e.dstIP
+}
+
+func (e *QUICEndpoint) DstToBytes() []byte {
+	return []byte(e.key)
+}
+
+func (e *QUICEndpoint) DstToString() string {
+	return e.key
+}
+
+func (*QUICBind) ParseEndpoint(s string) (Endpoint, error) {
+	return ParseQUICEndpoint(s)
+}
+
+// Open starts the listeners, the port is ignored as listen addresses are
+// specified when the bind is created.
+func (b *QUICBind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.open {
+		return nil, 0, ErrBindAlreadyOpen
+	}
+
+	closed := make(chan struct{})
+	recv := make(chan streamMessage, IdealBatchSize)
+
+	for _, u := range b.listenAddrs {
+		lis, err := quic.ListenAddr(u.Host, b.tlsConfig, quicConfig())
+		if err != nil {
+			for _, lis := range b.listeners {
+				_ = lis.Close()
+			}
+			b.listeners = nil
+			return nil, 0, fmt.Errorf("could not listen on %q: %w", u, err)
+		}
+		b.listeners = append(b.listeners, lis)
+
+		go b.accept(lis, closed, recv)
+	}
+
+	b.open = true
+	b.closed = closed
+	b.recv = recv
+
+	return []ReceiveFunc{channelReceiveFunc(recv, closed)}, port, nil
+}
+
+func (b *QUICBind) accept(lis *quic.Listener, closed chan struct{}, recv chan streamMessage) {
+	for {
+		c, err := lis.Accept(context.Background())
+		if err != nil {
+			if !errors.Is(err, quic.ErrServerClosed) {
+				b.logger.Warn("Failed to accept connection", "addr", lis.Addr(), "error", err)
+			}
+			return
+		}
+
+		ep := &QUICEndpoint{key: "quic://" + c.RemoteAddr().String()}
+		if addrPort, err := netip.ParseAddrPort(c.RemoteAddr().String()); err == nil {
+			ep.dstIP = addrPort.Addr()
+		}
+
+		if qc, ok := b.addConn(c, ep, closed); ok {
+			b.serveConn(qc, ep, closed, recv)
+		}
+	}
+}
+
+// addConn registers the connection for the endpoint, if there is already a
+// connection for the endpoint it is returned instead and c is closed.
+func (b *QUICBind) addConn(c quic.Connection, ep *QUICEndpoint, closed chan struct{}) (*quicConn, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.open || b.closed != closed {
+		_ = c.CloseWithError(0, "")
+		return nil, false
+	}
+
+	if existing, ok := b.conns[ep.key]; ok {
+		_ = c.CloseWithError(0, "")
+		return existing, false
+	}
+
+	qc := &quicConn{Connection: c}
+	b.conns[ep.key] = qc
+
+	return qc, true
+}
+
+// serveConn reads messages from the connection, in the background, until it
+// is closed.
+func (b *QUICBind) serveConn(qc *quicConn, ep *QUICEndpoint, closed chan struct{}, recv chan streamMessage) {
+	go func() {
+		defer func() {
+			b.mu.Lock()
+			if b.conns[ep.key] == qc {
+				delete(b.conns, ep.key)
+			}
+			b.mu.Unlock()
+
+			_ = qc.CloseWithError(0, "")
+		}()
+
+		for {
+			data, err := qc.ReceiveDatagram(qc.Context())
+			if err != nil {
+				return
+			}
+
+			select {
+			case recv <- streamMessage{data: data, ep: ep}:
+			case <-closed:
+				return
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			stream, err := qc.AcceptUniStream(qc.Context())
+			if err != nil {
+				return
+			}
+
+			go readStream(stream, ep, closed, recv)
+		}
+	}()
+}
+
+// readStream reads length prefixed messages from the stream until it is closed.
+func readStream(stream quic.ReceiveStream, ep *QUICEndpoint, closed chan struct{}, recv chan streamMessage) {
+	defer stream.CancelRead(0)
+
+	var hdr [2]byte
+	for {
+		if _, err := io.ReadFull(stream, hdr[:]); err != nil {
+			return
+		}
+
+		data := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+		if _, err := io.ReadFull(stream, data); err != nil {
+			return
+		}
+
+		select {
+		case recv <- streamMessage{data: data, ep: ep}:
+		case <-closed:
+			return
+		}
+	}
+}
+
+func (b *QUICBind) Send(bufs [][]byte, endpoint Endpoint) error {
+	ep, ok := endpoint.(*QUICEndpoint)
+	if !ok {
+		return ErrWrongEndpointType
+	}
+
+	qc, err := b.connFor(ep)
+	if err != nil {
+		return err
+	}
+
+	for _, buf := range bufs {
+		if len(buf) > quicMaxDatagramSize {
+			if err := qc.sendOnStream(buf); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := qc.SendDatagram(buf); err != nil {
+			_ = qc.CloseWithError(0, "")
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sendOnStream sends a message that is too large for a datagram on the
+// connection's stream.
+func (qc *quicConn) sendOnStream(buf []byte) error {
+	if len(buf) > streamMaxMessageSize {
+		return fmt.Errorf("message too large: %d bytes", len(buf))
+	}
+
+	qc.writeMu.Lock()
+	defer qc.writeMu.Unlock()
+
+	if qc.stream == nil {
+		stream, err := qc.OpenUniStream()
+		if err != nil {
+			return err
+		}
+		qc.stream = stream
+	}
+
+	if err := qc.stream.SetWriteDeadline(time.Now().Add(streamWriteTimeout)); err != nil {
+		return err
+	}
+
+	frame := make([]byte, 2+len(buf))
+	binary.BigEndian.PutUint16(frame, uint16(len(buf)))
+	copy(frame[2:], buf)
+
+	if _, err := qc.stream.Write(frame); err != nil {
+		_ = qc.CloseWithError(0, "")
+		return err
+	}
+
+	return nil
+}
+
+// connFor returns the connection for the endpoint, dialing it if required.
+func (b *QUICBind) connFor(ep *QUICEndpoint) (*quicConn, error) {
+	b.mu.Lock()
+	if !b.open {
+		b.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	qc, ok := b.conns[ep.key]
+	closed, recv := b.closed, b.recv
+	b.mu.Unlock()
+
+	if ok {
+		return qc, nil
+	}
+
+	if ep.u == nil {
+		return nil, fmt.Errorf("connection to %s has been closed", ep.key)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), streamDialTimeout)
+	defer cancel()
+
+	c, err := quic.DialAddr(ctx, ep.u.Host, &tls.Config{
+		ServerName: ep.u.Hostname(),
+		NextProtos: []string{quicALPN},
+		// The peer is authenticated by the WireGuard handshake.
+		InsecureSkipVerify: true,
+	}, quicConfig())
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to %s: %w", ep.key, err)
+	}
+
+	qc, added := b.addConn(c, ep, closed)
+	if qc == nil {
+		return nil, net.ErrClosed
+	}
+
+	if added {
+		b.serveConn(qc, ep, closed, recv)
+	}
+
+	return qc, nil
+}
+
+func (b *QUICBind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.open {
+		return nil
+	}
+
+	var errs []error
+	for _, lis := range b.listeners {
+		if err := lis.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	b.listeners = nil
+
+	for key, qc := range b.conns {
+		_ = qc.CloseWithError(0, "")
+		delete(b.conns, key)
+	}
+
+	close(b.closed)
+	b.open = false
+
+	return errors.Join(errs...)
+}
+
+func (b *QUICBind) BatchSize() int {
+	return IdealBatchSize
+}
+
+func quicConfig() *quic.Config {
+	return &quic.Config{
+		HandshakeIdleTimeout: streamDialTimeout,
+		KeepAlivePeriod:      quicKeepAlivePeriod,
+		EnableDatagrams:      true,
+	}
+}
+
+// selfSignedCertificate generates a certificate for QUIC listeners.
+func selfSignedCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,86 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (c) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package conn
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQUICBind(t *testing.T) {
+	logger := slogt.New(t)
+
+	server, err := NewQUICBind(logger, []string{"quic://127.0.0.1:12469"})
+	require.NoError(t, err)
+
+	serverFns, _, err := server.Open(0)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, server.Close())
+	})
+
+	client, err := NewQUICBind(logger, nil)
+	require.NoError(t, err)
+
+	clientFns, _, err := client.Open(0)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, client.Close())
+	})
+
+	ep, err := client.ParseEndpoint("quic://127.0.0.1:12469")
+	require.NoError(t, err)
+
+	require.NoError(t, client.Send([][]byte{[]byte("ping")}, ep))
+
+	data, replyEp := receiveOne(t, serverFns[0])
+	require.Equal(t, "ping", string(data))
+
+	// Replies are sent over the accepted connection.
+	require.NoError(t, server.Send([][]byte{[]byte("pong")}, replyEp))
+
+	data, _ = receiveOne(t, clientFns[0])
+	require.Equal(t, "pong", string(data))
+
+	t.Run("Too Large For A Datagram", func(t *testing.T) {
+		large := bytes.Repeat([]byte{0xaa}, 1452)
+		require.NoError(t, client.Send([][]byte{large}, ep))
+
+		data, _ := receiveOne(t, serverFns[0])
+		require.Equal(t, large, data)
+	})
+}
+
+func TestQUICBindReceiveFuncAfterClose(t *testing.T) {
+	bind, err := NewQUICBind(slogt.New(t), nil)
+	require.NoError(t, err)
+
+	fns, _, err := bind.Open(0)
+	require.NoError(t, err)
+
+	require.NoError(t, bind.Close())
+
+	_, err = fns[0](make([][]byte, 1), make([]int, 1), make([]Endpoint, 1))
+	require.True(t, errors.Is(err, net.ErrClosed))
+}
+
+func TestParseQUICEndpoint(t *testing.T) {
+	ep, err := ParseQUICEndpoint("quic://127.0.0.1:51820")
+	require.NoError(t, err)
+	require.Equal(t, "quic://127.0.0.1:51820", ep.DstToString())
+	require.Equal(t, "127.0.0.1", ep.DstIP().String())
+
+	_, err = ParseQUICEndpoint("quic://127.0.0.1")
+	require.Error(t, err)
+
+	_, err = NewQUICBind(slogt.New(t), []string{"tcp://0.0.0.0:51820"})
+	require.ErrorIs(t, err, ErrUnsupportedTransport)
+}
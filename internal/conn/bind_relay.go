@@ -0,0 +1,265 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (c) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package conn
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/noisysockets/noisysockets/relay"
+)
+
+const (
+	// relayMinReconnectDelay is how long to wait before reconnecting to the
+	// relay, it is doubled after each failed attempt.
+	relayMinReconnectDelay = time.Second
+	// relayMaxReconnectDelay is the upper bound on the reconnect delay.
+	relayMaxReconnectDelay = 30 * time.Second
+)
+
+var (
+	_ Bind     = (*RelayBind)(nil)
+	_ Endpoint = (*RelayEndpoint)(nil)
+)
+
+var errNotConnectedToRelay = errors.New("not connected to relay")
+
+// RelayBind implements Bind by exchanging packets with peers via a relay
+// server. It stays connected to the relay whenever it is open, reconnecting
+// as required.
+type RelayBind struct {
+	logger *slog.Logger
+	u      *url.URL
+
+	mu         sync.Mutex // protects all fields below
+	privateKey [relay.KeySize]byte
+	open       bool
+	closed     chan struct{}
+	client     *relay.Client
+}
+
+// RelayEndpoint is a peer reached via the relay, identified by its public key.
+type RelayEndpoint struct {
+	publicKey [relay.KeySize]byte
+}
+
+// NewRelayEndpoint returns the relay endpoint of the peer with the given
+// public key.
+func NewRelayEndpoint(publicKey [relay.KeySize]byte) *RelayEndpoint {
+	return &RelayEndpoint{publicKey: publicKey}
+}
+
+func (e *RelayEndpoint) DstIP() netip.Addr {
+	return netip.Addr{}
+}
+
+func (e *RelayEndpoint) DstToBytes() []byte {
+	return e.publicKey[:]
+}
+
+func (e *RelayEndpoint) DstToString() string {
+	return "relay://" + base64.StdEncoding.EncodeToString(e.publicKey[:])
+}
+
+// NewRelayBind creates a new RelayBind that connects to the relay server at
+// the given URL, eg. "tcp://relay.example.com:8443" or
+// "wss://relay.example.com/relay", authenticating with the private key.
+func NewRelayBind(logger *slog.Logger, relayURL string, privateKey [relay.KeySize]byte) (*RelayBind, error) {
+	u, err := url.Parse(relayURL)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse relay url %q: %w", relayURL, err)
+	}
+
+	switch u.Scheme {
+	case "tcp", "ws", "wss":
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedTransport, u.Scheme)
+	}
+
+	return &RelayBind{
+		logger:     logger,
+		u:          u,
+		privateKey: privateKey,
+	}, nil
+}
+
+// SetPrivateKey replaces the private key used to authenticate with the relay,
+// the bind reconnects to the relay with the new key.
+func (b *RelayBind) SetPrivateKey(privateKey [relay.KeySize]byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.privateKey = privateKey
+
+	if b.client != nil {
+		_ = b.client.Close()
+	}
+}
+
+func (*RelayBind) ParseEndpoint(s string) (Endpoint, error) {
+	encodedPublicKey, ok := strings.CutPrefix(s, "relay://")
+	if !ok {
+		return nil, ErrWrongEndpointType
+	}
+
+	publicKey, err := base64.StdEncoding.DecodeString(encodedPublicKey)
+	if err != nil || len(publicKey) != relay.KeySize {
+		return nil, fmt.Errorf("invalid relay endpoint %q", s)
+	}
+
+	ep := &RelayEndpoint{}
+	copy(ep.publicKey[:], publicKey)
+
+	return ep, nil
+}
+
+// Open connects to the relay in the background, the port is ignored.
+func (b *RelayBind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.open {
+		return nil, 0, ErrBindAlreadyOpen
+	}
+
+	closed := make(chan struct{})
+	recv := make(chan streamMessage, IdealBatchSize)
+
+	b.open = true
+	b.closed = closed
+
+	go b.run(closed, recv)
+
+	return []ReceiveFunc{channelReceiveFunc(recv, closed)}, port, nil
+}
+
+// run maintains the connection to the relay, until the bind is closed.
+func (b *RelayBind) run(closed chan struct{}, recv chan streamMessage) {
+	delay := relayMinReconnectDelay
+	for {
+		if err := b.connectAndReceive(closed, recv); err != nil {
+			b.logger.Warn("Relay connection failed", "relay", b.u.String(), "error", err)
+		} else {
+			// We were connected, so start backing off afresh.
+			delay = relayMinReconnectDelay
+		}
+
+		select {
+		case <-closed:
+			return
+		case <-time.After(delay):
+		}
+
+		delay = min(2*delay, relayMaxReconnectDelay)
+	}
+}
+
+// connectAndReceive connects to the relay and receives packets until the
+// connection fails. It returns nil if the connection was established.
+func (b *RelayBind) connectAndReceive(closed chan struct{}, recv chan streamMessage) error {
+	c, err := dialStream(b.u)
+	if err != nil {
+		return fmt.Errorf("could not connect: %w", err)
+	}
+
+	b.mu.Lock()
+	privateKey := b.privateKey
+	b.mu.Unlock()
+
+	client, err := relay.NewClient(c, privateKey)
+	if err != nil {
+		_ = c.Close()
+		return fmt.Errorf("could not authenticate: %w", err)
+	}
+
+	b.mu.Lock()
+	if !b.open || b.closed != closed {
+		b.mu.Unlock()
+		_ = client.Close()
+		return nil
+	}
+	b.client = client
+	b.mu.Unlock()
+
+	b.logger.Debug("Connected to relay", "relay", b.u.String())
+
+	defer func() {
+		b.mu.Lock()
+		if b.client == client {
+			b.client = nil
+		}
+		b.mu.Unlock()
+
+		_ = client.Close()
+	}()
+
+	for {
+		src, packet, err := client.Recv()
+		if err != nil {
+			return nil
+		}
+
+		select {
+		case recv <- streamMessage{data: packet, ep: &RelayEndpoint{publicKey: src}}:
+		case <-closed:
+			return nil
+		}
+	}
+}
+
+func (b *RelayBind) Send(bufs [][]byte, endpoint Endpoint) error {
+	ep, ok := endpoint.(*RelayEndpoint)
+	if !ok {
+		return ErrWrongEndpointType
+	}
+
+	b.mu.Lock()
+	client := b.client
+	b.mu.Unlock()
+
+	if client == nil {
+		return errNotConnectedToRelay
+	}
+
+	for _, buf := range bufs {
+		if err := client.Send(ep.publicKey, buf); err != nil {
+			_ = client.Close()
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *RelayBind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.open {
+		return nil
+	}
+
+	close(b.closed)
+	b.open = false
+
+	if b.client != nil {
+		_ = b.client.Close()
+		b.client = nil
+	}
+
+	return nil
+}
+
+func (b *RelayBind) BatchSize() int {
+	return IdealBatchSize
+}
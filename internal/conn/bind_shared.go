@@ -0,0 +1,295 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (c) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package conn
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// sharedBindQueueSize is the number of received packets that can be queued
+	// for each member of a shared bind, before packets are dropped.
+	sharedBindQueueSize = 1024
+	// sharedBindMaxPacketSize is the size of the buffers packets are received into.
+	sharedBindMaxPacketSize = 65535
+)
+
+var _ Bind = (*SharedBindMember)(nil)
+
+// SharedBind shares a single bind (eg. a UDP socket) between several members,
+// each of which is typically the bind of a separate transport. Received packets
+// are delivered to the first member that accepts them. The underlying bind is
+// opened along with the first member, and closed along with the last.
+type SharedBind struct {
+	bind Bind
+
+	mu      sync.Mutex // protects all fields below
+	members []*SharedBindMember
+	open    int
+	port    uint16
+	wg      sync.WaitGroup
+
+	bufPool sync.Pool
+}
+
+// NewSharedBind creates a new SharedBind, sharing the given bind.
+func NewSharedBind(bind Bind) *SharedBind {
+	return &SharedBind{
+		bind: bind,
+		bufPool: sync.Pool{
+			New: func() any {
+				buf := make([]byte, sharedBindMaxPacketSize)
+				return &buf
+			},
+		},
+	}
+}
+
+// Attach creates a new member of the shared bind, accept reports whether a
+// received packet is addressed to the member. It must be safe for concurrent use.
+func (b *SharedBind) Attach(accept func(packet []byte) bool) *SharedBindMember {
+	return &SharedBindMember{
+		shared: b,
+		accept: accept,
+		queue:  make(chan sharedPacket, sharedBindQueueSize),
+	}
+}
+
+// Port returns the port the underlying bind is listening on, or zero if it
+// isn't open.
+func (b *SharedBind) Port() uint16 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.port
+}
+
+func (b *SharedBind) openMember(m *SharedBindMember, port uint16) (uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.open == 0 {
+		fns, actualPort, err := b.bind.Open(port)
+		if err != nil {
+			return 0, err
+		}
+
+		b.port = actualPort
+
+		for _, fn := range fns {
+			b.wg.Add(1)
+			go b.receive(fn)
+		}
+	} else if port != 0 && port != b.port {
+		return 0, fmt.Errorf("shared bind is already listening on port %d", b.port)
+	}
+
+	b.open++
+	// Members are copied on write, as they're read without holding the lock.
+	b.members = append(slices.Clone(b.members), m)
+
+	return b.port, nil
+}
+
+func (b *SharedBind) closeMember(m *SharedBindMember) error {
+	b.mu.Lock()
+
+	if i := slices.Index(b.members, m); i != -1 {
+		b.members = slices.Delete(slices.Clone(b.members), i, i+1)
+		b.open--
+	}
+
+	if b.open > 0 {
+		b.mu.Unlock()
+		return nil
+	}
+
+	err := b.bind.Close()
+	b.port = 0
+	b.mu.Unlock()
+
+	// The receive functions return once the bind is closed.
+	b.wg.Wait()
+
+	return err
+}
+
+// receive delivers packets, received by fn, to the members they're addressed to.
+func (b *SharedBind) receive(fn ReceiveFunc) {
+	defer b.wg.Done()
+
+	batchSize := b.bind.BatchSize()
+	bufs := make([]*[]byte, batchSize)
+	packets := make([][]byte, batchSize)
+	sizes := make([]int, batchSize)
+	eps := make([]Endpoint, batchSize)
+	for i := range bufs {
+		bufs[i] = b.bufPool.Get().(*[]byte)
+		packets[i] = *bufs[i]
+	}
+	defer func() {
+		for _, buf := range bufs {
+			b.bufPool.Put(buf)
+		}
+	}()
+
+	var failures int
+	for {
+		n, err := fn(packets, sizes, eps)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			// Temporary errors (eg. ICMP unreachable) shouldn't take every member down.
+			if failures < 10 {
+				failures++
+				time.Sleep(time.Second / 3)
+				continue
+			}
+			return
+		}
+		failures = 0
+
+		b.mu.Lock()
+		members := b.members
+		b.mu.Unlock()
+
+		for i := 0; i < n; i++ {
+			if sizes[i] == 0 {
+				continue
+			}
+
+			packet := packets[i][:sizes[i]]
+			for _, m := range members {
+				if !m.accept(packet) {
+					continue
+				}
+
+				// Hand the buffer over to the member, so that a member that is
+				// slow to receive doesn't hold up the others.
+				select {
+				case m.queue <- sharedPacket{buf: bufs[i], size: sizes[i], ep: eps[i]}:
+					bufs[i] = b.bufPool.Get().(*[]byte)
+					packets[i] = *bufs[i]
+				default:
+					// The member isn't keeping up, drop the packet.
+				}
+				break
+			}
+		}
+	}
+}
+
+// sharedPacket is a packet received by a shared bind, queued for a member.
+type sharedPacket struct {
+	buf  *[]byte
+	size int
+	ep   Endpoint
+}
+
+// SharedBindMember is a bind backed by a SharedBind.
+type SharedBindMember struct {
+	shared *SharedBind
+	accept func(packet []byte) bool
+	queue  chan sharedPacket
+
+	mu     sync.Mutex // protects closed
+	closed chan struct{}
+}
+
+// Open opens the shared bind, if it isn't already. If it is, port must be zero
+// or the port it is already listening on.
+func (m *SharedBindMember) Open(port uint16) ([]ReceiveFunc, uint16, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed != nil {
+		return nil, 0, ErrBindAlreadyOpen
+	}
+
+	actualPort, err := m.shared.openMember(m, port)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	m.closed = make(chan struct{})
+
+	return []ReceiveFunc{m.makeReceiveFunc(m.closed)}, actualPort, nil
+}
+
+func (m *SharedBindMember) makeReceiveFunc(closed chan struct{}) ReceiveFunc {
+	return func(packets [][]byte, sizes []int, eps []Endpoint) (int, error) {
+		var pkt sharedPacket
+		select {
+		case <-closed:
+			return 0, net.ErrClosed
+		case pkt = <-m.queue:
+		}
+
+		// Fill the rest of the batch with any packets that are already queued.
+		var n int
+		for {
+			sizes[n] = copy(packets[n], (*pkt.buf)[:pkt.size])
+			eps[n] = pkt.ep
+			m.shared.bufPool.Put(pkt.buf)
+			n++
+
+			if n == len(packets) {
+				return n, nil
+			}
+
+			select {
+			case pkt = <-m.queue:
+			default:
+				return n, nil
+			}
+		}
+	}
+}
+
+// Close detaches the member from the shared bind, the shared bind is closed
+// along with its last member.
+func (m *SharedBindMember) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed == nil {
+		return nil
+	}
+
+	err := m.shared.closeMember(m)
+
+	close(m.closed)
+	m.closed = nil
+
+	// Release any packets that were never received.
+	for {
+		select {
+		case pkt := <-m.queue:
+			m.shared.bufPool.Put(pkt.buf)
+		default:
+			return err
+		}
+	}
+}
+
+func (m *SharedBindMember) Send(bufs [][]byte, ep Endpoint) error {
+	return m.shared.bind.Send(bufs, ep)
+}
+
+func (m *SharedBindMember) ParseEndpoint(s string) (Endpoint, error) {
+	return m.shared.bind.ParseEndpoint(s)
+}
+
+func (m *SharedBindMember) BatchSize() int {
+	return m.shared.bind.BatchSize()
+}
@@ -0,0 +1,86 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (c) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package conn
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSharedBind(t *testing.T) {
+	shared := NewSharedBind(NewStdNetBind())
+
+	// Each member accepts the packets starting with its own tag.
+	a := shared.Attach(func(packet []byte) bool { return packet[0] == 'a' })
+	b := shared.Attach(func(packet []byte) bool { return packet[0] == 'b' })
+
+	aFns, port, err := a.Open(0)
+	require.NoError(t, err)
+	require.Len(t, aFns, 1)
+	require.Equal(t, port, shared.Port())
+
+	// Every member must use the same port.
+	_, _, err = b.Open(port + 1)
+	require.Error(t, err)
+
+	bFns, bPort, err := b.Open(0)
+	require.NoError(t, err)
+	require.Equal(t, port, bPort)
+
+	client, err := net.DialUDP("udp4", nil, net.UDPAddrFromAddrPort(netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), port)))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+
+	for _, msg := range []string{"b1", "a1", "c1", "a2"} {
+		_, err := client.Write([]byte(msg))
+		require.NoError(t, err)
+	}
+
+	receive := func(fn ReceiveFunc) []string {
+		packets := make([][]byte, a.BatchSize())
+		for i := range packets {
+			packets[i] = make([]byte, 1500)
+		}
+		sizes := make([]int, len(packets))
+		eps := make([]Endpoint, len(packets))
+
+		n, err := fn(packets, sizes, eps)
+		require.NoError(t, err)
+
+		var received []string
+		for i := 0; i < n; i++ {
+			require.Equal(t, client.LocalAddr().String(), eps[i].DstToString())
+			received = append(received, string(packets[i][:sizes[i]]))
+		}
+		return received
+	}
+
+	require.Eventually(t, func() bool {
+		return len(a.queue) == 2 && len(b.queue) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.Equal(t, []string{"a1", "a2"}, receive(aFns[0]))
+	require.Equal(t, []string{"b1"}, receive(bFns[0]))
+
+	// The underlying bind stays open until the last member is closed.
+	require.NoError(t, a.Close())
+	require.Equal(t, port, shared.Port())
+
+	_, err = aFns[0](make([][]byte, 1), make([]int, 1), make([]Endpoint, 1))
+	require.ErrorIs(t, err, net.ErrClosed)
+
+	require.NoError(t, b.Close())
+	require.Zero(t, shared.Port())
+
+	_, err = bFns[0](make([][]byte, 1), make([]int, 1), make([]Endpoint, 1))
+	require.ErrorIs(t, err, net.ErrClosed)
+}
@@ -47,10 +47,27 @@ type StdNetBind struct {
 
 	blackhole4 bool
 	blackhole6 bool
+
+	sockOpts  SocketOptions
+	batchSize int
 }
 
 func NewStdNetBind() Bind {
+	return NewStdNetBindWithOptions(SocketOptions{})
+}
+
+// NewStdNetBindWithOptions creates a StdNetBind, that applies the given options
+// to its sockets.
+func NewStdNetBindWithOptions(opts SocketOptions) Bind {
+	batchSize := opts.BatchSize
+	if batchSize <= 0 || batchSize > IdealBatchSize {
+		batchSize = IdealBatchSize
+	}
+
 	return &StdNetBind{
+		sockOpts:  opts,
+		batchSize: batchSize,
+
 		udpAddrPool: sync.Pool{
 			New: func() any {
 				return &net.UDPAddr{
@@ -63,7 +80,7 @@ func NewStdNetBind() Bind {
 			New: func() any {
 				// ipv6.Message and ipv4.Message are interchangeable as they are
 				// both aliases for x/net/internal/socket.Message.
-				msgs := make([]ipv6.Message, IdealBatchSize)
+				msgs := make([]ipv6.Message, batchSize)
 				for i := range msgs {
 					msgs[i].Buffers = make(net.Buffers, 1)
 					msgs[i].OOB = make([]byte, 0, gsoControlSize)
@@ -109,8 +126,8 @@ func (e *StdNetEndpoint) DstToString() string {
 	return e.AddrPort.String()
 }
 
-func listenNet(network string, port int) (*net.UDPConn, int, error) {
-	conn, err := listenConfig().ListenPacket(context.Background(), network, ":"+strconv.Itoa(port))
+func listenNet(network string, port int, opts SocketOptions) (*net.UDPConn, int, error) {
+	conn, err := listenConfig(opts).ListenPacket(context.Background(), network, ":"+strconv.Itoa(port))
 	if err != nil {
 		return nil, 0, err
 	}
@@ -146,13 +163,13 @@ again:
 	var v4pc *ipv4.PacketConn
 	var v6pc *ipv6.PacketConn
 
-	v4conn, port, err = listenNet("udp4", port)
+	v4conn, port, err = listenNet("udp4", port, s.sockOpts)
 	if err != nil && !errors.Is(err, syscall.EAFNOSUPPORT) {
 		return nil, 0, err
 	}
 
 	// Listen on the same port as we're using for ipv4.
-	v6conn, port, err = listenNet("udp6", port)
+	v6conn, port, err = listenNet("udp6", port, s.sockOpts)
 	if uport == 0 && errors.Is(err, syscall.EADDRINUSE) && tries < 100 {
 		v4conn.Close()
 		tries++
@@ -165,6 +182,7 @@ again:
 	var fns []ReceiveFunc
 	if v4conn != nil {
 		s.ipv4TxOffload, s.ipv4RxOffload = supportsUDPOffload(v4conn)
+		s.ipv4RxOffload = s.ipv4RxOffload && s.canSplitCoalesced()
 		if runtime.GOOS == "linux" {
 			v4pc = ipv4.NewPacketConn(v4conn)
 			s.ipv4PC = v4pc
@@ -174,6 +192,7 @@ again:
 	}
 	if v6conn != nil {
 		s.ipv6TxOffload, s.ipv6RxOffload = supportsUDPOffload(v6conn)
+		s.ipv6RxOffload = s.ipv6RxOffload && s.canSplitCoalesced()
 		if runtime.GOOS == "linux" {
 			v6pc = ipv6.NewPacketConn(v6conn)
 			s.ipv6PC = v6pc
@@ -230,7 +249,7 @@ func (s *StdNetBind) receiveIP(
 	var numMsgs int
 	if runtime.GOOS == "linux" {
 		if rxOffload {
-			readAt := len(*msgs) - (IdealBatchSize / udpSegmentMaxDatagrams)
+			readAt := len(*msgs) - (s.batchSize / udpSegmentMaxDatagrams)
 			_, err = br.ReadBatch((*msgs)[readAt:], 0)
 			if err != nil {
 				return 0, err
@@ -278,15 +297,22 @@ func (s *StdNetBind) makeReceiveIPv6(pc *ipv6.PacketConn, conn *net.UDPConn, rxO
 	}
 }
 
-// TODO: When all Binds handle IdealBatchSize, remove this dynamic function and
-// rename the IdealBatchSize constant to BatchSize.
+// BatchSize returns the number of datagrams sent, or received, per syscall.
+// Datagrams are only batched on Linux.
 func (s *StdNetBind) BatchSize() int {
 	if runtime.GOOS == "linux" {
-		return IdealBatchSize
+		return s.batchSize
 	}
 	return 1
 }
 
+// canSplitCoalesced reports whether a batch has room for the datagrams of a
+// coalesced message (the kernel coalesces up to udpSegmentMaxDatagrams of
+// them), so that receive offload can be used.
+func (s *StdNetBind) canSplitCoalesced() bool {
+	return s.batchSize >= udpSegmentMaxDatagrams
+}
+
 func (s *StdNetBind) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -350,6 +376,15 @@ func (s *StdNetBind) Send(bufs [][]byte, endpoint Endpoint) error {
 		return syscall.EAFNOSUPPORT
 	}
 
+	// The transport's batches may be larger than ours (eg. when the source
+	// sink has a larger batch size), they are sent a batch at a time.
+	for len(bufs) > s.batchSize {
+		if err := s.Send(bufs[:s.batchSize], endpoint); err != nil {
+			return err
+		}
+		bufs = bufs[s.batchSize:]
+	}
+
 	msgs := s.getMessages()
 	defer s.putMessages(msgs)
 	ua := s.udpAddrPool.Get().(*net.UDPAddr)
@@ -10,6 +10,8 @@ import (
 	"encoding/binary"
 	"errors"
 	"net"
+	"net/netip"
+	"runtime"
 	"testing"
 
 	"golang.org/x/net/ipv6"
@@ -36,6 +38,66 @@ func TestStdNetBindReceiveFuncAfterClose(t *testing.T) {
 	}
 }
 
+func TestStdNetBindBatchSize(t *testing.T) {
+	const batchSize = 4
+
+	bind := NewStdNetBindWithOptions(SocketOptions{BatchSize: batchSize}).(*StdNetBind)
+	fns, port, err := bind.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+
+	wantBatchSize := 1
+	if runtime.GOOS == "linux" {
+		wantBatchSize = batchSize
+	}
+	if got := bind.BatchSize(); got != wantBatchSize {
+		t.Fatalf("BatchSize() = %d, want %d", got, wantBatchSize)
+	}
+
+	// More datagrams than fit in a batch are sent at once.
+	const count = 3*batchSize + 1
+	bufs := make([][]byte, count)
+	for i := range bufs {
+		bufs[i] = []byte{byte(i)}
+	}
+
+	ep := &StdNetEndpoint{AddrPort: netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), port)}
+	if err := bind.Send(bufs, ep); err != nil {
+		t.Fatal(err)
+	}
+
+	recvBufs := make([][]byte, bind.BatchSize())
+	for i := range recvBufs {
+		recvBufs[i] = make([]byte, 16)
+	}
+	sizes := make([]int, len(recvBufs))
+	eps := make([]Endpoint, len(recvBufs))
+
+	var received []byte
+	for len(received) < count {
+		// The first receive func is the IPv4 one.
+		n, err := fns[0](recvBufs, sizes, eps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > bind.BatchSize() {
+			t.Fatalf("received %d datagrams, more than the batch size", n)
+		}
+
+		for i := 0; i < n; i++ {
+			received = append(received, recvBufs[i][:sizes[i]]...)
+		}
+	}
+
+	for i, b := range received {
+		if b != byte(i) {
+			t.Fatalf("datagram %d out of order, got %d", i, b)
+		}
+	}
+}
+
 func mockSetGSOSize(control *[]byte, gsoSize uint16) {
 	*control = (*control)[:cap(*control)]
 	binary.LittleEndian.PutUint16(*control, gsoSize)
@@ -0,0 +1,430 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (c) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package conn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// streamDialTimeout is the maximum time to wait for a connection to a peer.
+	streamDialTimeout = 5 * time.Second
+	// streamWriteTimeout is the maximum time to wait for a message to be written.
+	streamWriteTimeout = 5 * time.Second
+	// streamMaxMessageSize is the largest message that can be framed.
+	streamMaxMessageSize = 1<<16 - 1
+)
+
+var (
+	_ Bind     = (*StreamBind)(nil)
+	_ Endpoint = (*StreamEndpoint)(nil)
+)
+
+var ErrUnsupportedTransport = errors.New("unsupported transport")
+
+// StreamBind implements Bind for stream oriented transports, TCP and WebSocket,
+// which can get through networks (and proxies) that block UDP. Each message is
+// prefixed with its length, as a 16-bit big endian integer. Connections to
+// peers are established on demand, and connections accepted from peers are
+// used for sending replies.
+type StreamBind struct {
+	logger      *slog.Logger
+	listenAddrs []*url.URL
+
+	mu        sync.Mutex // protects all fields below
+	open      bool
+	closed    chan struct{}
+	listeners []io.Closer
+	conns     map[string]*streamConn
+	recv      chan streamMessage
+}
+
+type streamMessage struct {
+	data []byte
+	ep   Endpoint
+}
+
+type streamConn struct {
+	net.Conn
+	writeMu sync.Mutex
+}
+
+// NewStreamBind creates a new StreamBind. It will accept connections from peers
+// on each of the given listen addresses, eg. "tcp://0.0.0.0:51820" or
+// "ws://0.0.0.0:8080/wireguard", whenever it is open.
+func NewStreamBind(logger *slog.Logger, listenAddrs []string) (*StreamBind, error) {
+	b := &StreamBind{
+		logger: logger,
+		conns:  make(map[string]*streamConn),
+	}
+
+	if len(listenAddrs) > 0 && !streamListenersSupported {
+		return nil, fmt.Errorf("%w: listeners are not supported on this platform", ErrUnsupportedTransport)
+	}
+
+	for _, listenAddr := range listenAddrs {
+		u, err := url.Parse(listenAddr)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse listen address %q: %w", listenAddr, err)
+		}
+
+		switch u.Scheme {
+		case "tcp", "ws":
+		case "wss":
+			return nil, fmt.Errorf("%w: wss listeners are not supported, use a TLS terminating proxy", ErrUnsupportedTransport)
+		default:
+			return nil, fmt.Errorf("%w: %q", ErrUnsupportedTransport, u.Scheme)
+		}
+
+		b.listenAddrs = append(b.listenAddrs, u)
+	}
+
+	return b, nil
+}
+
+// StreamEndpoint is a peer reachable over a stream oriented transport.
+type StreamEndpoint struct {
+	// key uniquely identifies the endpoint, it is the URL of dialable endpoints.
+	key string
+	// u is the URL to dial, it is nil for endpoints of accepted connections.
+	u     *url.URL
+	dstIP netip.Addr
+}
+
+// ParseStreamEndpoint parses a stream endpoint URL, eg. "tcp://host:port" or
+// "wss://host/path".
+func ParseStreamEndpoint(s string) (*StreamEndpoint, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "tcp", "ws", "wss":
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedTransport, u.Scheme)
+	}
+
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing host in endpoint %q", s)
+	}
+
+	ep := &StreamEndpoint{key: u.String(), u: u}
+	if addr, err := netip.ParseAddr(u.Hostname()); err == nil {
+		ep.dstIP = addr
+	}
+
+	return ep, nil
+}
+
+func (e *StreamEndpoint) DstIP() netip.Addr {
+	return e.dstIP
+}
+
+func (e *StreamEndpoint) DstToBytes() []byte {
+	return []byte(e.key)
+}
+
+func (e *StreamEndpoint) DstToString() string {
+	return e.key
+}
+
+func (*StreamBind) ParseEndpoint(s string) (Endpoint, error) {
+	return ParseStreamEndpoint(s)
+}
+
+// Open starts the listeners, the port is ignored as listen addresses are
+// specified when the bind is created.
+func (b *StreamBind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.open {
+		return nil, 0, ErrBindAlreadyOpen
+	}
+
+	closed := make(chan struct{})
+	recv := make(chan streamMessage, IdealBatchSize)
+
+	for _, u := range b.listenAddrs {
+		l, err := b.listenLocked(u, closed, recv)
+		if err != nil {
+			for _, l := range b.listeners {
+				_ = l.Close()
+			}
+			b.listeners = nil
+			return nil, 0, fmt.Errorf("could not listen on %q: %w", u, err)
+		}
+		b.listeners = append(b.listeners, l)
+	}
+
+	b.open = true
+	b.closed = closed
+	b.recv = recv
+
+	return []ReceiveFunc{channelReceiveFunc(recv, closed)}, port, nil
+}
+
+// channelReceiveFunc returns a ReceiveFunc that receives the messages sent on
+// recv, until closed is closed.
+func channelReceiveFunc(recv chan streamMessage, closed chan struct{}) ReceiveFunc {
+	return func(packets [][]byte, sizes []int, eps []Endpoint) (int, error) {
+		var n int
+		for n < len(packets) {
+			var msg streamMessage
+			if n == 0 {
+				select {
+				case msg = <-recv:
+				case <-closed:
+					return 0, net.ErrClosed
+				}
+			} else {
+				select {
+				case msg = <-recv:
+				default:
+					return n, nil
+				}
+			}
+
+			sizes[n] = copy(packets[n], msg.data)
+			eps[n] = msg.ep
+			n++
+		}
+		return n, nil
+	}
+}
+
+func (b *StreamBind) listenLocked(u *url.URL, closed chan struct{}, recv chan streamMessage) (io.Closer, error) {
+	lis, err := net.Listen("tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == "ws" {
+		path := u.Path
+		if path == "" {
+			path = "/"
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle(path, websocket.Server{
+			// Peers are authenticated by the WireGuard handshake, not the origin.
+			Handshake: func(*websocket.Config, *http.Request) error { return nil },
+			Handler: func(ws *websocket.Conn) {
+				ws.PayloadType = websocket.BinaryFrame
+				b.serveConn(ws, acceptedEndpoint("ws", ws.Request().RemoteAddr), closed, recv)
+			},
+		})
+
+		srv := &http.Server{Handler: mux, ReadHeaderTimeout: streamDialTimeout}
+		go func() {
+			if err := srv.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				b.logger.Warn("Failed to serve websocket listener", "addr", u.Host, "error", err)
+			}
+		}()
+
+		return srv, nil
+	}
+
+	go func() {
+		for {
+			c, err := lis.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					b.logger.Warn("Failed to accept connection", "addr", u.Host, "error", err)
+				}
+				return
+			}
+
+			go b.serveConn(c, acceptedEndpoint("tcp", c.RemoteAddr().String()), closed, recv)
+		}
+	}()
+
+	return lis, nil
+}
+
+func acceptedEndpoint(scheme, remoteAddr string) *StreamEndpoint {
+	ep := &StreamEndpoint{key: scheme + "://" + remoteAddr}
+	if addrPort, err := netip.ParseAddrPort(remoteAddr); err == nil {
+		ep.dstIP = addrPort.Addr()
+	}
+	return ep
+}
+
+// addConn registers the connection for the endpoint, if there is already a
+// connection for the endpoint it is returned instead and c is closed.
+func (b *StreamBind) addConn(c net.Conn, ep *StreamEndpoint, closed chan struct{}) (*streamConn, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.open || b.closed != closed {
+		_ = c.Close()
+		return nil, false
+	}
+
+	if existing, ok := b.conns[ep.key]; ok {
+		_ = c.Close()
+		return existing, false
+	}
+
+	sc := &streamConn{Conn: c}
+	b.conns[ep.key] = sc
+
+	return sc, true
+}
+
+// serveConn registers the connection and reads messages from it until it is closed.
+func (b *StreamBind) serveConn(c net.Conn, ep *StreamEndpoint, closed chan struct{}, recv chan streamMessage) {
+	if sc, ok := b.addConn(c, ep, closed); ok {
+		b.readConn(sc, ep, closed, recv)
+	}
+}
+
+// readConn reads messages from the connection until it is closed.
+func (b *StreamBind) readConn(sc *streamConn, ep *StreamEndpoint, closed chan struct{}, recv chan streamMessage) {
+	defer func() {
+		b.mu.Lock()
+		if b.conns[ep.key] == sc {
+			delete(b.conns, ep.key)
+		}
+		b.mu.Unlock()
+
+		_ = sc.Close()
+	}()
+
+	var hdr [2]byte
+	for {
+		if _, err := io.ReadFull(sc, hdr[:]); err != nil {
+			return
+		}
+
+		data := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+		if _, err := io.ReadFull(sc, data); err != nil {
+			return
+		}
+
+		select {
+		case recv <- streamMessage{data: data, ep: ep}:
+		case <-closed:
+			return
+		}
+	}
+}
+
+func (b *StreamBind) Send(bufs [][]byte, endpoint Endpoint) error {
+	ep, ok := endpoint.(*StreamEndpoint)
+	if !ok {
+		return ErrWrongEndpointType
+	}
+
+	sc, err := b.connFor(ep)
+	if err != nil {
+		return err
+	}
+
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+
+	if err := sc.SetWriteDeadline(time.Now().Add(streamWriteTimeout)); err != nil {
+		return err
+	}
+
+	for _, buf := range bufs {
+		if len(buf) > streamMaxMessageSize {
+			return fmt.Errorf("message too large: %d bytes", len(buf))
+		}
+
+		frame := make([]byte, 2+len(buf))
+		binary.BigEndian.PutUint16(frame, uint16(len(buf)))
+		copy(frame[2:], buf)
+
+		if _, err := sc.Write(frame); err != nil {
+			_ = sc.Close()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// connFor returns the connection for the endpoint, dialing it if required.
+func (b *StreamBind) connFor(ep *StreamEndpoint) (*streamConn, error) {
+	b.mu.Lock()
+	if !b.open {
+		b.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	sc, ok := b.conns[ep.key]
+	closed, recv := b.closed, b.recv
+	b.mu.Unlock()
+
+	if ok {
+		return sc, nil
+	}
+
+	if ep.u == nil {
+		return nil, fmt.Errorf("connection to %s has been closed", ep.key)
+	}
+
+	c, err := dialStream(ep.u)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to %s: %w", ep.key, err)
+	}
+
+	sc, added := b.addConn(c, ep, closed)
+	if sc == nil {
+		return nil, net.ErrClosed
+	}
+
+	if added {
+		go b.readConn(sc, ep, closed, recv)
+	}
+
+	return sc, nil
+}
+
+func (b *StreamBind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.open {
+		return nil
+	}
+
+	var errs []error
+	for _, l := range b.listeners {
+		if err := l.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	b.listeners = nil
+
+	for key, sc := range b.conns {
+		_ = sc.Close()
+		delete(b.conns, key)
+	}
+
+	close(b.closed)
+	b.open = false
+
+	return errors.Join(errs...)
+}
+
+func (b *StreamBind) BatchSize() int {
+	return IdealBatchSize
+}
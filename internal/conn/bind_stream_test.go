@@ -0,0 +1,99 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (c) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package conn
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamBind(t *testing.T) {
+	for _, listenAddr := range []string{"tcp://127.0.0.1:12373", "ws://127.0.0.1:12374/wireguard"} {
+		listenAddr := listenAddr
+		t.Run(listenAddr, func(t *testing.T) {
+			logger := slogt.New(t)
+
+			server, err := NewStreamBind(logger, []string{listenAddr})
+			require.NoError(t, err)
+
+			serverFns, _, err := server.Open(0)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, server.Close())
+			})
+
+			client, err := NewStreamBind(logger, nil)
+			require.NoError(t, err)
+
+			clientFns, _, err := client.Open(0)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, client.Close())
+			})
+
+			ep, err := client.ParseEndpoint(listenAddr)
+			require.NoError(t, err)
+
+			require.NoError(t, client.Send([][]byte{[]byte("ping")}, ep))
+
+			data, replyEp := receiveOne(t, serverFns[0])
+			require.Equal(t, "ping", string(data))
+
+			// Replies are sent over the accepted connection.
+			require.NoError(t, server.Send([][]byte{[]byte("pong")}, replyEp))
+
+			data, _ = receiveOne(t, clientFns[0])
+			require.Equal(t, "pong", string(data))
+		})
+	}
+}
+
+func TestStreamBindReceiveFuncAfterClose(t *testing.T) {
+	bind, err := NewStreamBind(slogt.New(t), nil)
+	require.NoError(t, err)
+
+	fns, _, err := bind.Open(0)
+	require.NoError(t, err)
+
+	require.NoError(t, bind.Close())
+
+	_, err = fns[0](make([][]byte, 1), make([]int, 1), make([]Endpoint, 1))
+	require.True(t, errors.Is(err, net.ErrClosed))
+
+	// And it can be reopened.
+	_, _, err = bind.Open(0)
+	require.NoError(t, err)
+	require.NoError(t, bind.Close())
+}
+
+func TestParseStreamEndpoint(t *testing.T) {
+	ep, err := ParseStreamEndpoint("wss://127.0.0.1/wireguard")
+	require.NoError(t, err)
+	require.Equal(t, "wss://127.0.0.1/wireguard", ep.DstToString())
+	require.Equal(t, "127.0.0.1", ep.DstIP().String())
+
+	_, err = ParseStreamEndpoint("quic://127.0.0.1:51820")
+	require.ErrorIs(t, err, ErrUnsupportedTransport)
+
+	_, err = NewStreamBind(slogt.New(t), []string{"wss://0.0.0.0:443"})
+	require.ErrorIs(t, err, ErrUnsupportedTransport)
+}
+
+func receiveOne(t *testing.T, fn ReceiveFunc) ([]byte, Endpoint) {
+	packets := [][]byte{make([]byte, 1500)}
+	sizes := make([]int, 1)
+	eps := make([]Endpoint, 1)
+
+	n, err := fn(packets, sizes, eps)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	return packets[0][:sizes[0]], eps[0]
+}
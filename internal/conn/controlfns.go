@@ -27,10 +27,23 @@ type controlFn func(network, address string, c syscall.RawConn) error
 // that can apply socket options.
 var controlFns = []controlFn{}
 
-// listenConfig returns a net.ListenConfig that applies the controlFns to the
-// socket prior to bind. This is used to apply socket buffer sizing and packet
-// information OOB configuration for sticky sockets.
-func listenConfig() *net.ListenConfig {
+// SocketOptions are user specified options of a bind's sockets.
+type SocketOptions struct {
+	// BindToDevice is the name of the network interface the sockets are bound to.
+	BindToDevice string
+	// Mark is the firewall mark (SO_MARK) of the sockets' packets.
+	Mark uint32
+	// DSCP is the differentiated services code point of the sockets' packets.
+	DSCP int
+	// BatchSize is the maximum number of datagrams sent, or received, per
+	// syscall (on Linux, elsewhere it is always 1). Zero means IdealBatchSize.
+	BatchSize int
+}
+
+// listenConfig returns a net.ListenConfig that applies the controlFns, and then
+// the socket options, to the socket prior to bind. This is used to apply socket
+// buffer sizing and packet information OOB configuration for sticky sockets.
+func listenConfig(opts SocketOptions) *net.ListenConfig {
 	return &net.ListenConfig{
 		Control: func(network, address string, c syscall.RawConn) error {
 			for _, fn := range controlFns {
@@ -38,7 +51,7 @@ func listenConfig() *net.ListenConfig {
 					return err
 				}
 			}
-			return nil
+			return opts.control(network, address, c)
 		},
 	}
 }
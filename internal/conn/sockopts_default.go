@@ -0,0 +1,21 @@
+//go:build !linux
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (c) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package conn
+
+import (
+	"errors"
+	"syscall"
+)
+
+func (o SocketOptions) control(network, address string, c syscall.RawConn) error {
+	if o != (SocketOptions{}) {
+		return errors.New("socket options are not supported on this platform")
+	}
+
+	return nil
+}
@@ -0,0 +1,49 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (c) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package conn
+
+import (
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func (o SocketOptions) control(network, address string, c syscall.RawConn) error {
+	var err error
+	if controlErr := c.Control(func(fd uintptr) {
+		if o.BindToDevice != "" {
+			if err = unix.BindToDevice(int(fd), o.BindToDevice); err != nil {
+				err = fmt.Errorf("could not bind to device %q: %w", o.BindToDevice, err)
+				return
+			}
+		}
+
+		if o.Mark != 0 {
+			if err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, int(o.Mark)); err != nil {
+				err = fmt.Errorf("could not set firewall mark: %w", err)
+				return
+			}
+		}
+
+		if o.DSCP != 0 {
+			// The DSCP is the upper six bits of the TOS (or traffic class) field.
+			if network == "udp6" {
+				err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_TCLASS, o.DSCP<<2)
+			} else {
+				err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, o.DSCP<<2)
+			}
+			if err != nil {
+				err = fmt.Errorf("could not set dscp: %w", err)
+				return
+			}
+		}
+	}); controlErr != nil {
+		return controlErr
+	}
+
+	return err
+}
@@ -0,0 +1,62 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (c) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package conn
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestSocketOptions(t *testing.T) {
+	bind := NewStdNetBindWithOptions(SocketOptions{
+		BindToDevice: "lo",
+		Mark:         0x51820,
+		DSCP:         46,
+	}).(*StdNetBind)
+
+	_, _, err := bind.Open(0)
+	if errors.Is(err, unix.EPERM) {
+		t.Skip("binding to a device, and marking packets, requires CAP_NET_RAW and CAP_NET_ADMIN")
+	}
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, bind.Close())
+	})
+
+	for _, tc := range []struct {
+		conn          *net.UDPConn
+		level, tosOpt int
+	}{
+		{conn: bind.ipv4, level: unix.IPPROTO_IP, tosOpt: unix.IP_TOS},
+		{conn: bind.ipv6, level: unix.IPPROTO_IPV6, tosOpt: unix.IPV6_TCLASS},
+	} {
+		// IPv6 may be unavailable.
+		if tc.conn == nil {
+			continue
+		}
+
+		rc, err := tc.conn.SyscallConn()
+		require.NoError(t, err)
+
+		require.NoError(t, rc.Control(func(fd uintptr) {
+			device, err := unix.GetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE)
+			require.NoError(t, err)
+			require.Equal(t, "lo", device)
+
+			mark, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK)
+			require.NoError(t, err)
+			require.Equal(t, 0x51820, mark)
+
+			tos, err := unix.GetsockoptInt(int(fd), tc.level, tc.tosOpt)
+			require.NoError(t, err)
+			require.Equal(t, 46<<2, tos)
+		}))
+	}
+}
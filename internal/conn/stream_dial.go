@@ -0,0 +1,47 @@
+//go:build !js
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (c) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package conn
+
+import (
+	"net"
+	"net/url"
+
+	"golang.org/x/net/websocket"
+)
+
+// streamListenersSupported is false on platforms that can not accept
+// connections (eg. browsers).
+const streamListenersSupported = true
+
+func dialStream(u *url.URL) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: streamDialTimeout}
+
+	if u.Scheme == "tcp" {
+		return dialer.Dial("tcp", u.Host)
+	}
+
+	origin := "http://" + u.Host
+	if u.Scheme == "wss" {
+		origin = "https://" + u.Host
+	}
+
+	config, err := websocket.NewConfig(u.String(), origin)
+	if err != nil {
+		return nil, err
+	}
+
+	config.Dialer = dialer
+
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	ws.PayloadType = websocket.BinaryFrame
+
+	return ws, nil
+}
@@ -0,0 +1,279 @@
+//go:build js
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (c) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package conn
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"syscall/js"
+	"time"
+)
+
+// Browsers can't accept connections.
+const streamListenersSupported = false
+
+// dialStream connects to a WebSocket endpoint using the browser's WebSocket API
+// (raw TCP connections can't be made from a browser).
+func dialStream(u *url.URL) (net.Conn, error) {
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, fmt.Errorf("%w: %s is not supported on this platform", ErrUnsupportedTransport, u.Scheme)
+	}
+
+	webSocket := js.Global().Get("WebSocket")
+	if webSocket.IsUndefined() {
+		return nil, fmt.Errorf("%w: websockets are not supported by this runtime", ErrUnsupportedTransport)
+	}
+
+	c := &wsConn{
+		u:        u,
+		readable: make(chan struct{}, 1),
+	}
+
+	opened := make(chan struct{})
+	var openOnce sync.Once
+
+	if err := jsCatch(func() { c.ws = webSocket.New(u.String()) }); err != nil {
+		return nil, err
+	}
+	c.ws.Set("binaryType", "arraybuffer")
+
+	c.addEventListener("open", func(js.Value) {
+		openOnce.Do(func() { close(opened) })
+	})
+	c.addEventListener("message", func(event js.Value) {
+		data := js.Global().Get("Uint8Array").New(event.Get("data"))
+		buf := make([]byte, data.Length())
+		js.CopyBytesToGo(buf, data)
+
+		c.mu.Lock()
+		c.pending = append(c.pending, buf)
+		c.mu.Unlock()
+
+		c.notify()
+	})
+	// Errors are always followed by a close event, which carries more detail.
+	c.addEventListener("close", func(event js.Value) {
+		c.mu.Lock()
+		if c.err == nil {
+			if event.Get("wasClean").Bool() {
+				c.err = io.EOF
+			} else {
+				c.err = fmt.Errorf("websocket closed with code %d", event.Get("code").Int())
+			}
+		}
+		c.mu.Unlock()
+
+		c.notify()
+		openOnce.Do(func() { close(opened) })
+	})
+
+	timer := time.NewTimer(streamDialTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-opened:
+	case <-timer.C:
+		_ = c.Close()
+		return nil, os.ErrDeadlineExceeded
+	}
+
+	// The connection was closed before it was opened.
+	c.mu.Lock()
+	err := c.err
+	c.mu.Unlock()
+	if err != nil {
+		c.release()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// wsConn is a net.Conn backed by a browser WebSocket. Each write is sent as a
+// single binary message.
+type wsConn struct {
+	u         *url.URL
+	ws        js.Value
+	listeners []wsListener
+	// readable is signaled whenever a message is received, or the connection
+	// is closed.
+	readable chan struct{}
+
+	mu           sync.Mutex // protects all fields below
+	buf          []byte
+	pending      [][]byte
+	err          error
+	readDeadline time.Time
+}
+
+type wsListener struct {
+	event string
+	fn    js.Func
+}
+
+func (c *wsConn) addEventListener(event string, fn func(event js.Value)) {
+	listener := js.FuncOf(func(this js.Value, args []js.Value) any {
+		fn(args[0])
+		return nil
+	})
+	c.listeners = append(c.listeners, wsListener{event: event, fn: listener})
+	c.ws.Call("addEventListener", event, listener)
+}
+
+func (c *wsConn) notify() {
+	select {
+	case c.readable <- struct{}{}:
+	default:
+	}
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if len(c.buf) == 0 && len(c.pending) > 0 {
+			c.buf, c.pending = c.pending[0], c.pending[1:]
+		}
+
+		if len(c.buf) > 0 {
+			n := copy(p, c.buf)
+			c.buf = c.buf[n:]
+			c.mu.Unlock()
+			return n, nil
+		}
+
+		if c.err != nil {
+			err := c.err
+			c.mu.Unlock()
+			return 0, err
+		}
+
+		deadline := c.readDeadline
+		c.mu.Unlock()
+
+		if deadline.IsZero() {
+			<-c.readable
+			continue
+		}
+
+		timer := time.NewTimer(time.Until(deadline))
+		select {
+		case <-c.readable:
+			timer.Stop()
+		case <-timer.C:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// Write queues p to be sent, browsers buffer outgoing messages so it never
+// blocks.
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	err := c.err
+	c.mu.Unlock()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = net.ErrClosed
+		}
+		return 0, err
+	}
+
+	data := js.Global().Get("Uint8Array").New(len(p))
+	js.CopyBytesToJS(data, p)
+
+	if err := jsCatch(func() { c.ws.Call("send", data) }); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (c *wsConn) Close() error {
+	c.mu.Lock()
+	if c.err == net.ErrClosed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.err = net.ErrClosed
+	c.mu.Unlock()
+
+	c.notify()
+
+	c.ws.Call("close")
+	c.release()
+
+	return nil
+}
+
+// release removes, and frees, the event listeners of the WebSocket.
+func (c *wsConn) release() {
+	for _, listener := range c.listeners {
+		c.ws.Call("removeEventListener", listener.event, listener.fn)
+		listener.fn.Release()
+	}
+	c.listeners = nil
+}
+
+func (c *wsConn) LocalAddr() net.Addr {
+	return wsAddr("")
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return wsAddr(c.u.Host)
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *wsConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+
+	c.notify()
+
+	return nil
+}
+
+// SetWriteDeadline is a no-op, as writes never block.
+func (c *wsConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+type wsAddr string
+
+func (wsAddr) Network() string {
+	return "websocket"
+}
+
+func (a wsAddr) String() string {
+	return string(a)
+}
+
+// jsCatch calls fn, returning any JavaScript exception it throws as an error.
+func jsCatch(fn func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if jsErr, ok := r.(js.Error); ok {
+				err = jsErr
+				return
+			}
+			panic(r)
+		}
+	}()
+
+	fn()
+
+	return nil
+}
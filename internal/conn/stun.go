@@ -0,0 +1,241 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (c) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package conn
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	stunHeaderSize           = 20
+	stunMagicCookie          = 0x2112A442
+	stunBindingRequest       = 0x0001
+	stunBindingSuccess       = 0x0101
+	stunAttrMappedAddress    = 0x0001
+	stunAttrXORMappedAddress = 0x0020
+	stunFamilyIPv4           = 0x01
+	stunFamilyIPv6           = 0x02
+
+	// stunRetransmitInterval is how often binding requests are retransmitted.
+	stunRetransmitInterval = 500 * time.Millisecond
+)
+
+var _ Bind = (*STUNBind)(nil)
+
+var errMalformedSTUNResponse = errors.New("malformed STUN response")
+
+// STUNBind wraps a UDP bind, so that STUN (RFC 5389) binding requests can be
+// sent from the same socket as WireGuard packets. This allows the public
+// address, and port, that a NAT has mapped the socket to, to be discovered.
+type STUNBind struct {
+	Bind
+
+	mu      sync.Mutex
+	pending map[[12]byte]chan netip.AddrPort
+}
+
+// NewSTUNBind wraps the UDP bind.
+func NewSTUNBind(bind Bind) *STUNBind {
+	return &STUNBind{
+		Bind:    bind,
+		pending: make(map[[12]byte]chan netip.AddrPort),
+	}
+}
+
+// Open opens the wrapped bind, responses to binding requests are removed from
+// the received packets.
+func (b *STUNBind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
+	fns, actualPort, err := b.Bind.Open(port)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for i := range fns {
+		fn := fns[i]
+		fns[i] = func(packets [][]byte, sizes []int, eps []Endpoint) (int, error) {
+			n, err := fn(packets, sizes, eps)
+			for j := 0; j < n; j++ {
+				if b.handleResponse(packets[j][:sizes[j]]) {
+					sizes[j] = 0
+				}
+			}
+			return n, err
+		}
+	}
+
+	return fns, actualPort, nil
+}
+
+// Discover sends a binding request to the STUN server, and returns the
+// address from which the server saw it come.
+func (b *STUNBind) Discover(ctx context.Context, server netip.AddrPort) (netip.AddrPort, error) {
+	var txID [12]byte
+	if _, err := rand.Read(txID[:]); err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	ch := make(chan netip.AddrPort, 1)
+
+	b.mu.Lock()
+	b.pending[txID] = ch
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		delete(b.pending, txID)
+		b.mu.Unlock()
+	}()
+
+	req := make([]byte, stunHeaderSize)
+	binary.BigEndian.PutUint16(req[0:2], stunBindingRequest)
+	binary.BigEndian.PutUint32(req[4:8], stunMagicCookie)
+	copy(req[8:20], txID[:])
+
+	ep := &StdNetEndpoint{AddrPort: server}
+
+	ticker := time.NewTicker(stunRetransmitInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := b.Bind.Send([][]byte{req}, ep); err != nil {
+			return netip.AddrPort{}, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return netip.AddrPort{}, ctx.Err()
+		case addr := <-ch:
+			return addr, nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// handleResponse delivers the packet to the pending request, if it is the
+// response to one, and reports whether it was.
+func (b *STUNBind) handleResponse(packet []byte) bool {
+	// Every WireGuard message has a zero second byte, so can't be mistaken
+	// for a binding response.
+	if len(packet) < stunHeaderSize ||
+		binary.BigEndian.Uint16(packet[0:2]) != stunBindingSuccess ||
+		binary.BigEndian.Uint32(packet[4:8]) != stunMagicCookie {
+		return false
+	}
+
+	var txID [12]byte
+	copy(txID[:], packet[8:20])
+
+	b.mu.Lock()
+	ch, ok := b.pending[txID]
+	b.mu.Unlock()
+
+	if !ok {
+		// A late response to a request that has completed.
+		return true
+	}
+
+	addr, err := parseSTUNBindingResponse(packet)
+	if err != nil {
+		return true
+	}
+
+	select {
+	case ch <- addr:
+	default:
+	}
+
+	return true
+}
+
+func parseSTUNBindingResponse(packet []byte) (netip.AddrPort, error) {
+	length := int(binary.BigEndian.Uint16(packet[2:4]))
+	if len(packet) < stunHeaderSize+length {
+		return netip.AddrPort{}, errMalformedSTUNResponse
+	}
+
+	var mapped netip.AddrPort
+	attrs := packet[stunHeaderSize : stunHeaderSize+length]
+	for len(attrs) >= 4 {
+		attrType := binary.BigEndian.Uint16(attrs[0:2])
+		attrLen := int(binary.BigEndian.Uint16(attrs[2:4]))
+		if len(attrs) < 4+attrLen {
+			return netip.AddrPort{}, errMalformedSTUNResponse
+		}
+		value := attrs[4 : 4+attrLen]
+
+		switch attrType {
+		case stunAttrXORMappedAddress:
+			addr, err := parseSTUNAddress(value, packet[4:20])
+			if err != nil {
+				return netip.AddrPort{}, err
+			}
+			// XOR-MAPPED-ADDRESS takes precedence, as NATs can rewrite the
+			// plain mapped address.
+			return addr, nil
+		case stunAttrMappedAddress:
+			addr, err := parseSTUNAddress(value, nil)
+			if err != nil {
+				return netip.AddrPort{}, err
+			}
+			mapped = addr
+		}
+
+		// Attributes are padded to a multiple of 4 bytes.
+		next := 4 + (attrLen+3)&^3
+		if next > len(attrs) {
+			break
+		}
+		attrs = attrs[next:]
+	}
+
+	if !mapped.IsValid() {
+		return netip.AddrPort{}, errMalformedSTUNResponse
+	}
+
+	return mapped, nil
+}
+
+// parseSTUNAddress parses a (XOR-)MAPPED-ADDRESS attribute value, xorKey is
+// the magic cookie and transaction id for XOR-MAPPED-ADDRESS, or nil.
+func parseSTUNAddress(value, xorKey []byte) (netip.AddrPort, error) {
+	if len(value) < 4 {
+		return netip.AddrPort{}, errMalformedSTUNResponse
+	}
+
+	var ipLen int
+	switch value[1] {
+	case stunFamilyIPv4:
+		ipLen = 4
+	case stunFamilyIPv6:
+		ipLen = 16
+	default:
+		return netip.AddrPort{}, errMalformedSTUNResponse
+	}
+
+	if len(value) < 4+ipLen {
+		return netip.AddrPort{}, errMalformedSTUNResponse
+	}
+
+	port := binary.BigEndian.Uint16(value[2:4])
+	ip := make([]byte, ipLen)
+	copy(ip, value[4:4+ipLen])
+
+	if xorKey != nil {
+		port ^= uint16(stunMagicCookie >> 16)
+		for i := range ip {
+			ip[i] ^= xorKey[i]
+		}
+	}
+
+	addr, _ := netip.AddrFromSlice(ip)
+	return netip.AddrPortFrom(addr, port), nil
+}
@@ -0,0 +1,156 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (c) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package conn
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSTUNBind(t *testing.T) {
+	server := serveSTUN(t)
+
+	bind := NewSTUNBind(NewStdNetBind())
+
+	fns, port, err := bind.Open(0)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, bind.Close())
+	})
+
+	// Something has to be reading from the socket.
+	for _, fn := range fns {
+		fn := fn
+		go func() {
+			packets := make([][]byte, bind.BatchSize())
+			for i := range packets {
+				packets[i] = make([]byte, 1500)
+			}
+			sizes := make([]int, len(packets))
+			eps := make([]Endpoint, len(packets))
+			for {
+				n, err := fn(packets, sizes, eps)
+				if err != nil {
+					return
+				}
+
+				// Binding responses must never be passed on.
+				for i := 0; i < n; i++ {
+					if sizes[i] != 0 {
+						t.Errorf("unexpected packet of size %d", sizes[i])
+					}
+				}
+			}
+		}()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	addr, err := bind.Discover(ctx, server)
+	require.NoError(t, err)
+
+	require.Equal(t, netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), port), addr)
+}
+
+func TestParseSTUNBindingResponse(t *testing.T) {
+	var txID [12]byte
+	copy(txID[:], "0123456789ab")
+
+	t.Run("XORMappedAddressIPv6", func(t *testing.T) {
+		addr := netip.MustParseAddrPort("[2001:db8::1]:51820")
+		resp := stunBindingResponse(txID, addr)
+
+		parsed, err := parseSTUNBindingResponse(resp)
+		require.NoError(t, err)
+		require.Equal(t, addr, parsed)
+	})
+
+	t.Run("MappedAddress", func(t *testing.T) {
+		resp := make([]byte, stunHeaderSize, stunHeaderSize+12)
+		binary.BigEndian.PutUint16(resp[0:2], stunBindingSuccess)
+		binary.BigEndian.PutUint16(resp[2:4], 12)
+		binary.BigEndian.PutUint32(resp[4:8], stunMagicCookie)
+		copy(resp[8:20], txID[:])
+		resp = append(resp, 0x00, 0x01, 0x00, 0x08, 0x00, stunFamilyIPv4, 0xca, 0x6c, 203, 0, 113, 7)
+
+		parsed, err := parseSTUNBindingResponse(resp)
+		require.NoError(t, err)
+		require.Equal(t, netip.MustParseAddrPort("203.0.113.7:51820"), parsed)
+	})
+
+	t.Run("Truncated", func(t *testing.T) {
+		resp := stunBindingResponse(txID, netip.MustParseAddrPort("203.0.113.7:51820"))
+
+		_, err := parseSTUNBindingResponse(resp[:len(resp)-4])
+		require.Error(t, err)
+	})
+}
+
+// serveSTUN starts a minimal STUN server, that answers binding requests.
+func serveSTUN(t *testing.T) netip.AddrPort {
+	pc, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = pc.Close()
+	})
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+
+			if n < stunHeaderSize || binary.BigEndian.Uint16(buf[0:2]) != stunBindingRequest {
+				continue
+			}
+
+			var txID [12]byte
+			copy(txID[:], buf[8:20])
+
+			_, _ = pc.WriteToUDPAddrPort(stunBindingResponse(txID, addr), addr)
+		}
+	}()
+
+	return pc.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+func stunBindingResponse(txID [12]byte, addr netip.AddrPort) []byte {
+	ip := addr.Addr().AsSlice()
+
+	family := byte(stunFamilyIPv4)
+	if addr.Addr().Is6() {
+		family = stunFamilyIPv6
+	}
+
+	header := make([]byte, stunHeaderSize)
+	binary.BigEndian.PutUint32(header[4:8], stunMagicCookie)
+	copy(header[8:20], txID[:])
+
+	value := []byte{0, family, 0, 0}
+	binary.BigEndian.PutUint16(value[2:4], addr.Port()^uint16(stunMagicCookie>>16))
+	for i := range ip {
+		value = append(value, ip[i]^header[4+i])
+	}
+
+	attr := make([]byte, 4, 4+len(value))
+	binary.BigEndian.PutUint16(attr[0:2], stunAttrXORMappedAddress)
+	binary.BigEndian.PutUint16(attr[2:4], uint16(len(value)))
+	attr = append(attr, value...)
+
+	binary.BigEndian.PutUint16(header[0:2], stunBindingSuccess)
+	binary.BigEndian.PutUint16(header[2:4], uint16(len(attr)))
+
+	return append(header, attr...)
+}
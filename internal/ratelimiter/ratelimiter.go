@@ -9,6 +9,7 @@ package ratelimiter
 import (
 	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,6 +21,15 @@ const (
 	maxTokens          = packetCost * packetsBurstable
 )
 
+const (
+	// DefaultPacketsPerSecond is the default number of packets allowed from
+	// each address per second.
+	DefaultPacketsPerSecond = packetsPerSecond
+	// DefaultPacketsBurstable is the default number of packets that can be
+	// sent from each address in a burst.
+	DefaultPacketsBurstable = packetsBurstable
+)
+
 type RatelimiterEntry struct {
 	mu       sync.Mutex
 	lastTime time.Time
@@ -32,6 +42,34 @@ type Ratelimiter struct {
 
 	stopReset chan struct{} // send to reset, close to stop
 	table     map[netip.Addr]*RatelimiterEntry
+
+	// packetCost, and maxTokens, override the default limits if set.
+	packetCost atomic.Int64
+	maxTokens  atomic.Int64
+}
+
+// SetLimit adjusts the number of packets allowed from each address per
+// second, and how many of them can be sent in a burst. Zero values are
+// replaced by the defaults.
+func (rate *Ratelimiter) SetLimit(packetsPerSecond, burst int) {
+	if packetsPerSecond <= 0 {
+		packetsPerSecond = DefaultPacketsPerSecond
+	}
+	if burst <= 0 {
+		burst = DefaultPacketsBurstable
+	}
+
+	cost := time.Second.Nanoseconds() / int64(packetsPerSecond)
+	rate.packetCost.Store(cost)
+	rate.maxTokens.Store(cost * int64(burst))
+}
+
+func (rate *Ratelimiter) limits() (cost, tokens int64) {
+	cost, tokens = rate.packetCost.Load(), rate.maxTokens.Load()
+	if cost == 0 {
+		return packetCost, maxTokens
+	}
+	return cost, tokens
 }
 
 func (rate *Ratelimiter) Close() error {
@@ -88,9 +126,16 @@ func (rate *Ratelimiter) cleanup() (empty bool) {
 	rate.mu.Lock()
 	defer rate.mu.Unlock()
 
+	// Entries can't be removed until their tokens have refilled, or the
+	// address would get a fresh burst.
+	expiry := garbageCollectTime
+	if _, tokens := rate.limits(); time.Duration(tokens) > expiry {
+		expiry = time.Duration(tokens)
+	}
+
 	for key, entry := range rate.table {
 		entry.mu.Lock()
-		if rate.timeNow().Sub(entry.lastTime) > garbageCollectTime {
+		if rate.timeNow().Sub(entry.lastTime) > expiry {
 			delete(rate.table, key)
 		}
 		entry.mu.Unlock()
@@ -100,6 +145,8 @@ func (rate *Ratelimiter) cleanup() (empty bool) {
 }
 
 func (rate *Ratelimiter) Allow(ip netip.Addr) bool {
+	packetCost, maxTokens := rate.limits()
+
 	var entry *RatelimiterEntry
 	// lookup entry
 	rate.mu.RLock()
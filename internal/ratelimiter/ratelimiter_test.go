@@ -122,3 +122,58 @@ func TestRatelimiter(t *testing.T) {
 		}
 	}
 }
+
+func TestRatelimiterSetLimit(t *testing.T) {
+	var rate Ratelimiter
+
+	now := time.Now()
+	rate.timeNow = func() time.Time {
+		return now
+	}
+	defer func() {
+		rate.mu.Lock()
+		defer rate.mu.Unlock()
+
+		rate.timeNow = time.Now
+	}()
+
+	rate.Init()
+	t.Cleanup(func() {
+		if err := rate.Close(); err != nil {
+			t.Fatalf("rate.Close()=%v, want nil", err)
+		}
+	})
+
+	rate.SetLimit(1, 3)
+
+	ip := netip.MustParseAddr("192.168.1.1")
+
+	// Like timeSleep above, tokens must exceed the cost of a packet.
+	allow := func() bool {
+		now = now.Add(1)
+		return rate.Allow(ip)
+	}
+
+	for i := 0; i < 3; i++ {
+		if !allow() {
+			t.Fatalf("%d: rate.Allow(%q)=false, want true", i, ip)
+		}
+	}
+
+	if allow() {
+		t.Fatalf("after burst: rate.Allow(%q)=true, want false", ip)
+	}
+
+	// The entry must survive garbage collection until its tokens have
+	// refilled, otherwise the address would get a fresh burst.
+	now = now.Add(time.Second)
+	rate.cleanup()
+
+	if !allow() {
+		t.Fatalf("after refill: rate.Allow(%q)=false, want true", ip)
+	}
+
+	if allow() {
+		t.Fatalf("after single refill: rate.Allow(%q)=true, want false", ip)
+	}
+}
@@ -61,3 +61,20 @@ func (f *Filter) ValidateCounter(counter, limit uint64) bool {
 	f.ring[indexBlock] = new
 	return old != new
 }
+
+// Restore resets the filter to the state of having received every counter up
+// to, and including, last. Such that, once restored (eg. after a restart),
+// nothing that may have been received before can be replayed.
+func (f *Filter) Restore(last uint64) {
+	f.last = last
+	for i := range f.ring {
+		f.ring[i] = ^block(0)
+	}
+	// Counters after last, in its block, are yet to be received.
+	f.ring[(last>>blockBitLog)&blockMask] = ^block(0) >> (bitMask - last&bitMask)
+}
+
+// Last returns the highest counter accepted by the filter.
+func (f *Filter) Last() uint64 {
+	return f.last
+}
@@ -118,3 +118,31 @@ func TestReplay(t *testing.T) {
 	T(0, true)
 	T(windowSize+1, true)
 }
+
+func TestRestore(t *testing.T) {
+	var filter Filter
+
+	for _, last := range []uint64{0, 62, 63, 64, windowSize + 100} {
+		filter.Restore(last)
+
+		if filter.Last() != last {
+			t.Fatal("Restored filter has last", filter.Last(), "want", last)
+		}
+
+		for n := uint64(0); n <= last; n++ {
+			if filter.ValidateCounter(n, RejectAfterMessages) {
+				t.Fatal("Counter", n, "accepted after restoring", last)
+			}
+		}
+
+		if !filter.ValidateCounter(last+1, RejectAfterMessages) {
+			t.Fatal("Counter", last+1, "rejected after restoring", last)
+		}
+		if !filter.ValidateCounter(last+3, RejectAfterMessages) {
+			t.Fatal("Counter", last+3, "rejected after restoring", last)
+		}
+		if !filter.ValidateCounter(last+2, RejectAfterMessages) {
+			t.Fatal("Counter", last+2, "rejected after restoring", last)
+		}
+	}
+}
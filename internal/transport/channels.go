@@ -136,3 +136,21 @@ func (transport *Transport) flushOutboundQueue(q *autodrainingOutboundQueue) {
 		}
 	}
 }
+
+// QueueDepths is the number of elements waiting in each of the transport's
+// shared queues.
+type QueueDepths struct {
+	Encryption int
+	Decryption int
+	Handshake  int
+}
+
+// QueueDepths returns the number of elements currently waiting in each of the
+// transport's shared queues.
+func (transport *Transport) QueueDepths() QueueDepths {
+	return QueueDepths{
+		Encryption: len(transport.queue.encryption.c),
+		Decryption: len(transport.queue.decryption.c),
+		Handshake:  len(transport.queue.handshake.c),
+	}
+}
@@ -0,0 +1,172 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (c) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package transport
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/klauspost/compress/snappy"
+)
+
+// Packets are only compressed once both peers have agreed to it. Each peer
+// with compression enabled sends a hello, whenever a new session is
+// established, and packets sent using a session's keypair are only compressed
+// once the remote peer's hello has been received with it. Hellos, and
+// compressed packets, are control packets.
+const (
+	// compressionHelloType is the first byte of a hello, it is followed by a
+	// bitmask of the algorithms the sender can decompress.
+	compressionHelloType = 0x10
+	// compressionSnappyType is the first byte of a compressed packet, it is
+	// followed by the big endian length of the compressed data (as packets are
+	// padded), and then the data itself.
+	compressionSnappyType = 0x11
+
+	compressionHelloSize       = 2
+	compressedPacketHeaderSize = 3
+	compressionSnappy          = 1 << 0
+	compressionMinPacketSize   = 64
+)
+
+// Compression algorithms.
+const (
+	// CompressionNone disables compression.
+	CompressionNone = ""
+	// CompressionSnappy compresses packets using snappy.
+	CompressionSnappy = "snappy"
+)
+
+// ParseCompression checks that an algorithm is supported.
+func ParseCompression(algorithm string) (string, error) {
+	switch algorithm {
+	case CompressionNone, "none":
+		return CompressionNone, nil
+	case CompressionSnappy:
+		return CompressionSnappy, nil
+	default:
+		return "", fmt.Errorf("unsupported compression algorithm %q", algorithm)
+	}
+}
+
+// SetCompression sets the algorithm used to compress packets sent to the peer,
+// or CompressionNone to disable compression. Changes take effect from the next
+// handshake.
+func (peer *Peer) SetCompression(algorithm string) error {
+	algorithm, err := ParseCompression(algorithm)
+	if err != nil {
+		return err
+	}
+
+	peer.compression.Store(algorithm == CompressionSnappy)
+
+	return nil
+}
+
+// sendCompressionHello tells the peer that it can compress the packets it
+// sends using the current session, if compression is enabled.
+func (peer *Peer) sendCompressionHello() error {
+	if !peer.compression.Load() || !peer.isRunning.Load() {
+		return nil
+	}
+
+	peer.transport.log.Debug("Sending compression hello", "peer", peer)
+
+	return peer.sendControlPacket([]byte{compressionHelloType, compressionSnappy})
+}
+
+// receivedCompressionHello handles a hello from the peer.
+func (peer *Peer) receivedCompressionHello(keypair *Keypair, packet []byte) {
+	if len(packet) < compressionHelloSize {
+		return
+	}
+
+	if peer.compression.Load() && packet[1]&compressionSnappy != 0 {
+		peer.transport.log.Debug("Received compression hello", "peer", peer)
+		keypair.remoteCompression.Store(true)
+	}
+}
+
+// compressPacket compresses an outbound packet in place, if it is worth doing,
+// using scratch (of at least snappy.MaxEncodedLen(MaxContentSize) bytes), and
+// returns the packet to send.
+func compressPacket(packet, scratch []byte) []byte {
+	// Only IP packets are compressed, not keepalives or control packets.
+	if len(packet) < compressionMinPacketSize || (packet[0]>>4 != 4 && packet[0]>>4 != 6) {
+		return packet
+	}
+
+	compressed := snappy.Encode(scratch, packet)
+	if len(compressed)+compressedPacketHeaderSize >= len(packet) {
+		return packet
+	}
+
+	packet[0] = compressionSnappyType
+	binary.BigEndian.PutUint16(packet[1:], uint16(len(compressed)))
+	n := copy(packet[compressedPacketHeaderSize:], compressed)
+
+	return packet[:compressedPacketHeaderSize+n]
+}
+
+// isCompressedPacket returns whether an inbound packet is compressed.
+func isCompressedPacket(packet []byte) bool {
+	return len(packet) > 0 && packet[0] == compressionSnappyType
+}
+
+// decompressedPacketLen returns the size of a compressed packet once it has
+// been decompressed.
+func decompressedPacketLen(packet []byte) (int, error) {
+	compressed, err := compressedPacketData(packet)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := snappy.DecodedLen(compressed)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decompress packet: %w", err)
+	}
+
+	if n > MaxContentSize {
+		return 0, fmt.Errorf("decompressed packet too large: %d bytes", n)
+	}
+
+	return n, nil
+}
+
+// decompressPacket decompresses a packet into dst, which must be exactly the
+// size returned by decompressedPacketLen.
+func decompressPacket(dst, packet []byte) ([]byte, error) {
+	compressed, err := compressedPacketData(packet)
+	if err != nil {
+		return nil, err
+	}
+
+	decompressed, err := snappy.Decode(dst, compressed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress packet: %w", err)
+	}
+
+	return decompressed, nil
+}
+
+// compressedPacketSize returns the size of a valid compressed packet, without
+// any padding.
+func compressedPacketSize(packet []byte) int {
+	return compressedPacketHeaderSize + int(binary.BigEndian.Uint16(packet[1:]))
+}
+
+func compressedPacketData(packet []byte) ([]byte, error) {
+	if len(packet) < compressedPacketHeaderSize {
+		return nil, fmt.Errorf("compressed packet too short")
+	}
+
+	n := int(binary.BigEndian.Uint16(packet[1:]))
+	if n > len(packet)-compressedPacketHeaderSize {
+		return nil, fmt.Errorf("compressed packet truncated")
+	}
+
+	return packet[compressedPacketHeaderSize : compressedPacketHeaderSize+n], nil
+}
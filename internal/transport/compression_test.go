@@ -0,0 +1,66 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (c) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package transport
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressPacket(t *testing.T) {
+	scratch := make([]byte, snappy.MaxEncodedLen(MaxContentSize))
+
+	t.Run("Compressible", func(t *testing.T) {
+		packet := append([]byte{0x45}, bytes.Repeat([]byte{0xaa}, 1000)...)
+		original := bytes.Clone(packet)
+
+		compressed := compressPacket(packet, scratch)
+		require.Less(t, len(compressed), len(original))
+		require.True(t, isCompressedPacket(compressed))
+
+		// With padding, as it would be received.
+		padded := append(compressed, make([]byte, calculatePaddingSize(len(compressed), 0))...)
+
+		n, err := decompressedPacketLen(padded)
+		require.NoError(t, err)
+
+		decompressed, err := decompressPacket(make([]byte, n), padded)
+		require.NoError(t, err)
+		require.Equal(t, original, decompressed)
+	})
+
+	t.Run("Incompressible", func(t *testing.T) {
+		packet := make([]byte, 1000)
+		_, err := rand.Read(packet)
+		require.NoError(t, err)
+		packet[0] = 0x60
+
+		original := bytes.Clone(packet)
+		require.Equal(t, original, compressPacket(packet, scratch))
+	})
+
+	t.Run("Not IP", func(t *testing.T) {
+		hello := []byte{compressionHelloType, compressionSnappy}
+		require.Equal(t, []byte{compressionHelloType, compressionSnappy}, compressPacket(hello, scratch))
+	})
+
+	t.Run("Truncated", func(t *testing.T) {
+		_, err := decompressedPacketLen([]byte{compressionSnappyType, 0x10, 0x00, 0x01})
+		require.Error(t, err)
+	})
+
+	t.Run("Too Large", func(t *testing.T) {
+		compressed := snappy.Encode(nil, make([]byte, MaxContentSize+1))
+		packet := append([]byte{compressionSnappyType, byte(len(compressed) >> 8), byte(len(compressed))}, compressed...)
+
+		_, err := decompressedPacketLen(packet)
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,52 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (c) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package transport
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Changes to any of these values will break compatibility with stock
+// WireGuard implementations, see: https://www.wireguard.com/papers/wireguard.pdf
+func TestWireGuardConformance(t *testing.T) {
+	t.Run("Protocol", func(t *testing.T) {
+		require.Equal(t, "Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s", NoiseConstruction)
+		require.Equal(t, "WireGuard v1 zx2c4 Jason@zx2c4.com", NoiseIdentifier)
+		require.Equal(t, "mac1----", NoiseLabelMAC1)
+		require.Equal(t, "cookie--", NoiseLabelCookie)
+	})
+
+	t.Run("Messages", func(t *testing.T) {
+		require.Equal(t, 1, MessageInitiationType)
+		require.Equal(t, 2, MessageResponseType)
+		require.Equal(t, 3, MessageCookieReplyType)
+		require.Equal(t, 4, MessageTransportType)
+
+		require.Equal(t, 148, MessageInitiationSize)
+		require.Equal(t, MessageInitiationSize, binary.Size(MessageInitiation{}))
+		require.Equal(t, 92, MessageResponseSize)
+		require.Equal(t, MessageResponseSize, binary.Size(MessageResponse{}))
+		require.Equal(t, 64, MessageCookieReplySize)
+		require.Equal(t, MessageCookieReplySize, binary.Size(MessageCookieReply{}))
+		require.Equal(t, 32, MessageKeepaliveSize)
+		require.Equal(t, 16, PaddingMultiple)
+	})
+
+	t.Run("Timers", func(t *testing.T) {
+		require.Equal(t, uint64(1<<60), uint64(RekeyAfterMessages))
+		require.Equal(t, uint64((1<<64)-(1<<13)-1), uint64(RejectAfterMessages))
+		require.Equal(t, 120*time.Second, RekeyAfterTime)
+		require.Equal(t, 180*time.Second, RejectAfterTime)
+		require.Equal(t, 90*time.Second, RekeyAttemptTime)
+		require.Equal(t, 5*time.Second, RekeyTimeout)
+		require.Equal(t, 10*time.Second, KeepaliveTimeout)
+		require.Equal(t, 120*time.Second, CookieRefreshTime)
+	})
+}
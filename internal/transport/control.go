@@ -0,0 +1,72 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (c) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package transport
+
+import "fmt"
+
+// Control packets are exchanged, through the tunnel, between peers that both
+// support an extension (eg. compression). They start with a version nibble of
+// 1, so that they can't be mistaken for IP packets (and are dropped by peers
+// that don't understand them, eg. other WireGuard implementations).
+
+// isControlPacket returns whether a decrypted packet is a control packet.
+func isControlPacket(packet []byte) bool {
+	return len(packet) > 0 && packet[0]>>4 == 1
+}
+
+// receivedControlPacket handles a control packet from the peer. Control
+// packets are never written to the source sink, even if they aren't
+// understood.
+func (peer *Peer) receivedControlPacket(keypair *Keypair, packet []byte) {
+	switch packet[0] {
+	case compressionHelloType:
+		peer.receivedCompressionHello(keypair, packet)
+	case kemEncapsulationKeyType:
+		peer.receivedKEMEncapsulationKey(packet)
+	case kemCiphertextType:
+		peer.receivedKEMCiphertext(packet)
+	case kemConfirmType:
+		peer.receivedKEMConfirm(packet)
+	default:
+		peer.transport.log.Debug("Received unknown control packet", "peer", peer, "type", packet[0])
+	}
+}
+
+// sendControlPacket sends a control packet to the peer, using the current
+// session.
+func (peer *Peer) sendControlPacket(packet []byte) error {
+	if !peer.isRunning.Load() {
+		return nil
+	}
+
+	elem := peer.transport.NewOutboundElement()
+	elem.packet = elem.buffer[MessageTransportHeaderSize : MessageTransportHeaderSize+copy(elem.buffer[MessageTransportHeaderSize:], packet)]
+
+	elemsContainer := peer.transport.GetOutboundElementsContainer()
+	elemsContainer.elems = append(elemsContainer.elems, elem)
+	peer.StagePackets(elemsContainer)
+
+	return peer.SendStagedPackets()
+}
+
+// sessionEstablished is called once a new session with the peer has been
+// established, to tell the peer about the extensions that are enabled.
+func (peer *Peer) sessionEstablished() error {
+	keypair := peer.keypairs.Current()
+	if keypair == nil {
+		return nil
+	}
+
+	if err := peer.sendCompressionHello(); err != nil {
+		return fmt.Errorf("failed to send compression hello: %w", err)
+	}
+
+	if err := peer.postQuantumSessionEstablished(keypair); err != nil {
+		return fmt.Errorf("failed to exchange post-quantum key: %w", err)
+	}
+
+	return nil
+}
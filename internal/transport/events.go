@@ -0,0 +1,85 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (c) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package transport
+
+import (
+	"github.com/noisysockets/noisysockets/internal/conn"
+)
+
+// PeerEventType is the type of a change in the state of a peer.
+type PeerEventType int
+
+const (
+	// PeerEventHandshakeCompleted is a handshake with the peer completing.
+	PeerEventHandshakeCompleted PeerEventType = iota
+	// PeerEventUnreachable is giving up on a handshake with the peer, after it
+	// failed to complete multiple times.
+	PeerEventUnreachable
+	// PeerEventEndpointChanged is packets starting to be sent to a different
+	// endpoint of the peer (eg. it has roamed, or is now reached via the relay).
+	PeerEventEndpointChanged
+	// PeerEventHandshakeInitiated is a handshake initiation being sent to the
+	// peer, including retries.
+	PeerEventHandshakeInitiated
+)
+
+// PeerEvent is a change in the state of a peer.
+type PeerEvent struct {
+	Type PeerEventType
+	// PublicKey is the public key of the peer.
+	PublicKey NoisePublicKey
+	// Endpoint is the endpoint packets are currently sent to, if any.
+	Endpoint string
+}
+
+// SetPeerEventHandler sets a handler that will be invoked with changes in the
+// state of peers. It is invoked synchronously, so it must be fast and safe for
+// concurrent use. A nil handler disables events.
+func (transport *Transport) SetPeerEventHandler(handler func(PeerEvent)) {
+	if handler == nil {
+		transport.peerEvents.Store(nil)
+		return
+	}
+
+	transport.peerEvents.Store(&handler)
+}
+
+func (peer *Peer) emitEvent(typ PeerEventType, endpoint conn.Endpoint) {
+	handler := peer.transport.peerEvents.Load()
+	if handler == nil {
+		return
+	}
+
+	ev := PeerEvent{Type: typ, PublicKey: peer.pk}
+	if endpoint != nil {
+		ev.Endpoint = endpoint.DstToString()
+	}
+
+	(*handler)(ev)
+}
+
+// currentEndpoint returns the endpoint packets are currently sent to.
+func (peer *Peer) currentEndpoint() conn.Endpoint {
+	peer.endpoint.Lock()
+	defer peer.endpoint.Unlock()
+
+	return peer.endpoint.val
+}
+
+// sameEndpoint reports whether two endpoints have the same destination.
+func sameEndpoint(a, b conn.Endpoint) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	// Avoid formatting the addresses of every received packet.
+	if a, ok := a.(*conn.StdNetEndpoint); ok {
+		b, ok := b.(*conn.StdNetEndpoint)
+		return ok && a.AddrPort == b.AddrPort
+	}
+
+	return a.DstToString() == b.DstToString()
+}
@@ -0,0 +1,167 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (c) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net/netip"
+	"testing"
+
+	"github.com/noisysockets/noisysockets/internal/conn"
+	"github.com/stretchr/testify/require"
+)
+
+// Messages from a hostile peer reach these paths before they are
+// authenticated, so they must never panic, whatever they contain.
+
+func FuzzMessageType(f *testing.F) {
+	_, _, seeds := newFuzzTransport(f)
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		msgType, err := messageType(packet)
+		if err != nil {
+			require.True(t, errors.Is(err, errUnknownMessageType) || errors.Is(err, errInvalidMessageSize))
+			return
+		}
+
+		switch msgType {
+		case MessageInitiationType:
+			require.Len(t, packet, MessageInitiationSize)
+		case MessageResponseType:
+			require.Len(t, packet, MessageResponseSize)
+		case MessageCookieReplyType:
+			require.Len(t, packet, MessageCookieReplySize)
+		case MessageTransportType:
+			require.GreaterOrEqual(t, len(packet), MessageTransportSize)
+		default:
+			t.Fatalf("unknown message type %d was accepted", msgType)
+		}
+	})
+}
+
+func FuzzHandshakeMessages(f *testing.F) {
+	transport, peer, seeds := newFuzzTransport(f)
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+
+	src := netip.MustParseAddr("192.0.2.1").AsSlice()
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		_ = transport.IsAddressedTo(packet)
+
+		msgType, err := messageType(packet)
+		if err != nil {
+			return
+		}
+
+		switch msgType {
+		case MessageInitiationType:
+			if cookieChecker := transport.cookieCheckerForMAC1(packet); cookieChecker != nil {
+				_ = cookieChecker.CheckMAC2(packet, src)
+			}
+
+			var msg MessageInitiation
+			require.NoError(t, binary.Read(bytes.NewReader(packet), binary.LittleEndian, &msg))
+			_ = transport.ConsumeMessageInitiation(&msg)
+		case MessageResponseType:
+			if cookieChecker := transport.cookieCheckerForMAC1(packet); cookieChecker != nil {
+				_ = cookieChecker.CheckMAC2(packet, src)
+			}
+
+			var msg MessageResponse
+			require.NoError(t, binary.Read(bytes.NewReader(packet), binary.LittleEndian, &msg))
+			_ = transport.ConsumeMessageResponse(&msg)
+		case MessageCookieReplyType:
+			var reply MessageCookieReply
+			require.NoError(t, binary.Read(bytes.NewReader(packet), binary.LittleEndian, &reply))
+			_ = peer.cookieGenerator.ConsumeReply(&reply)
+		}
+	})
+}
+
+// newFuzzTransport creates a transport with a single peer, that logs nothing
+// (logging every rejected message would slow fuzzing to a crawl). It also
+// returns a well formed message of each type from the peer, so that fuzzing
+// starts from messages that get past the size, and mac1, checks.
+func newFuzzTransport(f *testing.F) (*Transport, *Peer, [][]byte) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	newTransport := func() *Transport {
+		sk, err := NewPrivateKey()
+		require.NoError(f, err)
+
+		transport := NewTransport(&discardingSink{}, conn.NewStdNetBind(), logger)
+		transport.SetPrivateKey(sk)
+		f.Cleanup(func() {
+			require.NoError(f, transport.Close())
+		})
+
+		return transport
+	}
+
+	transport := newTransport()
+	remote := newTransport()
+
+	peer, err := transport.NewPeer(remote.staticIdentity.privateKey.PublicKey())
+	require.NoError(f, err)
+
+	remotePeer, err := remote.NewPeer(transport.staticIdentity.privateKey.PublicKey())
+	require.NoError(f, err)
+
+	// Messages from peers that aren't running are ignored.
+	peer.Start()
+	remotePeer.Start()
+
+	marshal := func(msg any) []byte {
+		var buf bytes.Buffer
+		require.NoError(f, binary.Write(&buf, binary.LittleEndian, msg))
+		return buf.Bytes()
+	}
+
+	initiation, err := remote.CreateMessageInitiation(remotePeer)
+	require.NoError(f, err)
+	initiationPacket := marshal(initiation)
+	remotePeer.cookieGenerator.AddMacs(initiationPacket)
+
+	// A response, and a cookie reply, to an initiation of our own.
+	ourInitiation, err := transport.CreateMessageInitiation(peer)
+	require.NoError(f, err)
+	ourInitiationPacket := marshal(ourInitiation)
+	peer.cookieGenerator.AddMacs(ourInitiationPacket)
+
+	require.NotNil(f, remote.ConsumeMessageInitiation(ourInitiation))
+
+	response, err := remote.CreateMessageResponse(remotePeer)
+	require.NoError(f, err)
+	responsePacket := marshal(response)
+	remotePeer.cookieGenerator.AddMacs(responsePacket)
+
+	cookieReply, err := remote.cookieChecker.CreateReply(ourInitiationPacket, ourInitiation.Sender,
+		netip.MustParseAddr("192.0.2.1").AsSlice())
+	require.NoError(f, err)
+
+	keepalive := make([]byte, MessageKeepaliveSize)
+	binary.LittleEndian.PutUint32(keepalive, MessageTransportType)
+	binary.LittleEndian.PutUint32(keepalive[MessageTransportOffsetReceiver:], ourInitiation.Sender)
+
+	return transport, peer, [][]byte{
+		nil,
+		{0x01, 0x00, 0x00, 0x00},
+		initiationPacket,
+		responsePacket,
+		marshal(cookieReply),
+		keepalive,
+		bytes.Repeat([]byte{0xff}, MessageInitiationSize),
+	}
+}
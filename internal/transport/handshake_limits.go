@@ -0,0 +1,138 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (c) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package transport
+
+import (
+	"fmt"
+
+	"github.com/noisysockets/noisysockets/internal/ratelimiter"
+)
+
+// HandshakeLimits control how a responder protects itself against floods of
+// handshake messages (eg. a public facing gateway). Zero values are the
+// defaults of the WireGuard implementation.
+type HandshakeLimits struct {
+	// AlwaysRequireCookie replies with a cookie to every handshake message
+	// that doesn't carry a valid one, rather than only when under load. This
+	// costs initiators an extra round trip, but proves that they own their
+	// source address before any handshake is processed.
+	AlwaysRequireCookie bool
+	// UnderLoadThreshold is the number of queued handshake messages at which
+	// the transport is considered under load.
+	UnderLoadThreshold int
+	// PerSourceRate is the number of handshake messages per second accepted
+	// from each source address, when cookies are required.
+	PerSourceRate int
+	// PerSourceBurst is the number of handshake messages from each source
+	// address that can be accepted in a burst, when cookies are required.
+	PerSourceBurst int
+	// MaxConcurrent is the number of handshake messages that can be queued, or
+	// be processed, at once. Any more are dropped.
+	MaxConcurrent int
+}
+
+// DefaultHandshakeLimits returns the handshake limits of the WireGuard
+// implementation.
+func DefaultHandshakeLimits() HandshakeLimits {
+	return HandshakeLimits{
+		UnderLoadThreshold: QueueHandshakeSize / 8,
+		PerSourceRate:      ratelimiter.DefaultPacketsPerSecond,
+		PerSourceBurst:     ratelimiter.DefaultPacketsBurstable,
+		MaxConcurrent:      QueueHandshakeSize,
+	}
+}
+
+// SetHandshakeLimits adjusts the protection against handshake floods, zero
+// values are replaced by their defaults. The under load threshold, and the
+// maximum number of concurrent handshakes, can't exceed the size of the
+// handshake queue.
+func (transport *Transport) SetHandshakeLimits(limits HandshakeLimits) error {
+	if limits.UnderLoadThreshold < 0 || limits.PerSourceRate < 0 || limits.PerSourceBurst < 0 || limits.MaxConcurrent < 0 {
+		return fmt.Errorf("handshake limits must not be negative")
+	}
+
+	defaults := DefaultHandshakeLimits()
+	if limits.UnderLoadThreshold == 0 {
+		limits.UnderLoadThreshold = defaults.UnderLoadThreshold
+	}
+	if limits.PerSourceRate == 0 {
+		limits.PerSourceRate = defaults.PerSourceRate
+	}
+	if limits.PerSourceBurst == 0 {
+		limits.PerSourceBurst = defaults.PerSourceBurst
+	}
+	if limits.MaxConcurrent == 0 {
+		limits.MaxConcurrent = defaults.MaxConcurrent
+	}
+
+	if limits.UnderLoadThreshold > QueueHandshakeSize {
+		return fmt.Errorf("under load threshold must not exceed %d", QueueHandshakeSize)
+	}
+
+	if limits.MaxConcurrent > QueueHandshakeSize {
+		return fmt.Errorf("maximum concurrent handshakes must not exceed %d", QueueHandshakeSize)
+	}
+
+	transport.rate.limiter.SetLimit(limits.PerSourceRate, limits.PerSourceBurst)
+	transport.rate.limits.Store(&limits)
+
+	return nil
+}
+
+// HandshakeLimits returns the current protection against handshake floods.
+func (transport *Transport) HandshakeLimits() HandshakeLimits {
+	if limits := transport.rate.limits.Load(); limits != nil {
+		return *limits
+	}
+
+	return DefaultHandshakeLimits()
+}
+
+// HandshakeStats contains counters for the protection against handshake
+// floods. All counters are cumulative since the transport was created.
+type HandshakeStats struct {
+	// CookieReplies is the number of cookie replies sent to handshake
+	// messages without a valid cookie.
+	CookieReplies uint64
+	// RateLimited is the number of handshake messages dropped for exceeding
+	// the per source rate limit.
+	RateLimited uint64
+	// ConcurrencyLimited is the number of handshake messages dropped as too
+	// many were already queued, or being processed.
+	ConcurrencyLimited uint64
+}
+
+// HandshakeStats returns a snapshot of the handshake flood protection
+// counters.
+func (transport *Transport) HandshakeStats() HandshakeStats {
+	return HandshakeStats{
+		CookieReplies:      transport.rate.cookieReplies.Load(),
+		RateLimited:        transport.rate.rateLimited.Load(),
+		ConcurrencyLimited: transport.rate.concurrencyLimited.Load(),
+	}
+}
+
+// acquireHandshake reserves a slot for a handshake message, it reports false
+// if the maximum number of concurrent handshakes has been reached.
+func (transport *Transport) acquireHandshake() bool {
+	if transport.rate.pending.Add(1) > int32(transport.HandshakeLimits().MaxConcurrent) {
+		transport.releaseHandshake()
+		transport.rate.concurrencyLimited.Add(1)
+		return false
+	}
+
+	return true
+}
+
+// releaseHandshake releases a slot reserved by acquireHandshake.
+func (transport *Transport) releaseHandshake() {
+	transport.rate.pending.Add(-1)
+}
+
+// requireCookie reports whether handshake messages must carry a valid cookie.
+func (transport *Transport) requireCookie() bool {
+	return transport.HandshakeLimits().AlwaysRequireCookie || transport.IsUnderLoad()
+}
@@ -97,3 +97,18 @@ func (table *IndexTable) Lookup(id uint32) IndexTableEntry {
 	defer table.RUnlock()
 	return table.table[id]
 }
+
+// InsertKeypair adds a keypair under a given index (eg. of a restored
+// session), it returns false if the index is already in use.
+func (table *IndexTable) InsertKeypair(index uint32, peer *Peer, keypair *Keypair) bool {
+	table.Lock()
+	defer table.Unlock()
+	if _, found := table.table[index]; found {
+		return false
+	}
+	table.table[index] = IndexTableEntry{
+		peer:    peer,
+		keypair: keypair,
+	}
+	return true
+}
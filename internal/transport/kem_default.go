@@ -0,0 +1,29 @@
+//go:build !go1.24
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (c) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package transport
+
+// ML-KEM is only available in the standard library from Go 1.24.
+const (
+	kemEncapsulationKeySize = 1184
+	kemCiphertextSize       = 1088
+	kemSupported            = false
+)
+
+type kemDecapsulationKey struct{}
+
+func newKEMKey() (*kemDecapsulationKey, []byte, error) {
+	return nil, nil, errKEMUnsupported
+}
+
+func kemEncapsulate(_ []byte) ([]byte, []byte, error) {
+	return nil, nil, errKEMUnsupported
+}
+
+func kemDecapsulate(_ *kemDecapsulationKey, _ []byte) ([]byte, error) {
+	return nil, errKEMUnsupported
+}
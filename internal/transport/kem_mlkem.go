@@ -0,0 +1,47 @@
+//go:build go1.24
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (c) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package transport
+
+import "crypto/mlkem"
+
+const (
+	kemEncapsulationKeySize = mlkem.EncapsulationKeySize768
+	kemCiphertextSize       = mlkem.CiphertextSize768
+	kemSupported            = true
+)
+
+// kemDecapsulationKey is the private half of an ML-KEM-768 key pair.
+type kemDecapsulationKey = mlkem.DecapsulationKey768
+
+// newKEMKey generates a new ML-KEM-768 key pair, and returns it along with
+// its encoded encapsulation (public) key.
+func newKEMKey() (*kemDecapsulationKey, []byte, error) {
+	dk, err := mlkem.GenerateKey768()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return dk, dk.EncapsulationKey().Bytes(), nil
+}
+
+// kemEncapsulate generates a shared secret, and its ciphertext, for the holder
+// of the encoded encapsulation key.
+func kemEncapsulate(encapsulationKey []byte) (sharedSecret, ciphertext []byte, err error) {
+	ek, err := mlkem.NewEncapsulationKey768(encapsulationKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sharedSecret, ciphertext = ek.Encapsulate()
+	return sharedSecret, ciphertext, nil
+}
+
+// kemDecapsulate recovers the shared secret from its ciphertext.
+func kemDecapsulate(dk *kemDecapsulationKey, ciphertext []byte) ([]byte, error) {
+	return dk.Decapsulate(ciphertext)
+}
@@ -31,6 +31,15 @@ type Keypair struct {
 	created      time.Time
 	localIndex   uint32
 	remoteIndex  uint32
+	// remoteCompression is set once the peer has said that it can decompress
+	// packets sent using the keypair.
+	remoteCompression atomic.Bool
+	// postQuantumID identifies the post-quantum shared secret mixed into the
+	// handshake of the keypair, if any.
+	postQuantumID kemExchangeID
+	// keys are the keypair's keys, only retained if sessions can be saved
+	// (see RetainSessions).
+	keys *sessionKeys
 }
 
 type Keypairs struct {
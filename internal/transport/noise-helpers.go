@@ -89,6 +89,11 @@ func NewPrivateKey() (sk NoisePrivateKey, err error) {
 	return
 }
 
+func NewPresharedKey() (psk NoisePresharedKey, err error) {
+	_, err = rand.Read(psk[:])
+	return
+}
+
 func (sk *NoisePrivateKey) PublicKey() (pk NoisePublicKey) {
 	apk := (*[NoisePublicKeySize]byte)(&pk)
 	ask := (*[NoisePrivateKeySize]byte)(sk)
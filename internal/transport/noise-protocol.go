@@ -132,6 +132,8 @@ type Handshake struct {
 	lastTimestamp             tai64n.Timestamp
 	lastInitiationConsumption time.Time
 	lastSentHandshake         time.Time
+	presharedKeyID            kemExchangeID // post-quantum shared secret mixed into the psk
+	postQuantum               postQuantumState
 }
 
 var (
@@ -259,22 +261,32 @@ func (transport *Transport) ConsumeMessageInitiation(msg *MessageInitiation) *Pe
 	transport.staticIdentity.RLock()
 	defer transport.staticIdentity.RUnlock()
 
-	mixHash(&hash, &InitialHash, transport.staticIdentity.publicKey[:])
-	mixHash(&hash, &hash, msg.Ephemeral[:])
-	mixKey(&chainKey, &InitialChainKey, msg.Ephemeral[:])
-
 	// decrypt static key
 	var peerPK NoisePublicKey
 	var key [chacha20poly1305.KeySize]byte
-	ss, err := transport.staticIdentity.privateKey.sharedSecret(msg.Ephemeral)
-	if err != nil {
-		return nil
+	openStatic := func(sk *NoisePrivateKey, pk *NoisePublicKey) bool {
+		mixHash(&hash, &InitialHash, pk[:])
+		mixHash(&hash, &hash, msg.Ephemeral[:])
+		mixKey(&chainKey, &InitialChainKey, msg.Ephemeral[:])
+
+		ss, err := sk.sharedSecret(msg.Ephemeral)
+		if err != nil {
+			return false
+		}
+		KDF2(&chainKey, &key, chainKey[:], ss[:])
+		aead, _ := chacha20poly1305.New(key[:])
+		_, err = aead.Open(peerPK[:0], ZeroNonce[:], msg.Static[:], hash[:])
+		return err == nil
 	}
-	KDF2(&chainKey, &key, chainKey[:], ss[:])
-	aead, _ := chacha20poly1305.New(key[:])
-	_, err = aead.Open(peerPK[:0], ZeroNonce[:], msg.Static[:], hash[:])
-	if err != nil {
-		return nil
+
+	// peers might not have learned of a key rotation yet
+	var previous bool
+	if !openStatic(&transport.staticIdentity.privateKey, &transport.staticIdentity.publicKey) {
+		if !transport.previousStaticIdentityValidLocked() ||
+			!openStatic(&transport.staticIdentity.previous.privateKey, &transport.staticIdentity.previous.publicKey) {
+			return nil
+		}
+		previous = true
 	}
 	mixHash(&hash, &hash, msg.Static[:])
 
@@ -291,9 +303,20 @@ func (transport *Transport) ConsumeMessageInitiation(msg *MessageInitiation) *Pe
 
 	var timestamp tai64n.Timestamp
 
+	var previousStaticStatic [NoisePublicKeySize]byte
+	if previous {
+		previousStaticStatic, _ = transport.staticIdentity.previous.privateKey.sharedSecret(peerPK)
+		defer setZero(previousStaticStatic[:])
+	}
+
 	handshake.mutex.RLock()
 
-	if isZero(handshake.precomputedStaticStatic[:]) {
+	staticStatic := &handshake.precomputedStaticStatic
+	if previous {
+		staticStatic = &previousStaticStatic
+	}
+
+	if isZero(staticStatic[:]) {
 		handshake.mutex.RUnlock()
 		return nil
 	}
@@ -301,10 +324,10 @@ func (transport *Transport) ConsumeMessageInitiation(msg *MessageInitiation) *Pe
 		&chainKey,
 		&key,
 		chainKey[:],
-		handshake.precomputedStaticStatic[:],
+		staticStatic[:],
 	)
-	aead, _ = chacha20poly1305.New(key[:])
-	_, err = aead.Open(timestamp[:0], ZeroNonce[:], msg.Timestamp[:], hash[:])
+	aead, _ := chacha20poly1305.New(key[:])
+	_, err := aead.Open(timestamp[:0], ZeroNonce[:], msg.Timestamp[:], hash[:])
 	if err != nil {
 		handshake.mutex.RUnlock()
 		return nil
@@ -314,7 +337,7 @@ func (transport *Transport) ConsumeMessageInitiation(msg *MessageInitiation) *Pe
 	// protect against replay & flood
 
 	replay := !timestamp.After(handshake.lastTimestamp)
-	flood := time.Since(handshake.lastInitiationConsumption) <= HandshakeInitationRate
+	flood := transport.since(handshake.lastInitiationConsumption) <= HandshakeInitationRate
 	handshake.mutex.RUnlock()
 	if replay {
 		transport.log.Debug("ConsumeMessageInitiation: handshake replay", "peer", peer)
@@ -336,7 +359,7 @@ func (transport *Transport) ConsumeMessageInitiation(msg *MessageInitiation) *Pe
 	if timestamp.After(handshake.lastTimestamp) {
 		handshake.lastTimestamp = timestamp
 	}
-	now := time.Now()
+	now := transport.clock.Now()
 	if now.After(handshake.lastInitiationConsumption) {
 		handshake.lastInitiationConsumption = now
 	}
@@ -394,7 +417,13 @@ func (transport *Transport) CreateMessageResponse(peer *Peer) (*MessageResponse,
 	}
 	handshake.mixKey(ss[:])
 
-	// add preshared key
+	// add preshared key, trying a different candidate until a session is
+	// established
+
+	candidates := handshake.presharedKeyCandidates()
+	candidate := candidates[handshake.postQuantum.unconfirmedResponses%len(candidates)]
+	handshake.postQuantum.unconfirmedResponses++
+	handshake.presharedKeyID = candidate.id
 
 	var tau [blake2s.Size]byte
 	var key [chacha20poly1305.KeySize]byte
@@ -404,7 +433,7 @@ func (transport *Transport) CreateMessageResponse(peer *Peer) (*MessageResponse,
 		&tau,
 		&key,
 		handshake.chainKey[:],
-		handshake.presharedKey[:],
+		candidate.key[:],
 	)
 
 	handshake.mixHash(tau[:])
@@ -434,8 +463,9 @@ func (transport *Transport) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 	}
 
 	var (
-		hash     [blake2s.Size]byte
-		chainKey [blake2s.Size]byte
+		hash           [blake2s.Size]byte
+		chainKey       [blake2s.Size]byte
+		presharedKeyID kemExchangeID
 	)
 
 	ok := func() bool {
@@ -475,29 +505,34 @@ func (transport *Transport) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 		mixKey(&chainKey, &chainKey, ss[:])
 		setZero(ss[:])
 
-		// add preshared key (psk)
-
-		var tau [blake2s.Size]byte
-		var key [chacha20poly1305.KeySize]byte
-		KDF3(
-			&chainKey,
-			&tau,
-			&key,
-			chainKey[:],
-			handshake.presharedKey[:],
-		)
-		mixHash(&hash, &hash, tau[:])
-
-		// authenticate transcript
-
-		aead, _ := chacha20poly1305.New(key[:])
-		_, err = aead.Open(nil, ZeroNonce[:], msg.Empty[:], hash[:])
-		if err != nil {
-			transport.log.Debug("ConsumeMessageResponse: failed to authenticate transcript", "peer", lookup.peer)
-			return false
+		// add preshared key (psk), and authenticate transcript, with each of
+		// the candidates the responder might have used
+
+		for _, candidate := range handshake.presharedKeyCandidates() {
+			candidateHash, candidateChainKey := hash, chainKey
+
+			var tau [blake2s.Size]byte
+			var key [chacha20poly1305.KeySize]byte
+			KDF3(
+				&candidateChainKey,
+				&tau,
+				&key,
+				candidateChainKey[:],
+				candidate.key[:],
+			)
+			mixHash(&candidateHash, &candidateHash, tau[:])
+
+			aead, _ := chacha20poly1305.New(key[:])
+			if _, err = aead.Open(nil, ZeroNonce[:], msg.Empty[:], candidateHash[:]); err == nil {
+				mixHash(&hash, &candidateHash, msg.Empty[:])
+				chainKey = candidateChainKey
+				presharedKeyID = candidate.id
+				return true
+			}
 		}
-		mixHash(&hash, &hash, msg.Empty[:])
-		return true
+
+		transport.log.Debug("ConsumeMessageResponse: failed to authenticate transcript", "peer", lookup.peer)
+		return false
 	}()
 
 	if !ok {
@@ -511,6 +546,7 @@ func (transport *Transport) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 	handshake.hash = hash
 	handshake.chainKey = chainKey
 	handshake.remoteIndex = msg.Sender
+	handshake.presharedKeyID = presharedKeyID
 	handshake.state = handshakeResponseConsumed
 
 	handshake.mutex.Unlock()
@@ -568,15 +604,20 @@ func (peer *Peer) BeginSymmetricSession() error {
 	keypair := new(Keypair)
 	keypair.send, _ = chacha20poly1305.New(sendKey[:])
 	keypair.receive, _ = chacha20poly1305.New(recvKey[:])
+	if transport.retainSessions.Load() {
+		keypair.keys = &sessionKeys{send: sendKey, receive: recvKey}
+	}
 
 	setZero(sendKey[:])
 	setZero(recvKey[:])
 
-	keypair.created = time.Now()
+	keypair.created = peer.transport.clock.Now()
 	keypair.replayFilter.Reset()
 	keypair.isInitiator = isInitiator
 	keypair.localIndex = peer.handshake.localIndex
 	keypair.remoteIndex = peer.handshake.remoteIndex
+	keypair.postQuantumID = peer.handshake.presharedKeyID
+	handshake.presharedKeyID = kemExchangeID{}
 
 	// remap index
 
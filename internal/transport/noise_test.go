@@ -10,6 +10,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"net"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -66,9 +67,6 @@ func TestNoiseHandshake(t *testing.T) {
 	t.Cleanup(func() {
 		require.NoError(t, trans1.Close())
 		require.NoError(t, trans2.Close())
-
-		// Time for the workers to finish.
-		time.Sleep(100 * time.Millisecond)
 	})
 
 	peer1, err := trans2.NewPeer(trans1.staticIdentity.privateKey.PublicKey())
@@ -186,17 +184,101 @@ func TestNoiseHandshake(t *testing.T) {
 	}()
 }
 
+func TestRotatePrivateKey(t *testing.T) {
+	trans1 := randTransport(t)
+	trans2 := randTransport(t)
+
+	t.Cleanup(func() {
+		require.NoError(t, trans1.Close())
+		require.NoError(t, trans2.Close())
+	})
+
+	peer1, err := trans2.NewPeer(trans1.staticIdentity.privateKey.PublicKey())
+	require.NoError(t, err)
+	peer2, err := trans1.NewPeer(trans2.staticIdentity.privateKey.PublicKey())
+	require.NoError(t, err)
+	peer1.Start()
+	peer2.Start()
+
+	// initiate returns the wire encoding of a new handshake initiation from
+	// trans1 to trans2, it is consumed by trans2.
+	initiate := func() ([]byte, *Peer) {
+		// Avoid the handshake flood protection.
+		time.Sleep(2 * HandshakeInitationRate)
+
+		msg, err := trans1.CreateMessageInitiation(peer2)
+		require.NoError(t, err)
+
+		var buf bytes.Buffer
+		require.NoError(t, binary.Write(&buf, binary.LittleEndian, msg))
+		packet := buf.Bytes()
+		peer2.cookieGenerator.AddMacs(packet)
+
+		return packet, trans2.ConsumeMessageInitiation(msg)
+	}
+
+	packet, peer := initiate()
+	require.NotNil(t, trans2.cookieCheckerForMAC1(packet))
+	require.Equal(t, peer1, peer)
+
+	msg, err := trans2.CreateMessageResponse(peer1)
+	require.NoError(t, err)
+	require.Equal(t, peer2, trans1.ConsumeMessageResponse(msg))
+
+	require.NoError(t, peer1.BeginSymmetricSession())
+	keypair := peer1.keypairs.next.Load()
+	require.NotNil(t, keypair)
+
+	sk, err := NewPrivateKey()
+	require.NoError(t, err)
+
+	trans2.RotatePrivateKey(sk, time.Minute)
+
+	// Existing sessions should be left alone.
+	require.Equal(t, keypair, peer1.keypairs.next.Load())
+
+	// Handshakes addressed to the previous key should still be accepted.
+	packet, peer = initiate()
+	require.NotNil(t, trans2.cookieCheckerForMAC1(packet))
+	require.Equal(t, peer1, peer)
+
+	// Handshakes addressed to the new key should be accepted.
+	trans1.RemovePeer(trans2.staticIdentity.previous.publicKey)
+	peer2, err = trans1.NewPeer(sk.PublicKey())
+	require.NoError(t, err)
+	peer2.Start()
+
+	packet, peer = initiate()
+	require.NotNil(t, trans2.cookieCheckerForMAC1(packet))
+	require.Equal(t, peer1, peer)
+
+	// Without a grace period, the previous key should no longer be accepted.
+	trans1.RemovePeer(sk.PublicKey())
+	peer2, err = trans1.NewPeer(sk.PublicKey())
+	require.NoError(t, err)
+	peer2.Start()
+
+	otherSK, err := NewPrivateKey()
+	require.NoError(t, err)
+
+	trans2.RotatePrivateKey(otherSK, 0)
+
+	packet, peer = initiate()
+	require.Nil(t, trans2.cookieCheckerForMAC1(packet))
+	require.Nil(t, peer)
+}
+
 type discardingSink struct {
-	closed bool
+	closed atomic.Bool
 }
 
 func (ss *discardingSink) Close() error {
-	ss.closed = true
+	ss.closed.Store(true)
 	return nil
 }
 
 func (ss *discardingSink) Read(bufs [][]byte, sizes []int, destinations []NoisePublicKey, offset int) (int, error) {
-	if ss.closed {
+	if ss.closed.Load() {
 		return 0, net.ErrClosed
 	}
 
@@ -205,10 +287,10 @@ func (ss *discardingSink) Read(bufs [][]byte, sizes []int, destinations []NoiseP
 	return 0, nil
 }
 
-func (discardingSink) Write(bufs [][]byte, sources []NoisePublicKey, offset int) (int, error) {
+func (*discardingSink) Write(bufs [][]byte, sources []NoisePublicKey, offset int) (int, error) {
 	return 0, nil
 }
 
-func (discardingSink) BatchSize() int {
+func (*discardingSink) BatchSize() int {
 	return 1
 }
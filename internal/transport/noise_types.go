@@ -9,6 +9,7 @@ package transport
 import (
 	"crypto/subtle"
 	"encoding/base64"
+	"fmt"
 )
 
 const (
@@ -67,3 +68,24 @@ func (key NoisePublicKey) Equals(tar NoisePublicKey) bool {
 func (key NoisePublicKey) String() string {
 	return base64.StdEncoding.EncodeToString(key[:])
 }
+
+func (key *NoisePresharedKey) FromString(src string) error {
+	b, err := base64.StdEncoding.DecodeString(src)
+	if err != nil {
+		return err
+	}
+	if len(b) != NoisePresharedKeySize {
+		return fmt.Errorf("invalid preshared key length %d, expected %d", len(b), NoisePresharedKeySize)
+	}
+	copy(key[:], b)
+	return nil
+}
+
+func (key NoisePresharedKey) IsZero() bool {
+	var zero NoisePresharedKey
+	return subtle.ConstantTimeCompare(key[:], zero[:]) == 1
+}
+
+func (key NoisePresharedKey) String() string {
+	return base64.StdEncoding.EncodeToString(key[:])
+}
@@ -10,6 +10,8 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"net/netip"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -26,26 +28,62 @@ type Peer struct {
 	stopping          sync.WaitGroup // routines pending stop
 	txBytes           atomic.Uint64  // bytes send to peer (endpoint)
 	rxBytes           atomic.Uint64  // bytes received from peer
+	txPackets         atomic.Uint64  // messages sent to peer
+	rxPackets         atomic.Uint64  // messages received from peer
 	lastHandshakeNano atomic.Int64   // nano seconds since epoch
+	lastDataNano      atomic.Int64   // nano seconds since epoch, of the last data packet sent or received
+
+	handshakesCompleted atomic.Uint64 // handshakes completed with peer
+	handshakesFailed    atomic.Uint64 // handshake attempts that timed out
+
+	compression atomic.Bool // whether packets sent to the peer may be compressed
+	compressed  struct {
+		// The sizes of data packets exchanged while compression was agreed,
+		// before and after compression.
+		txUncompressed atomic.Uint64
+		txCompressed   atomic.Uint64
+		rxUncompressed atomic.Uint64
+		rxCompressed   atomic.Uint64
+	}
+
+	// postQuantumRequired is whether data may only be exchanged with the peer
+	// using sessions with a post-quantum shared secret.
+	postQuantumRequired atomic.Bool
 
 	endpoint struct {
 		sync.Mutex
 		val conn.Endpoint
+		// direct is the most recent endpoint not via the relay, if any.
+		direct conn.Endpoint
+		// relay is the peer's endpoint via the relay, if one is configured.
+		relay conn.Endpoint
+		// candidates are endpoints the peer has told us it might be reachable at.
+		candidates []netip.AddrPort
+		// punching is whether handshake initiations are sent to the candidates,
+		// even though the peer isn't relayed (see PunchHoles).
+		punching bool
+		// configured are the endpoints the peer is configured with, if more than one.
+		configured []conn.Endpoint
 	}
 
 	timers struct {
 		retransmitHandshake     *Timer
 		sendKeepalive           *Timer
 		newHandshake            *Timer
+		postQuantumHandshake    *Timer
 		zeroKeyMaterial         *Timer
 		persistentKeepalive     *Timer
+		idleSession             *Timer
 		handshakeAttempts       atomic.Uint32
 		needAnotherKeepalive    atomic.Bool
 		sentLastMinuteHandshake atomic.Bool
 	}
 
 	state struct {
-		sync.Mutex // protects against concurrent Start/Stop
+		sync.Mutex // protects against concurrent Start/Stop, and saved
+		// saved is the session the peer had when it was last stopped, if
+		// sessions are retained.
+		saved *SessionState
 	}
 
 	queue struct {
@@ -56,6 +94,7 @@ type Peer struct {
 
 	cookieGenerator             CookieGenerator
 	persistentKeepaliveInterval atomic.Uint32
+	idleTimeout                 atomic.Int64 // nanoseconds, zero disables idle session expiry
 }
 
 func (transport *Transport) NewPeer(pk NoisePublicKey) (*Peer, error) {
@@ -135,10 +174,96 @@ func (peer *Peer) SendBuffers(buffers [][]byte) error {
 			totalLen += uint64(len(b))
 		}
 		peer.txBytes.Add(totalLen)
+		peer.txPackets.Add(uint64(len(buffers)))
 	}
 	return err
 }
 
+// PeerStats contains counters for a peer, all counters are cumulative since
+// the peer was created.
+type PeerStats struct {
+	// TxBytes is the number of bytes sent to the peer.
+	TxBytes uint64
+	// RxBytes is the number of bytes received from the peer.
+	RxBytes uint64
+	// TxPackets is the number of messages (including handshakes and
+	// keepalives) sent to the peer.
+	TxPackets uint64
+	// RxPackets is the number of messages (including handshakes and
+	// keepalives) received from the peer.
+	RxPackets uint64
+	// LastHandshake is the time of the most recent completed handshake, or the
+	// zero time if no handshake has completed.
+	LastHandshake time.Time
+	// HandshakesCompleted is the number of handshakes completed with the peer.
+	HandshakesCompleted uint64
+	// HandshakesFailed is the number of handshake attempts that timed out.
+	HandshakesFailed uint64
+	// Endpoint is the endpoint packets are currently sent to, if any.
+	Endpoint string
+	// Relayed is whether packets are currently sent via the relay.
+	Relayed bool
+	// CandidateEndpoints are the endpoints the peer has told us it might be
+	// reachable at.
+	CandidateEndpoints []netip.AddrPort
+	// UncompressedTxBytes, and CompressedTxBytes, are the sizes of the packets
+	// sent to the peer while compression was agreed, before and after
+	// compression (packets that don't compress are counted as is).
+	UncompressedTxBytes uint64
+	CompressedTxBytes   uint64
+	// UncompressedRxBytes, and CompressedRxBytes, are the sizes of the
+	// packets received from the peer while compression was agreed, after and
+	// before decompression.
+	UncompressedRxBytes uint64
+	CompressedRxBytes   uint64
+	// PostQuantum is whether a post-quantum shared secret was mixed into the
+	// handshake of the current session.
+	PostQuantum bool
+	// SessionActive is whether there is a current session with the peer.
+	SessionActive bool
+	// PersistentKeepaliveInterval is the interval at which keepalives are
+	// sent to the peer regardless of other traffic, or zero if persistent
+	// keepalives are disabled.
+	PersistentKeepaliveInterval time.Duration
+}
+
+// Stats returns a snapshot of the peer's counters.
+func (peer *Peer) Stats() PeerStats {
+	stats := PeerStats{
+		TxBytes:             peer.txBytes.Load(),
+		RxBytes:             peer.rxBytes.Load(),
+		TxPackets:           peer.txPackets.Load(),
+		RxPackets:           peer.rxPackets.Load(),
+		HandshakesCompleted: peer.handshakesCompleted.Load(),
+		HandshakesFailed:    peer.handshakesFailed.Load(),
+		UncompressedTxBytes: peer.compressed.txUncompressed.Load(),
+		CompressedTxBytes:   peer.compressed.txCompressed.Load(),
+		UncompressedRxBytes: peer.compressed.rxUncompressed.Load(),
+		CompressedRxBytes:   peer.compressed.rxCompressed.Load(),
+
+		PersistentKeepaliveInterval: time.Duration(peer.persistentKeepaliveInterval.Load()) * time.Second,
+	}
+
+	if nano := peer.lastHandshakeNano.Load(); nano != 0 {
+		stats.LastHandshake = time.Unix(0, nano)
+	}
+
+	if keypair := peer.keypairs.Current(); keypair != nil {
+		stats.SessionActive = true
+		stats.PostQuantum = keypair.postQuantumID != kemExchangeID{}
+	}
+
+	peer.endpoint.Lock()
+	if peer.endpoint.val != nil {
+		stats.Endpoint = peer.endpoint.val.DstToString()
+		_, stats.Relayed = peer.endpoint.val.(*conn.RelayEndpoint)
+	}
+	stats.CandidateEndpoints = slices.Clone(peer.endpoint.candidates)
+	peer.endpoint.Unlock()
+
+	return stats
+}
+
 func (peer *Peer) String() string {
 	base64Key := base64.StdEncoding.EncodeToString(peer.handshake.remoteStatic[:])
 	abbreviatedKey := base64Key[0:4] + "…" + base64Key[39:43]
@@ -167,7 +292,7 @@ func (peer *Peer) Start() {
 	peer.stopping.Add(2)
 
 	peer.handshake.mutex.Lock()
-	peer.handshake.lastSentHandshake = time.Now().Add(-(RekeyTimeout + time.Second))
+	peer.handshake.lastSentHandshake = peer.transport.clock.Now().Add(-(peer.transport.rekeyTimeout() + time.Second))
 	peer.handshake.mutex.Unlock()
 
 	peer.transport.queue.encryption.wg.Add(1) // keep encryption queue open for our writes
@@ -186,6 +311,18 @@ func (peer *Peer) Start() {
 	peer.isRunning.Store(true)
 }
 
+// StartWithKeepalive starts the peer, and if it has a persistent keepalive
+// interval, sends the first keepalive straight away to establish the mapping.
+func (peer *Peer) StartWithKeepalive() {
+	peer.Start()
+
+	if peer.persistentKeepaliveInterval.Load() > 0 {
+		if err := peer.SendKeepalive(); err != nil {
+			peer.transport.log.Error("Failed to send keepalive", "peer", peer, "error", err)
+		}
+	}
+}
+
 func (peer *Peer) ZeroAndFlushAll() {
 	transport := peer.transport
 
@@ -217,7 +354,7 @@ func (peer *Peer) ExpireCurrentKeypairs() {
 	handshake.mutex.Lock()
 	peer.transport.indexTable.Delete(handshake.localIndex)
 	handshake.Clear()
-	peer.handshake.lastSentHandshake = time.Now().Add(-(RekeyTimeout + time.Second))
+	peer.handshake.lastSentHandshake = peer.transport.clock.Now().Add(-(peer.transport.rekeyTimeout() + time.Second))
 	handshake.mutex.Unlock()
 
 	keypairs := &peer.keypairs
@@ -248,13 +385,224 @@ func (peer *Peer) Stop() {
 	peer.stopping.Wait()
 	peer.transport.queue.encryption.wg.Done() // no more writes to encryption queue from us
 
+	// Nothing is being sent, or received, so the session's counters are final.
+	peer.state.saved = peer.saveSession()
+
 	peer.ZeroAndFlushAll()
 }
 
 func (peer *Peer) SetEndpointFromPacket(endpoint conn.Endpoint) {
 	peer.endpoint.Lock()
-	defer peer.endpoint.Unlock()
+	changed := !sameEndpoint(peer.endpoint.val, endpoint)
 	peer.endpoint.val = endpoint
+	if _, ok := endpoint.(*conn.RelayEndpoint); !ok {
+		peer.endpoint.direct = endpoint
+		// A path has been established.
+		peer.endpoint.punching = false
+	}
+	peer.endpoint.Unlock()
+
+	if changed {
+		peer.emitEvent(PeerEventEndpointChanged, endpoint)
+	}
+}
+
+// SetRelayEndpoint sets the endpoint through which the peer can be reached
+// via a relay. Packets are sent via the relay if the peer has no other known
+// endpoint, or if a handshake over its direct endpoint times out. While
+// relayed, handshake initiations are also sent to the direct endpoint, so
+// that the peer switches back to it if it starts working (by the usual
+// endpoint roaming). A nil endpoint disables the relay.
+func (peer *Peer) SetRelayEndpoint(endpoint conn.Endpoint) {
+	peer.endpoint.Lock()
+	previous := peer.endpoint.val
+
+	peer.endpoint.relay = endpoint
+	if endpoint == nil {
+		if _, ok := peer.endpoint.val.(*conn.RelayEndpoint); ok {
+			peer.endpoint.val = peer.endpoint.direct
+		}
+	} else if peer.endpoint.val == nil {
+		peer.endpoint.val = endpoint
+	}
+
+	current := peer.endpoint.val
+	peer.endpoint.Unlock()
+
+	if !sameEndpoint(previous, current) {
+		peer.emitEvent(PeerEventEndpointChanged, current)
+	}
+}
+
+// fallBackToRelay starts sending packets via the relay, if one is configured,
+// and the peer is not already being reached via it.
+func (peer *Peer) fallBackToRelay() {
+	peer.endpoint.Lock()
+
+	if peer.endpoint.relay == nil {
+		peer.endpoint.Unlock()
+		return
+	}
+
+	if _, ok := peer.endpoint.val.(*conn.RelayEndpoint); ok {
+		peer.endpoint.Unlock()
+		return
+	}
+
+	peer.transport.log.Info("Direct path is not working, falling back to relay", "peer", peer)
+
+	peer.endpoint.val = peer.endpoint.relay
+	relay := peer.endpoint.relay
+	peer.endpoint.Unlock()
+
+	peer.emitEvent(PeerEventEndpointChanged, relay)
+}
+
+// SetCandidateEndpoints sets the endpoints that the peer has told us it might
+// be reachable at (eg. discovered using STUN). While the peer is being reached
+// via the relay, handshake initiations are also sent to each candidate, so
+// that a direct path can be established through NATs (hole punching).
+func (peer *Peer) SetCandidateEndpoints(candidates []netip.AddrPort) {
+	peer.endpoint.Lock()
+	defer peer.endpoint.Unlock()
+
+	peer.endpoint.candidates = slices.Clone(candidates)
+}
+
+// PunchHoles sets the endpoints that a mutual peer has told us the peer might
+// be reachable at, and sends a handshake initiation to each of them straight
+// away (and again with each retry, until a packet is received from the peer
+// over a direct path). The mutual peer tells the peer about our endpoints at
+// the same time, so that both send initiations at once, each opening a path
+// through their own NAT for the other's (hole punching).
+func (peer *Peer) PunchHoles(candidates []netip.AddrPort) error {
+	peer.endpoint.Lock()
+	peer.endpoint.candidates = slices.Clone(candidates)
+	peer.endpoint.punching = len(candidates) > 0
+	peer.endpoint.Unlock()
+
+	return peer.ForceHandshakeInitiation()
+}
+
+// SetConfiguredEndpoints sets the endpoints that the peer is configured with
+// (eg. its IPv4 and IPv6 addresses, or a primary and backup server). Handshake
+// initiations are sent to each of them, and as with any other roaming, packets
+// are then sent to whichever endpoint the response arrives from first. So the
+// fastest working endpoint is preferred, and if it stops working, the next
+// handshake fails over to another.
+func (peer *Peer) SetConfiguredEndpoints(endpoints []conn.Endpoint) {
+	peer.endpoint.Lock()
+	defer peer.endpoint.Unlock()
+
+	if len(endpoints) > 1 {
+		peer.endpoint.configured = slices.Clone(endpoints)
+	} else {
+		peer.endpoint.configured = nil
+	}
+}
+
+// probeConfiguredEndpoints sends the packet to each of the peer's configured
+// endpoints, other than the one it is currently being reached at.
+func (peer *Peer) probeConfiguredEndpoints(packet []byte) {
+	peer.endpoint.Lock()
+	var probes []conn.Endpoint
+	for _, ep := range peer.endpoint.configured {
+		if !sameEndpoint(ep, peer.endpoint.val) {
+			probes = append(probes, ep)
+		}
+	}
+	peer.endpoint.Unlock()
+
+	if len(probes) == 0 {
+		return
+	}
+
+	peer.transport.net.RLock()
+	defer peer.transport.net.RUnlock()
+
+	if peer.transport.isClosed() {
+		return
+	}
+
+	for _, ep := range probes {
+		if err := peer.transport.net.bind.Send([][]byte{packet}, ep); err != nil {
+			peer.transport.log.Debug("Failed to probe configured endpoint",
+				"peer", peer, "endpoint", ep.DstToString(), "error", err)
+		}
+	}
+}
+
+// probeDirectEndpoint sends the packet to the peer's direct endpoint, and any
+// candidate endpoints, if it is currently being reached via the relay, or
+// holes are being punched to it.
+func (peer *Peer) probeDirectEndpoint(packet []byte) {
+	peer.endpoint.Lock()
+	_, isRelayed := peer.endpoint.val.(*conn.RelayEndpoint)
+	punching := peer.endpoint.punching
+	var probes []conn.Endpoint
+	if peer.endpoint.direct != nil && !sameEndpoint(peer.endpoint.direct, peer.endpoint.val) {
+		probes = append(probes, peer.endpoint.direct)
+	}
+	for _, candidate := range peer.endpoint.candidates {
+		if (peer.endpoint.direct == nil || candidate.String() != peer.endpoint.direct.DstToString()) &&
+			(peer.endpoint.val == nil || candidate.String() != peer.endpoint.val.DstToString()) {
+			probes = append(probes, &conn.StdNetEndpoint{AddrPort: candidate})
+		}
+	}
+	peer.endpoint.Unlock()
+
+	if (!isRelayed && !punching) || len(probes) == 0 {
+		return
+	}
+
+	peer.transport.net.RLock()
+	defer peer.transport.net.RUnlock()
+
+	if peer.transport.isClosed() {
+		return
+	}
+
+	for _, ep := range probes {
+		if err := peer.transport.net.bind.Send([][]byte{packet}, ep); err != nil {
+			peer.transport.log.Debug("Failed to probe direct endpoint",
+				"peer", peer, "endpoint", ep.DstToString(), "error", err)
+		}
+	}
+}
+
+// SetPersistentKeepaliveInterval sets the interval at which keepalives are
+// sent to the peer, regardless of other traffic, eg. to keep NAT mappings
+// alive. A zero interval disables persistent keepalives.
+func (peer *Peer) SetPersistentKeepaliveInterval(interval time.Duration) error {
+	secs := uint32(interval / time.Second)
+	old := peer.persistentKeepaliveInterval.Swap(secs)
+
+	// Establish the mapping straight away, rather than waiting for traffic.
+	if old == 0 && secs != 0 && peer.isRunning.Load() {
+		return peer.SendKeepalive()
+	}
+
+	return nil
+}
+
+// SetIdleTimeout sets how long a session with the peer may go without any data
+// being sent or received (keepalives don't count), before it is torn down and
+// its keys and handshake state are freed. A new session is established when
+// there is traffic for the peer again. Zero disables idle session expiry.
+func (peer *Peer) SetIdleTimeout(timeout time.Duration) error {
+	if timeout < 0 {
+		return fmt.Errorf("idle timeout must not be negative")
+	}
+
+	peer.idleTimeout.Store(int64(timeout))
+
+	if timeout == 0 {
+		peer.timers.idleSession.Del()
+	} else if peer.timersActive() && peer.keypairs.Current() != nil {
+		peer.timers.idleSession.Mod(timeout)
+	}
+
+	return nil
 }
 
 func (peer *Peer) SetPresharedKey(psk NoisePresharedKey) {
@@ -107,6 +107,10 @@ func (transport *Transport) GetInboundElement() *QueueInboundElement {
 }
 
 func (transport *Transport) PutInboundElement(elem *QueueInboundElement) {
+	// packets that were never written to the source sink
+	if elem.pkt != nil {
+		elem.pkt.Release()
+	}
 	elem.clearPointers()
 	transport.pool.inboundElements.Put(elem)
 }
@@ -0,0 +1,378 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (c) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package transport
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"time"
+)
+
+// Peers with post-quantum key exchange enabled exchange an ML-KEM-768 shared
+// secret, through the tunnel, and mix it into the preshared key of their
+// subsequent handshakes. So handshakes are a hybrid of X25519 and ML-KEM, and
+// sessions stay confidential even if X25519 is later broken. The first session
+// with a peer isn't protected, a new handshake is initiated once the exchange
+// has completed.
+//
+// Only the peer with the lower public key starts exchanges, sending a fresh
+// encapsulation key, the other peer encapsulates a secret to it, and the
+// starter confirms once it has decapsulated it. Either peer might lose its
+// keys (eg. on restart), or miss a confirmation, so both keep the keys that
+// could be in use. The initiator of a handshake tries each of them, while the
+// responder tries a different one each time a handshake isn't completed,
+// falling back to the configured preshared key.
+//
+// Once a session has been established with a shared secret, the configured
+// preshared key alone is no longer tried. Otherwise, an attacker could drop
+// handshake responses until the peers fall back to it. A peer that has lost
+// its keys can reconnect once they have been zeroed, after a long time
+// without a session. Peers can also require a shared secret, so that data is
+// never exchanged without one.
+const (
+	// kemEncapsulationKeyType is the first byte of an encapsulation key, it is
+	// followed by the exchange ID, the ID of the starter's current key (so a
+	// missed confirmation can be recovered from), and the key itself.
+	kemEncapsulationKeyType = 0x12
+	// kemCiphertextType is the first byte of a ciphertext, it is followed by
+	// the exchange ID, and the ciphertext itself.
+	kemCiphertextType = 0x13
+	// kemConfirmType is the first byte of a confirmation, it is followed by
+	// the exchange ID.
+	kemConfirmType = 0x14
+
+	kemExchangeIDSize             = 8
+	kemEncapsulationKeyPacketSize = 1 + 2*kemExchangeIDSize + kemEncapsulationKeySize
+	kemCiphertextPacketSize       = 1 + kemExchangeIDSize + kemCiphertextSize
+	kemConfirmPacketSize          = 1 + kemExchangeIDSize
+
+	// postQuantumRekeyAfterTime is how long a shared secret is mixed into
+	// handshakes for, before a new one is exchanged.
+	postQuantumRekeyAfterTime = 10 * time.Minute
+	// postQuantumHandshakeDelay is how long after an exchange completes the
+	// handshake that uses it is initiated, so that its timestamp is distinct
+	// from that of the handshake that just completed (timestamps are whitened
+	// to ~16ms), and it isn't rejected as a replay.
+	postQuantumHandshakeDelay = 100 * time.Millisecond
+)
+
+var errKEMUnsupported = errors.New("post-quantum key exchange requires Go 1.24 or later")
+
+// kemExchangeID identifies a key exchange, and the shared secret it produced.
+// The zero ID is the configured preshared key alone.
+type kemExchangeID [kemExchangeIDSize]byte
+
+type postQuantumKey struct {
+	id           kemExchangeID
+	sharedSecret [NoisePresharedKeySize]byte
+	created      time.Time
+}
+
+// postQuantumState is guarded by the handshake's mutex.
+type postQuantumState struct {
+	enabled bool
+	// current is the shared secret both peers are believed to be using,
+	// previous the one before it, and pending one that has been encapsulated
+	// but not yet confirmed.
+	current  *postQuantumKey
+	previous *postQuantumKey
+	pending  *postQuantumKey
+	// unconfirmedResponses is the number of handshake responses created since
+	// a session was last established, used to pick the key to respond with.
+	unconfirmedResponses int
+	// hybrid is whether a session has been established using a shared
+	// secret, since which the configured preshared key alone isn't tried.
+	hybrid bool
+	// decapsulationKey, and exchangeID, belong to the exchange started by us,
+	// if one is in progress.
+	decapsulationKey *kemDecapsulationKey
+	exchangeID       kemExchangeID
+}
+
+type presharedKeyCandidate struct {
+	id  kemExchangeID
+	key NoisePresharedKey
+}
+
+// presharedKeyCandidates returns the preshared keys that the peer might be
+// using, most likely first, the handshake's mutex must be held.
+func (h *Handshake) presharedKeyCandidates() []presharedKeyCandidate {
+	var candidates []presharedKeyCandidate
+	for _, pqKey := range []*postQuantumKey{h.postQuantum.current, h.postQuantum.previous, h.postQuantum.pending} {
+		if pqKey == nil {
+			continue
+		}
+
+		candidate := presharedKeyCandidate{id: pqKey.id}
+		KDF1((*[NoisePresharedKeySize]byte)(&candidate.key), h.presharedKey[:], pqKey.sharedSecret[:])
+		candidates = append(candidates, candidate)
+	}
+
+	if h.postQuantum.hybrid && len(candidates) > 0 {
+		return candidates
+	}
+
+	return append(candidates, presharedKeyCandidate{key: h.presharedKey})
+}
+
+// confirm records that the handshake of a session used the shared secret with
+// the given ID, the handshake's mutex must be held.
+func (pq *postQuantumState) confirm(id kemExchangeID) {
+	pq.unconfirmedResponses = 0
+
+	switch {
+	case id == kemExchangeID{}:
+		// The peer has no shared secrets (eg. it has restarted).
+		pq.current, pq.previous = nil, nil
+	case pq.current != nil && pq.current.id == id:
+		pq.hybrid = true
+	case pq.pending != nil && pq.pending.id == id:
+		pq.promotePending()
+		pq.hybrid = true
+	case pq.previous != nil && pq.previous.id == id:
+		pq.current, pq.previous = pq.previous, nil
+		pq.hybrid = true
+	}
+}
+
+// forgetHybrid allows the configured preshared key alone to be tried again,
+// once our keys have been zeroed, so that a peer which has lost its shared
+// secrets (eg. on restart) can reconnect.
+func (peer *Peer) forgetHybrid() {
+	peer.handshake.mutex.Lock()
+	peer.handshake.postQuantum.hybrid = false
+	peer.handshake.mutex.Unlock()
+}
+
+func (pq *postQuantumState) promotePending() {
+	pq.current, pq.previous, pq.pending = pq.pending, pq.current, nil
+}
+
+// CheckPostQuantum returns an error if post-quantum key exchange is enabled,
+// but isn't supported by this build.
+func CheckPostQuantum(enabled bool) error {
+	if enabled && !kemSupported {
+		return errKEMUnsupported
+	}
+
+	return nil
+}
+
+// SetPostQuantum sets whether a post-quantum shared secret is exchanged with
+// the peer, and mixed into its handshakes. Both peers must enable it. Changes
+// take effect from the next handshake.
+func (peer *Peer) SetPostQuantum(enabled bool) error {
+	if err := CheckPostQuantum(enabled); err != nil {
+		return err
+	}
+
+	peer.handshake.mutex.Lock()
+	defer peer.handshake.mutex.Unlock()
+
+	if !enabled {
+		peer.handshake.postQuantum = postQuantumState{}
+		return nil
+	}
+
+	peer.handshake.postQuantum.enabled = true
+
+	return nil
+}
+
+// SetPostQuantumRequired sets whether data may only be exchanged with the peer
+// using sessions with a post-quantum shared secret. Data sent or received
+// using other sessions (eg. the first, which exchanges a shared secret) is
+// dropped, so a downgrade to X25519 alone is refused.
+func (peer *Peer) SetPostQuantumRequired(required bool) {
+	peer.postQuantumRequired.Store(required)
+}
+
+// refusesData returns whether data can't be exchanged with the peer using the
+// keypair.
+func (peer *Peer) refusesData(keypair *Keypair) bool {
+	return peer.postQuantumRequired.Load() && keypair.postQuantumID == kemExchangeID{}
+}
+
+// isKEMExchangeStarter returns whether we start key exchanges with the peer.
+func (peer *Peer) isKEMExchangeStarter() bool {
+	peer.transport.staticIdentity.RLock()
+	publicKey := peer.transport.staticIdentity.publicKey
+	peer.transport.staticIdentity.RUnlock()
+
+	peer.handshake.mutex.RLock()
+	defer peer.handshake.mutex.RUnlock()
+
+	return bytes.Compare(publicKey[:], peer.handshake.remoteStatic[:]) < 0
+}
+
+// postQuantumSessionEstablished confirms the shared secret used by a new
+// session, and starts a new key exchange if it is needed.
+func (peer *Peer) postQuantumSessionEstablished(keypair *Keypair) error {
+	isStarter := peer.isKEMExchangeStarter()
+
+	handshake := &peer.handshake
+	handshake.mutex.Lock()
+
+	pq := &handshake.postQuantum
+	pq.confirm(keypair.postQuantumID)
+
+	if !pq.enabled || !isStarter || (keypair.postQuantumID != kemExchangeID{} &&
+		pq.current != nil && peer.transport.since(pq.current.created) < postQuantumRekeyAfterTime) {
+		handshake.mutex.Unlock()
+		return nil
+	}
+
+	dk, encapsulationKey, err := newKEMKey()
+	if err != nil {
+		handshake.mutex.Unlock()
+		return err
+	}
+
+	var id kemExchangeID
+	if _, err := rand.Read(id[:]); err != nil {
+		handshake.mutex.Unlock()
+		return err
+	}
+
+	pq.decapsulationKey, pq.exchangeID = dk, id
+
+	packet := make([]byte, kemEncapsulationKeyPacketSize)
+	packet[0] = kemEncapsulationKeyType
+	copy(packet[1:], id[:])
+	if pq.current != nil {
+		copy(packet[1+kemExchangeIDSize:], pq.current.id[:])
+	}
+	copy(packet[1+2*kemExchangeIDSize:], encapsulationKey)
+
+	handshake.mutex.Unlock()
+
+	peer.transport.log.Debug("Sending post-quantum encapsulation key", "peer", peer)
+
+	return peer.sendControlPacket(packet)
+}
+
+// receivedKEMEncapsulationKey handles an encapsulation key from the peer,
+// replying with the ciphertext of a new shared secret.
+func (peer *Peer) receivedKEMEncapsulationKey(packet []byte) {
+	if len(packet) < kemEncapsulationKeyPacketSize || peer.isKEMExchangeStarter() {
+		return
+	}
+
+	var id, confirmedID kemExchangeID
+	copy(id[:], packet[1:])
+	copy(confirmedID[:], packet[1+kemExchangeIDSize:])
+
+	handshake := &peer.handshake
+	handshake.mutex.Lock()
+
+	pq := &handshake.postQuantum
+	if !pq.enabled {
+		handshake.mutex.Unlock()
+		return
+	}
+
+	sharedSecret, ciphertext, err := kemEncapsulate(packet[1+2*kemExchangeIDSize : kemEncapsulationKeyPacketSize])
+	if err != nil {
+		handshake.mutex.Unlock()
+		peer.transport.log.Debug("Dropping invalid post-quantum encapsulation key", "peer", peer, "error", err)
+		return
+	}
+
+	// The peer might have missed our last confirmation.
+	if pq.pending != nil && pq.pending.id == confirmedID {
+		pq.promotePending()
+	}
+
+	pq.pending = &postQuantumKey{id: id, created: peer.transport.clock.Now()}
+	copy(pq.pending.sharedSecret[:], sharedSecret)
+
+	handshake.mutex.Unlock()
+
+	reply := make([]byte, kemCiphertextPacketSize)
+	reply[0] = kemCiphertextType
+	copy(reply[1:], id[:])
+	copy(reply[1+kemExchangeIDSize:], ciphertext)
+
+	peer.transport.log.Debug("Sending post-quantum ciphertext", "peer", peer)
+
+	if err := peer.sendControlPacket(reply); err != nil {
+		peer.transport.log.Warn("Failed to send post-quantum ciphertext", "peer", peer, "error", err)
+	}
+}
+
+// receivedKEMCiphertext handles the ciphertext of the exchange we started,
+// confirming it once the shared secret has been decapsulated.
+func (peer *Peer) receivedKEMCiphertext(packet []byte) {
+	if len(packet) < kemCiphertextPacketSize {
+		return
+	}
+
+	var id kemExchangeID
+	copy(id[:], packet[1:])
+
+	handshake := &peer.handshake
+	handshake.mutex.Lock()
+
+	pq := &handshake.postQuantum
+	if !pq.enabled || pq.decapsulationKey == nil || pq.exchangeID != id {
+		handshake.mutex.Unlock()
+		return
+	}
+
+	sharedSecret, err := kemDecapsulate(pq.decapsulationKey, packet[1+kemExchangeIDSize:kemCiphertextPacketSize])
+	if err != nil {
+		handshake.mutex.Unlock()
+		peer.transport.log.Debug("Dropping invalid post-quantum ciphertext", "peer", peer, "error", err)
+		return
+	}
+	pq.decapsulationKey = nil
+
+	pqKey := &postQuantumKey{id: id, created: peer.transport.clock.Now()}
+	copy(pqKey.sharedSecret[:], sharedSecret)
+	pq.current, pq.previous = pqKey, pq.current
+
+	handshake.mutex.Unlock()
+
+	confirm := make([]byte, kemConfirmPacketSize)
+	confirm[0] = kemConfirmType
+	copy(confirm[1:], id[:])
+
+	peer.transport.log.Debug("Sending post-quantum confirmation", "peer", peer)
+
+	if err := peer.sendControlPacket(confirm); err != nil {
+		peer.transport.log.Warn("Failed to send post-quantum confirmation", "peer", peer, "error", err)
+	}
+}
+
+// receivedKEMConfirm handles the confirmation of a shared secret we
+// encapsulated, and initiates a handshake that uses it (shortly).
+func (peer *Peer) receivedKEMConfirm(packet []byte) {
+	if len(packet) < kemConfirmPacketSize {
+		return
+	}
+
+	var id kemExchangeID
+	copy(id[:], packet[1:])
+
+	handshake := &peer.handshake
+	handshake.mutex.Lock()
+
+	pq := &handshake.postQuantum
+	if pq.pending == nil || pq.pending.id != id {
+		handshake.mutex.Unlock()
+		return
+	}
+	pq.promotePending()
+
+	handshake.mutex.Unlock()
+
+	peer.transport.log.Debug("Post-quantum key exchange complete", "peer", peer)
+
+	if peer.timersActive() {
+		peer.timers.postQuantumHandshake.Mod(postQuantumHandshakeDelay)
+	}
+}
@@ -0,0 +1,171 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (c) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package transport
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostQuantumHandshake(t *testing.T) {
+	trans1 := randTransport(t)
+	trans2 := randTransport(t)
+
+	t.Cleanup(func() {
+		require.NoError(t, trans1.Close())
+		require.NoError(t, trans2.Close())
+
+		// Time for the workers to finish.
+		time.Sleep(100 * time.Millisecond)
+	})
+
+	peer1, err := trans2.NewPeer(trans1.staticIdentity.privateKey.PublicKey())
+	require.NoError(t, err)
+	peer2, err := trans1.NewPeer(trans2.staticIdentity.privateKey.PublicKey())
+	require.NoError(t, err)
+	peer1.Start()
+	peer2.Start()
+
+	// handshake attempts a handshake initiated by trans1, with the response
+	// created by trans2, and returns whether it completed.
+	handshake := func() bool {
+		// Avoid the handshake flood protection.
+		time.Sleep(2 * HandshakeInitationRate)
+
+		msg1, err := trans1.CreateMessageInitiation(peer2)
+		require.NoError(t, err)
+		require.Equal(t, peer1, trans2.ConsumeMessageInitiation(msg1))
+
+		msg2, err := trans2.CreateMessageResponse(peer1)
+		require.NoError(t, err)
+
+		if trans1.ConsumeMessageResponse(msg2) == nil {
+			return false
+		}
+
+		require.NoError(t, peer2.BeginSymmetricSession())
+		require.NoError(t, peer1.BeginSymmetricSession())
+
+		// As would happen once the session is established.
+		for peer, keypair := range map[*Peer]*Keypair{peer1: peer1.keypairs.next.Load(), peer2: peer2.keypairs.current} {
+			peer.handshake.mutex.Lock()
+			peer.handshake.postQuantum.confirm(keypair.postQuantumID)
+			peer.handshake.mutex.Unlock()
+		}
+
+		return true
+	}
+
+	keyA := &postQuantumKey{id: kemExchangeID{1}, sharedSecret: [NoisePresharedKeySize]byte{1}}
+	keyB := &postQuantumKey{id: kemExchangeID{2}, sharedSecret: [NoisePresharedKeySize]byte{2}}
+
+	t.Run("Shared", func(t *testing.T) {
+		peer1.handshake.postQuantum = postQuantumState{current: keyA}
+		peer2.handshake.postQuantum = postQuantumState{current: keyA}
+
+		require.True(t, handshake())
+		require.Equal(t, keyA.id, peer1.keypairs.next.Load().postQuantumID)
+		require.Equal(t, keyA.id, peer2.keypairs.current.postQuantumID)
+	})
+
+	t.Run("Unconfirmed", func(t *testing.T) {
+		// The responder never received the confirmation of key B.
+		peer1.handshake.postQuantum = postQuantumState{current: keyA, pending: keyB}
+		peer2.handshake.postQuantum = postQuantumState{current: keyB, previous: keyA}
+
+		require.True(t, handshake())
+		require.Equal(t, keyA.id, peer2.keypairs.current.postQuantumID)
+		require.Equal(t, keyA, peer1.handshake.postQuantum.current)
+		require.Equal(t, keyA, peer2.handshake.postQuantum.current)
+	})
+
+	// dropResponse creates a handshake response, that never reaches the
+	// initiator.
+	dropResponse := func() {
+		time.Sleep(2 * HandshakeInitationRate)
+
+		msg1, err := trans1.CreateMessageInitiation(peer2)
+		require.NoError(t, err)
+		require.Equal(t, peer1, trans2.ConsumeMessageInitiation(msg1))
+
+		_, err = trans2.CreateMessageResponse(peer1)
+		require.NoError(t, err)
+	}
+
+	t.Run("Downgrade", func(t *testing.T) {
+		peer1.handshake.postQuantum = postQuantumState{current: keyA, hybrid: true}
+		peer2.handshake.postQuantum = postQuantumState{current: keyA, hybrid: true}
+
+		// The responder doesn't fall back to the configured preshared key.
+		for i := 0; i < 3; i++ {
+			dropResponse()
+		}
+
+		require.True(t, handshake())
+		require.Equal(t, keyA.id, peer2.keypairs.current.postQuantumID)
+		require.Equal(t, keyA, peer1.handshake.postQuantum.current)
+	})
+
+	t.Run("Initiator Restarted", func(t *testing.T) {
+		peer1.handshake.postQuantum = postQuantumState{current: keyA, previous: keyB, hybrid: true}
+		peer2.handshake.postQuantum = postQuantumState{}
+
+		// Until the responder's keys have been zeroed.
+		for i := 0; i < 3; i++ {
+			require.False(t, handshake())
+		}
+
+		expiredZeroKeyMaterial(peer1)
+
+		// The responder tries each of its keys in turn.
+		require.False(t, handshake())
+		require.False(t, handshake())
+		require.True(t, handshake())
+		require.Equal(t, kemExchangeID{}, peer2.keypairs.current.postQuantumID)
+		require.Nil(t, peer1.handshake.postQuantum.current)
+
+		// And starts from the most likely once a session is established.
+		require.Zero(t, peer1.handshake.postQuantum.unconfirmedResponses)
+	})
+
+	t.Run("Responder Restarted", func(t *testing.T) {
+		peer1.handshake.postQuantum = postQuantumState{}
+		peer2.handshake.postQuantum = postQuantumState{current: keyA, hybrid: true}
+
+		// Until the initiator's keys have been zeroed.
+		require.False(t, handshake())
+
+		expiredZeroKeyMaterial(peer2)
+
+		require.True(t, handshake())
+		require.Equal(t, kemExchangeID{}, peer2.keypairs.current.postQuantumID)
+		require.Nil(t, peer2.handshake.postQuantum.current)
+	})
+}
+
+func TestKEM(t *testing.T) {
+	if !kemSupported {
+		t.Skip("ML-KEM is not supported by this version of Go")
+	}
+
+	dk, encapsulationKey, err := newKEMKey()
+	require.NoError(t, err)
+	require.Len(t, encapsulationKey, kemEncapsulationKeySize)
+
+	sharedSecret, ciphertext, err := kemEncapsulate(encapsulationKey)
+	require.NoError(t, err)
+	require.Len(t, sharedSecret, NoisePresharedKeySize)
+	require.Len(t, ciphertext, kemCiphertextSize)
+
+	decapsulated, err := kemDecapsulate(dk, ciphertext)
+	require.NoError(t, err)
+	require.Equal(t, sharedSecret, decapsulated)
+
+	_, _, err = kemEncapsulate(encapsulationKey[1:])
+	require.Error(t, err)
+}
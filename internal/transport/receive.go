@@ -18,6 +18,41 @@ import (
 	"golang.org/x/crypto/chacha20poly1305"
 )
 
+var (
+	errUnknownMessageType = errors.New("unknown message type")
+	errInvalidMessageSize = errors.New("invalid message size")
+)
+
+// messageType returns the type of a message received from the network. It
+// fails if the type is unknown, or the message is the wrong size for its type.
+func messageType(packet []byte) (uint32, error) {
+	if len(packet) < MinMessageSize {
+		return 0, errInvalidMessageSize
+	}
+
+	msgType := binary.LittleEndian.Uint32(packet[:4])
+
+	var ok bool
+	switch msgType {
+	case MessageInitiationType:
+		ok = len(packet) == MessageInitiationSize
+	case MessageResponseType:
+		ok = len(packet) == MessageResponseSize
+	case MessageCookieReplyType:
+		ok = len(packet) == MessageCookieReplySize
+	case MessageTransportType:
+		ok = len(packet) >= MessageTransportSize
+	default:
+		return msgType, errUnknownMessageType
+	}
+
+	if !ok {
+		return msgType, errInvalidMessageSize
+	}
+
+	return msgType, nil
+}
+
 type QueueHandshakeElement struct {
 	msgType  uint32
 	packet   []byte
@@ -26,11 +61,16 @@ type QueueHandshakeElement struct {
 }
 
 type QueueInboundElement struct {
-	buffer   *[MaxMessageSize]byte
+	buffer *[MaxMessageSize]byte
+	// pkt, if set, holds the decrypted packet (rather than buffer).
+	pkt      Packet
 	packet   []byte
 	counter  uint64
 	keypair  *Keypair
 	endpoint conn.Endpoint
+	// compressedSize is the size of the packet before it was decompressed, or
+	// zero if it wasn't compressed.
+	compressedSize int
 }
 
 type QueueInboundElementsContainer struct {
@@ -44,6 +84,7 @@ type QueueInboundElementsContainer struct {
 // It also reduces the possible collateral damage from use-after-free bugs.
 func (elem *QueueInboundElement) clearPointers() {
 	elem.buffer = nil
+	elem.pkt = nil
 	elem.packet = nil
 	elem.keypair = nil
 	elem.endpoint = nil
@@ -59,7 +100,7 @@ func (peer *Peer) keepKeyFreshReceiving() error {
 	}
 
 	keypair := peer.keypairs.Current()
-	if keypair != nil && keypair.isInitiator && time.Since(keypair.created) > (RejectAfterTime-KeepaliveTimeout-RekeyTimeout) {
+	if keypair != nil && keypair.isInitiator && peer.transport.since(keypair.created) > (peer.transport.rejectAfterTime()-KeepaliveTimeout-peer.transport.rekeyTimeout()) {
 		peer.timers.sentLastMinuteHandshake.Store(true)
 		if err := peer.SendHandshakeInitiation(false); err != nil {
 			return err
@@ -129,26 +170,20 @@ func (transport *Transport) RoutineReceiveIncoming(maxBatchSize int, recv conn.R
 
 		// handle each packet in the batch
 		for i, size := range sizes[:count] {
-			if size < MinMessageSize {
-				continue
-			}
-
-			// check size of packet
+			// check type and size of packet
 
 			packet := bufsArrs[i][:size]
-			msgType := binary.LittleEndian.Uint32(packet[:4])
-
-			switch msgType {
+			msgType, err := messageType(packet)
+			if err != nil {
+				if errors.Is(err, errUnknownMessageType) {
+					transport.log.Warn("Received message with unknown type", "type", msgType)
+				}
+				continue
+			}
 
 			// check if transport
 
-			case MessageTransportType:
-
-				// check size
-
-				if len(packet) < MessageTransportSize {
-					continue
-				}
+			if msgType == MessageTransportType {
 
 				// lookup key pair
 
@@ -163,7 +198,7 @@ func (transport *Transport) RoutineReceiveIncoming(maxBatchSize int, recv conn.R
 
 				// check keypair expiry
 
-				if keypair.created.Add(RejectAfterTime).Before(time.Now()) {
+				if keypair.created.Add(transport.rejectAfterTime()).Before(transport.clock.Now()) {
 					continue
 				}
 
@@ -186,26 +221,11 @@ func (transport *Transport) RoutineReceiveIncoming(maxBatchSize int, recv conn.R
 				bufsArrs[i] = transport.GetMessageBuffer()
 				bufs[i] = bufsArrs[i][:]
 				continue
+			}
 
 			// otherwise it is a fixed size & handshake related packet
 
-			case MessageInitiationType:
-				if len(packet) != MessageInitiationSize {
-					continue
-				}
-
-			case MessageResponseType:
-				if len(packet) != MessageResponseSize {
-					continue
-				}
-
-			case MessageCookieReplyType:
-				if len(packet) != MessageCookieReplySize {
-					continue
-				}
-
-			default:
-				transport.log.Warn("Received message with unknown type", "type", msgType)
+			if !transport.acquireHandshake() {
 				continue
 			}
 
@@ -219,6 +239,8 @@ func (transport *Transport) RoutineReceiveIncoming(maxBatchSize int, recv conn.R
 				bufsArrs[i] = transport.GetMessageBuffer()
 				bufs[i] = bufsArrs[i][:]
 			default:
+				transport.releaseHandshake()
+				transport.rate.concurrencyLimited.Add(1)
 			}
 		}
 		for peer, elemsContainer := range elemsByPeer {
@@ -239,7 +261,9 @@ func (transport *Transport) RoutineReceiveIncoming(maxBatchSize int, recv conn.R
 
 func (transport *Transport) RoutineDecryption(id int) {
 	var nonce [chacha20poly1305.NonceSize]byte
+	var decompressionScratch []byte
 
+	defer transport.queue.workers.Done()
 	defer transport.log.Debug("Routine: decryption worker - stopped", "id", id)
 	transport.log.Debug("Routine: decryption worker - started", "id", id)
 
@@ -251,9 +275,29 @@ func (transport *Transport) RoutineDecryption(id int) {
 
 			// decrypt and release to consumer
 			var err error
+			elem.compressedSize = 0
 			elem.counter = binary.LittleEndian.Uint64(counter)
 			// copy counter to nonce
 			binary.LittleEndian.PutUint64(nonce[0x4:0xc], elem.counter)
+			if transport.packetSink != nil && len(content) > chacha20poly1305.Overhead {
+				// decrypt straight into memory owned by the source sink
+				pkt := transport.packetSink.NewPacket(len(content) - chacha20poly1305.Overhead)
+				elem.packet, err = elem.keypair.receive.Open(
+					pkt.AsSlice()[:0],
+					nonce[:],
+					content,
+					nil,
+				)
+				if err != nil {
+					pkt.Release()
+					elem.packet = nil
+				} else {
+					elem.pkt = pkt
+					transport.decompressPacketInto(elem)
+				}
+				continue
+			}
+
 			elem.packet, err = elem.keypair.receive.Open(
 				content[:0],
 				nonce[:],
@@ -262,17 +306,77 @@ func (transport *Transport) RoutineDecryption(id int) {
 			)
 			if err != nil {
 				elem.packet = nil
+			} else if isCompressedPacket(elem.packet) {
+				if decompressionScratch == nil {
+					decompressionScratch = make([]byte, MaxContentSize)
+				}
+				transport.decompressPacketInPlace(elem, decompressionScratch)
 			}
 		}
 		elemsContainer.Unlock()
 	}
 }
 
+// decompressPacketInto replaces a compressed packet, allocated by the packet
+// sink, with a new packet holding its decompressed contents. If the packet
+// can't be decompressed it is dropped.
+func (transport *Transport) decompressPacketInto(elem *QueueInboundElement) {
+	if !isCompressedPacket(elem.packet) {
+		return
+	}
+
+	n, err := decompressedPacketLen(elem.packet)
+	if err != nil {
+		transport.log.Debug("Dropping invalid compressed packet", "error", err)
+		elem.pkt.Release()
+		elem.pkt = nil
+		elem.packet = nil
+		return
+	}
+
+	compressedSize := compressedPacketSize(elem.packet)
+
+	pkt := transport.packetSink.NewPacket(n)
+	decompressed, err := decompressPacket(pkt.AsSlice(), elem.packet)
+	elem.pkt.Release()
+	if err != nil {
+		transport.log.Debug("Dropping invalid compressed packet", "error", err)
+		pkt.Release()
+		elem.pkt = nil
+		elem.packet = nil
+		return
+	}
+
+	elem.pkt = pkt
+	elem.packet = decompressed
+	elem.compressedSize = compressedSize
+}
+
+// decompressPacketInPlace decompresses a compressed packet, via scratch, back
+// into the element's buffer. If the packet can't be decompressed it is
+// dropped.
+func (transport *Transport) decompressPacketInPlace(elem *QueueInboundElement, scratch []byte) {
+	n, err := decompressedPacketLen(elem.packet)
+	if err == nil {
+		var decompressed []byte
+		decompressed, err = decompressPacket(scratch[:n], elem.packet)
+		if err == nil {
+			elem.compressedSize = compressedPacketSize(elem.packet)
+			elem.packet = elem.buffer[MessageTransportOffsetContent : MessageTransportOffsetContent+copy(elem.buffer[MessageTransportOffsetContent:], decompressed)]
+			return
+		}
+	}
+
+	transport.log.Debug("Dropping invalid compressed packet", "error", err)
+	elem.packet = nil
+}
+
 // Handles incoming packets related to handshake.
 func (transport *Transport) RoutineHandshake(id int) {
 	defer func() {
 		transport.log.Debug("Routine: handshake worker - stopped", "id", id)
 		transport.queue.encryption.wg.Done()
+		transport.queue.workers.Done()
 	}()
 	transport.log.Debug("Routine: handshake worker - started", "id", id)
 
@@ -317,20 +421,23 @@ func (transport *Transport) RoutineHandshake(id int) {
 
 			// check mac fields and maybe ratelimit
 
-			if !transport.cookieChecker.CheckMAC1(elem.packet) {
+			cookieChecker := transport.cookieCheckerForMAC1(elem.packet)
+			if cookieChecker == nil {
 				transport.log.Warn("Received packet with invalid mac1")
 				goto skip
 			}
 
 			// endpoints destination address is the source of the datagram
 
-			if transport.IsUnderLoad() {
+			if transport.requireCookie() {
 
 				// verify MAC2 field
 
-				if !transport.cookieChecker.CheckMAC2(elem.packet, elem.endpoint.DstToBytes()) {
-					if err := transport.SendHandshakeCookie(&elem); err != nil {
+				if !cookieChecker.CheckMAC2(elem.packet, elem.endpoint.DstToBytes()) {
+					if err := transport.SendHandshakeCookie(cookieChecker, &elem); err != nil {
 						transport.log.Warn("Failed to send handshake cookie", "error", err)
+					} else {
+						transport.rate.cookieReplies.Add(1)
 					}
 					goto skip
 				}
@@ -338,6 +445,7 @@ func (transport *Transport) RoutineHandshake(id int) {
 				// check ratelimiter
 
 				if !transport.rate.limiter.Allow(elem.endpoint.DstIP()) {
+					transport.rate.rateLimited.Add(1)
 					goto skip
 				}
 			}
@@ -370,6 +478,11 @@ func (transport *Transport) RoutineHandshake(id int) {
 				goto skip
 			}
 
+			if transport.draining.Load() && peer.keypairs.Current() == nil {
+				transport.log.Debug("Ignoring handshake initiation while draining", "peer", peer)
+				goto skip
+			}
+
 			// update timers
 
 			peer.timersAnyAuthenticatedPacketTraversal()
@@ -380,6 +493,7 @@ func (transport *Transport) RoutineHandshake(id int) {
 
 			transport.log.Debug("Received handshake initiation", "peer", peer)
 			peer.rxBytes.Add(uint64(len(elem.packet)))
+			peer.rxPackets.Add(1)
 
 			if err := peer.SendHandshakeResponse(); err != nil {
 				transport.log.Error("Failed to send handshake response", "error", err)
@@ -411,6 +525,7 @@ func (transport *Transport) RoutineHandshake(id int) {
 
 			transport.log.Debug("Received handshake response", "peer", peer)
 			peer.rxBytes.Add(uint64(len(elem.packet)))
+			peer.rxPackets.Add(1)
 
 			// update timers
 
@@ -429,9 +544,14 @@ func (transport *Transport) RoutineHandshake(id int) {
 				transport.log.Error("Failed to send keepalive", "peer", peer, "error", err)
 				goto skip
 			}
+			if err := peer.sessionEstablished(); err != nil {
+				transport.log.Error("Failed to set up session", "peer", peer, "error", err)
+				goto skip
+			}
 		}
 	skip:
 		transport.PutMessageBuffer(elem.buffer)
+		transport.releaseHandshake()
 	}
 }
 
@@ -444,6 +564,7 @@ func (peer *Peer) RoutineSequentialReceiver(maxBatchSize int) {
 	t.log.Debug("Routine: sequential receiver - started", "peer", peer)
 
 	bufs := make([][]byte, 0, maxBatchSize)
+	pkts := make([]Packet, 0, maxBatchSize)
 
 	peers := make([]NoisePublicKey, 0, maxBatchSize)
 	for i := 0; i < maxBatchSize; i++ {
@@ -458,6 +579,7 @@ func (peer *Peer) RoutineSequentialReceiver(maxBatchSize int) {
 		validTailPacket := -1
 		dataPacketReceived := false
 		rxBytesLen := uint64(0)
+		rxPackets := uint64(0)
 		for i, elem := range elemsContainer.elems {
 			if elem.packet == nil {
 				// decryption failed
@@ -476,19 +598,50 @@ func (peer *Peer) RoutineSequentialReceiver(maxBatchSize int) {
 					t.log.Warn("Failed to send staged packets", "peer", peer, "error", err)
 					continue
 				}
+				if err := peer.sessionEstablished(); err != nil {
+					t.log.Warn("Failed to set up session", "peer", peer, "error", err)
+					continue
+				}
 			}
 			rxBytesLen += uint64(len(elem.packet) + MinMessageSize)
+			rxPackets++
 
 			if len(elem.packet) == 0 {
 				t.log.Debug("Receiving keepalive packet", "peer", peer)
 				continue
 			}
+
+			if isControlPacket(elem.packet) {
+				peer.receivedControlPacket(elem.keypair, elem.packet)
+				continue
+			}
+
+			if peer.refusesData(elem.keypair) {
+				t.log.Debug("Dropping packet from a session without a post-quantum shared secret", "peer", peer)
+				continue
+			}
+
+			if elem.compressedSize > 0 {
+				peer.compressed.rxUncompressed.Add(uint64(len(elem.packet)))
+				peer.compressed.rxCompressed.Add(uint64(elem.compressedSize))
+			} else if elem.keypair.remoteCompression.Load() {
+				peer.compressed.rxUncompressed.Add(uint64(len(elem.packet)))
+				peer.compressed.rxCompressed.Add(uint64(len(elem.packet)))
+			}
 			dataPacketReceived = true
 
+			if elem.pkt != nil {
+				pkts = append(pkts, elem.pkt)
+				// ownership passes to the source sink
+				elem.pkt = nil
+				continue
+			}
+
 			bufs = append(bufs, elem.buffer[:MessageTransportOffsetContent+len(elem.packet)])
 		}
 
 		peer.rxBytes.Add(rxBytesLen)
+		peer.rxPackets.Add(rxPackets)
 		if validTailPacket >= 0 {
 			peer.SetEndpointFromPacket(elemsContainer.elems[validTailPacket].endpoint)
 			if err := peer.keepKeyFreshReceiving(); err != nil {
@@ -501,6 +654,14 @@ func (peer *Peer) RoutineSequentialReceiver(maxBatchSize int) {
 		if dataPacketReceived {
 			peer.timersDataReceived()
 		}
+		if len(pkts) > 0 {
+			_, err := t.packetSink.WritePackets(pkts, peers)
+			if err != nil && !t.isClosed() {
+				t.log.Error("Failed to write packets to source sink", "peer", peer, "error", err)
+			}
+			clear(pkts)
+			pkts = pkts[:0]
+		}
 		if len(bufs) > 0 {
 			_, err := t.sourceSink.Write(bufs, peers, MessageTransportOffsetContent)
 			if err != nil && !t.isClosed() {
@@ -14,6 +14,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/klauspost/compress/snappy"
 	"github.com/noisysockets/noisysockets/internal/conn"
 	"golang.org/x/crypto/chacha20poly1305"
 )
@@ -101,22 +102,24 @@ func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
 	}
 
 	peer.handshake.mutex.RLock()
-	if time.Since(peer.handshake.lastSentHandshake) < RekeyTimeout {
+	if peer.transport.since(peer.handshake.lastSentHandshake) < peer.transport.rekeyTimeout() {
 		peer.handshake.mutex.RUnlock()
 		return nil
 	}
 	peer.handshake.mutex.RUnlock()
 
 	peer.handshake.mutex.Lock()
-	if time.Since(peer.handshake.lastSentHandshake) < RekeyTimeout {
+	if peer.transport.since(peer.handshake.lastSentHandshake) < peer.transport.rekeyTimeout() {
 		peer.handshake.mutex.Unlock()
 		return nil
 	}
-	peer.handshake.lastSentHandshake = time.Now()
+	peer.handshake.lastSentHandshake = peer.transport.clock.Now()
 	peer.handshake.mutex.Unlock()
 
 	peer.transport.log.Debug("Sending handshake initiation", "peer", peer)
 
+	peer.emitEvent(PeerEventHandshakeInitiated, peer.currentEndpoint())
+
 	msg, err := peer.transport.CreateMessageInitiation(peer)
 	if err != nil {
 		peer.transport.log.Error("Failed to create initiation message", "peer", peer, "error", err)
@@ -140,14 +143,28 @@ func (peer *Peer) SendHandshakeInitiation(isRetry bool) error {
 	if err != nil {
 		peer.transport.log.Error("Failed to send handshake initiation", "peer", peer, "error", err)
 	}
+	peer.probeDirectEndpoint(packet)
+	peer.probeConfiguredEndpoints(packet)
 	peer.timersHandshakeInitiated()
 
 	return err
 }
 
+// ForceHandshakeInitiation sends a handshake initiation, even if one was sent
+// recently (eg. because our address has changed, and the peer needs to learn
+// the new endpoint). The current keypair remains usable until the handshake
+// completes.
+func (peer *Peer) ForceHandshakeInitiation() error {
+	peer.handshake.mutex.Lock()
+	peer.handshake.lastSentHandshake = peer.transport.clock.Now().Add(-(peer.transport.rekeyTimeout() + time.Second))
+	peer.handshake.mutex.Unlock()
+
+	return peer.SendHandshakeInitiation(false)
+}
+
 func (peer *Peer) SendHandshakeResponse() error {
 	peer.handshake.mutex.Lock()
-	peer.handshake.lastSentHandshake = time.Now()
+	peer.handshake.lastSentHandshake = peer.transport.clock.Now()
 	peer.handshake.mutex.Unlock()
 
 	peer.transport.log.Debug("Sending handshake response", "peer", peer)
@@ -186,11 +203,11 @@ func (peer *Peer) SendHandshakeResponse() error {
 	return err
 }
 
-func (transport *Transport) SendHandshakeCookie(initiatingElem *QueueHandshakeElement) error {
+func (transport *Transport) SendHandshakeCookie(cookieChecker *CookieChecker, initiatingElem *QueueHandshakeElement) error {
 	transport.log.Debug("Sending cookie response for denied handshake message for", "source", initiatingElem.endpoint.DstToString())
 
 	sender := binary.LittleEndian.Uint32(initiatingElem.packet[4:8])
-	reply, err := transport.cookieChecker.CreateReply(initiatingElem.packet, sender, initiatingElem.endpoint.DstToBytes())
+	reply, err := cookieChecker.CreateReply(initiatingElem.packet, sender, initiatingElem.endpoint.DstToBytes())
 	if err != nil {
 		transport.log.Error("Failed to create cookie reply", "error", err)
 		return err
@@ -214,21 +231,30 @@ func (peer *Peer) keepKeyFreshSending() error {
 	}
 
 	nonce := keypair.sendNonce.Load()
-	if nonce > RekeyAfterMessages || (keypair.isInitiator && time.Since(keypair.created) > RekeyAfterTime) {
+	if nonce > RekeyAfterMessages || (keypair.isInitiator && peer.transport.since(keypair.created) > peer.transport.rekeyAfterTime()) {
 		return peer.SendHandshakeInitiation(false)
 	}
 
 	return nil
 }
 
-func (transport *Transport) RoutineReadFromSourceSink() {
+// RoutineReadFromSourceSink reads outbound packets from the given queue of the
+// source sink (there is only one, unless it is a MultiQueueSourceSink).
+func (transport *Transport) RoutineReadFromSourceSink(queue int) {
 	defer func() {
-		transport.log.Debug("Routine: Source reader - stopped")
+		transport.log.Debug("Routine: Source reader - stopped", "queue", queue)
 		transport.state.stopping.Done()
 		transport.queue.encryption.wg.Done()
 	}()
 
-	transport.log.Debug("Routine: Source reader - started")
+	transport.log.Debug("Routine: Source reader - started", "queue", queue)
+
+	read := transport.sourceSink.Read
+	if multiQueue, ok := transport.sourceSink.(MultiQueueSourceSink); ok {
+		read = func(bufs [][]byte, sizes []int, destinations []NoisePublicKey, offset int) (int, error) {
+			return multiQueue.ReadQueue(queue, bufs, sizes, destinations, offset)
+		}
+	}
 
 	var (
 		batchSize   = transport.BatchSize()
@@ -258,7 +284,7 @@ func (transport *Transport) RoutineReadFromSourceSink() {
 
 	for {
 		// read packets
-		count, readErr = transport.sourceSink.Read(bufs, sizes, peers, offset)
+		count, readErr = read(bufs, sizes, peers, offset)
 		for i := 0; i < count; i++ {
 			if sizes[i] < 1 {
 				continue
@@ -287,9 +313,10 @@ func (transport *Transport) RoutineReadFromSourceSink() {
 		for peer, elemsForPeer := range elemsByPeer {
 			if peer.isRunning.Load() {
 				peer.StagePackets(elemsForPeer)
+				// The container now belongs to the staged queue, so it must be
+				// forgotten even if sending fails (eg. the peer has no endpoint yet).
 				if err := peer.SendStagedPackets(); err != nil {
 					transport.log.Warn("Failed to send staged packets", "error", err)
-					continue
 				}
 			} else {
 				for _, elem := range elemsForPeer.elems {
@@ -339,16 +366,24 @@ top:
 	}
 
 	keypair := peer.keypairs.Current()
-	if keypair == nil || keypair.sendNonce.Load() >= RejectAfterMessages || time.Since(keypair.created) >= RejectAfterTime {
+	if keypair == nil || keypair.sendNonce.Load() >= RejectAfterMessages || peer.transport.since(keypair.created) >= peer.transport.rejectAfterTime() {
 		return peer.SendHandshakeInitiation(false)
 	}
 
+	refusesData := peer.refusesData(keypair)
+
 	for {
 		var elemsContainerOOO *QueueOutboundElementsContainer
 		select {
 		case elemsContainer := <-peer.queue.staged:
 			i := 0
 			for _, elem := range elemsContainer.elems {
+				// Data is sent as a keepalive instead, so that the peer still
+				// confirms the session (and control packets are still sent).
+				if refusesData && !isControlPacket(elem.packet) {
+					elem.packet = elem.packet[:0]
+				}
+
 				elem.peer = peer
 				elem.nonce = keypair.sendNonce.Add(1) - 1
 				if elem.nonce >= RejectAfterMessages {
@@ -436,7 +471,9 @@ func calculatePaddingSize(packetSize, mtu int) int {
 func (transport *Transport) RoutineEncryption(id int) {
 	var paddingZeros [PaddingMultiple]byte
 	var nonce [chacha20poly1305.NonceSize]byte
+	var compressionScratch []byte
 
+	defer transport.queue.workers.Done()
 	defer transport.log.Debug("Routine: encryption worker - stopped", "id", id)
 	transport.log.Debug("Routine: encryption worker - started", "id", id)
 
@@ -453,8 +490,18 @@ func (transport *Transport) RoutineEncryption(id int) {
 			binary.LittleEndian.PutUint32(fieldReceiver, elem.keypair.remoteIndex)
 			binary.LittleEndian.PutUint64(fieldNonce, elem.nonce)
 
+			// compress content, if agreed with the peer
+			if len(elem.packet) > 0 && elem.keypair.remoteCompression.Load() && elem.peer.compression.Load() {
+				if compressionScratch == nil {
+					compressionScratch = make([]byte, snappy.MaxEncodedLen(MaxContentSize))
+				}
+				elem.peer.compressed.txUncompressed.Add(uint64(len(elem.packet)))
+				elem.packet = compressPacket(elem.packet, compressionScratch)
+				elem.peer.compressed.txCompressed.Add(uint64(len(elem.packet)))
+			}
+
 			// pad content to multiple of 16
-			paddingSize := calculatePaddingSize(len(elem.packet), DefaultMTU)
+			paddingSize := calculatePaddingSize(len(elem.packet), int(transport.mtu.Load()))
 			elem.packet = append(elem.packet, paddingZeros[:paddingSize]...)
 
 			// encrypt content and release to consumer
@@ -0,0 +1,163 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (c) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/noisysockets/noisysockets/internal/conn"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// sessionKeys are the keys of a keypair.
+type sessionKeys struct {
+	send    [chacha20poly1305.KeySize]byte
+	receive [chacha20poly1305.KeySize]byte
+}
+
+// SessionState is the current session of a peer, saved so that it can be
+// restored (eg. after a restart) without handshaking again. It holds the
+// session's keys, so must be kept secret.
+type SessionState struct {
+	PublicKey   NoisePublicKey
+	IsInitiator bool
+	Created     time.Time
+	LocalIndex  uint32
+	RemoteIndex uint32
+	SendKey     [chacha20poly1305.KeySize]byte
+	ReceiveKey  [chacha20poly1305.KeySize]byte
+	// SendNonce is the counter of the next packet to be sent.
+	SendNonce uint64
+	// ReceivedCounter is the highest counter received, everything up to, and
+	// including, it is rejected as a replay once restored.
+	ReceivedCounter uint64
+	// Endpoint is the peer's endpoint, if it was reached directly.
+	Endpoint string
+}
+
+// RetainSessions keeps the keys of sessions established from now on, so that
+// they can be saved when peers stop (see ExportSessions).
+func (transport *Transport) RetainSessions() {
+	transport.retainSessions.Store(true)
+}
+
+// ExportSessions returns the sessions that peers had when they were last
+// stopped (eg. by taking the transport down), sessions are only saved if they
+// are retained (see RetainSessions) and haven't expired.
+func (transport *Transport) ExportSessions() []SessionState {
+	transport.peers.RLock()
+	defer transport.peers.RUnlock()
+
+	var sessions []SessionState
+	for _, peer := range transport.peers.keyMap {
+		peer.state.Lock()
+		if peer.state.saved != nil {
+			sessions = append(sessions, *peer.state.saved)
+		}
+		peer.state.Unlock()
+	}
+
+	return sessions
+}
+
+// ImportSession restores the session of a peer that is yet to be started, so
+// that packets can be exchanged with it straight away.
+func (transport *Transport) ImportSession(session *SessionState) error {
+	peer := transport.LookupPeer(session.PublicKey)
+	if peer == nil {
+		return fmt.Errorf("unknown peer %s", session.PublicKey)
+	}
+
+	if transport.since(session.Created) >= transport.rejectAfterTime() || session.SendNonce >= RejectAfterMessages {
+		return errors.New("session expired")
+	}
+
+	peer.state.Lock()
+	defer peer.state.Unlock()
+
+	if peer.isRunning.Load() {
+		return errors.New("peer already started")
+	}
+
+	keypair := new(Keypair)
+	keypair.send, _ = chacha20poly1305.New(session.SendKey[:])
+	keypair.receive, _ = chacha20poly1305.New(session.ReceiveKey[:])
+	if transport.retainSessions.Load() {
+		keypair.keys = &sessionKeys{send: session.SendKey, receive: session.ReceiveKey}
+	}
+	keypair.sendNonce.Store(session.SendNonce)
+	keypair.replayFilter.Restore(session.ReceivedCounter)
+	keypair.isInitiator = session.IsInitiator
+	keypair.created = session.Created
+	keypair.localIndex = session.LocalIndex
+	keypair.remoteIndex = session.RemoteIndex
+
+	if !transport.indexTable.InsertKeypair(session.LocalIndex, peer, keypair) {
+		return errors.New("session index already in use")
+	}
+
+	keypairs := &peer.keypairs
+	keypairs.Lock()
+	transport.DeleteKeypair(keypairs.current)
+	keypairs.current = keypair
+	keypairs.Unlock()
+
+	peer.lastHandshakeNano.Store(session.Created.UnixNano())
+
+	if session.Endpoint != "" {
+		peer.endpoint.Lock()
+		if peer.endpoint.val == nil {
+			transport.net.RLock()
+			endpoint, err := transport.net.bind.ParseEndpoint(session.Endpoint)
+			transport.net.RUnlock()
+			if err == nil {
+				peer.endpoint.val = endpoint
+				peer.endpoint.direct = endpoint
+			}
+		}
+		peer.endpoint.Unlock()
+	}
+
+	return nil
+}
+
+// saveSession returns the peer's current session, if it can be restored.
+// Must hold peer.state, with the peer's routines stopped.
+func (peer *Peer) saveSession() *SessionState {
+	keypair := peer.keypairs.Current()
+	if keypair == nil || keypair.keys == nil {
+		return nil
+	}
+
+	nonce := keypair.sendNonce.Load()
+	if nonce >= RejectAfterMessages || peer.transport.since(keypair.created) >= peer.transport.rejectAfterTime() {
+		return nil
+	}
+
+	session := &SessionState{
+		PublicKey:       peer.pk,
+		IsInitiator:     keypair.isInitiator,
+		Created:         keypair.created,
+		LocalIndex:      keypair.localIndex,
+		RemoteIndex:     keypair.remoteIndex,
+		SendKey:         keypair.keys.send,
+		ReceiveKey:      keypair.keys.receive,
+		SendNonce:       nonce,
+		ReceivedCounter: keypair.replayFilter.Last(),
+	}
+
+	peer.endpoint.Lock()
+	if peer.endpoint.val != nil {
+		if _, relayed := peer.endpoint.val.(*conn.RelayEndpoint); !relayed {
+			session.Endpoint = peer.endpoint.val.DstToString()
+		}
+	}
+	peer.endpoint.Unlock()
+
+	return session
+}
@@ -31,3 +31,43 @@ type SourceSink interface {
 	// lifetime of a Transport.
 	BatchSize() int
 }
+
+// Packet is memory, allocated by a PacketSourceSink, that an inbound packet is
+// decrypted into.
+type Packet interface {
+	// AsSlice returns the contents of the packet.
+	AsSlice() []byte
+	// Release frees the packet, if it isn't written to the source sink.
+	Release()
+}
+
+// PacketSourceSink is implemented by source sinks that allocate the memory
+// inbound packets are decrypted into, so that packets are handed over without
+// being copied.
+type PacketSourceSink interface {
+	SourceSink
+
+	// NewPacket returns a packet, of size bytes, to decrypt an inbound packet
+	// into.
+	NewPacket(size int) Packet
+
+	// WritePackets writes packets allocated by NewPacket, taking ownership of
+	// them (they must not be used, or released, afterwards). It returns the
+	// number of packets written.
+	WritePackets(pkts []Packet, sources []NoisePublicKey) (int, error)
+}
+
+// MultiQueueSourceSink is implemented by source sinks that spread their
+// outbound packets across several queues, so that they can be read in
+// parallel. All the packets to a peer are read from the same queue, so that
+// they stay in order.
+type MultiQueueSourceSink interface {
+	SourceSink
+
+	// Queues returns the number of queues, the transport reads each from its
+	// own goroutine. Queues must not change over the lifetime of a Transport.
+	Queues() int
+
+	// ReadQueue is like Read, but only reads packets from the given queue.
+	ReadQueue(queue int, bufs [][]byte, sizes []int, destinations []NoisePublicKey, offset int) (int, error)
+}
@@ -7,9 +7,12 @@
 package transport
 
 import (
+	"fmt"
 	"sync"
 	"time"
 	_ "unsafe"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
 )
 
 //go:linkname fastrandn runtime.fastrandn
@@ -18,7 +21,7 @@ func fastrandn(n uint32) uint32
 // A Timer manages time-based aspects of the WireGuard protocol.
 // Timer roughly copies the interface of the Linux kernel's struct timer_list.
 type Timer struct {
-	*time.Timer
+	tcpip.Timer
 	modifyingLock sync.RWMutex
 	runningLock   sync.Mutex
 	isPending     bool
@@ -26,7 +29,7 @@ type Timer struct {
 
 func (peer *Peer) NewTimer(expirationFunction func(*Peer)) *Timer {
 	timer := &Timer{}
-	timer.Timer = time.AfterFunc(time.Hour, func() {
+	timer.Timer = peer.transport.clock.AfterFunc(time.Hour, func() {
 		timer.runningLock.Lock()
 		defer timer.runningLock.Unlock()
 
@@ -76,9 +79,13 @@ func (peer *Peer) timersActive() bool {
 }
 
 func expiredRetransmitHandshake(peer *Peer) {
-	if peer.timers.handshakeAttempts.Load() > MaxTimerHandshakes {
+	peer.handshakesFailed.Add(1)
+
+	if peer.timers.handshakeAttempts.Load() > peer.transport.maxTimerHandshakes() {
 		peer.transport.log.Error("Handshake did not complete after multiple attempts, giving up",
-			"peer", peer, "maxAttempts", MaxTimerHandshakes+2)
+			"peer", peer, "maxAttempts", peer.transport.maxTimerHandshakes()+2)
+
+		peer.emitEvent(PeerEventUnreachable, peer.currentEndpoint())
 
 		if peer.timersActive() {
 			peer.timers.sendKeepalive.Del()
@@ -93,12 +100,14 @@ func expiredRetransmitHandshake(peer *Peer) {
 		 * of a partial exchange.
 		 */
 		if peer.timersActive() && !peer.timers.zeroKeyMaterial.IsPending() {
-			peer.timers.zeroKeyMaterial.Mod(RejectAfterTime * 3)
+			peer.timers.zeroKeyMaterial.Mod(peer.transport.rejectAfterTime() * 3)
 		}
 	} else {
 		peer.timers.handshakeAttempts.Add(1)
 		peer.transport.log.Warn("Handshake did not complete within timeout, retrying",
-			"peer", peer, "timeout", int(RekeyTimeout.Seconds()), "try", peer.timers.handshakeAttempts.Load()+1)
+			"peer", peer, "timeout", int(peer.transport.rekeyTimeout().Seconds()), "try", peer.timers.handshakeAttempts.Load()+1)
+
+		peer.fallBackToRelay()
 
 		if err := peer.SendHandshakeInitiation(true); err != nil {
 			peer.transport.log.Error("Failed to retransmit handshake initiation",
@@ -123,17 +132,68 @@ func expiredSendKeepalive(peer *Peer) {
 
 func expiredNewHandshake(peer *Peer) {
 	peer.transport.log.Debug("Retrying handshake because we stopped hearing back",
-		"peer", peer, "timeout", int((KeepaliveTimeout + RekeyTimeout).Seconds()))
+		"peer", peer, "timeout", int((KeepaliveTimeout + peer.transport.rekeyTimeout()).Seconds()))
 	if err := peer.SendHandshakeInitiation(false); err != nil {
 		peer.transport.log.Error("Failed to retransmit handshake initiation",
 			"peer", peer, "error", err)
 	}
 }
 
+func expiredPostQuantumHandshake(peer *Peer) {
+	// Without waiting for the usual rate limit, the current session only just
+	// began.
+	peer.handshake.mutex.Lock()
+	peer.handshake.lastSentHandshake = peer.transport.clock.Now().Add(-(peer.transport.rekeyTimeout() + time.Second))
+	peer.handshake.mutex.Unlock()
+
+	peer.transport.log.Debug("Initiating handshake with post-quantum shared secret", "peer", peer)
+	if err := peer.SendHandshakeInitiation(false); err != nil {
+		peer.transport.log.Error("Failed to send handshake initiation",
+			"peer", peer, "error", err)
+	}
+}
+
 func expiredZeroKeyMaterial(peer *Peer) {
 	peer.transport.log.Debug("Removing all keys, since we haven't received a new one in time",
-		"peer", peer, "timeout", int((RejectAfterTime * 3).Seconds()))
+		"peer", peer, "timeout", int((peer.transport.rejectAfterTime() * 3).Seconds()))
+	peer.ZeroAndFlushAll()
+	peer.forgetHybrid()
+}
+
+func expiredIdleSession(peer *Peer) {
+	timeout := time.Duration(peer.idleTimeout.Load())
+	if timeout == 0 {
+		return
+	}
+
+	// Rather than resetting the timer for every packet, check whether there
+	// was any data since it was set.
+	idle := peer.transport.clock.Now().Sub(time.Unix(0, peer.lastDataNano.Load()))
+	if idle < timeout {
+		if peer.timersActive() {
+			peer.timers.idleSession.Mod(timeout - idle)
+		}
+		return
+	}
+
+	peer.transport.log.Debug("Removing all keys, since the session has been idle",
+		"peer", peer, "timeout", int(timeout.Seconds()))
+
+	// The peer's remaining timers would only keep the session alive, or try
+	// to re-establish it.
+	peer.timers.retransmitHandshake.Del()
+	peer.timers.sendKeepalive.Del()
+	peer.timers.newHandshake.Del()
+	peer.timers.postQuantumHandshake.Del()
+	peer.timers.zeroKeyMaterial.Del()
+	peer.timers.persistentKeepalive.Del()
+
 	peer.ZeroAndFlushAll()
+
+	// So that traffic for the peer can make a new handshake straight away.
+	peer.handshake.mutex.Lock()
+	peer.handshake.lastSentHandshake = peer.transport.clock.Now().Add(-(peer.transport.rekeyTimeout() + time.Second))
+	peer.handshake.mutex.Unlock()
 }
 
 func expiredPersistentKeepalive(peer *Peer) {
@@ -147,13 +207,15 @@ func expiredPersistentKeepalive(peer *Peer) {
 
 /* Should be called after an authenticated data packet is sent. */
 func (peer *Peer) timersDataSent() {
+	peer.lastDataNano.Store(peer.transport.clock.Now().UnixNano())
 	if peer.timersActive() && !peer.timers.newHandshake.IsPending() {
-		peer.timers.newHandshake.Mod(KeepaliveTimeout + RekeyTimeout + time.Millisecond*time.Duration(fastrandn(RekeyTimeoutJitterMaxMs)))
+		peer.timers.newHandshake.Mod(KeepaliveTimeout + peer.transport.rekeyTimeout() + time.Millisecond*time.Duration(fastrandn(RekeyTimeoutJitterMaxMs)))
 	}
 }
 
 /* Should be called after an authenticated data packet is received. */
 func (peer *Peer) timersDataReceived() {
+	peer.lastDataNano.Store(peer.transport.clock.Now().UnixNano())
 	if peer.timersActive() {
 		if !peer.timers.sendKeepalive.IsPending() {
 			peer.timers.sendKeepalive.Mod(KeepaliveTimeout)
@@ -180,7 +242,7 @@ func (peer *Peer) timersAnyAuthenticatedPacketReceived() {
 /* Should be called after a handshake initiation message is sent. */
 func (peer *Peer) timersHandshakeInitiated() {
 	if peer.timersActive() {
-		peer.timers.retransmitHandshake.Mod(RekeyTimeout + time.Millisecond*time.Duration(fastrandn(RekeyTimeoutJitterMaxMs)))
+		peer.timers.retransmitHandshake.Mod(peer.transport.rekeyTimeout() + time.Millisecond*time.Duration(fastrandn(RekeyTimeoutJitterMaxMs)))
 	}
 }
 
@@ -191,13 +253,23 @@ func (peer *Peer) timersHandshakeComplete() {
 	}
 	peer.timers.handshakeAttempts.Store(0)
 	peer.timers.sentLastMinuteHandshake.Store(false)
-	peer.lastHandshakeNano.Store(time.Now().UnixNano())
+	peer.lastHandshakeNano.Store(peer.transport.clock.Now().UnixNano())
+
+	// Handshakes (eg. due to persistent keepalives) don't keep a session alive.
+	if timeout := peer.idleTimeout.Load(); timeout > 0 && peer.timersActive() && !peer.timers.idleSession.IsPending() {
+		peer.timers.idleSession.Mod(time.Duration(timeout))
+	}
+	peer.handshakesCompleted.Add(1)
+
+	peer.transport.log.Debug("Handshake completed", "peer", peer)
+
+	peer.emitEvent(PeerEventHandshakeCompleted, peer.currentEndpoint())
 }
 
 /* Should be called after an ephemeral key is created, which is before sending a handshake response or after receiving a handshake response. */
 func (peer *Peer) timersSessionDerived() {
 	if peer.timersActive() {
-		peer.timers.zeroKeyMaterial.Mod(RejectAfterTime * 3)
+		peer.timers.zeroKeyMaterial.Mod(peer.transport.rejectAfterTime() * 3)
 	}
 }
 
@@ -213,8 +285,10 @@ func (peer *Peer) timersInit() {
 	peer.timers.retransmitHandshake = peer.NewTimer(expiredRetransmitHandshake)
 	peer.timers.sendKeepalive = peer.NewTimer(expiredSendKeepalive)
 	peer.timers.newHandshake = peer.NewTimer(expiredNewHandshake)
+	peer.timers.postQuantumHandshake = peer.NewTimer(expiredPostQuantumHandshake)
 	peer.timers.zeroKeyMaterial = peer.NewTimer(expiredZeroKeyMaterial)
 	peer.timers.persistentKeepalive = peer.NewTimer(expiredPersistentKeepalive)
+	peer.timers.idleSession = peer.NewTimer(expiredIdleSession)
 }
 
 func (peer *Peer) timersStart() {
@@ -227,6 +301,123 @@ func (peer *Peer) timersStop() {
 	peer.timers.retransmitHandshake.DelSync()
 	peer.timers.sendKeepalive.DelSync()
 	peer.timers.newHandshake.DelSync()
+	peer.timers.postQuantumHandshake.DelSync()
 	peer.timers.zeroKeyMaterial.DelSync()
 	peer.timers.persistentKeepalive.DelSync()
+	peer.timers.idleSession.DelSync()
+}
+
+const (
+	minHandshakeRetry = time.Second
+	maxHandshakeRetry = time.Minute
+	minRekeyAfter     = 30 * time.Second
+	maxRekeyAfter     = time.Hour
+	// maxRejectAfterGrace is how much longer than RekeyAfter a session's keys
+	// can be used for.
+	maxRejectAfterGrace = time.Hour
+)
+
+// Timers are the handshake, and rekey, timers of the protocol. They can be
+// adjusted, eg. so that constrained deployments (satellite links, battery
+// powered devices) can trade latency for fewer packets. Zero values are the
+// defaults of the WireGuard specification.
+type Timers struct {
+	// HandshakeRetry is how long to wait for a response to a handshake
+	// initiation before it is retried (RekeyTimeout).
+	HandshakeRetry time.Duration
+	// RekeyAfter is how old a session can get before the initiator starts a
+	// new handshake (RekeyAfterTime).
+	RekeyAfter time.Duration
+	// RejectAfter is how old a session can get before its keys are no longer
+	// used (RejectAfterTime).
+	RejectAfter time.Duration
+}
+
+// DefaultTimers returns the timers of the WireGuard specification.
+func DefaultTimers() Timers {
+	return Timers{
+		HandshakeRetry: RekeyTimeout,
+		RekeyAfter:     RekeyAfterTime,
+		RejectAfter:    RejectAfterTime,
+	}
+}
+
+// SetTimers adjusts the protocol's timers, zero values are replaced by their
+// defaults. The handshake retry interval must be between 1s and 1m, the rekey
+// time between 30s and 1h, and the reject time must leave enough time after
+// rekeying for the handshake to complete (but not exceed it by more than 1h).
+// Peers should use the same timers, as a session the peer is still using is
+// rejected once it is older than our reject time.
+func (transport *Transport) SetTimers(timers Timers) error {
+	defaults := DefaultTimers()
+	if timers.HandshakeRetry == 0 {
+		timers.HandshakeRetry = defaults.HandshakeRetry
+	}
+	if timers.RekeyAfter == 0 {
+		timers.RekeyAfter = defaults.RekeyAfter
+	}
+	if timers.RejectAfter == 0 {
+		timers.RejectAfter = defaults.RejectAfter
+	}
+
+	if timers.HandshakeRetry < minHandshakeRetry || timers.HandshakeRetry > maxHandshakeRetry {
+		return fmt.Errorf("handshake retry interval must be between %s and %s", minHandshakeRetry, maxHandshakeRetry)
+	}
+
+	if timers.RekeyAfter < minRekeyAfter || timers.RekeyAfter > maxRekeyAfter {
+		return fmt.Errorf("rekey after time must be between %s and %s", minRekeyAfter, maxRekeyAfter)
+	}
+
+	// The session is rekeyed, when data is received, this long before it is
+	// rejected.
+	minRejectAfter := timers.RekeyAfter + KeepaliveTimeout + timers.HandshakeRetry
+	if timers.RejectAfter < minRejectAfter || timers.RejectAfter > timers.RekeyAfter+maxRejectAfterGrace {
+		return fmt.Errorf("reject after time must be between %s and %s", minRejectAfter, timers.RekeyAfter+maxRejectAfterGrace)
+	}
+
+	transport.timers.Store(&timers)
+
+	return nil
+}
+
+// Timers returns the protocol's current timers.
+func (transport *Transport) Timers() Timers {
+	if timers := transport.timers.Load(); timers != nil {
+		return *timers
+	}
+
+	return DefaultTimers()
+}
+
+// rekeyTimeout is how long to wait for a response to a handshake initiation.
+func (transport *Transport) rekeyTimeout() time.Duration {
+	if timers := transport.timers.Load(); timers != nil {
+		return timers.HandshakeRetry
+	}
+
+	return RekeyTimeout
+}
+
+// rekeyAfterTime is how old a session can get before it is rekeyed.
+func (transport *Transport) rekeyAfterTime() time.Duration {
+	if timers := transport.timers.Load(); timers != nil {
+		return timers.RekeyAfter
+	}
+
+	return RekeyAfterTime
+}
+
+// rejectAfterTime is how old a session can get before its keys are rejected.
+func (transport *Transport) rejectAfterTime() time.Duration {
+	if timers := transport.timers.Load(); timers != nil {
+		return timers.RejectAfter
+	}
+
+	return RejectAfterTime
+}
+
+// maxTimerHandshakes is how many times a handshake is retried, so that it is
+// attempted for RekeyAttemptTime.
+func (transport *Transport) maxTimerHandshakes() uint32 {
+	return uint32(max(RekeyAttemptTime/transport.rekeyTimeout(), 1))
 }
@@ -7,6 +7,7 @@
 package transport
 
 import (
+	"encoding/binary"
 	"fmt"
 	"log/slog"
 	"runtime"
@@ -16,6 +17,7 @@ import (
 
 	"github.com/noisysockets/noisysockets/internal/conn"
 	"github.com/noisysockets/noisysockets/internal/ratelimiter"
+	"gvisor.dev/gvisor/pkg/tcpip"
 )
 
 type Transport struct {
@@ -49,6 +51,14 @@ type Transport struct {
 		sync.RWMutex
 		privateKey NoisePrivateKey
 		publicKey  NoisePublicKey
+		// previous is the keypair replaced by a key rotation, handshakes
+		// addressed to it are still accepted until it expires.
+		previous struct {
+			privateKey    NoisePrivateKey
+			publicKey     NoisePublicKey
+			cookieChecker CookieChecker
+			expiry        time.Time
+		}
 	}
 
 	peers struct {
@@ -59,6 +69,13 @@ type Transport struct {
 	rate struct {
 		underLoadUntil atomic.Int64
 		limiter        ratelimiter.Ratelimiter
+		// limits, if set, replaces the default handshake limits.
+		limits  atomic.Pointer[HandshakeLimits]
+		pending atomic.Int32 // handshake messages queued, or being processed
+
+		cookieReplies      atomic.Uint64
+		rateLimited        atomic.Uint64
+		concurrencyLimited atomic.Uint64
 	}
 
 	indexTable    IndexTable
@@ -76,12 +93,34 @@ type Transport struct {
 		encryption *outboundQueue
 		decryption *inboundQueue
 		handshake  *handshakeQueue
+		// workers blocks until the encryption, decryption, and handshake
+		// workers have stopped (once the queues are closed).
+		workers sync.WaitGroup
 	}
 
 	sourceSink SourceSink
+	// packetSink is the source sink, if it allocates inbound packets itself.
+	packetSink PacketSourceSink
+	mtu        atomic.Int32 // mtu of the source sink, packets are padded up to it
 
 	closed chan struct{}
 	log    *slog.Logger
+	// clock drives the protocol's timers (eg. handshake retransmission, and
+	// keepalives).
+	clock tcpip.Clock
+
+	// peerEvents, if set, is invoked with changes in the state of peers.
+	peerEvents atomic.Pointer[func(PeerEvent)]
+
+	// draining, if set, ignores handshakes that would establish new sessions.
+	draining atomic.Bool
+
+	// timers, if set, replaces the default handshake, and rekey, timers.
+	timers atomic.Pointer[Timers]
+
+	// retainSessions, if set, keeps the keys of sessions so that they can be
+	// saved when peers stop (see ExportSessions).
+	retainSessions atomic.Bool
 }
 
 // transportState represents the state of a Transport.
@@ -130,6 +169,14 @@ func (transport *Transport) isUp() bool {
 	return transport.transportState() == transportStateUp
 }
 
+// SetDraining sets whether the transport is draining (eg. before being closed).
+// While draining, handshake initiations from peers without a current session
+// are ignored, so no new sessions are established, but existing sessions are
+// still rekeyed.
+func (transport *Transport) SetDraining(draining bool) {
+	transport.draining.Store(draining)
+}
+
 // Must hold transport.peers.Lock()
 func removePeerLocked(transport *Transport, peer *Peer, key NoisePublicKey) {
 	// stop routing and processing of packets
@@ -180,12 +227,7 @@ func (transport *Transport) upLocked() error {
 
 	transport.peers.RLock()
 	for _, peer := range transport.peers.keyMap {
-		peer.Start()
-		if peer.persistentKeepaliveInterval.Load() > 0 {
-			if err := peer.SendKeepalive(); err != nil {
-				transport.log.Error("Failed to send keepalive", "peer", peer, "error", err)
-			}
-		}
+		peer.StartWithKeepalive()
 	}
 	transport.peers.RUnlock()
 	return nil
@@ -207,6 +249,11 @@ func (transport *Transport) downLocked() error {
 	return err
 }
 
+// IsUp reports whether the transport is up (or is attempting to come up).
+func (transport *Transport) IsUp() bool {
+	return transport.isUp()
+}
+
 func (transport *Transport) Up() error {
 	return transport.changeState(transportStateUp)
 }
@@ -217,8 +264,8 @@ func (transport *Transport) Down() error {
 
 func (transport *Transport) IsUnderLoad() bool {
 	// check if currently under load
-	now := time.Now()
-	underLoad := len(transport.queue.handshake.c) >= QueueHandshakeSize/8
+	now := transport.clock.Now()
+	underLoad := len(transport.queue.handshake.c) >= transport.HandshakeLimits().UnderLoadThreshold
 	if underLoad {
 		transport.rate.underLoadUntil.Store(now.Add(UnderLoadAfterTime).UnixNano())
 		return true
@@ -280,13 +327,121 @@ func (transport *Transport) SetPrivateKey(sk NoisePrivateKey) {
 	}
 }
 
+// RotatePrivateKey replaces the transport's private key without tearing down
+// existing sessions, which are renegotiated using the new key when they are
+// next rekeyed. Handshakes addressed to the previous key will continue to be
+// accepted for the grace period, giving peers time to learn the new public key.
+func (transport *Transport) RotatePrivateKey(sk NoisePrivateKey, gracePeriod time.Duration) {
+	transport.staticIdentity.Lock()
+	defer transport.staticIdentity.Unlock()
+
+	if sk.Equals(transport.staticIdentity.privateKey) {
+		return
+	}
+
+	transport.peers.Lock()
+	defer transport.peers.Unlock()
+
+	// remove peers with matching public keys
+
+	publicKey := sk.PublicKey()
+	for key, peer := range transport.peers.keyMap {
+		if peer.handshake.remoteStatic.Equals(publicKey) {
+			removePeerLocked(transport, peer, key)
+		}
+	}
+
+	// retain the previous key material for the grace period
+
+	previous := &transport.staticIdentity.previous
+	if gracePeriod > 0 && !transport.staticIdentity.privateKey.IsZero() {
+		previous.privateKey = transport.staticIdentity.privateKey
+		previous.publicKey = transport.staticIdentity.publicKey
+		previous.cookieChecker.Init(previous.publicKey)
+		previous.expiry = transport.clock.Now().Add(gracePeriod)
+	} else {
+		setZero(previous.privateKey[:])
+		previous.publicKey = NoisePublicKey{}
+		previous.expiry = time.Time{}
+	}
+
+	// update key material
+
+	transport.staticIdentity.privateKey = sk
+	transport.staticIdentity.publicKey = publicKey
+	transport.cookieChecker.Init(publicKey)
+
+	// do static-static DH pre-computations, current keypairs are left alone
+
+	for _, peer := range transport.peers.keyMap {
+		handshake := &peer.handshake
+		handshake.mutex.Lock()
+		handshake.precomputedStaticStatic, _ = transport.staticIdentity.privateKey.sharedSecret(handshake.remoteStatic)
+		handshake.mutex.Unlock()
+	}
+}
+
+// previousStaticIdentityValidLocked reports whether the keypair replaced by a
+// key rotation is still within its grace period. The caller must hold the
+// staticIdentity lock.
+func (transport *Transport) previousStaticIdentityValidLocked() bool {
+	return transport.clock.Now().Before(transport.staticIdentity.previous.expiry)
+}
+
+// cookieCheckerForMAC1 returns the cookie checker for the local public key the
+// handshake message is addressed to, or nil if its mac1 is invalid.
+func (transport *Transport) cookieCheckerForMAC1(msg []byte) *CookieChecker {
+	if transport.cookieChecker.CheckMAC1(msg) {
+		return &transport.cookieChecker
+	}
+
+	transport.staticIdentity.RLock()
+	defer transport.staticIdentity.RUnlock()
+
+	// Peers might not have learned of a key rotation yet.
+	if transport.previousStaticIdentityValidLocked() && transport.staticIdentity.previous.cookieChecker.CheckMAC1(msg) {
+		return &transport.staticIdentity.previous.cookieChecker
+	}
+
+	return nil
+}
+
+// IsAddressedTo reports whether a received message is addressed to this
+// transport, so that a bind shared by several transports can deliver it to the
+// right one. Handshake messages are matched by their mac1 (which is keyed by
+// our public key), everything else by the receiver index.
+func (transport *Transport) IsAddressedTo(packet []byte) bool {
+	msgType, err := messageType(packet)
+	if err != nil {
+		return false
+	}
+
+	switch msgType {
+	case MessageInitiationType, MessageResponseType:
+		return transport.cookieCheckerForMAC1(packet) != nil
+	}
+
+	receiver := binary.LittleEndian.Uint32(packet[MessageTransportOffsetReceiver:MessageTransportOffsetCounter])
+	return transport.indexTable.Lookup(receiver).peer != nil
+}
+
 func NewTransport(sourceSink SourceSink, bind conn.Bind, logger *slog.Logger) *Transport {
+	return NewTransportWithClock(sourceSink, bind, logger, tcpip.NewStdClock())
+}
+
+// NewTransportWithClock creates a transport whose timers are driven by the
+// given clock (eg. a fake clock, so that timing dependent behavior can be
+// tested deterministically).
+func NewTransportWithClock(sourceSink SourceSink, bind conn.Bind, logger *slog.Logger, clock tcpip.Clock) *Transport {
 	t := new(Transport)
 	t.state.state.Store(uint32(transportStateDown))
 	t.closed = make(chan struct{})
 	t.log = logger
+	t.clock = clock
 	t.net.bind = bind
 	t.sourceSink = sourceSink
+	t.packetSink, _ = sourceSink.(PacketSourceSink)
+	t.mtu.Store(DefaultMTU)
 	t.peers.keyMap = make(map[NoisePublicKey]*Peer)
 	t.rate.limiter.Init()
 	t.indexTable.Init()
@@ -304,19 +459,32 @@ func NewTransport(sourceSink SourceSink, bind conn.Bind, logger *slog.Logger) *T
 	cpus := runtime.NumCPU()
 	t.state.stopping.Wait()
 	t.queue.encryption.wg.Add(cpus) // One for each RoutineHandshake
+	t.queue.workers.Add(3 * cpus)
 	for i := 0; i < cpus; i++ {
 		go t.RoutineEncryption(i + 1)
 		go t.RoutineDecryption(i + 1)
 		go t.RoutineHandshake(i + 1)
 	}
 
-	t.state.stopping.Add(1)
-	t.queue.encryption.wg.Add(1)
-	go t.RoutineReadFromSourceSink()
+	readers := 1
+	if multiQueue, ok := sourceSink.(MultiQueueSourceSink); ok {
+		readers = multiQueue.Queues()
+	}
+
+	t.state.stopping.Add(readers)
+	t.queue.encryption.wg.Add(readers)
+	for i := 0; i < readers; i++ {
+		go t.RoutineReadFromSourceSink(i)
+	}
 
 	return t
 }
 
+// since returns the time elapsed since t, according to the transport's clock.
+func (transport *Transport) since(t time.Time) time.Duration {
+	return transport.clock.Now().Sub(t)
+}
+
 // BatchSize returns the BatchSize for the transport as a whole which is the max of
 // the bind batch size and the sink batch size. The batch size reported by transport
 // is the size used to construct memory pools, and is the allowed batch size for
@@ -330,6 +498,12 @@ func (transport *Transport) BatchSize() int {
 	return size
 }
 
+// SetMTU sets the MTU of the source sink, packets are padded to a multiple
+// of 16 bytes, but never beyond the MTU.
+func (transport *Transport) SetMTU(mtu int) {
+	transport.mtu.Store(int32(mtu))
+}
+
 func (transport *Transport) LookupPeer(pk NoisePublicKey) *Peer {
 	transport.peers.RLock()
 	defer transport.peers.RUnlock()
@@ -382,6 +556,8 @@ func (transport *Transport) Close() error {
 	transport.queue.decryption.wg.Done()
 	transport.queue.handshake.wg.Done()
 	transport.state.stopping.Wait()
+	// So that nothing is logged once the transport is closed.
+	transport.queue.workers.Wait()
 
 	if err := transport.rate.limiter.Close(); err != nil {
 		return fmt.Errorf("failed to close rate limiter: %w", err)
@@ -405,7 +581,7 @@ func (transport *Transport) SendKeepalivesToPeersWithCurrentKeypair() {
 	transport.peers.RLock()
 	for _, peer := range transport.peers.keyMap {
 		peer.keypairs.RLock()
-		sendKeepalive := peer.keypairs.current != nil && !peer.keypairs.current.created.Add(RejectAfterTime).Before(time.Now())
+		sendKeepalive := peer.keypairs.current != nil && !peer.keypairs.current.created.Add(transport.rejectAfterTime()).Before(transport.clock.Now())
 		peer.keypairs.RUnlock()
 		if sendKeepalive {
 			if err := peer.SendKeepalive(); err != nil {
@@ -490,3 +666,11 @@ func (transport *Transport) UpdatePort(port uint16) error {
 
 	return nil
 }
+
+// Port returns the port the bind is listening on (eg. when a random port was
+// requested), or zero if the bind is not open.
+func (transport *Transport) Port() uint16 {
+	transport.net.Lock()
+	defer transport.net.Unlock()
+	return transport.net.port
+}
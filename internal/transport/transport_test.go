@@ -0,0 +1,61 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (c) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package transport
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/noisysockets/noisysockets/internal/conn"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransport_Close(t *testing.T) {
+	h := &closedHandler{}
+	transport := NewTransport(&discardingSink{}, conn.NewStdNetBind(), slog.New(h))
+
+	sk, err := NewPrivateKey()
+	require.NoError(t, err)
+
+	transport.SetPrivateKey(sk)
+	require.NoError(t, transport.Up())
+
+	require.NoError(t, transport.Close())
+	h.closed.Store(true)
+
+	// Workers that outlive the transport would log after it is closed (eg.
+	// once a test's logger has gone away).
+	time.Sleep(100 * time.Millisecond)
+	require.Zero(t, h.afterClose.Load())
+}
+
+// closedHandler counts the records logged once closed is set.
+type closedHandler struct {
+	closed     atomic.Bool
+	afterClose atomic.Int64
+}
+
+func (h *closedHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (h *closedHandler) Handle(context.Context, slog.Record) error {
+	if h.closed.Load() {
+		h.afterClose.Add(1)
+	}
+	return nil
+}
+
+func (h *closedHandler) WithAttrs([]slog.Attr) slog.Handler {
+	return h
+}
+
+func (h *closedHandler) WithGroup(string) slog.Handler {
+	return h
+}
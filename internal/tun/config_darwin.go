@@ -0,0 +1,76 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package tun
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// AddRoutes routes the prefixes via the interface (using route(8)), replacing
+// any existing routes for them.
+func AddRoutes(name string, prefixes []netip.Prefix) error {
+	for _, prefix := range prefixes {
+		family := "-inet"
+		if prefix.Addr().Is6() {
+			family = "-inet6"
+		}
+
+		args := []string{"-q", "-n", "add", family, prefix.Masked().String(), "-interface", name}
+		if err := run("", "route", args...); err != nil {
+			// The route might already exist.
+			args[2] = "change"
+			if err := run("", "route", args...); err != nil {
+				return fmt.Errorf("could not add route %s: %w", prefix, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// SetDNS configures the DNS servers, and search domains, of the interface
+// (using scutil(8)). Names within the domains (or all names, if there are no
+// domains) are resolved using the servers. The configuration isn't removed
+// with the interface, so ResetDNS must be called when it is closed.
+func SetDNS(name string, servers []netip.Addr, domains []string) error {
+	addrs := make([]string, 0, len(servers))
+	for _, server := range servers {
+		addrs = append(addrs, server.String())
+	}
+
+	matchDomains := domains
+	if len(matchDomains) == 0 {
+		matchDomains = []string{`""`}
+	}
+
+	var script strings.Builder
+	script.WriteString("d.init\n")
+	fmt.Fprintf(&script, "d.add ServerAddresses * %s\n", strings.Join(addrs, " "))
+	if len(domains) > 0 {
+		fmt.Fprintf(&script, "d.add SearchDomains * %s\n", strings.Join(domains, " "))
+	}
+	fmt.Fprintf(&script, "d.add SupplementalMatchDomains * %s\n", strings.Join(matchDomains, " "))
+	fmt.Fprintf(&script, "set %s\n", dnsStateKey(name))
+
+	if err := run(script.String(), "scutil"); err != nil {
+		return fmt.Errorf("could not set dns configuration: %w", err)
+	}
+
+	return nil
+}
+
+// ResetDNS removes the DNS configuration of the interface.
+func ResetDNS(name string) error {
+	return run(fmt.Sprintf("remove %s\n", dnsStateKey(name)), "scutil")
+}
+
+// dnsStateKey returns the key, in the dynamic store, of the interface's DNS
+// configuration.
+func dnsStateKey(name string) string {
+	return "State:/Network/Service/noisysockets-" + name + "/DNS"
+}
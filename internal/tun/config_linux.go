@@ -0,0 +1,53 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package tun
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// AddRoutes routes the prefixes via the interface (using ip(8)), replacing
+// any existing routes for them.
+func AddRoutes(name string, prefixes []netip.Prefix) error {
+	for _, prefix := range prefixes {
+		family := "-4"
+		if prefix.Addr().Is6() {
+			family = "-6"
+		}
+
+		if err := run("", "ip", family, "route", "replace", prefix.Masked().String(), "dev", name); err != nil {
+			return fmt.Errorf("could not add route %s: %w", prefix, err)
+		}
+	}
+
+	return nil
+}
+
+// SetDNS configures the DNS servers, and search domains, of the interface
+// (using resolvectl(1), so systemd-resolved must be managing the host's DNS).
+// Names within the domains are resolved using the servers.
+func SetDNS(name string, servers []netip.Addr, domains []string) error {
+	args := []string{"dns", name}
+	for _, server := range servers {
+		args = append(args, server.String())
+	}
+
+	if err := run("", "resolvectl", args...); err != nil {
+		return fmt.Errorf("could not set dns servers: %w", err)
+	}
+
+	if err := run("", "resolvectl", append([]string{"domain", name}, domains...)...); err != nil {
+		return fmt.Errorf("could not set search domains: %w", err)
+	}
+
+	return nil
+}
+
+// ResetDNS removes the DNS configuration of the interface.
+func ResetDNS(name string) error {
+	return run("", "resolvectl", "revert", name)
+}
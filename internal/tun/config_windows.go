@@ -0,0 +1,75 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package tun
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// AddRoutes routes the prefixes via the interface (using netsh). The routes
+// are removed with the interface.
+func AddRoutes(name string, prefixes []netip.Prefix) error {
+	for _, prefix := range prefixes {
+		family := "ipv4"
+		if prefix.Addr().Is6() {
+			family = "ipv6"
+		}
+
+		if err := run("", "netsh", "interface", family, "add", "route", "prefix="+prefix.Masked().String(), "interface="+name, "store=active"); err != nil {
+			return fmt.Errorf("could not add route %s: %w", prefix, err)
+		}
+	}
+
+	return nil
+}
+
+// SetDNS configures the DNS servers of the interface (using netsh), and its
+// connection specific DNS suffix (using PowerShell). Windows only supports a
+// single suffix per interface, so only the first domain is used. The
+// configuration is removed with the interface.
+func SetDNS(name string, servers []netip.Addr, domains []string) error {
+	var index = map[string]int{}
+	for _, server := range servers {
+		family := "ipv4"
+		if server.Is6() {
+			family = "ipv6"
+		}
+		index[family]++
+
+		// The first server of each family replaces any existing ones.
+		args := []string{"interface", family, "add", "dnsservers", "name=" + name, "address=" + server.String(), "index=" + strconv.Itoa(index[family]), "validate=no"}
+		if index[family] == 1 {
+			args = []string{"interface", family, "set", "dnsservers", "name=" + name, "source=static", "address=" + server.String(), "register=none", "validate=no"}
+		}
+
+		if err := run("", "netsh", args...); err != nil {
+			return fmt.Errorf("could not set dns server %s: %w", server, err)
+		}
+	}
+
+	if len(domains) > 0 {
+		cmd := fmt.Sprintf("Set-DnsClient -InterfaceAlias %s -ConnectionSpecificSuffix %s", quotePowerShell(name), quotePowerShell(domains[0]))
+		if err := run("", "powershell", "-NoProfile", "-NonInteractive", "-Command", cmd); err != nil {
+			return fmt.Errorf("could not set dns suffix: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// ResetDNS removes the DNS configuration of the interface, there is nothing
+// to do as it is removed with the interface.
+func ResetDNS(name string) error {
+	return nil
+}
+
+// quotePowerShell quotes a string as a PowerShell literal.
+func quotePowerShell(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -0,0 +1,35 @@
+//go:build linux || darwin || windows
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package tun
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// run runs one of the platform's network configuration tools (eg. ip, route,
+// or netsh), with the given input, including its output in any error.
+func run(input string, name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	if input != "" {
+		cmd.Stdin = strings.NewReader(input)
+	}
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if out = bytes.TrimSpace(out); len(out) > 0 {
+			return fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, out)
+		}
+
+		return fmt.Errorf("%s %s: %w", name, strings.Join(args, " "), err)
+	}
+
+	return nil
+}
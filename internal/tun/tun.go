@@ -0,0 +1,24 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+// Package tun provides access to operating system TUN devices.
+package tun
+
+import "errors"
+
+// ErrNotSupported is returned when TUN devices are not supported on the current platform.
+var ErrNotSupported = errors.New("tun devices are not supported on this platform")
+
+// Device is a TUN device, it reads and writes raw IP packets.
+type Device interface {
+	// Name returns the name of the network interface.
+	Name() string
+	// Read reads a single packet into buf, starting at offset.
+	Read(buf []byte, offset int) (int, error)
+	// Write writes a single packet from buf, starting at offset.
+	Write(buf []byte, offset int) (int, error)
+	// Close closes the device, unblocking any pending reads.
+	Close() error
+}
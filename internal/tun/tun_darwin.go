@@ -0,0 +1,179 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package tun
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	utunControlName = "com.apple.net.utun_control"
+	// sysprotoControl is SYSPROTO_CONTROL, the protocol of kernel control
+	// sockets.
+	sysprotoControl = 2
+	// utunOptIfname is UTUN_OPT_IFNAME, the socket option holding the name of
+	// the interface.
+	utunOptIfname = 2
+	// utunHeaderSize is the size of the address family, that precedes each
+	// packet read from, or written to, a utun device.
+	utunHeaderSize = 4
+)
+
+type device struct {
+	name string
+	file *os.File
+}
+
+// Open creates a utun device with the given name (which must be of the form
+// utunN, the next free device is used if empty), brings it up and assigns it
+// the given IPv4 addresses. A route is installed for the subnet of each
+// address. IPv6 addresses, and routes to any other prefixes, must be
+// configured separately.
+func Open(name string, mtu int, addrs []netip.Prefix) (Device, error) {
+	// Units are numbered from one, zero asks for the next free unit.
+	var unit uint32
+	if name != "" {
+		n, err := strconv.ParseUint(strings.TrimPrefix(name, "utun"), 10, 32)
+		if err != nil || !strings.HasPrefix(name, "utun") {
+			return nil, fmt.Errorf("invalid interface name %q, must be of the form utunN", name)
+		}
+		unit = uint32(n) + 1
+	}
+
+	fd, err := unix.Socket(unix.AF_SYSTEM, unix.SOCK_DGRAM, sysprotoControl)
+	if err != nil {
+		return nil, fmt.Errorf("could not open control socket: %w", err)
+	}
+	unix.CloseOnExec(fd)
+
+	ctlInfo := &unix.CtlInfo{}
+	copy(ctlInfo.Name[:], utunControlName)
+	if err := unix.IoctlCtlInfo(fd, ctlInfo); err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("could not find utun control: %w", err)
+	}
+
+	if err := unix.Connect(fd, &unix.SockaddrCtl{ID: ctlInfo.Id, Unit: unit}); err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("could not create tun device: %w", err)
+	}
+
+	if err := unix.SetNonblock(fd, true); err != nil {
+		_ = unix.Close(fd)
+		return nil, err
+	}
+
+	ifname, err := unix.GetsockoptString(fd, sysprotoControl, utunOptIfname)
+	if err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("could not get interface name: %w", err)
+	}
+
+	// Using the runtime poller allows Close() to unblock pending reads.
+	dev := &device{
+		name: ifname,
+		file: os.NewFile(uintptr(fd), ifname),
+	}
+
+	if err := dev.configure(mtu, addrs); err != nil {
+		_ = dev.Close()
+		return nil, err
+	}
+
+	return dev, nil
+}
+
+func (d *device) Name() string {
+	return d.name
+}
+
+// Read reads a packet, the address family that precedes it is read into the
+// (at least 4 bytes) before offset.
+func (d *device) Read(buf []byte, offset int) (int, error) {
+	if offset < utunHeaderSize {
+		return 0, fmt.Errorf("offset must be at least %d bytes", utunHeaderSize)
+	}
+
+	n, err := d.file.Read(buf[offset-utunHeaderSize:])
+	if n < utunHeaderSize {
+		return 0, err
+	}
+
+	return n - utunHeaderSize, err
+}
+
+// Write writes a packet, the address family that must precede it is written
+// into the (at least 4 bytes) before offset.
+func (d *device) Write(buf []byte, offset int) (int, error) {
+	if offset < utunHeaderSize {
+		return 0, fmt.Errorf("offset must be at least %d bytes", utunHeaderSize)
+	}
+
+	if len(buf) <= offset {
+		return 0, nil
+	}
+
+	hdr := buf[offset-utunHeaderSize : offset]
+	hdr[0], hdr[1], hdr[2] = 0, 0, 0
+	switch buf[offset] >> 4 {
+	case 4:
+		hdr[3] = unix.AF_INET
+	case 6:
+		hdr[3] = unix.AF_INET6
+	default:
+		return 0, fmt.Errorf("invalid ip version")
+	}
+
+	n, err := d.file.Write(buf[offset-utunHeaderSize:])
+	if n < utunHeaderSize {
+		return 0, err
+	}
+
+	return n - utunHeaderSize, err
+}
+
+func (d *device) Close() error {
+	return d.file.Close()
+}
+
+func (d *device) configure(mtu int, addrs []netip.Prefix) error {
+	if err := run("", "ifconfig", d.name, "mtu", strconv.Itoa(mtu)); err != nil {
+		return fmt.Errorf("could not set mtu: %w", err)
+	}
+
+	var subnets []netip.Prefix
+	for _, addr := range addrs {
+		if !addr.Addr().Is4() {
+			continue
+		}
+
+		// Utun devices are point to point, so the local address is also the
+		// destination.
+		mask := net.IP(net.CIDRMask(addr.Bits(), 32)).String()
+		if err := run("", "ifconfig", d.name, "inet", addr.Addr().String(), addr.Addr().String(), "netmask", mask, "alias"); err != nil {
+			return fmt.Errorf("could not set address %s: %w", addr, err)
+		}
+
+		if addr.Bits() < 32 {
+			subnets = append(subnets, addr.Masked())
+		}
+	}
+
+	if err := run("", "ifconfig", d.name, "up"); err != nil {
+		return fmt.Errorf("could not bring interface up: %w", err)
+	}
+
+	// Unlike Linux, routes aren't installed for the subnets of point to point
+	// interfaces.
+	return AddRoutes(d.name, subnets)
+}
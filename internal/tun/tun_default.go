@@ -0,0 +1,30 @@
+//go:build !linux && !darwin && !windows
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package tun
+
+import "net/netip"
+
+// Open creates a TUN device.
+func Open(name string, mtu int, addrs []netip.Prefix) (Device, error) {
+	return nil, ErrNotSupported
+}
+
+// AddRoutes routes the prefixes via the interface.
+func AddRoutes(name string, prefixes []netip.Prefix) error {
+	return ErrNotSupported
+}
+
+// SetDNS configures the DNS servers, and search domains, of the interface.
+func SetDNS(name string, servers []netip.Addr, domains []string) error {
+	return ErrNotSupported
+}
+
+// ResetDNS removes the DNS configuration of the interface.
+func ResetDNS(name string) error {
+	return ErrNotSupported
+}
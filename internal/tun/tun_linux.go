@@ -0,0 +1,126 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package tun
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+const cloneDevicePath = "/dev/net/tun"
+
+type device struct {
+	name string
+	file *os.File
+}
+
+// Open creates a TUN device with the given name (a kernel generated name is
+// used if empty), brings it up and assigns it the given IPv4 addresses. The
+// kernel will install a route for the subnet of each address. IPv6 addresses,
+// and routes to any other prefixes, must be configured separately.
+func Open(name string, mtu int, addrs []netip.Prefix) (Device, error) {
+	fd, err := unix.Open(cloneDevicePath, unix.O_RDWR|unix.O_CLOEXEC|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s: %w", cloneDevicePath, err)
+	}
+
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("invalid interface name %q: %w", name, err)
+	}
+
+	ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI)
+	if err := unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("could not create tun device: %w", err)
+	}
+
+	// Using the runtime poller allows Close() to unblock pending reads.
+	dev := &device{
+		name: ifr.Name(),
+		file: os.NewFile(uintptr(fd), cloneDevicePath),
+	}
+
+	if err := dev.configure(mtu, addrs); err != nil {
+		_ = dev.Close()
+		return nil, err
+	}
+
+	return dev, nil
+}
+
+func (d *device) Name() string {
+	return d.name
+}
+
+func (d *device) Read(buf []byte, offset int) (int, error) {
+	return d.file.Read(buf[offset:])
+}
+
+func (d *device) Write(buf []byte, offset int) (int, error) {
+	return d.file.Write(buf[offset:])
+}
+
+func (d *device) Close() error {
+	return d.file.Close()
+}
+
+func (d *device) configure(mtu int, addrs []netip.Prefix) error {
+	// Interface configuration ioctls are issued against a socket.
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("could not open control socket: %w", err)
+	}
+	defer unix.Close(fd)
+
+	ifr, err := unix.NewIfreq(d.name)
+	if err != nil {
+		return err
+	}
+
+	ifr.SetUint32(uint32(mtu))
+	if err := unix.IoctlIfreq(fd, unix.SIOCSIFMTU, ifr); err != nil {
+		return fmt.Errorf("could not set mtu: %w", err)
+	}
+
+	for _, addr := range addrs {
+		if !addr.Addr().Is4() {
+			continue
+		}
+
+		if err := ifr.SetInet4Addr(addr.Addr().AsSlice()); err != nil {
+			return err
+		}
+
+		if err := unix.IoctlIfreq(fd, unix.SIOCSIFADDR, ifr); err != nil {
+			return fmt.Errorf("could not set address %s: %w", addr, err)
+		}
+
+		if err := ifr.SetInet4Addr(net.CIDRMask(addr.Bits(), 32)); err != nil {
+			return err
+		}
+
+		if err := unix.IoctlIfreq(fd, unix.SIOCSIFNETMASK, ifr); err != nil {
+			return fmt.Errorf("could not set netmask %s: %w", addr, err)
+		}
+	}
+
+	if err := unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifr); err != nil {
+		return fmt.Errorf("could not get interface flags: %w", err)
+	}
+
+	ifr.SetUint16(ifr.Uint16() | unix.IFF_UP | unix.IFF_RUNNING)
+	if err := unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifr); err != nil {
+		return fmt.Errorf("could not bring interface up: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,226 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package tun
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	// defaultName is the name of the adapter, if none is given.
+	defaultName = "noisysockets"
+	// tunnelType is the type of the adapter, shown in its description.
+	tunnelType = "NoisySockets"
+	// ringCapacity is the size of each of the session's rings (it must be a
+	// power of two between 128KiB and 64MiB).
+	ringCapacity = 8 << 20
+)
+
+// Wintun (https://www.wintun.net) provides the adapter, its DLL is loaded on
+// first use, and must be installed alongside the executable.
+var (
+	modwintun = windows.NewLazyDLL("wintun.dll")
+
+	procWintunCreateAdapter        = modwintun.NewProc("WintunCreateAdapter")
+	procWintunCloseAdapter         = modwintun.NewProc("WintunCloseAdapter")
+	procWintunStartSession         = modwintun.NewProc("WintunStartSession")
+	procWintunEndSession           = modwintun.NewProc("WintunEndSession")
+	procWintunGetReadWaitEvent     = modwintun.NewProc("WintunGetReadWaitEvent")
+	procWintunReceivePacket        = modwintun.NewProc("WintunReceivePacket")
+	procWintunReleaseReceivePacket = modwintun.NewProc("WintunReleaseReceivePacket")
+	procWintunAllocateSendPacket   = modwintun.NewProc("WintunAllocateSendPacket")
+	procWintunSendPacket           = modwintun.NewProc("WintunSendPacket")
+)
+
+type device struct {
+	name     string
+	adapter  uintptr
+	session  uintptr
+	readWait windows.Handle
+	// closing is signalled when the device is closed, to unblock reads.
+	closing   windows.Handle
+	closed    atomic.Bool
+	closeOnce sync.Once
+	// mu is held, for reading, while the session is in use.
+	mu sync.RWMutex
+}
+
+// Open creates a Wintun adapter with the given name (noisysockets if empty),
+// and assigns it the given IPv4 addresses. Windows will install a route for
+// the subnet of each address. IPv6 addresses, and routes to any other
+// prefixes, must be configured separately. The adapter is removed when the
+// device is closed.
+func Open(name string, mtu int, addrs []netip.Prefix) (Device, error) {
+	if err := modwintun.Load(); err != nil {
+		return nil, fmt.Errorf("could not load wintun.dll (it must be installed alongside the executable): %w", err)
+	}
+
+	if name == "" {
+		name = defaultName
+	}
+
+	name16, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid interface name %q: %w", name, err)
+	}
+
+	tunnelType16, err := windows.UTF16PtrFromString(tunnelType)
+	if err != nil {
+		return nil, err
+	}
+
+	adapter, _, err := procWintunCreateAdapter.Call(uintptr(unsafe.Pointer(name16)), uintptr(unsafe.Pointer(tunnelType16)), 0)
+	if adapter == 0 {
+		return nil, fmt.Errorf("could not create tun device: %w", err)
+	}
+
+	session, _, err := procWintunStartSession.Call(adapter, ringCapacity)
+	if session == 0 {
+		_, _, _ = procWintunCloseAdapter.Call(adapter)
+		return nil, fmt.Errorf("could not start session: %w", err)
+	}
+
+	readWait, _, _ := procWintunGetReadWaitEvent.Call(session)
+
+	closing, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		_, _, _ = procWintunEndSession.Call(session)
+		_, _, _ = procWintunCloseAdapter.Call(adapter)
+		return nil, err
+	}
+
+	dev := &device{
+		name:     name,
+		adapter:  adapter,
+		session:  session,
+		readWait: windows.Handle(readWait),
+		closing:  closing,
+	}
+
+	if err := dev.configure(mtu, addrs); err != nil {
+		_ = dev.Close()
+		return nil, err
+	}
+
+	return dev, nil
+}
+
+func (d *device) Name() string {
+	return d.name
+}
+
+func (d *device) Read(buf []byte, offset int) (int, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for {
+		if d.closed.Load() {
+			return 0, os.ErrClosed
+		}
+
+		var size uint32
+		packet, _, err := procWintunReceivePacket.Call(d.session, uintptr(unsafe.Pointer(&size)))
+		if packet != 0 {
+			n := copy(buf[offset:], unsafe.Slice(*(**byte)(unsafe.Pointer(&packet)), size))
+			_, _, _ = procWintunReleaseReceivePacket.Call(d.session, packet)
+			return n, nil
+		}
+
+		switch {
+		case errors.Is(err, windows.ERROR_NO_MORE_ITEMS):
+			if _, err := windows.WaitForMultipleObjects([]windows.Handle{d.readWait, d.closing}, false, windows.INFINITE); err != nil {
+				return 0, fmt.Errorf("could not wait for packets: %w", err)
+			}
+		case errors.Is(err, windows.ERROR_HANDLE_EOF):
+			return 0, os.ErrClosed
+		default:
+			return 0, fmt.Errorf("could not receive packet: %w", err)
+		}
+	}
+}
+
+func (d *device) Write(buf []byte, offset int) (int, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.closed.Load() {
+		return 0, os.ErrClosed
+	}
+
+	pkt := buf[offset:]
+
+	packet, _, err := procWintunAllocateSendPacket.Call(d.session, uintptr(len(pkt)))
+	if packet == 0 {
+		// Like the kernel's queues, packets are dropped when the ring is full.
+		if errors.Is(err, windows.ERROR_BUFFER_OVERFLOW) {
+			return 0, nil
+		}
+
+		return 0, fmt.Errorf("could not allocate packet: %w", err)
+	}
+
+	n := copy(unsafe.Slice(*(**byte)(unsafe.Pointer(&packet)), len(pkt)), pkt)
+	_, _, _ = procWintunSendPacket.Call(d.session, packet)
+
+	return n, nil
+}
+
+func (d *device) Close() error {
+	d.closeOnce.Do(func() {
+		d.closed.Store(true)
+		_ = windows.SetEvent(d.closing)
+
+		// Wait for pending reads, and writes, to finish with the session.
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		_, _, _ = procWintunEndSession.Call(d.session)
+		_, _, _ = procWintunCloseAdapter.Call(d.adapter)
+		_ = windows.CloseHandle(d.closing)
+	})
+
+	return nil
+}
+
+func (d *device) configure(mtu int, addrs []netip.Prefix) error {
+	if err := run("", "netsh", "interface", "ipv4", "set", "subinterface", d.name, "mtu="+strconv.Itoa(mtu), "store=active"); err != nil {
+		return fmt.Errorf("could not set mtu: %w", err)
+	}
+
+	first := true
+	for _, addr := range addrs {
+		if !addr.Addr().Is4() {
+			continue
+		}
+
+		mask := net.IP(net.CIDRMask(addr.Bits(), 32)).String()
+
+		// The first address replaces the adapter's (DHCP) configuration.
+		verb, source := "add", []string{}
+		if first {
+			verb, source = "set", []string{"source=static"}
+		}
+		first = false
+
+		args := append([]string{"interface", "ipv4", verb, "address", "name=" + d.name}, source...)
+		args = append(args, "address="+addr.Addr().String(), "mask="+mask, "store=active")
+		if err := run("", "netsh", args...); err != nil {
+			return fmt.Errorf("could not set address %s: %w", addr, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,459 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+)
+
+const (
+	// introductionPort is the UDP port, on each socket's addresses, on which
+	// introductions are requested from, and made by, mutual peers.
+	introductionPort = 51822
+	// introductionInterval is the minimum time between introduction requests
+	// for a peer, and between introductions of the same pair of peers.
+	introductionInterval = 10 * time.Second
+	// punchDelay is how long one of a pair of introduced peers waits, before
+	// punching holes to the other.
+	punchDelay = 250 * time.Millisecond
+)
+
+const (
+	// introductionTypeRequest asks an introducer to introduce us to a peer.
+	introductionTypeRequest = "request"
+	// introductionTypeIntroduction tells a peer about the candidate endpoints
+	// of another peer, that is about to punch holes to it.
+	introductionTypeIntroduction = "introduction"
+)
+
+// introductionMessage is exchanged, through the tunnel, with introducers.
+type introductionMessage struct {
+	Type string `json:"type"`
+	// PublicKey is the public key of the peer to be introduced to (in a
+	// request), or that is being introduced.
+	PublicKey string `json:"publicKey"`
+	// Endpoints are candidate endpoints, in a request they are our own (eg.
+	// discovered by STUN), in an introduction they are the introduced peer's.
+	Endpoints []string `json:"endpoints,omitempty"`
+}
+
+// introductions asks mutual peers (introducers) to introduce us to peers we
+// can't reach, and introduces peers to each other (if IntroducePeers is set).
+// An introduction tells both peers about each other's endpoints, at the same
+// time, so that their handshake initiations punch holes through their NATs.
+type introductions struct {
+	logger         *slog.Logger
+	s              *NoisySocket
+	introducePeers bool
+	pc             net.PacketConn
+	pending        chan transport.NoisePublicKey
+	ctx            context.Context
+	cancel         context.CancelFunc
+	wg             sync.WaitGroup
+
+	mu         sync.Mutex // protects requested and introduced
+	requested  map[transport.NoisePublicKey]time.Time
+	introduced map[[2]transport.NoisePublicKey]time.Time
+}
+
+// introductionsEnabled returns whether the configuration makes use of
+// introductions.
+func introductionsEnabled(conf *v1alpha1.Config) bool {
+	return conf.IntroducePeers || slices.ContainsFunc(conf.Peers, func(peerConf v1alpha1.WireGuardPeerConfig) bool {
+		return peerConf.Introducer
+	})
+}
+
+func newIntroductions(logger *slog.Logger, s *NoisySocket, introducePeers bool) (*introductions, error) {
+	pc, err := s.ListenPacket("udp", net.JoinHostPort("", strconv.Itoa(introductionPort)))
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	in := &introductions{
+		logger:         logger,
+		s:              s,
+		introducePeers: introducePeers,
+		pc:             pc,
+		pending:        make(chan transport.NoisePublicKey, 16),
+		ctx:            ctx,
+		cancel:         cancel,
+		requested:      make(map[transport.NoisePublicKey]time.Time),
+		introduced:     make(map[[2]transport.NoisePublicKey]time.Time),
+	}
+
+	in.wg.Add(2)
+	go in.run()
+	go in.receive()
+
+	return in, nil
+}
+
+// Close stops requesting, and making, introductions.
+func (in *introductions) Close() error {
+	in.cancel()
+	err := in.pc.Close()
+	in.wg.Wait()
+	return err
+}
+
+// handshakeInitiated is called when a handshake initiation is sent to a peer,
+// it must not block.
+func (in *introductions) handshakeInitiated(pk transport.NoisePublicKey) {
+	select {
+	case in.pending <- pk:
+	default:
+		// We'll be asked again when the handshake is retried.
+	}
+}
+
+func (in *introductions) run() {
+	defer in.wg.Done()
+
+	ticker := time.NewTicker(introductionInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-in.ctx.Done():
+			return
+		case pk := <-in.pending:
+			in.request(pk)
+		case <-ticker.C:
+			in.expire()
+		}
+	}
+}
+
+// expire forgets requests, and introductions, that are no longer rate limited.
+func (in *introductions) expire() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	for pk, t := range in.requested {
+		if time.Since(t) >= introductionInterval {
+			delete(in.requested, pk)
+		}
+	}
+
+	for pair, t := range in.introduced {
+		if time.Since(t) >= introductionInterval {
+			delete(in.introduced, pair)
+		}
+	}
+}
+
+// request asks each of our introducers, with which we have a session, to
+// introduce us to a peer we are trying to reach.
+func (in *introductions) request(pk transport.NoisePublicKey) {
+	if in.isIntroducer(pk) || in.hasSession(pk) {
+		return
+	}
+
+	in.mu.Lock()
+	if time.Since(in.requested[pk]) < introductionInterval {
+		in.mu.Unlock()
+		return
+	}
+	in.requested[pk] = time.Now()
+	in.mu.Unlock()
+
+	msg := introductionMessage{
+		Type:      introductionTypeRequest,
+		PublicKey: pk.String(),
+	}
+	if in.s.endpointDiscovery != nil {
+		for _, endpoint := range in.s.endpointDiscovery.Endpoints() {
+			msg.Endpoints = append(msg.Endpoints, endpoint.String())
+		}
+	}
+
+	for _, introducerPk := range in.introducers(pk) {
+		in.logger.Debug("Requesting introduction", "peer", pk.String(), "introducer", introducerPk.String())
+
+		in.send(introducerPk, &msg)
+	}
+}
+
+// canIntroduce returns whether one of our introducers could introduce us to
+// the peer.
+func (in *introductions) canIntroduce(pk transport.NoisePublicKey) bool {
+	return !in.isIntroducer(pk) && len(in.introducers(pk)) > 0
+}
+
+// introducers returns the introducers, with which we have a session, that
+// could introduce us to the peer.
+func (in *introductions) introducers(pk transport.NoisePublicKey) []transport.NoisePublicKey {
+	in.s.peerConfigsMu.Lock()
+	var candidates []transport.NoisePublicKey
+	for introducerPk, peerConf := range in.s.peerConfigs {
+		if peerConf.Introducer && introducerPk != pk {
+			candidates = append(candidates, introducerPk)
+		}
+	}
+	in.s.peerConfigsMu.Unlock()
+
+	// Don't trigger handshakes with introducers we aren't talking to.
+	var introducers []transport.NoisePublicKey
+	for _, introducerPk := range candidates {
+		if in.hasSession(introducerPk) {
+			introducers = append(introducers, introducerPk)
+		}
+	}
+
+	return introducers
+}
+
+// receive handles requests from peers, and introductions from introducers.
+func (in *introductions) receive() {
+	defer in.wg.Done()
+
+	buf := make([]byte, transport.DefaultMTU)
+	for {
+		n, addr, err := in.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		identity := in.s.peerIdentity(addr)
+		if identity.publicKey.IsZero() {
+			continue
+		}
+
+		var msg introductionMessage
+		if err := json.Unmarshal(buf[:n], &msg); err != nil {
+			in.logger.Debug("Ignoring invalid introduction message", "peer", addr, "error", err)
+			continue
+		}
+
+		var pk transport.NoisePublicKey
+		if err := pk.FromString(msg.PublicKey); err != nil || pk == identity.publicKey {
+			in.logger.Debug("Ignoring introduction message with invalid public key", "peer", addr)
+			continue
+		}
+
+		candidates := parseCandidateEndpoints(msg.Endpoints)
+
+		switch msg.Type {
+		case introductionTypeRequest:
+			in.introduce(identity.publicKey, pk, candidates)
+		case introductionTypeIntroduction:
+			in.punch(identity.publicKey, pk, candidates)
+		default:
+			in.logger.Debug("Ignoring introduction message of unknown type", "peer", addr, "type", msg.Type)
+		}
+	}
+}
+
+// introduce tells a requester, and the peer it wants to reach, about each
+// other's endpoints. The candidate endpoints are those the requester
+// discovered itself.
+func (in *introductions) introduce(requester, pk transport.NoisePublicKey, candidates []netip.AddrPort) {
+	if !in.introducePeers {
+		return
+	}
+
+	// Both must be peers we are talking to, otherwise we don't know where
+	// they are.
+	if !in.hasSession(requester) || !in.hasSession(pk) {
+		return
+	}
+
+	pair := [2]transport.NoisePublicKey{requester, pk}
+	if requester.String() > pk.String() {
+		pair = [2]transport.NoisePublicKey{pk, requester}
+	}
+
+	in.mu.Lock()
+	if time.Since(in.introduced[pair]) < introductionInterval {
+		in.mu.Unlock()
+		return
+	}
+	in.introduced[pair] = time.Now()
+	in.mu.Unlock()
+
+	requesterEndpoints := in.observedEndpoints(requester, candidates)
+	peerEndpoints := in.observedEndpoints(pk, nil)
+	if len(requesterEndpoints) == 0 || len(peerEndpoints) == 0 {
+		return
+	}
+
+	in.logger.Debug("Introducing peers", "requester", requester.String(), "peer", pk.String())
+
+	in.send(pk, &introductionMessage{
+		Type:      introductionTypeIntroduction,
+		PublicKey: requester.String(),
+		Endpoints: endpointStrings(requesterEndpoints),
+	})
+
+	in.send(requester, &introductionMessage{
+		Type:      introductionTypeIntroduction,
+		PublicKey: pk.String(),
+		Endpoints: endpointStrings(peerEndpoints),
+	})
+}
+
+// punch punches holes to a peer, that an introducer has told us about.
+func (in *introductions) punch(introducer, pk transport.NoisePublicKey, candidates []netip.AddrPort) {
+	if !in.isIntroducer(introducer) || len(candidates) == 0 {
+		return
+	}
+
+	peer := in.s.transport.LookupPeer(pk)
+	if peer == nil {
+		return
+	}
+
+	if in.hasDirectPath(peer) {
+		return
+	}
+
+	// If both peers sent initiations at the same time, each would discard its
+	// own handshake on receiving the other's, and neither response would be
+	// accepted (until the handshake is retried). So the peer with the higher
+	// public key waits, for the other's initiation to open a path through its
+	// NAT first (and likely complete the handshake).
+	var delay time.Duration
+	if bytes.Compare(in.s.sourceSink.publicKey[:], pk[:]) > 0 {
+		delay = punchDelay
+	}
+
+	in.wg.Add(1)
+	go func() {
+		defer in.wg.Done()
+
+		select {
+		case <-in.ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		if delay > 0 && in.hasDirectPath(peer) {
+			return
+		}
+
+		in.logger.Debug("Punching holes to introduced peer", "peer", pk.String(), "introducer", introducer.String(), "endpoints", candidates)
+
+		if err := peer.PunchHoles(candidates); err != nil {
+			in.logger.Debug("Failed to send handshake initiation", "peer", pk.String(), "error", err)
+		}
+	}()
+}
+
+// hasDirectPath returns whether we have recently completed a handshake with
+// the peer, over a direct path.
+func (in *introductions) hasDirectPath(peer *transport.Peer) bool {
+	stats := peer.Stats()
+	return !stats.Relayed && time.Since(stats.LastHandshake) <= in.s.transport.Timers().RejectAfter
+}
+
+// observedEndpoints returns the endpoint we receive a peer's packets from
+// (unless it's relayed), along with its candidate endpoints.
+func (in *introductions) observedEndpoints(pk transport.NoisePublicKey, candidates []netip.AddrPort) []netip.AddrPort {
+	peer := in.s.transport.LookupPeer(pk)
+	if peer == nil {
+		return nil
+	}
+
+	stats := peer.Stats()
+
+	var endpoints []netip.AddrPort
+	if !stats.Relayed {
+		if endpoint, err := netip.ParseAddrPort(stats.Endpoint); err == nil {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+
+	for _, endpoint := range append(slices.Clone(candidates), stats.CandidateEndpoints...) {
+		if len(endpoints) >= maxCandidateEndpoints {
+			break
+		}
+
+		if !slices.Contains(endpoints, endpoint) {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+
+	return endpoints
+}
+
+func (in *introductions) send(pk transport.NoisePublicKey, msg *introductionMessage) {
+	in.s.peersMu.RLock()
+	addrs := in.s.peerAddresses[pk]
+	in.s.peersMu.RUnlock()
+
+	if len(addrs) == 0 {
+		return
+	}
+
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+
+	dst := net.UDPAddrFromAddrPort(netip.AddrPortFrom(addrs[0], introductionPort))
+	if _, err := in.pc.WriteTo(buf, dst); err != nil {
+		in.logger.Debug("Failed to send introduction message", "peer", dst, "error", err)
+	}
+}
+
+// isIntroducer returns whether the peer is configured as an introducer.
+func (in *introductions) isIntroducer(pk transport.NoisePublicKey) bool {
+	in.s.peerConfigsMu.Lock()
+	defer in.s.peerConfigsMu.Unlock()
+
+	return in.s.peerConfigs[pk].Introducer
+}
+
+// hasSession returns whether we have recently completed a handshake with the
+// peer.
+func (in *introductions) hasSession(pk transport.NoisePublicKey) bool {
+	peer := in.s.transport.LookupPeer(pk)
+	if peer == nil {
+		return false
+	}
+
+	return time.Since(peer.Stats().LastHandshake) <= in.s.transport.Timers().RejectAfter
+}
+
+// parseCandidateEndpoints parses the candidate endpoints sent by a peer,
+// ignoring any that are invalid, or beyond the maximum number accepted.
+func parseCandidateEndpoints(endpoints []string) []netip.AddrPort {
+	var candidates []netip.AddrPort
+	for _, s := range endpoints {
+		if len(candidates) >= maxCandidateEndpoints {
+			break
+		}
+
+		if endpoint, err := netip.ParseAddrPort(s); err == nil {
+			candidates = append(candidates, endpoint)
+		}
+	}
+
+	return candidates
+}
+
+func endpointStrings(endpoints []netip.AddrPort) []string {
+	s := make([]string, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		s = append(s, endpoint.String())
+	}
+	return s
+}
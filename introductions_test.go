@@ -0,0 +1,163 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets_test
+
+import (
+	"io"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoisySocket_Introductions(t *testing.T) {
+	logger := slogt.New(t)
+
+	newSocket := func(t *testing.T, conf *v1alpha1.Config) *noisysockets.NoisySocket {
+		socket, err := noisysockets.NewNoisySocket(logger, conf)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, socket.Close())
+		})
+
+		return socket
+	}
+
+	hubPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	alicePrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	bobPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	// The hub learns the endpoints of alice and bob when they connect to it.
+	hubSocket := newSocket(t, &v1alpha1.Config{
+		Name:           "hub",
+		ListenPort:     12463,
+		PrivateKey:     hubPrivateKey.String(),
+		IPs:            []string{"10.7.0.1"},
+		IntroducePeers: true,
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "alice",
+				PublicKey: alicePrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.2"},
+			},
+			{
+				Name:      "bob",
+				PublicKey: bobPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.3"},
+			},
+		},
+	})
+
+	// Alice and bob don't know each other's endpoints.
+	aliceSocket := newSocket(t, &v1alpha1.Config{
+		Name:       "alice",
+		ListenPort: 12464,
+		PrivateKey: alicePrivateKey.String(),
+		IPs:        []string{"10.7.0.2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:       "hub",
+				PublicKey:  hubPrivateKey.PublicKey().String(),
+				Endpoint:   "127.0.0.1:12463",
+				IPs:        []string{"10.7.0.1"},
+				Introducer: true,
+			},
+			{
+				Name:      "bob",
+				PublicKey: bobPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.3"},
+			},
+		},
+	})
+
+	bobSocket := newSocket(t, &v1alpha1.Config{
+		Name:       "bob",
+		ListenPort: 12465,
+		PrivateKey: bobPrivateKey.String(),
+		IPs:        []string{"10.7.0.3"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:       "hub",
+				PublicKey:  hubPrivateKey.PublicKey().String(),
+				Endpoint:   "127.0.0.1:12463",
+				IPs:        []string{"10.7.0.1"},
+				Introducer: true,
+			},
+			{
+				Name:      "alice",
+				PublicKey: alicePrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.2"},
+			},
+		},
+	})
+
+	hubLis, err := hubSocket.Listen("tcp", ":80")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = hubLis.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := hubLis.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+
+	// Establish sessions with the hub.
+	for _, socket := range []*noisysockets.NoisySocket{aliceSocket, bobSocket} {
+		conn, err := socket.Dial("tcp", "hub:80")
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+	}
+
+	bobLis, err := bobSocket.Listen("tcp", ":7")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = bobLis.Close()
+	})
+
+	go func() {
+		conn, err := bobLis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	// The hub introduces alice to bob, so that they can connect directly.
+	conn, err := aliceSocket.Dial("tcp", "bob:7")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, conn.Close())
+	})
+
+	_, err = conn.Write([]byte("Hello, bob!"))
+	require.NoError(t, err)
+
+	buf := make([]byte, len("Hello, bob!"))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "Hello, bob!", string(buf))
+
+	status, err := aliceSocket.PeerStatus("bob")
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1:12465", status.Endpoint)
+	require.False(t, status.Relayed)
+}
@@ -0,0 +1,30 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package ipam
+
+import (
+	"crypto/sha256"
+	"net/netip"
+)
+
+// DerivedPrefix is the prefix of derived addresses, the locally assigned half
+// of the IPv6 unique local address space (RFC 4193).
+var DerivedPrefix = netip.MustParsePrefix("fd00::/8")
+
+// DeriveAddr returns the stable IPv6 address derived from a public key, so
+// that no allocation, or coordination, is needed. It is fd followed by the
+// first 120 bits of the SHA-256 hash of the (base64 encoded) public key, so
+// collisions are vanishingly unlikely, and addresses can be derived by any
+// implementation.
+func DeriveAddr(publicKey string) netip.Addr {
+	hash := sha256.Sum256([]byte(publicKey))
+
+	var b [16]byte
+	b[0] = DerivedPrefix.Addr().As16()[0]
+	copy(b[1:], hash[:15])
+
+	return netip.AddrFrom16(b)
+}
@@ -0,0 +1,246 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+// Package ipam implements automatic assignment of mesh addresses to peers.
+//
+// Addresses are allocated from a prefix, and are derived by hashing each
+// peer's public key. This means that sockets sharing a prefix will usually
+// agree on each other's addresses without any coordination. If the derived
+// address is already taken, the next free address in the prefix is used
+// instead, so allocations are persisted to keep them stable.
+package ipam
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+)
+
+// maxProbes is the maximum number of addresses that are tried when looking
+// for a free address.
+const maxProbes = 1 << 16
+
+var ErrPoolExhausted = errors.New("no free addresses")
+
+// Store persists allocations, so that peers keep their addresses.
+type Store interface {
+	// Load returns the persisted allocations, keyed by public key.
+	Load() (map[string]netip.Addr, error)
+	// Save replaces the persisted allocations.
+	Save(allocations map[string]netip.Addr) error
+}
+
+// Allocator allocates addresses from a prefix. It is safe for concurrent use.
+type Allocator struct {
+	prefix netip.Prefix
+	store  Store
+	// size is the number of addresses in the prefix (saturating at 2^64).
+	size uint64
+
+	mu          sync.Mutex // protects all fields below
+	allocations map[string]netip.Addr
+	owners      map[netip.Addr]string
+	reserved    map[netip.Addr]struct{}
+}
+
+// NewAllocator creates a new allocator for the prefix. Existing allocations
+// are loaded from the store, which may be nil if allocations shouldn't be
+// persisted.
+func NewAllocator(prefix netip.Prefix, store Store) (*Allocator, error) {
+	if !prefix.IsValid() {
+		return nil, fmt.Errorf("invalid prefix")
+	}
+	prefix = prefix.Masked()
+
+	hostBits := prefix.Addr().BitLen() - prefix.Bits()
+	// There must be at least one address, that isn't reserved, to allocate.
+	if hostBits < 2 {
+		return nil, fmt.Errorf("prefix %s is too small", prefix)
+	}
+
+	a := &Allocator{
+		prefix:      prefix,
+		store:       store,
+		size:        ^uint64(0),
+		allocations: make(map[string]netip.Addr),
+		owners:      make(map[netip.Addr]string),
+		reserved:    make(map[netip.Addr]struct{}),
+	}
+
+	if hostBits < 64 {
+		a.size = 1 << hostBits
+	}
+
+	if store != nil {
+		allocations, err := store.Load()
+		if err != nil {
+			return nil, fmt.Errorf("could not load allocations: %w", err)
+		}
+
+		for publicKey, addr := range allocations {
+			// Allocations from a different prefix are discarded.
+			if !a.usable(addr) {
+				continue
+			}
+
+			if _, ok := a.owners[addr]; ok {
+				continue
+			}
+
+			a.allocations[publicKey] = addr
+			a.owners[addr] = publicKey
+		}
+	}
+
+	return a, nil
+}
+
+// Prefix returns the prefix addresses are allocated from.
+func (a *Allocator) Prefix() netip.Prefix {
+	return a.prefix
+}
+
+// Allocate returns the address allocated to the public key, allocating one if
+// it doesn't already have one.
+func (a *Allocator) Allocate(publicKey string) (netip.Addr, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if addr, ok := a.allocations[publicKey]; ok {
+		return addr, nil
+	}
+
+	hash := sha256.Sum256([]byte(publicKey))
+	offset := binary.BigEndian.Uint64(hash[:8])
+	if a.size != ^uint64(0) {
+		offset %= a.size
+	}
+
+	for i := 0; i < maxProbes; i++ {
+		addr := a.addrAt(offset + uint64(i))
+		if !a.usable(addr) {
+			continue
+		}
+
+		if _, ok := a.owners[addr]; ok {
+			continue
+		}
+
+		if _, ok := a.reserved[addr]; ok {
+			continue
+		}
+
+		a.allocations[publicKey] = addr
+		a.owners[addr] = publicKey
+
+		if err := a.saveLocked(); err != nil {
+			delete(a.allocations, publicKey)
+			delete(a.owners, addr)
+			return netip.Addr{}, err
+		}
+
+		return addr, nil
+	}
+
+	return netip.Addr{}, ErrPoolExhausted
+}
+
+// Lookup returns the address allocated to the public key, if any.
+func (a *Allocator) Lookup(publicKey string) (netip.Addr, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	addr, ok := a.allocations[publicKey]
+	return addr, ok
+}
+
+// Release frees the address allocated to the public key, if any.
+func (a *Allocator) Release(publicKey string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	addr, ok := a.allocations[publicKey]
+	if !ok {
+		return nil
+	}
+
+	delete(a.allocations, publicKey)
+	delete(a.owners, addr)
+
+	if err := a.saveLocked(); err != nil {
+		a.allocations[publicKey] = addr
+		a.owners[addr] = publicKey
+		return err
+	}
+
+	return nil
+}
+
+// Reserve prevents an address from being allocated, eg. because it has been
+// assigned by hand. If the address is already allocated, the allocation is
+// released, and the peer will be given a different address when it is next
+// allocated one.
+func (a *Allocator) Reserve(addr netip.Addr) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.prefix.Contains(addr) {
+		return nil
+	}
+
+	a.reserved[addr] = struct{}{}
+
+	if publicKey, ok := a.owners[addr]; ok {
+		delete(a.allocations, publicKey)
+		delete(a.owners, addr)
+
+		return a.saveLocked()
+	}
+
+	return nil
+}
+
+// addrAt returns the address at the given offset (modulo the size) from the
+// start of the prefix.
+func (a *Allocator) addrAt(offset uint64) netip.Addr {
+	if a.size != ^uint64(0) {
+		offset %= a.size
+	}
+
+	if a.prefix.Addr().Is4() {
+		b := a.prefix.Addr().As4()
+		binary.BigEndian.PutUint32(b[:], binary.BigEndian.Uint32(b[:])+uint32(offset))
+		return netip.AddrFrom4(b)
+	}
+
+	b := a.prefix.Addr().As16()
+	binary.BigEndian.PutUint64(b[8:], binary.BigEndian.Uint64(b[8:])+offset)
+	return netip.AddrFrom16(b)
+}
+
+// usable reports whether the address can be allocated, the first address in
+// the prefix (and for IPv4, the broadcast address) are never allocated.
+func (a *Allocator) usable(addr netip.Addr) bool {
+	if !a.prefix.Contains(addr) || addr == a.prefix.Addr() {
+		return false
+	}
+
+	return !(addr.Is4() && addr == a.addrAt(a.size-1))
+}
+
+func (a *Allocator) saveLocked() error {
+	if a.store == nil {
+		return nil
+	}
+
+	if err := a.store.Save(a.allocations); err != nil {
+		return fmt.Errorf("could not save allocations: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,160 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package ipam_test
+
+import (
+	"net/netip"
+	"path/filepath"
+	"testing"
+
+	"github.com/noisysockets/noisysockets/ipam"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllocator(t *testing.T) {
+	prefix := netip.MustParsePrefix("10.7.0.0/24")
+
+	a, err := ipam.NewAllocator(prefix, nil)
+	require.NoError(t, err)
+
+	alice, err := a.Allocate("alice")
+	require.NoError(t, err)
+	require.True(t, prefix.Contains(alice))
+	require.NotEqual(t, netip.MustParseAddr("10.7.0.0"), alice)
+	require.NotEqual(t, netip.MustParseAddr("10.7.0.255"), alice)
+
+	// Allocations are stable.
+	addr, err := a.Allocate("alice")
+	require.NoError(t, err)
+	require.Equal(t, alice, addr)
+
+	// And derived from the public key, so other allocators agree.
+	b, err := ipam.NewAllocator(prefix, nil)
+	require.NoError(t, err)
+
+	addr, err = b.Allocate("alice")
+	require.NoError(t, err)
+	require.Equal(t, alice, addr)
+
+	t.Run("Collision", func(t *testing.T) {
+		c, err := ipam.NewAllocator(prefix, nil)
+		require.NoError(t, err)
+
+		require.NoError(t, c.Reserve(alice))
+
+		addr, err := c.Allocate("alice")
+		require.NoError(t, err)
+		require.NotEqual(t, alice, addr)
+		require.True(t, prefix.Contains(addr))
+	})
+
+	t.Run("Reserve", func(t *testing.T) {
+		c, err := ipam.NewAllocator(prefix, nil)
+		require.NoError(t, err)
+
+		addr, err := c.Allocate("alice")
+		require.NoError(t, err)
+
+		// Addresses assigned by hand take precedence.
+		require.NoError(t, c.Reserve(addr))
+
+		_, ok := c.Lookup("alice")
+		require.False(t, ok)
+
+		newAddr, err := c.Allocate("alice")
+		require.NoError(t, err)
+		require.NotEqual(t, addr, newAddr)
+	})
+
+	t.Run("Release", func(t *testing.T) {
+		require.NoError(t, a.Release("alice"))
+
+		_, ok := a.Lookup("alice")
+		require.False(t, ok)
+
+		require.NoError(t, a.Release("alice"))
+	})
+}
+
+func TestAllocator_Exhausted(t *testing.T) {
+	a, err := ipam.NewAllocator(netip.MustParsePrefix("10.7.0.0/30"), nil)
+	require.NoError(t, err)
+
+	first, err := a.Allocate("alice")
+	require.NoError(t, err)
+
+	second, err := a.Allocate("bob")
+	require.NoError(t, err)
+
+	require.ElementsMatch(t, []netip.Addr{netip.MustParseAddr("10.7.0.1"), netip.MustParseAddr("10.7.0.2")}, []netip.Addr{first, second})
+
+	_, err = a.Allocate("carol")
+	require.ErrorIs(t, err, ipam.ErrPoolExhausted)
+
+	_, err = ipam.NewAllocator(netip.MustParsePrefix("10.7.0.0/31"), nil)
+	require.Error(t, err)
+}
+
+func TestAllocator_IPv6(t *testing.T) {
+	prefix := netip.MustParsePrefix("fd00::/48")
+
+	a, err := ipam.NewAllocator(prefix, nil)
+	require.NoError(t, err)
+
+	addr, err := a.Allocate("alice")
+	require.NoError(t, err)
+	require.True(t, addr.Is6())
+	require.True(t, prefix.Contains(addr))
+}
+
+func TestDeriveAddr(t *testing.T) {
+	alice := ipam.DeriveAddr("alice")
+	require.True(t, ipam.DerivedPrefix.Contains(alice))
+	require.Equal(t, alice, ipam.DeriveAddr("alice"))
+
+	// The hash of "alice" starts 2bd806c97f0e00af1a1fc3328fa763.
+	require.Equal(t, netip.MustParseAddr("fd2b:d806:c97f:e00:af1a:1fc3:328f:a763"), alice)
+
+	require.NotEqual(t, alice, ipam.DeriveAddr("bob"))
+}
+
+func TestFileStore(t *testing.T) {
+	prefix := netip.MustParsePrefix("10.7.0.0/24")
+	store := ipam.NewFileStore(filepath.Join(t.TempDir(), "ipam.json"))
+
+	a, err := ipam.NewAllocator(prefix, store)
+	require.NoError(t, err)
+
+	// Force alice onto an address that can't be derived from her key.
+	derived, err := a.Allocate("alice")
+	require.NoError(t, err)
+	require.NoError(t, a.Reserve(derived))
+
+	alice, err := a.Allocate("alice")
+	require.NoError(t, err)
+
+	bob, err := a.Allocate("bob")
+	require.NoError(t, err)
+
+	// Allocations are restored.
+	b, err := ipam.NewAllocator(prefix, store)
+	require.NoError(t, err)
+
+	addr, ok := b.Lookup("alice")
+	require.True(t, ok)
+	require.Equal(t, alice, addr)
+
+	addr, ok = b.Lookup("bob")
+	require.True(t, ok)
+	require.Equal(t, bob, addr)
+
+	// Unless they are from a different prefix.
+	c, err := ipam.NewAllocator(netip.MustParsePrefix("10.8.0.0/24"), store)
+	require.NoError(t, err)
+
+	_, ok = c.Lookup("alice")
+	require.False(t, ok)
+}
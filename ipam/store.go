@@ -0,0 +1,75 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package ipam
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+)
+
+var _ Store = (*FileStore)(nil)
+
+// FileStore persists allocations to a JSON file.
+type FileStore struct {
+	path string
+}
+
+type fileStoreState struct {
+	Allocations map[string]netip.Addr `json:"allocations"`
+}
+
+// NewFileStore creates a new FileStore, the file is created when allocations
+// are first saved.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+func (s *FileStore) Load() (map[string]netip.Addr, error) {
+	buf, err := os.ReadFile(s.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var state fileStoreState
+	if err := json.Unmarshal(buf, &state); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", s.path, err)
+	}
+
+	return state.Allocations, nil
+}
+
+// Save atomically replaces the file.
+func (s *FileStore) Save(allocations map[string]netip.Addr) error {
+	buf, err := json.MarshalIndent(&fileStoreState{Allocations: allocations}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(buf); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), s.path)
+}
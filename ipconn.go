@@ -0,0 +1,466 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+const (
+	// ipConnQueueSize is the number of received packets an IPConn holds, that
+	// haven't been read yet, before it drops them.
+	ipConnQueueSize = 256
+	// ipConnTTL is the TTL (or hop limit) of the packets sent by an IPConn.
+	ipConnTTL = 64
+)
+
+var (
+	errNumericProtocol = errors.New("protocol must be numeric")
+	errProtocolInUse   = errors.New("protocol already in use")
+)
+
+var _ net.PacketConn = (*IPConn)(nil)
+
+// IPConn sends, and receives, the packets of an IP protocol that the network
+// stack doesn't implement (eg. a routing protocol), so that it can be
+// implemented by the application. Like a raw socket, the payloads read and
+// written exclude the IP header. Fragmented packets, and IPv6 packets with
+// extension headers, aren't received.
+type IPConn struct {
+	key       ipConnKey
+	laddr     netip.Addr
+	bound     bool // only packets addressed to laddr are received
+	queue     func(pkt *stack.PacketBuffer) bool
+	remove    func(c *IPConn)
+	packets   chan ipPacket
+	closed    chan struct{}
+	closeOnce sync.Once
+	mu        sync.Mutex // protects readDeadline and deadlineChanged
+	// readDeadline is the read deadline, deadlineChanged is closed when it is
+	// changed, so that pending reads see it.
+	readDeadline    time.Time
+	deadlineChanged chan struct{}
+}
+
+type ipConnKey struct {
+	protoNumber tcpip.NetworkProtocolNumber
+	protocol    uint8
+}
+
+type ipPacket struct {
+	from    netip.Addr
+	payload []byte
+}
+
+// ListenIP creates a connection for an IP protocol, network is "ip", "ip4", or
+// "ip6", followed by a colon and the protocol number (eg. "ip4:89"). If laddr
+// is nil, or unspecified, packets addressed to any of the socket's addresses
+// are received. Protocols handled by the network stack (eg. TCP and UDP) can't
+// be used, and each protocol can only have one connection per address family.
+func (n *noisyNet) ListenIP(network string, laddr *net.IPAddr) (*IPConn, error) {
+	acceptV4, acceptV6, protocol, err := parseIPNetwork(network)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+
+	var addr netip.Addr
+	var bound bool
+	if laddr != nil && laddr.IP != nil && !laddr.IP.IsUnspecified() {
+		var ok bool
+		addr, ok = netip.AddrFromSlice(laddr.IP)
+		if !ok {
+			return nil, &net.OpError{Op: "listen", Net: network, Addr: laddr, Err: errMissingAddress}
+		}
+		addr = addr.Unmap()
+
+		if (addr.Is4() && !acceptV4) || (addr.Is6() && !acceptV6) {
+			return nil, &net.OpError{Op: "listen", Net: network, Addr: laddr, Err: errNoSuitableAddress}
+		}
+
+		isLocal := false
+		for _, localAddr := range n.localAddrs.load() {
+			isLocal = isLocal || localAddr == addr
+		}
+		if !isLocal {
+			return nil, &net.OpError{Op: "listen", Net: network, Addr: laddr, Err: errNoSuitableAddress}
+		}
+
+		bound = true
+	} else {
+		for _, localAddr := range n.localAddrs.load() {
+			if (localAddr.Is6() && acceptV6) || (localAddr.Is4() && acceptV4) {
+				addr = localAddr
+				break
+			}
+		}
+
+		if !addr.IsValid() {
+			return nil, &net.OpError{Op: "listen", Net: network, Err: errNoSuitableAddress}
+		}
+	}
+
+	key := ipConnKey{protoNumber: header.IPv4ProtocolNumber, protocol: protocol}
+	if addr.Is6() {
+		key.protoNumber = header.IPv6ProtocolNumber
+	}
+
+	c := &IPConn{
+		key:             key,
+		laddr:           addr,
+		bound:           bound,
+		queue:           n.queueOutbound,
+		remove:          n.ipConns.remove,
+		packets:         make(chan ipPacket, ipConnQueueSize),
+		closed:          make(chan struct{}),
+		deadlineChanged: make(chan struct{}),
+	}
+
+	if !n.ipConns.add(c) {
+		return nil, &net.OpError{Op: "listen", Net: network, Addr: c.LocalAddr(), Err: errProtocolInUse}
+	}
+
+	return c, nil
+}
+
+// parseIPNetwork parses the network of an IP connection, returning the
+// address families, and the protocol, it is for.
+func parseIPNetwork(network string) (acceptV4, acceptV6 bool, protocol uint8, err error) {
+	family, proto, ok := strings.Cut(network, ":")
+	if !ok {
+		return false, false, 0, net.UnknownNetworkError(network)
+	}
+
+	switch family {
+	case "ip":
+		acceptV4, acceptV6 = true, true
+	case "ip4":
+		acceptV4 = true
+	case "ip6":
+		acceptV6 = true
+	default:
+		return false, false, 0, net.UnknownNetworkError(network)
+	}
+
+	n, err := strconv.ParseUint(proto, 10, 8)
+	if err != nil {
+		return false, false, 0, errNumericProtocol
+	}
+
+	switch tcpip.TransportProtocolNumber(n) {
+	case header.TCPProtocolNumber, header.UDPProtocolNumber, header.ICMPv4ProtocolNumber,
+		header.ICMPv6ProtocolNumber, header.IGMPProtocolNumber:
+		return false, false, 0, fmt.Errorf("protocol %d is handled by the network stack", n)
+	}
+
+	// Extension headers aren't protocols.
+	switch header.IPv6ExtensionHeaderIdentifier(n) {
+	case header.IPv6HopByHopOptionsExtHdrIdentifier, header.IPv6RoutingExtHdrIdentifier,
+		header.IPv6FragmentExtHdrIdentifier, header.IPv6DestinationOptionsExtHdrIdentifier,
+		header.IPv6NoNextHeaderIdentifier:
+		return false, false, 0, fmt.Errorf("protocol %d is an IPv6 extension header", n)
+	}
+
+	return acceptV4, acceptV6, uint8(n), nil
+}
+
+// ReadFrom reads the payload of a packet, returning the address of the peer
+// that sent it.
+func (c *IPConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		c.mu.Lock()
+		deadline, deadlineChanged := c.readDeadline, c.deadlineChanged
+		c.mu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, c.opError("read", os.ErrDeadlineExceeded)
+			}
+
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		select {
+		case pkt := <-c.packets:
+			stopTimer(timer)
+			return copy(b, pkt.payload), &net.IPAddr{IP: pkt.from.AsSlice()}, nil
+		case <-c.closed:
+			stopTimer(timer)
+			return 0, nil, c.opError("read", net.ErrClosed)
+		case <-timeout:
+			return 0, nil, c.opError("read", os.ErrDeadlineExceeded)
+		case <-deadlineChanged:
+			stopTimer(timer)
+		}
+	}
+}
+
+// WriteTo sends a packet, with the payload b, to addr (which must be an
+// *net.IPAddr). As with UDP, packets are dropped if they can't be sent.
+func (c *IPConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, c.opError("write", net.ErrClosed)
+	default:
+	}
+
+	ipAddr, ok := addr.(*net.IPAddr)
+	if !ok {
+		return 0, c.opError("write", fmt.Errorf("unsupported address type %T", addr))
+	}
+
+	dst, ok := netip.AddrFromSlice(ipAddr.IP)
+	if !ok {
+		return 0, c.opError("write", errMissingAddress)
+	}
+	dst = dst.Unmap()
+
+	if dst.Is4() != c.laddr.Is4() {
+		return 0, c.opError("write", errNoSuitableAddress)
+	}
+
+	var pkt []byte
+	var hdrLen int
+	if c.key.protoNumber == header.IPv4ProtocolNumber {
+		hdrLen = header.IPv4MinimumSize
+		if hdrLen+len(b) > header.IPv4MaximumPayloadSize {
+			return 0, c.opError("write", errors.New("message too long"))
+		}
+
+		pkt = make([]byte, hdrLen+len(b))
+		hdr := header.IPv4(pkt)
+		hdr.Encode(&header.IPv4Fields{
+			TotalLength: uint16(len(pkt)),
+			TTL:         ipConnTTL,
+			Protocol:    c.key.protocol,
+			SrcAddr:     tcpip.AddrFrom4(c.laddr.As4()),
+			DstAddr:     tcpip.AddrFrom4(dst.As4()),
+		})
+		hdr.SetChecksum(^hdr.CalculateChecksum())
+	} else {
+		hdrLen = header.IPv6MinimumSize
+		if len(b) > header.IPv6MaximumPayloadSize {
+			return 0, c.opError("write", errors.New("message too long"))
+		}
+
+		pkt = make([]byte, hdrLen+len(b))
+		header.IPv6(pkt).Encode(&header.IPv6Fields{
+			PayloadLength:     uint16(len(b)),
+			TransportProtocol: tcpip.TransportProtocolNumber(c.key.protocol),
+			HopLimit:          ipConnTTL,
+			SrcAddr:           tcpip.AddrFrom16(c.laddr.As16()),
+			DstAddr:           tcpip.AddrFrom16(dst.As16()),
+		})
+	}
+	copy(pkt[hdrLen:], b)
+
+	outPkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(pkt)})
+	outPkt.NetworkProtocolNumber = c.key.protoNumber
+	_, _ = outPkt.NetworkHeader().Consume(hdrLen)
+
+	c.queue(outPkt)
+	outPkt.DecRef()
+
+	return len(b), nil
+}
+
+// Close closes the connection, pending reads are unblocked.
+func (c *IPConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.remove(c)
+		close(c.closed)
+	})
+
+	return nil
+}
+
+// LocalAddr returns the address packets are sent from.
+func (c *IPConn) LocalAddr() net.Addr {
+	return &net.IPAddr{IP: c.laddr.AsSlice()}
+}
+
+func (c *IPConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *IPConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	close(c.deadlineChanged)
+	c.deadlineChanged = make(chan struct{})
+	c.mu.Unlock()
+
+	return nil
+}
+
+// SetWriteDeadline is a no-op, as writes never block.
+func (c *IPConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func stopTimer(timer *time.Timer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
+
+func (c *IPConn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: c.network(), Addr: c.LocalAddr(), Err: err}
+}
+
+func (c *IPConn) network() string {
+	family := "ip4"
+	if c.key.protoNumber == header.IPv6ProtocolNumber {
+		family = "ip6"
+	}
+
+	return family + ":" + strconv.Itoa(int(c.key.protocol))
+}
+
+// ipConns are the socket's IP connections.
+type ipConns struct {
+	mu    sync.Mutex // serializes updates to conns
+	conns atomic.Pointer[map[ipConnKey]*IPConn]
+}
+
+// add adds a connection, it reports false if its protocol is already in use.
+func (ic *ipConns) add(c *IPConn) bool {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	conns := make(map[ipConnKey]*IPConn)
+	if existing := ic.conns.Load(); existing != nil {
+		if _, ok := (*existing)[c.key]; ok {
+			return false
+		}
+
+		for key, conn := range *existing {
+			conns[key] = conn
+		}
+	}
+	conns[c.key] = c
+
+	ic.conns.Store(&conns)
+
+	return true
+}
+
+func (ic *ipConns) remove(c *IPConn) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	existing := ic.conns.Load()
+	if existing == nil || (*existing)[c.key] != c {
+		return
+	}
+
+	if len(*existing) == 1 {
+		ic.conns.Store(nil)
+		return
+	}
+
+	conns := make(map[ipConnKey]*IPConn, len(*existing)-1)
+	for key, conn := range *existing {
+		if conn != c {
+			conns[key] = conn
+		}
+	}
+
+	ic.conns.Store(&conns)
+}
+
+// closeAll closes every connection, eg. when the socket is closed.
+func (ic *ipConns) closeAll() {
+	existing := ic.conns.Load()
+	if existing == nil {
+		return
+	}
+
+	for _, c := range *existing {
+		_ = c.Close()
+	}
+}
+
+// handleIPConnPacket reports whether the inbound packet is for one of the
+// socket's IP connections, if so it is consumed.
+func (ss *sourceSink) handleIPConnPacket(protoNumber tcpip.NetworkProtocolNumber, pkt []byte) bool {
+	conns := ss.ipConns.conns.Load()
+	if conns == nil {
+		return false
+	}
+
+	var dst, src netip.Addr
+	var protocol uint8
+	var payload []byte
+	switch protoNumber {
+	case header.IPv4ProtocolNumber:
+		hdr := header.IPv4(pkt)
+		if !hdr.IsValid(len(pkt)) || hdr.More() || hdr.FragmentOffset() != 0 {
+			return false
+		}
+
+		dst = netip.AddrFrom4(hdr.DestinationAddress().As4())
+		src = netip.AddrFrom4(hdr.SourceAddress().As4())
+		protocol, payload = hdr.Protocol(), hdr.Payload()
+	case header.IPv6ProtocolNumber:
+		hdr := header.IPv6(pkt)
+		if !hdr.IsValid(len(pkt)) {
+			return false
+		}
+
+		dst = netip.AddrFrom16(hdr.DestinationAddress().As16())
+		src = netip.AddrFrom16(hdr.SourceAddress().As16())
+		protocol, payload = hdr.NextHeader(), hdr.Payload()
+	default:
+		return false
+	}
+
+	c, ok := (*conns)[ipConnKey{protoNumber: protoNumber, protocol: protocol}]
+	if !ok {
+		return false
+	}
+
+	if !isGroupAddress(dst) {
+		if c.bound && dst != c.laddr {
+			return false
+		}
+
+		isLocal := false
+		for _, localAddr := range ss.localAddrs.load() {
+			isLocal = isLocal || localAddr == dst
+		}
+		if !isLocal {
+			return false
+		}
+	}
+
+	// The packet's memory is reused once it has been written.
+	select {
+	case c.packets <- ipPacket{from: src, payload: append([]byte(nil), payload...)}:
+	default:
+		ss.writeDropped.Add(1)
+		ss.logDropped("Dropping inbound packet for full IP connection", "protocol", protocol)
+	}
+
+	return true
+}
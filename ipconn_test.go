@@ -0,0 +1,156 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets_test
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoisySocket_ListenIP(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverSocket, clientSocket, err := noisysockets.Pipe(logger, &v1alpha1.Config{
+		Name:       "server",
+		PrivateKey: serverPrivateKey.String(),
+		IPs:        []string{"10.7.0.1", "fdff:7061:ac89::1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "client",
+				PublicKey: clientPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.2", "fdff:7061:ac89::2"},
+			},
+		},
+	}, &v1alpha1.Config{
+		Name:       "client",
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.2", "fdff:7061:ac89::2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "server",
+				PublicKey: serverPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.1", "fdff:7061:ac89::1"},
+			},
+		},
+	}, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+		require.NoError(t, clientSocket.Close())
+	})
+
+	for _, tc := range []struct {
+		network    string
+		serverAddr string
+		clientAddr string
+	}{
+		{"ip4:89", "10.7.0.1", "10.7.0.2"},
+		{"ip6:253", "fdff:7061:ac89::1", "fdff:7061:ac89::2"},
+	} {
+		t.Run(tc.network, func(t *testing.T) {
+			serverConn, err := serverSocket.ListenPacket(tc.network, "")
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, serverConn.Close())
+			})
+
+			clientConn, err := clientSocket.ListenIP(tc.network, &net.IPAddr{IP: net.ParseIP(tc.clientAddr)})
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, clientConn.Close())
+			})
+
+			require.Equal(t, tc.clientAddr, clientConn.LocalAddr().String())
+
+			_, err = clientConn.WriteTo([]byte("hello"), &net.IPAddr{IP: net.ParseIP(tc.serverAddr)})
+			require.NoError(t, err)
+
+			require.NoError(t, serverConn.SetReadDeadline(time.Now().Add(10*time.Second)))
+
+			buf := make([]byte, 1500)
+			n, addr, err := serverConn.ReadFrom(buf)
+			require.NoError(t, err)
+			require.Equal(t, "hello", string(buf[:n]))
+			require.Equal(t, tc.clientAddr, addr.String())
+
+			_, err = serverConn.WriteTo([]byte("world"), addr)
+			require.NoError(t, err)
+
+			require.NoError(t, clientConn.SetReadDeadline(time.Now().Add(10*time.Second)))
+
+			n, addr, err = clientConn.ReadFrom(buf)
+			require.NoError(t, err)
+			require.Equal(t, "world", string(buf[:n]))
+			require.Equal(t, tc.serverAddr, addr.String())
+		})
+	}
+
+	t.Run("Deadline", func(t *testing.T) {
+		conn, err := serverSocket.ListenIP("ip4:89", nil)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, conn.Close())
+		})
+
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+
+		_, _, err = conn.ReadFrom(make([]byte, 1500))
+		require.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		conn, err := serverSocket.ListenIP("ip4:89", nil)
+		require.NoError(t, err)
+
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			_ = conn.Close()
+		}()
+
+		_, _, err = conn.ReadFrom(make([]byte, 1500))
+		require.True(t, errors.Is(err, net.ErrClosed))
+
+		// The protocol can be used again.
+		conn, err = serverSocket.ListenIP("ip4:89", nil)
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		conn, err := serverSocket.ListenIP("ip4:89", nil)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, conn.Close())
+		})
+
+		_, err = serverSocket.ListenIP("ip4:89", nil)
+		require.ErrorContains(t, err, "protocol already in use")
+
+		_, err = serverSocket.ListenIP("ip4:6", nil)
+		require.ErrorContains(t, err, "handled by the network stack")
+
+		_, err = serverSocket.ListenIP("ip4:ospf", nil)
+		require.ErrorContains(t, err, "protocol must be numeric")
+
+		_, err = serverSocket.ListenIP("ip4:89", &net.IPAddr{IP: net.ParseIP("10.7.0.2")})
+		require.ErrorContains(t, err, "no suitable address")
+	})
+}
@@ -0,0 +1,173 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+// Package kernel provides an alternative backend that, on Linux hosts with the
+// wireguard kernel module (and CAP_NET_ADMIN), programs a kernel WireGuard
+// interface instead of running the userspace data plane. Connections are made
+// using the host's network stack, bound to the interface, for native
+// performance behind the same Dial and Listen API.
+package kernel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+)
+
+// Backends that can be selected with Config.Backend.
+const (
+	// BackendUserspace is the userspace data plane (NoisySocket), the default.
+	BackendUserspace = "userspace"
+	// BackendKernel is a kernel WireGuard interface.
+	BackendKernel = "kernel"
+	// BackendAuto uses a kernel WireGuard interface if it is supported, and the
+	// configuration doesn't need any userspace only features, and otherwise
+	// falls back to the userspace data plane.
+	BackendAuto = "auto"
+)
+
+// ErrNotSupported is returned when kernel WireGuard interfaces are not
+// supported (eg. on other platforms, without the wireguard module, or
+// without CAP_NET_ADMIN).
+var ErrNotSupported = errors.New("kernel wireguard is not supported")
+
+// Network is the API shared by the kernel and userspace backends.
+type Network interface {
+	// Dial connects to an address (eg. "peer:80") through the mesh.
+	Dial(network, address string) (net.Conn, error)
+	// DialContext is like Dial, but with a context.
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+	// Listen listens for connections from peers.
+	Listen(network, address string) (net.Listener, error)
+	// ListenPacket listens for packets from peers.
+	ListenPacket(network, address string) (net.PacketConn, error)
+	// LookupHost returns the addresses of a host (eg. the name of a peer).
+	LookupHost(host string) ([]string, error)
+	// AddPeer adds a peer, it can be called while the network is running.
+	AddPeer(peerConf v1alpha1.WireGuardPeerConfig) error
+	// RemovePeer removes a peer, identified by its encoded public key.
+	RemovePeer(publicKey string) error
+	// Close brings the network down.
+	Close() error
+}
+
+var (
+	_ Network = (*noisysockets.NoisySocket)(nil)
+	_ Network = (*Interface)(nil)
+)
+
+// Open brings a network up using the backend selected by Config.Backend.
+func Open(logger *slog.Logger, conf *v1alpha1.Config) (Network, error) {
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+
+	switch conf.Backend {
+	case "", BackendUserspace:
+		return noisysockets.NewNoisySocket(logger, conf)
+	case BackendKernel:
+		return NewInterface(logger, conf)
+	case BackendAuto:
+		if !Supported() {
+			logger.Debug("Kernel WireGuard not supported, using userspace backend")
+			return noisysockets.NewNoisySocket(logger, conf)
+		}
+
+		if err := checkCompatible(conf); err != nil {
+			logger.Info("Configuration needs userspace backend", "reason", err)
+			return noisysockets.NewNoisySocket(logger, conf)
+		}
+
+		n, err := NewInterface(logger, conf)
+		if err != nil {
+			logger.Warn("Failed to create kernel WireGuard interface, using userspace backend", "error", err)
+			return noisysockets.NewNoisySocket(logger, conf)
+		}
+
+		return n, nil
+	default:
+		return nil, fmt.Errorf("unknown backend %q", conf.Backend)
+	}
+}
+
+// Supported reports whether kernel WireGuard interfaces can be created.
+func Supported() bool {
+	return supported()
+}
+
+// checkCompatible returns an error if the configuration uses features that
+// are only available in the userspace data plane. Every option, other than
+// those the kernel interface applies itself (name, listenPort, backend, mtu,
+// privateKey, ips, domain, useHostResolver, strictInterop, and peers), must be
+// accounted for here, so that nothing is silently ignored.
+func checkCompatible(conf *v1alpha1.Config) error {
+	var unsupported []string
+	if conf.DefaultGatewayPeerName != "" {
+		unsupported = append(unsupported, "defaultGatewayPeerName")
+	}
+	if conf.EnableForwarding || conf.ForwardToHostNetwork || conf.NAT64Prefix != "" {
+		unsupported = append(unsupported, "forwarding")
+	}
+	if conf.EnableDNSServer || conf.DisableDNSForwarder || conf.EnableMeasurementServer || len(conf.ReverseProxies) > 0 || conf.DisableEchoReply {
+		unsupported = append(unsupported, "built-in servers")
+	}
+	if len(conf.Listeners) > 0 || conf.RelayURL != "" || len(conf.STUNServers) > 0 || conf.IntroducePeers || conf.LANDiscovery != nil ||
+		conf.Obfuscation != nil || conf.Roaming != nil || conf.SocketOptions != nil {
+		unsupported = append(unsupported, "alternative transports")
+	}
+	if len(conf.ACL) > 0 || conf.RateLimit != nil || conf.OutboundRateLimit != nil {
+		unsupported = append(unsupported, "access control and rate limits")
+	}
+	if len(conf.DNSServers) > 0 || conf.DNS != nil || len(conf.DNSRoutes) > 0 || conf.LoadBalancing != "" {
+		unsupported = append(unsupported, "dns servers")
+	}
+	if conf.SessionStateFile != "" {
+		unsupported = append(unsupported, "session resumption")
+	}
+	if conf.IPAM != nil || conf.DeriveIPv6Addresses || len(conf.FloatingIPs) > 0 || conf.AddressConflicts != "" {
+		unsupported = append(unsupported, "address assignment")
+	}
+	if conf.PathMTUDiscovery || conf.HealthCheck != nil || conf.PeerIdleTimeoutSeconds != 0 || conf.EnableMulticast {
+		unsupported = append(unsupported, "peer monitoring and multicast")
+	}
+	if conf.Timers != nil || conf.HandshakeLimits != nil || conf.Tuning != nil || conf.QoS != nil || conf.Stack != nil || conf.ClampMSS {
+		unsupported = append(unsupported, "tuning")
+	}
+
+	for _, peerConf := range conf.Peers {
+		if err := checkPeerCompatible(&peerConf); err != nil {
+			unsupported = append(unsupported, err.Error())
+		}
+	}
+
+	if len(unsupported) > 0 {
+		return fmt.Errorf("unsupported by kernel backend: %v", unsupported)
+	}
+
+	return nil
+}
+
+// checkPeerCompatible returns an error if a peer uses features that are only
+// available in the userspace data plane. Only the name, publicKey,
+// presharedKey, endpoint (an address), ips, and persistentKeepalive of peers
+// are applied by the kernel interface.
+func checkPeerCompatible(peerConf *v1alpha1.WireGuardPeerConfig) error {
+	if peerConf.DefaultGateway || peerConf.Via != "" || peerConf.Introducer || peerConf.Compression != "" || peerConf.PostQuantum || peerConf.RequirePostQuantum ||
+		peerConf.RateLimit != nil || peerConf.OutboundRateLimit != nil || peerConf.ExpiresAt != "" ||
+		len(peerConf.Endpoints) > 0 || strings.Contains(peerConf.Endpoint, "://") ||
+		len(peerConf.Tags) > 0 || len(peerConf.Services) > 0 || len(peerConf.SRVRecords) > 0 || len(peerConf.TXTRecords) > 0 ||
+		peerConf.IdleTimeoutSeconds != 0 || peerConf.DisableMulticast {
+		return fmt.Errorf("peer %s options", peerConf.PublicKey)
+	}
+
+	return nil
+}
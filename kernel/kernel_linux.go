@@ -0,0 +1,374 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package kernel
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"syscall"
+
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"golang.org/x/sys/unix"
+)
+
+// maxInterfaces is the number of interface names (noisysockets0 to
+// noisysockets99) that are tried, when creating an interface.
+const maxInterfaces = 100
+
+type linuxDevice struct {
+	name   string
+	index  int
+	family uint16
+	mu     sync.Mutex
+	rtnl   *netlinkConn
+	genl   *netlinkConn
+	routes map[transport.NoisePublicKey][]netip.Prefix
+}
+
+func supported() bool {
+	var caps [2]unix.CapUserData
+	if err := unix.Capget(&unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}, &caps[0]); err != nil {
+		return false
+	}
+	if caps[0].Effective&(1<<unix.CAP_NET_ADMIN) == 0 {
+		return false
+	}
+
+	// The family is only registered once the wireguard module is loaded (the
+	// kernel will try to load it on demand).
+	genl, err := dialNetlink(unix.NETLINK_GENERIC)
+	if err != nil {
+		return false
+	}
+	defer genl.Close()
+
+	_, err = resolveFamily(genl, unix.WG_GENL_NAME)
+	return err == nil
+}
+
+func newDevice(privateKey transport.NoisePrivateKey, listenPort uint16, mtu int, addrs []netip.Addr) (device, error) {
+	rtnl, err := dialNetlink(unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+
+	genl, err := dialNetlink(unix.NETLINK_GENERIC)
+	if err != nil {
+		_ = rtnl.Close()
+		return nil, err
+	}
+
+	d := &linuxDevice{
+		rtnl:   rtnl,
+		genl:   genl,
+		routes: make(map[transport.NoisePublicKey][]netip.Prefix),
+	}
+
+	d.family, err = resolveFamily(genl, unix.WG_GENL_NAME)
+	if err != nil {
+		d.closeConns()
+		return nil, fmt.Errorf("%w: %v", ErrNotSupported, err)
+	}
+
+	if err := d.createLink(mtu); err != nil {
+		d.closeConns()
+		return nil, err
+	}
+
+	if err := d.configure(privateKey, listenPort, addrs); err != nil {
+		_ = d.Close()
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func (d *linuxDevice) Name() string {
+	return d.name
+}
+
+func (d *linuxDevice) SetPeer(peerConf *peerConfig) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	e := newSetDeviceEncoder(d.index)
+	e.nested(unix.WGDEVICE_A_PEERS, func(e *attrEncoder) {
+		encodePeer(e, peerConf, unix.WGPEER_F_REPLACE_ALLOWEDIPS)
+	})
+
+	if _, err := d.genl.execute(d.family, 0, e.buf); err != nil {
+		return err
+	}
+
+	// Remove the routes to any prefixes the peer no longer has.
+	for _, prefix := range d.routes[peerConf.publicKey] {
+		if !containsPrefix(peerConf.prefixes, prefix) {
+			if err := d.route(unix.RTM_DELROUTE, 0, prefix); err != nil && !errors.Is(err, unix.ESRCH) {
+				return fmt.Errorf("could not remove route to %s: %w", prefix, err)
+			}
+		}
+	}
+
+	var routes []netip.Prefix
+	for _, prefix := range peerConf.prefixes {
+		// Routing everything to the interface would take over the host's default
+		// route (and the route to the peer's endpoint).
+		if prefix.Bits() == 0 {
+			continue
+		}
+
+		if err := d.route(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_REPLACE, prefix); err != nil {
+			return fmt.Errorf("could not add route to %s: %w", prefix, err)
+		}
+		routes = append(routes, prefix)
+	}
+	d.routes[peerConf.publicKey] = routes
+
+	return nil
+}
+
+func (d *linuxDevice) RemovePeer(pk transport.NoisePublicKey) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	e := newSetDeviceEncoder(d.index)
+	e.nested(unix.WGDEVICE_A_PEERS, func(e *attrEncoder) {
+		e.nested(0, func(e *attrEncoder) {
+			e.bytes(unix.WGPEER_A_PUBLIC_KEY, pk[:])
+			e.uint32(unix.WGPEER_A_FLAGS, unix.WGPEER_F_REMOVE_ME)
+		})
+	})
+
+	if _, err := d.genl.execute(d.family, 0, e.buf); err != nil {
+		return err
+	}
+
+	for _, prefix := range d.routes[pk] {
+		if err := d.route(unix.RTM_DELROUTE, 0, prefix); err != nil && !errors.Is(err, unix.ESRCH) {
+			return fmt.Errorf("could not remove route to %s: %w", prefix, err)
+		}
+	}
+	delete(d.routes, pk)
+
+	return nil
+}
+
+func (d *linuxDevice) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	defer d.closeConns()
+
+	// Deleting the link also removes its addresses, and routes.
+	if _, err := d.rtnl.execute(unix.RTM_DELLINK, 0, ifInfomsg(d.index, 0, 0)); err != nil {
+		return fmt.Errorf("could not delete interface %s: %w", d.name, err)
+	}
+
+	return nil
+}
+
+func (d *linuxDevice) closeConns() {
+	_ = d.rtnl.Close()
+	_ = d.genl.Close()
+}
+
+// createLink creates a wireguard link, with the first free name.
+func (d *linuxDevice) createLink(mtu int) error {
+	for i := 0; i < maxInterfaces; i++ {
+		name := fmt.Sprintf("noisysockets%d", i)
+
+		e := attrEncoder{buf: ifInfomsg(0, 0, 0)}
+		e.string(unix.IFLA_IFNAME, name)
+		e.uint32(unix.IFLA_MTU, uint32(mtu))
+		e.nested(unix.IFLA_LINKINFO, func(e *attrEncoder) {
+			e.string(unix.IFLA_INFO_KIND, "wireguard")
+		})
+
+		_, err := d.rtnl.execute(unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL, e.buf)
+		if errors.Is(err, unix.EEXIST) {
+			continue
+		} else if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.EPERM) {
+			return fmt.Errorf("%w: %v", ErrNotSupported, err)
+		} else if err != nil {
+			return fmt.Errorf("could not create interface: %w", err)
+		}
+
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return fmt.Errorf("could not find interface %s: %w", name, err)
+		}
+
+		d.name = name
+		d.index = iface.Index
+
+		return nil
+	}
+
+	return fmt.Errorf("no free interface names")
+}
+
+// configure sets the private key, and listen port, of the interface, assigns
+// it its addresses, and brings it up.
+func (d *linuxDevice) configure(privateKey transport.NoisePrivateKey, listenPort uint16, addrs []netip.Addr) error {
+	e := newSetDeviceEncoder(d.index)
+	e.bytes(unix.WGDEVICE_A_PRIVATE_KEY, privateKey[:])
+	e.uint16(unix.WGDEVICE_A_LISTEN_PORT, listenPort)
+
+	if _, err := d.genl.execute(d.family, 0, e.buf); err != nil {
+		return fmt.Errorf("could not configure interface: %w", err)
+	}
+
+	for _, addr := range addrs {
+		if err := d.addAddress(addr); err != nil {
+			return fmt.Errorf("could not add address %s: %w", addr, err)
+		}
+	}
+
+	if _, err := d.rtnl.execute(unix.RTM_NEWLINK, 0, ifInfomsg(d.index, unix.IFF_UP, unix.IFF_UP)); err != nil {
+		return fmt.Errorf("could not bring interface up: %w", err)
+	}
+
+	return nil
+}
+
+func (d *linuxDevice) addAddress(addr netip.Addr) error {
+	var body []byte
+	body = append(body, addrFamily(addr), uint8(addr.BitLen()), unix.IFA_F_NODAD, unix.RT_SCOPE_UNIVERSE)
+	body = binary.NativeEndian.AppendUint32(body, uint32(d.index))
+
+	e := attrEncoder{buf: body}
+	e.bytes(unix.IFA_LOCAL, addr.AsSlice())
+	e.bytes(unix.IFA_ADDRESS, addr.AsSlice())
+
+	_, err := d.rtnl.execute(unix.RTM_NEWADDR, unix.NLM_F_CREATE|unix.NLM_F_EXCL, e.buf)
+	return err
+}
+
+func (d *linuxDevice) route(typ, flags uint16, prefix netip.Prefix) error {
+	body := []byte{
+		addrFamily(prefix.Addr()), uint8(prefix.Bits()), 0, 0,
+		unix.RT_TABLE_MAIN, unix.RTPROT_BOOT, unix.RT_SCOPE_LINK, unix.RTN_UNICAST,
+		0, 0, 0, 0,
+	}
+
+	e := attrEncoder{buf: body}
+	e.bytes(unix.RTA_DST, prefix.Addr().AsSlice())
+	e.uint32(unix.RTA_OIF, uint32(d.index))
+
+	_, err := d.rtnl.execute(typ, flags, e.buf)
+	return err
+}
+
+// resolveFamily returns the id of a generic netlink family.
+func resolveFamily(genl *netlinkConn, name string) (uint16, error) {
+	e := attrEncoder{buf: []byte{unix.CTRL_CMD_GETFAMILY, 1, 0, 0}}
+	e.string(unix.CTRL_ATTR_FAMILY_NAME, name)
+
+	replies, err := genl.execute(unix.GENL_ID_CTRL, 0, e.buf)
+	if err != nil {
+		return 0, fmt.Errorf("could not resolve %s family: %w", name, err)
+	}
+
+	for _, reply := range replies {
+		if len(reply) < sizeofGenlmsghdr {
+			continue
+		}
+
+		if id, ok := parseAttrs(reply[sizeofGenlmsghdr:])[unix.CTRL_ATTR_FAMILY_ID]; ok && len(id) == 2 {
+			return binary.NativeEndian.Uint16(id), nil
+		}
+	}
+
+	return 0, fmt.Errorf("could not resolve %s family", name)
+}
+
+// newSetDeviceEncoder starts a WG_CMD_SET_DEVICE request for an interface.
+func newSetDeviceEncoder(index int) *attrEncoder {
+	e := &attrEncoder{buf: []byte{unix.WG_CMD_SET_DEVICE, unix.WG_GENL_VERSION, 0, 0}}
+	e.uint32(unix.WGDEVICE_A_IFINDEX, uint32(index))
+	return e
+}
+
+// encodePeer encodes the configuration of a peer, as an element of
+// WGDEVICE_A_PEERS.
+func encodePeer(e *attrEncoder, peerConf *peerConfig, flags uint32) {
+	e.nested(0, func(e *attrEncoder) {
+		e.bytes(unix.WGPEER_A_PUBLIC_KEY, peerConf.publicKey[:])
+		e.bytes(unix.WGPEER_A_PRESHARED_KEY, peerConf.presharedKey[:])
+		e.uint32(unix.WGPEER_A_FLAGS, flags)
+		if peerConf.endpoint.IsValid() {
+			e.bytes(unix.WGPEER_A_ENDPOINT, encodeSockaddr(peerConf.endpoint))
+		}
+		e.uint16(unix.WGPEER_A_PERSISTENT_KEEPALIVE_INTERVAL, peerConf.keepalive)
+		e.nested(unix.WGPEER_A_ALLOWEDIPS, func(e *attrEncoder) {
+			for _, prefix := range peerConf.prefixes {
+				e.nested(0, func(e *attrEncoder) {
+					e.uint16(unix.WGALLOWEDIP_A_FAMILY, uint16(addrFamily(prefix.Addr())))
+					e.bytes(unix.WGALLOWEDIP_A_IPADDR, prefix.Addr().AsSlice())
+					e.uint8(unix.WGALLOWEDIP_A_CIDR_MASK, uint8(prefix.Bits()))
+				})
+			}
+		})
+	})
+}
+
+// encodeSockaddr encodes an address as a struct sockaddr_in, or sockaddr_in6.
+func encodeSockaddr(addrPort netip.AddrPort) []byte {
+	addr := addrPort.Addr().Unmap()
+
+	var b []byte
+	b = binary.NativeEndian.AppendUint16(b, uint16(addrFamily(addr)))
+	b = binary.BigEndian.AppendUint16(b, addrPort.Port())
+	if addr.Is4() {
+		b = append(b, addr.AsSlice()...)
+		return append(b, make([]byte, 8)...)
+	}
+
+	b = append(b, 0, 0, 0, 0) // flow info
+	b = append(b, addr.AsSlice()...)
+	return append(b, 0, 0, 0, 0) // scope id
+}
+
+func addrFamily(addr netip.Addr) uint8 {
+	if addr.Unmap().Is4() {
+		return unix.AF_INET
+	}
+	return unix.AF_INET6
+}
+
+// ifInfomsg encodes a struct ifinfomsg.
+func ifInfomsg(index int, flags, change uint32) []byte {
+	b := make([]byte, 8, unix.SizeofIfInfomsg)
+	binary.NativeEndian.PutUint32(b[4:], uint32(int32(index)))
+	b = binary.NativeEndian.AppendUint32(b, flags)
+	return binary.NativeEndian.AppendUint32(b, change)
+}
+
+func containsPrefix(prefixes []netip.Prefix, prefix netip.Prefix) bool {
+	for _, p := range prefixes {
+		if p == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+// bindToDevice binds sockets to the interface, so that they only send (and
+// receive) packets through it.
+func bindToDevice(name string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		if err := c.Control(func(fd uintptr) {
+			sockErr = unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, name)
+		}); err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
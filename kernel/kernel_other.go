@@ -0,0 +1,29 @@
+//go:build !linux
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package kernel
+
+import (
+	"net/netip"
+	"syscall"
+
+	"github.com/noisysockets/noisysockets/internal/transport"
+)
+
+func supported() bool {
+	return false
+}
+
+func newDevice(privateKey transport.NoisePrivateKey, listenPort uint16, mtu int, addrs []netip.Addr) (device, error) {
+	return nil, ErrNotSupported
+}
+
+func bindToDevice(name string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return ErrNotSupported
+	}
+}
@@ -0,0 +1,234 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package kernel
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpen(t *testing.T) {
+	logger := slogt.New(t)
+
+	privateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	t.Run("Userspace", func(t *testing.T) {
+		n, err := Open(logger, &v1alpha1.Config{
+			ListenPort: 12444,
+			PrivateKey: privateKey.String(),
+			IPs:        []string{"10.7.0.1"},
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, n.Close())
+		})
+
+		require.IsType(t, &noisysockets.NoisySocket{}, n)
+	})
+
+	t.Run("Auto With Userspace Only Features", func(t *testing.T) {
+		n, err := Open(logger, &v1alpha1.Config{
+			Backend:         BackendAuto,
+			ListenPort:      12445,
+			PrivateKey:      privateKey.String(),
+			IPs:             []string{"10.7.0.1"},
+			EnableDNSServer: true,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, n.Close())
+		})
+
+		require.IsType(t, &noisysockets.NoisySocket{}, n)
+	})
+
+	t.Run("Unknown Backend", func(t *testing.T) {
+		_, err := Open(logger, &v1alpha1.Config{
+			Backend:    "ebpf",
+			PrivateKey: privateKey.String(),
+		})
+		require.Error(t, err)
+	})
+
+	t.Run("Kernel With Userspace Only Features", func(t *testing.T) {
+		_, err := Open(logger, &v1alpha1.Config{
+			Backend:    BackendKernel,
+			PrivateKey: privateKey.String(),
+			Peers: []v1alpha1.WireGuardPeerConfig{{
+				PublicKey:   privateKey.PublicKey().String(),
+				Compression: "snappy",
+			}},
+		})
+		require.ErrorContains(t, err, "unsupported by kernel backend")
+	})
+}
+
+func TestCheckCompatible(t *testing.T) {
+	// Options applied by the kernel interface, every other option must be
+	// rejected (rather than silently ignored).
+	supported := map[string]bool{
+		"TypeMeta": true, "Name": true, "ListenPort": true, "Backend": true, "MTU": true, "PrivateKey": true,
+		"IPs": true, "Domain": true, "UseHostResolver": true, "StrictInterop": true, "Peers": true,
+	}
+
+	supportedPeer := map[string]bool{
+		"Name": true, "PublicKey": true, "PresharedKey": true, "Endpoint": true, "IPs": true, "PersistentKeepalive": true,
+	}
+
+	require.NoError(t, checkCompatible(&v1alpha1.Config{}))
+
+	confType := reflect.TypeOf(v1alpha1.Config{})
+	for i := 0; i < confType.NumField(); i++ {
+		field := confType.Field(i)
+
+		var conf v1alpha1.Config
+		setNonZero(reflect.ValueOf(&conf).Elem().Field(i))
+
+		err := checkCompatible(&conf)
+		if supported[field.Name] {
+			require.NoError(t, err, field.Name)
+		} else {
+			require.ErrorContains(t, err, "unsupported by kernel backend", field.Name)
+		}
+	}
+
+	peerConfType := reflect.TypeOf(v1alpha1.WireGuardPeerConfig{})
+	for i := 0; i < peerConfType.NumField(); i++ {
+		field := peerConfType.Field(i)
+
+		var peerConf v1alpha1.WireGuardPeerConfig
+		setNonZero(reflect.ValueOf(&peerConf).Elem().Field(i))
+
+		err := checkCompatible(&v1alpha1.Config{Peers: []v1alpha1.WireGuardPeerConfig{peerConf}})
+		if supportedPeer[field.Name] {
+			require.NoError(t, err, field.Name)
+		} else {
+			require.ErrorContains(t, err, "unsupported by kernel backend", field.Name)
+		}
+	}
+}
+
+// setNonZero sets a field to an arbitrary non-zero value.
+func setNonZero(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.String:
+		v.SetString("x")
+	case reflect.Int, reflect.Int64:
+		v.SetInt(1)
+	case reflect.Uint16:
+		v.SetUint(1)
+	case reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), 1, 1))
+	case reflect.Pointer:
+		v.Set(reflect.New(v.Type().Elem()))
+	case reflect.Struct:
+		// Embedded metadata (eg. TypeMeta).
+	default:
+		panic("unhandled kind " + v.Kind().String())
+	}
+}
+
+func TestInterface(t *testing.T) {
+	peerPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	dev := &fakeDevice{peers: make(map[transport.NoisePublicKey]*peerConfig)}
+
+	n := &Interface{
+		logger: slogt.New(t),
+		dev:    dev,
+		name:   "client",
+		domain: "my-net.internal",
+		addrs:  []netip.Addr{netip.MustParseAddr("10.7.0.1")},
+		peers:  make(map[transport.NoisePublicKey]*peer),
+	}
+
+	peerConf := v1alpha1.WireGuardPeerConfig{
+		Name:                "server",
+		PublicKey:           peerPrivateKey.PublicKey().String(),
+		Endpoint:            "127.0.0.1:51820",
+		IPs:                 []string{"10.7.0.2", "192.168.1.0/24"},
+		PersistentKeepalive: 25,
+	}
+	require.NoError(t, n.AddPeer(peerConf))
+
+	kernelPeerConf := dev.peers[peerPrivateKey.PublicKey()]
+	require.NotNil(t, kernelPeerConf)
+	require.Equal(t, netip.MustParseAddrPort("127.0.0.1:51820"), kernelPeerConf.endpoint)
+	require.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("10.7.0.2/32"),
+		netip.MustParsePrefix("192.168.1.0/24"),
+	}, kernelPeerConf.prefixes)
+	require.Equal(t, uint16(25), kernelPeerConf.keepalive)
+
+	addrs, err := n.LookupHost("server.my-net.internal")
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.7.0.2"}, addrs)
+
+	addrs, err = n.LookupHost("client")
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.7.0.1"}, addrs)
+
+	_, err = n.LookupHost("example.com")
+	require.Error(t, err)
+
+	require.True(t, n.reachable(netip.MustParseAddr("192.168.1.10")))
+	require.False(t, n.reachable(netip.MustParseAddr("192.168.2.10")))
+
+	_, err = n.Dial("tcp", "192.168.2.10:80")
+	require.ErrorIs(t, err, noisysockets.ErrNoRouteToPeer)
+
+	// Options that need the userspace data plane are refused.
+	require.Error(t, n.AddPeer(v1alpha1.WireGuardPeerConfig{
+		PublicKey:      peerPrivateKey.PublicKey().String(),
+		DefaultGateway: true,
+	}))
+
+	require.NoError(t, n.RemovePeer(peerConf.PublicKey))
+	require.Empty(t, dev.peers)
+
+	require.ErrorIs(t, n.RemovePeer(peerConf.PublicKey), noisysockets.ErrUnknownPeer)
+
+	_, err = n.LookupHost("server")
+	require.Error(t, err)
+
+	require.NoError(t, n.Close())
+	require.True(t, dev.closed)
+}
+
+type fakeDevice struct {
+	peers  map[transport.NoisePublicKey]*peerConfig
+	closed bool
+}
+
+func (d *fakeDevice) Name() string {
+	return "noisysockets0"
+}
+
+func (d *fakeDevice) SetPeer(peerConf *peerConfig) error {
+	d.peers[peerConf.publicKey] = peerConf
+	return nil
+}
+
+func (d *fakeDevice) RemovePeer(pk transport.NoisePublicKey) error {
+	delete(d.peers, pk)
+	return nil
+}
+
+func (d *fakeDevice) Close() error {
+	d.closed = true
+	return nil
+}
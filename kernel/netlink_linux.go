@@ -0,0 +1,160 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package kernel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// sizeofGenlmsghdr is the size of the header of generic netlink messages.
+const sizeofGenlmsghdr = 4
+
+// netlinkConn is a netlink socket, used to make requests of the kernel.
+type netlinkConn struct {
+	fd  int
+	seq uint32
+}
+
+func dialNetlink(proto int) (*netlinkConn, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, fmt.Errorf("could not open netlink socket: %w", err)
+	}
+
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("could not bind netlink socket: %w", err)
+	}
+
+	return &netlinkConn{fd: fd}, nil
+}
+
+func (c *netlinkConn) Close() error {
+	return unix.Close(c.fd)
+}
+
+// execute sends a request, and waits for the kernel to acknowledge it,
+// returning the payloads of any replies.
+func (c *netlinkConn) execute(typ, flags uint16, body []byte) ([][]byte, error) {
+	c.seq++
+
+	msg := make([]byte, unix.NLMSG_HDRLEN, unix.NLMSG_HDRLEN+len(body))
+	binary.NativeEndian.PutUint32(msg[0:], uint32(unix.NLMSG_HDRLEN+len(body)))
+	binary.NativeEndian.PutUint16(msg[4:], typ)
+	binary.NativeEndian.PutUint16(msg[6:], flags|unix.NLM_F_REQUEST|unix.NLM_F_ACK)
+	binary.NativeEndian.PutUint32(msg[8:], c.seq)
+	msg = append(msg, body...)
+
+	if err := unix.Sendto(c.fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, fmt.Errorf("could not send netlink request: %w", err)
+	}
+
+	var replies [][]byte
+	buf := make([]byte, 32*1024)
+	for {
+		n, _, err := unix.Recvfrom(c.fd, buf, 0)
+		if err != nil {
+			return nil, fmt.Errorf("could not receive netlink reply: %w", err)
+		}
+
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, fmt.Errorf("could not parse netlink reply: %w", err)
+		}
+
+		for _, m := range msgs {
+			if m.Header.Seq != c.seq {
+				continue
+			}
+
+			switch m.Header.Type {
+			case unix.NLMSG_ERROR:
+				if len(m.Data) < 4 {
+					return nil, fmt.Errorf("truncated netlink error")
+				}
+				if errno := int32(binary.NativeEndian.Uint32(m.Data)); errno != 0 {
+					return nil, unix.Errno(-errno)
+				}
+				return replies, nil
+			case unix.NLMSG_DONE:
+				return replies, nil
+			default:
+				replies = append(replies, append([]byte(nil), m.Data...))
+			}
+		}
+	}
+}
+
+// attrEncoder encodes netlink attributes.
+type attrEncoder struct {
+	buf []byte
+}
+
+func (e *attrEncoder) bytes(typ uint16, v []byte) {
+	e.buf = binary.NativeEndian.AppendUint16(e.buf, uint16(unix.SizeofNlAttr+len(v)))
+	e.buf = binary.NativeEndian.AppendUint16(e.buf, typ)
+	e.buf = append(e.buf, v...)
+	e.pad()
+}
+
+func (e *attrEncoder) string(typ uint16, v string) {
+	e.bytes(typ, append([]byte(v), 0))
+}
+
+func (e *attrEncoder) uint8(typ uint16, v uint8) {
+	e.bytes(typ, []byte{v})
+}
+
+func (e *attrEncoder) uint16(typ uint16, v uint16) {
+	e.bytes(typ, binary.NativeEndian.AppendUint16(nil, v))
+}
+
+func (e *attrEncoder) uint32(typ uint16, v uint32) {
+	e.bytes(typ, binary.NativeEndian.AppendUint32(nil, v))
+}
+
+// nested encodes the attributes added by fn as a nested attribute.
+func (e *attrEncoder) nested(typ uint16, fn func(e *attrEncoder)) {
+	start := len(e.buf)
+	e.buf = append(e.buf, make([]byte, unix.SizeofNlAttr)...)
+
+	fn(e)
+
+	binary.NativeEndian.PutUint16(e.buf[start:], uint16(len(e.buf)-start))
+	binary.NativeEndian.PutUint16(e.buf[start+2:], typ|unix.NLA_F_NESTED)
+}
+
+func (e *attrEncoder) pad() {
+	for len(e.buf)%unix.NLA_ALIGNTO != 0 {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+// parseAttrs decodes netlink attributes, by type.
+func parseAttrs(b []byte) map[uint16][]byte {
+	attrs := make(map[uint16][]byte)
+	for len(b) >= unix.SizeofNlAttr {
+		length := int(binary.NativeEndian.Uint16(b))
+		typ := binary.NativeEndian.Uint16(b[2:]) &^ (unix.NLA_F_NESTED | unix.NLA_F_NET_BYTEORDER)
+		if length < unix.SizeofNlAttr || length > len(b) {
+			break
+		}
+
+		attrs[typ] = b[unix.SizeofNlAttr:length]
+
+		aligned := (length + unix.NLA_ALIGNTO - 1) &^ (unix.NLA_ALIGNTO - 1)
+		if aligned > len(b) {
+			break
+		}
+		b = b[aligned:]
+	}
+
+	return attrs
+}
@@ -0,0 +1,77 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package kernel
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestEncodePeer(t *testing.T) {
+	privateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	peerConf := &peerConfig{
+		publicKey: privateKey.PublicKey(),
+		endpoint:  netip.MustParseAddrPort("[2001:db8::1]:51820"),
+		keepalive: 25,
+		prefixes: []netip.Prefix{
+			netip.MustParsePrefix("10.7.0.2/32"),
+			netip.MustParsePrefix("fd00::/64"),
+		},
+	}
+
+	e := newSetDeviceEncoder(7)
+	e.nested(unix.WGDEVICE_A_PEERS, func(e *attrEncoder) {
+		encodePeer(e, peerConf, unix.WGPEER_F_REPLACE_ALLOWEDIPS)
+	})
+	require.Zero(t, len(e.buf)%unix.NLA_ALIGNTO)
+
+	require.Equal(t, []byte{unix.WG_CMD_SET_DEVICE, unix.WG_GENL_VERSION, 0, 0}, e.buf[:sizeofGenlmsghdr])
+
+	attrs := parseAttrs(e.buf[sizeofGenlmsghdr:])
+	require.Equal(t, uint32(7), binary.NativeEndian.Uint32(attrs[unix.WGDEVICE_A_IFINDEX]))
+
+	peerAttrs := parseAttrs(parseAttrs(attrs[unix.WGDEVICE_A_PEERS])[0])
+	require.Equal(t, peerConf.publicKey[:], peerAttrs[unix.WGPEER_A_PUBLIC_KEY])
+	require.Equal(t, uint32(unix.WGPEER_F_REPLACE_ALLOWEDIPS), binary.NativeEndian.Uint32(peerAttrs[unix.WGPEER_A_FLAGS]))
+	require.Equal(t, uint16(25), binary.NativeEndian.Uint16(peerAttrs[unix.WGPEER_A_PERSISTENT_KEEPALIVE_INTERVAL]))
+
+	endpoint := peerAttrs[unix.WGPEER_A_ENDPOINT]
+	require.Len(t, endpoint, unix.SizeofSockaddrInet6)
+	require.Equal(t, uint16(unix.AF_INET6), binary.NativeEndian.Uint16(endpoint))
+	require.Equal(t, uint16(51820), binary.BigEndian.Uint16(endpoint[2:]))
+	require.Equal(t, netip.MustParseAddr("2001:db8::1").AsSlice(), endpoint[8:24])
+
+	// Nested attributes of the same type can't be told apart by parseAttrs,
+	// so walk the allowed IPs by hand.
+	allowedIPs := peerAttrs[unix.WGPEER_A_ALLOWEDIPS]
+	var prefixes []netip.Prefix
+	for len(allowedIPs) > 0 {
+		length := int(binary.NativeEndian.Uint16(allowedIPs))
+		allowedIPAttrs := parseAttrs(allowedIPs[unix.SizeofNlAttr:length])
+
+		addr, ok := netip.AddrFromSlice(allowedIPAttrs[unix.WGALLOWEDIP_A_IPADDR])
+		require.True(t, ok)
+		prefixes = append(prefixes, netip.PrefixFrom(addr, int(allowedIPAttrs[unix.WGALLOWEDIP_A_CIDR_MASK][0])))
+
+		allowedIPs = allowedIPs[(length+unix.NLA_ALIGNTO-1)&^(unix.NLA_ALIGNTO-1):]
+	}
+	require.Equal(t, peerConf.prefixes, prefixes)
+}
+
+func TestEncodeSockaddr(t *testing.T) {
+	sa := encodeSockaddr(netip.MustParseAddrPort("192.0.2.1:51820"))
+	require.Len(t, sa, unix.SizeofSockaddrInet4)
+	require.Equal(t, uint16(unix.AF_INET), binary.NativeEndian.Uint16(sa))
+	require.Equal(t, uint16(51820), binary.BigEndian.Uint16(sa[2:]))
+	require.Equal(t, []byte{192, 0, 2, 1}, sa[4:8])
+}
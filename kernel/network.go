@@ -0,0 +1,370 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package kernel
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+)
+
+// defaultMTU is the MTU of the interface, if not configured (the same as the
+// userspace data plane).
+const defaultMTU = 1420
+
+// peerConfig is the configuration of a peer, as programmed into the kernel.
+type peerConfig struct {
+	publicKey    transport.NoisePublicKey
+	presharedKey transport.NoisePresharedKey
+	endpoint     netip.AddrPort
+	keepalive    uint16
+	prefixes     []netip.Prefix
+}
+
+// device is a kernel WireGuard interface.
+type device interface {
+	// Name returns the name of the interface.
+	Name() string
+	// SetPeer adds a peer, or replaces the configuration of an existing one,
+	// and routes its prefixes to the interface.
+	SetPeer(peerConf *peerConfig) error
+	// RemovePeer removes a peer, and the routes to its prefixes.
+	RemovePeer(pk transport.NoisePublicKey) error
+	// Close deletes the interface (and its addresses and routes).
+	Close() error
+}
+
+type peer struct {
+	name     string
+	prefixes []netip.Prefix
+}
+
+// Interface is a kernel WireGuard interface, with the same API as a
+// NoisySocket. Connections use the host's network stack, and are bound to the
+// interface, so they can only reach (or be reached from) peers.
+type Interface struct {
+	logger          *slog.Logger
+	dev             device
+	name            string
+	domain          string
+	useHostResolver bool
+	addrs           []netip.Addr
+	mu              sync.RWMutex
+	peers           map[transport.NoisePublicKey]*peer
+	closeOnce       sync.Once
+	closeErr        error
+}
+
+// NewInterface creates a kernel WireGuard interface from the configuration.
+// It returns ErrNotSupported if kernel WireGuard isn't supported, and an error
+// if the configuration uses features that are only available in the userspace
+// data plane.
+func NewInterface(logger *slog.Logger, conf *v1alpha1.Config) (*Interface, error) {
+	if err := checkCompatible(conf); err != nil {
+		return nil, err
+	}
+
+	var privateKey transport.NoisePrivateKey
+	if err := privateKey.FromString(conf.PrivateKey); err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+
+	var addrs []netip.Addr
+	for _, ip := range conf.IPs {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse local address %q: %w", ip, err)
+		}
+		addrs = append(addrs, addr)
+	}
+
+	peerConfs := make([]*peerConfig, 0, len(conf.Peers))
+	for _, peerConf := range conf.Peers {
+		kernelPeerConf, err := parsePeerConfig(&peerConf)
+		if err != nil {
+			return nil, err
+		}
+		peerConfs = append(peerConfs, kernelPeerConf)
+	}
+
+	mtu := conf.MTU
+	if mtu == 0 {
+		mtu = defaultMTU
+	}
+
+	dev, err := newDevice(privateKey, conf.ListenPort, mtu, addrs)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &Interface{
+		logger:          logger,
+		dev:             dev,
+		name:            conf.Name,
+		domain:          strings.TrimSuffix(conf.Domain, "."),
+		useHostResolver: conf.UseHostResolver,
+		addrs:           addrs,
+		peers:           make(map[transport.NoisePublicKey]*peer),
+	}
+
+	for i, peerConf := range conf.Peers {
+		if err := n.setPeer(peerConf.Name, peerConfs[i]); err != nil {
+			_ = n.Close()
+			return nil, err
+		}
+	}
+
+	logger.Info("Created kernel WireGuard interface", "name", dev.Name())
+
+	return n, nil
+}
+
+// Close deletes the interface, closing any connections using it.
+func (n *Interface) Close() error {
+	n.closeOnce.Do(func() {
+		n.closeErr = n.dev.Close()
+	})
+
+	return n.closeErr
+}
+
+// InterfaceName returns the name of the kernel interface (eg. "noisysockets0").
+func (n *Interface) InterfaceName() string {
+	return n.dev.Name()
+}
+
+// AddPeer adds a peer, or replaces the configuration of an existing one.
+func (n *Interface) AddPeer(peerConf v1alpha1.WireGuardPeerConfig) error {
+	if err := checkPeerCompatible(&peerConf); err != nil {
+		return fmt.Errorf("unsupported by kernel backend: %w", err)
+	}
+
+	kernelPeerConf, err := parsePeerConfig(&peerConf)
+	if err != nil {
+		return err
+	}
+
+	return n.setPeer(peerConf.Name, kernelPeerConf)
+}
+
+// RemovePeer removes a peer, identified by its encoded public key.
+func (n *Interface) RemovePeer(publicKey string) error {
+	var pk transport.NoisePublicKey
+	if err := pk.FromString(publicKey); err != nil {
+		return fmt.Errorf("failed to parse peer public key: %w", err)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.peers[pk]; !ok {
+		return fmt.Errorf("%w: %s", noisysockets.ErrUnknownPeer, publicKey)
+	}
+
+	if err := n.dev.RemovePeer(pk); err != nil {
+		return fmt.Errorf("could not remove peer: %w", err)
+	}
+
+	delete(n.peers, pk)
+
+	return nil
+}
+
+// Dial connects to an address (eg. "peer:80") through the interface.
+func (n *Interface) Dial(network, address string) (net.Conn, error) {
+	return n.DialContext(context.Background(), network, address)
+}
+
+// DialContext is like Dial, but with a context.
+func (n *Interface) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	addrs, err := n.LookupHost(host)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	var firstErr error
+	for _, addrStr := range addrs {
+		addr, err := netip.ParseAddr(addrStr)
+		if err != nil {
+			continue
+		}
+
+		if !n.reachable(addr) {
+			if firstErr == nil {
+				firstErr = &net.OpError{Op: "dial", Net: network, Err: noisysockets.ErrNoRouteToPeer}
+			}
+			continue
+		}
+
+		d := net.Dialer{Control: bindToDevice(n.dev.Name())}
+		conn, err := d.DialContext(ctx, network, net.JoinHostPort(addr.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if firstErr == nil {
+		firstErr = &net.OpError{Op: "dial", Net: network, Err: noisysockets.ErrNoRouteToPeer}
+	}
+
+	return nil, firstErr
+}
+
+// Listen listens for connections from peers, on the interface.
+func (n *Interface) Listen(network, address string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: bindToDevice(n.dev.Name())}
+	return lc.Listen(context.Background(), network, address)
+}
+
+// ListenPacket listens for packets from peers, on the interface.
+func (n *Interface) ListenPacket(network, address string) (net.PacketConn, error) {
+	lc := net.ListenConfig{Control: bindToDevice(n.dev.Name())}
+	return lc.ListenPacket(context.Background(), network, address)
+}
+
+// LookupHost returns the addresses of a host, this interface, or one of its
+// peers (by name). Other names are only resolved if UseHostResolver is set.
+func (n *Interface) LookupHost(host string) ([]string, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []string{addr.String()}, nil
+	}
+
+	name := strings.TrimSuffix(host, ".")
+	if n.domain != "" {
+		name = strings.TrimSuffix(name, "."+n.domain)
+	}
+
+	var addrs []string
+	if n.name != "" && name == n.name {
+		for _, addr := range n.addrs {
+			addrs = append(addrs, addr.String())
+		}
+	} else {
+		n.mu.RLock()
+		for _, p := range n.peers {
+			if p.name != "" && name == p.name {
+				for _, prefix := range p.prefixes {
+					if prefix.IsSingleIP() {
+						addrs = append(addrs, prefix.Addr().String())
+					}
+				}
+			}
+		}
+		n.mu.RUnlock()
+	}
+
+	if len(addrs) > 0 {
+		return addrs, nil
+	}
+
+	if n.useHostResolver {
+		return net.DefaultResolver.LookupHost(context.Background(), host)
+	}
+
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (n *Interface) setPeer(name string, peerConf *peerConfig) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if err := n.dev.SetPeer(peerConf); err != nil {
+		return fmt.Errorf("could not configure peer %s: %w", peerConf.publicKey, err)
+	}
+
+	n.peers[peerConf.publicKey] = &peer{
+		name:     name,
+		prefixes: peerConf.prefixes,
+	}
+
+	return nil
+}
+
+// reachable reports whether an address belongs to this interface, or is
+// routed to one of its peers.
+func (n *Interface) reachable(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	for _, localAddr := range n.addrs {
+		if addr == localAddr {
+			return true
+		}
+	}
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	for _, p := range n.peers {
+		for _, prefix := range p.prefixes {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// parsePeerConfig parses the configuration of a peer into its kernel
+// representation.
+func parsePeerConfig(peerConf *v1alpha1.WireGuardPeerConfig) (*peerConfig, error) {
+	kernelPeerConf := &peerConfig{
+		keepalive: peerConf.PersistentKeepalive,
+	}
+
+	if err := kernelPeerConf.publicKey.FromString(peerConf.PublicKey); err != nil {
+		return nil, fmt.Errorf("failed to parse peer public key: %w", err)
+	}
+
+	if peerConf.PresharedKey != "" {
+		if err := kernelPeerConf.presharedKey.FromString(peerConf.PresharedKey); err != nil {
+			return nil, fmt.Errorf("failed to parse peer preshared key: %w", err)
+		}
+	}
+
+	for _, ip := range peerConf.IPs {
+		var prefix netip.Prefix
+		var err error
+		if strings.Contains(ip, "/") {
+			prefix, err = netip.ParsePrefix(ip)
+		} else {
+			var addr netip.Addr
+			addr, err = netip.ParseAddr(ip)
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not parse peer address %q: %v", ip, err)
+		}
+		kernelPeerConf.prefixes = append(kernelPeerConf.prefixes, prefix.Masked())
+	}
+
+	if peerConf.Endpoint != "" {
+		// The kernel only accepts an IP address, so host names are resolved now.
+		endpoint, err := net.ResolveUDPAddr("udp", peerConf.Endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("could not resolve peer endpoint %q: %w", peerConf.Endpoint, err)
+		}
+		kernelPeerConf.endpoint = netip.AddrPortFrom(endpoint.AddrPort().Addr().Unmap(), endpoint.AddrPort().Port())
+	}
+
+	return kernelPeerConf, nil
+}
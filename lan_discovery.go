@@ -0,0 +1,281 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+)
+
+const (
+	// defaultLANDiscoveryGroup is the multicast group on which sockets are
+	// announced by default.
+	defaultLANDiscoveryGroup = "239.255.78.83:51822"
+	// defaultLANDiscoveryInterval is how often the socket is announced by
+	// default.
+	defaultLANDiscoveryInterval = 5 * time.Second
+	// maxLANAnnouncementSize is the maximum size of an announcement.
+	maxLANAnnouncementSize = 1024
+	// maxLANDiscoveredPeers is the maximum number of peers that will be added
+	// by LAN discovery.
+	maxLANDiscoveredPeers = 256
+)
+
+// lanAnnouncement is multicast to the local network, to tell other sockets
+// how to reach us.
+type lanAnnouncement struct {
+	Name      string   `json:"name,omitempty"`
+	PublicKey string   `json:"publicKey"`
+	IPs       []string `json:"ips,omitempty"`
+	// Port is the UDP port the socket is listening on, its address is the
+	// source address of the announcement.
+	Port uint16 `json:"port"`
+}
+
+// lanDiscoveryOptions are the parsed LAN discovery configuration.
+type lanDiscoveryOptions struct {
+	group    *net.UDPAddr
+	interval time.Duration
+}
+
+func parseLANDiscoveryConfig(conf *v1alpha1.LANDiscoveryConfig) (lanDiscoveryOptions, error) {
+	opts := lanDiscoveryOptions{
+		interval: defaultLANDiscoveryInterval,
+	}
+
+	if conf.IntervalSeconds < 0 {
+		return lanDiscoveryOptions{}, fmt.Errorf("lan discovery interval must not be negative")
+	}
+	if conf.IntervalSeconds > 0 {
+		opts.interval = time.Duration(conf.IntervalSeconds) * time.Second
+	}
+
+	group := conf.Group
+	if group == "" {
+		group = defaultLANDiscoveryGroup
+	}
+
+	groupAddr, err := netip.ParseAddrPort(group)
+	if err != nil {
+		return lanDiscoveryOptions{}, fmt.Errorf("could not parse multicast group: %w", err)
+	}
+
+	if !groupAddr.Addr().IsMulticast() {
+		return lanDiscoveryOptions{}, fmt.Errorf("%s is not a multicast group", groupAddr.Addr())
+	}
+
+	opts.group = net.UDPAddrFromAddrPort(groupAddr)
+
+	return opts, nil
+}
+
+// lanDiscovery announces the socket to the local network, and adds the peers
+// that announce themselves.
+type lanDiscovery struct {
+	logger *slog.Logger
+	s      *NoisySocket
+	opts   lanDiscoveryOptions
+	pc     *net.UDPConn
+	// sender sends announcements, multicast loopback is disabled on pc, so
+	// other sockets on the same host wouldn't hear them.
+	sender *net.UDPConn
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu sync.Mutex // protects endpoints
+	// endpoints are the endpoints of peers that were discovered, or updated, by
+	// us. Peers are only updated if their endpoint hasn't since been changed by
+	// something else (eg. the configuration).
+	endpoints map[transport.NoisePublicKey]string
+}
+
+func newLANDiscovery(logger *slog.Logger, s *NoisySocket, opts lanDiscoveryOptions) (*lanDiscovery, error) {
+	network := "udp4"
+	if opts.group.IP.To4() == nil {
+		network = "udp6"
+	}
+
+	pc, err := net.ListenMulticastUDP(network, nil, opts.group)
+	if err != nil {
+		return nil, fmt.Errorf("could not join multicast group: %w", err)
+	}
+
+	sender, err := net.ListenUDP(network, nil)
+	if err != nil {
+		_ = pc.Close()
+		return nil, fmt.Errorf("could not open announcement socket: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	d := &lanDiscovery{
+		logger:    logger,
+		s:         s,
+		opts:      opts,
+		pc:        pc,
+		sender:    sender,
+		cancel:    cancel,
+		endpoints: make(map[transport.NoisePublicKey]string),
+	}
+
+	d.wg.Add(2)
+	go d.run(ctx)
+	go d.receive()
+
+	return d, nil
+}
+
+// Close stops announcing the socket, and discovering peers.
+func (d *lanDiscovery) Close() error {
+	d.cancel()
+	err := d.pc.Close()
+	d.wg.Wait()
+	return errors.Join(err, d.sender.Close())
+}
+
+func (d *lanDiscovery) run(ctx context.Context) {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(d.opts.interval)
+	defer ticker.Stop()
+
+	for {
+		d.announce()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// announce multicasts our public key, addresses, and port.
+func (d *lanDiscovery) announce() {
+	ann := lanAnnouncement{
+		Name:      d.s.localName,
+		PublicKey: d.s.sourceSink.publicKey.String(),
+		Port:      d.s.transport.Port(),
+	}
+	for _, addr := range d.s.localAddrs.load() {
+		ann.IPs = append(ann.IPs, addr.String())
+	}
+
+	payload, err := json.Marshal(&ann)
+	if err != nil {
+		d.logger.Warn("Failed to marshal LAN announcement", "error", err)
+		return
+	}
+
+	if _, err := d.sender.WriteToUDP(payload, d.opts.group); err != nil {
+		d.logger.Debug("Failed to send LAN announcement", "error", err)
+	}
+}
+
+func (d *lanDiscovery) receive() {
+	defer d.wg.Done()
+
+	buf := make([]byte, maxLANAnnouncementSize)
+	for {
+		n, from, err := d.pc.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			d.logger.Debug("Failed to receive LAN announcement", "error", err)
+			continue
+		}
+
+		var ann lanAnnouncement
+		if err := json.Unmarshal(buf[:n], &ann); err != nil {
+			d.logger.Debug("Ignoring invalid LAN announcement", "from", from, "error", err)
+			continue
+		}
+
+		if err := d.handleAnnouncement(from.Addr().Unmap(), &ann); err != nil {
+			d.logger.Debug("Ignoring LAN announcement", "from", from, "error", err)
+		}
+	}
+}
+
+// handleAnnouncement adds the announced peer, or updates its endpoint if it is
+// already known.
+func (d *lanDiscovery) handleAnnouncement(from netip.Addr, ann *lanAnnouncement) error {
+	var pk transport.NoisePublicKey
+	if err := pk.FromString(ann.PublicKey); err != nil {
+		return fmt.Errorf("failed to parse public key: %w", err)
+	}
+
+	// We hear our own announcements too.
+	if pk == d.s.sourceSink.publicKey {
+		return nil
+	}
+
+	if ann.Port == 0 {
+		return fmt.Errorf("peer is not listening on a port")
+	}
+
+	endpoint := net.JoinHostPort(from.String(), strconv.Itoa(int(ann.Port)))
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.s.peerConfigsMu.Lock()
+	peerConf, known := d.s.peerConfigs[pk]
+	// Forget about peers that have since been removed.
+	for pk := range d.endpoints {
+		if _, ok := d.s.peerConfigs[pk]; !ok {
+			delete(d.endpoints, pk)
+		}
+	}
+	d.s.peerConfigsMu.Unlock()
+
+	if known {
+		// Peers with a configured endpoint are left alone.
+		if peerConf.Endpoint == endpoint || (peerConf.Endpoint != "" && peerConf.Endpoint != d.endpoints[pk]) {
+			return nil
+		}
+
+		if err := d.s.SetPeerEndpoint(pk.String(), endpoint); err != nil {
+			return err
+		}
+		d.endpoints[pk] = endpoint
+
+		d.logger.Debug("Updated endpoint of LAN peer", "peer", ann.Name, "endpoint", endpoint)
+
+		return nil
+	}
+
+	if len(d.endpoints) >= maxLANDiscoveredPeers {
+		return fmt.Errorf("too many peers")
+	}
+
+	if err := d.s.AddPeer(v1alpha1.WireGuardPeerConfig{
+		Name:      ann.Name,
+		PublicKey: ann.PublicKey,
+		Endpoint:  endpoint,
+		IPs:       ann.IPs,
+	}); err != nil {
+		return err
+	}
+	d.endpoints[pk] = endpoint
+
+	d.logger.Info("Discovered LAN peer", "peer", ann.Name, "endpoint", endpoint)
+
+	return nil
+}
@@ -0,0 +1,104 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets_test
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoisySocket_LANDiscovery(t *testing.T) {
+	logger := slogt.New(t)
+
+	lanDiscovery := &v1alpha1.LANDiscoveryConfig{
+		Group:           "239.255.78.83:12424",
+		IntervalSeconds: 1,
+	}
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:         "server",
+		ListenPort:   12425,
+		PrivateKey:   serverPrivateKey.String(),
+		IPs:          []string{"10.7.0.1"},
+		LANDiscovery: lanDiscovery,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+	})
+
+	clientSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:         "client",
+		ListenPort:   12426,
+		PrivateKey:   clientPrivateKey.String(),
+		IPs:          []string{"10.7.0.2"},
+		LANDiscovery: lanDiscovery,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, clientSocket.Close())
+	})
+
+	require.Eventually(t, func() bool {
+		_, serverErr := serverSocket.PeerStatus("client")
+		_, clientErr := clientSocket.PeerStatus("server")
+		return serverErr == nil && clientErr == nil
+	}, 10*time.Second, 100*time.Millisecond)
+
+	status, err := clientSocket.PeerStatus("server")
+	require.NoError(t, err)
+	require.Equal(t, serverPrivateKey.PublicKey().String(), status.PublicKey)
+
+	lis, err := serverSocket.Listen("tcp", ":80")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = lis.Close()
+	})
+
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		_, _ = conn.Write([]byte("hello"))
+	}()
+
+	conn, err := clientSocket.Dial("tcp", "server:80")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	buf, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+
+	t.Run("Invalid Config", func(t *testing.T) {
+		_, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+			PrivateKey: clientPrivateKey.String(),
+			IPs:        []string{"10.7.0.2"},
+			LANDiscovery: &v1alpha1.LANDiscoveryConfig{
+				Group: "10.0.0.1:12424",
+			},
+		})
+		require.Error(t, err)
+	})
+}
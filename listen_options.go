@@ -0,0 +1,234 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// ListenOption configures a listener created with ListenWithOptions().
+type ListenOption func(*listenOptions)
+
+type listenOptions struct {
+	peerNames      []string
+	peerPublicKeys []string
+	reuseAddr      bool
+	reusePort      bool
+}
+
+func (opts *listenOptions) hasPeerFilter() bool {
+	return len(opts.peerNames) > 0 || len(opts.peerPublicKeys) > 0
+}
+
+// apply sets the socket options of an endpoint, before it is bound.
+func (opts *listenOptions) apply(ep tcpip.Endpoint) {
+	if opts.reuseAddr {
+		ep.SocketOptions().SetReuseAddress(true)
+	}
+
+	if opts.reusePort {
+		ep.SocketOptions().SetReusePort(true)
+	}
+}
+
+// WithAllowedPeers restricts a listener to connections from the named peers.
+func WithAllowedPeers(names ...string) ListenOption {
+	return func(opts *listenOptions) {
+		opts.peerNames = append(opts.peerNames, names...)
+	}
+}
+
+// WithAllowedPublicKeys restricts a listener to connections from the peers with
+// the given (encoded) public keys.
+func WithAllowedPublicKeys(publicKeys ...string) ListenOption {
+	return func(opts *listenOptions) {
+		opts.peerPublicKeys = append(opts.peerPublicKeys, publicKeys...)
+	}
+}
+
+// ListenConfig contains options for listening on the mesh, it is the equivalent
+// of net.ListenConfig. As with net.Listen, the host of the address selects
+// which of the socket's addresses to listen on (by default its first), and the
+// network (eg. "tcp4" or "tcp6") restricts a listener to IPv4 or IPv6.
+type ListenConfig struct {
+	// ReuseAddr allows the address to be reused while connections of a previous
+	// listener linger (eg. in TIME_WAIT), so that servers can restart quickly.
+	// It is the equivalent of SO_REUSEADDR.
+	ReuseAddr bool
+	// ReusePort allows several listeners, that all set it, to share the same
+	// address and port. Connections (or datagrams) are distributed between them.
+	// It is the equivalent of SO_REUSEPORT.
+	ReusePort bool
+	// Options are further options for TCP listeners (eg. WithAllowedPeers).
+	Options []ListenOption
+}
+
+// Listen announces on a mesh address of the socket, see NoisySocket.Listen().
+// The context only affects the creation of the listener.
+func (lc *ListenConfig) Listen(ctx context.Context, socket *NoisySocket, network, address string) (net.Listener, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: mapErr(err)}
+	}
+
+	return socket.listen(network, address, lc.listenOptions())
+}
+
+// ListenPacket announces on a mesh address of the socket, see
+// NoisySocket.ListenPacket(). The context only affects the creation of the
+// listener.
+func (lc *ListenConfig) ListenPacket(ctx context.Context, socket *NoisySocket, network, address string) (net.PacketConn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: mapErr(err)}
+	}
+
+	return socket.listenPacket(network, address, lc.listenOptions())
+}
+
+func (lc *ListenConfig) listenOptions() *listenOptions {
+	opts := &listenOptions{
+		reuseAddr: lc.ReuseAddr,
+		reusePort: lc.ReusePort,
+	}
+
+	for _, opt := range lc.Options {
+		opt(opts)
+	}
+
+	return opts
+}
+
+// listenerFilter restricts the peers that can connect to a listener.
+type listenerFilter struct {
+	addr       netip.AddrPort
+	names      []string
+	publicKeys map[transport.NoisePublicKey]struct{}
+}
+
+func newListenerFilter(addr netip.AddrPort, opts *listenOptions) (*listenerFilter, error) {
+	f := &listenerFilter{
+		addr:       addr,
+		names:      opts.peerNames,
+		publicKeys: make(map[transport.NoisePublicKey]struct{}, len(opts.peerPublicKeys)),
+	}
+
+	for _, s := range opts.peerPublicKeys {
+		var publicKey transport.NoisePublicKey
+		if err := publicKey.FromString(s); err != nil {
+			return nil, fmt.Errorf("failed to parse public key: %w", err)
+		}
+
+		f.publicKeys[publicKey] = struct{}{}
+	}
+
+	return f, nil
+}
+
+// matches reports whether a connection attempt to dst is for the listener.
+func (f *listenerFilter) matches(dst netip.AddrPort) bool {
+	if dst.Port() != f.addr.Port() {
+		return false
+	}
+
+	return !f.addr.Addr().IsValid() || f.addr.Addr().IsUnspecified() || f.addr.Addr() == dst.Addr()
+}
+
+// listenerFilters are the filters of a socket's listeners.
+type listenerFilters struct {
+	mu      sync.Mutex // serializes updates to filters
+	filters atomic.Pointer[[]*listenerFilter]
+}
+
+func (lf *listenerFilters) add(f *listenerFilter) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+
+	var filters []*listenerFilter
+	if existing := lf.filters.Load(); existing != nil {
+		filters = slices.Clone(*existing)
+	}
+	filters = append(filters, f)
+
+	lf.filters.Store(&filters)
+}
+
+func (lf *listenerFilters) remove(f *listenerFilter) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+
+	existing := lf.filters.Load()
+	if existing == nil {
+		return
+	}
+
+	filters := slices.DeleteFunc(slices.Clone(*existing), func(other *listenerFilter) bool {
+		return other == f
+	})
+
+	if len(filters) == 0 {
+		lf.filters.Store(nil)
+		return
+	}
+
+	lf.filters.Store(&filters)
+}
+
+// allowListener reports whether a packet received from a peer is permitted by
+// the filters of the socket's listeners. Only connection attempts are
+// filtered, the stack will reset any segments that don't belong to a permitted
+// connection.
+func (ss *sourceSink) allowListener(filters []*listenerFilter, publicKey transport.NoisePublicKey, protoNumber tcpip.NetworkProtocolNumber, pkt []byte) bool {
+	_, protocol, payload, ok := parseACLPacket(protoNumber, pkt)
+	if !ok || protocol != uint8(header.TCPProtocolNumber) || len(payload) < header.TCPMinimumSize {
+		return true
+	}
+
+	tcpHdr := header.TCP(payload)
+	if tcpHdr.Flags()&(header.TCPFlagSyn|header.TCPFlagAck) != header.TCPFlagSyn {
+		return true
+	}
+
+	var dst netip.Addr
+	if protoNumber == header.IPv4ProtocolNumber {
+		dst = netip.AddrFrom4(header.IPv4(pkt).DestinationAddress().As4())
+	} else {
+		dst = netip.AddrFrom16(header.IPv6(pkt).DestinationAddress().As16())
+	}
+
+	for _, f := range filters {
+		if !f.matches(netip.AddrPortFrom(dst, tcpHdr.DestinationPort())) {
+			continue
+		}
+
+		if _, ok := f.publicKeys[publicKey]; ok {
+			return true
+		}
+
+		// Names are resolved when connecting, so that peers added (or renamed)
+		// after the listener was created are handled.
+		ss.peersMu.RLock()
+		defer ss.peersMu.RUnlock()
+
+		for _, name := range f.names {
+			if pk, ok := ss.peerNames[name]; ok && pk == publicKey {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,80 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+func TestSourceSink_ListenerFilter(t *testing.T) {
+	localAddr := netip.MustParseAddr("10.7.0.1")
+
+	ss, n := newTestSourceSink(t, []netip.Addr{localAddr})
+
+	addPeer := func(name string, addr netip.Addr) transport.NoisePublicKey {
+		privateKey, err := transport.NewPrivateKey()
+		require.NoError(t, err)
+
+		require.NoError(t, ss.AddPeer(name, privateKey.PublicKey(), []netip.Prefix{netip.PrefixFrom(addr, addr.BitLen())}))
+
+		return privateKey.PublicKey()
+	}
+
+	namedAddr := netip.MustParseAddr("10.7.0.2")
+	namedPublicKey := addPeer("named", namedAddr)
+
+	keyedAddr := netip.MustParseAddr("10.7.0.3")
+	keyedPublicKey := addPeer("", keyedAddr)
+
+	otherAddr := netip.MustParseAddr("10.7.0.4")
+	otherPublicKey := addPeer("other", otherAddr)
+
+	lis, err := n.ListenWithOptions("tcp", "10.7.0.1:80",
+		WithAllowedPeers("named", "late"), WithAllowedPublicKeys(keyedPublicKey.String()))
+	require.NoError(t, err)
+
+	allowed := func(src netip.Addr, publicKey transport.NoisePublicKey, dstPort uint16, flags header.TCPFlags) bool {
+		dropped := ss.writeDropped.Load()
+
+		pkt := newIPv4Packet(tcpip.AddrFrom4(src.As4()), tcpip.AddrFrom4(localAddr.As4()),
+			header.TCPProtocolNumber, newTCPSegment(40000, dstPort, flags))
+		_, err := ss.Write([][]byte{pkt}, []transport.NoisePublicKey{publicKey}, 0)
+		require.NoError(t, err)
+
+		return ss.writeDropped.Load() == dropped
+	}
+
+	require.True(t, allowed(namedAddr, namedPublicKey, 80, header.TCPFlagSyn))
+	require.True(t, allowed(keyedAddr, keyedPublicKey, 80, header.TCPFlagSyn))
+	require.False(t, allowed(otherAddr, otherPublicKey, 80, header.TCPFlagSyn))
+
+	// Only connection attempts to the listener are filtered.
+	require.True(t, allowed(otherAddr, otherPublicKey, 81, header.TCPFlagSyn))
+	require.True(t, allowed(otherAddr, otherPublicKey, 80, header.TCPFlagAck))
+
+	// Peers added after the listener are matched by name.
+	lateAddr := netip.MustParseAddr("10.7.0.5")
+	latePublicKey := addPeer("late", lateAddr)
+	require.True(t, allowed(lateAddr, latePublicKey, 80, header.TCPFlagSyn))
+
+	// Closing the listener removes its filter.
+	require.NoError(t, lis.Close())
+	require.Nil(t, ss.listenerFilters.filters.Load())
+	require.True(t, allowed(otherAddr, otherPublicKey, 80, header.TCPFlagSyn))
+
+	t.Run("Invalid Public Key", func(t *testing.T) {
+		_, err := n.ListenWithOptions("tcp", "10.7.0.1:80", WithAllowedPublicKeys("invalid"))
+		require.Error(t, err)
+
+		require.Nil(t, ss.listenerFilters.filters.Load())
+	})
+}
@@ -0,0 +1,153 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"sync"
+
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+// Load balancing policies, for services served by several peers.
+const (
+	// loadBalancingRoundRobin takes turns between the peers, the default.
+	loadBalancingRoundRobin = "round-robin"
+	// loadBalancingLeastConnections prefers the peer with the fewest open
+	// connections.
+	loadBalancingLeastConnections = "least-connections"
+)
+
+// serviceBalancer orders the peers serving a service, so that connections are
+// distributed among them.
+type serviceBalancer struct {
+	leastConnections bool
+	mu               sync.Mutex // protects next
+	next             map[string]int
+}
+
+// parseLoadBalancing parses a load balancing policy, returning whether it is
+// least connections.
+func parseLoadBalancing(policy string) (bool, error) {
+	switch policy {
+	case "", loadBalancingRoundRobin:
+		return false, nil
+	case loadBalancingLeastConnections:
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown load balancing policy %q", policy)
+	}
+}
+
+// SetPeerServices replaces the names of the services a peer serves.
+func (ss *sourceSink) SetPeerServices(publicKey transport.NoisePublicKey, services []string) {
+	ss.peersMu.Lock()
+	defer ss.peersMu.Unlock()
+
+	if len(services) == 0 {
+		delete(ss.peerServices, publicKey)
+	} else {
+		ss.peerServices[publicKey] = slices.Clone(services)
+	}
+}
+
+// lookupServiceLocked resolves the name of a service to the addresses of the
+// peers serving it, in the order they should be tried. Unhealthy peers (see
+// Config.HealthCheck) are skipped.
+// Must hold n.peersMu.
+func (n *noisyNet) lookupServiceLocked(service string) ([]netip.Addr, bool) {
+	var peers []transport.NoisePublicKey
+	for pk, services := range n.peerServices {
+		if !slices.Contains(services, service) {
+			continue
+		}
+
+		if n.peerHealth != nil && n.peerHealth(pk) == Unhealthy {
+			continue
+		}
+
+		peers = append(peers, pk)
+	}
+	if len(peers) == 0 {
+		return nil, false
+	}
+
+	slices.SortFunc(peers, func(a, b transport.NoisePublicKey) int {
+		return slices.Compare(a[:], b[:])
+	})
+
+	peers = n.balancer.order(service, peers, n.connectionsPerPeerLocked)
+
+	var addrs []netip.Addr
+	for _, pk := range peers {
+		addrs = append(addrs, n.peerAddresses[pk]...)
+	}
+
+	return addrs, true
+}
+
+// order returns the peers serving a service, rotated so that each lookup
+// starts with the next peer, and with the least connections, if enabled, ahead
+// of the rest.
+func (b *serviceBalancer) order(service string, peers []transport.NoisePublicKey, connections func() map[transport.NoisePublicKey]int) []transport.NoisePublicKey {
+	b.mu.Lock()
+	if b.next == nil {
+		b.next = make(map[string]int)
+	}
+	start := b.next[service] % len(peers)
+	b.next[service] = start + 1
+	b.mu.Unlock()
+
+	ordered := append(slices.Clone(peers[start:]), peers[:start]...)
+
+	// Ties are broken by the rotation.
+	if b.leastConnections {
+		conns := connections()
+		slices.SortStableFunc(ordered, func(a, b transport.NoisePublicKey) int {
+			return conns[a] - conns[b]
+		})
+	}
+
+	return ordered
+}
+
+// connectionsPerPeerLocked counts the open TCP connections (that aren't
+// closing), and connected UDP endpoints, of each peer.
+// Must hold n.peersMu.
+func (n *noisyNet) connectionsPerPeerLocked() map[transport.NoisePublicKey]int {
+	conns := make(map[transport.NoisePublicKey]int)
+	for _, ep := range n.stack.RegisteredEndpoints() {
+		tep, ok := ep.(tcpip.Endpoint)
+		if !ok {
+			continue
+		}
+
+		info, ok := tep.Info().(*stack.TransportEndpointInfo)
+		if !ok || info.ID.RemotePort == 0 {
+			continue
+		}
+
+		if info.TransProto == tcp.ProtocolNumber {
+			switch tcp.EndpointState(tep.State()) {
+			case tcp.StateEstablished, tcp.StateSynSent, tcp.StateSynRecv, tcp.StateCloseWait:
+			default:
+				continue
+			}
+		}
+
+		remoteAddr := endpointAddrPort(info.NetProto, info.ID.RemoteAddress, info.ID.RemotePort)
+		if pk, ok := n.fromPeerAddress.Lookup(remoteAddr.Addr()); ok {
+			conns[pk]++
+		}
+	}
+
+	return conns
+}
@@ -0,0 +1,167 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets_test
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoisySocket_LoadBalancing(t *testing.T) {
+	logger := slogt.New(t)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	server1PrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	server2PrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	newServer := func(t *testing.T, name string, listenPort uint16, privateKey transport.NoisePrivateKey, ip string) {
+		socket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+			Name:       name,
+			ListenPort: listenPort,
+			PrivateKey: privateKey.String(),
+			IPs:        []string{ip},
+			Peers: []v1alpha1.WireGuardPeerConfig{{
+				Name:      "client",
+				PublicKey: clientPrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12449",
+				IPs:       []string{"10.7.0.1"},
+			}},
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, socket.Close())
+		})
+
+		lis, err := socket.Listen("tcp", ":80")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = lis.Close()
+		})
+
+		// Each connection is greeted with the name of the server, and held open
+		// until the client closes it.
+		go func() {
+			for {
+				conn, err := lis.Accept()
+				if err != nil {
+					return
+				}
+
+				go func() {
+					defer conn.Close()
+
+					_, _ = conn.Write([]byte(name))
+					_, _ = io.Copy(io.Discard, conn)
+				}()
+			}
+		}()
+	}
+
+	newServer(t, "server1", 12450, server1PrivateKey, "10.7.0.2")
+	newServer(t, "server2", 12451, server2PrivateKey, "10.7.0.3")
+
+	newClient := func(t *testing.T, loadBalancing string) *noisysockets.NoisySocket {
+		socket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+			Name:          "client",
+			ListenPort:    12449,
+			PrivateKey:    clientPrivateKey.String(),
+			IPs:           []string{"10.7.0.1"},
+			LoadBalancing: loadBalancing,
+			Peers: []v1alpha1.WireGuardPeerConfig{
+				{
+					Name:      "server1",
+					PublicKey: server1PrivateKey.PublicKey().String(),
+					Endpoint:  "localhost:12450",
+					IPs:       []string{"10.7.0.2"},
+					Services:  []string{"api"},
+				},
+				{
+					Name:      "server2",
+					PublicKey: server2PrivateKey.PublicKey().String(),
+					Endpoint:  "localhost:12451",
+					IPs:       []string{"10.7.0.3"},
+					Services:  []string{"api"},
+				},
+			},
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, socket.Close())
+		})
+
+		return socket
+	}
+
+	// dial connects to the service, returning the name of the server that
+	// answered.
+	dial := func(t *testing.T, socket *noisysockets.NoisySocket) (net.Conn, string) {
+		conn, err := socket.Dial("tcp", "api:80")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+
+		buf := make([]byte, len("server1"))
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+
+		return conn, string(buf)
+	}
+
+	t.Run("Round Robin", func(t *testing.T) {
+		socket := newClient(t, "")
+
+		addrs, err := socket.LookupHost("api")
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{"10.7.0.2", "10.7.0.3"}, addrs)
+
+		var servers []string
+		for i := 0; i < 4; i++ {
+			conn, server := dial(t, socket)
+			require.NoError(t, conn.Close())
+
+			servers = append(servers, server)
+		}
+
+		// Connections alternate between the servers.
+		require.NotEqual(t, servers[0], servers[1])
+		require.Equal(t, servers[0], servers[2])
+		require.Equal(t, servers[1], servers[3])
+	})
+
+	t.Run("Least Connections", func(t *testing.T) {
+		socket := newClient(t, "least-connections")
+
+		_, busy := dial(t, socket)
+
+		// While a connection to one server is open, the other is preferred.
+		for i := 0; i < 3; i++ {
+			conn, server := dial(t, socket)
+			require.NotEqual(t, busy, server)
+			require.NoError(t, conn.Close())
+		}
+	})
+
+	t.Run("Unknown Policy", func(t *testing.T) {
+		_, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+			PrivateKey:    clientPrivateKey.String(),
+			LoadBalancing: "random",
+		})
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,213 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// localAddrSet is the socket's own addresses, they can be added and removed
+// while the socket is running.
+type localAddrSet struct {
+	mu    sync.Mutex // serializes updates to addrs
+	addrs atomic.Pointer[[]netip.Addr]
+}
+
+func newLocalAddrSet(addrs []netip.Addr) *localAddrSet {
+	var s localAddrSet
+	addrs = slices.Clone(addrs)
+	s.addrs.Store(&addrs)
+	return &s
+}
+
+// load returns the addresses, in the order they were added. The returned
+// slice must not be modified.
+func (s *localAddrSet) load() []netip.Addr {
+	return *s.addrs.Load()
+}
+
+func (s *localAddrSet) add(addr netip.Addr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	addrs := append(slices.Clone(s.load()), addr)
+	s.addrs.Store(&addrs)
+}
+
+func (s *localAddrSet) remove(addr netip.Addr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	addrs := slices.DeleteFunc(slices.Clone(s.load()), func(other netip.Addr) bool {
+		return other == addr
+	})
+	s.addrs.Store(&addrs)
+}
+
+// localProtocolAddress returns the protocol address of a local address.
+func localProtocolAddress(addr netip.Addr) tcpip.ProtocolAddress {
+	var protoNumber tcpip.NetworkProtocolNumber
+	if addr.Is4() {
+		protoNumber = ipv4.ProtocolNumber
+	} else if addr.Is6() {
+		protoNumber = ipv6.ProtocolNumber
+	}
+
+	return tcpip.ProtocolAddress{
+		Protocol:          protoNumber,
+		AddressWithPrefix: tcpip.AddrFromSlice(addr.AsSlice()).WithPrefix(),
+	}
+}
+
+// AddLocalAddr adds an address to the socket's interface. The address must not
+// be claimed by a peer, or be a floating IP.
+func (ss *sourceSink) AddLocalAddr(addr netip.Addr) error {
+	ss.peersMu.Lock()
+	defer ss.peersMu.Unlock()
+
+	if slices.Contains(ss.localAddrs.load(), addr) {
+		return fmt.Errorf("address %s is already a local address", addr)
+	}
+
+	prefix := netip.PrefixFrom(addr, addr.BitLen())
+	if owner, ok := ss.prefixOwner(prefix); ok {
+		return fmt.Errorf("address %s is already claimed by peer %s", addr, ss.peerDisplayName("", owner))
+	}
+
+	if _, ok := ss.floatingIPs[prefix]; ok {
+		return fmt.Errorf("address %s collides with a floating IP", addr)
+	}
+
+	if ss.addressConflicts == addressConflictsStrict {
+		for publicKey, peerPrefixes := range ss.peerPrefixes {
+			for _, peerPrefix := range peerPrefixes {
+				if peerPrefix.Bits() != 0 && peerPrefix.Contains(addr) {
+					return fmt.Errorf("address %s is within prefix %s of peer %s", addr, peerPrefix, ss.peerDisplayName("", publicKey))
+				}
+			}
+		}
+	}
+
+	if err := ss.stack.AddProtocolAddress(1, localProtocolAddress(addr), stack.AddressProperties{}); err != nil {
+		return fmt.Errorf("could not add protocol address: %v", err)
+	}
+
+	ss.localAddrs.add(addr)
+
+	return nil
+}
+
+// RemoveLocalAddr removes an address from the socket's interface. Connections
+// using the address will no longer receive any packets. The socket must be
+// left with at least one address.
+func (ss *sourceSink) RemoveLocalAddr(addr netip.Addr) error {
+	ss.peersMu.Lock()
+	defer ss.peersMu.Unlock()
+
+	addrs := ss.localAddrs.load()
+	if !slices.Contains(addrs, addr) {
+		return fmt.Errorf("address %s is not a local address", addr)
+	}
+
+	if len(addrs) == 1 {
+		return fmt.Errorf("address %s is the only local address", addr)
+	}
+
+	if err := ss.stack.RemoveAddress(1, tcpip.AddrFromSlice(addr.AsSlice())); err != nil {
+		return fmt.Errorf("could not remove protocol address: %v", err)
+	}
+
+	ss.localAddrs.remove(addr)
+
+	return nil
+}
+
+// AddAddress adds an address to the running socket, eg. so that it can join
+// another address family, or be renumbered, without recreating it (and
+// dropping every connection). The address must not be claimed by a peer, or
+// be a floating IP.
+func (s *NoisySocket) AddAddress(addr string) error {
+	parsedAddr, err := netip.ParseAddr(addr)
+	if err != nil {
+		return fmt.Errorf("could not parse address: %w", err)
+	}
+
+	s.confMu.Lock()
+	defer s.confMu.Unlock()
+
+	return s.addAddressLocked(parsedAddr.Unmap())
+}
+
+// Must hold s.confMu.
+func (s *NoisySocket) addAddressLocked(addr netip.Addr) error {
+	if err := s.sourceSink.AddLocalAddr(addr); err != nil {
+		return err
+	}
+
+	// Prevent the address from being allocated to a peer.
+	if s.ipam != nil {
+		if err := s.ipam.Reserve(addr); err != nil {
+			_ = s.sourceSink.RemoveLocalAddr(addr)
+			return fmt.Errorf("failed to reserve address: %w", err)
+		}
+	}
+
+	s.logger.Info("Added address", "address", addr.String())
+
+	s.setConfIPsLocked()
+
+	return nil
+}
+
+// RemoveAddress removes an address from the running socket. Connections using
+// the address will fail, but those using the socket's other addresses are
+// unaffected. The socket's last address can't be removed.
+func (s *NoisySocket) RemoveAddress(addr string) error {
+	parsedAddr, err := netip.ParseAddr(addr)
+	if err != nil {
+		return fmt.Errorf("could not parse address: %w", err)
+	}
+
+	s.confMu.Lock()
+	defer s.confMu.Unlock()
+
+	return s.removeAddressLocked(parsedAddr.Unmap())
+}
+
+// Must hold s.confMu.
+func (s *NoisySocket) removeAddressLocked(addr netip.Addr) error {
+	if err := s.sourceSink.RemoveLocalAddr(addr); err != nil {
+		return err
+	}
+
+	s.logger.Info("Removed address", "address", addr.String())
+
+	s.setConfIPsLocked()
+
+	return nil
+}
+
+// setConfIPsLocked records the socket's current addresses in its
+// configuration. Allocated, and derived, addresses are included, so that they
+// are kept if the socket is recreated from the configuration.
+// Must hold s.confMu.
+func (s *NoisySocket) setConfIPsLocked() {
+	addrs := s.sourceSink.localAddrs.load()
+
+	s.conf.IPs = make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		s.conf.IPs = append(s.conf.IPs, addr.String())
+	}
+}
@@ -0,0 +1,149 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoisySocket_AddRemoveAddress(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverSocket, clientSocket, err := noisysockets.Pipe(logger, &v1alpha1.Config{
+		Name:       "server",
+		PrivateKey: serverPrivateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{{
+			Name:      "client",
+			PublicKey: clientPrivateKey.PublicKey().String(),
+			IPs:       []string{"10.7.0.2", "fd00::2"},
+		}},
+	}, &v1alpha1.Config{
+		Name:       "client",
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.2", "fd00::2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{{
+			Name:      "server",
+			PublicKey: serverPrivateKey.PublicKey().String(),
+			IPs:       []string{"10.7.0.1", "fd00::1"},
+		}},
+	}, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+		require.NoError(t, clientSocket.Close())
+	})
+
+	// serve echoes back everything received on the server's port 7.
+	serve := func(t *testing.T, network string) {
+		lis, err := serverSocket.Listen(network, ":7")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = lis.Close()
+		})
+
+		go func() {
+			for {
+				conn, err := lis.Accept()
+				if err != nil {
+					return
+				}
+
+				go func() {
+					defer conn.Close()
+
+					_, _ = io.Copy(conn, conn)
+				}()
+			}
+		}()
+	}
+
+	serve(t, "tcp4")
+
+	echo := func(t *testing.T, conn net.Conn) {
+		_, err := conn.Write([]byte("Hello, server!"))
+		require.NoError(t, err)
+
+		buf := make([]byte, len("Hello, server!"))
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		require.Equal(t, "Hello, server!", string(buf))
+	}
+
+	dial := func(addr string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		return clientSocket.DialContext(ctx, "tcp", addr)
+	}
+
+	conn, err := dial("10.7.0.1:7")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	echo(t, conn)
+
+	// Join the IPv6 mesh, without disturbing the existing connection.
+	require.NoError(t, serverSocket.AddAddress("fd00::1"))
+
+	serve(t, "tcp6")
+
+	conn6, err := dial("[fd00::1]:7")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn6.Close()
+	})
+
+	echo(t, conn6)
+	echo(t, conn)
+
+	require.Equal(t, []string{"10.7.0.1", "fd00::1"}, serverSocket.Config().IPs)
+
+	// Leave the IPv4 mesh.
+	require.NoError(t, serverSocket.RemoveAddress("10.7.0.1"))
+
+	echo(t, conn6)
+
+	_, err = dial("10.7.0.1:7")
+	require.Error(t, err)
+
+	require.Equal(t, []string{"fd00::1"}, serverSocket.Config().IPs)
+
+	t.Run("Errors", func(t *testing.T) {
+		err := serverSocket.AddAddress("fd00::2")
+		require.ErrorContains(t, err, "already claimed by peer")
+
+		err = serverSocket.AddAddress("fd00::1")
+		require.ErrorContains(t, err, "already a local address")
+
+		err = serverSocket.RemoveAddress("10.7.0.1")
+		require.ErrorContains(t, err, "not a local address")
+
+		err = serverSocket.RemoveAddress("fd00::1")
+		require.ErrorContains(t, err, "only local address")
+
+		err = serverSocket.AddAddress("invalid")
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,402 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+const (
+	// measurementPort is the TCP and UDP port the measurement server listens
+	// on (the same as iperf3).
+	measurementPort = 5201
+	// defaultMeasureDuration is how long throughput is measured for by default.
+	defaultMeasureDuration = 5 * time.Second
+	// defaultMeasureCount is the number of latency probes sent by default.
+	defaultMeasureCount = 20
+	// defaultMeasureInterval is the time between latency probes by default.
+	defaultMeasureInterval = 100 * time.Millisecond
+	// defaultMeasureTimeout is how long to wait for each probe to be echoed,
+	// and for the result of a throughput measurement, by default.
+	defaultMeasureTimeout = 2 * time.Second
+	// measureBufferSize is the size of the writes of a throughput measurement.
+	measureBufferSize = 128 * 1024
+	// measureProbeSize is the size of a latency probe, its sequence number
+	// followed by padding.
+	measureProbeSize = 64
+)
+
+// MeasureOption configures a call to MeasureThroughput() or MeasureLatency().
+type MeasureOption func(*measureOptions)
+
+type measureOptions struct {
+	duration time.Duration
+	count    int
+	interval time.Duration
+	timeout  time.Duration
+}
+
+// WithMeasureDuration sets how long data is sent for when measuring throughput,
+// it defaults to five seconds.
+func WithMeasureDuration(duration time.Duration) MeasureOption {
+	return func(opts *measureOptions) {
+		opts.duration = duration
+	}
+}
+
+// WithMeasureCount sets the number of probes sent when measuring latency, it
+// defaults to 20.
+func WithMeasureCount(count int) MeasureOption {
+	return func(opts *measureOptions) {
+		opts.count = count
+	}
+}
+
+// WithMeasureInterval sets the time between sending probes when measuring
+// latency, it defaults to 100 milliseconds.
+func WithMeasureInterval(interval time.Duration) MeasureOption {
+	return func(opts *measureOptions) {
+		opts.interval = interval
+	}
+}
+
+// WithMeasureTimeout sets how long to wait for each probe to be echoed, before
+// it is considered lost, and for the peer to report the result of a
+// throughput measurement. It defaults to two seconds.
+func WithMeasureTimeout(timeout time.Duration) MeasureOption {
+	return func(opts *measureOptions) {
+		opts.timeout = timeout
+	}
+}
+
+// ThroughputStats are the results of measuring the throughput to a peer.
+type ThroughputStats struct {
+	// Bytes is the number of bytes received by the peer.
+	Bytes uint64
+	// Duration is how long it took to send the bytes, and for the peer to
+	// receive them.
+	Duration time.Duration
+	// BitsPerSecond is the throughput to the peer.
+	BitsPerSecond float64
+}
+
+// LatencyStats are the results of measuring the latency to a peer.
+type LatencyStats struct {
+	// Sent is the number of probes sent.
+	Sent int
+	// Received is the number of probes echoed back.
+	Received int
+	// PacketLoss is the fraction (between 0 and 1) of probes that were lost.
+	PacketLoss float64
+	// MinRTT is the shortest round trip time.
+	MinRTT time.Duration
+	// AvgRTT is the average round trip time.
+	AvgRTT time.Duration
+	// MaxRTT is the longest round trip time.
+	MaxRTT time.Duration
+	// Jitter is the average difference between the round trip times of
+	// consecutive probes.
+	Jitter time.Duration
+}
+
+// MeasureThroughput measures the throughput to a host (eg. the name of a peer)
+// by sending it as much data as possible, over a TCP connection through the
+// mesh, for a while. The host must be running the measurement server (see
+// Config.EnableMeasurementServer).
+func (n *noisyNet) MeasureThroughput(ctx context.Context, host string, opts ...MeasureOption) (*ThroughputStats, error) {
+	options := newMeasureOptions(opts)
+	if options.duration <= 0 {
+		return nil, fmt.Errorf("measurement duration must be positive")
+	}
+
+	conn, err := n.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(measurementPort)))
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to measurement server: %w", err)
+	}
+	defer conn.Close()
+
+	// Interrupt any pending write, or read, when the context is done.
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	start := time.Now()
+
+	if err := conn.SetWriteDeadline(start.Add(options.duration)); err != nil {
+		return nil, fmt.Errorf("could not set write deadline: %w", err)
+	}
+
+	buf := make([]byte, measureBufferSize)
+	for {
+		if _, err := conn.Write(buf); err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if isTimeout(err) {
+				break
+			}
+			return nil, fmt.Errorf("could not send data: %w", err)
+		}
+	}
+
+	// The end of the data is signalled by a FIN, after which the server
+	// replies with the number of bytes it received.
+	hc, ok := conn.(halfCloser)
+	if !ok {
+		return nil, fmt.Errorf("connection can't be half closed")
+	}
+
+	if err := hc.CloseWrite(); err != nil {
+		return nil, fmt.Errorf("could not close connection for writing: %w", err)
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(options.timeout)); err != nil {
+		return nil, fmt.Errorf("could not set read deadline: %w", err)
+	}
+
+	var received [8]byte
+	if _, err := io.ReadFull(conn, received[:]); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("could not receive result: %w", err)
+	}
+
+	stats := &ThroughputStats{
+		Bytes:    binary.BigEndian.Uint64(received[:]),
+		Duration: time.Since(start),
+	}
+	stats.BitsPerSecond = float64(stats.Bytes*8) / stats.Duration.Seconds()
+
+	return stats, nil
+}
+
+// MeasureLatency measures the latency, jitter, and packet loss to a host (eg.
+// the name of a peer) by sending it UDP probes, which it echoes back. The host
+// must be running the measurement server (see Config.EnableMeasurementServer).
+// If the context is done before all the probes are sent, the statistics so far
+// are returned along with the context's error.
+func (n *noisyNet) MeasureLatency(ctx context.Context, host string, opts ...MeasureOption) (*LatencyStats, error) {
+	options := newMeasureOptions(opts)
+	if options.count <= 0 {
+		return nil, fmt.Errorf("probe count must be positive")
+	}
+
+	conn, err := n.DialContext(ctx, "udp", net.JoinHostPort(host, strconv.Itoa(measurementPort)))
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to measurement server: %w", err)
+	}
+	defer conn.Close()
+
+	// Interrupt any pending read when the context is done.
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	var rtts []time.Duration
+	stats := &LatencyStats{}
+
+	req := make([]byte, measureProbeSize)
+	reply := make([]byte, measureProbeSize)
+
+	for seq := 0; seq < options.count; seq++ {
+		start := time.Now()
+
+		binary.BigEndian.PutUint64(req, uint64(seq))
+
+		if _, err := conn.Write(req); err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return nil, fmt.Errorf("could not send probe: %w", err)
+		}
+		stats.Sent++
+
+		if err := conn.SetReadDeadline(start.Add(options.timeout)); err != nil {
+			return nil, fmt.Errorf("could not set read deadline: %w", err)
+		}
+
+		for ctx.Err() == nil {
+			size, err := conn.Read(reply)
+			if err != nil {
+				if isTimeout(err) {
+					break
+				}
+				return nil, fmt.Errorf("could not receive probe: %w", err)
+			}
+
+			// Ignore late replies to earlier probes.
+			if size >= 8 && binary.BigEndian.Uint64(reply) == uint64(seq) {
+				rtts = append(rtts, time.Since(start))
+				break
+			}
+		}
+
+		if ctx.Err() != nil || seq == options.count-1 {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Until(start.Add(options.interval))):
+		}
+	}
+
+	stats.Received = len(rtts)
+	if stats.Sent > 0 {
+		stats.PacketLoss = float64(stats.Sent-stats.Received) / float64(stats.Sent)
+	}
+
+	var total, totalVariation time.Duration
+	for i, rtt := range rtts {
+		if i == 0 || rtt < stats.MinRTT {
+			stats.MinRTT = rtt
+		}
+		stats.MaxRTT = max(stats.MaxRTT, rtt)
+		total += rtt
+
+		if i > 0 {
+			variation := rtt - rtts[i-1]
+			if variation < 0 {
+				variation = -variation
+			}
+			totalVariation += variation
+		}
+	}
+	if stats.Received > 0 {
+		stats.AvgRTT = total / time.Duration(stats.Received)
+	}
+	if stats.Received > 1 {
+		stats.Jitter = totalVariation / time.Duration(stats.Received-1)
+	}
+
+	return stats, ctx.Err()
+}
+
+func newMeasureOptions(opts []MeasureOption) measureOptions {
+	options := measureOptions{
+		duration: defaultMeasureDuration,
+		count:    defaultMeasureCount,
+		interval: defaultMeasureInterval,
+		timeout:  defaultMeasureTimeout,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return options
+}
+
+// measurementServer answers throughput and latency measurements from peers.
+// Throughput is measured by counting the bytes received over a TCP connection,
+// and latency by echoing UDP probes.
+type measurementServer struct {
+	logger *slog.Logger
+	lis    net.Listener
+	pc     net.PacketConn
+	wg     sync.WaitGroup
+}
+
+func newMeasurementServer(logger *slog.Logger, n *noisyNet) (*measurementServer, error) {
+	lis, err := n.Listen("tcp", ":"+strconv.Itoa(measurementPort))
+	if err != nil {
+		return nil, fmt.Errorf("could not listen on tcp port %d: %w", measurementPort, err)
+	}
+
+	pc, err := n.ListenPacket("udp", ":"+strconv.Itoa(measurementPort))
+	if err != nil {
+		_ = lis.Close()
+		return nil, fmt.Errorf("could not listen on udp port %d: %w", measurementPort, err)
+	}
+
+	s := &measurementServer{
+		logger: logger,
+		lis:    lis,
+		pc:     pc,
+	}
+
+	s.wg.Add(2)
+	go s.serveThroughput()
+	go s.serveLatency()
+
+	return s, nil
+}
+
+func (s *measurementServer) Close() error {
+	var result *multierror.Error
+
+	if err := s.lis.Close(); err != nil {
+		result = multierror.Append(result, err)
+	}
+
+	if err := s.pc.Close(); err != nil {
+		result = multierror.Append(result, err)
+	}
+
+	s.wg.Wait()
+
+	return result.ErrorOrNil()
+}
+
+func (s *measurementServer) serveThroughput() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.lis.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.logger.Warn("Measurement server stopped", "error", err)
+			}
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			received, err := io.Copy(io.Discard, conn)
+			if err != nil {
+				s.logger.Debug("Failed to receive measurement data", "error", err)
+				return
+			}
+
+			var result [8]byte
+			binary.BigEndian.PutUint64(result[:], uint64(received))
+			if _, err := conn.Write(result[:]); err != nil {
+				s.logger.Debug("Failed to send measurement result", "error", err)
+			}
+		}()
+	}
+}
+
+func (s *measurementServer) serveLatency() {
+	defer s.wg.Done()
+
+	buf := make([]byte, measureProbeSize)
+	for {
+		size, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			// The connection has been closed.
+			return
+		}
+
+		if _, err := s.pc.WriteTo(buf[:size], addr); err != nil {
+			s.logger.Debug("Failed to echo measurement probe", "error", err)
+		}
+	}
+}
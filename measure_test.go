@@ -0,0 +1,94 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoisySocket_Measure(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:                    "server",
+		ListenPort:              12442,
+		PrivateKey:              serverPrivateKey.String(),
+		IPs:                     []string{"10.7.0.1"},
+		EnableMeasurementServer: true,
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "client",
+				PublicKey: clientPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.2"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+	})
+
+	clientSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "client",
+		ListenPort: 12443,
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "server",
+				PublicKey: serverPrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12442",
+				IPs:       []string{"10.7.0.1"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, clientSocket.Close())
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	t.Cleanup(cancel)
+
+	t.Run("Latency", func(t *testing.T) {
+		// Give the first probe plenty of time, as it triggers a handshake.
+		stats, err := clientSocket.MeasureLatency(ctx, "server", noisysockets.WithMeasureCount(5),
+			noisysockets.WithMeasureInterval(20*time.Millisecond), noisysockets.WithMeasureTimeout(5*time.Second))
+		require.NoError(t, err)
+
+		require.Equal(t, 5, stats.Sent)
+		require.Equal(t, 5, stats.Received)
+		require.Zero(t, stats.PacketLoss)
+		require.Positive(t, stats.MinRTT)
+		require.LessOrEqual(t, stats.MinRTT, stats.AvgRTT)
+		require.LessOrEqual(t, stats.AvgRTT, stats.MaxRTT)
+	})
+
+	t.Run("Throughput", func(t *testing.T) {
+		stats, err := clientSocket.MeasureThroughput(ctx, "server", noisysockets.WithMeasureDuration(500*time.Millisecond))
+		require.NoError(t, err)
+
+		require.Positive(t, stats.Bytes)
+		require.GreaterOrEqual(t, stats.Duration, 500*time.Millisecond)
+		require.Positive(t, stats.BitsPerSecond)
+
+		t.Logf("Throughput: %.2f Mbit/s", stats.BitsPerSecond/1e6)
+	})
+}
@@ -0,0 +1,213 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "noisysockets"
+
+var (
+	_ prometheus.Collector = (*collector)(nil)
+)
+
+// collector exports transport and network stack metrics to Prometheus.
+type collector struct {
+	s *NoisySocket
+
+	peerHandshakesCompleted *prometheus.Desc
+	peerHandshakesFailed    *prometheus.Desc
+	peerLastHandshake       *prometheus.Desc
+	peerTxBytes             *prometheus.Desc
+	peerRxBytes             *prometheus.Desc
+	peerRateLimitedPackets  *prometheus.Desc
+	peerRateLimitedBytes    *prometheus.Desc
+	peerSpoofedPackets      *prometheus.Desc
+	peerRejectedConnections *prometheus.Desc
+	peerTCPConnections      *prometheus.Desc
+	peerUncompressedBytes   *prometheus.Desc
+	peerCompressedBytes     *prometheus.Desc
+	rateLimitedPackets      *prometheus.Desc
+	rateLimitedBytes        *prometheus.Desc
+	droppedPackets          *prometheus.Desc
+	handshakeCookieReplies  *prometheus.Desc
+	handshakeDropped        *prometheus.Desc
+	queuedPackets           *prometheus.Desc
+	tcpCurrentEstablished   *prometheus.Desc
+	tcpRetransmits          *prometheus.Desc
+	tcpTimeouts             *prometheus.Desc
+	tcpResetsSent           *prometheus.Desc
+	tcpResetsReceived       *prometheus.Desc
+	tcpRejectedConnections  *prometheus.Desc
+}
+
+// Collector returns a Prometheus collector for the socket's metrics, it can be
+// registered into an existing registry. Per peer metrics are labelled with the
+// peer's name, or its public key if it has no name.
+func (s *NoisySocket) Collector() prometheus.Collector {
+	peerLabels := []string{"peer"}
+	peerDirectionLabels := []string{"peer", "direction"}
+
+	return &collector{
+		s: s,
+		peerHandshakesCompleted: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "peer", "handshakes_completed_total"),
+			"Number of handshakes completed with the peer.", peerLabels, nil),
+		peerHandshakesFailed: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "peer", "handshakes_failed_total"),
+			"Number of handshake attempts with the peer that timed out.", peerLabels, nil),
+		peerLastHandshake: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "peer", "last_handshake_timestamp_seconds"),
+			"Unix time of the most recent handshake completed with the peer.", peerLabels, nil),
+		peerTxBytes: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "peer", "tx_bytes_total"),
+			"Number of bytes sent to the peer.", peerLabels, nil),
+		peerRxBytes: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "peer", "rx_bytes_total"),
+			"Number of bytes received from the peer.", peerLabels, nil),
+		peerRateLimitedPackets: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "peer", "rate_limited_packets_total"),
+			"Number of packets exchanged with the peer dropped for exceeding its rate limits.", peerDirectionLabels, nil),
+		peerRateLimitedBytes: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "peer", "rate_limited_bytes_total"),
+			"Number of bytes exchanged with the peer dropped for exceeding its rate limits.", peerDirectionLabels, nil),
+		peerSpoofedPackets: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "peer", "spoofed_packets_total"),
+			"Number of packets received from the peer dropped as their source address isn't routed to it.", peerLabels, nil),
+		peerRejectedConnections: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "peer", "rejected_connections_total"),
+			"Number of connection attempts from the peer reset for exceeding the connection limits.", peerLabels, nil),
+		peerTCPConnections: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "peer", "tcp_connections"),
+			"Number of TCP connections currently open with the peer.", peerLabels, nil),
+		peerUncompressedBytes: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "peer", "uncompressed_bytes_total"),
+			"Number of bytes exchanged with the peer while compression was agreed, when uncompressed.", peerDirectionLabels, nil),
+		peerCompressedBytes: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "peer", "compressed_bytes_total"),
+			"Number of bytes exchanged with the peer while compression was agreed, when compressed.", peerDirectionLabels, nil),
+		rateLimitedPackets: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "rate_limited_packets_total"),
+			"Number of packets dropped for exceeding the global rate limits.", []string{"direction"}, nil),
+		rateLimitedBytes: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "rate_limited_bytes_total"),
+			"Number of bytes dropped for exceeding the global rate limits.", []string{"direction"}, nil),
+		droppedPackets: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "dropped_packets_total"),
+			"Number of packets dropped between the transport and the network stack.", []string{"direction"}, nil),
+		handshakeCookieReplies: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "handshake", "cookie_replies_total"),
+			"Number of cookie replies sent to handshake messages without a valid cookie.", nil, nil),
+		handshakeDropped: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "handshake", "dropped_total"),
+			"Number of handshake messages dropped by the handshake limits.", []string{"reason"}, nil),
+		queuedPackets: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "queued_packets"),
+			"Number of outbound packets waiting to be read by the transport.", nil, nil),
+		tcpCurrentEstablished: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "tcp", "current_established"),
+			"Number of TCP connections currently established.", nil, nil),
+		tcpRetransmits: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "tcp", "retransmits_total"),
+			"Number of retransmitted TCP segments.", nil, nil),
+		tcpTimeouts: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "tcp", "timeouts_total"),
+			"Number of TCP retransmission timeouts.", nil, nil),
+		tcpResetsSent: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "tcp", "resets_sent_total"),
+			"Number of TCP RST segments sent.", nil, nil),
+		tcpResetsReceived: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "tcp", "resets_received_total"),
+			"Number of TCP RST segments received.", nil, nil),
+		tcpRejectedConnections: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "tcp", "rejected_connections_total"),
+			"Number of connection attempts from peers reset for exceeding the connection limits.", nil, nil),
+	}
+}
+
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.peerHandshakesCompleted
+	ch <- c.peerHandshakesFailed
+	ch <- c.peerLastHandshake
+	ch <- c.peerTxBytes
+	ch <- c.peerRxBytes
+	ch <- c.peerRateLimitedPackets
+	ch <- c.peerRateLimitedBytes
+	ch <- c.peerSpoofedPackets
+	ch <- c.peerRejectedConnections
+	ch <- c.peerTCPConnections
+	ch <- c.peerUncompressedBytes
+	ch <- c.peerCompressedBytes
+	ch <- c.rateLimitedPackets
+	ch <- c.rateLimitedBytes
+	ch <- c.droppedPackets
+	ch <- c.handshakeCookieReplies
+	ch <- c.handshakeDropped
+	ch <- c.queuedPackets
+	ch <- c.tcpCurrentEstablished
+	ch <- c.tcpRetransmits
+	ch <- c.tcpTimeouts
+	ch <- c.tcpResetsSent
+	ch <- c.tcpResetsReceived
+	ch <- c.tcpRejectedConnections
+}
+
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	ss := c.s.sourceSink
+
+	conns, _ := ss.connectionsPerPeer(nil)
+
+	type peerInfo struct {
+		label  string
+		status PeerStatus
+	}
+
+	ss.peersMu.RLock()
+	peers := make(map[transport.NoisePublicKey]*peerInfo, len(ss.peerAddresses))
+	for pk := range ss.peerAddresses {
+		info := &peerInfo{label: pk.String()}
+		c.s.peerCountersLocked(pk, &info.status)
+		peers[pk] = info
+	}
+	for name, pk := range ss.peerNames {
+		if info, ok := peers[pk]; ok {
+			info.label = name
+		}
+	}
+	ss.peersMu.RUnlock()
+
+	for pk, info := range peers {
+		peer := c.s.transport.LookupPeer(pk)
+		if peer == nil {
+			continue
+		}
+
+		stats := peer.Stats()
+
+		ch <- prometheus.MustNewConstMetric(c.peerHandshakesCompleted, prometheus.CounterValue, float64(stats.HandshakesCompleted), info.label)
+		ch <- prometheus.MustNewConstMetric(c.peerHandshakesFailed, prometheus.CounterValue, float64(stats.HandshakesFailed), info.label)
+		if !stats.LastHandshake.IsZero() {
+			ch <- prometheus.MustNewConstMetric(c.peerLastHandshake, prometheus.GaugeValue, float64(stats.LastHandshake.UnixNano())/1e9, info.label)
+		}
+		ch <- prometheus.MustNewConstMetric(c.peerTxBytes, prometheus.CounterValue, float64(stats.TxBytes), info.label)
+		ch <- prometheus.MustNewConstMetric(c.peerRxBytes, prometheus.CounterValue, float64(stats.RxBytes), info.label)
+		ch <- prometheus.MustNewConstMetric(c.peerRateLimitedPackets, prometheus.CounterValue, float64(info.status.RateLimitedPackets), info.label, "inbound")
+		ch <- prometheus.MustNewConstMetric(c.peerRateLimitedPackets, prometheus.CounterValue, float64(info.status.OutboundRateLimitedPackets), info.label, "outbound")
+		ch <- prometheus.MustNewConstMetric(c.peerRateLimitedBytes, prometheus.CounterValue, float64(info.status.RateLimitedBytes), info.label, "inbound")
+		ch <- prometheus.MustNewConstMetric(c.peerRateLimitedBytes, prometheus.CounterValue, float64(info.status.OutboundRateLimitedBytes), info.label, "outbound")
+		ch <- prometheus.MustNewConstMetric(c.peerSpoofedPackets, prometheus.CounterValue, float64(info.status.SpoofedPackets), info.label)
+		ch <- prometheus.MustNewConstMetric(c.peerRejectedConnections, prometheus.CounterValue, float64(info.status.RejectedConnections), info.label)
+		ch <- prometheus.MustNewConstMetric(c.peerTCPConnections, prometheus.GaugeValue, float64(conns[pk]), info.label)
+		ch <- prometheus.MustNewConstMetric(c.peerUncompressedBytes, prometheus.CounterValue, float64(stats.UncompressedRxBytes), info.label, "inbound")
+		ch <- prometheus.MustNewConstMetric(c.peerUncompressedBytes, prometheus.CounterValue, float64(stats.UncompressedTxBytes), info.label, "outbound")
+		ch <- prometheus.MustNewConstMetric(c.peerCompressedBytes, prometheus.CounterValue, float64(stats.CompressedRxBytes), info.label, "inbound")
+		ch <- prometheus.MustNewConstMetric(c.peerCompressedBytes, prometheus.CounterValue, float64(stats.CompressedTxBytes), info.label, "outbound")
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.droppedPackets, prometheus.CounterValue, float64(ss.readDropped.Load()), "read")
+	ch <- prometheus.MustNewConstMetric(c.droppedPackets, prometheus.CounterValue, float64(ss.writeDropped.Load()), "write")
+
+	rateLimitStats := c.s.RateLimitStats()
+
+	ch <- prometheus.MustNewConstMetric(c.rateLimitedPackets, prometheus.CounterValue, float64(rateLimitStats.RateLimitedPackets), "inbound")
+	ch <- prometheus.MustNewConstMetric(c.rateLimitedPackets, prometheus.CounterValue, float64(rateLimitStats.OutboundRateLimitedPackets), "outbound")
+	ch <- prometheus.MustNewConstMetric(c.rateLimitedBytes, prometheus.CounterValue, float64(rateLimitStats.RateLimitedBytes), "inbound")
+	ch <- prometheus.MustNewConstMetric(c.rateLimitedBytes, prometheus.CounterValue, float64(rateLimitStats.OutboundRateLimitedBytes), "outbound")
+
+	handshakeStats := c.s.HandshakeStats()
+
+	ch <- prometheus.MustNewConstMetric(c.handshakeCookieReplies, prometheus.CounterValue, float64(handshakeStats.CookieReplies))
+	ch <- prometheus.MustNewConstMetric(c.handshakeDropped, prometheus.CounterValue, float64(handshakeStats.RateLimited), "rate_limited")
+	ch <- prometheus.MustNewConstMetric(c.handshakeDropped, prometheus.CounterValue, float64(handshakeStats.ConcurrencyLimited), "concurrency_limited")
+
+	stackStats := c.s.StackStats()
+
+	ch <- prometheus.MustNewConstMetric(c.queuedPackets, prometheus.GaugeValue, float64(stackStats.QueuedPackets))
+	ch <- prometheus.MustNewConstMetric(c.tcpCurrentEstablished, prometheus.GaugeValue, float64(stackStats.TCP.CurrentEstablished))
+	ch <- prometheus.MustNewConstMetric(c.tcpRetransmits, prometheus.CounterValue, float64(stackStats.TCP.Retransmits))
+	ch <- prometheus.MustNewConstMetric(c.tcpTimeouts, prometheus.CounterValue, float64(stackStats.TCP.Timeouts))
+	ch <- prometheus.MustNewConstMetric(c.tcpResetsSent, prometheus.CounterValue, float64(stackStats.TCP.ResetsSent))
+	ch <- prometheus.MustNewConstMetric(c.tcpResetsReceived, prometheus.CounterValue, float64(stackStats.TCP.ResetsReceived))
+	ch <- prometheus.MustNewConstMetric(c.tcpRejectedConnections, prometheus.CounterValue, float64(stackStats.TCP.RejectedConnections))
+}
@@ -0,0 +1,126 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoisySocket_Collector(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "server",
+		ListenPort: 12362,
+		PrivateKey: serverPrivateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "client",
+				PublicKey: clientPrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12363",
+				IPs:       []string{"10.7.0.2"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+	})
+
+	clientSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "client",
+		ListenPort: 12363,
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "server",
+				PublicKey: serverPrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12362",
+				IPs:       []string{"10.7.0.1"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, clientSocket.Close())
+	})
+
+	lis, err := serverSocket.Listen("tcp", "10.7.0.1:80")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = lis.Close()
+	})
+
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		_ = conn.Close()
+	}()
+
+	conn, err := clientSocket.DialTimeout("tcp", "10.7.0.1:80", 5*time.Second)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	metrics := gatherMetrics(t, clientSocket.Collector())
+
+	require.Equal(t, float64(1), metrics["noisysockets_peer_handshakes_completed_total{peer=server}"])
+	require.Zero(t, metrics["noisysockets_peer_handshakes_failed_total{peer=server}"])
+	require.NotZero(t, metrics["noisysockets_peer_last_handshake_timestamp_seconds{peer=server}"])
+	require.NotZero(t, metrics["noisysockets_peer_tx_bytes_total{peer=server}"])
+	require.NotZero(t, metrics["noisysockets_peer_rx_bytes_total{peer=server}"])
+	require.Contains(t, metrics, "noisysockets_dropped_packets_total{direction=read}")
+	require.Contains(t, metrics, "noisysockets_dropped_packets_total{direction=write}")
+	require.Contains(t, metrics, "noisysockets_tcp_retransmits_total")
+	require.Contains(t, metrics, "noisysockets_queued_packets")
+	require.Contains(t, metrics, "noisysockets_handshake_cookie_replies_total")
+	require.Contains(t, metrics, "noisysockets_handshake_dropped_total{reason=rate_limited}")
+}
+
+// gatherMetrics collects the current metric values, keyed by name and labels.
+func gatherMetrics(t *testing.T, c prometheus.Collector) map[string]float64 {
+	registry := prometheus.NewRegistry()
+	require.NoError(t, registry.Register(c))
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+
+	metrics := make(map[string]float64)
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			name := family.GetName()
+			for _, label := range m.GetLabel() {
+				name += "{" + label.GetName() + "=" + label.GetValue() + "}"
+			}
+
+			switch {
+			case m.GetCounter() != nil:
+				metrics[name] = m.GetCounter().GetValue()
+			case m.GetGauge() != nil:
+				metrics[name] = m.GetGauge().GetValue()
+			}
+		}
+	}
+
+	return metrics
+}
@@ -0,0 +1,101 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package mobile
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// Conn is a connection to a peer.
+type Conn struct {
+	conn net.Conn
+}
+
+// Read reads up to maxBytes from the connection, blocking until at least one
+// byte is available. At the end of the stream, an empty result is returned.
+func (c *Conn) Read(maxBytes int) ([]byte, error) {
+	buf := make([]byte, maxBytes)
+	for {
+		n, err := c.conn.Read(buf)
+		if n > 0 {
+			return buf[:n], nil
+		}
+
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Write writes data to the connection, returning the number of bytes written.
+func (c *Conn) Write(data []byte) (int, error) {
+	return c.conn.Write(data)
+}
+
+// SetTimeout sets a deadline, timeoutMillis milliseconds from now, for pending
+// and future reads and writes. A timeout of zero clears the deadline.
+func (c *Conn) SetTimeout(timeoutMillis int64) error {
+	if timeoutMillis <= 0 {
+		return c.conn.SetDeadline(time.Time{})
+	}
+
+	return c.conn.SetDeadline(time.Now().Add(time.Duration(timeoutMillis) * time.Millisecond))
+}
+
+// LocalAddress returns the local address of the connection.
+func (c *Conn) LocalAddress() string {
+	return c.conn.LocalAddr().String()
+}
+
+// RemoteAddress returns the address of the peer.
+func (c *Conn) RemoteAddress() string {
+	return c.conn.RemoteAddr().String()
+}
+
+// CloseWrite shuts down the writing side of the connection, so that the peer
+// sees the end of the stream.
+func (c *Conn) CloseWrite() error {
+	if hc, ok := c.conn.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
+	}
+
+	return errors.New("connection does not support half-close")
+}
+
+// Close closes the connection.
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// Listener accepts connections from peers.
+type Listener struct {
+	lis net.Listener
+}
+
+// Accept waits for, and returns, the next connection.
+func (l *Listener) Accept() (*Conn, error) {
+	conn, err := l.lis.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Conn{conn: conn}, nil
+}
+
+// Address returns the address the listener is listening on.
+func (l *Listener) Address() string {
+	return l.lis.Addr().String()
+}
+
+// Close stops listening, unblocking any pending Accept.
+func (l *Listener) Close() error {
+	return l.lis.Close()
+}
@@ -0,0 +1,18 @@
+//go:build !unix
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package mobile
+
+import (
+	"errors"
+
+	"github.com/noisysockets/noisysockets"
+)
+
+func newFDDevice(fd int) (noisysockets.TUNDevice, error) {
+	return nil, errors.New("file descriptors are not supported on this platform")
+}
@@ -0,0 +1,47 @@
+//go:build unix
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package mobile
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// fdDevice is a TUN device backed by a file descriptor, that was opened by the
+// platform.
+type fdDevice struct {
+	file *os.File
+}
+
+func newFDDevice(fd int) (*fdDevice, error) {
+	// Using the runtime poller allows Close() to unblock pending reads.
+	if err := unix.SetNonblock(fd, true); err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("could not set file descriptor to non-blocking: %w", err)
+	}
+
+	return &fdDevice{file: os.NewFile(uintptr(fd), "tun")}, nil
+}
+
+func (d *fdDevice) Name() string {
+	return d.file.Name()
+}
+
+func (d *fdDevice) Read(buf []byte, offset int) (int, error) {
+	return d.file.Read(buf[offset:])
+}
+
+func (d *fdDevice) Write(buf []byte, offset int) (int, error) {
+	return d.file.Write(buf[offset:])
+}
+
+func (d *fdDevice) Close() error {
+	return d.file.Close()
+}
@@ -0,0 +1,154 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+// Package mobile provides bindings, for use with gomobile, that let Android and
+// iOS applications join a noisy sockets mesh.
+//
+// The exported API is restricted to the types that gomobile can bind (strings,
+// numbers, byte slices, errors, and interfaces), so configs are passed as YAML
+// strings, and statuses are returned as JSON. To build the bindings:
+//
+//	gomobile bind -target=android -o noisysockets.aar ./mobile
+//	gomobile bind -target=ios -o Noisysockets.xcframework ./mobile
+//
+// A Network is a userspace socket, connections to peers are made with its Dial
+// and Listen methods. Alternatively, a Tunnel bridges the mesh to the platform's
+// VPN service (eg. an Android VpnService, or an iOS NEPacketTunnelProvider), so
+// that all of the application's traffic (or the whole device's) can reach
+// peers. When using a Tunnel on Android, exclude the application itself from
+// the VPN (with VpnService.Builder.addDisallowedApplication), so that the
+// tunnel's own packets aren't routed back into it.
+package mobile
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config"
+)
+
+// Logger receives the log messages of a network (or tunnel), eg. to forward
+// them to logcat, or the unified logging system.
+type Logger interface {
+	// Log is called with each formatted log message.
+	Log(message string)
+}
+
+// Network is a noisy sockets network, that connections to peers can be made
+// through.
+type Network struct {
+	socket *noisysockets.NoisySocket
+}
+
+// NewNetwork brings up a network from a YAML encoded config. The logger may be
+// nil, in which case log messages are discarded.
+func NewNetwork(conf string, logger Logger) (*Network, error) {
+	c, err := config.FromYAMLBytes([]byte(conf))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+
+	socket, err := noisysockets.NewNoisySocket(newLogger(logger), c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create noisy socket: %w", err)
+	}
+
+	return &Network{socket: socket}, nil
+}
+
+// Close brings the network down, closing any open connections.
+func (n *Network) Close() error {
+	return n.socket.Close()
+}
+
+// Reload applies a new YAML encoded config to the network, without interrupting
+// connections to peers that are unchanged.
+func (n *Network) Reload(conf string) error {
+	c, err := config.FromYAMLBytes([]byte(conf))
+	if err != nil {
+		return fmt.Errorf("failed to parse config: %w", err)
+	}
+
+	return n.socket.Reload(c)
+}
+
+// ListenPort returns the port the network is listening on for incoming packets.
+func (n *Network) ListenPort() int {
+	return int(n.socket.ListenPort())
+}
+
+// Rebind re-binds the network's underlying sockets, and re-initiates handshakes
+// with its peers. It should be called when the platform reports a change to
+// the device's connectivity (eg. moving from Wi-Fi to LTE).
+func (n *Network) Rebind() error {
+	return n.socket.Rebind()
+}
+
+// Status returns the status of the network's peers, as a JSON encoded array.
+func (n *Network) Status() (string, error) {
+	status, err := json.Marshal(n.socket.PeerStatuses())
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal status: %w", err)
+	}
+
+	return string(status), nil
+}
+
+// Dial connects to an address on the network (eg. "tcp", "server:80"). If
+// timeoutMillis is greater than zero, the dial fails if it doesn't complete
+// within that many milliseconds.
+func (n *Network) Dial(network, address string, timeoutMillis int64) (*Conn, error) {
+	ctx := context.Background()
+	if timeoutMillis > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeoutMillis)*time.Millisecond)
+		defer cancel()
+	}
+
+	conn, err := n.socket.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Conn{conn: conn}, nil
+}
+
+// Listen listens for connections on an address of the network (eg. "tcp",
+// ":8080").
+func (n *Network) Listen(network, address string) (*Listener, error) {
+	lis, err := n.socket.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Listener{lis: lis}, nil
+}
+
+// newLogger returns a slog logger that writes to logger, or discards messages
+// if it is nil.
+func newLogger(logger Logger) *slog.Logger {
+	if logger == nil {
+		return slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+
+	return slog.New(slog.NewTextHandler(&logWriter{logger: logger}, nil))
+}
+
+// logWriter passes each message written by a slog handler to a Logger. Handlers
+// write a message at a time, so there is no need to buffer.
+type logWriter struct {
+	logger Logger
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.logger.Log(strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
@@ -0,0 +1,140 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package mobile_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/noisysockets/noisysockets/mobile"
+	"github.com/stretchr/testify/require"
+)
+
+type testLogger struct {
+	t *testing.T
+}
+
+func (l *testLogger) Log(message string) {
+	l.t.Log(message)
+}
+
+func TestNetwork(t *testing.T) {
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	server, err := mobile.NewNetwork(fmt.Sprintf(`apiVersion: noisysockets.github.com/v1alpha1
+kind: Config
+name: server
+listenPort: 12427
+privateKey: %s
+ips:
+- 10.7.0.1
+peers:
+- name: client
+  publicKey: %s
+  ips:
+  - 10.7.0.2
+`, serverPrivateKey, clientPrivateKey.PublicKey()), &testLogger{t: t})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, server.Close())
+	})
+
+	client, err := mobile.NewNetwork(fmt.Sprintf(`apiVersion: noisysockets.github.com/v1alpha1
+kind: Config
+name: client
+listenPort: 12428
+privateKey: %s
+ips:
+- 10.7.0.2
+peers:
+- name: server
+  publicKey: %s
+  endpoint: localhost:12427
+  ips:
+  - 10.7.0.1
+`, clientPrivateKey, serverPrivateKey.PublicKey()), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, client.Close())
+	})
+
+	lis, err := server.Listen("tcp", ":8080")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, lis.Close())
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		conn, err := lis.Accept()
+		if err != nil {
+			t.Log(err)
+			return
+		}
+		defer conn.Close()
+
+		// Echo until the end of the stream.
+		for {
+			data, err := conn.Read(1024)
+			if err != nil || len(data) == 0 {
+				return
+			}
+
+			if _, err := conn.Write(data); err != nil {
+				return
+			}
+		}
+	}()
+
+	conn, err := client.Dial("tcp", "server:8080", 10000)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	require.NoError(t, conn.SetTimeout(10000))
+
+	n, err := conn.Write([]byte("Hello, world!"))
+	require.NoError(t, err)
+	require.Equal(t, len("Hello, world!"), n)
+
+	require.NoError(t, conn.CloseWrite())
+
+	var received []byte
+	for {
+		data, err := conn.Read(4)
+		require.NoError(t, err)
+
+		if len(data) == 0 {
+			break
+		}
+		received = append(received, data...)
+	}
+
+	require.Equal(t, "Hello, world!", string(received))
+
+	wg.Wait()
+
+	status, err := client.Status()
+	require.NoError(t, err)
+
+	var statuses []noisysockets.PeerStatus
+	require.NoError(t, json.Unmarshal([]byte(status), &statuses))
+	require.Len(t, statuses, 1)
+	require.Equal(t, "server", statuses[0].Name)
+	require.False(t, statuses[0].LastHandshake.IsZero())
+}
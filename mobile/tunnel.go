@@ -0,0 +1,112 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package mobile
+
+import (
+	"fmt"
+
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config"
+)
+
+// PacketFlow is implemented by the application, to pass raw IP packets between
+// the platform's VPN service and a tunnel (eg. wrapping an iOS
+// NEPacketTunnelFlow).
+type PacketFlow interface {
+	// ReadPacket blocks until a packet is sent by the platform, and returns it.
+	ReadPacket() ([]byte, error)
+	// WritePacket delivers a packet to the platform.
+	WritePacket(packet []byte) error
+	// Close is called when the tunnel is closed, it must unblock any pending
+	// ReadPacket.
+	Close() error
+}
+
+// Tunnel bridges the interface of the platform's VPN service to the mesh.
+//
+// The platform is responsible for configuring the addresses, MTU, and routes of
+// the interface, these should match the config (eg. the interface is assigned
+// the config's IPs, and routes are added for the IPs of each peer).
+type Tunnel struct {
+	bridge *noisysockets.TUNBridge
+}
+
+// NewTunnel brings up a tunnel from a YAML encoded config, exchanging packets
+// with the platform through flow. The logger may be nil, in which case log
+// messages are discarded.
+func NewTunnel(conf string, flow PacketFlow, logger Logger) (*Tunnel, error) {
+	return newTunnel(conf, &packetFlowDevice{flow: flow}, logger)
+}
+
+// NewTunnelFromFD brings up a tunnel from a YAML encoded config, reading and
+// writing packets directly from the file descriptor of the interface (eg. as
+// returned by ParcelFileDescriptor.detachFd() for an Android VpnService). The
+// tunnel takes ownership of the file descriptor.
+func NewTunnelFromFD(conf string, fd int, logger Logger) (*Tunnel, error) {
+	dev, err := newFDDevice(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	return newTunnel(conf, dev, logger)
+}
+
+func newTunnel(conf string, dev noisysockets.TUNDevice, logger Logger) (*Tunnel, error) {
+	c, err := config.FromYAMLBytes([]byte(conf))
+	if err != nil {
+		_ = dev.Close()
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+
+	bridge, err := noisysockets.NewTUNBridgeFromDevice(newLogger(logger), c, dev)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tun bridge: %w", err)
+	}
+
+	return &Tunnel{bridge: bridge}, nil
+}
+
+// Close brings the tunnel down.
+func (t *Tunnel) Close() error {
+	return t.bridge.Close()
+}
+
+// packetFlowDevice adapts a PacketFlow to a TUN device.
+type packetFlowDevice struct {
+	flow PacketFlow
+}
+
+func (d *packetFlowDevice) Name() string {
+	return "tun"
+}
+
+func (d *packetFlowDevice) Read(buf []byte, offset int) (int, error) {
+	for {
+		packet, err := d.flow.ReadPacket()
+		if err != nil {
+			return 0, err
+		}
+
+		// Drop packets that are larger than the MTU, as the kernel would.
+		if len(packet) > len(buf)-offset {
+			continue
+		}
+
+		return copy(buf[offset:], packet), nil
+	}
+}
+
+func (d *packetFlowDevice) Write(buf []byte, offset int) (int, error) {
+	if err := d.flow.WritePacket(buf[offset:]); err != nil {
+		return 0, err
+	}
+
+	return len(buf) - offset, nil
+}
+
+func (d *packetFlowDevice) Close() error {
+	return d.flow.Close()
+}
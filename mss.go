@@ -0,0 +1,105 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"encoding/binary"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// SetMSSClamping controls whether the MSS advertised by TCP SYN segments
+// passing through the source sink is lowered, so that segments fit within the
+// MTU of the path to the peer. Without it, hosts that route through the
+// tunnel (eg. via an exit node) advertise an MSS based on their own MTU, and
+// their full sized segments are dropped.
+func (ss *sourceSink) SetMSSClamping(enabled bool) {
+	ss.clampMSS.Store(enabled)
+}
+
+// maxMSS returns the largest MSS that fits within the given MTU.
+func maxMSS(protoNumber tcpip.NetworkProtocolNumber, mtu int) uint16 {
+	hdrLen := header.IPv4MinimumSize
+	if protoNumber == header.IPv6ProtocolNumber {
+		hdrLen = header.IPv6MinimumSize
+	}
+
+	return uint16(max(mtu-hdrLen-header.TCPMinimumSize, 0))
+}
+
+// clampMSS lowers the MSS option of a TCP SYN segment, in place, if it is
+// larger than the given MSS. It reports whether the packet was modified.
+func clampMSS(protoNumber tcpip.NetworkProtocolNumber, pkt []byte, mss uint16) bool {
+	var tcpHdr header.TCP
+	var src, dst tcpip.Address
+	switch protoNumber {
+	case header.IPv4ProtocolNumber:
+		hdr := header.IPv4(pkt)
+		if !hdr.IsValid(len(pkt)) || hdr.TransportProtocol() != header.TCPProtocolNumber || hdr.FragmentOffset() != 0 {
+			return false
+		}
+
+		tcpHdr = header.TCP(hdr.Payload())
+		src, dst = hdr.SourceAddress(), hdr.DestinationAddress()
+	case header.IPv6ProtocolNumber:
+		hdr := header.IPv6(pkt)
+		// Segments behind extension headers are left alone.
+		if !hdr.IsValid(len(pkt)) || hdr.TransportProtocol() != header.TCPProtocolNumber {
+			return false
+		}
+
+		tcpHdr = header.TCP(hdr.Payload())
+		src, dst = hdr.SourceAddress(), hdr.DestinationAddress()
+	default:
+		return false
+	}
+
+	if len(tcpHdr) < header.TCPMinimumSize || tcpHdr.Flags()&header.TCPFlagSyn == 0 {
+		return false
+	}
+
+	dataOffset := int(tcpHdr.DataOffset())
+	if dataOffset < header.TCPMinimumSize || dataOffset > len(tcpHdr) {
+		return false
+	}
+
+	opts := tcpHdr[header.TCPMinimumSize:dataOffset]
+	for i := 0; i < len(opts); {
+		switch opts[i] {
+		case header.TCPOptionEOL:
+			return false
+		case header.TCPOptionNOP:
+			i++
+			continue
+		}
+
+		if i+1 >= len(opts) || opts[i+1] < 2 || i+int(opts[i+1]) > len(opts) {
+			return false
+		}
+
+		if opts[i] == header.TCPOptionMSS && opts[i+1] == header.TCPOptionMSSLength {
+			if binary.BigEndian.Uint16(opts[i+2:]) <= mss {
+				return false
+			}
+
+			binary.BigEndian.PutUint16(opts[i+2:], mss)
+
+			payload := tcpHdr[dataOffset:]
+			xsum := header.PseudoHeaderChecksum(header.TCPProtocolNumber, src, dst, uint16(len(tcpHdr)))
+			xsum = checksum.Checksum(payload, xsum)
+			tcpHdr.SetChecksum(0)
+			tcpHdr.SetChecksum(^tcpHdr.CalculateChecksum(xsum))
+
+			return true
+		}
+
+		i += int(opts[i+1])
+	}
+
+	return false
+}
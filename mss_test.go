@@ -0,0 +1,157 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+func TestClampMSS(t *testing.T) {
+	src := netip.MustParseAddr("10.7.0.1")
+	dst := netip.MustParseAddr("10.7.0.2")
+
+	t.Run("IPv4", func(t *testing.T) {
+		pkt := newTestTCPSegment(src, dst, header.TCPFlagSyn, 1460)
+
+		require.True(t, clampMSS(header.IPv4ProtocolNumber, pkt, maxMSS(header.IPv4ProtocolNumber, 1280)))
+		requireMSS(t, header.IPv4ProtocolNumber, pkt, 1240)
+
+		// Already small enough.
+		require.False(t, clampMSS(header.IPv4ProtocolNumber, pkt, 1380))
+		requireMSS(t, header.IPv4ProtocolNumber, pkt, 1240)
+	})
+
+	t.Run("IPv6", func(t *testing.T) {
+		pkt := newTestTCPSegment(netip.MustParseAddr("fd00::1"), netip.MustParseAddr("fd00::2"), header.TCPFlagSyn|header.TCPFlagAck, 1440)
+
+		require.True(t, clampMSS(header.IPv6ProtocolNumber, pkt, maxMSS(header.IPv6ProtocolNumber, 1280)))
+		requireMSS(t, header.IPv6ProtocolNumber, pkt, 1220)
+	})
+
+	t.Run("Not SYN", func(t *testing.T) {
+		pkt := newTestTCPSegment(src, dst, header.TCPFlagAck, 1460)
+
+		require.False(t, clampMSS(header.IPv4ProtocolNumber, pkt, 1240))
+		requireMSS(t, header.IPv4ProtocolNumber, pkt, 1460)
+	})
+
+	t.Run("Truncated", func(t *testing.T) {
+		pkt := newTestTCPSegment(src, dst, header.TCPFlagSyn, 1460)
+
+		require.False(t, clampMSS(header.IPv4ProtocolNumber, pkt[:header.IPv4MinimumSize+header.TCPMinimumSize], 1240))
+	})
+}
+
+func TestSourceSink_MSSClamping(t *testing.T) {
+	localAddr := netip.MustParseAddr("10.7.0.1")
+
+	ss, _ := newTestSourceSink(t, []netip.Addr{localAddr})
+
+	peerPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+	peerPublicKey := peerPrivateKey.PublicKey()
+
+	require.NoError(t, ss.AddPeer("peer", peerPublicKey, []netip.Prefix{netip.MustParsePrefix("10.7.0.2/32")}))
+
+	ss.SetPeerMTU(peerPublicKey, 1280)
+
+	readSegment := func() []byte {
+		go func() {
+			pkt := newTestTCPSegment(localAddr, netip.MustParseAddr("10.7.0.2"), header.TCPFlagSyn, 1460)
+
+			pktBuf := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(pkt)})
+			pktBuf.NetworkProtocolNumber = header.IPv4ProtocolNumber
+			_, _ = pktBuf.NetworkHeader().Consume(header.IPv4MinimumSize)
+
+			writeOutboundPacket(ss, pktBuf)
+		}()
+
+		pkt, _, err := readPacket(ss)(time.Second)
+		require.NoError(t, err)
+
+		return pkt
+	}
+
+	// Disabled by default.
+	requireMSS(t, header.IPv4ProtocolNumber, readSegment(), 1460)
+
+	// Clamped to the MTU of the path to the peer.
+	ss.SetMSSClamping(true)
+	requireMSS(t, header.IPv4ProtocolNumber, readSegment(), 1240)
+}
+
+func newTestTCPSegment(src, dst netip.Addr, flags header.TCPFlags, mss uint16) []byte {
+	opts := make([]byte, header.TCPOptionMSSLength)
+	header.EncodeMSSOption(uint32(mss), opts)
+
+	tcpLen := header.TCPMinimumSize + len(opts)
+
+	var pkt []byte
+	var tcpHdr header.TCP
+	srcAddr, dstAddr := tcpip.AddrFromSlice(src.AsSlice()), tcpip.AddrFromSlice(dst.AsSlice())
+	if src.Is4() {
+		pkt = make([]byte, header.IPv4MinimumSize+tcpLen)
+		ipHdr := header.IPv4(pkt)
+		ipHdr.Encode(&header.IPv4Fields{
+			TotalLength: uint16(len(pkt)),
+			TTL:         64,
+			Protocol:    uint8(header.TCPProtocolNumber),
+			SrcAddr:     srcAddr,
+			DstAddr:     dstAddr,
+		})
+		ipHdr.SetChecksum(^ipHdr.CalculateChecksum())
+		tcpHdr = header.TCP(pkt[header.IPv4MinimumSize:])
+	} else {
+		pkt = make([]byte, header.IPv6MinimumSize+tcpLen)
+		header.IPv6(pkt).Encode(&header.IPv6Fields{
+			PayloadLength:     uint16(tcpLen),
+			TransportProtocol: header.TCPProtocolNumber,
+			HopLimit:          64,
+			SrcAddr:           srcAddr,
+			DstAddr:           dstAddr,
+		})
+		tcpHdr = header.TCP(pkt[header.IPv6MinimumSize:])
+	}
+
+	tcpHdr.Encode(&header.TCPFields{
+		SrcPort:    12345,
+		DstPort:    80,
+		SeqNum:     1,
+		DataOffset: uint8(tcpLen),
+		Flags:      flags,
+		WindowSize: 65535,
+	})
+	copy(tcpHdr[header.TCPMinimumSize:], opts)
+	tcpHdr.SetChecksum(^tcpHdr.CalculateChecksum(header.PseudoHeaderChecksum(header.TCPProtocolNumber, srcAddr, dstAddr, uint16(tcpLen))))
+
+	return pkt
+}
+
+// requireMSS checks the MSS option of a TCP segment, and that its checksum is still valid.
+func requireMSS(t *testing.T, protoNumber tcpip.NetworkProtocolNumber, pkt []byte, mss uint16) {
+	var tcpHdr header.TCP
+	var src, dst tcpip.Address
+	if protoNumber == header.IPv4ProtocolNumber {
+		ipHdr := header.IPv4(pkt)
+		tcpHdr, src, dst = header.TCP(ipHdr.Payload()), ipHdr.SourceAddress(), ipHdr.DestinationAddress()
+	} else {
+		ipHdr := header.IPv6(pkt)
+		tcpHdr, src, dst = header.TCP(ipHdr.Payload()), ipHdr.SourceAddress(), ipHdr.DestinationAddress()
+	}
+
+	opts := header.ParseSynOptions(tcpHdr.Options(), tcpHdr.Flags()&header.TCPFlagAck != 0)
+	require.Equal(t, mss, opts.MSS)
+	require.True(t, tcpHdr.IsChecksumValid(src, dst, 0, 0))
+}
@@ -0,0 +1,52 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+)
+
+// resolveVia returns the public key of the intermediate peer through which a
+// peer is reached (see WireGuardPeerConfig.Via), or nil if it is reached
+// directly.
+func (s *NoisySocket) resolveVia(peerConf *v1alpha1.WireGuardPeerConfig) (*transport.NoisePublicKey, error) {
+	if peerConf.Via == "" {
+		return nil, nil
+	}
+
+	via, err := s.lookupPeer(peerConf.Via)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.transport.LookupPeer(via) == nil {
+		return nil, fmt.Errorf("%w %s", ErrUnknownPeer, peerConf.Via)
+	}
+
+	return &via, nil
+}
+
+// directPeersFirst orders peers so that those reached via another peer are
+// added after the peers they are reached via.
+func directPeersFirst(peerConfs []v1alpha1.WireGuardPeerConfig) []v1alpha1.WireGuardPeerConfig {
+	ordered := slices.Clone(peerConfs)
+	slices.SortStableFunc(ordered, func(a, b v1alpha1.WireGuardPeerConfig) int {
+		switch {
+		case a.Via == "" && b.Via != "":
+			return -1
+		case a.Via != "" && b.Via == "":
+			return 1
+		default:
+			return 0
+		}
+	})
+
+	return ordered
+}
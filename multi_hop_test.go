@@ -0,0 +1,177 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets_test
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoisySocket_MultiHop(t *testing.T) {
+	logger := slogt.New(t)
+
+	newSocket := func(t *testing.T, conf *v1alpha1.Config) *noisysockets.NoisySocket {
+		socket, err := noisysockets.NewNoisySocket(logger, conf)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, socket.Close())
+		})
+
+		return socket
+	}
+
+	routerPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	alicePrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	bobPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	_ = newSocket(t, &v1alpha1.Config{
+		Name:             "router",
+		ListenPort:       12446,
+		PrivateKey:       routerPrivateKey.String(),
+		IPs:              []string{"10.7.0.1"},
+		EnableForwarding: true,
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "alice",
+				PublicKey: alicePrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12447",
+				IPs:       []string{"10.7.0.2"},
+			},
+			{
+				Name:      "bob",
+				PublicKey: bobPrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12448",
+				IPs:       []string{"10.7.0.3"},
+			},
+		},
+	})
+
+	// Alice and bob have no direct connectivity, and reach each other via the
+	// router (peers reached via another peer may be listed first).
+	aliceSocket := newSocket(t, &v1alpha1.Config{
+		Name:       "alice",
+		ListenPort: 12447,
+		PrivateKey: alicePrivateKey.String(),
+		IPs:        []string{"10.7.0.2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "bob",
+				PublicKey: bobPrivateKey.PublicKey().String(),
+				Via:       "router",
+				IPs:       []string{"10.7.0.3"},
+			},
+			{
+				Name:      "router",
+				PublicKey: routerPrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12446",
+				IPs:       []string{"10.7.0.1"},
+			},
+		},
+	})
+
+	bobSocket := newSocket(t, &v1alpha1.Config{
+		Name:       "bob",
+		ListenPort: 12448,
+		PrivateKey: bobPrivateKey.String(),
+		IPs:        []string{"10.7.0.3"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "router",
+				PublicKey: routerPrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12446",
+				IPs:       []string{"10.7.0.1"},
+			},
+			{
+				Name:      "alice",
+				PublicKey: alicePrivateKey.PublicKey().String(),
+				Via:       routerPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.2"},
+			},
+		},
+	})
+
+	lis, err := bobSocket.Listen("tcp", ":7")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = lis.Close()
+	})
+
+	remoteAddrs := make(chan string, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		remoteAddrs <- conn.RemoteAddr().String()
+
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	t.Run("Via Intermediate Peer", func(t *testing.T) {
+		conn, err := aliceSocket.Dial("tcp", "bob:7")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, conn.Close())
+		})
+
+		_, err = conn.Write([]byte("Hello, bob!"))
+		require.NoError(t, err)
+
+		buf := make([]byte, len("Hello, bob!"))
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+
+		require.Equal(t, "Hello, bob!", string(buf))
+
+		// The connection came from alice's address, not the router's.
+		host, _, err := net.SplitHostPort(<-remoteAddrs)
+		require.NoError(t, err)
+		require.Equal(t, "10.7.0.2", host)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		carolPrivateKey, err := transport.NewPrivateKey()
+		require.NoError(t, err)
+
+		// Peers reached via another peer have no endpoint of their own.
+		require.Error(t, aliceSocket.AddPeer(v1alpha1.WireGuardPeerConfig{
+			Name:      "carol",
+			PublicKey: carolPrivateKey.PublicKey().String(),
+			Via:       "router",
+			Endpoint:  "localhost:12449",
+			IPs:       []string{"10.7.0.4"},
+		}))
+
+		require.ErrorIs(t, aliceSocket.AddPeer(v1alpha1.WireGuardPeerConfig{
+			Name:      "carol",
+			PublicKey: carolPrivateKey.PublicKey().String(),
+			Via:       "dave",
+			IPs:       []string{"10.7.0.4"},
+		}), noisysockets.ErrUnknownPeer)
+
+		// Only a single intermediate hop is routed.
+		require.Error(t, aliceSocket.AddPeer(v1alpha1.WireGuardPeerConfig{
+			Name:      "carol",
+			PublicKey: carolPrivateKey.PublicKey().String(),
+			Via:       "bob",
+			IPs:       []string{"10.7.0.4"},
+		}))
+	})
+}
@@ -0,0 +1,196 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// groupRoutes are the routes needed for the stack to send packets to the IPv4
+// broadcast address, and to multicast groups.
+var groupRoutes = []tcpip.Route{
+	{Destination: header.IPv4Broadcast.WithPrefix().Subnet(), NIC: 1},
+	{Destination: prefixToSubnet(netip.MustParsePrefix("224.0.0.0/4")), NIC: 1},
+	{Destination: prefixToSubnet(netip.MustParsePrefix("ff00::/8")), NIC: 1},
+}
+
+// fanout is a broadcast, or multicast, packet that is still to be sent to
+// some of the peers.
+type fanout struct {
+	protoNumber  tcpip.NetworkProtocolNumber
+	pkt          []byte
+	destinations []transport.NoisePublicKey
+}
+
+// SetMulticast controls whether packets sent to the IPv4 broadcast address, or
+// to a multicast group, are delivered to every peer (that hasn't opted out).
+func (ss *sourceSink) SetMulticast(enabled bool) {
+	if ss.multicast.Swap(enabled) == enabled {
+		return
+	}
+
+	for _, route := range groupRoutes {
+		if enabled {
+			ss.stack.AddRoute(route)
+		} else {
+			ss.stack.RemoveRoutes(func(r tcpip.Route) bool {
+				return r == route
+			})
+		}
+	}
+}
+
+// SetPeerMulticast controls whether broadcast and multicast packets are sent
+// to a peer, they are by default.
+func (ss *sourceSink) SetPeerMulticast(publicKey transport.NoisePublicKey, enabled bool) {
+	ss.peersMu.Lock()
+	defer ss.peersMu.Unlock()
+
+	if enabled {
+		delete(ss.noMulticastPeers, publicKey)
+	} else {
+		ss.noMulticastPeers[publicKey] = struct{}{}
+	}
+}
+
+// readFanout sends the pending broadcast, or multicast, packet to as many of
+// its remaining destinations as there is room for in the batch.
+func (ss *sourceSink) readFanout(q *outboundQueue, bufs [][]byte, sizes []int, destinations []transport.NoisePublicKey, offset int) int {
+	f := q.fanout
+
+	var count int
+	for count < len(bufs) && len(f.destinations) > 0 {
+		destination := f.destinations[0]
+		f.destinations = f.destinations[1:]
+
+		ss.peersMu.RLock()
+		limiter := ss.outboundRateLimiters[destination]
+		mtu := ss.peerMTUs[destination]
+		ss.peersMu.RUnlock()
+
+		// Packets are never fragmented, so those too large for the path to the
+		// peer are dropped.
+		if (mtu > 0 && len(f.pkt) > mtu) || len(f.pkt) > len(bufs[count])-offset ||
+			(limiter != nil && !limiter.allow(len(f.pkt))) || !allowGlobal(&ss.globalOutboundRateLimiter, len(f.pkt)) {
+			ss.readDropped.Add(1)
+			ss.logDropped("Dropping group packet for peer", "peer", destination, "size", len(f.pkt))
+			continue
+		}
+
+		sizes[count] = copy(bufs[count][offset:], f.pkt)
+		destinations[count] = destination
+
+		if ss.acl.Load() != nil {
+			ss.trackOutbound(destination, f.protoNumber, bufs[count][offset:offset+sizes[count]])
+		}
+
+		ss.capturePacket(CaptureOutbound, destination, bufs[count][offset:offset+sizes[count]])
+
+		count++
+	}
+
+	if len(f.destinations) == 0 {
+		q.fanout = nil
+	}
+
+	return count
+}
+
+// queueFanout copies a broadcast, or multicast, packet so that it can be sent
+// to each of the peers that accept them.
+func (ss *sourceSink) queueFanout(q *outboundQueue, pkt *stack.PacketBuffer) {
+	ss.peersMu.RLock()
+	destinations := make([]transport.NoisePublicKey, 0, len(ss.peerAddresses))
+	for publicKey := range ss.peerAddresses {
+		if _, ok := ss.noMulticastPeers[publicKey]; !ok {
+			destinations = append(destinations, publicKey)
+		}
+	}
+	ss.peersMu.RUnlock()
+
+	if len(destinations) == 0 {
+		ss.readDropped.Add(1)
+		ss.logDropped("Dropping group packet, no peers accept group packets")
+		return
+	}
+
+	data := pkt.ToBuffer()
+	q.fanout = &fanout{
+		protoNumber:  pkt.NetworkProtocolNumber,
+		pkt:          data.Flatten(),
+		destinations: destinations,
+	}
+	data.Release()
+}
+
+// isGroupAddress reports whether the address is the IPv4 broadcast address, or
+// a multicast group.
+func isGroupAddress(addr netip.Addr) bool {
+	return addr == netip.AddrFrom4([4]byte{255, 255, 255, 255}) || addr.IsMulticast()
+}
+
+// isGroupManagementPacket reports whether the packet is a group membership
+// report (IGMP or MLD), or neighbor discovery message, which are only of use to
+// the stack that sent them, as every peer is a single hop away.
+func isGroupManagementPacket(protoNumber tcpip.NetworkProtocolNumber, pkt []byte) bool {
+	switch protoNumber {
+	case header.IPv4ProtocolNumber:
+		return header.IPv4(pkt).TransportProtocol() == header.IGMPProtocolNumber
+	case header.IPv6ProtocolNumber:
+		// MLD messages are preceded by a hop-by-hop options header.
+		nextHeader := header.IPv6(pkt).NextHeader()
+		return nextHeader == uint8(header.ICMPv6ProtocolNumber) || nextHeader == uint8(header.IPv6HopByHopOptionsExtHdrIdentifier)
+	default:
+		return false
+	}
+}
+
+// JoinGroup joins a multicast group, so that packets sent to it by peers are
+// received by the sockets listening on the group's port.
+func (n *noisyNet) JoinGroup(group netip.Addr) error {
+	protoNumber, err := groupProtocolNumber(group)
+	if err != nil {
+		return err
+	}
+
+	if err := n.stack.JoinGroup(protoNumber, 1, tcpip.AddrFromSlice(group.AsSlice())); err != nil {
+		return fmt.Errorf("could not join group %s: %v", group, err)
+	}
+
+	return nil
+}
+
+// LeaveGroup leaves a multicast group previously joined with JoinGroup.
+func (n *noisyNet) LeaveGroup(group netip.Addr) error {
+	protoNumber, err := groupProtocolNumber(group)
+	if err != nil {
+		return err
+	}
+
+	if err := n.stack.LeaveGroup(protoNumber, 1, tcpip.AddrFromSlice(group.AsSlice())); err != nil {
+		return fmt.Errorf("could not leave group %s: %v", group, err)
+	}
+
+	return nil
+}
+
+func groupProtocolNumber(group netip.Addr) (tcpip.NetworkProtocolNumber, error) {
+	if !group.IsMulticast() {
+		return 0, fmt.Errorf("%s is not a multicast address", group)
+	}
+
+	if group.Is4() {
+		return header.IPv4ProtocolNumber, nil
+	}
+
+	return header.IPv6ProtocolNumber, nil
+}
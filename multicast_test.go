@@ -0,0 +1,117 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+func TestSourceSink_Multicast(t *testing.T) {
+	localAddr := netip.MustParseAddr("10.7.0.1")
+	group := netip.MustParseAddr("224.0.0.251")
+
+	ss, _ := newTestSourceSink(t, []netip.Addr{localAddr})
+
+	var peers []transport.NoisePublicKey
+	for i, name := range []string{"a", "b", "c"} {
+		privateKey, err := transport.NewPrivateKey()
+		require.NoError(t, err)
+
+		addr := netip.AddrFrom4([4]byte{10, 7, 0, byte(i + 2)})
+		require.NoError(t, ss.AddPeer(name, privateKey.PublicKey(), []netip.Prefix{netip.PrefixFrom(addr, addr.BitLen())}))
+
+		peers = append(peers, privateKey.PublicKey())
+	}
+
+	// The last peer has opted out.
+	ss.SetPeerMulticast(peers[2], false)
+
+	const batchSize = 4
+	bufs := make([][]byte, batchSize)
+	for i := range bufs {
+		bufs[i] = make([]byte, transport.DefaultMTU)
+	}
+	sizes := make([]int, batchSize)
+	destinations := make([]transport.NoisePublicKey, batchSize)
+
+	t.Run("Disabled", func(t *testing.T) {
+		readDropped := ss.readDropped.Load()
+
+		writeOutboundPacket(ss, newTestOutboundPacket(localAddr, group))
+		writeOutboundPacket(ss, newTestOutboundPacket(localAddr, netip.MustParseAddr("10.7.0.2")))
+
+		count, err := ss.ReadBatch(bufs, sizes, destinations, 0, 0)
+		require.NoError(t, err)
+		require.Equal(t, 1, count)
+		require.Equal(t, peers[0], destinations[0])
+
+		require.Equal(t, readDropped+1, ss.readDropped.Load())
+	})
+
+	ss.SetMulticast(true)
+
+	t.Run("Multicast", func(t *testing.T) {
+		writeOutboundPacket(ss, newTestOutboundPacket(localAddr, group))
+
+		count, err := ss.ReadBatch(bufs, sizes, destinations, 0, 0)
+		require.NoError(t, err)
+		require.Equal(t, 2, count)
+		require.ElementsMatch(t, peers[:2], destinations[:count])
+
+		for i := 0; i < count; i++ {
+			require.Equal(t, group, netip.AddrFrom4(header.IPv4(bufs[i][:sizes[i]]).DestinationAddress().As4()))
+		}
+	})
+
+	t.Run("Broadcast", func(t *testing.T) {
+		writeOutboundPacket(ss, newTestOutboundPacket(localAddr, netip.MustParseAddr("255.255.255.255")))
+
+		// Packets are fanned out across reads, if there isn't room in the batch.
+		var received []transport.NoisePublicKey
+		for len(received) < 2 {
+			count, err := ss.ReadBatch(bufs[:1], sizes[:1], destinations[:1], 0, 0)
+			require.NoError(t, err)
+			require.Equal(t, 1, count)
+
+			received = append(received, destinations[0])
+		}
+		require.ElementsMatch(t, peers[:2], received)
+	})
+
+	t.Run("Group Management", func(t *testing.T) {
+		pkt := make([]byte, header.IPv4MinimumSize+header.IGMPMinimumSize)
+		ipHdr := header.IPv4(pkt)
+		ipHdr.Encode(&header.IPv4Fields{
+			TotalLength: uint16(len(pkt)),
+			TTL:         1,
+			Protocol:    uint8(header.IGMPProtocolNumber),
+			SrcAddr:     tcpip.AddrFrom4(localAddr.As4()),
+			DstAddr:     tcpip.AddrFrom4(group.As4()),
+		})
+		ipHdr.SetChecksum(^ipHdr.CalculateChecksum())
+
+		pktBuf := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(pkt)})
+		pktBuf.NetworkProtocolNumber = header.IPv4ProtocolNumber
+		_, _ = pktBuf.NetworkHeader().Consume(header.IPv4MinimumSize)
+
+		// Membership reports are of no use to peers.
+		writeOutboundPacket(ss, pktBuf)
+		writeOutboundPacket(ss, newTestOutboundPacket(localAddr, netip.MustParseAddr("10.7.0.3")))
+
+		count, err := ss.ReadBatch(bufs, sizes, destinations, 0, 0)
+		require.NoError(t, err)
+		require.Equal(t, 1, count)
+		require.Equal(t, peers[1], destinations[0])
+	})
+}
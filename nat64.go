@@ -0,0 +1,71 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// NAT64 is implemented by the host forwarder, connections from peers to
+// addresses within the prefix are terminated as usual, and then proxied to the
+// embedded IPv4 address through sockets on the host. So no packets need to be
+// translated.
+
+// parseNAT64Prefix parses a NAT64 prefix, only /96 prefixes are supported (as
+// they don't require the embedded address to skip the reserved u octet).
+func parseNAT64Prefix(s string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("could not parse NAT64 prefix: %w", err)
+	}
+
+	if !prefix.Addr().Is6() || prefix.Addr().Is4In6() || prefix.Bits() != 96 {
+		return netip.Prefix{}, fmt.Errorf("NAT64 prefix must be an IPv6 /96 prefix: %s", s)
+	}
+
+	return prefix.Masked(), nil
+}
+
+// nat64Embed returns the address, within the prefix, for an IPv4 address.
+func nat64Embed(prefix netip.Prefix, addr netip.Addr) netip.Addr {
+	b := prefix.Addr().As16()
+	v4 := addr.As4()
+	copy(b[12:], v4[:])
+
+	return netip.AddrFrom16(b)
+}
+
+// nat64Extract returns the IPv4 address embedded in an address within the
+// prefix, if it can be forwarded to. Loopback, link local, multicast, and
+// broadcast addresses never are, so that peers can't reach services bound to
+// the host's loopback interface.
+func nat64Extract(prefix netip.Prefix, addr netip.Addr) (netip.Addr, bool) {
+	if !prefix.IsValid() || !addr.Is6() || !prefix.Contains(addr) {
+		return netip.Addr{}, false
+	}
+
+	b := addr.As16()
+	v4 := netip.AddrFrom4([4]byte(b[12:]))
+
+	if !v4.IsGlobalUnicast() {
+		return netip.Addr{}, false
+	}
+
+	return v4, true
+}
+
+// EnableNAT64 forwards TCP and UDP traffic from peers, addressed to the
+// prefix, to the embedded IPv4 addresses. Requires host forwarding.
+func (ss *sourceSink) EnableNAT64(prefix netip.Prefix) error {
+	if ss.hostForwarder == nil {
+		return fmt.Errorf("NAT64 requires host forwarding")
+	}
+
+	ss.hostForwarder.nat64Prefix = prefix
+
+	return nil
+}
@@ -0,0 +1,163 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+)
+
+type staticResolver map[string][]string
+
+func (r staticResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	addrs, ok := r[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	return addrs, nil
+}
+
+func TestNoisySocket_NAT64(t *testing.T) {
+	logger := slogt.New(t)
+
+	// Loopback addresses are never forwarded to, so we need an external address.
+	hostAddr := externalAddr(t)
+
+	gatewayPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	gatewayConf := v1alpha1.Config{
+		Name:                 "gateway",
+		PrivateKey:           gatewayPrivateKey.String(),
+		IPs:                  []string{"fdff:7061:ac89::1"},
+		EnableDNSServer:      true,
+		EnableForwarding:     true,
+		ForwardToHostNetwork: true,
+		NAT64Prefix:          "64:ff9b::/96",
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "client",
+				PublicKey: clientPrivateKey.PublicKey().String(),
+				IPs:       []string{"fdff:7061:ac89::2"},
+			},
+		},
+	}
+
+	// The client is IPv6 only, and routes the NAT64 prefix via the gateway.
+	gatewaySocket, clientSocket, err := noisysockets.Pipe(logger, &gatewayConf, &v1alpha1.Config{
+		Name:       "client",
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"fdff:7061:ac89::2"},
+		DNSServers: []string{"fdff:7061:ac89::1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "gateway",
+				PublicKey: gatewayPrivateKey.PublicKey().String(),
+				IPs:       []string{"fdff:7061:ac89::1", "64:ff9b::/96"},
+			},
+		},
+	}, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, gatewaySocket.Close())
+		require.NoError(t, clientSocket.Close())
+	})
+
+	gatewaySocket.SetResolver(staticResolver{
+		"ipv4only.example":  {hostAddr.String()},
+		"dualstack.example": {hostAddr.String(), "2001:db8::1"},
+		"loopback.example":  {"127.0.0.1"},
+	})
+
+	nat64Addr := netip.MustParseAddr("64:ff9b::" + hostAddr.String())
+
+	t.Run("DNS64", func(t *testing.T) {
+		addrs, err := clientSocket.LookupHost("ipv4only.example")
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{hostAddr.String(), nat64Addr.String()}, addrs)
+
+		// Names with IPv6 addresses aren't synthesized.
+		addrs, err = clientSocket.LookupHost("dualstack.example")
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{hostAddr.String(), "2001:db8::1"}, addrs)
+
+		addrs, err = clientSocket.LookupHost("loopback.example")
+		require.NoError(t, err)
+		require.Equal(t, []string{"127.0.0.1"}, addrs)
+
+		_, err = clientSocket.LookupHost("missing.example")
+		require.Error(t, err)
+	})
+
+	t.Run("NAT64", func(t *testing.T) {
+		lis, err := net.Listen("tcp", net.JoinHostPort(hostAddr.String(), "0"))
+		require.NoError(t, err)
+
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "Hello, world!")
+		}))
+		srv.Listener = lis
+		srv.Start()
+		t.Cleanup(srv.Close)
+
+		client := &http.Client{
+			Transport: &http.Transport{
+				DialContext:       clientSocket.DialContext,
+				DisableKeepAlives: true,
+			},
+			Timeout: 5 * time.Second,
+		}
+
+		port := lis.Addr().(*net.TCPAddr).Port
+
+		resp, err := client.Get(fmt.Sprintf("http://%s", netip.AddrPortFrom(nat64Addr, uint16(port))))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, resp.Body.Close())
+		})
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, "Hello, world!", string(body))
+
+		// The host's loopback interface can't be reached.
+		_, err = clientSocket.Dial("tcp", fmt.Sprintf("[64:ff9b::7f00:1]:%d", port))
+		require.Error(t, err)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, prefix := range []string{"64:ff9b::/64", "10.0.0.0/8", "not a prefix"} {
+			conf := gatewayConf
+			conf.NAT64Prefix = prefix
+
+			_, err := noisysockets.NewNoisySocket(logger, &conf)
+			require.Error(t, err, prefix)
+		}
+
+		conf := gatewayConf
+		conf.ForwardToHostNetwork = false
+
+		_, err := noisysockets.NewNoisySocket(logger, &conf)
+		require.Error(t, err)
+	})
+}
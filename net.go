@@ -9,71 +9,208 @@ package noisysockets
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net"
 	"net/netip"
 	"regexp"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/miekg/dns"
 	"github.com/noisysockets/noisysockets/internal/transport"
+	"go.opentelemetry.io/otel/trace"
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
 )
 
 type DialContextFn func(ctx context.Context, network, address string) (net.Conn, error)
 
+// dialFallbackDelay is how long to wait for a connection to the primary
+// address family of a dual stack host, before racing the other family.
+const dialFallbackDelay = 300 * time.Millisecond
+
 var (
-	errCanceled          = errors.New("operation was canceled")
-	errTimeout           = errors.New("i/o timeout")
-	errNumericPort       = errors.New("port must be numeric")
-	errNoSuitableAddress = errors.New("no suitable address found")
-	errMissingAddress    = errors.New("missing address")
+	errCanceled          error = &canceledError{}
+	errTimeout           error = &timeoutError{}
+	errNumericPort             = errors.New("port must be numeric")
+	errNoSuitableAddress       = errors.New("no suitable address found")
+	errMissingAddress          = errors.New("missing address")
 )
 
-var protoSplitter = regexp.MustCompile(`^(tcp)(4|6)?$`)
+// timeoutError is returned when a dial times out, it matches context.DeadlineExceeded.
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return "i/o timeout" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+func (e *timeoutError) Is(err error) bool {
+	return err == context.DeadlineExceeded
+}
+
+// canceledError is returned when a dial is canceled, it matches context.Canceled.
+type canceledError struct{}
+
+func (e *canceledError) Error() string { return "operation was canceled" }
+
+func (e *canceledError) Is(err error) bool {
+	return err == context.Canceled
+}
+
+// mapErr converts context errors into their historical net package equivalents.
+func mapErr(err error) error {
+	switch err {
+	case context.Canceled:
+		return errCanceled
+	case context.DeadlineExceeded:
+		return errTimeout
+	default:
+		return err
+	}
+}
+
+var protoSplitter = regexp.MustCompile(`^(tcp|udp)(4|6)?$`)
 
 type noisyNet struct {
-	stack         *stack.Stack
-	localName     string
-	localAddrs    []netip.Addr
-	peerNames     map[string]transport.NoisePublicKey
-	peerAddresses map[transport.NoisePublicKey][]netip.Addr
-	dnsServers    []netip.Addr
+	stack                   *stack.Stack
+	ep                      *outboundQueues
+	localName               string
+	domain                  string       // the mesh's DNS domain, if any
+	dns64Prefix             netip.Prefix // the NAT64 prefix of synthesized AAAA records, if any
+	localAddrs              *localAddrSet
+	peersMu                 *sync.RWMutex
+	peerNames               map[string]transport.NoisePublicKey
+	peerAddresses           map[transport.NoisePublicKey][]netip.Addr
+	peerServices            map[transport.NoisePublicKey][]string
+	peerSRVRecords          map[transport.NoisePublicKey][]Service
+	peerTXTRecords          map[transport.NoisePublicKey][]string
+	fromPeerAddress         *prefixTrie[transport.NoisePublicKey]
+	rateLimiters            map[transport.NoisePublicKey]*rateLimiter
+	outboundRateLimiters    map[transport.NoisePublicKey]*rateLimiter
+	spoofedPackets          map[transport.NoisePublicKey]*atomic.Uint64
+	peerRejectedConnections map[transport.NoisePublicKey]*atomic.Uint64
+	rejectedConnections     *atomic.Uint64
+	acl                     *atomic.Pointer[acl]
+	unknownDestination      *atomic.Pointer[func(netip.Addr)]
+	peerConnected           func(publicKey transport.NoisePublicKey) bool   // whether a peer can be reached, if set
+	peerHealth              func(publicKey transport.NoisePublicKey) Health // the health of a peer, if set
+	balancer                serviceBalancer
+	advertisedServices      serviceRegistry
+	listenerFilters         *listenerFilters
+	ipConns                 *ipConns
+	queueOutbound           func(pkt *stack.PacketBuffer) bool
+	maxEndpoints            int // the maximum number of open endpoints, zero is unlimited
+	udpConns                *udpConns
+	connBytes               connBytes
+	resolverMu              sync.RWMutex
+	resolver                Resolver
+	domainResolvers         map[string]Resolver
+	tracer                  atomic.Pointer[trace.Tracer]
+}
+
+// SetResolver sets the resolver used for host names that aren't the names of
+// peers. A nil resolver disables resolution of such names.
+func (n *noisyNet) SetResolver(resolver Resolver) {
+	n.resolverMu.Lock()
+	defer n.resolverMu.Unlock()
+
+	n.resolver = resolver
+}
+
+// SetDomainResolver sets the resolver used for host names within a domain
+// (eg. "corp.internal"), and the domain itself, instead of the resolver set by
+// SetResolver. The resolver of the longest matching domain is used, and reverse
+// lookups use the resolver of the reverse domain (eg. "10.in-addr.arpa"), if
+// any. A nil resolver removes the domain's resolver.
+func (n *noisyNet) SetDomainResolver(domain string, resolver Resolver) {
+	domain = strings.ToLower(strings.Trim(domain, "."))
+
+	n.resolverMu.Lock()
+	defer n.resolverMu.Unlock()
+
+	if resolver == nil {
+		delete(n.domainResolvers, domain)
+		return
+	}
+
+	if n.domainResolvers == nil {
+		n.domainResolvers = make(map[string]Resolver)
+	}
+	n.domainResolvers[domain] = resolver
+}
+
+// resolverFor returns the resolver to use for a host name.
+func (n *noisyNet) resolverFor(host string) Resolver {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	n.resolverMu.RLock()
+	defer n.resolverMu.RUnlock()
+
+	for name := host; len(n.domainResolvers) > 0 && name != ""; {
+		if resolver, ok := n.domainResolvers[name]; ok {
+			return resolver
+		}
+
+		_, parent, ok := strings.Cut(name, ".")
+		if !ok {
+			break
+		}
+		name = parent
+	}
+
+	return n.resolver
+}
+
+// Stack returns the underlying gVisor network stack, eg. to register extra
+// protocols, adjust stack options, or attach a sniffer.
+//
+// This is an advanced, and unstable, API. The stack is owned by the socket,
+// and it (and what it is configured with) may change between releases without
+// notice. Misconfiguring it can break the socket.
+func (n *noisyNet) Stack() *stack.Stack {
+	return n.stack
 }
 
 // LookupHost resolves host names (encoded public keys) to IP addresses.
 func (n *noisyNet) LookupHost(host string) ([]string, error) {
-	// Host is an IP address.
+	return n.LookupHostContext(context.Background(), host)
+}
+
+// LookupHostContext is like LookupHost, but allows the lookup to be cancelled.
+func (n *noisyNet) LookupHostContext(ctx context.Context, host string) ([]string, error) {
+	// Host is an IP address, IPv4-mapped addresses are returned as IPv4.
 	if addr, err := netip.ParseAddr(host); err == nil {
-		return []string{addr.String()}, nil
+		return []string{addr.Unmap().String()}, nil
 	}
 
-	// Host is the name of the local node.
-	if host == n.localName {
-		var addrs []string
-		for _, addr := range n.localAddrs {
+	// Host is the name of the local node or a peer.
+	var addrs []string
+	if meshAddrs, ok := n.lookupMeshHost(host); ok {
+		for _, addr := range meshAddrs {
 			addrs = append(addrs, addr.String())
 		}
 		return addrs, nil
 	}
 
-	// Host is the name of a peer.
-	var addrs []string
-	if pk, ok := n.peerNames[host]; ok {
-		for _, addr := range n.peerAddresses[pk] {
-			addrs = append(addrs, addr.String())
-		}
-
-		return addrs, nil
+	// Names within the mesh's domain are never resolved upstream.
+	if _, ok := n.trimDomain(host); ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
 	}
 
 	// Host is a DNS name.
-	if len(n.dnsServers) > 0 {
+	if resolver := n.resolverFor(host); resolver != nil {
 		var err error
-		addrs, err = resolveHost(n.dnsServers, host, n.DialContext)
+		addrs, err = resolver.LookupHost(ctx, host)
 		if err != nil {
 			return nil, err
 		}
@@ -86,59 +223,284 @@ func (n *noisyNet) LookupHost(host string) ([]string, error) {
 	return nil, &net.DNSError{Err: "no such host", Name: host}
 }
 
+// lookupMeshHost resolves the name of the local node, a peer, or a service to
+// its addresses.
+// The name can also be qualified with the mesh's domain (eg. "web.my-net.internal").
+func (n *noisyNet) lookupMeshHost(host string) ([]netip.Addr, bool) {
+	host, _ = n.trimDomain(host)
+	if host == "" {
+		return nil, false
+	}
+
+	if host == n.localName {
+		return slices.Clone(n.localAddrs.load()), true
+	}
+
+	n.peersMu.RLock()
+	defer n.peersMu.RUnlock()
+
+	pk, ok := n.peerNames[host]
+	if !ok {
+		// Or a service served by several peers.
+		return n.lookupServiceLocked(host)
+	}
+
+	return append([]netip.Addr(nil), n.peerAddresses[pk]...), true
+}
+
+// LookupAddr performs a reverse lookup for the given address, returning the
+// name of the local node or peer it belongs to. Other addresses are looked up
+// using the resolver, if it supports reverse lookups (as *net.Resolver does).
+// Names are returned without a trailing dot.
+func (n *noisyNet) LookupAddr(addr string) ([]string, error) {
+	return n.LookupAddrContext(context.Background(), addr)
+}
+
+// LookupAddrContext is like LookupAddr, but allows the lookup to be cancelled.
+func (n *noisyNet) LookupAddrContext(ctx context.Context, addr string) ([]string, error) {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return nil, &net.DNSError{Err: "unrecognized address", Name: addr}
+	}
+
+	if name, ok := n.lookupMeshAddr(ip.Unmap()); ok {
+		return []string{n.qualifyName(name)}, nil
+	}
+
+	var resolver Resolver
+	if arpa, err := dns.ReverseAddr(ip.Unmap().String()); err == nil {
+		resolver = n.resolverFor(arpa)
+	}
+
+	if resolver, ok := resolver.(addrResolver); ok {
+		names, err := resolver.LookupAddr(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range names {
+			names[i] = strings.TrimSuffix(names[i], ".")
+		}
+
+		if len(names) > 0 {
+			return names, nil
+		}
+	}
+
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+// LookupSRV looks up the SRV records of a service, as net.LookupSRV does. The
+// services advertised by the local node, and published by peers, are answered
+// from the mesh (eg. LookupSRV("api", "tcp", "") returns the hosts of
+// "_api._tcp"). Other services are looked up using the resolver, if it
+// supports SRV lookups (as *net.Resolver does).
+func (n *noisyNet) LookupSRV(service, proto, name string) (string, []*net.SRV, error) {
+	return n.LookupSRVContext(context.Background(), service, proto, name)
+}
+
+// LookupSRVContext is like LookupSRV, but allows the lookup to be cancelled.
+func (n *noisyNet) LookupSRVContext(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	target := name
+	if service != "" || proto != "" {
+		target = serviceOwnerName(service, proto)
+		if name != "" {
+			target += "." + name
+		}
+	}
+	target = strings.TrimSuffix(target, ".")
+
+	if services := n.lookupServiceRecords(target); len(services) > 0 {
+		owner, _ := n.trimDomain(target)
+
+		srvs := make([]*net.SRV, 0, len(services))
+		for _, svc := range services {
+			srvs = append(srvs, &net.SRV{Target: dns.Fqdn(n.qualifyName(svc.Host)), Port: svc.Port})
+		}
+
+		return dns.Fqdn(n.qualifyName(strings.ToLower(owner))), srvs, nil
+	}
+
+	// Names within the mesh's domain are never resolved upstream.
+	if _, ok := n.trimDomain(target); ok {
+		return "", nil, &net.DNSError{Err: "no such host", Name: target, IsNotFound: true}
+	}
+
+	if resolver, ok := n.resolverFor(target).(srvResolver); ok {
+		return resolver.LookupSRV(ctx, service, proto, name)
+	}
+
+	return "", nil, &net.DNSError{Err: "no such host", Name: target, IsNotFound: true}
+}
+
+// LookupTXT looks up the TXT records of a name, as net.LookupTXT does. The
+// names of services, and peers, are answered from the mesh, other names are
+// looked up using the resolver, if it supports TXT lookups (as *net.Resolver
+// does).
+func (n *noisyNet) LookupTXT(name string) ([]string, error) {
+	return n.LookupTXTContext(context.Background(), name)
+}
+
+// LookupTXTContext is like LookupTXT, but allows the lookup to be cancelled.
+func (n *noisyNet) LookupTXTContext(ctx context.Context, name string) ([]string, error) {
+	if records, ok := n.lookupMeshTXT(name); ok {
+		txt := make([]string, 0, len(records))
+		for _, record := range records {
+			txt = append(txt, strings.Join(record, ""))
+		}
+
+		return txt, nil
+	}
+
+	// Names within the mesh's domain are never resolved upstream.
+	if _, ok := n.trimDomain(name); ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+
+	if resolver, ok := n.resolverFor(name).(txtResolver); ok {
+		return resolver.LookupTXT(ctx, name)
+	}
+
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// trimDomain removes the mesh's domain from a host name, and reports whether
+// the name was within the domain.
+func (n *noisyNet) trimDomain(host string) (string, bool) {
+	host = strings.TrimSuffix(host, ".")
+	if n.domain == "" {
+		return host, false
+	}
+
+	if strings.EqualFold(host, n.domain) {
+		return "", true
+	}
+
+	if i := len(host) - len(n.domain) - 1; i > 0 && host[i] == '.' && strings.EqualFold(host[i+1:], n.domain) {
+		return host[:i], true
+	}
+
+	return host, false
+}
+
+// qualifyName returns the fully qualified name of the local node or a peer, if
+// the mesh has a domain.
+func (n *noisyNet) qualifyName(name string) string {
+	if n.domain == "" {
+		return name
+	}
+
+	return name + "." + n.domain
+}
+
+// lookupMeshAddr returns the name of the local node or peer that an address
+// belongs to. Addresses within subnets routed to a peer don't belong to it.
+func (n *noisyNet) lookupMeshAddr(addr netip.Addr) (string, bool) {
+	if n.localName != "" && slices.Contains(n.localAddrs.load(), addr) {
+		return n.localName, true
+	}
+
+	n.peersMu.RLock()
+	defer n.peersMu.RUnlock()
+
+	for name, pk := range n.peerNames {
+		if slices.Contains(n.peerAddresses[pk], addr) {
+			return name, true
+		}
+	}
+
+	return "", false
+}
+
 // Dial creates a network connection.
 func (n *noisyNet) Dial(network, address string) (net.Conn, error) {
 	return n.DialContext(context.Background(), network, address)
 }
 
-// DialContext creates a network connection with a context.
+// DialTimeout is like Dial but with a timeout covering name resolution and connection establishment.
+func (n *noisyNet) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return n.DialContext(ctx, network, address)
+}
+
+// DialContext creates a network connection with a context. If the context is
+// canceled, or its deadline is exceeded, during name resolution or while
+// connecting, the dial is aborted. The returned connection implements PeerConn.
 func (n *noisyNet) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if tracer := n.loadTracer(); tracer != nil {
+		return n.traceDial(ctx, tracer, network, address)
+	}
+
+	return n.dialContext(ctx, network, address)
+}
+
+func (n *noisyNet) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
 	acceptV4, acceptV6 := true, true
 	matches := protoSplitter.FindStringSubmatch(network)
 	if matches == nil {
-		return nil, &net.OpError{Op: "dial", Err: net.UnknownNetworkError(network)}
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
 	} else if len(matches[2]) != 0 {
 		acceptV4 = matches[2][0] == '4'
 		acceptV6 = !acceptV4
 	}
+	isUDP := matches[1] == "udp"
 
 	host, sport, err := net.SplitHostPort(address)
 	if err != nil {
-		return nil, &net.OpError{Op: "dial", Err: err}
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
 	}
 
 	port, err := strconv.Atoi(sport)
 	if err != nil || port < 0 || port > 65535 {
-		return nil, &net.OpError{Op: "dial", Err: errNumericPort}
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errNumericPort}
 	}
 
-	allAddr, err := n.LookupHost(host)
+	if err := ctx.Err(); err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: mapErr(err)}
+	}
+
+	allAddr, err := n.LookupHostContext(ctx, host)
 	if err != nil {
-		return nil, &net.OpError{Op: "dial", Err: err}
+		return nil, &net.OpError{Op: "dial", Net: network, Err: mapErr(err)}
 	}
 
 	var addrs []netip.AddrPort
 	for _, addr := range allAddr {
 		ip, err := netip.ParseAddr(addr)
-		if err == nil && ((ip.Is4() && acceptV4) || (ip.Is6() && acceptV6)) {
+		if err != nil {
+			continue
+		}
+		// The resolver may return IPv4-mapped addresses.
+		ip = ip.Unmap()
+
+		if (ip.Is4() && acceptV4) || (ip.Is6() && acceptV6) {
 			addrs = append(addrs, netip.AddrPortFrom(ip, uint16(port)))
 		}
 	}
 	if len(addrs) == 0 && len(allAddr) != 0 {
-		return nil, &net.OpError{Op: "dial", Err: errNoSuitableAddress}
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errNoSuitableAddress}
+	}
+
+	// Race the address families of dual stack hosts (RFC 8305), so that a broken
+	// family doesn't stall the connection. Connecting a UDP socket never blocks.
+	if !isUDP {
+		if primaries, fallbacks := partitionAddrs(addrs); len(fallbacks) > 0 {
+			return n.dialParallel(ctx, network, primaries, fallbacks)
+		}
 	}
 
-	var firstErr error
+	return n.dialSerial(ctx, network, addrs, isUDP)
+}
+
+// dialSerial connects to each of the addresses in turn, until one succeeds.
+func (n *noisyNet) dialSerial(ctx context.Context, network string, addrs []netip.AddrPort, isUDP bool) (net.Conn, error) {
+	var err, firstErr error
 	for i, addr := range addrs {
 		select {
 		case <-ctx.Done():
-			err := ctx.Err()
-			if err == context.Canceled {
-				err = errCanceled
-			} else if err == context.DeadlineExceeded {
-				err = errTimeout
-			}
-			return nil, &net.OpError{Op: "dial", Err: err}
+			return nil, &net.OpError{Op: "dial", Net: network, Err: mapErr(ctx.Err())}
 		default:
 		}
 
@@ -147,7 +509,7 @@ func (n *noisyNet) DialContext(ctx context.Context, network, address string) (ne
 			partialDeadline, err := partialDeadline(time.Now(), deadline, len(addrs)-i)
 			if err != nil {
 				if firstErr == nil {
-					firstErr = &net.OpError{Op: "dial", Err: err}
+					firstErr = &net.OpError{Op: "dial", Net: network, Err: err}
 				}
 				break
 			}
@@ -158,61 +520,498 @@ func (n *noisyNet) DialContext(ctx context.Context, network, address string) (ne
 			}
 		}
 
+		var raddr net.Addr = net.TCPAddrFromAddrPort(addr)
+		if isUDP {
+			raddr = net.UDPAddrFromAddrPort(addr)
+		}
+
+		if !n.allowDial(addr, isUDP) {
+			if firstErr == nil {
+				firstErr = &net.OpError{Op: "dial", Net: network, Addr: raddr, Err: errACLDenied}
+			}
+			continue
+		}
+
 		fa, pn := convertToFullAddr(addr)
-		c, err := gonet.DialContextTCP(dialCtx, n.stack, fa, pn)
-		if err == nil {
-			return c, nil
+
+		if err := n.checkRoute(fa, pn); err != nil {
+			if firstErr == nil {
+				firstErr = &net.OpError{Op: "dial", Net: network, Addr: raddr, Err: err}
+			}
+			continue
+		}
+
+		if isUDP {
+			var c *gonet.UDPConn
+			c, err = n.dialUDP(nil, &fa, pn)
+			if err == nil {
+				return &udpPeerConn{UDPConn: c, peerIdentity: n.peerIdentity(c.RemoteAddr())}, nil
+			}
+		} else {
+			var c *tcpConn
+			c, err = n.dialTCP(dialCtx, fa, pn)
+			if err == nil {
+				return &tcpPeerConn{tcpConn: c, peerIdentity: n.peerIdentity(c.RemoteAddr())}, nil
+			}
 		}
 		if firstErr == nil {
-			firstErr = err
+			firstErr = &net.OpError{Op: "dial", Net: network, Addr: raddr, Err: err}
 		}
 	}
 	if firstErr == nil {
-		firstErr = &net.OpError{Op: "dial", Err: errMissingAddress}
+		firstErr = &net.OpError{Op: "dial", Net: network, Err: errMissingAddress}
 	}
 
 	return nil, firstErr
 }
 
-// Listen creates a network listener.
+// checkRoute returns an error if an address can't be reached, as it doesn't
+// belong to the local node, or any peer, or the peer it belongs to isn't
+// connected. Packets to such addresses would otherwise be silently dropped,
+// and connections would hang until they timed out.
+func (n *noisyNet) checkRoute(fa tcpip.FullAddress, pn tcpip.NetworkProtocolNumber) error {
+	addr, _ := netip.AddrFromSlice(fa.Addr.AsSlice())
+	if !addr.IsValid() || isGroupAddress(addr) || n.stack.CheckLocalAddress(0, pn, fa.Addr) != 0 {
+		return nil
+	}
+
+	n.peersMu.RLock()
+	publicKey, ok := n.fromPeerAddress.Lookup(addr)
+	n.peersMu.RUnlock()
+
+	if !ok {
+		// The peer may be looked up on demand (see SetUnknownPeerFunc).
+		if n.unknownDestination != nil && n.unknownDestination.Load() != nil {
+			return nil
+		}
+
+		return ErrNoRouteToPeer
+	}
+
+	if n.peerConnected != nil && !n.peerConnected(publicKey) {
+		return ErrPeerNotConnected
+	}
+
+	return nil
+}
+
+// dialTCP connects a TCP endpoint to an address. Unlike gonet.DialContextTCP,
+// errors are mapped to their net package equivalents.
+func (n *noisyNet) dialTCP(ctx context.Context, addr tcpip.FullAddress, pn tcpip.NetworkProtocolNumber) (*tcpConn, error) {
+	var wq waiter.Queue
+	ep, err := n.newEndpoint(tcp.ProtocolNumber, pn, &wq)
+	if err != nil {
+		return nil, err
+	}
+
+	// Register for notifications before connecting, so that none are missed.
+	waitEntry, notifyCh := waiter.NewChannelEntry(waiter.WritableEvents)
+	wq.EventRegister(&waitEntry)
+	defer wq.EventUnregister(&waitEntry)
+
+	tcpErr := ep.Connect(addr)
+	if _, ok := tcpErr.(*tcpip.ErrConnectStarted); ok {
+		select {
+		case <-ctx.Done():
+			ep.Close()
+			return nil, mapErr(ctx.Err())
+		case <-notifyCh:
+		}
+
+		tcpErr = ep.LastError()
+	}
+	if tcpErr != nil {
+		ep.Close()
+		return nil, mapTCPIPErr(tcpErr)
+	}
+
+	return newTCPConn(&wq, n.connBytes.track(ep, &wq)), nil
+}
+
+// dialUDP creates a UDP endpoint, bound to laddr and connected to raddr (if
+// they are set). Unlike gonet.DialUDP, errors are mapped to their net package
+// equivalents.
+func (n *noisyNet) dialUDP(laddr, raddr *tcpip.FullAddress, pn tcpip.NetworkProtocolNumber) (*gonet.UDPConn, error) {
+	var wq waiter.Queue
+	ep, err := n.newEndpoint(udp.ProtocolNumber, pn, &wq)
+	if err != nil {
+		return nil, err
+	}
+
+	if laddr != nil {
+		if tcpErr := ep.Bind(*laddr); tcpErr != nil {
+			ep.Close()
+			return nil, mapTCPIPErr(tcpErr)
+		}
+	}
+
+	if raddr != nil {
+		if tcpErr := ep.Connect(*raddr); tcpErr != nil {
+			ep.Close()
+			return nil, mapTCPIPErr(tcpErr)
+		}
+	}
+
+	return n.newUDPConn(&wq, ep), nil
+}
+
+// dialParallel races connections to the primary and fallback addresses, the
+// fallbacks are started after a short delay, or as soon as the primaries fail.
+// The first successful connection is returned.
+func (n *noisyNet) dialParallel(ctx context.Context, network string, primaries, fallbacks []netip.AddrPort) (net.Conn, error) {
+	type dialResult struct {
+		net.Conn
+		error
+		primary bool
+		done    bool
+	}
+
+	results := make(chan dialResult) // unbuffered
+	returned := make(chan struct{})
+	defer close(returned)
+
+	startRacer := func(ctx context.Context, primary bool) {
+		addrs := primaries
+		if !primary {
+			addrs = fallbacks
+		}
+
+		c, err := n.dialSerial(ctx, network, addrs, false)
+		select {
+		case results <- dialResult{Conn: c, error: err, primary: primary, done: true}:
+		case <-returned:
+			// Another racer won.
+			if c != nil {
+				_ = c.Close()
+			}
+		}
+	}
+
+	var primary, fallback dialResult
+
+	primaryCtx, primaryCancel := context.WithCancel(ctx)
+	defer primaryCancel()
+	go startRacer(primaryCtx, true)
+
+	fallbackTimer := time.NewTimer(dialFallbackDelay)
+	defer fallbackTimer.Stop()
+
+	for {
+		select {
+		case <-fallbackTimer.C:
+			fallbackCtx, fallbackCancel := context.WithCancel(ctx)
+			defer fallbackCancel()
+			go startRacer(fallbackCtx, false)
+
+		case res := <-results:
+			if res.error == nil {
+				return res.Conn, nil
+			}
+
+			if res.primary {
+				primary = res
+			} else {
+				fallback = res
+			}
+
+			if primary.done && fallback.done {
+				return nil, primary.error
+			}
+
+			// The primaries failed before the fallbacks were started, so start
+			// them now.
+			if res.primary && fallbackTimer.Stop() {
+				fallbackTimer.Reset(0)
+			}
+		}
+	}
+}
+
+// partitionAddrs divides the addresses into those of the same family as the
+// first address (primaries), and the rest (fallbacks).
+func partitionAddrs(addrs []netip.AddrPort) (primaries, fallbacks []netip.AddrPort) {
+	for _, addr := range addrs {
+		if addr.Addr().Is4() == addrs[0].Addr().Is4() {
+			primaries = append(primaries, addr)
+		} else {
+			fallbacks = append(fallbacks, addr)
+		}
+	}
+
+	return primaries, fallbacks
+}
+
+// Listen creates a network listener (only TCP is currently supported). The
+// listener implements Listener, and accepted connections implement PeerConn.
 func (n *noisyNet) Listen(network, address string) (net.Listener, error) {
+	return n.ListenWithOptions(network, address)
+}
+
+// ListenWithOptions is like Listen, but the listener can be restricted to
+// connections from a set of peers (see WithAllowedPeers and
+// WithAllowedPublicKeys). Connection attempts from any other peer are dropped,
+// before a connection is established.
+func (n *noisyNet) ListenWithOptions(network, address string, opts ...ListenOption) (net.Listener, error) {
+	var options listenOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return n.listen(network, address, &options)
+}
+
+func (n *noisyNet) listen(network, address string, opts *listenOptions) (lis net.Listener, err error) {
+	if tracer := n.loadTracer(); tracer != nil {
+		defer func() {
+			n.traceListen(tracer, network, address, err)
+		}()
+	}
+
+	addr, isUDP, err := n.resolveListenAddr(network, address)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+
+	if isUDP {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+
+	var filter *listenerFilter
+	if opts.hasPeerFilter() {
+		filter, err = newListenerFilter(addr, opts)
+		if err != nil {
+			return nil, &net.OpError{Op: "listen", Net: network, Addr: net.TCPAddrFromAddrPort(addr), Err: err}
+		}
+
+		// Install the filter first, so that no connections slip through.
+		n.listenerFilters.add(filter)
+	}
+
+	fa, pn := convertToFullAddr(addr)
+	lis, err = n.newPeerListener(fa, pn, opts, filter)
+	if err != nil {
+		if filter != nil {
+			n.listenerFilters.remove(filter)
+		}
+		return nil, err
+	}
+
+	return lis, nil
+}
+
+// ListenPacket creates a packet listener, for UDP, or an IP protocol (see
+// ListenIP, the address is then just a host).
+func (n *noisyNet) ListenPacket(network, address string) (net.PacketConn, error) {
+	return n.listenPacket(network, address, &listenOptions{})
+}
+
+func (n *noisyNet) listenPacket(network, address string, opts *listenOptions) (net.PacketConn, error) {
+	if strings.HasPrefix(network, "ip") {
+		return n.listenIPPacket(network, address, opts)
+	}
+
+	addr, isUDP, err := n.resolveListenAddr(network, address)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+
+	if !isUDP {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+
+	// Datagrams aren't connection attempts, so can't be filtered by the listener.
+	if opts.hasPeerFilter() {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: errors.New("peer filters are only supported by tcp listeners")}
+	}
+
+	fa, pn := convertToFullAddr(addr)
+
+	var wq waiter.Queue
+	ep, err := n.newEndpoint(udp.ProtocolNumber, pn, &wq)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Addr: net.UDPAddrFromAddrPort(addr), Err: err}
+	}
+
+	opts.apply(ep)
+
+	if tcpErr := ep.Bind(fa); tcpErr != nil {
+		ep.Close()
+		return nil, &net.OpError{Op: "bind", Net: "udp", Addr: net.UDPAddrFromAddrPort(addr), Err: mapTCPIPErr(tcpErr)}
+	}
+
+	return n.newUDPConn(&wq, ep), nil
+}
+
+// ReachableAddrs returns the addresses at which peers can reach a listener,
+// or packet conn, bound to addr (eg. the listener's Addr()). So that services
+// listening on an ephemeral port, or on the wildcard address, can register
+// themselves with a discovery system. A wildcard address is expanded into
+// each of the local addresses it accepts traffic for (IPv6 wildcards also
+// accept IPv4 traffic), in the order they were configured. An address without
+// an IP (eg. the LocalAddr() of a packet conn bound to the wildcard address)
+// accepts any.
+func (n *noisyNet) ReachableAddrs(addr net.Addr) ([]netip.AddrPort, error) {
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	default:
+		return nil, fmt.Errorf("unsupported address type %T", addr)
+	}
+
+	if port == 0 {
+		return nil, fmt.Errorf("address %s has no port", addr)
+	}
+
+	var reachable []netip.AddrPort
+	if len(ip) == 0 || ip.IsUnspecified() {
+		v4Only := ip.To4() != nil
+
+		for _, localAddr := range n.localAddrs.load() {
+			if v4Only && !localAddr.Unmap().Is4() {
+				continue
+			}
+
+			reachable = append(reachable, netip.AddrPortFrom(localAddr, uint16(port)))
+		}
+
+		return reachable, nil
+	}
+
+	bound, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return nil, fmt.Errorf("invalid address %s", addr)
+	}
+
+	for _, localAddr := range n.localAddrs.load() {
+		if localAddr.Unmap() == bound.Unmap() {
+			return []netip.AddrPort{netip.AddrPortFrom(localAddr, uint16(port))}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("address %s is not a local address", addr)
+}
+
+func (n *noisyNet) listenIPPacket(network, address string, opts *listenOptions) (net.PacketConn, error) {
+	if opts.hasPeerFilter() {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: errors.New("peer filters are only supported by tcp listeners")}
+	}
+
+	var laddr *net.IPAddr
+	if address != "" {
+		addr, err := netip.ParseAddr(address)
+		if err != nil {
+			return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+		}
+
+		laddr = &net.IPAddr{IP: addr.AsSlice()}
+	}
+
+	return n.ListenIP(network, laddr)
+}
+
+// DialUDP creates a UDP connection. If laddr is nil, a local address is
+// automatically chosen. If raddr is nil, the connection is unconnected.
+func (n *noisyNet) DialUDP(network string, laddr, raddr *net.UDPAddr) (*gonet.UDPConn, error) {
+	if network != "udp" && network != "udp4" && network != "udp6" {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+
+	var lfa, rfa *tcpip.FullAddress
+	var pn tcpip.NetworkProtocolNumber
+	if laddr != nil {
+		var addr tcpip.FullAddress
+		addr, pn = convertToFullAddr(laddr.AddrPort())
+		lfa = &addr
+	}
+	if raddr != nil {
+		var addr tcpip.FullAddress
+		addr, pn = convertToFullAddr(raddr.AddrPort())
+		rfa = &addr
+	}
+	if lfa == nil && rfa == nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errMissingAddress}
+	}
+
+	c, err := n.dialUDP(lfa, rfa, pn)
+	if err != nil {
+		opErr := &net.OpError{Op: "dial", Net: network, Err: err}
+		if laddr != nil {
+			opErr.Source = laddr
+		}
+		if raddr != nil {
+			opErr.Addr = raddr
+		}
+		return nil, opErr
+	}
+
+	return c, nil
+}
+
+// ListenUDP creates an unconnected UDP connection listening on laddr.
+func (n *noisyNet) ListenUDP(network string, laddr *net.UDPAddr) (*gonet.UDPConn, error) {
+	if laddr == nil {
+		laddr = &net.UDPAddr{}
+	}
+
+	if laddr.IP == nil || laddr.IP.IsUnspecified() {
+		addr, _, err := n.resolveListenAddr(network, net.JoinHostPort("", strconv.Itoa(laddr.Port)))
+		if err != nil {
+			return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+		}
+
+		laddr = net.UDPAddrFromAddrPort(addr)
+	}
+
+	return n.DialUDP(network, laddr, nil)
+}
+
+// resolveListenAddr parses a listen network and address, choosing a suitable
+// local address if no host is specified.
+func (n *noisyNet) resolveListenAddr(network, address string) (netip.AddrPort, bool, error) {
 	acceptV4, acceptV6 := true, true
 	matches := protoSplitter.FindStringSubmatch(network)
 	if matches == nil {
-		return nil, &net.OpError{Op: "listen", Err: net.UnknownNetworkError(network)}
+		return netip.AddrPort{}, false, net.UnknownNetworkError(network)
 	} else if len(matches[2]) != 0 {
 		acceptV4 = matches[2][0] == '4'
 		acceptV6 = !acceptV4
 	}
+	isUDP := matches[1] == "udp"
 
 	host, sport, err := net.SplitHostPort(address)
 	if err != nil {
-		return nil, &net.OpError{Op: "listen", Err: err}
+		return netip.AddrPort{}, false, err
 	}
 
 	port, err := strconv.Atoi(sport)
 	if err != nil || port < 0 || port > 65535 {
-		return nil, &net.OpError{Op: "listen", Err: errNumericPort}
+		return netip.AddrPort{}, false, errNumericPort
 	}
 
 	var addr netip.AddrPort
 	if host != "" {
 		ip, err := netip.ParseAddr(host)
 		if err != nil {
-			return nil, &net.OpError{Op: "listen", Err: err}
+			return netip.AddrPort{}, false, err
 		}
+		// Eg. the IPv4-mapped wildcard, ::ffff:0.0.0.0, is the IPv4 wildcard.
+		ip = ip.Unmap()
 
 		if ip.Is4() && !acceptV4 {
-			return nil, &net.OpError{Op: "listen", Err: net.UnknownNetworkError("tcp4")}
+			return netip.AddrPort{}, false, net.UnknownNetworkError(matches[1] + "4")
 		}
 
 		if ip.Is6() && !acceptV6 {
-			return nil, &net.OpError{Op: "listen", Err: net.UnknownNetworkError("tcp6")}
+			return netip.AddrPort{}, false, net.UnknownNetworkError(matches[1] + "6")
 		}
 
 		addr = netip.AddrPortFrom(ip, uint16(port))
 	} else {
-		for _, localAddr := range n.localAddrs {
+		for _, localAddr := range n.localAddrs.load() {
 			if localAddr.Is6() && acceptV6 {
 				addr = netip.AddrPortFrom(localAddr, uint16(port))
 				break
@@ -224,22 +1023,32 @@ func (n *noisyNet) Listen(network, address string) (net.Listener, error) {
 		}
 	}
 
-	fa, pn := convertToFullAddr(addr)
-	return gonet.ListenTCP(n.stack, fa, pn)
+	return addr, isUDP, nil
 }
 
+// convertToFullAddr converts an endpoint to a stack address, IPv4-mapped
+// addresses are converted to IPv4 addresses (the stack would otherwise treat
+// them as IPv6 addresses, that no peer has). The stack binds to any address
+// when it is empty, so unspecified addresses are left empty.
 func convertToFullAddr(endpoint netip.AddrPort) (tcpip.FullAddress, tcpip.NetworkProtocolNumber) {
+	addr := endpoint.Addr().Unmap()
+
 	var protoNumber tcpip.NetworkProtocolNumber
-	if endpoint.Addr().Is4() {
+	if addr.Is4() {
 		protoNumber = ipv4.ProtocolNumber
 	} else {
 		protoNumber = ipv6.ProtocolNumber
 	}
-	return tcpip.FullAddress{
+
+	fa := tcpip.FullAddress{
 		NIC:  1,
-		Addr: tcpip.AddrFromSlice(endpoint.Addr().AsSlice()),
 		Port: endpoint.Port(),
-	}, protoNumber
+	}
+	if !addr.IsUnspecified() {
+		fa.Addr = tcpip.AddrFromSlice(addr.AsSlice())
+	}
+
+	return fa, protoNumber
 }
 
 func partialDeadline(now, deadline time.Time, addrsRemaining int) (time.Time, error) {
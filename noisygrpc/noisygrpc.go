@@ -0,0 +1,138 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+// Package noisygrpc allows gRPC clients to connect to services on the mesh,
+// using targets of the form "noisy:///peername:port".
+package noisygrpc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/resolver"
+)
+
+// Scheme is the URI scheme of gRPC targets that are resolved on the mesh.
+const Scheme = "noisy"
+
+// defaultServiceConfig balances calls across all the addresses of a peer,
+// rather than using only the first.
+const defaultServiceConfig = `{"loadBalancingConfig": [{"round_robin": {}}]}`
+
+// Network is a network on which hosts can be resolved and dialed.
+// A noisy socket is one such network.
+type Network interface {
+	LookupHostContext(ctx context.Context, host string) ([]string, error)
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// DialOptions returns the options needed for a gRPC client to connect to
+// "noisy:///peername:port" targets through the network. Calls are balanced
+// across the addresses of the peer, unless the client sets its own service
+// config.
+func DialOptions(network Network) []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithContextDialer(func(ctx context.Context, address string) (net.Conn, error) {
+			return network.DialContext(ctx, "tcp", address)
+		}),
+		grpc.WithResolvers(NewBuilder(network)),
+		grpc.WithDefaultServiceConfig(defaultServiceConfig),
+	}
+}
+
+// NewBuilder returns a gRPC resolver builder for the "noisy" scheme, that
+// resolves targets to the addresses of peers on the network.
+func NewBuilder(network Network) resolver.Builder {
+	return &builder{network: network}
+}
+
+type builder struct {
+	network Network
+}
+
+func (b *builder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
+	host, port, err := net.SplitHostPort(target.Endpoint())
+	if err != nil {
+		return nil, fmt.Errorf("invalid target %q: %w", target.Endpoint(), err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	r := &meshResolver{
+		network:    b.network,
+		host:       host,
+		port:       port,
+		cc:         cc,
+		cancel:     cancel,
+		resolveNow: make(chan struct{}, 1),
+	}
+
+	r.wg.Add(1)
+	go r.watch(ctx)
+
+	return r, nil
+}
+
+func (b *builder) Scheme() string {
+	return Scheme
+}
+
+// meshResolver resolves a target whenever gRPC asks it to, eg. after a
+// connection to one of the peer's addresses has failed.
+type meshResolver struct {
+	network    Network
+	host       string
+	port       string
+	cc         resolver.ClientConn
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+	resolveNow chan struct{}
+}
+
+func (r *meshResolver) ResolveNow(resolver.ResolveNowOptions) {
+	select {
+	case r.resolveNow <- struct{}{}:
+	default:
+	}
+}
+
+func (r *meshResolver) Close() {
+	r.cancel()
+	r.wg.Wait()
+}
+
+func (r *meshResolver) watch(ctx context.Context) {
+	defer r.wg.Done()
+
+	for {
+		r.resolve(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.resolveNow:
+		}
+	}
+}
+
+func (r *meshResolver) resolve(ctx context.Context) {
+	hosts, err := r.network.LookupHostContext(ctx, r.host)
+	if err != nil {
+		if ctx.Err() == nil {
+			r.cc.ReportError(fmt.Errorf("failed to resolve %q: %w", r.host, err))
+		}
+		return
+	}
+
+	addrs := make([]resolver.Address, 0, len(hosts))
+	for _, host := range hosts {
+		addrs = append(addrs, resolver.Address{Addr: net.JoinHostPort(host, r.port)})
+	}
+
+	_ = r.cc.UpdateState(resolver.State{Addresses: addrs})
+}
@@ -0,0 +1,148 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisygrpc_test
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/noisysockets/noisysockets/noisygrpc"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestDialOptions(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "server",
+		ListenPort: 12406,
+		PrivateKey: serverPrivateKey.String(),
+		IPs:        []string{"10.7.0.1", "10.7.0.3"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				PublicKey: clientPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.2"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+	})
+
+	srv := grpc.NewServer()
+	healthpb.RegisterHealthServer(srv, health.NewServer())
+	t.Cleanup(srv.Stop)
+
+	// A listener for each of the server's addresses.
+	var listeners []*countingListener
+	for _, addr := range []string{"10.7.0.1:50051", "10.7.0.3:50051"} {
+		lis, err := serverSocket.Listen("tcp", addr)
+		require.NoError(t, err)
+
+		countingLis := &countingListener{Listener: lis}
+		listeners = append(listeners, countingLis)
+
+		go func() {
+			_ = srv.Serve(countingLis)
+		}()
+	}
+
+	clientSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "client",
+		ListenPort: 12407,
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "server",
+				PublicKey: serverPrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12406",
+				IPs:       []string{"10.7.0.1", "10.7.0.3"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, clientSocket.Close())
+	})
+
+	opts := append(noisygrpc.DialOptions(clientSocket), grpc.WithTransportCredentials(insecure.NewCredentials()))
+
+	t.Run("Load Balanced", func(t *testing.T) {
+		conn, err := grpc.Dial("noisy:///server:50051", opts...)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, conn.Close())
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		t.Cleanup(cancel)
+
+		client := healthpb.NewHealthClient(conn)
+		for i := 0; i < 4; i++ {
+			resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{}, grpc.WaitForReady(true))
+			require.NoError(t, err)
+
+			require.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+		}
+
+		// Each of the server's addresses was connected to.
+		require.Eventually(t, func() bool {
+			return listeners[0].accepted.Load() > 0 && listeners[1].accepted.Load() > 0
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("Unknown Host", func(t *testing.T) {
+		conn, err := grpc.Dial("noisy:///unknown:50051", opts...)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, conn.Close())
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		t.Cleanup(cancel)
+
+		_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+		require.ErrorContains(t, err, "no such host")
+	})
+
+	t.Run("Invalid Target", func(t *testing.T) {
+		_, err := grpc.Dial("noisy:///server", opts...)
+		require.Error(t, err)
+	})
+}
+
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int64
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+
+	return conn, err
+}
@@ -7,25 +7,117 @@
 package noisysockets
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"net"
 	"net/netip"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/noisysockets/noisysockets/config/v1alpha1"
 	"github.com/noisysockets/noisysockets/internal/conn"
 	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/noisysockets/noisysockets/ipam"
+	"github.com/noisysockets/noisysockets/proxy"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
 )
 
+// defaultRoutePrefixes are the catch-all prefixes routed via a default gateway peer.
+var defaultRoutePrefixes = []netip.Prefix{
+	netip.PrefixFrom(netip.IPv4Unspecified(), 0),
+	netip.PrefixFrom(netip.IPv6Unspecified(), 0),
+}
+
 // NoisySocket is a noisy socket, it exposes Dial() and Listen() methods compatible with the net package.
 type NoisySocket struct {
 	*noisyNet
-	transport *transport.Transport
+	logger                 *slog.Logger
+	sourceSink             *sourceSink
+	transport              *transport.Transport
+	dnsServer              *dnsServer
+	measurementServer      *measurementServer
+	reverseProxies         []*proxy.ReverseProxy
+	defaultGatewayPeerName string
+	strictInterop          bool
+	peerIdleTimeoutSeconds int
+	// relayBind is the bind used to reach peers via the relay, if configured.
+	relayBind *conn.RelayBind
+	// endpointDiscovery discovers, and exchanges, public endpoints, if configured.
+	endpointDiscovery *endpointDiscovery
+	// introductions requests, and makes, introductions of peers, if configured.
+	// It is started after the transport, so is read by its event handler atomically.
+	introductions atomic.Pointer[introductions]
+	// unknownPeers looks up peers on demand, see SetUnknownPeerFunc.
+	unknownPeers *unknownPeerResolver
+	// ipam assigns addresses to peers without any, if configured.
+	ipam *ipam.Allocator
+	// deriveAddrs assigns derived IPv6 addresses to peers without any, if enabled.
+	deriveAddrs bool
+	// lanDiscovery announces the socket, and discovers peers, on the local
+	// network, if enabled.
+	lanDiscovery *lanDiscovery
+	// pathMTUDiscovery probes the path MTU to each peer, if enabled.
+	pathMTUDiscovery *pathMTUDiscovery
+	// healthChecker pings each peer to check its health, if enabled.
+	healthChecker *healthChecker
+	// sessionStateFile is where the sessions of peers are saved on close, if
+	// configured.
+	sessionStateFile string
+	// floatingIPsMu serializes failing over floatingIPs.
+	floatingIPsMu sync.Mutex
+	floatingIPs   []floatingIP
+	// roaming rebinds the socket when the host's network changes, if enabled.
+	roaming *roamingMonitor
+	// peerExpiry removes peers once they expire.
+	peerExpiry *peerExpiry
+	// confMu protects conf, the socket's current configuration (excluding peers).
+	confMu sync.Mutex
+	conf   v1alpha1.Config
+	// peerConfigsMu protects peerConfigs, the configuration of each peer.
+	peerConfigsMu sync.Mutex
+	peerConfigs   map[transport.NoisePublicKey]v1alpha1.WireGuardPeerConfig
+	// events delivers changes in the state of peers to subscribers.
+	events eventBus
+	// handshakeTracer traces handshakes, if tracing is enabled.
+	handshakeTracer handshakeTracer
 }
 
-// NewNoisySocket creates a new NoisySocket.
+// NewNoisySocket creates a new NoisySocket. Handshakes, and the packets that
+// are dropped (eg. for lack of a route to their destination, or by an ACL), are
+// logged at the debug level. A nil logger disables logging.
 func NewNoisySocket(logger *slog.Logger, conf *v1alpha1.Config) (*NoisySocket, error) {
+	return newNoisySocket(logger, conf, nil, nil)
+}
+
+// underlay provides the bind over which a socket exchanges UDP packets with its
+// peers, in place of its own UDP socket (eg. a shared port).
+type underlay struct {
+	// name describes the underlay in errors.
+	name string
+	// newBind creates the socket's bind, accept reports whether a received
+	// packet is addressed to the socket.
+	newBind func(accept func(packet []byte) bool) conn.Bind
+}
+
+// newNoisySocket creates a new NoisySocket, that exchanges UDP packets with its
+// peers over the underlay, if not nil. The socket's timers are driven by the
+// clock, if not nil, rather than the system clock.
+func newNoisySocket(logger *slog.Logger, conf *v1alpha1.Config, under *underlay, clock tcpip.Clock) (*NoisySocket, error) {
+	if logger == nil {
+		logger = slog.New(discardHandler{})
+	}
+
+	if clock == nil {
+		clock = tcpip.NewStdClock()
+	}
+
 	var privateKey transport.NoisePrivateKey
 	if err := privateKey.FromString(conf.PrivateKey); err != nil {
 		return nil, fmt.Errorf("failed to parse private key: %w", err)
@@ -42,119 +134,1499 @@ func NewNoisySocket(logger *slog.Logger, conf *v1alpha1.Config) (*NoisySocket, e
 		addrs = append(addrs, addr)
 	}
 
-	var defaultGateway *transport.NoisePublicKey
-	var defaultGatewayAddrs []netip.Addr
+	var allocator *ipam.Allocator
+	if conf.IPAM != nil {
+		var err error
+		allocator, err = newAllocator(conf)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(addrs) == 0 {
+			addr, err := allocator.Allocate(publicKey.String())
+			if err != nil {
+				return nil, fmt.Errorf("could not allocate address: %w", err)
+			}
+			addrs = append(addrs, addr)
+		}
+	}
+
+	if conf.DeriveIPv6Addresses && len(conf.IPs) == 0 {
+		addrs = append(addrs, ipam.DeriveAddr(publicKey.String()))
+	}
+
 	if conf.DefaultGatewayPeerName != "" {
-		var defaultGatewayPeerConf *v1alpha1.WireGuardPeerConfig
+		var found bool
 		for i := range conf.Peers {
 			if conf.Peers[i].Name == conf.DefaultGatewayPeerName {
-				defaultGatewayPeerConf = &conf.Peers[i]
+				found = true
 				break
 			}
 		}
 
-		if defaultGatewayPeerConf == nil {
+		if !found {
 			return nil, fmt.Errorf("could not find default gateway peer %q", conf.DefaultGatewayPeerName)
 		}
+	}
+
+	if len(conf.DNSServers) > 0 && conf.UseHostResolver {
+		return nil, fmt.Errorf("dns servers and the host resolver are mutually exclusive")
+	}
+
+	var dnsServers []dnsServerSpec
+	for _, server := range conf.DNSServers {
+		spec, err := parseDNSServer(server)
+		if err != nil {
+			return nil, err
+		}
+
+		dnsServers = append(dnsServers, spec)
+	}
+
+	var dnsConf v1alpha1.DNSConfig
+	if conf.DNS != nil {
+		dnsConf = *conf.DNS
+	}
+
+	if dnsConf.CacheSize < 0 {
+		return nil, fmt.Errorf("dns cache size must not be negative")
+	}
+
+	var bootstrapServers []dnsServerSpec
+	for _, ip := range dnsConf.BootstrapServers {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse bootstrap DNS server address: %w", err)
+		}
+
+		bootstrapServers = append(bootstrapServers, dnsServerSpec{addr: addr.Unmap()})
+	}
+
+	type dnsRoute struct {
+		domain          string
+		servers         []dnsServerSpec
+		useHostResolver bool
+	}
+
+	var dnsRoutes []dnsRoute
+	for _, routeConf := range conf.DNSRoutes {
+		route := dnsRoute{
+			domain:          strings.TrimPrefix(routeConf.Domain, "*."),
+			useHostResolver: routeConf.UseHostResolver,
+		}
+
+		if strings.Trim(route.domain, ".") == "" {
+			return nil, fmt.Errorf("dns route must have a domain")
+		}
 
-		defaultGateway = &transport.NoisePublicKey{}
-		if err := defaultGateway.FromString(defaultGatewayPeerConf.PublicKey); err != nil {
-			return nil, fmt.Errorf("could not parse default gateway public key: %w", err)
+		if (len(routeConf.Servers) > 0) == routeConf.UseHostResolver {
+			return nil, fmt.Errorf("dns route for %q must have either servers or use the host resolver", routeConf.Domain)
 		}
 
-		for _, ip := range defaultGatewayPeerConf.IPs {
-			addr, err := netip.ParseAddr(ip)
+		for _, server := range routeConf.Servers {
+			spec, err := parseDNSServer(server)
 			if err != nil {
-				return nil, fmt.Errorf("could not parse default gateway address: %w", err)
+				return nil, fmt.Errorf("invalid dns route for %q: %w", routeConf.Domain, err)
 			}
 
-			defaultGatewayAddrs = append(defaultGatewayAddrs, addr)
+			route.servers = append(route.servers, spec)
 		}
+
+		dnsRoutes = append(dnsRoutes, route)
 	}
 
-	var dnsServers []netip.Addr
-	for _, ip := range conf.DNSServers {
-		addr, err := netip.ParseAddr(ip)
+	leastConnections, err := parseLoadBalancing(conf.LoadBalancing)
+	if err != nil {
+		return nil, err
+	}
+
+	floatingIPs, err := parseFloatingIPs(conf.FloatingIPs)
+	if err != nil {
+		return nil, err
+	}
+
+	opts, err := configSourceSinkOptions(conf)
+	if err != nil {
+		return nil, err
+	}
+	mtu := opts.mtu
+	opts.logger = logger
+	opts.clock = clock
+
+	timers, err := configTimers(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	sourceSink, n, err := newSourceSink(conf.Name, publicKey, addrs, opts)
+	if err != nil {
+		return nil, fmt.Errorf("could not create source sink: %w", err)
+	}
+
+	// If the socket can't be created, whatever has been started is closed.
+	var (
+		t       *transport.Transport
+		s       *NoisySocket
+		created bool
+	)
+	defer func() {
+		if created {
+			return
+		}
+
+		switch {
+		case s != nil:
+			// Don't overwrite the saved sessions with those of a socket that
+			// never came up.
+			s.sessionStateFile = ""
+			_ = s.Close()
+		case t != nil:
+			// Closing the transport also closes the source sink.
+			_ = t.Close()
+		default:
+			_ = sourceSink.Close()
+		}
+	}()
+
+	n.domain = strings.ToLower(strings.Trim(conf.Domain, "."))
+	n.balancer.leastConnections = leastConnections
+
+	dialContext := n.DialContext
+	if dnsConf.ViaHostNetwork {
+		var d net.Dialer
+		dialContext = d.DialContext
+	}
+
+	// The bootstrap servers must be addresses, so they never need resolving.
+	var bootstrap Resolver = net.DefaultResolver
+	if len(bootstrapServers) > 0 {
+		var upstreams []dnsUpstream
+		for _, spec := range bootstrapServers {
+			upstreams = append(upstreams, newDNSUpstream(spec, dialContext, nil))
+		}
+		bootstrap = newDNSResolver(upstreams, nil)
+	}
+
+	var cache *dnsCache
+	if dnsConf.CacheSize > 0 {
+		cache = newDNSCache(dnsConf.CacheSize, clock.Now)
+	}
+
+	newResolver := func(servers []dnsServerSpec) Resolver {
+		var upstreams []dnsUpstream
+		for _, spec := range servers {
+			upstreams = append(upstreams, newDNSUpstream(spec, dialContext, bootstrap))
+		}
+
+		return newDNSResolver(upstreams, cache)
+	}
+
+	if len(dnsServers) > 0 {
+		n.SetResolver(newResolver(dnsServers))
+	} else if conf.UseHostResolver {
+		n.SetResolver(net.DefaultResolver)
+	}
+
+	for _, route := range dnsRoutes {
+		if route.useHostResolver {
+			n.SetDomainResolver(route.domain, net.DefaultResolver)
+		} else {
+			n.SetDomainResolver(route.domain, newResolver(route.servers))
+		}
+	}
+
+	sourceSink.SetEchoReply(!conf.DisableEchoReply)
+	sourceSink.SetMSSClamping(conf.ClampMSS)
+	sourceSink.SetMulticast(conf.EnableMulticast)
+
+	if conf.RateLimit != nil {
+		sourceSink.SetGlobalRateLimit(conf.RateLimit.PacketsPerSecond, conf.RateLimit.BytesPerSecond)
+	}
+
+	if conf.OutboundRateLimit != nil {
+		sourceSink.SetGlobalOutboundRateLimit(conf.OutboundRateLimit.PacketsPerSecond, conf.OutboundRateLimit.BytesPerSecond)
+	}
+
+	if conf.EnableForwarding {
+		if err := sourceSink.SetForwarding(true); err != nil {
+			return nil, fmt.Errorf("failed to enable forwarding: %w", err)
+		}
+	}
+
+	if conf.ForwardToHostNetwork {
+		if !conf.EnableForwarding {
+			return nil, fmt.Errorf("forwarding to the host network requires forwarding to be enabled")
+		}
+
+		if err := sourceSink.EnableHostForwarding(logger); err != nil {
+			return nil, fmt.Errorf("failed to enable host forwarding: %w", err)
+		}
+	}
+
+	if conf.NAT64Prefix != "" {
+		if !conf.ForwardToHostNetwork {
+			return nil, fmt.Errorf("NAT64 requires forwarding to the host network to be enabled")
+		}
+
+		prefix, err := parseNAT64Prefix(conf.NAT64Prefix)
 		if err != nil {
-			return nil, fmt.Errorf("could not parse DNS server address: %w", err)
+			return nil, err
 		}
 
-		dnsServers = append(dnsServers, addr)
+		if err := sourceSink.EnableNAT64(prefix); err != nil {
+			return nil, fmt.Errorf("failed to enable NAT64: %w", err)
+		}
+		n.dns64Prefix = prefix
 	}
 
-	sourceSink, n, err := newSourceSink(conf.Name, publicKey, addrs, defaultGateway, defaultGatewayAddrs, dnsServers)
+	// Packets received on a shared bind are delivered to the transport they're
+	// addressed to, the bind isn't opened until the transport is brought up.
+	bind, err := newBind(logger, conf, privateKey, under, func(packet []byte) bool {
+		return t.IsAddressedTo(packet)
+	})
 	if err != nil {
-		return nil, fmt.Errorf("could not create source sink: %w", err)
+		return nil, err
 	}
 
-	t := transport.NewTransport(sourceSink, conn.NewStdNetBind(), logger)
+	t = transport.NewTransportWithClock(sourceSink, bind, logger, clock)
 
 	t.SetPrivateKey(privateKey)
+	t.SetMTU(mtu)
+
+	if err := t.SetTimers(timers); err != nil {
+		return nil, fmt.Errorf("failed to set timers: %w", err)
+	}
+
+	if err := t.SetHandshakeLimits(configHandshakeLimits(conf)); err != nil {
+		return nil, fmt.Errorf("failed to set handshake limits: %w", err)
+	}
 
 	if err := t.UpdatePort(conf.ListenPort); err != nil {
 		return nil, fmt.Errorf("failed to update port: %w", err)
 	}
 
-	for _, peerConf := range conf.Peers {
-		var peerPublicKey transport.NoisePublicKey
-		if err := peerPublicKey.FromString(peerConf.PublicKey); err != nil {
-			return nil, fmt.Errorf("failed to parse peer public key: %w", err)
+	s = &NoisySocket{
+		noisyNet:               n,
+		logger:                 logger,
+		sourceSink:             sourceSink,
+		transport:              t,
+		defaultGatewayPeerName: conf.DefaultGatewayPeerName,
+		strictInterop:          conf.StrictInterop,
+		peerIdleTimeoutSeconds: conf.PeerIdleTimeoutSeconds,
+		relayBind:              bind.relay,
+		ipam:                   allocator,
+		deriveAddrs:            conf.DeriveIPv6Addresses,
+		conf:                   *conf,
+		peerConfigs:            make(map[transport.NoisePublicKey]v1alpha1.WireGuardPeerConfig),
+		floatingIPs:            floatingIPs,
+		sessionStateFile:       conf.SessionStateFile,
+	}
+	s.unknownPeers = newUnknownPeerResolver(logger, s.AddPeer)
+	s.peerExpiry = newPeerExpiry(clock, s.expirePeer)
+	n.peerConnected = s.peerConnected
+	n.peerHealth = s.peerHealth
+	sourceSink.addressTakenOver = s.addressTakenOver
+
+	t.SetPeerEventHandler(s.handlePeerEvent)
+
+	for _, peerConf := range directPeersFirst(conf.Peers) {
+		if s.peerExpired(&peerConf) {
+			logger.Warn("Skipping expired peer", "peer", peerConf.Name, "expiresAt", peerConf.ExpiresAt)
+			continue
+		}
+
+		if err := s.AddPeer(peerConf); err != nil {
+			return nil, err
+		}
+	}
+
+	// Without any DNS configuration, names are resolved by the default gateway
+	// (as an exit node forwards DNS queries to the host's name servers).
+	if conf.DefaultGatewayPeerName != "" && len(dnsServers) == 0 && !conf.UseHostResolver {
+		gatewayAddrs, _ := n.lookupMeshHost(conf.DefaultGatewayPeerName)
+
+		var gatewayServers []dnsServerSpec
+		for _, addr := range gatewayAddrs {
+			gatewayServers = append(gatewayServers, dnsServerSpec{addr: addr})
+		}
+
+		if len(gatewayServers) > 0 {
+			n.SetResolver(newResolver(gatewayServers))
 		}
+	}
+
+	// Sessions are restored before the transport comes up, so that peers start
+	// with them.
+	if s.sessionStateFile != "" {
+		t.RetainSessions()
+		s.restoreSessions(privateKey)
+	}
+
+	// Rules are applied after the peers have been added so that names can be resolved.
+	if err := sourceSink.SetACL(conf.ACL); err != nil {
+		return nil, fmt.Errorf("failed to set acl: %w", err)
+	}
+
+	if err := t.Up(); err != nil {
+		return nil, fmt.Errorf("failed to bring transport up: %w", err)
+	}
 
-		var peerAddrs []netip.Addr
-		for _, ip := range peerConf.IPs {
-			addr, err := netip.ParseAddr(ip)
+	// Exit nodes relay the DNS queries of their peers to the host's name
+	// servers, so that clients routing all of their traffic through them
+	// don't need any DNS configuration of their own.
+	forwardDNS := conf.ForwardToHostNetwork && !conf.DisableDNSForwarder
+	if conf.EnableDNSServer || forwardDNS {
+		var forwarder *dnsForwarder
+		if forwardDNS {
+			forwarder, err = newDNSForwarder(hostResolvConf)
 			if err != nil {
-				return nil, fmt.Errorf("could not parse peer address %q: %v", ip, err)
+				logger.Warn("DNS forwarder disabled", "error", err)
 			}
-			peerAddrs = append(peerAddrs, addr)
 		}
 
-		sourceSink.AddPeer(peerConf.Name, peerPublicKey, peerAddrs)
+		s.dnsServer, err = newDNSServer(logger, n, forwarder)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start DNS server: %w", err)
+		}
+	}
+
+	if conf.EnableMeasurementServer {
+		s.measurementServer, err = newMeasurementServer(logger, n)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start measurement server: %w", err)
+		}
+	}
+
+	for _, proxyConf := range conf.ReverseProxies {
+		if err := s.startReverseProxy(&proxyConf); err != nil {
+			return nil, fmt.Errorf("failed to start reverse proxy on %s: %w", proxyConf.ListenAddress, err)
+		}
+	}
 
-		peer, err := t.NewPeer(peerPublicKey)
+	// Candidate endpoints are exchanged whenever they could help establish a
+	// direct path. If we are only using a relay, we still need to learn about
+	// the endpoints of our peers.
+	if bind.stun != nil || bind.relay != nil {
+		s.endpointDiscovery, err = newEndpointDiscovery(logger, s, bind.stun, conf.STUNServers)
 		if err != nil {
-			return nil, fmt.Errorf("failed to create peer: %w", err)
+			return nil, fmt.Errorf("failed to start endpoint discovery: %w", err)
 		}
+	}
 
-		if peerConf.Endpoint != "" {
-			peerEndpointHost, peerEndpointPortStr, err := net.SplitHostPort(peerConf.Endpoint)
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse peer endpoint: %w", err)
-			}
+	if introductionsEnabled(conf) {
+		in, err := newIntroductions(logger, s, conf.IntroducePeers)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start introductions: %w", err)
+		}
+		s.introductions.Store(in)
+	}
 
-			peerEndpointAddrs, err := net.LookupHost(peerEndpointHost)
-			if err != nil {
-				return nil, fmt.Errorf("failed to resolve peer address: %w", err)
-			}
+	if conf.LANDiscovery != nil {
+		opts, err := parseLANDiscoveryConfig(conf.LANDiscovery)
+		if err != nil {
+			return nil, fmt.Errorf("invalid lan discovery configuration: %w", err)
+		}
 
-			peerEndpointAddr, err := netip.ParseAddr(peerEndpointAddrs[0])
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse peer address: %w", err)
-			}
+		s.lanDiscovery, err = newLANDiscovery(logger, s, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start lan discovery: %w", err)
+		}
+	}
 
-			peerEndpointPort, err := strconv.Atoi(peerEndpointPortStr)
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse peer port: %w", err)
-			}
+	// There is nothing to discover if the MTU is already the minimum.
+	if conf.PathMTUDiscovery && mtu > minPathMTU {
+		s.pathMTUDiscovery = newPathMTUDiscovery(logger, s)
+	}
 
-			peer.SetEndpointFromPacket(&conn.StdNetEndpoint{
-				AddrPort: netip.AddrPortFrom(peerEndpointAddr, uint16(peerEndpointPort)),
-			})
+	if conf.HealthCheck != nil {
+		opts, err := parseHealthCheckConfig(conf.HealthCheck)
+		if err != nil {
+			return nil, fmt.Errorf("invalid health check configuration: %w", err)
 		}
+
+		s.healthChecker = newHealthChecker(logger, s, opts)
 	}
 
-	if err := t.Up(); err != nil {
-		return nil, fmt.Errorf("failed to bring transport up: %w", err)
+	if conf.Roaming != nil {
+		interval, err := parseRoamingConfig(conf.Roaming)
+		if err != nil {
+			return nil, fmt.Errorf("invalid roaming configuration: %w", err)
+		}
+
+		s.roaming = newRoamingMonitor(logger, s, interval)
+		s.roaming.Start()
 	}
 
-	return &NoisySocket{
-		noisyNet:  n,
-		transport: t,
-	}, nil
+	created = true
+
+	return s, nil
 }
 
 // Close closes the socket.
 func (s *NoisySocket) Close() error {
+	defer s.events.close()
+
+	s.unknownPeers.Close()
+	s.peerExpiry.Close()
+
+	if s.roaming != nil {
+		s.roaming.Close()
+	}
+
+	if s.pathMTUDiscovery != nil {
+		s.pathMTUDiscovery.Close()
+	}
+
+	if s.healthChecker != nil {
+		s.healthChecker.Close()
+	}
+
+	if s.lanDiscovery != nil {
+		_ = s.lanDiscovery.Close()
+	}
+
+	if s.endpointDiscovery != nil {
+		_ = s.endpointDiscovery.Close()
+	}
+
+	if in := s.introductions.Load(); in != nil {
+		_ = in.Close()
+	}
+
+	for _, p := range s.reverseProxies {
+		_ = p.Close()
+	}
+
+	if s.measurementServer != nil {
+		_ = s.measurementServer.Close()
+	}
+
+	if s.dnsServer != nil {
+		if err := s.dnsServer.Close(); err != nil {
+			_ = s.transport.Close()
+			return fmt.Errorf("failed to stop DNS server: %w", err)
+		}
+	}
+
+	if s.sessionStateFile != "" {
+		s.persistSessions()
+	}
+
 	return s.transport.Close()
 }
+
+// AddPeer adds a peer to the socket, it can be called while the socket is running.
+// Peers that have already expired are refused with ErrPeerExpired.
+func (s *NoisySocket) AddPeer(peerConf v1alpha1.WireGuardPeerConfig) error {
+	peerPublicKey, peerAddrs, peerEndpoints, err := parsePeerConfig(&peerConf)
+	if err != nil {
+		return err
+	}
+
+	peerExpiresAt, err := parsePeerExpiry(&peerConf)
+	if err != nil {
+		return err
+	}
+
+	if s.peerExpiry.expired(peerExpiresAt) {
+		return fmt.Errorf("%w %s at %s", ErrPeerExpired, peerConf.PublicKey, peerConf.ExpiresAt)
+	}
+
+	peerAddrs, err = s.assignPeerAddrs(peerPublicKey, &peerConf, peerAddrs)
+	if err != nil {
+		return err
+	}
+
+	peerPresharedKey, err := parsePresharedKey(&peerConf)
+	if err != nil {
+		return err
+	}
+
+	peerSRVRecords, err := parsePeerRecords(&peerConf)
+	if err != nil {
+		return err
+	}
+
+	if err := checkStrictInteropEndpoints(s.strictInterop, peerEndpoints); err != nil {
+		return err
+	}
+
+	if err := checkStrictInteropPeer(s.strictInterop, &peerConf); err != nil {
+		return err
+	}
+
+	if s.isDefaultGateway(&peerConf) {
+		peerAddrs = append(peerAddrs, defaultRoutePrefixes...)
+	}
+
+	via, err := s.resolveVia(&peerConf)
+	if err != nil {
+		return err
+	}
+
+	if err := s.sourceSink.AddPeerVia(peerConf.Name, peerPublicKey, via, peerAddrs); err != nil {
+		return fmt.Errorf("failed to add peer: %w", err)
+	}
+
+	if err := s.reservePeerAddrs(&peerConf, peerAddrs); err != nil {
+		s.sourceSink.RemovePeer(peerPublicKey)
+		return err
+	}
+
+	peer, err := s.transport.NewPeer(peerPublicKey)
+	if err != nil {
+		s.sourceSink.RemovePeer(peerPublicKey)
+		return fmt.Errorf("failed to create peer: %w", err)
+	}
+
+	if err := s.configurePeer(peer, &peerConf, peerPresharedKey); err != nil {
+		s.transport.RemovePeer(peerPublicKey)
+		s.sourceSink.RemovePeer(peerPublicKey)
+		return err
+	}
+
+	// Nothing below can fail, so the peer has now been added.
+	s.events.publish(Event{
+		Timestamp:     time.Now(),
+		Type:          PeerAdded,
+		PeerName:      peerConf.Name,
+		PeerPublicKey: peerPublicKey.String(),
+	})
+
+	if peerConf.RateLimit != nil {
+		s.sourceSink.SetPeerRateLimit(peerPublicKey, peerConf.RateLimit.PacketsPerSecond, peerConf.RateLimit.BytesPerSecond)
+	}
+
+	if peerConf.OutboundRateLimit != nil {
+		s.sourceSink.SetPeerOutboundRateLimit(peerPublicKey, peerConf.OutboundRateLimit.PacketsPerSecond, peerConf.OutboundRateLimit.BytesPerSecond)
+	}
+
+	s.sourceSink.SetPeerMulticast(peerPublicKey, !peerConf.DisableMulticast)
+	s.sourceSink.SetPeerTags(peerPublicKey, peerConf.Tags)
+	s.sourceSink.SetPeerServices(peerPublicKey, peerConf.Services)
+	s.sourceSink.SetPeerRecords(peerPublicKey, peerSRVRecords, peerConf.TXTRecords)
+
+	setPeerEndpoints(peer, peerEndpoints)
+
+	if s.relayBind != nil {
+		peer.SetRelayEndpoint(conn.NewRelayEndpoint(peerPublicKey))
+	}
+
+	// Peers added before the transport is up will be started when it comes up.
+	if s.transport.IsUp() {
+		peer.StartWithKeepalive()
+	}
+
+	s.setPeerConfig(peerPublicKey, &peerConf)
+	s.peerExpiry.set(peerPublicKey, peerExpiresAt)
+	s.failoverFloatingIPs()
+
+	return nil
+}
+
+// configurePeer applies the settings of a newly created peer, that isn't
+// running yet.
+func (s *NoisySocket) configurePeer(peer *transport.Peer, peerConf *v1alpha1.WireGuardPeerConfig, peerPresharedKey transport.NoisePresharedKey) error {
+	peer.SetPresharedKey(peerPresharedKey)
+
+	if err := peer.SetCompression(peerConf.Compression); err != nil {
+		return fmt.Errorf("failed to set compression: %w", err)
+	}
+
+	if err := peer.SetPostQuantum(peerConf.PostQuantum); err != nil {
+		return fmt.Errorf("failed to set post-quantum key exchange: %w", err)
+	}
+	peer.SetPostQuantumRequired(peerConf.RequirePostQuantum)
+
+	if err := peer.SetPersistentKeepaliveInterval(time.Duration(peerConf.PersistentKeepalive) * time.Second); err != nil {
+		return fmt.Errorf("failed to set persistent keepalive: %w", err)
+	}
+
+	if err := peer.SetIdleTimeout(peerIdleTimeout(s.peerIdleTimeoutSeconds, peerConf)); err != nil {
+		return fmt.Errorf("failed to set idle timeout: %w", err)
+	}
+
+	return nil
+}
+
+// RemovePeer removes a peer, identified by its encoded public key, from the socket.
+func (s *NoisySocket) RemovePeer(publicKey string) error {
+	var peerPublicKey transport.NoisePublicKey
+	if err := peerPublicKey.FromString(publicKey); err != nil {
+		return fmt.Errorf("failed to parse peer public key: %w", err)
+	}
+
+	if s.transport.LookupPeer(peerPublicKey) == nil {
+		return fmt.Errorf("%w %s", ErrUnknownPeer, publicKey)
+	}
+
+	name := s.sourceSink.peerName(peerPublicKey)
+
+	s.peerExpiry.clear(peerPublicKey)
+	s.transport.RemovePeer(peerPublicKey)
+	s.sourceSink.RemovePeer(peerPublicKey)
+	s.failoverFloatingIPs()
+
+	s.events.publish(Event{
+		Timestamp:     time.Now(),
+		Type:          PeerRemoved,
+		PeerName:      name,
+		PeerPublicKey: peerPublicKey.String(),
+	})
+
+	if s.ipam != nil {
+		if err := s.ipam.Release(peerPublicKey.String()); err != nil {
+			return fmt.Errorf("failed to release peer address: %w", err)
+		}
+	}
+
+	s.peerConfigsMu.Lock()
+	delete(s.peerConfigs, peerPublicKey)
+	s.peerConfigsMu.Unlock()
+
+	return nil
+}
+
+// UpdatePeer updates the configuration of an existing peer, identified by its
+// public key. The peer's name, addresses, preshared key, rate limits,
+// persistent keepalive, idle timeout, expiry time and tags are replaced, and if endpoints are specified
+// the peer's endpoints are updated. A peer updated with an expiry time that
+// has passed is removed.
+func (s *NoisySocket) UpdatePeer(peerConf v1alpha1.WireGuardPeerConfig) error {
+	peerPublicKey, peerAddrs, peerEndpoints, err := parsePeerConfig(&peerConf)
+	if err != nil {
+		return err
+	}
+
+	peerExpiresAt, err := parsePeerExpiry(&peerConf)
+	if err != nil {
+		return err
+	}
+
+	peerPresharedKey, err := parsePresharedKey(&peerConf)
+	if err != nil {
+		return err
+	}
+
+	peerSRVRecords, err := parsePeerRecords(&peerConf)
+	if err != nil {
+		return err
+	}
+
+	if err := checkStrictInteropEndpoints(s.strictInterop, peerEndpoints); err != nil {
+		return err
+	}
+
+	if err := checkStrictInteropPeer(s.strictInterop, &peerConf); err != nil {
+		return err
+	}
+
+	peer := s.transport.LookupPeer(peerPublicKey)
+	if peer == nil {
+		return fmt.Errorf("%w %s", ErrUnknownPeer, peerConf.PublicKey)
+	}
+
+	peerAddrs, err = s.assignPeerAddrs(peerPublicKey, &peerConf, peerAddrs)
+	if err != nil {
+		return err
+	}
+
+	if s.isDefaultGateway(&peerConf) {
+		peerAddrs = append(peerAddrs, defaultRoutePrefixes...)
+	}
+
+	via, err := s.resolveVia(&peerConf)
+	if err != nil {
+		return err
+	}
+
+	if err := s.sourceSink.UpdatePeerVia(peerConf.Name, peerPublicKey, via, peerAddrs); err != nil {
+		return fmt.Errorf("failed to update peer: %w", err)
+	}
+
+	if err := s.reservePeerAddrs(&peerConf, peerAddrs); err != nil {
+		return err
+	}
+
+	// Takes effect from the next handshake.
+	peer.SetPresharedKey(peerPresharedKey)
+
+	// As does this.
+	if err := peer.SetCompression(peerConf.Compression); err != nil {
+		return fmt.Errorf("failed to set compression: %w", err)
+	}
+
+	if err := peer.SetPostQuantum(peerConf.PostQuantum); err != nil {
+		return fmt.Errorf("failed to set post-quantum key exchange: %w", err)
+	}
+	peer.SetPostQuantumRequired(peerConf.RequirePostQuantum)
+
+	if peerConf.RateLimit != nil {
+		s.sourceSink.SetPeerRateLimit(peerPublicKey, peerConf.RateLimit.PacketsPerSecond, peerConf.RateLimit.BytesPerSecond)
+	} else {
+		s.sourceSink.SetPeerRateLimit(peerPublicKey, 0, 0)
+	}
+
+	if peerConf.OutboundRateLimit != nil {
+		s.sourceSink.SetPeerOutboundRateLimit(peerPublicKey, peerConf.OutboundRateLimit.PacketsPerSecond, peerConf.OutboundRateLimit.BytesPerSecond)
+	} else {
+		s.sourceSink.SetPeerOutboundRateLimit(peerPublicKey, 0, 0)
+	}
+
+	s.sourceSink.SetPeerMulticast(peerPublicKey, !peerConf.DisableMulticast)
+	s.sourceSink.SetPeerTags(peerPublicKey, peerConf.Tags)
+	s.sourceSink.SetPeerServices(peerPublicKey, peerConf.Services)
+	s.sourceSink.SetPeerRecords(peerPublicKey, peerSRVRecords, peerConf.TXTRecords)
+
+	setPeerEndpoints(peer, peerEndpoints)
+
+	if err := peer.SetPersistentKeepaliveInterval(time.Duration(peerConf.PersistentKeepalive) * time.Second); err != nil {
+		return fmt.Errorf("failed to set persistent keepalive: %w", err)
+	}
+
+	if err := peer.SetIdleTimeout(peerIdleTimeout(s.peerIdleTimeoutSeconds, &peerConf)); err != nil {
+		return fmt.Errorf("failed to set idle timeout: %w", err)
+	}
+
+	s.setPeerConfig(peerPublicKey, &peerConf)
+	s.failoverFloatingIPs()
+
+	s.events.publish(Event{
+		Timestamp:     time.Now(),
+		Type:          PeerUpdated,
+		PeerName:      peerConf.Name,
+		PeerPublicKey: peerPublicKey.String(),
+	})
+
+	// If the peer has already expired, this removes it straight away.
+	s.peerExpiry.set(peerPublicKey, peerExpiresAt)
+
+	return nil
+}
+
+// SetPeerEndpoint updates the endpoint of a peer, identified by its name or
+// encoded public key, eg. when it has roamed to a different network. Packets
+// are sent to the new endpoint straight away, although, as usual, the endpoint
+// will be updated again if the peer is heard from elsewhere.
+func (s *NoisySocket) SetPeerEndpoint(peer, endpoint string) error {
+	pk, err := s.lookupPeer(peer)
+	if err != nil {
+		return err
+	}
+
+	peerEndpoint, err := parseEndpoint(endpoint)
+	if err != nil {
+		return err
+	}
+
+	if err := checkStrictInteropEndpoint(s.strictInterop, peerEndpoint); err != nil {
+		return err
+	}
+
+	p := s.transport.LookupPeer(pk)
+	if p == nil {
+		return fmt.Errorf("%w %q", ErrUnknownPeer, peer)
+	}
+
+	p.SetEndpointFromPacket(peerEndpoint)
+
+	s.peerConfigsMu.Lock()
+	if peerConf, ok := s.peerConfigs[pk]; ok {
+		peerConf.Endpoint = endpoint
+		s.peerConfigs[pk] = peerConf
+	}
+	s.peerConfigsMu.Unlock()
+
+	return nil
+}
+
+// lookupPeer returns the public key of a peer, identified by its name or
+// encoded public key.
+func (s *NoisySocket) lookupPeer(peer string) (transport.NoisePublicKey, error) {
+	s.peersMu.RLock()
+	pk, ok := s.peerNames[peer]
+	s.peersMu.RUnlock()
+
+	if !ok {
+		if err := pk.FromString(peer); err != nil {
+			return pk, fmt.Errorf("%w %q", ErrUnknownPeer, peer)
+		}
+	}
+
+	return pk, nil
+}
+
+// peerHealth returns the health of a peer, it is unknown if health checking is
+// disabled.
+func (s *NoisySocket) peerHealth(pk transport.NoisePublicKey) Health {
+	if s.healthChecker == nil {
+		return HealthUnknown
+	}
+
+	health, _ := s.healthChecker.status(pk)
+	return health
+}
+
+// peerConnected reports whether a peer can be reached, that is, whether it has
+// an active session, or an endpoint (or candidate endpoints) that a handshake
+// can be sent to, or an introducer that can introduce us. Peers without any of
+// these can only be reached once they connect.
+func (s *NoisySocket) peerConnected(pk transport.NoisePublicKey) bool {
+	p := s.transport.LookupPeer(pk)
+	if p == nil {
+		return false
+	}
+
+	stats := p.Stats()
+	if stats.SessionActive || stats.Endpoint != "" || len(stats.CandidateEndpoints) > 0 {
+		return true
+	}
+
+	in := s.introductions.Load()
+	return in != nil && in.canIntroduce(pk)
+}
+
+// RotatePrivateKey replaces the socket's private key, it can be called while
+// the socket is running. New handshakes use the new key, while existing
+// sessions are renegotiated when they are next rekeyed. Handshakes from peers
+// still configured with the previous public key are accepted for the grace
+// period, they should be updated with the new public key before it ends.
+// In strict interop mode, existing sessions are expired immediately and the
+// grace period is ignored, as with stock WireGuard implementations.
+func (s *NoisySocket) RotatePrivateKey(privateKey string, gracePeriod time.Duration) error {
+	var sk transport.NoisePrivateKey
+	if err := sk.FromString(privateKey); err != nil {
+		return fmt.Errorf("failed to parse private key: %w", err)
+	}
+
+	s.confMu.Lock()
+	defer s.confMu.Unlock()
+
+	s.rotatePrivateKeyLocked(sk, gracePeriod)
+	s.conf.PrivateKey = privateKey
+
+	return nil
+}
+
+func (s *NoisySocket) rotatePrivateKeyLocked(sk transport.NoisePrivateKey, gracePeriod time.Duration) {
+	if s.relayBind != nil {
+		s.relayBind.SetPrivateKey(sk)
+	}
+
+	if s.conf.StrictInterop {
+		s.transport.SetPrivateKey(sk)
+		return
+	}
+
+	s.transport.RotatePrivateKey(sk, gracePeriod)
+}
+
+// SetRateLimit replaces the limits on the combined rate of inbound and outbound
+// traffic exchanged with all peers, it can be called while the socket is
+// running. A nil limit means unlimited.
+func (s *NoisySocket) SetRateLimit(inbound, outbound *v1alpha1.RateLimitConfig) {
+	s.confMu.Lock()
+	defer s.confMu.Unlock()
+
+	s.setRateLimitLocked(inbound, outbound)
+}
+
+func (s *NoisySocket) setRateLimitLocked(inbound, outbound *v1alpha1.RateLimitConfig) {
+	s.conf.RateLimit = inbound
+	s.conf.OutboundRateLimit = outbound
+
+	if inbound != nil {
+		s.sourceSink.SetGlobalRateLimit(inbound.PacketsPerSecond, inbound.BytesPerSecond)
+	} else {
+		s.sourceSink.SetGlobalRateLimit(0, 0)
+	}
+
+	if outbound != nil {
+		s.sourceSink.SetGlobalOutboundRateLimit(outbound.PacketsPerSecond, outbound.BytesPerSecond)
+	} else {
+		s.sourceSink.SetGlobalOutboundRateLimit(0, 0)
+	}
+}
+
+// SetACL replaces the socket's access control rules, it can be called while
+// the socket is running. Rules may refer to peers by name or public key, peers
+// that don't exist yet will be matched once they are added.
+func (s *NoisySocket) SetACL(rules []v1alpha1.ACLRuleConfig) error {
+	s.confMu.Lock()
+	defer s.confMu.Unlock()
+
+	return s.setACLLocked(rules)
+}
+
+func (s *NoisySocket) setACLLocked(rules []v1alpha1.ACLRuleConfig) error {
+	if err := s.sourceSink.SetACL(rules); err != nil {
+		return err
+	}
+
+	s.conf.ACL = rules
+
+	return nil
+}
+
+// reservePeerAddrs prevents the addresses, assigned to the peer by hand, from
+// being allocated to other peers.
+func (s *NoisySocket) reservePeerAddrs(peerConf *v1alpha1.WireGuardPeerConfig, peerAddrs []netip.Prefix) error {
+	if s.ipam == nil || len(peerConf.IPs) == 0 {
+		return nil
+	}
+
+	for _, prefix := range peerAddrs {
+		if prefix.IsSingleIP() {
+			if err := s.ipam.Reserve(prefix.Addr()); err != nil {
+				return fmt.Errorf("failed to reserve peer address: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// isDefaultGateway reports whether all traffic not destined for another peer should be routed via the peer.
+// newAllocator creates the allocator for the configured address pool. Any
+// addresses assigned by hand are reserved, so that they aren't allocated.
+// configMTU returns the MTU of the socket's interface.
+func configMTU(conf *v1alpha1.Config) (int, error) {
+	if conf.MTU == 0 {
+		return transport.DefaultMTU, nil
+	}
+
+	if conf.MTU < header.IPv4MinimumProcessableDatagramSize || conf.MTU > transport.MaxContentSize {
+		return 0, fmt.Errorf("mtu must be between %d and %d",
+			header.IPv4MinimumProcessableDatagramSize, transport.MaxContentSize)
+	}
+
+	return conf.MTU, nil
+}
+
+// configTimers returns the handshake, and rekey, timers of the socket's
+// transport (they are validated by the transport).
+func configTimers(conf *v1alpha1.Config) (transport.Timers, error) {
+	if conf.Timers == nil {
+		return transport.Timers{}, nil
+	}
+
+	if conf.Timers.HandshakeRetrySeconds < 0 || conf.Timers.RekeyAfterSeconds < 0 || conf.Timers.RejectAfterSeconds < 0 {
+		return transport.Timers{}, fmt.Errorf("timers must not be negative")
+	}
+
+	return transport.Timers{
+		HandshakeRetry: time.Duration(conf.Timers.HandshakeRetrySeconds) * time.Second,
+		RekeyAfter:     time.Duration(conf.Timers.RekeyAfterSeconds) * time.Second,
+		RejectAfter:    time.Duration(conf.Timers.RejectAfterSeconds) * time.Second,
+	}, nil
+}
+
+// configHandshakeLimits returns the handshake flood protection of the socket's
+// transport (it is validated by the transport).
+func configHandshakeLimits(conf *v1alpha1.Config) transport.HandshakeLimits {
+	if conf.HandshakeLimits == nil {
+		return transport.HandshakeLimits{}
+	}
+
+	return transport.HandshakeLimits{
+		AlwaysRequireCookie: conf.HandshakeLimits.AlwaysRequireCookie,
+		UnderLoadThreshold:  conf.HandshakeLimits.UnderLoadThreshold,
+		PerSourceRate:       conf.HandshakeLimits.PerSourceHandshakesPerSecond,
+		PerSourceBurst:      conf.HandshakeLimits.PerSourceBurst,
+		MaxConcurrent:       conf.HandshakeLimits.MaxConcurrentHandshakes,
+	}
+}
+
+// configSourceSinkOptions returns the sizing, and TCP, options of the socket's
+// source sink.
+func configSourceSinkOptions(conf *v1alpha1.Config) (sourceSinkOptions, error) {
+	mtu, err := configMTU(conf)
+	if err != nil {
+		return sourceSinkOptions{}, err
+	}
+
+	addressConflicts, err := parseAddressConflicts(conf.AddressConflicts)
+	if err != nil {
+		return sourceSinkOptions{}, err
+	}
+
+	opts := sourceSinkOptions{mtu: mtu, classifier: newClassifier(conf.QoS), addressConflicts: addressConflicts}
+
+	if conf.Tuning != nil {
+		if conf.Tuning.QueueSize < 0 {
+			return sourceSinkOptions{}, fmt.Errorf("queue size must not be negative")
+		}
+
+		if conf.Tuning.BatchSize < 0 || conf.Tuning.BatchSize > conn.IdealBatchSize {
+			return sourceSinkOptions{}, fmt.Errorf("batch size must be between 1 and %d", conn.IdealBatchSize)
+		}
+
+		if conf.Tuning.Queues < 0 || conf.Tuning.Queues > maxQueues {
+			return sourceSinkOptions{}, fmt.Errorf("queues must be between 1 and %d", maxQueues)
+		}
+
+		opts.queueSize = conf.Tuning.QueueSize
+		opts.queues = conf.Tuning.Queues
+		opts.batchSize = conf.Tuning.BatchSize
+		opts.disableOffload = conf.Tuning.DisableOffload
+	}
+
+	if conf.Stack != nil {
+		for _, size := range []int{conf.Stack.SendBufferSize, conf.Stack.ReceiveBufferSize} {
+			if size != 0 && (size < tcp.MinBufferSize || size > maxStackBufferSize) {
+				return sourceSinkOptions{}, fmt.Errorf("buffer sizes must be between %d and %d", tcp.MinBufferSize, maxStackBufferSize)
+			}
+		}
+
+		switch conf.Stack.CongestionControl {
+		case "", "reno", "cubic":
+		default:
+			return sourceSinkOptions{}, fmt.Errorf("unsupported congestion control algorithm %q", conf.Stack.CongestionControl)
+		}
+
+		if conf.Stack.MaxEndpoints < 0 {
+			return sourceSinkOptions{}, fmt.Errorf("max endpoints must not be negative")
+		}
+
+		if conf.Stack.MaxConnections < 0 || conf.Stack.MaxConnectionsPerPeer < 0 {
+			return sourceSinkOptions{}, fmt.Errorf("max connections must not be negative")
+		}
+
+		opts.stack = stackOptions{
+			sendBufferSize:        conf.Stack.SendBufferSize,
+			receiveBufferSize:     conf.Stack.ReceiveBufferSize,
+			congestionControl:     conf.Stack.CongestionControl,
+			disableSACK:           conf.Stack.DisableSACK,
+			maxEndpoints:          conf.Stack.MaxEndpoints,
+			maxConnections:        conf.Stack.MaxConnections,
+			maxConnectionsPerPeer: conf.Stack.MaxConnectionsPerPeer,
+			memoryLimit:           conf.Stack.MemoryLimit,
+		}
+
+		if conf.Stack.MemoryLimit != 0 && conf.Stack.MemoryLimit < opts.stack.endpointMemory() {
+			return sourceSinkOptions{}, fmt.Errorf("memory limit must fit the buffers of at least one endpoint (%d bytes)",
+				opts.stack.endpointMemory())
+		}
+	}
+
+	return opts, nil
+}
+
+func newAllocator(conf *v1alpha1.Config) (*ipam.Allocator, error) {
+	prefix, err := netip.ParsePrefix(conf.IPAM.Prefix)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse ipam prefix: %w", err)
+	}
+
+	var store ipam.Store
+	if conf.IPAM.StatePath != "" {
+		store = ipam.NewFileStore(conf.IPAM.StatePath)
+	}
+
+	allocator, err := ipam.NewAllocator(prefix, store)
+	if err != nil {
+		return nil, fmt.Errorf("could not create address allocator: %w", err)
+	}
+
+	ips := slices.Clone(conf.IPs)
+	for _, peerConf := range conf.Peers {
+		ips = append(ips, peerConf.IPs...)
+	}
+
+	for _, ip := range ips {
+		if prefix, err := parseAddrOrPrefix(ip); err == nil && prefix.IsSingleIP() {
+			if err := allocator.Reserve(prefix.Addr()); err != nil {
+				return nil, fmt.Errorf("could not reserve address: %w", err)
+			}
+		}
+	}
+
+	return allocator, nil
+}
+
+// assignPeerAddrs allocates an address for the peer, if it doesn't have any
+// IPs and an address pool is configured, and adds its derived address, if
+// enabled.
+func (s *NoisySocket) assignPeerAddrs(publicKey transport.NoisePublicKey, peerConf *v1alpha1.WireGuardPeerConfig, peerAddrs []netip.Prefix) ([]netip.Prefix, error) {
+	if s.ipam != nil {
+		if len(peerConf.IPs) > 0 {
+			// The peer may previously have been allocated an address.
+			if err := s.ipam.Release(publicKey.String()); err != nil {
+				return nil, fmt.Errorf("failed to release peer address: %w", err)
+			}
+		} else {
+			addr, err := s.ipam.Allocate(publicKey.String())
+			if err != nil {
+				return nil, fmt.Errorf("failed to allocate peer address: %w", err)
+			}
+
+			peerAddrs = []netip.Prefix{netip.PrefixFrom(addr, addr.BitLen())}
+		}
+	}
+
+	if s.deriveAddrs && len(peerConf.IPs) == 0 {
+		addr := ipam.DeriveAddr(publicKey.String())
+		peerAddrs = append(peerAddrs, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+
+	return peerAddrs, nil
+}
+
+func (s *NoisySocket) isDefaultGateway(peerConf *v1alpha1.WireGuardPeerConfig) bool {
+	return peerConf.DefaultGateway || (peerConf.Name != "" && peerConf.Name == s.defaultGatewayPeerName)
+}
+
+// socketBind is the bind used to exchange packets with peers, along with the
+// binds for any optional features.
+type socketBind struct {
+	conn.Bind
+	// relay is the bind used to reach peers via the relay, if configured.
+	relay *conn.RelayBind
+	// stun is used to discover public endpoints, if STUN servers are configured.
+	stun *conn.STUNBind
+}
+
+// newBind creates the bind used to exchange packets with peers. Unless in strict
+// interop mode, peers can also be reached over stream oriented transports, and
+// via the relay (if configured). If under is not nil, UDP packets are exchanged
+// over it, and accept selects the packets addressed to this socket.
+func newBind(logger *slog.Logger, conf *v1alpha1.Config, privateKey transport.NoisePrivateKey, under *underlay, accept func(packet []byte) bool) (*socketBind, error) {
+	sockOpts, err := configSocketOptions(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	newUDPBind := func() conn.Bind {
+		return conn.NewDefaultBind(sockOpts)
+	}
+	if under != nil {
+		// STUN responses aren't addressed to any particular transport.
+		if len(conf.STUNServers) > 0 {
+			return nil, fmt.Errorf("endpoint discovery is not supported on a %s", under.name)
+		}
+
+		// The underlay's socket (if any) isn't created by us.
+		if conf.SocketOptions != nil {
+			return nil, fmt.Errorf("socket options are not supported on a %s", under.name)
+		}
+
+		newUDPBind = func() conn.Bind {
+			return under.newBind(accept)
+		}
+	}
+
+	if conf.StrictInterop {
+		if len(conf.Listeners) > 0 {
+			return nil, fmt.Errorf("listeners are not supported in strict interop mode")
+		}
+
+		if conf.RelayURL != "" {
+			return nil, fmt.Errorf("relays are not supported in strict interop mode")
+		}
+
+		if len(conf.STUNServers) > 0 {
+			return nil, fmt.Errorf("endpoint discovery is not supported in strict interop mode")
+		}
+
+		if conf.IntroducePeers {
+			return nil, fmt.Errorf("introductions are not supported in strict interop mode")
+		}
+
+		if conf.Obfuscation != nil {
+			return nil, fmt.Errorf("obfuscation is not supported in strict interop mode")
+		}
+
+		return &socketBind{Bind: newUDPBind()}, nil
+	}
+
+	var bind socketBind
+
+	udpBind := newUDPBind()
+	if len(conf.STUNServers) > 0 {
+		bind.stun = conn.NewSTUNBind(udpBind)
+		udpBind = bind.stun
+	}
+
+	var streamListeners, quicListeners []string
+	for _, listener := range conf.Listeners {
+		if strings.HasPrefix(listener, "quic://") {
+			quicListeners = append(quicListeners, listener)
+		} else {
+			streamListeners = append(streamListeners, listener)
+		}
+	}
+
+	streamBind, err := conn.NewStreamBind(logger, streamListeners)
+	if err != nil {
+		return nil, fmt.Errorf("could not create stream bind: %w", err)
+	}
+
+	quicBind, err := conn.NewQUICBind(logger, quicListeners)
+	if err != nil {
+		return nil, fmt.Errorf("could not create quic bind: %w", err)
+	}
+
+	if conf.RelayURL != "" {
+		bind.relay, err = conn.NewRelayBind(logger, conf.RelayURL, privateKey)
+		if err != nil {
+			return nil, fmt.Errorf("could not create relay bind: %w", err)
+		}
+	}
+
+	bind.Bind = conn.NewMuxBind(udpBind, streamBind, quicBind, bind.relay)
+
+	// Disguises the packets sent over every transport.
+	if conf.Obfuscation != nil {
+		opts := conn.ObfuscationOptions{
+			JunkPackets:       conf.Obfuscation.JunkPackets,
+			JunkPacketMinSize: conf.Obfuscation.JunkPacketMinSize,
+			JunkPacketMaxSize: conf.Obfuscation.JunkPacketMaxSize,
+			InitiationPadding: conf.Obfuscation.InitiationPadding,
+			ResponsePadding:   conf.Obfuscation.ResponsePadding,
+			InitiationMagic:   conf.Obfuscation.InitiationMagic,
+			ResponseMagic:     conf.Obfuscation.ResponseMagic,
+			CookieReplyMagic:  conf.Obfuscation.CookieReplyMagic,
+			TransportMagic:    conf.Obfuscation.TransportMagic,
+		}
+		if err := opts.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid obfuscation: %w", err)
+		}
+
+		bind.Bind = conn.NewObfuscatedBind(bind.Bind, opts)
+	}
+
+	return &bind, nil
+}
+
+// configSocketOptions returns the options of the socket's UDP sockets.
+func configSocketOptions(conf *v1alpha1.Config) (conn.SocketOptions, error) {
+	var opts conn.SocketOptions
+
+	// Datagrams are sent, and received, in batches the size of the source
+	// sink's (validated by configSourceSinkOptions).
+	if conf.Tuning != nil {
+		opts.BatchSize = conf.Tuning.BatchSize
+	}
+
+	if conf.SocketOptions == nil {
+		return opts, nil
+	}
+
+	if conf.SocketOptions.DSCP < 0 || conf.SocketOptions.DSCP > 63 {
+		return conn.SocketOptions{}, fmt.Errorf("dscp must be between 0 and 63")
+	}
+
+	opts.BindToDevice = conf.SocketOptions.BindToDevice
+	opts.Mark = conf.SocketOptions.FirewallMark
+	opts.DSCP = conf.SocketOptions.DSCP
+
+	return opts, nil
+}
+
+// checkStrictInteropEndpoint returns an error if the endpoint can't be reached
+// by a stock WireGuard implementation.
+func checkStrictInteropEndpoint(strictInterop bool, endpoint conn.Endpoint) error {
+	switch endpoint.(type) {
+	case *conn.StreamEndpoint, *conn.QUICEndpoint:
+		if strictInterop {
+			return fmt.Errorf("endpoint %s is not supported in strict interop mode", endpoint.DstToString())
+		}
+	}
+
+	return nil
+}
+
+// checkStrictInteropPeer returns an error if compression, post-quantum key
+// exchange, or introductions, are enabled for a peer, as stock WireGuard
+// implementations don't support them.
+func checkStrictInteropPeer(strictInterop bool, peerConf *v1alpha1.WireGuardPeerConfig) error {
+	if strictInterop && peerConf.Compression != "" && peerConf.Compression != "none" {
+		return fmt.Errorf("compression is not supported in strict interop mode")
+	}
+
+	if strictInterop && peerConf.PostQuantum {
+		return fmt.Errorf("post-quantum key exchange is not supported in strict interop mode")
+	}
+
+	if strictInterop && peerConf.Introducer {
+		return fmt.Errorf("introductions are not supported in strict interop mode")
+	}
+
+	return nil
+}
+
+func checkStrictInteropEndpoints(strictInterop bool, endpoints []conn.Endpoint) error {
+	for _, endpoint := range endpoints {
+		if err := checkStrictInteropEndpoint(strictInterop, endpoint); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// peerIdleTimeout returns how long a session with the peer may be idle, before it
+// is torn down (or zero if sessions never expire).
+func peerIdleTimeout(defaultSeconds int, peerConf *v1alpha1.WireGuardPeerConfig) time.Duration {
+	if peerConf.IdleTimeoutSeconds != 0 {
+		return time.Duration(peerConf.IdleTimeoutSeconds) * time.Second
+	}
+
+	return time.Duration(defaultSeconds) * time.Second
+}
+
+// parsePeerConfig parses a peer's public key, addresses, and endpoints. The
+// first endpoint (if any) is the one packets are initially sent to.
+func parsePeerConfig(peerConf *v1alpha1.WireGuardPeerConfig) (transport.NoisePublicKey, []netip.Prefix, []conn.Endpoint, error) {
+	var peerPublicKey transport.NoisePublicKey
+	if err := peerPublicKey.FromString(peerConf.PublicKey); err != nil {
+		return peerPublicKey, nil, nil, fmt.Errorf("failed to parse peer public key: %w", err)
+	}
+
+	var peerAddrs []netip.Prefix
+	for _, ip := range peerConf.IPs {
+		prefix, err := parseAddrOrPrefix(ip)
+		if err != nil {
+			return peerPublicKey, nil, nil, fmt.Errorf("could not parse peer address %q: %v", ip, err)
+		}
+		peerAddrs = append(peerAddrs, prefix)
+	}
+
+	var peerEndpoints []conn.Endpoint
+	for _, endpoint := range append([]string{peerConf.Endpoint}, peerConf.Endpoints...) {
+		if endpoint == "" {
+			continue
+		}
+
+		peerEndpoint, err := parseEndpoint(endpoint)
+		if err != nil {
+			return peerPublicKey, nil, nil, err
+		}
+		peerEndpoints = append(peerEndpoints, peerEndpoint)
+	}
+
+	if peerConf.Via != "" && len(peerEndpoints) > 0 {
+		return peerPublicKey, nil, nil, fmt.Errorf("peer %s is reached via %s, so can't have an endpoint", peerConf.PublicKey, peerConf.Via)
+	}
+
+	if _, err := transport.ParseCompression(peerConf.Compression); err != nil {
+		return peerPublicKey, nil, nil, err
+	}
+
+	if err := transport.CheckPostQuantum(peerConf.PostQuantum); err != nil {
+		return peerPublicKey, nil, nil, err
+	}
+
+	if peerConf.RequirePostQuantum && !peerConf.PostQuantum {
+		return peerPublicKey, nil, nil, fmt.Errorf("peer %s requires post-quantum key exchange, but it isn't enabled", peerConf.PublicKey)
+	}
+
+	if peerConf.IdleTimeoutSeconds < 0 {
+		return peerPublicKey, nil, nil, fmt.Errorf("peer %s idle timeout must not be negative", peerConf.PublicKey)
+	}
+
+	if _, err := parsePeerExpiry(peerConf); err != nil {
+		return peerPublicKey, nil, nil, err
+	}
+
+	if _, err := parsePeerRecords(peerConf); err != nil {
+		return peerPublicKey, nil, nil, err
+	}
+
+	return peerPublicKey, peerAddrs, peerEndpoints, nil
+}
+
+// setPeerEndpoints sends packets to the first of a peer's configured
+// endpoints, and handshake initiations to all of them.
+func setPeerEndpoints(peer *transport.Peer, peerEndpoints []conn.Endpoint) {
+	if len(peerEndpoints) > 0 {
+		peer.SetEndpointFromPacket(peerEndpoints[0])
+	}
+
+	peer.SetConfiguredEndpoints(peerEndpoints)
+}
+
+// parseEndpoint parses a peer endpoint, eg. "host:port" or "tcp://host:port".
+func parseEndpoint(endpoint string) (conn.Endpoint, error) {
+	if scheme, addr, ok := strings.Cut(endpoint, "://"); ok {
+		switch scheme {
+		case "udp":
+			endpoint = addr
+		case "quic":
+			quicEndpoint, err := conn.ParseQUICEndpoint(endpoint)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse peer endpoint: %w", err)
+			}
+
+			return quicEndpoint, nil
+		default:
+			streamEndpoint, err := conn.ParseStreamEndpoint(endpoint)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse peer endpoint: %w", err)
+			}
+
+			return streamEndpoint, nil
+		}
+	}
+
+	peerEndpointHost, peerEndpointPortStr, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse peer endpoint: %w", err)
+	}
+
+	peerEndpointAddrs, err := net.LookupHost(peerEndpointHost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve peer address: %w", err)
+	}
+
+	peerEndpointAddr, err := netip.ParseAddr(peerEndpointAddrs[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse peer address: %w", err)
+	}
+
+	peerEndpointPort, err := strconv.Atoi(peerEndpointPortStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse peer port: %w", err)
+	}
+
+	return &conn.StdNetEndpoint{
+		AddrPort: netip.AddrPortFrom(peerEndpointAddr, uint16(peerEndpointPort)),
+	}, nil
+}
+
+// parsePresharedKey parses the peer's optional preshared key, a zero key means none.
+func parsePresharedKey(peerConf *v1alpha1.WireGuardPeerConfig) (transport.NoisePresharedKey, error) {
+	var psk transport.NoisePresharedKey
+	if peerConf.PresharedKey == "" {
+		return psk, nil
+	}
+
+	if err := psk.FromString(peerConf.PresharedKey); err != nil {
+		return psk, fmt.Errorf("failed to parse peer preshared key: %w", err)
+	}
+
+	return psk, nil
+}
+
+// parseAddrOrPrefix parses either a CIDR prefix (e.g. 10.8.0.0/24) or a single
+// IP address, which is treated as a prefix covering only that address.
+func parseAddrOrPrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		return netip.ParsePrefix(s)
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// discardHandler is a log handler that discards all records.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
@@ -8,14 +8,22 @@ package noisysockets_test
 
 import (
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"html/template"
 	"io"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
@@ -25,8 +33,11 @@ import (
 	"github.com/noisysockets/noisysockets/config"
 	"github.com/noisysockets/noisysockets/config/v1alpha1"
 	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/noisysockets/noisysockets/ipam"
+	"github.com/noisysockets/noisysockets/relay"
 	"github.com/stretchr/testify/require"
 	"github.com/testcontainers/testcontainers-go"
+	tcexec "github.com/testcontainers/testcontainers-go/exec"
 	"github.com/testcontainers/testcontainers-go/network"
 	"github.com/testcontainers/testcontainers-go/wait"
 	"golang.org/x/sync/errgroup"
@@ -154,141 +165,3027 @@ func TestNoisySocket(t *testing.T) {
 	time.Sleep(time.Second)
 }
 
-func TestNoisySocket_GatewayAndDNS(t *testing.T) {
-	pwd, err := os.Getwd()
+func TestNoisySocket_UDP(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
 	require.NoError(t, err)
 
-	ctx := context.Background()
-	net, err := network.New(ctx, network.WithCheckDuplicate())
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "server",
+		ListenPort: 12347,
+		PrivateKey: serverPrivateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				PublicKey: clientPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.2"},
+			},
+		},
+	})
 	require.NoError(t, err)
 	t.Cleanup(func() {
-		require.NoError(t, net.Remove(ctx))
+		require.NoError(t, serverSocket.Close())
 	})
 
-	// Spin up a dnsmasq that forwards DNS queries to the host.
-	dnsmasqReq := testcontainers.ContainerRequest{
-		Image:        "andyshinn/dnsmasq:2.83",
-		ExposedPorts: []string{"53/tcp", "53/udp"},
-		Networks:     []string{net.Name},
-		WaitingFor:   wait.ForListeningPort("53/tcp"),
+	pc, err := serverSocket.ListenPacket("udp", ":53")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = pc.Close()
+	})
+
+	// Echo back any received datagrams.
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			if _, err := pc.WriteTo(buf[:n], addr); err != nil {
+				logger.Error("Failed to write", "error", err)
+				return
+			}
+		}
+	}()
+
+	clientSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "client",
+		ListenPort: 12348,
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "server",
+				PublicKey: serverPrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12347",
+				IPs:       []string{"10.7.0.1"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, clientSocket.Close())
+	})
+
+	conn, err := clientSocket.Dial("udp", "server:53")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	// The first datagrams may be dropped while the handshake completes, so retry.
+	buf := make([]byte, 1500)
+	var n int
+	for i := 0; i < 10; i++ {
+		_, err = conn.Write([]byte("Hello, world!"))
+		require.NoError(t, err)
+
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(500*time.Millisecond)))
+
+		n, err = conn.Read(buf)
+		if err == nil {
+			break
+		}
 	}
+	require.NoError(t, err)
 
-	dnsmasqC, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
-		ContainerRequest: dnsmasqReq,
-		Started:          true,
+	require.Equal(t, "Hello, world!", string(buf[:n]))
+}
+
+func TestNoisySocket_AddRemovePeer(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	// The server starts without knowing about the client.
+	serverSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "server",
+		ListenPort: 12349,
+		PrivateKey: serverPrivateKey.String(),
+		IPs:        []string{"10.7.0.1"},
 	})
 	require.NoError(t, err)
 	t.Cleanup(func() {
-		require.NoError(t, dnsmasqC.Terminate(ctx))
+		require.NoError(t, serverSocket.Close())
 	})
 
-	// Spin up an nginx server.
-	nginxReq := testcontainers.ContainerRequest{
-		Image:        "nginx:latest",
-		ExposedPorts: []string{"80/tcp"},
-		Networks:     []string{net.Name},
-		NetworkAliases: map[string][]string{
-			net.Name: {"web"},
-		},
-		WaitingFor: wait.ForListeningPort("80/tcp"),
+	lis, err := serverSocket.Listen("tcp", ":80")
+	require.NoError(t, err)
+
+	var mux http.ServeMux
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "Hello, world!")
+	})
+
+	srv := &http.Server{
+		Handler: &mux,
 	}
+	t.Cleanup(func() {
+		_ = srv.Close()
+	})
 
-	nginxC, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
-		ContainerRequest: nginxReq,
-		Started:          true,
+	go func() {
+		if err := srv.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Failed to serve", "error", err)
+		}
+	}()
+
+	clientSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "client",
+		ListenPort: 12350,
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.2"},
 	})
 	require.NoError(t, err)
 	t.Cleanup(func() {
-		require.NoError(t, nginxC.Terminate(ctx))
+		require.NoError(t, clientSocket.Close())
 	})
 
-	// Spin up a WireGuard gateway.
-	wgReq := testcontainers.ContainerRequest{
-		Image:        "masipcat/wireguard-go:latest",
-		ExposedPorts: []string{"51820/udp"},
-		Files: []testcontainers.ContainerFile{
-			{HostFilePath: filepath.Join(pwd, "testdata/wg0.conf"), ContainerFilePath: "/etc/wireguard/wg0.conf", FileMode: 0o400},
-		},
-		Networks: []string{net.Name},
-		HostConfigModifier: func(hostConfig *container.HostConfig) {
-			hostConfig.CapAdd = []string{"NET_ADMIN"}
+	require.NoError(t, serverSocket.AddPeer(v1alpha1.WireGuardPeerConfig{
+		PublicKey: clientPrivateKey.PublicKey().String(),
+		IPs:       []string{"10.7.0.2"},
+	}))
 
-			hostConfig.Sysctls = map[string]string{
-				"net.ipv4.ip_forward":              "1",
-				"net.ipv4.conf.all.src_valid_mark": "1",
-			}
+	require.NoError(t, clientSocket.AddPeer(v1alpha1.WireGuardPeerConfig{
+		Name:      "server",
+		PublicKey: serverPrivateKey.PublicKey().String(),
+		Endpoint:  "localhost:12349",
+		IPs:       []string{"10.7.0.1"},
+	}))
 
-			hostConfig.Binds = append(hostConfig.Binds, "/dev/net/tun:/dev/net/tun")
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial:              clientSocket.Dial,
+			DisableKeepAlives: true,
 		},
+		Timeout: 5 * time.Second,
 	}
 
-	wgC, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
-		ContainerRequest: wgReq,
-		Started:          true,
+	resp, err := client.Get("http://server")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	// Rename the server.
+	require.NoError(t, clientSocket.UpdatePeer(v1alpha1.WireGuardPeerConfig{
+		Name:      "web",
+		PublicKey: serverPrivateKey.PublicKey().String(),
+		IPs:       []string{"10.7.0.1"},
+	}))
+
+	_, err = clientSocket.LookupHost("server")
+	require.Error(t, err)
+
+	resp, err = client.Get("http://web")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	require.NoError(t, serverSocket.RemovePeer(clientPrivateKey.PublicKey().String()))
+
+	// The server should no longer respond to the client.
+	client.Timeout = time.Second
+	_, err = client.Get("http://web")
+	require.Error(t, err)
+
+	require.Error(t, serverSocket.RemovePeer(clientPrivateKey.PublicKey().String()))
+}
+
+func TestNoisySocket_PersistentKeepalive(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "server",
+		ListenPort: 12366,
+		PrivateKey: serverPrivateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "client",
+				PublicKey: clientPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.2"},
+			},
+		},
 	})
 	require.NoError(t, err)
 	t.Cleanup(func() {
-		require.NoError(t, wgC.Terminate(ctx))
+		require.NoError(t, serverSocket.Close())
 	})
 
-	outputDir := t.TempDir()
-	configPath := filepath.Join(outputDir, "noisysockets.yaml")
+	clientSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "client",
+		ListenPort: 12367,
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "server",
+				PublicKey: serverPrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12366",
+				IPs:       []string{"10.7.0.1"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, clientSocket.Close())
+	})
 
-	require.NoError(t, generateConfig(ctx, configPath, wgC, dnsmasqC))
+	// Without any traffic, or keepalives, no handshake should take place.
+	time.Sleep(500 * time.Millisecond)
+	require.Zero(t, gatherMetrics(t, clientSocket.Collector())["noisysockets_peer_handshakes_completed_total{peer=server}"])
+
+	// Enable persistent keepalives at runtime.
+	require.NoError(t, clientSocket.UpdatePeer(v1alpha1.WireGuardPeerConfig{
+		Name:                "server",
+		PublicKey:           serverPrivateKey.PublicKey().String(),
+		IPs:                 []string{"10.7.0.1"},
+		PersistentKeepalive: 1,
+	}))
+
+	require.Eventually(t, func() bool {
+		return gatherMetrics(t, clientSocket.Collector())["noisysockets_peer_handshakes_completed_total{peer=server}"] > 0
+	}, 5*time.Second, 100*time.Millisecond)
+
+	// The server should keep on receiving keepalives from the client.
+	rxBytes := gatherMetrics(t, serverSocket.Collector())["noisysockets_peer_rx_bytes_total{peer=client}"]
+	require.Eventually(t, func() bool {
+		return gatherMetrics(t, serverSocket.Collector())["noisysockets_peer_rx_bytes_total{peer=client}"] > rxBytes
+	}, 5*time.Second, 100*time.Millisecond)
+}
 
+func TestNoisySocket_PeerEndpointRoaming(t *testing.T) {
 	logger := slogt.New(t)
 
-	conf, err := config.FromYAML(configPath)
+	serverPrivateKey, err := transport.NewPrivateKey()
 	require.NoError(t, err)
 
-	socket, err := noisysockets.NewNoisySocket(logger, conf)
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "server",
+		ListenPort: 12384,
+		PrivateKey: serverPrivateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "client",
+				PublicKey: clientPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.2"},
+			},
+		},
+	})
 	require.NoError(t, err)
 	t.Cleanup(func() {
-		require.NoError(t, socket.Close())
+		require.NoError(t, serverSocket.Close())
 	})
 
-	httpClient := &http.Client{
-		Transport: &http.Transport{
-			Dial: socket.Dial,
+	// The server's endpoint is wrong, eg. it has moved since the config was written.
+	clientSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "client",
+		ListenPort: 12385,
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:                "server",
+				PublicKey:           serverPrivateKey.PublicKey().String(),
+				Endpoint:            "localhost:12386",
+				IPs:                 []string{"10.7.0.1"},
+				PersistentKeepalive: 1,
+			},
 		},
-	}
-
-	resp, err := httpClient.Get("http://web")
+	})
 	require.NoError(t, err)
 	t.Cleanup(func() {
-		require.NoError(t, resp.Body.Close())
+		require.NoError(t, clientSocket.Close())
 	})
 
-	require.Equal(t, http.StatusOK, resp.StatusCode)
+	time.Sleep(500 * time.Millisecond)
+
+	status, err := clientSocket.PeerStatus("server")
+	require.NoError(t, err)
+	require.True(t, status.LastHandshake.IsZero())
+	require.Equal(t, "127.0.0.1:12386", status.Endpoint)
+	require.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.7.0.1/32")}, status.AllowedIPs)
+	require.Equal(t, time.Second, status.PersistentKeepalive)
+
+	require.Error(t, clientSocket.SetPeerEndpoint("unknown", "localhost:12384"))
+	require.Error(t, clientSocket.SetPeerEndpoint("server", "localhost"))
+
+	require.NoError(t, clientSocket.SetPeerEndpoint("server", "localhost:12384"))
+	require.Equal(t, "localhost:12384", clientSocket.Config().Peers[0].Endpoint)
+
+	require.Eventually(t, func() bool {
+		status, err := clientSocket.PeerStatus(serverPrivateKey.PublicKey().String())
+		require.NoError(t, err)
+		return !status.LastHandshake.IsZero()
+	}, 10*time.Second, 100*time.Millisecond)
+
+	statuses := serverSocket.PeerStatuses()
+	require.Len(t, statuses, 1)
+	require.Equal(t, "client", statuses[0].Name)
+	require.Equal(t, clientPrivateKey.PublicKey().String(), statuses[0].PublicKey)
+	require.Equal(t, "127.0.0.1:12385", statuses[0].Endpoint)
+	require.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.7.0.2/32")}, statuses[0].AllowedIPs)
+	require.Zero(t, statuses[0].PersistentKeepalive)
+	require.False(t, statuses[0].LastHandshake.IsZero())
+
+	require.Eventually(t, func() bool {
+		status, err := clientSocket.PeerStatus("server")
+		require.NoError(t, err)
+		return status.RxBytes > 0 && status.TxBytes > 0
+	}, 5*time.Second, 100*time.Millisecond)
 }
 
-func generateConfig(ctx context.Context, configPath string, wgC, dnsmasqC testcontainers.Container) error {
-	wgHost, err := wgC.Host(ctx)
-	if err != nil {
-		return err
-	}
+func TestNoisySocket_UnknownPeerFunc(t *testing.T) {
+	logger := slogt.New(t)
 
-	wgPort, err := wgC.MappedPort(ctx, "51820/udp")
-	if err != nil {
-		return err
-	}
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
 
-	dnsServer, err := dnsmasqC.ContainerIP(ctx)
-	if err != nil {
-		return err
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "server",
+		ListenPort: 12387,
+		PrivateKey: serverPrivateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "client",
+				PublicKey: clientPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.2"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+	})
+
+	lis, err := serverSocket.Listen("tcp", ":80")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = lis.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte("hello"))
+			_ = conn.Close()
+		}
+	}()
+
+	// The client doesn't know about any peers to begin with.
+	clientSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "client",
+		ListenPort: 12388,
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.2"},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, clientSocket.Close())
+	})
+
+	var lookupsMu sync.Mutex
+	var lookups []netip.Addr
+	clientSocket.SetUnknownPeerFunc(func(ctx context.Context, addr netip.Addr) (*v1alpha1.WireGuardPeerConfig, error) {
+		lookupsMu.Lock()
+		lookups = append(lookups, addr)
+		lookupsMu.Unlock()
+
+		if addr != netip.MustParseAddr("10.7.0.1") {
+			return nil, nil
+		}
+
+		return &v1alpha1.WireGuardPeerConfig{
+			Name:      "server",
+			PublicKey: serverPrivateKey.PublicKey().String(),
+			Endpoint:  "localhost:12387",
+			IPs:       []string{"10.7.0.1"},
+		}, nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+
+	conn, err := clientSocket.DialContext(ctx, "tcp", "10.7.0.1:80")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	buf, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+
+	_, err = clientSocket.PeerStatus("server")
+	require.NoError(t, err)
+
+	// Addresses that don't belong to a peer are only looked up once.
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+		_, err = clientSocket.DialContext(ctx, "tcp", "10.7.0.3:80")
+		cancel()
+		require.Error(t, err)
 	}
 
-	var renderedConfig strings.Builder
-	tmpl := template.Must(template.ParseFiles("testdata/noisysockets.yaml.tmpl"))
-	if err := tmpl.Execute(&renderedConfig, struct {
-		Endpoint  string
-		DNSServer string
-	}{
-		Endpoint:  wgHost + ":" + wgPort.Port(),
-		DNSServer: dnsServer,
-	}); err != nil {
-		return err
+	lookupsMu.Lock()
+	defer lookupsMu.Unlock()
+
+	require.Equal(t, []netip.Addr{netip.MustParseAddr("10.7.0.1"), netip.MustParseAddr("10.7.0.3")}, lookups)
+}
+
+func TestNoisySocket_IPAM(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	statePath := filepath.Join(t.TempDir(), "ipam.json")
+
+	// Neither socket has any addresses assigned by hand.
+	serverSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "server",
+		ListenPort: 12389,
+		PrivateKey: serverPrivateKey.String(),
+		IPAM:       &v1alpha1.IPAMConfig{Prefix: "10.7.0.0/16"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "client",
+				PublicKey: clientPrivateKey.PublicKey().String(),
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+	})
+
+	clientConf := &v1alpha1.Config{
+		Name:       "client",
+		ListenPort: 12390,
+		PrivateKey: clientPrivateKey.String(),
+		IPAM: &v1alpha1.IPAMConfig{
+			Prefix:    "10.7.0.0/16",
+			StatePath: statePath,
+		},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "server",
+				PublicKey: serverPrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12389",
+			},
+		},
 	}
 
-	return os.WriteFile(configPath, []byte(renderedConfig.String()), 0o400)
+	clientSocket, err := noisysockets.NewNoisySocket(logger, clientConf)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, clientSocket.Close())
+	})
+
+	lis, err := serverSocket.Listen("tcp", ":80")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = lis.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte(conn.RemoteAddr().String()))
+			_ = conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+
+	conn, err := clientSocket.DialContext(ctx, "tcp", "server:80")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	// Both sockets agree on the client's address.
+	remoteAddr, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, conn.LocalAddr().String(), string(remoteAddr))
+	require.True(t, netip.MustParsePrefix("10.7.0.0/16").Contains(netip.MustParseAddrPort(string(remoteAddr)).Addr()))
+
+	// The allocation of the server's address is persisted.
+	buf, err := os.ReadFile(statePath)
+	require.NoError(t, err)
+	require.Contains(t, string(buf), serverPrivateKey.PublicKey().String())
+
+	// Reloading doesn't change anything, as allocated addresses aren't part of the config.
+	require.NoError(t, clientSocket.Reload(clientConf))
+	require.Empty(t, clientSocket.Config().Peers[0].IPs)
+}
+
+func TestNoisySocket_DerivedIPv6Addresses(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	// Neither socket has any addresses configured.
+	serverSocket, clientSocket, err := noisysockets.Pipe(logger, &v1alpha1.Config{
+		Name:                "server",
+		PrivateKey:          serverPrivateKey.String(),
+		DeriveIPv6Addresses: true,
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "client",
+				PublicKey: clientPrivateKey.PublicKey().String(),
+			},
+		},
+	}, &v1alpha1.Config{
+		Name:                "client",
+		PrivateKey:          clientPrivateKey.String(),
+		DeriveIPv6Addresses: true,
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "server",
+				PublicKey: serverPrivateKey.PublicKey().String(),
+			},
+		},
+	}, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+		require.NoError(t, clientSocket.Close())
+	})
+
+	serverAddr := ipam.DeriveAddr(serverPrivateKey.PublicKey().String())
+	clientAddr := ipam.DeriveAddr(clientPrivateKey.PublicKey().String())
+
+	addrs, err := clientSocket.LookupHost("server")
+	require.NoError(t, err)
+	require.Equal(t, []string{serverAddr.String()}, addrs)
+
+	lis, err := serverSocket.Listen("tcp", ":80")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = lis.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte(conn.RemoteAddr().String()))
+			_ = conn.Close()
+		}
+	}()
+
+	conn, err := clientSocket.Dial("tcp", "server:80")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	// Both sockets agree on the client's address.
+	remoteAddr, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, clientAddr, netip.MustParseAddrPort(string(remoteAddr)).Addr())
+}
+
+func TestNoisySocket_IPv4Mapped(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverSocket, clientSocket, err := noisysockets.Pipe(logger, &v1alpha1.Config{
+		Name:       "server",
+		PrivateKey: serverPrivateKey.String(),
+		IPs:        []string{"100.64.0.1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "client",
+				PublicKey: clientPrivateKey.PublicKey().String(),
+				IPs:       []string{"100.64.0.2"},
+			},
+		},
+	}, &v1alpha1.Config{
+		Name:       "client",
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"100.64.0.2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "server",
+				PublicKey: serverPrivateKey.PublicKey().String(),
+				IPs:       []string{"100.64.0.1"},
+			},
+		},
+	}, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+		require.NoError(t, clientSocket.Close())
+	})
+
+	addrs, err := clientSocket.LookupHost("::ffff:100.64.0.1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"100.64.0.1"}, addrs)
+
+	t.Run("TCP", func(t *testing.T) {
+		// The IPv4-mapped wildcard.
+		lis, err := serverSocket.Listen("tcp", "[::ffff:0.0.0.0]:80")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = lis.Close()
+		})
+
+		go func() {
+			for {
+				conn, err := lis.Accept()
+				if err != nil {
+					return
+				}
+				_, _ = conn.Write([]byte(conn.(noisysockets.PeerConn).PeerName()))
+				_ = conn.Close()
+			}
+		}()
+
+		conn, err := clientSocket.Dial("tcp", "[::ffff:100.64.0.1]:80")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+
+		require.Equal(t, "server", conn.(noisysockets.PeerConn).PeerName())
+
+		peerName, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		require.Equal(t, "client", string(peerName))
+	})
+
+	t.Run("UDP", func(t *testing.T) {
+		serverConn, err := serverSocket.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("::ffff:100.64.0.1"), Port: 53})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, serverConn.Close())
+		})
+
+		clientConn, err := clientSocket.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("::ffff:100.64.0.1"), Port: 53})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, clientConn.Close())
+		})
+
+		_, err = clientConn.Write([]byte("Hello"))
+		require.NoError(t, err)
+
+		require.NoError(t, serverConn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+		buf := make([]byte, 64)
+		n, addr, err := serverConn.ReadFrom(buf)
+		require.NoError(t, err)
+		require.Equal(t, "Hello", string(buf[:n]))
+		require.Equal(t, "100.64.0.2", addr.(*net.UDPAddr).IP.String())
+	})
+}
+
+func TestNoisySocket_PathMTUDiscovery(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "server",
+		ListenPort: 12391,
+		PrivateKey: serverPrivateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "client",
+				PublicKey: clientPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.2"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+	})
+
+	// Simulate a path with a smaller MTU, by dropping large datagrams.
+	const maxDatagramSize = 1344
+
+	proxyConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12393})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = proxyConn.Close()
+	})
+
+	go func() {
+		serverAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12391}
+		var clientAddr *net.UDPAddr
+
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := proxyConn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+
+			if n > maxDatagramSize {
+				continue
+			}
+
+			if addr.Port == serverAddr.Port {
+				if clientAddr != nil {
+					_, _ = proxyConn.WriteToUDP(buf[:n], clientAddr)
+				}
+			} else {
+				clientAddr = addr
+				_, _ = proxyConn.WriteToUDP(buf[:n], serverAddr)
+			}
+		}
+	}()
+
+	clientSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:             "client",
+		ListenPort:       12392,
+		PrivateKey:       clientPrivateKey.String(),
+		IPs:              []string{"10.7.0.2"},
+		PathMTUDiscovery: true,
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:                "server",
+				PublicKey:           serverPrivateKey.PublicKey().String(),
+				Endpoint:            "localhost:12393",
+				IPs:                 []string{"10.7.0.1"},
+				PersistentKeepalive: 1,
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, clientSocket.Close())
+	})
+
+	status, err := clientSocket.PeerStatus("server")
+	require.NoError(t, err)
+	require.Equal(t, transport.DefaultMTU, status.MTU)
+
+	require.Eventually(t, func() bool {
+		status, err := clientSocket.PeerStatus("server")
+		require.NoError(t, err)
+		return status.MTU < transport.DefaultMTU
+	}, 45*time.Second, 500*time.Millisecond)
+
+	status, err = clientSocket.PeerStatus("server")
+	require.NoError(t, err)
+	// The overhead of WireGuard's transport messages is 32 bytes.
+	require.LessOrEqual(t, status.MTU, maxDatagramSize-32)
+	require.GreaterOrEqual(t, status.MTU, 1280)
+
+	lis, err := serverSocket.Listen("tcp", ":80")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = lis.Close()
+	})
+
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		n, _ := io.CopyN(io.Discard, conn, 1<<20)
+		_, _ = conn.Write([]byte(strconv.FormatInt(n, 10)))
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+
+	conn, err := clientSocket.DialContext(ctx, "tcp", "server:80")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	require.NoError(t, conn.SetDeadline(time.Now().Add(10*time.Second)))
+
+	// Full sized segments would be dropped, unless the stack uses the discovered MTU.
+	_, err = conn.Write(make([]byte, 1<<20))
+	require.NoError(t, err)
+
+	reply, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, strconv.Itoa(1<<20), string(reply))
+}
+
+func TestNoisySocket_PresharedKey(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	psk, err := transport.NewPresharedKey()
+	require.NoError(t, err)
+
+	serverSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "server",
+		ListenPort: 12368,
+		PrivateKey: serverPrivateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:         "client",
+				PublicKey:    clientPrivateKey.PublicKey().String(),
+				PresharedKey: psk.String(),
+				IPs:          []string{"10.7.0.2"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+	})
+
+	lis, err := serverSocket.Listen("tcp", "10.7.0.1:80")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = lis.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+
+	newClientSocket := func(t *testing.T, listenPort uint16, presharedKey string) *noisysockets.NoisySocket {
+		clientSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+			Name:       "client",
+			ListenPort: listenPort,
+			PrivateKey: clientPrivateKey.String(),
+			IPs:        []string{"10.7.0.2"},
+			Peers: []v1alpha1.WireGuardPeerConfig{
+				{
+					Name:         "server",
+					PublicKey:    serverPrivateKey.PublicKey().String(),
+					PresharedKey: presharedKey,
+					Endpoint:     "localhost:12368",
+					IPs:          []string{"10.7.0.1"},
+				},
+			},
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, clientSocket.Close())
+		})
+
+		return clientSocket
+	}
+
+	t.Run("Matching", func(t *testing.T) {
+		clientSocket := newClientSocket(t, 12369, psk.String())
+
+		conn, err := clientSocket.DialTimeout("tcp", "10.7.0.1:80", 5*time.Second)
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+	})
+
+	t.Run("Mismatched", func(t *testing.T) {
+		otherPSK, err := transport.NewPresharedKey()
+		require.NoError(t, err)
+
+		clientSocket := newClientSocket(t, 12370, otherPSK.String())
+
+		_, err = clientSocket.DialTimeout("tcp", "10.7.0.1:80", time.Second)
+		require.Error(t, err)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		otherPrivateKey, err := transport.NewPrivateKey()
+		require.NoError(t, err)
+
+		err = serverSocket.AddPeer(v1alpha1.WireGuardPeerConfig{
+			PublicKey:    otherPrivateKey.PublicKey().String(),
+			PresharedKey: "dG9vIHNob3J0",
+			IPs:          []string{"10.7.0.3"},
+		})
+		require.ErrorContains(t, err, "preshared key")
+	})
+}
+
+func TestNoisySocket_StreamTransports(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	tcpClientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	wsClientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	quicClientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "server",
+		ListenPort: 12377,
+		Listeners:  []string{"tcp://127.0.0.1:12375", "ws://127.0.0.1:12376/wireguard", "quic://127.0.0.1:12468"},
+		PrivateKey: serverPrivateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "tcp-client",
+				PublicKey: tcpClientPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.2"},
+			},
+			{
+				Name:      "ws-client",
+				PublicKey: wsClientPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.3"},
+			},
+			{
+				Name:      "quic-client",
+				PublicKey: quicClientPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.4"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+	})
+
+	lis, err := serverSocket.Listen("tcp", "10.7.0.1:80")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = lis.Close()
+	})
+
+	go func() {
+		_ = http.Serve(lis, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("Hello, world!"))
+		}))
+	}()
+
+	tests := []struct {
+		name       string
+		privateKey transport.NoisePrivateKey
+		ip         string
+		endpoint   string
+	}{
+		{"TCP", tcpClientPrivateKey, "10.7.0.2", "tcp://127.0.0.1:12375"},
+		{"WebSocket", wsClientPrivateKey, "10.7.0.3", "ws://127.0.0.1:12376/wireguard"},
+		{"QUIC", quicClientPrivateKey, "10.7.0.4", "quic://127.0.0.1:12468"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			clientSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+				Name:       tt.name,
+				PrivateKey: tt.privateKey.String(),
+				IPs:        []string{tt.ip},
+				Peers: []v1alpha1.WireGuardPeerConfig{
+					{
+						Name:      "server",
+						PublicKey: serverPrivateKey.PublicKey().String(),
+						Endpoint:  tt.endpoint,
+						IPs:       []string{"10.7.0.1"},
+					},
+				},
+			})
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				require.NoError(t, clientSocket.Close())
+			})
+
+			client := &http.Client{
+				Transport: &http.Transport{
+					DialContext: clientSocket.DialContext,
+				},
+				Timeout: 5 * time.Second,
+			}
+
+			resp, err := client.Get("http://10.7.0.1")
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			require.Equal(t, "Hello, world!", string(body))
+		})
+	}
+}
+
+func TestNoisySocket_Relay(t *testing.T) {
+	logger := slogt.New(t)
+
+	relayServer, err := relay.NewServer(logger)
+	require.NoError(t, err)
+
+	relayLis, err := net.Listen("tcp", "127.0.0.1:12378")
+	require.NoError(t, err)
+
+	go func() {
+		_ = relayServer.Serve(relayLis)
+	}()
+	t.Cleanup(func() {
+		require.NoError(t, relayServer.Close())
+	})
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "server",
+		ListenPort: 12379,
+		RelayURL:   "tcp://127.0.0.1:12378",
+		PrivateKey: serverPrivateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "client",
+				PublicKey: clientPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.2"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+	})
+
+	lis, err := serverSocket.Listen("tcp", "10.7.0.1:80")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = lis.Close()
+	})
+
+	go func() {
+		_ = http.Serve(lis, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("Hello, world!"))
+		}))
+	}()
+
+	clientSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "client",
+		RelayURL:   "tcp://127.0.0.1:12378",
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "server",
+				PublicKey: serverPrivateKey.PublicKey().String(),
+				// Nothing is listening here, so the direct path will fail.
+				Endpoint: "127.0.0.1:12380",
+				IPs:      []string{"10.7.0.1"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, clientSocket.Close())
+	})
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: clientSocket.DialContext,
+		},
+		// Long enough for the first handshake to time out.
+		Timeout: 3 * transport.RekeyTimeout,
+	}
+
+	resp, err := client.Get("http://10.7.0.1")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	require.Equal(t, "Hello, world!", string(body))
+}
+
+func TestNoisySocket_EndpointDiscovery(t *testing.T) {
+	logger := slogt.New(t)
+
+	stunServer := serveSTUN(t, "127.0.0.1:12381")
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:        "server",
+		ListenPort:  12382,
+		STUNServers: []string{stunServer},
+		PrivateKey:  serverPrivateKey.String(),
+		IPs:         []string{"10.7.0.1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "client",
+				PublicKey: clientPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.2"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+	})
+
+	clientSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:        "client",
+		ListenPort:  12383,
+		STUNServers: []string{stunServer},
+		PrivateKey:  clientPrivateKey.String(),
+		IPs:         []string{"10.7.0.2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "server",
+				PublicKey: serverPrivateKey.PublicKey().String(),
+				Endpoint:  "127.0.0.1:12382",
+				IPs:       []string{"10.7.0.1"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, clientSocket.Close())
+	})
+
+	serverEndpoint := netip.MustParseAddrPort("127.0.0.1:12382")
+	clientEndpoint := netip.MustParseAddrPort("127.0.0.1:12383")
+
+	require.Eventually(t, func() bool {
+		return slices.Contains(serverSocket.PublicEndpoints(), serverEndpoint)
+	}, 5*time.Second, 100*time.Millisecond)
+
+	// Endpoints are only announced to peers we have a session with.
+	lis, err := serverSocket.Listen("tcp", "10.7.0.1:80")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = lis.Close()
+	})
+
+	conn, err := clientSocket.DialTimeout("tcp", "10.7.0.1:80", 5*time.Second)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	require.Eventually(t, func() bool {
+		status, err := clientSocket.PeerStatus("server")
+		require.NoError(t, err)
+
+		return slices.Contains(status.CandidateEndpoints, serverEndpoint)
+	}, 15*time.Second, 100*time.Millisecond)
+
+	require.Eventually(t, func() bool {
+		status, err := serverSocket.PeerStatus("client")
+		require.NoError(t, err)
+
+		return slices.Contains(status.CandidateEndpoints, clientEndpoint)
+	}, 15*time.Second, 100*time.Millisecond)
+
+	status, err := clientSocket.PeerStatus("server")
+	require.NoError(t, err)
+	require.Equal(t, serverEndpoint.String(), status.Endpoint)
+	require.False(t, status.Relayed)
+	require.False(t, status.LastHandshake.IsZero())
+}
+
+// serveSTUN starts a minimal STUN server, that answers binding requests with
+// the address they were received from.
+func serveSTUN(t *testing.T, addr string) string {
+	pc, err := net.ListenPacket("udp4", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = pc.Close()
+	})
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			// Only binding requests (with the magic cookie) are answered.
+			if n < 20 || binary.BigEndian.Uint16(buf[0:2]) != 0x0001 || binary.BigEndian.Uint32(buf[4:8]) != 0x2112A442 {
+				continue
+			}
+
+			fromAddr := from.(*net.UDPAddr).AddrPort()
+			ip := fromAddr.Addr().As4()
+
+			resp := make([]byte, 32)
+			binary.BigEndian.PutUint16(resp[0:2], 0x0101)
+			binary.BigEndian.PutUint16(resp[2:4], 12)
+			copy(resp[4:20], buf[4:20])
+
+			// XOR-MAPPED-ADDRESS.
+			binary.BigEndian.PutUint16(resp[20:22], 0x0020)
+			binary.BigEndian.PutUint16(resp[22:24], 8)
+			resp[25] = 0x01
+			binary.BigEndian.PutUint16(resp[26:28], fromAddr.Port()^0x2112)
+			for i := range ip {
+				resp[28+i] = ip[i] ^ resp[4+i]
+			}
+
+			_, _ = pc.WriteTo(resp, from)
+		}
+	}()
+
+	return pc.LocalAddr().String()
+}
+
+func TestNoisySocket_Forwarding(t *testing.T) {
+	logger := slogt.New(t)
+
+	newSocket := func(t *testing.T, conf *v1alpha1.Config) *noisysockets.NoisySocket {
+		socket, err := noisysockets.NewNoisySocket(logger, conf)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, socket.Close())
+		})
+
+		return socket
+	}
+
+	routerPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	alicePrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	bobPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	_ = newSocket(t, &v1alpha1.Config{
+		Name:                 "router",
+		ListenPort:           12351,
+		PrivateKey:           routerPrivateKey.String(),
+		IPs:                  []string{"10.7.0.1"},
+		EnableForwarding:     true,
+		ForwardToHostNetwork: true,
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "alice",
+				PublicKey: alicePrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12352",
+				IPs:       []string{"10.7.0.2"},
+			},
+			{
+				Name:      "bob",
+				PublicKey: bobPrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12353",
+				IPs:       []string{"10.7.0.3"},
+			},
+		},
+	})
+
+	// Alice routes traffic for bob, and the host network of the router, via the router.
+	aliceSocket := newSocket(t, &v1alpha1.Config{
+		Name:       "alice",
+		ListenPort: 12352,
+		PrivateKey: alicePrivateKey.String(),
+		IPs:        []string{"10.7.0.2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "router",
+				PublicKey: routerPrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12351",
+				IPs:       []string{"10.7.0.1", "10.7.0.3"},
+			},
+		},
+	})
+
+	bobSocket := newSocket(t, &v1alpha1.Config{
+		Name:       "bob",
+		ListenPort: 12353,
+		PrivateKey: bobPrivateKey.String(),
+		IPs:        []string{"10.7.0.3"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "router",
+				PublicKey: routerPrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12351",
+				IPs:       []string{"10.7.0.1", "10.7.0.2"},
+			},
+		},
+	})
+
+	var mux http.ServeMux
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "Hello, world!")
+	})
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial:              aliceSocket.Dial,
+			DisableKeepAlives: true,
+		},
+		Timeout: 5 * time.Second,
+	}
+
+	t.Run("Between Peers", func(t *testing.T) {
+		lis, err := bobSocket.Listen("tcp", ":80")
+		require.NoError(t, err)
+
+		srv := &http.Server{
+			Handler: &mux,
+		}
+		t.Cleanup(func() {
+			_ = srv.Close()
+		})
+
+		go func() {
+			if err := srv.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("Failed to serve", "error", err)
+			}
+		}()
+
+		resp, err := client.Get("http://10.7.0.3")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, resp.Body.Close())
+		})
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		require.Equal(t, "Hello, world!", string(body))
+	})
+
+	t.Run("Host Network", func(t *testing.T) {
+		// Loopback addresses can't be routed, so we need an external address.
+		hostAddr := externalAddr(t)
+
+		// Route the host address via the router.
+		require.NoError(t, aliceSocket.UpdatePeer(v1alpha1.WireGuardPeerConfig{
+			Name:      "router",
+			PublicKey: routerPrivateKey.PublicKey().String(),
+			IPs:       []string{"10.7.0.1", "10.7.0.3", hostAddr.String()},
+		}))
+
+		lis, err := net.Listen("tcp", net.JoinHostPort(hostAddr.String(), "0"))
+		require.NoError(t, err)
+
+		srv := httptest.NewUnstartedServer(&mux)
+		srv.Listener = lis
+		srv.Start()
+		t.Cleanup(srv.Close)
+
+		resp, err := client.Get(srv.URL)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, resp.Body.Close())
+		})
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		require.Equal(t, "Hello, world!", string(body))
+	})
+}
+
+func TestNoisySocket_ExitNode(t *testing.T) {
+	logger := slogt.New(t)
+
+	// Loopback addresses can't be routed, so we need an external address.
+	hostAddr := externalAddr(t)
+
+	exitPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	exitSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:                 "exit",
+		ListenPort:           12354,
+		PrivateKey:           exitPrivateKey.String(),
+		IPs:                  []string{"10.7.0.1"},
+		EnableForwarding:     true,
+		ForwardToHostNetwork: true,
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "client",
+				PublicKey: clientPrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12355",
+				IPs:       []string{"10.7.0.2"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, exitSocket.Close())
+	})
+
+	clientSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:                   "client",
+		ListenPort:             12355,
+		PrivateKey:             clientPrivateKey.String(),
+		IPs:                    []string{"10.7.0.2"},
+		DefaultGatewayPeerName: "exit",
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "exit",
+				PublicKey: exitPrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12354",
+				IPs:       []string{"10.7.0.1"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, clientSocket.Close())
+	})
+
+	lis, err := net.Listen("tcp", net.JoinHostPort(hostAddr.String(), "0"))
+	require.NoError(t, err)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "Hello, world!")
+	}))
+	srv.Listener = lis
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial:              clientSocket.Dial,
+			DisableKeepAlives: true,
+		},
+		Timeout: 5 * time.Second,
+	}
+
+	resp, err := client.Get(srv.URL)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, resp.Body.Close())
+	})
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	require.Equal(t, "Hello, world!", string(body))
+
+	t.Run("Half Close", func(t *testing.T) {
+		lis, err := net.Listen("tcp", net.JoinHostPort(hostAddr.String(), "0"))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = lis.Close()
+		})
+
+		// Reply with the request, once the client has finished sending it.
+		go func() {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			req, err := io.ReadAll(conn)
+			if err != nil {
+				return
+			}
+
+			_, _ = conn.Write(req)
+		}()
+
+		conn, err := clientSocket.Dial("tcp", lis.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+
+		_, err = conn.Write([]byte("Hello, world!"))
+		require.NoError(t, err)
+
+		require.NoError(t, conn.(interface{ CloseWrite() error }).CloseWrite())
+
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+		reply, err := io.ReadAll(conn)
+		require.NoError(t, err)
+
+		require.Equal(t, "Hello, world!", string(reply))
+	})
+}
+
+func TestNoisySocket_DNSServer(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	alicePrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:            "server",
+		ListenPort:      12356,
+		PrivateKey:      serverPrivateKey.String(),
+		IPs:             []string{"10.7.0.1"},
+		EnableDNSServer: true,
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "client",
+				PublicKey: clientPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.2"},
+			},
+			{
+				Name:      "alice",
+				PublicKey: alicePrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.3", "fd00::3"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+	})
+
+	// The client only knows about the server.
+	clientSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "client",
+		ListenPort: 12357,
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.2"},
+		DNSServers: []string{"10.7.0.1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "server",
+				PublicKey: serverPrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12356",
+				IPs:       []string{"10.7.0.1"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, clientSocket.Close())
+	})
+
+	addrs, err := clientSocket.LookupHost("alice")
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"10.7.0.3", "fd00::3"}, addrs)
+
+	addrs, err = clientSocket.LookupHost("server")
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.7.0.1"}, addrs)
+
+	_, err = clientSocket.LookupHost("bob")
+	require.Error(t, err)
+
+	names, err := clientSocket.LookupAddr("fd00::3")
+	require.NoError(t, err)
+	require.Equal(t, []string{"alice"}, names)
+
+	names, err = clientSocket.LookupAddr("10.7.0.1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"server"}, names)
+
+	_, err = clientSocket.LookupAddr("10.7.0.4")
+	require.Error(t, err)
+}
+
+func TestNoisySocket_DialContext(t *testing.T) {
+	logger := slogt.New(t)
+
+	privateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	peerPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	// The peer's endpoint is unreachable, so connections will hang.
+	socket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "client",
+		ListenPort: 12358,
+		PrivateKey: privateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "unreachable",
+				PublicKey: peerPrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12359",
+				IPs:       []string{"10.7.0.2"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, socket.Close())
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		start := time.Now()
+		_, err := socket.DialTimeout("tcp", "unreachable:80", 200*time.Millisecond)
+		require.Error(t, err)
+		require.Less(t, time.Since(start), time.Second)
+
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+
+		var netErr net.Error
+		require.ErrorAs(t, err, &netErr)
+		require.True(t, netErr.Timeout())
+	})
+
+	t.Run("Cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(200*time.Millisecond, cancel)
+
+		start := time.Now()
+		_, err := socket.DialContext(ctx, "tcp", "unreachable:80")
+		require.ErrorIs(t, err, context.Canceled)
+		require.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("Already Cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := socket.DialContext(ctx, "tcp", "unreachable:80")
+		require.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+func TestNoisySocket_Errors(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverSocket, clientSocket, err := noisysockets.Pipe(logger, &v1alpha1.Config{
+		Name:       "server",
+		PrivateKey: serverPrivateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "client",
+				PublicKey: clientPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.2"},
+			},
+		},
+	}, &v1alpha1.Config{
+		Name:       "client",
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "server",
+				PublicKey: serverPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.1"},
+			},
+		},
+	}, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+		require.NoError(t, clientSocket.Close())
+	})
+
+	t.Run("Connection Refused", func(t *testing.T) {
+		_, err := clientSocket.Dial("tcp", "server:80")
+		require.ErrorIs(t, err, syscall.ECONNREFUSED)
+
+		var opErr *net.OpError
+		require.ErrorAs(t, err, &opErr)
+		require.Equal(t, "dial", opErr.Op)
+		require.Equal(t, "tcp", opErr.Net)
+		require.Equal(t, "10.7.0.1:80", opErr.Addr.String())
+	})
+
+	t.Run("No Route To Peer", func(t *testing.T) {
+		_, err := clientSocket.Dial("tcp", "10.7.0.3:80")
+		require.ErrorIs(t, err, noisysockets.ErrNoRouteToPeer)
+		require.ErrorIs(t, err, syscall.EHOSTUNREACH)
+	})
+
+	t.Run("Peer Not Connected", func(t *testing.T) {
+		otherPrivateKey, err := transport.NewPrivateKey()
+		require.NoError(t, err)
+
+		// The peer has no endpoint, so it can't be reached until it connects.
+		socket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+			Name:       "other",
+			ListenPort: 12440,
+			PrivateKey: otherPrivateKey.String(),
+			IPs:        []string{"10.7.0.3"},
+			Peers: []v1alpha1.WireGuardPeerConfig{
+				{
+					Name:      "server",
+					PublicKey: serverPrivateKey.PublicKey().String(),
+					IPs:       []string{"10.7.0.1"},
+				},
+			},
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, socket.Close())
+		})
+
+		_, err = socket.Dial("tcp", "server:80")
+		require.ErrorIs(t, err, noisysockets.ErrPeerNotConnected)
+		require.ErrorIs(t, err, syscall.EHOSTUNREACH)
+	})
+
+	t.Run("Unknown Peer", func(t *testing.T) {
+		_, err := clientSocket.PeerStatus("nobody")
+		require.ErrorIs(t, err, noisysockets.ErrUnknownPeer)
+	})
+
+	t.Run("Address In Use", func(t *testing.T) {
+		lis, err := serverSocket.Listen("tcp", ":80")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = lis.Close()
+		})
+
+		_, err = serverSocket.Listen("tcp", ":80")
+		require.ErrorIs(t, err, syscall.EADDRINUSE)
+
+		var opErr *net.OpError
+		require.ErrorAs(t, err, &opErr)
+		require.Equal(t, "bind", opErr.Op)
+		require.Equal(t, "10.7.0.1:80", opErr.Addr.String())
+	})
+
+	t.Run("Accept Closed", func(t *testing.T) {
+		lis, err := serverSocket.Listen("tcp", ":81")
+		require.NoError(t, err)
+
+		require.NoError(t, lis.Close())
+
+		_, err = lis.Accept()
+		require.ErrorIs(t, err, net.ErrClosed)
+
+		var opErr *net.OpError
+		require.ErrorAs(t, err, &opErr)
+		require.Equal(t, "accept", opErr.Op)
+	})
+}
+
+func TestNoisySocket_HappyEyeballs(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	// The server doesn't own its IPv6 address, so connections over IPv6 stall.
+	serverSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "server",
+		ListenPort: 12402,
+		PrivateKey: serverPrivateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				PublicKey: clientPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.2", "fd00::2"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+	})
+
+	lis, err := serverSocket.Listen("tcp", "10.7.0.1:80")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = lis.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+
+			_ = conn.Close()
+		}
+	}()
+
+	clientSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "client",
+		ListenPort: 12403,
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.2", "fd00::2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "server",
+				PublicKey: serverPrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12402",
+				IPs:       []string{"fd00::1", "10.7.0.1"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, clientSocket.Close())
+	})
+
+	// Complete the handshake, so that it doesn't count towards the dial time.
+	conn, err := clientSocket.DialTimeout("tcp", "10.7.0.1:80", 5*time.Second)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	// Dialing each address in turn would wait for half the timeout, before
+	// trying IPv4.
+	start := time.Now()
+	conn, err = clientSocket.DialTimeout("tcp", "server:80", 10*time.Second)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	require.Less(t, time.Since(start), 2*time.Second)
+	require.Equal(t, "10.7.0.1:80", conn.RemoteAddr().String())
+}
+
+func TestNoisySocket_Multicast(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:            "server",
+		ListenPort:      12398,
+		PrivateKey:      serverPrivateKey.String(),
+		IPs:             []string{"10.7.0.1"},
+		EnableMulticast: true,
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				PublicKey: clientPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.2"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+	})
+
+	group := netip.MustParseAddr("224.0.0.251")
+	require.NoError(t, serverSocket.JoinGroup(group))
+
+	pc, err := serverSocket.ListenPacket("udp", netip.AddrPortFrom(group, 5353).String())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = pc.Close()
+	})
+
+	clientSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:            "client",
+		ListenPort:      12399,
+		PrivateKey:      clientPrivateKey.String(),
+		IPs:             []string{"10.7.0.2"},
+		EnableMulticast: true,
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "server",
+				PublicKey: serverPrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12398",
+				IPs:       []string{"10.7.0.1"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, clientSocket.Close())
+	})
+
+	conn, err := clientSocket.Dial("udp", netip.AddrPortFrom(group, 5353).String())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	// The first datagrams may be dropped while the handshake completes, so retry.
+	buf := make([]byte, 1500)
+	var n int
+	var addr net.Addr
+	for i := 0; i < 10; i++ {
+		_, err = conn.Write([]byte("Hello, world!"))
+		require.NoError(t, err)
+
+		require.NoError(t, pc.SetReadDeadline(time.Now().Add(500*time.Millisecond)))
+
+		n, addr, err = pc.ReadFrom(buf)
+		if err == nil {
+			break
+		}
+	}
+	require.NoError(t, err)
+
+	require.Equal(t, "Hello, world!", string(buf[:n]))
+	require.Equal(t, "10.7.0.2", addr.(*net.UDPAddr).IP.String())
+
+	// Only members of the group receive its packets.
+	require.NoError(t, serverSocket.LeaveGroup(group))
+
+	_, err = conn.Write([]byte("Hello, world!"))
+	require.NoError(t, err)
+
+	require.NoError(t, pc.SetReadDeadline(time.Now().Add(500*time.Millisecond)))
+
+	_, _, err = pc.ReadFrom(buf)
+	require.Error(t, err)
+}
+
+func TestNoisySocket_GatewayAndDNS(t *testing.T) {
+	pwd, err := os.Getwd()
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	net, err := network.New(ctx, network.WithCheckDuplicate())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, net.Remove(ctx))
+	})
+
+	// Spin up a dnsmasq that forwards DNS queries to the host.
+	dnsmasqReq := testcontainers.ContainerRequest{
+		Image:        "andyshinn/dnsmasq:2.83",
+		ExposedPorts: []string{"53/tcp", "53/udp"},
+		Networks:     []string{net.Name},
+		WaitingFor:   wait.ForListeningPort("53/tcp"),
+	}
+
+	dnsmasqC, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: dnsmasqReq,
+		Started:          true,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, dnsmasqC.Terminate(ctx))
+	})
+
+	// Spin up an nginx server.
+	nginxReq := testcontainers.ContainerRequest{
+		Image:        "nginx:latest",
+		ExposedPorts: []string{"80/tcp"},
+		Networks:     []string{net.Name},
+		NetworkAliases: map[string][]string{
+			net.Name: {"web"},
+		},
+		WaitingFor: wait.ForListeningPort("80/tcp"),
+	}
+
+	nginxC, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: nginxReq,
+		Started:          true,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, nginxC.Terminate(ctx))
+	})
+
+	// Spin up a WireGuard gateway.
+	wgReq := testcontainers.ContainerRequest{
+		Image:        "masipcat/wireguard-go:latest",
+		ExposedPorts: []string{"51820/udp"},
+		Files: []testcontainers.ContainerFile{
+			{HostFilePath: filepath.Join(pwd, "testdata/wg0.conf"), ContainerFilePath: "/etc/wireguard/wg0.conf", FileMode: 0o400},
+		},
+		Networks: []string{net.Name},
+		HostConfigModifier: func(hostConfig *container.HostConfig) {
+			hostConfig.CapAdd = []string{"NET_ADMIN"}
+
+			hostConfig.Sysctls = map[string]string{
+				"net.ipv4.ip_forward":              "1",
+				"net.ipv4.conf.all.src_valid_mark": "1",
+			}
+
+			hostConfig.Binds = append(hostConfig.Binds, "/dev/net/tun:/dev/net/tun")
+		},
+	}
+
+	wgC, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: wgReq,
+		Started:          true,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, wgC.Terminate(ctx))
+	})
+
+	outputDir := t.TempDir()
+	configPath := filepath.Join(outputDir, "noisysockets.yaml")
+
+	require.NoError(t, generateConfig(ctx, configPath, wgC, dnsmasqC))
+
+	logger := slogt.New(t)
+
+	conf, err := config.FromYAML(configPath)
+	require.NoError(t, err)
+
+	socket, err := noisysockets.NewNoisySocket(logger, conf)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, socket.Close())
+	})
+
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			Dial: socket.Dial,
+		},
+	}
+
+	resp, err := httpClient.Get("http://web")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, resp.Body.Close())
+	})
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+// TestNoisySocket_WireGuardInterop checks that a socket, in strict interop
+// mode, can peer with a stock WireGuard implementation.
+func TestNoisySocket_WireGuardInterop(t *testing.T) {
+	pwd, err := os.Getwd()
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	wgReq := testcontainers.ContainerRequest{
+		Image:        "masipcat/wireguard-go:latest",
+		ExposedPorts: []string{"51820/udp"},
+		Files: []testcontainers.ContainerFile{
+			{HostFilePath: filepath.Join(pwd, "testdata/wg1.conf"), ContainerFilePath: "/etc/wireguard/wg0.conf", FileMode: 0o400},
+		},
+		HostConfigModifier: func(hostConfig *container.HostConfig) {
+			hostConfig.CapAdd = []string{"NET_ADMIN"}
+			hostConfig.Binds = append(hostConfig.Binds, "/dev/net/tun:/dev/net/tun")
+		},
+	}
+
+	wgC, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: wgReq,
+		Started:          true,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, wgC.Terminate(ctx))
+	})
+
+	wgHost, err := wgC.Host(ctx)
+	require.NoError(t, err)
+
+	wgPort, err := wgC.MappedPort(ctx, "51820/udp")
+	require.NoError(t, err)
+
+	logger := slogt.New(t)
+
+	socket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:          "client",
+		PrivateKey:    "SFN1gntnAutVFefwrPDlM1W2/LGWaRSn2hq06TvL2GY=",
+		IPs:           []string{"10.8.0.2"},
+		StrictInterop: true,
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:                "wireguard",
+				PublicKey:           "6cvvZyj+EVL4DHjUKeVF7EUBfgR2mJO4php2Gdv9FVw=",
+				PresharedKey:        "/UwcSPg38hW/D9Y3tcS1FOV0K1wuURMbS0sesJEP5ak=",
+				Endpoint:            wgHost + ":" + wgPort.Port(),
+				IPs:                 []string{"10.8.0.1"},
+				PersistentKeepalive: 1,
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, socket.Close())
+	})
+
+	// wgShow returns the first value reported by "wg show wg0 <field>" for our peer.
+	wgShow := func(field string) uint64 {
+		exitCode, output, err := wgC.Exec(ctx, []string{"wg", "show", "wg0", field}, tcexec.Multiplexed())
+		require.NoError(t, err)
+		require.Zero(t, exitCode)
+
+		outputBytes, err := io.ReadAll(output)
+		require.NoError(t, err)
+
+		fields := strings.Fields(string(outputBytes))
+		require.GreaterOrEqual(t, len(fields), 2)
+
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		require.NoError(t, err)
+
+		return value
+	}
+
+	// Without any traffic, persistent keepalives should trigger a handshake.
+	require.Eventually(t, func() bool {
+		return wgShow("latest-handshakes") > 0
+	}, 10*time.Second, 100*time.Millisecond)
+
+	// And then keep on arriving.
+	rxBytes := wgShow("transfer")
+	require.Eventually(t, func() bool {
+		return wgShow("transfer") > rxBytes
+	}, 10*time.Second, 100*time.Millisecond)
+
+	// Traffic initiated by the stock implementation should be answered.
+	exitCode, _, err := wgC.Exec(ctx, []string{"ping", "-c", "1", "-W", "5", "10.8.0.2"})
+	require.NoError(t, err)
+	require.Zero(t, exitCode)
+}
+
+// externalAddr returns a non-loopback IPv4 address of the host.
+func externalAddr(t *testing.T) netip.Addr {
+	ifaceAddrs, err := net.InterfaceAddrs()
+	require.NoError(t, err)
+
+	for _, ifaceAddr := range ifaceAddrs {
+		if ipNet, ok := ifaceAddr.(*net.IPNet); ok {
+			addr, ok := netip.AddrFromSlice(ipNet.IP.To4())
+			if ok && !addr.IsLoopback() {
+				return addr
+			}
+		}
+	}
+
+	t.Skip("No external IPv4 address available")
+
+	return netip.Addr{}
+}
+
+func TestNoisySocket_Stats(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "server",
+		ListenPort: 12414,
+		PrivateKey: serverPrivateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "client",
+				PublicKey: clientPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.2"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+	})
+
+	lis, err := serverSocket.Listen("tcp", ":80")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = lis.Close()
+	})
+
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	clientSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "client",
+		ListenPort: 12415,
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "server",
+				PublicKey: serverPrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12414",
+				IPs:       []string{"10.7.0.1"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, clientSocket.Close())
+	})
+
+	stats := clientSocket.Stats()
+	require.Len(t, stats.Peers, 1)
+	require.Zero(t, stats.Peers[0].TxPackets)
+	require.True(t, stats.Peers[0].LastHandshake.IsZero())
+	require.Empty(t, stats.Connections)
+
+	conn, err := clientSocket.Dial("tcp", "server:80")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+
+	stats = clientSocket.Stats()
+	require.Len(t, stats.Peers, 1)
+
+	peerStats := stats.Peers[0]
+	require.Equal(t, "server", peerStats.Name)
+	require.NotZero(t, peerStats.TxPackets)
+	require.NotZero(t, peerStats.RxPackets)
+	require.NotZero(t, peerStats.TxBytes)
+	require.NotZero(t, peerStats.RxBytes)
+	require.False(t, peerStats.LastHandshake.IsZero())
+	require.Equal(t, uint64(1), peerStats.HandshakesCompleted)
+
+	require.Len(t, stats.Connections, 1)
+
+	connStats := stats.Connections[0]
+	require.Equal(t, conn.LocalAddr().String(), connStats.LocalAddr.String())
+	require.Equal(t, netip.MustParseAddrPort("10.7.0.1:80"), connStats.RemoteAddr)
+	require.Equal(t, "server", connStats.PeerName)
+	require.Equal(t, "ESTABLISHED", connStats.State)
+	require.Equal(t, uint64(5), connStats.BytesSent)
+	require.Equal(t, uint64(5), connStats.BytesReceived)
+
+	// The listener isn't a connection, only the accepted connection is.
+	require.Eventually(t, func() bool {
+		conns := serverSocket.Stats().Connections
+		return len(conns) == 1 && conns[0].PeerName == "client"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestNoisySocket_SocketOptions(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "server",
+		ListenPort: 12434,
+		PrivateKey: serverPrivateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+		SocketOptions: &v1alpha1.SocketOptionsConfig{
+			// Expedited forwarding.
+			DSCP: 46,
+		},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "client",
+				PublicKey: clientPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.2"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+	})
+
+	clientSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "client",
+		ListenPort: 12435,
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "server",
+				PublicKey: serverPrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12434",
+				IPs:       []string{"10.7.0.1"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, clientSocket.Close())
+	})
+
+	lis, err := serverSocket.Listen("tcp", ":80")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, lis.Close())
+	})
+
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		_, _ = conn.Write([]byte("Hello, world!"))
+	}()
+
+	conn, err := clientSocket.DialTimeout("tcp", "server:80", 10*time.Second)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, conn.Close())
+	})
+
+	buf, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, "Hello, world!", string(buf))
+
+	t.Run("Invalid DSCP", func(t *testing.T) {
+		_, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+			PrivateKey: clientPrivateKey.String(),
+			IPs:        []string{"10.7.0.2"},
+			SocketOptions: &v1alpha1.SocketOptionsConfig{
+				DSCP: 64,
+			},
+		})
+		require.ErrorContains(t, err, "dscp must be between 0 and 63")
+	})
+}
+
+func TestNoisySocket_MultipleEndpoints(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "server",
+		ListenPort: 12437,
+		PrivateKey: serverPrivateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "client",
+				PublicKey: clientPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.2"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+	})
+
+	clientSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "client",
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "server",
+				PublicKey: serverPrivateKey.PublicKey().String(),
+				// Nothing is listening on the primary endpoint.
+				Endpoint:  "127.0.0.1:12438",
+				Endpoints: []string{"127.0.0.1:12437"},
+				IPs:       []string{"10.7.0.1"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, clientSocket.Close())
+	})
+
+	lis, err := serverSocket.Listen("tcp", ":80")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, lis.Close())
+	})
+
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		_, _ = conn.Write([]byte("Hello, world!"))
+	}()
+
+	// The first handshake should complete via the backup endpoint, without
+	// waiting for the primary to time out.
+	conn, err := clientSocket.DialTimeout("tcp", "server:80", 4*time.Second)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, conn.Close())
+	})
+
+	buf, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, "Hello, world!", string(buf))
+
+	status, err := clientSocket.PeerStatus("server")
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1:12437", status.Endpoint)
+}
+
+func generateConfig(ctx context.Context, configPath string, wgC, dnsmasqC testcontainers.Container) error {
+	wgHost, err := wgC.Host(ctx)
+	if err != nil {
+		return err
+	}
+
+	wgPort, err := wgC.MappedPort(ctx, "51820/udp")
+	if err != nil {
+		return err
+	}
+
+	dnsServer, err := dnsmasqC.ContainerIP(ctx)
+	if err != nil {
+		return err
+	}
+
+	var renderedConfig strings.Builder
+	tmpl := template.Must(template.ParseFiles("testdata/noisysockets.yaml.tmpl"))
+	if err := tmpl.Execute(&renderedConfig, struct {
+		Endpoint  string
+		DNSServer string
+	}{
+		Endpoint:  wgHost + ":" + wgPort.Port(),
+		DNSServer: dnsServer,
+	}); err != nil {
+		return err
+	}
+
+	return os.WriteFile(configPath, []byte(renderedConfig.String()), 0o400)
+}
+
+func TestNoisySocket_Stack(t *testing.T) {
+	logger := slogt.New(t)
+
+	privateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	socket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		PrivateKey: privateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, socket.Close())
+	})
+
+	var addrs []string
+	for _, nicAddrs := range socket.Stack().AllAddresses() {
+		for _, addr := range nicAddrs {
+			addrs = append(addrs, addr.AddressWithPrefix.Address.String())
+		}
+	}
+	require.Contains(t, addrs, "10.7.0.1")
+}
+
+func TestNoisySocket_Connections(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverSocket, clientSocket, err := noisysockets.Pipe(logger, &v1alpha1.Config{
+		Name:       "server",
+		PrivateKey: serverPrivateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "client",
+				PublicKey: clientPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.2"},
+			},
+		},
+	}, &v1alpha1.Config{
+		Name:       "client",
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "server",
+				PublicKey: serverPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.1"},
+			},
+		},
+	}, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+		require.NoError(t, clientSocket.Close())
+	})
+
+	lis, err := serverSocket.Listen("tcp", ":80")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = lis.Close()
+	})
+
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	conn, err := clientSocket.Dial("tcp", "server:80")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	_, err = io.ReadFull(conn, make([]byte, 5))
+	require.NoError(t, err)
+
+	udpConn, err := clientSocket.Dial("udp", "server:53")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = udpConn.Close()
+	})
+
+	_, err = udpConn.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	clientAddr := netip.MustParseAddrPort(conn.LocalAddr().String())
+	udpClientAddr := netip.MustParseAddrPort(udpConn.LocalAddr().String())
+
+	require.Eventually(t, func() bool {
+		conns := serverSocket.Connections()
+		return len(conns) == 2 && conns[1].State == "ESTABLISHED"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The listener, and the accepted connection.
+	conns := serverSocket.Connections()
+	require.Equal(t, "tcp", conns[0].Network)
+	require.Equal(t, netip.MustParseAddrPort("10.7.0.1:80"), conns[0].LocalAddr)
+	require.False(t, conns[0].RemoteAddr.IsValid())
+	require.Equal(t, "LISTEN", conns[0].State)
+	require.Empty(t, conns[0].PeerName)
+
+	require.Equal(t, netip.MustParseAddrPort("10.7.0.1:80"), conns[1].LocalAddr)
+	require.Equal(t, clientAddr, conns[1].RemoteAddr)
+	require.Equal(t, "client", conns[1].PeerName)
+	require.Equal(t, clientPrivateKey.PublicKey().String(), conns[1].PeerPublicKey)
+	// Echoed using io.Copy's fast path.
+	require.Equal(t, uint64(5), conns[1].BytesReceived)
+	require.Equal(t, uint64(5), conns[1].BytesSent)
+
+	conns = clientSocket.Connections()
+	require.Len(t, conns, 2)
+
+	require.Equal(t, "tcp", conns[0].Network)
+	require.Equal(t, clientAddr, conns[0].LocalAddr)
+	require.Equal(t, "ESTABLISHED", conns[0].State)
+	require.Equal(t, "server", conns[0].PeerName)
+	require.Equal(t, uint64(5), conns[0].BytesSent)
+	require.Equal(t, uint64(5), conns[0].BytesReceived)
+
+	require.Equal(t, "udp", conns[1].Network)
+	require.Equal(t, udpClientAddr, conns[1].LocalAddr)
+	require.Equal(t, netip.MustParseAddrPort("10.7.0.1:53"), conns[1].RemoteAddr)
+	require.Equal(t, "CONNECTED", conns[1].State)
+	require.Equal(t, "server", conns[1].PeerName)
+	require.Equal(t, uint64(5), conns[1].BytesSent)
+}
+
+func TestNoisySocket_PeerIdleTimeout(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverSocket, clientSocket, err := noisysockets.Pipe(logger, &v1alpha1.Config{
+		Name:                   "server",
+		PrivateKey:             serverPrivateKey.String(),
+		IPs:                    []string{"10.7.0.1"},
+		PeerIdleTimeoutSeconds: 1,
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "client",
+				PublicKey: clientPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.2"},
+			},
+		},
+	}, &v1alpha1.Config{
+		Name:       "client",
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:               "server",
+				PublicKey:          serverPrivateKey.PublicKey().String(),
+				IPs:                []string{"10.7.0.1"},
+				IdleTimeoutSeconds: 1,
+			},
+		},
+	}, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+		require.NoError(t, clientSocket.Close())
+	})
+
+	pc, err := serverSocket.ListenPacket("udp", ":7")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = pc.Close()
+	})
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			if _, err := pc.WriteTo(buf[:n], addr); err != nil {
+				return
+			}
+		}
+	}()
+
+	conn, err := clientSocket.Dial("udp", "server:7")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	echo := func() {
+		_, err := conn.Write([]byte("hello"))
+		require.NoError(t, err)
+
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(buf))
+	}
+
+	sessionActive := func(socket *noisysockets.NoisySocket, peer string) bool {
+		status, err := socket.PeerStatus(peer)
+		require.NoError(t, err)
+
+		return status.SessionActive
+	}
+
+	echo()
+
+	require.True(t, sessionActive(serverSocket, "client"))
+	require.True(t, sessionActive(clientSocket, "server"))
+
+	// Once idle, both sides should tear down the session.
+	require.Eventually(t, func() bool {
+		return !sessionActive(serverSocket, "client") && !sessionActive(clientSocket, "server")
+	}, 5*time.Second, 100*time.Millisecond)
+
+	// But the peers are retained, and a new session is established on demand.
+	echo()
+
+	require.True(t, sessionActive(clientSocket, "server"))
+}
+
+func TestNoisySocket_Shutdown(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverSocket, clientSocket, err := noisysockets.Pipe(logger, &v1alpha1.Config{
+		Name:       "server",
+		PrivateKey: serverPrivateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "client",
+				PublicKey: clientPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.2"},
+			},
+		},
+	}, &v1alpha1.Config{
+		Name:       "client",
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "server",
+				PublicKey: serverPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.1"},
+			},
+		},
+	}, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, clientSocket.Close())
+	})
+
+	lis, err := serverSocket.Listen("tcp", ":80")
+	require.NoError(t, err)
+
+	accepted := make(chan net.Conn, 1)
+	acceptErr := make(chan error, 1)
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				acceptErr <- err
+				return
+			}
+
+			accepted <- conn
+		}
+	}()
+
+	conn, err := clientSocket.Dial("tcp", "server:80")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	serverConn := <-accepted
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- serverSocket.Shutdown(context.Background())
+	}()
+
+	// No new connections are accepted.
+	select {
+	case err := <-acceptErr:
+		require.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("listener was not closed")
+	}
+
+	// But the active connection keeps on working.
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(serverConn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+
+	select {
+	case <-shutdownErr:
+		t.Fatal("shutdown completed before the connection was closed")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Until it is closed.
+	require.NoError(t, serverConn.Close())
+	require.NoError(t, conn.Close())
+
+	select {
+	case err := <-shutdownErr:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not complete")
+	}
+
+	t.Run("Deadline", func(t *testing.T) {
+		serverSocket, clientSocket, err := noisysockets.Pipe(logger, &v1alpha1.Config{
+			Name:       "server",
+			PrivateKey: serverPrivateKey.String(),
+			IPs:        []string{"10.7.0.1"},
+			Peers: []v1alpha1.WireGuardPeerConfig{
+				{
+					Name:      "client",
+					PublicKey: clientPrivateKey.PublicKey().String(),
+					IPs:       []string{"10.7.0.2"},
+				},
+			},
+		}, &v1alpha1.Config{
+			Name:       "client",
+			PrivateKey: clientPrivateKey.String(),
+			IPs:        []string{"10.7.0.2"},
+			Peers: []v1alpha1.WireGuardPeerConfig{
+				{
+					Name:      "server",
+					PublicKey: serverPrivateKey.PublicKey().String(),
+					IPs:       []string{"10.7.0.1"},
+				},
+			},
+		}, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, clientSocket.Close())
+		})
+
+		lis, err := serverSocket.Listen("tcp", ":80")
+		require.NoError(t, err)
+
+		received := make(chan struct{})
+		go func() {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			buf := make([]byte, 5)
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				return
+			}
+			close(received)
+
+			_, _ = io.Copy(io.Discard, conn)
+		}()
+
+		conn, err := clientSocket.Dial("tcp", "server:80")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+
+		// Make sure the connection has been accepted.
+		_, err = conn.Write([]byte("hello"))
+		require.NoError(t, err)
+
+		<-received
+
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		t.Cleanup(cancel)
+
+		require.ErrorIs(t, serverSocket.Shutdown(ctx), context.DeadlineExceeded)
+	})
+}
+
+func TestNoisySocket_HandshakeLimits(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverConf := &v1alpha1.Config{
+		Name:       "server",
+		PrivateKey: serverPrivateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+		HandshakeLimits: &v1alpha1.HandshakeLimitsConfig{
+			AlwaysRequireCookie: true,
+		},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "client",
+				PublicKey: clientPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.2"},
+			},
+		},
+	}
+
+	t.Run("Always Require Cookie", func(t *testing.T) {
+		serverSocket, clientSocket, err := noisysockets.Pipe(logger, serverConf, &v1alpha1.Config{
+			Name:       "client",
+			PrivateKey: clientPrivateKey.String(),
+			IPs:        []string{"10.7.0.2"},
+			// Retry quickly, once the cookie reply has been received.
+			Timers: &v1alpha1.TimersConfig{
+				HandshakeRetrySeconds: 1,
+			},
+			Peers: []v1alpha1.WireGuardPeerConfig{
+				{
+					Name:      "server",
+					PublicKey: serverPrivateKey.PublicKey().String(),
+					IPs:       []string{"10.7.0.1"},
+				},
+			},
+		}, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, clientSocket.Close())
+			require.NoError(t, serverSocket.Close())
+		})
+
+		lis, err := serverSocket.Listen("tcp", ":80")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = lis.Close()
+		})
+
+		go func() {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}()
+
+		conn, err := clientSocket.DialTimeout("tcp", "10.7.0.1:80", 10*time.Second)
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+
+		stats := serverSocket.HandshakeStats()
+		require.NotZero(t, stats.CookieReplies)
+		require.Zero(t, stats.RateLimited)
+		require.Zero(t, stats.ConcurrencyLimited)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		conf := *serverConf
+		conf.HandshakeLimits = &v1alpha1.HandshakeLimitsConfig{
+			MaxConcurrentHandshakes: 4096,
+		}
+
+		_, err := noisysockets.NewNoisySocket(logger, &conf)
+		require.ErrorContains(t, err, "maximum concurrent handshakes must not exceed")
+	})
 }
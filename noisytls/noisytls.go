@@ -0,0 +1,232 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+// Package noisytls binds TLS certificates to the public keys of peers, so
+// that software which insists upon TLS (eg. HTTPS only clients) can run on the
+// mesh with meaningful identity checks.
+//
+// Certificates are self-signed, and identify a peer by including its public
+// key as a "noisy:" URI. A certificate is only accepted if the key it claims
+// is that of the peer at the other end of the mesh connection, so a peer can't
+// impersonate another, and no certificate authority is needed.
+//
+// Software that doesn't require TLS can rely on the identity of the
+// connection alone, see noisysockets.PeerConn.
+package noisytls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/noisysockets/noisysockets/internal/transport"
+)
+
+// Scheme is the URI scheme used to identify the public key of a peer in a
+// certificate.
+const Scheme = "noisy"
+
+// certificateLifetime is how long minted certificates are valid for. They are
+// not persisted, so a new certificate is normally minted on each start.
+const certificateLifetime = 365 * 24 * time.Hour
+
+// peerConn is a connection that identifies the remote peer, eg. a
+// noisysockets.PeerConn.
+type peerConn interface {
+	net.Conn
+	PeerPublicKey() string
+}
+
+// NewCertificate mints a self-signed certificate identifying the peer with the
+// given (encoded) public key. The DNS names, if any (eg. the name of the peer),
+// are included so that the certificate can also be used by clients that verify
+// host names.
+func NewCertificate(publicKey string, dnsNames ...string) (tls.Certificate, error) {
+	var pk transport.NoisePublicKey
+	if err := pk.FromString(publicKey); err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to parse public key: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: pk.String()},
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(certificateLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     dnsNames,
+		URIs:         []*url.URL{{Scheme: Scheme, Opaque: pk.String()}},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to create certificate: %w", err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// PublicKey returns the encoded public key of the peer a certificate
+// identifies.
+func PublicKey(cert *x509.Certificate) (string, error) {
+	for _, uri := range cert.URIs {
+		if uri.Scheme != Scheme {
+			continue
+		}
+
+		var pk transport.NoisePublicKey
+		if err := pk.FromString(uri.Opaque); err != nil {
+			return "", fmt.Errorf("failed to parse public key: %w", err)
+		}
+
+		return pk.String(), nil
+	}
+
+	return "", errors.New("certificate does not identify a peer")
+}
+
+// VerifyPeer returns a function, suitable for tls.Config.VerifyConnection,
+// that requires the certificate presented by the other side to be valid, and
+// to identify the peer with the given (encoded) public key.
+func VerifyPeer(publicKey string) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("no certificate presented")
+		}
+
+		leaf := cs.PeerCertificates[0]
+
+		// The handshake has already proven that the other side holds the key of
+		// the certificate, as it is self-signed there is no chain to verify.
+		now := time.Now()
+		if now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+			return errors.New("certificate has expired or is not yet valid")
+		}
+
+		certPublicKey, err := PublicKey(leaf)
+		if err != nil {
+			return err
+		}
+
+		if publicKey == "" || certPublicKey != publicKey {
+			return fmt.Errorf("certificate identifies %s, not the connected peer", certPublicKey)
+		}
+
+		return nil
+	}
+}
+
+// Client returns a TLS client connection over a connection with a peer (eg.
+// one returned by NoisySocket.Dial()). The handshake fails unless the server
+// presents a certificate identifying the peer, certificate authorities and
+// host names are not checked.
+func Client(conn net.Conn, config *tls.Config) (*tls.Conn, error) {
+	pc, ok := conn.(peerConn)
+	if !ok {
+		return nil, errors.New("connection does not identify the peer")
+	}
+
+	config = config.Clone()
+	if config == nil {
+		config = &tls.Config{}
+	}
+	// Verification is done by VerifyConnection instead.
+	config.InsecureSkipVerify = true
+	config.VerifyConnection = VerifyPeer(pc.PeerPublicKey())
+
+	return tls.Client(conn, config), nil
+}
+
+// Server returns a TLS server connection over a connection with a peer (eg.
+// one accepted by a listener of a noisy socket). If the config requests client
+// certificates, the handshake fails unless a certificate presented by the
+// client identifies the peer.
+func Server(conn net.Conn, config *tls.Config) (*tls.Conn, error) {
+	pc, ok := conn.(peerConn)
+	if !ok {
+		return nil, errors.New("connection does not identify the peer")
+	}
+
+	config = config.Clone()
+	if config == nil {
+		config = &tls.Config{}
+	}
+
+	if config.ClientAuth != tls.NoClientCert {
+		// Self-signed certificates can't be verified by the standard library.
+		if config.ClientAuth == tls.VerifyClientCertIfGiven {
+			config.ClientAuth = tls.RequestClientCert
+		} else if config.ClientAuth == tls.RequireAndVerifyClientCert {
+			config.ClientAuth = tls.RequireAnyClientCert
+		}
+
+		verifyPeer := VerifyPeer(pc.PeerPublicKey())
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 && config.ClientAuth == tls.RequestClientCert {
+				return nil
+			}
+
+			return verifyPeer(cs)
+		}
+	}
+
+	return tls.Server(conn, config), nil
+}
+
+// NewListener returns a listener that accepts TLS connections from peers, over
+// the connections accepted by the inner listener (eg. one returned by
+// NoisySocket.Listen()). See Server().
+func NewListener(inner net.Listener, config *tls.Config) net.Listener {
+	return &listener{Listener: inner, config: config}
+}
+
+type listener struct {
+	net.Listener
+	config *tls.Config
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConn, err := Server(conn, l.config)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
@@ -0,0 +1,207 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisytls_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/noisysockets/noisysockets/noisytls"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewCertificate(t *testing.T) {
+	privateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	cert, err := noisytls.NewCertificate(privateKey.PublicKey().String(), "server")
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"server"}, cert.Leaf.DNSNames)
+
+	publicKey, err := noisytls.PublicKey(cert.Leaf)
+	require.NoError(t, err)
+	require.Equal(t, privateKey.PublicKey().String(), publicKey)
+
+	verify := noisytls.VerifyPeer(publicKey)
+	require.NoError(t, verify(tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert.Leaf}}))
+
+	_, err = noisytls.NewCertificate("invalid")
+	require.Error(t, err)
+}
+
+func TestNoisySocket_TLS(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	otherPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "server",
+		ListenPort: 12408,
+		PrivateKey: serverPrivateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "client",
+				PublicKey: clientPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.2"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+	})
+
+	serverCert, err := noisytls.NewCertificate(serverPrivateKey.PublicKey().String(), "server")
+	require.NoError(t, err)
+
+	// A certificate claiming to be another peer.
+	otherCert, err := noisytls.NewCertificate(otherPrivateKey.PublicKey().String(), "server")
+	require.NoError(t, err)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) > 0 {
+			publicKey, err := noisytls.PublicKey(r.TLS.PeerCertificates[0])
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+
+			fmt.Fprintf(w, "Hello, %s!", publicKey)
+			return
+		}
+
+		fmt.Fprint(w, "Hello, world!")
+	})
+
+	serve := func(t *testing.T, port int, config *tls.Config) {
+		lis, err := serverSocket.Listen("tcp", fmt.Sprintf(":%d", port))
+		require.NoError(t, err)
+
+		srv := &http.Server{Handler: handler}
+		t.Cleanup(func() {
+			_ = srv.Close()
+		})
+
+		go func() {
+			_ = srv.Serve(noisytls.NewListener(lis, config))
+		}()
+	}
+
+	serve(t, 443, &tls.Config{Certificates: []tls.Certificate{serverCert}})
+	serve(t, 444, &tls.Config{Certificates: []tls.Certificate{otherCert}})
+	serve(t, 445, &tls.Config{Certificates: []tls.Certificate{serverCert}, ClientAuth: tls.RequireAndVerifyClientCert})
+
+	clientSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "client",
+		ListenPort: 12409,
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "server",
+				PublicKey: serverPrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12408",
+				IPs:       []string{"10.7.0.1"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, clientSocket.Close())
+	})
+
+	newClient := func(t *testing.T, config *tls.Config) *http.Client {
+		transport := clientSocket.HTTPTransport()
+		transport.DialTLSContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := clientSocket.DialContext(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+
+			tlsConn, err := noisytls.Client(conn, config)
+			if err != nil {
+				_ = conn.Close()
+				return nil, err
+			}
+
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				_ = conn.Close()
+				return nil, err
+			}
+
+			return tlsConn, nil
+		}
+		t.Cleanup(transport.CloseIdleConnections)
+
+		return &http.Client{Transport: transport, Timeout: 5 * time.Second}
+	}
+
+	get := func(client *http.Client, url string) (string, error) {
+		resp, err := client.Get(url)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	t.Run("Server Certificate", func(t *testing.T) {
+		body, err := get(newClient(t, nil), "https://server/")
+		require.NoError(t, err)
+
+		require.Equal(t, "Hello, world!", body)
+	})
+
+	t.Run("Impersonated Server", func(t *testing.T) {
+		_, err := get(newClient(t, nil), "https://server:444/")
+		require.ErrorContains(t, err, "not the connected peer")
+	})
+
+	t.Run("Client Certificate", func(t *testing.T) {
+		clientCert, err := noisytls.NewCertificate(clientPrivateKey.PublicKey().String())
+		require.NoError(t, err)
+
+		body, err := get(newClient(t, &tls.Config{Certificates: []tls.Certificate{clientCert}}), "https://server:445/")
+		require.NoError(t, err)
+
+		require.Equal(t, fmt.Sprintf("Hello, %s!", clientPrivateKey.PublicKey().String()), body)
+	})
+
+	t.Run("Impersonated Client", func(t *testing.T) {
+		clientCert, err := noisytls.NewCertificate(otherPrivateKey.PublicKey().String())
+		require.NoError(t, err)
+
+		_, err = get(newClient(t, &tls.Config{Certificates: []tls.Certificate{clientCert}}), "https://server:445/")
+		require.Error(t, err)
+	})
+
+	t.Run("Missing Client Certificate", func(t *testing.T) {
+		_, err := get(newClient(t, nil), "https://server:445/")
+		require.Error(t, err)
+	})
+}
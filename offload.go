@@ -0,0 +1,389 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"math/bits"
+	"net/netip"
+	"slices"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// maxOffloadHeaderSize is the largest IP, and TCP, header of a super-packet.
+const maxOffloadHeaderSize = header.IPv6MinimumSize + header.TCPHeaderMaximumSize
+
+// isSuperPacket reports whether an outbound packet was built by the stack for
+// segmentation offload. Such packets may carry more than one segment's worth
+// of payload, and only have a partial TCP checksum.
+func isSuperPacket(pkt *stack.PacketBuffer) bool {
+	switch pkt.GSOOptions.Type {
+	case stack.GSOTCPv4, stack.GSOTCPv6:
+		return true
+	default:
+		return false
+	}
+}
+
+// tcpSegmenter splits the TCP super-packets sent by the stack, into segments
+// that fit the MTU (segmentation offload). So that the stack's TCP, and IP,
+// layers handle a large run of data once, rather than once per segment.
+type tcpSegmenter struct {
+	// data is the remainder of the super-packet being split.
+	data        buffer.Buffer
+	protoNumber tcpip.NetworkProtocolNumber
+	peerAddr    netip.Addr
+	hdr         [maxOffloadHeaderSize]byte
+	ipHdrLen    int
+	tcpHdrLen   int
+	mss         int
+	seq         uint32
+	id          uint16
+	// offset is the offset of the next segment's payload, within data.
+	offset int
+	size   int
+}
+
+// pending reports whether there are segments left to send.
+func (s *tcpSegmenter) pending() bool {
+	return s.size > 0
+}
+
+// reset starts splitting a super-packet, whose destination is peerAddr. The
+// stack only leaves its TCP checksum partially computed, so even super-packets
+// that fit in a single segment must be split.
+func (s *tcpSegmenter) reset(pkt *stack.PacketBuffer, peerAddr netip.Addr) bool {
+	s.ipHdrLen = len(pkt.NetworkHeader().Slice())
+	tcpHdr := header.TCP(pkt.TransportHeader().Slice())
+	if len(tcpHdr) < header.TCPMinimumSize {
+		return false
+	}
+	s.tcpHdrLen = int(tcpHdr.DataOffset())
+
+	hdrLen := s.ipHdrLen + s.tcpHdrLen
+	if hdrLen > len(s.hdr) || hdrLen > pkt.Size() {
+		return false
+	}
+
+	s.data = pkt.ToBuffer()
+	if _, err := s.data.ReadAt(s.hdr[:hdrLen], 0); err != nil && !errors.Is(err, io.EOF) {
+		s.data.Release()
+		return false
+	}
+
+	s.protoNumber = pkt.NetworkProtocolNumber
+	s.peerAddr = peerAddr
+	s.mss = int(pkt.GSOOptions.MSS)
+	s.seq = header.TCP(s.hdr[s.ipHdrLen:hdrLen]).SequenceNumber()
+	if s.protoNumber == header.IPv4ProtocolNumber {
+		s.id = header.IPv4(s.hdr[:s.ipHdrLen]).ID()
+	}
+	s.offset = hdrLen
+	s.size = pkt.Size()
+
+	return true
+}
+
+// next writes the next segment to buf, and returns its size. buf must be large
+// enough to hold a segment of the MSS.
+func (s *tcpSegmenter) next(buf []byte) int {
+	hdrLen := s.ipHdrLen + s.tcpHdrLen
+
+	payloadLen := s.size - s.offset
+	if s.mss > 0 && payloadLen > s.mss {
+		payloadLen = s.mss
+	}
+	first := s.offset == hdrLen
+	last := s.offset+payloadLen == s.size
+
+	copy(buf, s.hdr[:hdrLen])
+	payload := buf[hdrLen : hdrLen+payloadLen]
+	_, _ = s.data.ReadAt(payload, int64(s.offset))
+
+	tcpLen := s.tcpHdrLen + payloadLen
+
+	var src, dst tcpip.Address
+	if s.protoNumber == header.IPv4ProtocolNumber {
+		ipHdr := header.IPv4(buf[:s.ipHdrLen])
+		ipHdr.SetTotalLength(uint16(hdrLen + payloadLen))
+		ipHdr.SetID(s.id)
+		ipHdr.SetChecksum(0)
+		ipHdr.SetChecksum(^ipHdr.CalculateChecksum())
+		src, dst = ipHdr.SourceAddress(), ipHdr.DestinationAddress()
+		s.id++
+	} else {
+		ipHdr := header.IPv6(buf[:s.ipHdrLen])
+		ipHdr.SetPayloadLength(uint16(tcpLen))
+		src, dst = ipHdr.SourceAddress(), ipHdr.DestinationAddress()
+	}
+
+	tcpHdr := header.TCP(buf[s.ipHdrLen:hdrLen])
+	tcpHdr.SetSequenceNumber(s.seq + uint32(s.offset-hdrLen))
+
+	// Like a NIC would, only the last segment pushes (or finishes), and only
+	// the first signals congestion window reduction.
+	flags := tcpHdr.Flags()
+	if !last {
+		flags &^= header.TCPFlagFin | header.TCPFlagPsh
+	}
+	if !first {
+		flags &^= header.TCPFlagCwr
+	}
+	tcpHdr.SetFlags(uint8(flags))
+
+	tcpHdr.SetChecksum(0)
+	xsum := header.PseudoHeaderChecksum(header.TCPProtocolNumber, src, dst, uint16(tcpLen))
+	xsum = checksum.Checksum(payload, xsum)
+	tcpHdr.SetChecksum(^tcpHdr.CalculateChecksum(xsum))
+
+	s.offset += payloadLen
+	if last {
+		s.data.Release()
+		s.size = 0
+	}
+
+	return hdrLen + payloadLen
+}
+
+// inboundDeliverer delivers an inbound packet, whose headers are hdr, to the
+// stack.
+type inboundDeliverer func(protoNumber tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer, hdr []byte)
+
+// tcpCoalescer merges consecutive TCP segments of a flow, received from a peer
+// for one of our own addresses, into a single super-packet (receive offload).
+// So that the stack handles a run of segments at once, rather than one at a
+// time.
+type tcpCoalescer struct {
+	localAddrs *localAddrSet
+
+	// The run of segments being merged, head is the first of them.
+	head        *buffer.View
+	data        buffer.Buffer
+	protoNumber tcpip.NetworkProtocolNumber
+	ipHdrLen    int
+	tcpHdrLen   int
+	// segmentSize is the payload size of the first segment, only the last
+	// segment of a run may be smaller.
+	segmentSize int
+	payloadLen  int
+	// payloadSum is the checksum of the merged payloads.
+	payloadSum uint16
+	nextSeq    uint32
+	segments   int
+	// done is set once a segment smaller than segmentSize has been merged.
+	done bool
+}
+
+// add merges a segment into the current run (or starts a new one), and reports
+// whether the coalescer took ownership of it. Segments it doesn't take must be
+// delivered after the current run is flushed, so that they aren't reordered.
+func (c *tcpCoalescer) add(protoNumber tcpip.NetworkProtocolNumber, v *buffer.View, deliver inboundDeliverer) bool {
+	pkt := v.AsSlice()
+
+	ipHdrLen, tcpHdrLen, payloadSum, ok := c.eligible(protoNumber, pkt)
+	if !ok {
+		return false
+	}
+
+	hdrLen := ipHdrLen + tcpHdrLen
+	payloadLen := len(pkt) - hdrLen
+	tcpHdr := header.TCP(pkt[ipHdrLen:hdrLen])
+
+	if c.head != nil && c.canAppend(protoNumber, pkt, ipHdrLen, tcpHdrLen, payloadLen) {
+		// The checksum of data at an odd offset is byte swapped.
+		if c.payloadLen%2 == 1 {
+			payloadSum = bits.RotateLeft16(payloadSum, 8)
+		}
+		c.payloadSum = checksum.Combine(c.payloadSum, payloadSum)
+		c.payloadLen += payloadLen
+		c.nextSeq += uint32(payloadLen)
+		c.segments++
+		c.done = payloadLen < c.segmentSize
+
+		// Pushed data ends the run.
+		if tcpHdr.Flags()&header.TCPFlagPsh != 0 {
+			headTCP := header.TCP(c.head.AsSlice()[c.ipHdrLen : c.ipHdrLen+c.tcpHdrLen])
+			headTCP.SetFlags(uint8(headTCP.Flags() | header.TCPFlagPsh))
+			c.done = true
+		}
+
+		v.TrimFront(hdrLen)
+		_ = c.data.Append(v)
+
+		if c.done {
+			c.flush(deliver)
+		}
+
+		return true
+	}
+
+	c.flush(deliver)
+
+	// A pushed segment is delivered straight away.
+	if tcpHdr.Flags()&header.TCPFlagPsh != 0 {
+		return false
+	}
+
+	c.head = v
+	c.data = buffer.MakeWithView(v)
+	c.protoNumber = protoNumber
+	c.ipHdrLen = ipHdrLen
+	c.tcpHdrLen = tcpHdrLen
+	c.segmentSize = payloadLen
+	c.payloadLen = payloadLen
+	c.payloadSum = payloadSum
+	c.nextSeq = tcpHdr.SequenceNumber() + uint32(payloadLen)
+	c.segments = 1
+	c.done = false
+
+	return true
+}
+
+// flush delivers the current run, if any.
+func (c *tcpCoalescer) flush(deliver inboundDeliverer) {
+	if c.head == nil {
+		return
+	}
+
+	hdr := c.head.AsSlice()[:c.ipHdrLen+c.tcpHdrLen]
+
+	// A single segment is delivered as it arrived.
+	if c.segments > 1 {
+		var src, dst tcpip.Address
+		if c.protoNumber == header.IPv4ProtocolNumber {
+			ipHdr := header.IPv4(hdr)
+			ipHdr.SetTotalLength(uint16(len(hdr) + c.payloadLen))
+			ipHdr.SetChecksum(0)
+			ipHdr.SetChecksum(^ipHdr.CalculateChecksum())
+			src, dst = ipHdr.SourceAddress(), ipHdr.DestinationAddress()
+		} else {
+			ipHdr := header.IPv6(hdr)
+			ipHdr.SetPayloadLength(uint16(c.tcpHdrLen + c.payloadLen))
+			src, dst = ipHdr.SourceAddress(), ipHdr.DestinationAddress()
+		}
+
+		tcpHdr := header.TCP(hdr[c.ipHdrLen:])
+		tcpHdr.SetChecksum(0)
+		xsum := header.PseudoHeaderChecksum(header.TCPProtocolNumber, src, dst, uint16(c.tcpHdrLen+c.payloadLen))
+		xsum = checksum.Combine(xsum, c.payloadSum)
+		tcpHdr.SetChecksum(^tcpHdr.CalculateChecksum(xsum))
+	}
+
+	deliver(c.protoNumber, stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: c.data}), hdr)
+
+	c.head = nil
+	c.data = buffer.Buffer{}
+}
+
+// eligible reports whether a segment can be merged with others. It must be a
+// data carrying TCP segment, with a valid checksum, and nothing unusual about
+// it (eg. IP options, or fragmentation), addressed to one of our addresses. It
+// returns the size of the segment's headers, and the checksum of its payload.
+func (c *tcpCoalescer) eligible(protoNumber tcpip.NetworkProtocolNumber, pkt []byte) (int, int, uint16, bool) {
+	var ipHdrLen int
+	var src, dst tcpip.Address
+	switch protoNumber {
+	case header.IPv4ProtocolNumber:
+		ipHdr := header.IPv4(pkt)
+		if ipHdr.HeaderLength() != header.IPv4MinimumSize || ipHdr.TransportProtocol() != header.TCPProtocolNumber ||
+			ipHdr.More() || ipHdr.FragmentOffset() != 0 || int(ipHdr.TotalLength()) != len(pkt) {
+			return 0, 0, 0, false
+		}
+		ipHdrLen = header.IPv4MinimumSize
+		src, dst = ipHdr.SourceAddress(), ipHdr.DestinationAddress()
+	case header.IPv6ProtocolNumber:
+		ipHdr := header.IPv6(pkt)
+		if ipHdr.NextHeader() != uint8(header.TCPProtocolNumber) || header.IPv6MinimumSize+int(ipHdr.PayloadLength()) != len(pkt) {
+			return 0, 0, 0, false
+		}
+		ipHdrLen = header.IPv6MinimumSize
+		src, dst = ipHdr.SourceAddress(), ipHdr.DestinationAddress()
+	default:
+		return 0, 0, 0, false
+	}
+
+	// Forwarded packets must still fit the MTU of the next hop.
+	if !slices.Contains(c.localAddrs.load(), addrFromTCPIP(dst)) {
+		return 0, 0, 0, false
+	}
+
+	tcpHdr := header.TCP(pkt[ipHdrLen:])
+	if len(tcpHdr) < header.TCPMinimumSize {
+		return 0, 0, 0, false
+	}
+
+	tcpHdrLen := int(tcpHdr.DataOffset())
+	if tcpHdrLen < header.TCPMinimumSize || ipHdrLen+tcpHdrLen >= len(pkt) {
+		return 0, 0, 0, false
+	}
+
+	if flags := tcpHdr.Flags(); flags&^header.TCPFlagPsh != header.TCPFlagAck {
+		return 0, 0, 0, false
+	}
+
+	// Merging hides the checksums of the individual segments from the stack,
+	// so they're checked here instead.
+	tcpLen := len(pkt) - ipHdrLen
+	payloadSum := checksum.Checksum(pkt[ipHdrLen+tcpHdrLen:], 0)
+	xsum := header.PseudoHeaderChecksum(header.TCPProtocolNumber, src, dst, uint16(tcpLen))
+	if tcpHdr.CalculateChecksum(checksum.Combine(xsum, payloadSum)) != 0xffff {
+		return 0, 0, 0, false
+	}
+
+	return ipHdrLen, tcpHdrLen, payloadSum, true
+}
+
+// canAppend reports whether an eligible segment continues the current run.
+func (c *tcpCoalescer) canAppend(protoNumber tcpip.NetworkProtocolNumber, pkt []byte, ipHdrLen, tcpHdrLen, payloadLen int) bool {
+	if c.done || protoNumber != c.protoNumber || ipHdrLen != c.ipHdrLen || tcpHdrLen != c.tcpHdrLen ||
+		payloadLen > c.segmentSize || c.ipHdrLen+c.tcpHdrLen+c.payloadLen+payloadLen > math.MaxUint16 {
+		return false
+	}
+
+	head := c.head.AsSlice()
+
+	// Everything but the lengths, and checksums, of the IP headers must match.
+	if protoNumber == header.IPv4ProtocolNumber {
+		headIP, ipHdr := header.IPv4(head), header.IPv4(pkt)
+		headTOS, _ := headIP.TOS()
+		tos, _ := ipHdr.TOS()
+		if headTOS != tos || headIP.TTL() != ipHdr.TTL() || headIP.Flags() != ipHdr.Flags() ||
+			headIP.SourceAddress() != ipHdr.SourceAddress() || headIP.DestinationAddress() != ipHdr.DestinationAddress() {
+			return false
+		}
+	} else {
+		headIP, ipHdr := header.IPv6(head), header.IPv6(pkt)
+		headTC, headFlow := headIP.TOS()
+		tc, flow := ipHdr.TOS()
+		if headTC != tc || headFlow != flow || headIP.HopLimit() != ipHdr.HopLimit() ||
+			headIP.SourceAddress() != ipHdr.SourceAddress() || headIP.DestinationAddress() != ipHdr.DestinationAddress() {
+			return false
+		}
+	}
+
+	// The segment must follow on from the run, and be part of the same flow,
+	// with the same acknowledgement, window, and options.
+	headTCP, tcpHdr := header.TCP(head[c.ipHdrLen:]), header.TCP(pkt[ipHdrLen:])
+	return tcpHdr.SequenceNumber() == c.nextSeq &&
+		tcpHdr.SourcePort() == headTCP.SourcePort() &&
+		tcpHdr.DestinationPort() == headTCP.DestinationPort() &&
+		tcpHdr.AckNumber() == headTCP.AckNumber() &&
+		tcpHdr.WindowSize() == headTCP.WindowSize() &&
+		bytes.Equal(tcpHdr[header.TCPMinimumSize:tcpHdrLen], headTCP[header.TCPMinimumSize:c.tcpHdrLen])
+}
+
+func addrFromTCPIP(addr tcpip.Address) netip.Addr {
+	a, _ := netip.AddrFromSlice(addr.AsSlice())
+	return a
+}
@@ -0,0 +1,227 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+func TestOffload(t *testing.T) {
+	const mss = 1000
+
+	payload := make([]byte, 4*mss+123)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		src, dst netip.Addr
+	}{
+		{name: "IPv4", src: netip.MustParseAddr("10.7.0.1"), dst: netip.MustParseAddr("10.7.0.2")},
+		{name: "IPv6", src: netip.MustParseAddr("fd00::1"), dst: netip.MustParseAddr("fd00::2")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			segments := segmentTestSuperPacket(t, tc.src, tc.dst, payload, mss)
+			require.Len(t, segments, 5)
+
+			var received []byte
+			for i, segment := range segments {
+				tcpHdr, segmentPayload := checkTestSegment(t, tc.dst, segment)
+				require.Equal(t, uint32(1000+i*mss), tcpHdr.SequenceNumber())
+
+				// Only the last segment pushes.
+				require.Equal(t, i == len(segments)-1, tcpHdr.Flags()&header.TCPFlagPsh != 0)
+
+				received = append(received, segmentPayload...)
+			}
+			require.Equal(t, payload, received)
+
+			t.Run("Coalesce", func(t *testing.T) {
+				c := tcpCoalescer{localAddrs: newLocalAddrSet([]netip.Addr{tc.dst})}
+
+				var delivered [][]byte
+				deliver := newTestDeliverer(&delivered)
+
+				for _, segment := range segments {
+					require.True(t, c.add(protoNumberOf(tc.dst), buffer.NewViewWithData(segment), deliver))
+				}
+				c.flush(deliver)
+
+				// The pushed segment ends the run, so it's delivered straight away.
+				require.Len(t, delivered, 1)
+
+				tcpHdr, coalescedPayload := checkTestSegment(t, tc.dst, delivered[0])
+				require.Equal(t, uint32(1000), tcpHdr.SequenceNumber())
+				require.NotZero(t, tcpHdr.Flags()&header.TCPFlagPsh)
+				require.Equal(t, payload, coalescedPayload)
+			})
+
+			t.Run("Out Of Order", func(t *testing.T) {
+				c := tcpCoalescer{localAddrs: newLocalAddrSet([]netip.Addr{tc.dst})}
+
+				var delivered [][]byte
+				deliver := newTestDeliverer(&delivered)
+
+				require.True(t, c.add(protoNumberOf(tc.dst), buffer.NewViewWithData(segments[0]), deliver))
+				require.True(t, c.add(protoNumberOf(tc.dst), buffer.NewViewWithData(segments[2]), deliver))
+				c.flush(deliver)
+
+				require.Equal(t, [][]byte{segments[0], segments[2]}, delivered)
+			})
+
+			t.Run("Not Local", func(t *testing.T) {
+				c := tcpCoalescer{localAddrs: newLocalAddrSet([]netip.Addr{tc.src})}
+
+				var delivered [][]byte
+				require.False(t, c.add(protoNumberOf(tc.dst), buffer.NewViewWithData(segments[0]), newTestDeliverer(&delivered)))
+				require.Empty(t, delivered)
+			})
+
+			t.Run("Bad Checksum", func(t *testing.T) {
+				c := tcpCoalescer{localAddrs: newLocalAddrSet([]netip.Addr{tc.dst})}
+
+				segment := append([]byte(nil), segments[0]...)
+				segment[len(segment)-1] ^= 0xff
+
+				var delivered [][]byte
+				require.False(t, c.add(protoNumberOf(tc.dst), buffer.NewViewWithData(segment), newTestDeliverer(&delivered)))
+			})
+		})
+	}
+
+	t.Run("No Payload", func(t *testing.T) {
+		src, dst := netip.MustParseAddr("10.7.0.1"), netip.MustParseAddr("10.7.0.2")
+
+		// Eg. an acknowledgement, it still needs its checksum completed.
+		segments := segmentTestSuperPacket(t, src, dst, nil, mss)
+		require.Len(t, segments, 1)
+
+		_, segmentPayload := checkTestSegment(t, dst, segments[0])
+		require.Empty(t, segmentPayload)
+	})
+}
+
+// segmentTestSuperPacket builds a super-packet, like the stack's TCP would, and
+// returns the segments it is split into.
+func segmentTestSuperPacket(t *testing.T, src, dst netip.Addr, payload []byte, mss uint16) [][]byte {
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		ReserveHeaderBytes: maxOffloadHeaderSize,
+		Payload:            buffer.MakeWithData(payload),
+	})
+	defer pkt.DecRef()
+
+	tcpHdr := header.TCP(pkt.TransportHeader().Push(header.TCPMinimumSize))
+	tcpHdr.Encode(&header.TCPFields{
+		SrcPort:    80,
+		DstPort:    12345,
+		SeqNum:     1000,
+		AckNum:     1,
+		DataOffset: header.TCPMinimumSize,
+		Flags:      header.TCPFlagAck | header.TCPFlagPsh,
+		WindowSize: 65535,
+	})
+	pkt.TransportProtocolNumber = header.TCPProtocolNumber
+
+	srcAddr, dstAddr := tcpip.AddrFromSlice(src.AsSlice()), tcpip.AddrFromSlice(dst.AsSlice())
+	tcpLen := header.TCPMinimumSize + len(payload)
+
+	pkt.NetworkProtocolNumber = protoNumberOf(dst)
+	if dst.Is4() {
+		ipHdr := header.IPv4(pkt.NetworkHeader().Push(header.IPv4MinimumSize))
+		ipHdr.Encode(&header.IPv4Fields{
+			TotalLength: uint16(header.IPv4MinimumSize + tcpLen),
+			ID:          7,
+			TTL:         64,
+			Protocol:    uint8(header.TCPProtocolNumber),
+			SrcAddr:     srcAddr,
+			DstAddr:     dstAddr,
+		})
+		pkt.GSOOptions = stack.GSO{Type: stack.GSOTCPv4, L3HdrLen: header.IPv4MinimumSize}
+	} else {
+		header.IPv6(pkt.NetworkHeader().Push(header.IPv6MinimumSize)).Encode(&header.IPv6Fields{
+			PayloadLength:     uint16(tcpLen),
+			TransportProtocol: header.TCPProtocolNumber,
+			HopLimit:          64,
+			SrcAddr:           srcAddr,
+			DstAddr:           dstAddr,
+		})
+		pkt.GSOOptions = stack.GSO{Type: stack.GSOTCPv6, L3HdrLen: header.IPv6MinimumSize}
+	}
+
+	// Like the stack, only the pseudo-header is checksummed.
+	pkt.GSOOptions.NeedsCsum = true
+	pkt.GSOOptions.MSS = mss
+	tcpHdr.SetChecksum(header.PseudoHeaderChecksum(header.TCPProtocolNumber, srcAddr, dstAddr, 0))
+
+	require.True(t, isSuperPacket(pkt))
+
+	var s tcpSegmenter
+	require.True(t, s.reset(pkt, dst))
+
+	var segments [][]byte
+	for s.pending() {
+		buf := make([]byte, 2048)
+		n := s.next(buf)
+		require.LessOrEqual(t, n, maxOffloadHeaderSize+int(mss))
+		segments = append(segments, buf[:n])
+	}
+
+	return segments
+}
+
+// checkTestSegment checks the headers, and checksums, of a TCP segment, and
+// returns its TCP header, and payload.
+func checkTestSegment(t *testing.T, dst netip.Addr, segment []byte) (header.TCP, []byte) {
+	var src, dstAddr tcpip.Address
+	var transport []byte
+	if dst.Is4() {
+		ipHdr := header.IPv4(segment)
+		require.True(t, ipHdr.IsValid(len(segment)))
+		require.True(t, ipHdr.IsChecksumValid())
+		src, dstAddr, transport = ipHdr.SourceAddress(), ipHdr.DestinationAddress(), ipHdr.Payload()
+	} else {
+		ipHdr := header.IPv6(segment)
+		require.True(t, ipHdr.IsValid(len(segment)))
+		src, dstAddr, transport = ipHdr.SourceAddress(), ipHdr.DestinationAddress(), ipHdr.Payload()
+	}
+	require.Equal(t, dst.AsSlice(), dstAddr.AsSlice())
+
+	tcpHdr := header.TCP(transport)
+	payload := tcpHdr.Payload()
+	require.True(t, tcpHdr.IsChecksumValid(src, dstAddr, checksum.Checksum(payload, 0), uint16(len(payload))))
+
+	return tcpHdr, payload
+}
+
+// newTestDeliverer returns a deliverer that appends the packets it is given to
+// delivered.
+func newTestDeliverer(delivered *[][]byte) inboundDeliverer {
+	return func(_ tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer, _ []byte) {
+		defer pkt.DecRef()
+
+		data := pkt.ToBuffer()
+		defer data.Release()
+
+		*delivered = append(*delivered, data.Flatten())
+	}
+}
+
+func protoNumberOf(addr netip.Addr) tcpip.NetworkProtocolNumber {
+	if addr.Is4() {
+		return header.IPv4ProtocolNumber
+	}
+
+	return header.IPv6ProtocolNumber
+}
@@ -0,0 +1,316 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// listenBacklog is the maximum number of pending connections of a listener,
+// it matches the default of gonet (and common Linux distributions).
+const listenBacklog = 4096
+
+var (
+	_ PeerConn   = (*tcpPeerConn)(nil)
+	_ PeerConn   = (*udpPeerConn)(nil)
+	_ halfCloser = (*tcpPeerConn)(nil)
+	_ Listener   = (*peerListener)(nil)
+)
+
+// PeerConn is a connection with a peer. Connections returned by Dial() and
+// Accept() implement PeerConn, exposing the cryptographic identity of the peer
+// responsible for the remote address. This can be used for authorization
+// instead of relying upon IP addresses.
+//
+// For addresses routed via a peer (eg. a subnet router or default gateway),
+// the identity is that of the routing peer.
+//
+// Like *net.TCPConn, TCP connections also implement CloseRead() and
+// CloseWrite(), so that either direction can be shut down on its own (eg. to
+// signal the end of a request with a FIN), and SetKeepAlive(),
+// SetKeepAlivePeriod(), SetNoDelay(), and SetLinger(). They also implement io.ReaderFrom
+// and io.WriterTo, so that io.Copy avoids extra copies, and
+// WriteBuffers(net.Buffers), for vectored writes.
+type PeerConn interface {
+	net.Conn
+	// PeerName returns the name of the remote peer, or an empty string if the
+	// peer has no name.
+	PeerName() string
+	// PeerPublicKey returns the encoded public key of the remote peer, or an
+	// empty string if the remote address doesn't belong to a peer.
+	PeerPublicKey() string
+}
+
+// halfCloser is a connection whose directions can be shut down separately.
+type halfCloser interface {
+	CloseRead() error
+	CloseWrite() error
+}
+
+type peerIdentity struct {
+	name      string
+	publicKey transport.NoisePublicKey
+}
+
+func (p *peerIdentity) PeerName() string {
+	return p.name
+}
+
+func (p *peerIdentity) PeerPublicKey() string {
+	if p.publicKey.IsZero() {
+		return ""
+	}
+
+	return p.publicKey.String()
+}
+
+type tcpPeerConn struct {
+	*tcpConn
+	peerIdentity
+}
+
+type udpPeerConn struct {
+	*gonet.UDPConn
+	peerIdentity
+}
+
+// Read is like gonet.UDPConn.Read, but errors reported by ICMP messages match
+// their syscall equivalents (eg. syscall.ECONNREFUSED).
+func (c *udpPeerConn) Read(b []byte) (int, error) {
+	n, err := c.UDPConn.Read(b)
+	return n, mapICMPErr(err)
+}
+
+// Write is like gonet.UDPConn.Write, but errors reported by ICMP messages
+// match their syscall equivalents (eg. syscall.ECONNREFUSED).
+func (c *udpPeerConn) Write(b []byte) (int, error) {
+	n, err := c.UDPConn.Write(b)
+	return n, mapICMPErr(err)
+}
+
+// Listener is a TCP listener. Listeners returned by Listen() implement
+// Listener, so that a blocked Accept() can be interrupted (eg. during a
+// graceful shutdown) without closing the listener.
+type Listener interface {
+	net.Listener
+	// AcceptContext waits for and returns the next connection, or returns an
+	// error once the context is done.
+	AcceptContext(ctx context.Context) (net.Conn, error)
+	// SetDeadline sets the deadline for pending and future Accept calls, a zero
+	// value means Accept will not time out.
+	SetDeadline(t time.Time) error
+}
+
+// peerListener is a TCP listener that returns connections identifying the peer.
+type peerListener struct {
+	*gonet.TCPListener
+	n           *noisyNet
+	ep          tcpip.Endpoint
+	wq          *waiter.Queue
+	protoNumber tcpip.NetworkProtocolNumber
+	filter      *listenerFilter
+
+	deadlineMu      sync.Mutex // protects deadline and deadlineChanged
+	deadline        time.Time
+	deadlineChanged chan struct{} // closed when the deadline is changed
+}
+
+func (n *noisyNet) newPeerListener(addr tcpip.FullAddress, protoNumber tcpip.NetworkProtocolNumber, opts *listenOptions, filter *listenerFilter) (*peerListener, error) {
+	var wq waiter.Queue
+	tcpAddr := &net.TCPAddr{IP: net.IP(addr.Addr.AsSlice()), Port: int(addr.Port)}
+
+	ep, err := n.newEndpoint(tcp.ProtocolNumber, protoNumber, &wq)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: "tcp", Addr: tcpAddr, Err: err}
+	}
+
+	opts.apply(ep)
+
+	if tcpErr := ep.Bind(addr); tcpErr != nil {
+		ep.Close()
+		return nil, &net.OpError{Op: "bind", Net: "tcp", Addr: tcpAddr, Err: mapTCPIPErr(tcpErr)}
+	}
+
+	if tcpErr := ep.Listen(listenBacklog); tcpErr != nil {
+		ep.Close()
+		return nil, &net.OpError{Op: "listen", Net: "tcp", Addr: tcpAddr, Err: mapTCPIPErr(tcpErr)}
+	}
+
+	return &peerListener{
+		TCPListener:     gonet.NewTCPListener(n.stack, &wq, ep),
+		n:               n,
+		ep:              ep,
+		wq:              &wq,
+		protoNumber:     protoNumber,
+		filter:          filter,
+		deadlineChanged: make(chan struct{}),
+	}, nil
+}
+
+func (l *peerListener) Close() error {
+	err := l.TCPListener.Close()
+
+	if l.filter != nil {
+		l.n.listenerFilters.remove(l.filter)
+	}
+
+	return err
+}
+
+// Addr returns the listener's address, including the port assigned to it when
+// listening on port zero. Like the net package, the address of a listener
+// bound to the wildcard address is unspecified (eg. 0.0.0.0), rather than
+// empty.
+func (l *peerListener) Addr() net.Addr {
+	addr := l.TCPListener.Addr().(*net.TCPAddr)
+	if len(addr.IP) == 0 {
+		if l.protoNumber == ipv4.ProtocolNumber {
+			addr.IP = net.IPv4zero
+		} else {
+			addr.IP = net.IPv6unspecified
+		}
+	}
+
+	return addr
+}
+
+func (l *peerListener) Accept() (net.Conn, error) {
+	return l.AcceptContext(context.Background())
+}
+
+func (l *peerListener) AcceptContext(ctx context.Context) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, l.newOpError(mapErr(err))
+	}
+
+	// Register for notifications before accepting, so that none are missed.
+	waitEntry, notifyCh := waiter.NewChannelEntry(waiter.ReadableEvents)
+	l.wq.EventRegister(&waitEntry)
+	defer l.wq.EventUnregister(&waitEntry)
+
+	for {
+		ep, wq, tcpErr := l.ep.Accept(nil)
+		if tcpErr == nil && l.n.overEndpointLimit() {
+			// Reset the connection, rather than leaving the peer waiting.
+			ep.Abort()
+			continue
+		}
+		if tcpErr == nil {
+			tcpConn := newTCPConn(wq, l.n.connBytes.track(ep, wq))
+
+			conn := &tcpPeerConn{
+				tcpConn:      tcpConn,
+				peerIdentity: l.n.peerIdentity(tcpConn.RemoteAddr()),
+			}
+
+			if tracer := l.n.loadTracer(); tracer != nil {
+				return l.traceAccept(tracer, conn), nil
+			}
+
+			return conn, nil
+		}
+
+		if _, ok := tcpErr.(*tcpip.ErrWouldBlock); !ok {
+			return nil, l.newOpError(mapAcceptErr(tcpErr))
+		}
+
+		l.deadlineMu.Lock()
+		deadline, deadlineChanged := l.deadline, l.deadlineChanged
+		l.deadlineMu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return nil, l.newOpError(os.ErrDeadlineExceeded)
+			}
+
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		var err error
+		select {
+		case <-ctx.Done():
+			err = mapErr(ctx.Err())
+		case <-timeout:
+			err = os.ErrDeadlineExceeded
+		case <-deadlineChanged:
+		case <-notifyCh:
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+
+		if err != nil {
+			return nil, l.newOpError(err)
+		}
+	}
+}
+
+func (l *peerListener) SetDeadline(t time.Time) error {
+	l.deadlineMu.Lock()
+	defer l.deadlineMu.Unlock()
+
+	l.deadline = t
+
+	// Wake up any pending Accept calls, so that they pick up the new deadline.
+	close(l.deadlineChanged)
+	l.deadlineChanged = make(chan struct{})
+
+	return nil
+}
+
+func (l *peerListener) newOpError(err error) *net.OpError {
+	return &net.OpError{Op: "accept", Net: "tcp", Addr: l.Addr(), Err: err}
+}
+
+// peerIdentity returns the identity of the peer responsible for the given address.
+func (n *noisyNet) peerIdentity(addr net.Addr) peerIdentity {
+	var ip netip.Addr
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.AddrPort().Addr()
+	case *net.UDPAddr:
+		ip = addr.AddrPort().Addr()
+	default:
+		return peerIdentity{}
+	}
+	// Peers are looked up by their IPv4, not IPv4-mapped, addresses.
+	ip = ip.Unmap()
+
+	n.peersMu.RLock()
+	defer n.peersMu.RUnlock()
+
+	publicKey, ok := n.fromPeerAddress.Lookup(ip)
+	if !ok {
+		return peerIdentity{}
+	}
+
+	identity := peerIdentity{publicKey: publicKey}
+	for name, pk := range n.peerNames {
+		if pk == publicKey {
+			identity.name = name
+			break
+		}
+	}
+
+	return identity
+}
@@ -0,0 +1,428 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets_test
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoisySocket_PeerConn(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "server",
+		ListenPort: 12364,
+		PrivateKey: serverPrivateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "client",
+				PublicKey: clientPrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12365",
+				IPs:       []string{"10.7.0.2"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+	})
+
+	clientSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "client",
+		ListenPort: 12365,
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				// Unnamed, so only the public key is known.
+				PublicKey: serverPrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12364",
+				IPs:       []string{"10.7.0.1"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, clientSocket.Close())
+	})
+
+	lis, err := serverSocket.Listen("tcp", "10.7.0.1:80")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = lis.Close()
+	})
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+
+	conn, err := clientSocket.DialTimeout("tcp", "10.7.0.1:80", 5*time.Second)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	dialedConn, ok := conn.(noisysockets.PeerConn)
+	require.True(t, ok)
+	require.Empty(t, dialedConn.PeerName())
+	require.Equal(t, serverPrivateKey.PublicKey().String(), dialedConn.PeerPublicKey())
+
+	var acceptedConn net.Conn
+	select {
+	case acceptedConn = <-accepted:
+		require.NotNil(t, acceptedConn)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for connection")
+	}
+	t.Cleanup(func() {
+		_ = acceptedConn.Close()
+	})
+
+	peerConn, ok := acceptedConn.(noisysockets.PeerConn)
+	require.True(t, ok)
+	require.Equal(t, "client", peerConn.PeerName())
+	require.Equal(t, clientPrivateKey.PublicKey().String(), peerConn.PeerPublicKey())
+
+	udpConn, err := clientSocket.Dial("udp", "10.7.0.1:53")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = udpConn.Close()
+	})
+
+	require.Equal(t, serverPrivateKey.PublicKey().String(), udpConn.(noisysockets.PeerConn).PeerPublicKey())
+}
+
+func TestNoisySocket_Listener(t *testing.T) {
+	logger := slogt.New(t)
+
+	privateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	socket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "server",
+		ListenPort: 12400,
+		PrivateKey: privateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, socket.Close())
+	})
+
+	netLis, err := socket.Listen("tcp", "10.7.0.1:80")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = netLis.Close()
+	})
+
+	lis, ok := netLis.(noisysockets.Listener)
+	require.True(t, ok)
+
+	t.Run("Accept", func(t *testing.T) {
+		// Local connections are handled by the stack.
+		conn, err := socket.Dial("tcp", "10.7.0.1:80")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		t.Cleanup(cancel)
+
+		acceptedConn, err := lis.AcceptContext(ctx)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = acceptedConn.Close()
+		})
+
+		require.Equal(t, conn.LocalAddr().String(), acceptedConn.RemoteAddr().String())
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(100*time.Millisecond, cancel)
+
+		_, err := lis.AcceptContext(ctx)
+		require.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("Deadline", func(t *testing.T) {
+		require.NoError(t, lis.SetDeadline(time.Now().Add(100*time.Millisecond)))
+		t.Cleanup(func() {
+			require.NoError(t, lis.SetDeadline(time.Time{}))
+		})
+
+		start := time.Now()
+		_, err := lis.Accept()
+		require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+		require.Less(t, time.Since(start), time.Second)
+
+		var netErr net.Error
+		require.ErrorAs(t, err, &netErr)
+		require.True(t, netErr.Timeout())
+	})
+
+	t.Run("Deadline Changed", func(t *testing.T) {
+		// Pending calls pick up a new deadline.
+		time.AfterFunc(100*time.Millisecond, func() {
+			_ = lis.SetDeadline(time.Now())
+		})
+		t.Cleanup(func() {
+			require.NoError(t, lis.SetDeadline(time.Time{}))
+		})
+
+		_, err := lis.Accept()
+		require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		time.AfterFunc(100*time.Millisecond, func() {
+			_ = lis.Close()
+		})
+
+		_, err := lis.Accept()
+		require.Error(t, err)
+	})
+}
+
+func TestNoisySocket_ReachableAddrs(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverSocket, clientSocket, err := noisysockets.Pipe(logger, &v1alpha1.Config{
+		Name:       "server",
+		PrivateKey: serverPrivateKey.String(),
+		IPs:        []string{"10.7.0.1", "fd00::1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "client",
+				PublicKey: clientPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.2", "fd00::2"},
+			},
+		},
+	}, &v1alpha1.Config{
+		Name:       "client",
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.2", "fd00::2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "server",
+				PublicKey: serverPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.1", "fd00::1"},
+			},
+		},
+	}, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, clientSocket.Close())
+		require.NoError(t, serverSocket.Close())
+	})
+
+	listen := func(t *testing.T, address string) (net.Listener, uint16) {
+		lis, err := serverSocket.Listen("tcp", address)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = lis.Close()
+		})
+
+		go func() {
+			for {
+				conn, err := lis.Accept()
+				if err != nil {
+					return
+				}
+				_ = conn.Close()
+			}
+		}()
+
+		port := lis.Addr().(*net.TCPAddr).Port
+		require.NotZero(t, port)
+
+		return lis, uint16(port)
+	}
+
+	// Peers must be able to connect to every advertised address.
+	requireReachable := func(t *testing.T, addrs []netip.AddrPort) {
+		for _, addr := range addrs {
+			conn, err := clientSocket.DialTimeout("tcp", addr.String(), 5*time.Second)
+			require.NoError(t, err, addr)
+			require.NoError(t, conn.Close())
+		}
+	}
+
+	t.Run("Ephemeral Port", func(t *testing.T) {
+		lis, port := listen(t, ":0")
+
+		addrs, err := serverSocket.ReachableAddrs(lis.Addr())
+		require.NoError(t, err)
+		require.Equal(t, []netip.AddrPort{netip.AddrPortFrom(netip.MustParseAddr("10.7.0.1"), port)}, addrs)
+
+		requireReachable(t, addrs)
+	})
+
+	t.Run("IPv6 Wildcard", func(t *testing.T) {
+		lis, port := listen(t, "[::]:0")
+		require.Equal(t, net.JoinHostPort("::", strconv.Itoa(int(port))), lis.Addr().String())
+
+		addrs, err := serverSocket.ReachableAddrs(lis.Addr())
+		require.NoError(t, err)
+		require.Equal(t, []netip.AddrPort{
+			netip.AddrPortFrom(netip.MustParseAddr("10.7.0.1"), port),
+			netip.AddrPortFrom(netip.MustParseAddr("fd00::1"), port),
+		}, addrs)
+
+		requireReachable(t, addrs)
+	})
+
+	t.Run("IPv4 Wildcard", func(t *testing.T) {
+		lis, port := listen(t, "0.0.0.0:0")
+		require.Equal(t, net.JoinHostPort("0.0.0.0", strconv.Itoa(int(port))), lis.Addr().String())
+
+		addrs, err := serverSocket.ReachableAddrs(lis.Addr())
+		require.NoError(t, err)
+		require.Equal(t, []netip.AddrPort{netip.AddrPortFrom(netip.MustParseAddr("10.7.0.1"), port)}, addrs)
+
+		requireReachable(t, addrs)
+	})
+
+	t.Run("Packet Conn", func(t *testing.T) {
+		pc, err := serverSocket.ListenPacket("udp", "[::]:0")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = pc.Close()
+		})
+
+		addrs, err := serverSocket.ReachableAddrs(pc.LocalAddr())
+		require.NoError(t, err)
+		require.Len(t, addrs, 2)
+		require.NotZero(t, addrs[0].Port())
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := serverSocket.ReachableAddrs(&net.TCPAddr{IP: net.ParseIP("10.7.0.1")})
+		require.ErrorContains(t, err, "has no port")
+
+		_, err = serverSocket.ReachableAddrs(&net.TCPAddr{IP: net.ParseIP("10.7.0.9"), Port: 80})
+		require.ErrorContains(t, err, "not a local address")
+	})
+}
+
+func TestNoisySocket_ListenConfig(t *testing.T) {
+	logger := slogt.New(t)
+
+	privateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	socket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "server",
+		ListenPort: 12401,
+		PrivateKey: privateKey.String(),
+		IPs:        []string{"10.7.0.1", "10.7.0.2", "fd00::1"},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, socket.Close())
+	})
+
+	ctx := context.Background()
+
+	t.Run("Local Address", func(t *testing.T) {
+		var lc noisysockets.ListenConfig
+
+		lis, err := lc.Listen(ctx, socket, "tcp", "10.7.0.2:80")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = lis.Close()
+		})
+
+		require.Equal(t, "10.7.0.2:80", lis.Addr().String())
+
+		lis, err = lc.Listen(ctx, socket, "tcp6", ":80")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = lis.Close()
+		})
+
+		require.Equal(t, "[fd00::1]:80", lis.Addr().String())
+	})
+
+	t.Run("Reuse Port", func(t *testing.T) {
+		lc := noisysockets.ListenConfig{ReusePort: true}
+
+		for i := 0; i < 2; i++ {
+			lis, err := lc.Listen(ctx, socket, "tcp", "10.7.0.1:8080")
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				_ = lis.Close()
+			})
+
+			pc, err := lc.ListenPacket(ctx, socket, "udp", "10.7.0.1:8080")
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				_ = pc.Close()
+			})
+		}
+
+		// Without the option, the address is already in use.
+		var noReuse noisysockets.ListenConfig
+		_, err := noReuse.Listen(ctx, socket, "tcp", "10.7.0.1:8080")
+		require.Error(t, err)
+
+		_, err = noReuse.ListenPacket(ctx, socket, "udp", "10.7.0.1:8080")
+		require.Error(t, err)
+	})
+
+	t.Run("Peer Filter", func(t *testing.T) {
+		lc := noisysockets.ListenConfig{Options: []noisysockets.ListenOption{noisysockets.WithAllowedPeers("client")}}
+
+		lis, err := lc.Listen(ctx, socket, "tcp", "10.7.0.1:443")
+		require.NoError(t, err)
+		require.NoError(t, lis.Close())
+
+		// Only connection attempts can be filtered.
+		_, err = lc.ListenPacket(ctx, socket, "udp", "10.7.0.1:443")
+		require.Error(t, err)
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		var lc noisysockets.ListenConfig
+		_, err := lc.Listen(ctx, socket, "tcp", "10.7.0.1:80")
+		require.ErrorIs(t, err, context.Canceled)
+	})
+}
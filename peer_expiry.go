@@ -0,0 +1,127 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+// peerExpiry calls expire for each peer once its expiry time has passed.
+type peerExpiry struct {
+	clock  tcpip.Clock
+	expire func(pk transport.NoisePublicKey)
+	mu     sync.Mutex
+	timers map[transport.NoisePublicKey]tcpip.Timer
+	closed bool
+}
+
+func newPeerExpiry(clock tcpip.Clock, expire func(pk transport.NoisePublicKey)) *peerExpiry {
+	return &peerExpiry{
+		clock:  clock,
+		expire: expire,
+		timers: make(map[transport.NoisePublicKey]tcpip.Timer),
+	}
+}
+
+// Close stops all the timers.
+func (e *peerExpiry) Close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for pk, timer := range e.timers {
+		timer.Stop()
+		delete(e.timers, pk)
+	}
+
+	e.closed = true
+}
+
+// expired reports whether an expiry time has passed.
+func (e *peerExpiry) expired(expiresAt time.Time) bool {
+	return !expiresAt.IsZero() && !e.clock.Now().Before(expiresAt)
+}
+
+// set schedules a peer to expire at the given time, replacing any previous
+// expiry time. The zero time means the peer never expires.
+func (e *peerExpiry) set(pk transport.NoisePublicKey, expiresAt time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if timer, ok := e.timers[pk]; ok {
+		timer.Stop()
+		delete(e.timers, pk)
+	}
+
+	if e.closed || expiresAt.IsZero() {
+		return
+	}
+
+	var timer tcpip.Timer
+	timer = e.clock.AfterFunc(expiresAt.Sub(e.clock.Now()), func() {
+		e.mu.Lock()
+		// Don't expire the peer if its expiry time was changed in the meantime.
+		current := e.timers[pk] == timer
+		if current {
+			delete(e.timers, pk)
+		}
+		e.mu.Unlock()
+
+		if current {
+			e.expire(pk)
+		}
+	})
+	e.timers[pk] = timer
+}
+
+// clear stops a peer from expiring (eg. because it has been removed).
+func (e *peerExpiry) clear(pk transport.NoisePublicKey) {
+	e.set(pk, time.Time{})
+}
+
+// parsePeerExpiry parses the expiry time of a peer, or returns the zero time
+// if it never expires.
+func parsePeerExpiry(peerConf *v1alpha1.WireGuardPeerConfig) (time.Time, error) {
+	if peerConf.ExpiresAt == "" {
+		return time.Time{}, nil
+	}
+
+	expiresAt, err := time.Parse(time.RFC3339, peerConf.ExpiresAt)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not parse peer expiry time %q: %w", peerConf.ExpiresAt, err)
+	}
+
+	return expiresAt, nil
+}
+
+// peerExpired reports whether a peer's expiry time has passed.
+func (s *NoisySocket) peerExpired(peerConf *v1alpha1.WireGuardPeerConfig) bool {
+	expiresAt, err := parsePeerExpiry(peerConf)
+	return err == nil && s.peerExpiry.expired(expiresAt)
+}
+
+// expirePeer removes a peer whose expiry time has passed.
+func (s *NoisySocket) expirePeer(pk transport.NoisePublicKey) {
+	name := s.sourceSink.peerName(pk)
+
+	s.logger.Info("Peer expired, removing", "peer", name, "publicKey", pk.String())
+
+	s.events.publish(Event{
+		Timestamp:     time.Now(),
+		Type:          PeerExpired,
+		PeerName:      name,
+		PeerPublicKey: pk.String(),
+	})
+
+	if err := s.RemovePeer(pk.String()); err != nil {
+		s.logger.Warn("Failed to remove expired peer", "peer", name, "error", err)
+	}
+}
@@ -0,0 +1,90 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoisySocket_PeerExpiry(t *testing.T) {
+	logger := slogt.New(t)
+
+	privateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	expiredPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	contractorPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	expiredPeer := v1alpha1.WireGuardPeerConfig{
+		Name:      "expired",
+		PublicKey: expiredPrivateKey.PublicKey().String(),
+		IPs:       []string{"10.7.0.2"},
+		ExpiresAt: time.Now().Add(-time.Hour).Format(time.RFC3339),
+	}
+
+	// Expired peers are skipped when the socket is created.
+	socket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "server",
+		ListenPort: 12441,
+		PrivateKey: privateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+		Peers:      []v1alpha1.WireGuardPeerConfig{expiredPeer},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, socket.Close())
+	})
+
+	_, err = socket.PeerStatus("expired")
+	require.ErrorIs(t, err, noisysockets.ErrUnknownPeer)
+
+	// And refused when added.
+	require.ErrorIs(t, socket.AddPeer(expiredPeer), noisysockets.ErrPeerExpired)
+
+	require.Error(t, socket.AddPeer(v1alpha1.WireGuardPeerConfig{
+		PublicKey: contractorPrivateKey.PublicKey().String(),
+		ExpiresAt: "tomorrow",
+	}))
+
+	events, unsubscribe := socket.Subscribe()
+	t.Cleanup(unsubscribe)
+
+	require.NoError(t, socket.AddPeer(v1alpha1.WireGuardPeerConfig{
+		Name:      "contractor",
+		PublicKey: contractorPrivateKey.PublicKey().String(),
+		IPs:       []string{"10.7.0.3"},
+		ExpiresAt: time.Now().Add(500 * time.Millisecond).Format(time.RFC3339Nano),
+	}))
+
+	_, err = socket.PeerStatus("contractor")
+	require.NoError(t, err)
+
+	var types []noisysockets.EventType
+	for len(types) < 3 {
+		select {
+		case ev := <-events:
+			require.Equal(t, "contractor", ev.PeerName)
+			types = append(types, ev.Type)
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "timed out waiting for the peer to expire")
+		}
+	}
+
+	require.Equal(t, []noisysockets.EventType{noisysockets.PeerAdded, noisysockets.PeerExpired, noisysockets.PeerRemoved}, types)
+
+	_, err = socket.PeerStatus("contractor")
+	require.ErrorIs(t, err, noisysockets.ErrUnknownPeer)
+}
@@ -0,0 +1,240 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+const (
+	// defaultPingCount is the number of echo requests sent by default.
+	defaultPingCount = 4
+	// defaultPingInterval is the time between echo requests by default.
+	defaultPingInterval = time.Second
+	// defaultPingTimeout is how long to wait for each reply by default.
+	defaultPingTimeout = 2 * time.Second
+	// pingPayloadSize is the size of the payload of each echo request.
+	pingPayloadSize = 56
+)
+
+// PingOption configures a call to Ping().
+type PingOption func(*pingOptions)
+
+type pingOptions struct {
+	count    int
+	interval time.Duration
+	timeout  time.Duration
+}
+
+// WithPingCount sets the number of echo requests to send, it defaults to 4.
+func WithPingCount(count int) PingOption {
+	return func(opts *pingOptions) {
+		opts.count = count
+	}
+}
+
+// WithPingInterval sets the time between sending echo requests, it defaults
+// to one second.
+func WithPingInterval(interval time.Duration) PingOption {
+	return func(opts *pingOptions) {
+		opts.interval = interval
+	}
+}
+
+// WithPingTimeout sets how long to wait for a reply to each echo request,
+// before it is considered lost. It defaults to two seconds.
+func WithPingTimeout(timeout time.Duration) PingOption {
+	return func(opts *pingOptions) {
+		opts.timeout = timeout
+	}
+}
+
+// PingStats are the results of pinging a host.
+type PingStats struct {
+	// Addr is the address that was pinged.
+	Addr netip.Addr
+	// Sent is the number of echo requests sent.
+	Sent int
+	// Received is the number of echo replies received.
+	Received int
+	// PacketLoss is the fraction (between 0 and 1) of echo requests that went
+	// unanswered.
+	PacketLoss float64
+	// RTTs are the round trip times of each of the replies received.
+	RTTs []time.Duration
+	// MinRTT is the shortest round trip time.
+	MinRTT time.Duration
+	// AvgRTT is the average round trip time.
+	AvgRTT time.Duration
+	// MaxRTT is the longest round trip time.
+	MaxRTT time.Duration
+}
+
+// Ping sends ICMP echo requests to a host (eg. the name of a peer) through
+// the mesh, and returns the round trip times of the replies and the packet
+// loss. If the context is done before all the echo requests are sent, the
+// statistics so far are returned along with the context's error.
+func (n *noisyNet) Ping(ctx context.Context, host string, opts ...PingOption) (*PingStats, error) {
+	options := pingOptions{
+		count:    defaultPingCount,
+		interval: defaultPingInterval,
+		timeout:  defaultPingTimeout,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	if options.count <= 0 {
+		return nil, fmt.Errorf("ping count must be positive")
+	}
+
+	addrs, err := n.LookupHostContext(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve host %q: %w", host, err)
+	}
+
+	addr, ok := n.pingAddr(addrs)
+	if !ok {
+		return nil, errNoSuitableAddress
+	}
+
+	transProto, netProto := icmp.ProtocolNumber4, ipv4.ProtocolNumber
+	echoType, replyType := uint8(header.ICMPv4Echo), uint8(header.ICMPv4EchoReply)
+	if addr.Is6() {
+		transProto, netProto = icmp.ProtocolNumber6, ipv6.ProtocolNumber
+		echoType, replyType = uint8(header.ICMPv6EchoRequest), uint8(header.ICMPv6EchoReply)
+	}
+
+	var wq waiter.Queue
+	ep, err := n.newEndpoint(transProto, netProto, &wq)
+	if err != nil {
+		return nil, fmt.Errorf("could not create ping endpoint: %w", err)
+	}
+
+	if tcpipErr := ep.Connect(tcpip.FullAddress{NIC: 1, Addr: tcpip.AddrFromSlice(addr.AsSlice())}); tcpipErr != nil {
+		ep.Close()
+		return nil, fmt.Errorf("could not connect ping endpoint: %v", tcpipErr)
+	}
+
+	// Ping endpoints are datagram endpoints, so the UDP adapter works for them
+	// too (and gives us deadlines).
+	conn := gonet.NewUDPConn(&wq, ep)
+	defer conn.Close()
+
+	// Interrupt any pending read when the context is done.
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	stats := &PingStats{Addr: addr}
+
+	// Echo messages have the same layout in ICMPv4 and ICMPv6, the endpoint
+	// fills in the identifier and checksum.
+	req := make([]byte, header.ICMPv4MinimumSize+pingPayloadSize)
+	reply := make([]byte, len(req))
+
+	for seq := 0; seq < options.count; seq++ {
+		start := time.Now()
+
+		req[0] = echoType
+		header.ICMPv4(req).SetSequence(uint16(seq))
+
+		if _, err := conn.Write(req); err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return nil, fmt.Errorf("could not send echo request: %w", err)
+		}
+		stats.Sent++
+
+		if err := conn.SetReadDeadline(start.Add(options.timeout)); err != nil {
+			return nil, fmt.Errorf("could not set read deadline: %w", err)
+		}
+
+		for ctx.Err() == nil {
+			size, err := conn.Read(reply)
+			if err != nil {
+				if isTimeout(err) {
+					break
+				}
+				return nil, fmt.Errorf("could not receive echo reply: %w", err)
+			}
+
+			// Ignore late replies to earlier requests.
+			if size >= header.ICMPv4MinimumSize && reply[0] == replyType &&
+				header.ICMPv4(reply).Sequence() == uint16(seq) {
+				stats.RTTs = append(stats.RTTs, time.Since(start))
+				break
+			}
+		}
+
+		if ctx.Err() != nil || seq == options.count-1 {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Until(start.Add(options.interval))):
+		}
+	}
+
+	stats.Received = len(stats.RTTs)
+	if stats.Sent > 0 {
+		stats.PacketLoss = float64(stats.Sent-stats.Received) / float64(stats.Sent)
+	}
+
+	var total time.Duration
+	for i, rtt := range stats.RTTs {
+		if i == 0 || rtt < stats.MinRTT {
+			stats.MinRTT = rtt
+		}
+		stats.MaxRTT = max(stats.MaxRTT, rtt)
+		total += rtt
+	}
+	if stats.Received > 0 {
+		stats.AvgRTT = total / time.Duration(stats.Received)
+	}
+
+	return stats, ctx.Err()
+}
+
+// pingAddr returns the first of the addresses of a host, that we have a local
+// address of the same family to ping from.
+func (n *noisyNet) pingAddr(addrs []string) (netip.Addr, bool) {
+	for _, s := range addrs {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			continue
+		}
+		addr = addr.Unmap()
+
+		for _, localAddr := range n.localAddrs.load() {
+			if localAddr.Is4() == addr.Is4() {
+				return addr, true
+			}
+		}
+	}
+
+	return netip.Addr{}, false
+}
+
+func isTimeout(err error) bool {
+	var timeoutErr interface{ Timeout() bool }
+	return errors.As(err, &timeoutErr) && timeoutErr.Timeout()
+}
@@ -0,0 +1,119 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets_test
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoisySocket_Ping(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "server",
+		ListenPort: 12419,
+		PrivateKey: serverPrivateKey.String(),
+		IPs:        []string{"10.7.0.1", "fdff:7061:ac89::1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "client",
+				PublicKey: clientPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.2", "fdff:7061:ac89::2"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+	})
+
+	clientSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "client",
+		ListenPort: 12420,
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.2", "fdff:7061:ac89::2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "server",
+				PublicKey: serverPrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12419",
+				IPs:       []string{"10.7.0.1", "fdff:7061:ac89::1"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, clientSocket.Close())
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	t.Cleanup(cancel)
+
+	for _, host := range []string{"server", "fdff:7061:ac89::1"} {
+		t.Run(host, func(t *testing.T) {
+			// Give the first request plenty of time, as it triggers a handshake.
+			stats, err := clientSocket.Ping(ctx, host, noisysockets.WithPingCount(3),
+				noisysockets.WithPingInterval(50*time.Millisecond), noisysockets.WithPingTimeout(5*time.Second))
+			require.NoError(t, err)
+
+			ip, err := netip.ParseAddr(host)
+			if err != nil {
+				ip = netip.MustParseAddr("10.7.0.1")
+			}
+			require.Equal(t, ip, stats.Addr)
+
+			require.Equal(t, 3, stats.Sent)
+			require.Equal(t, 3, stats.Received)
+			require.Zero(t, stats.PacketLoss)
+			require.Len(t, stats.RTTs, 3)
+			require.NotZero(t, stats.MinRTT)
+			require.LessOrEqual(t, stats.MinRTT, stats.AvgRTT)
+			require.LessOrEqual(t, stats.AvgRTT, stats.MaxRTT)
+		})
+	}
+
+	t.Run("No Reply", func(t *testing.T) {
+		conf := serverSocket.Config()
+		conf.DisableEchoReply = true
+		require.NoError(t, serverSocket.Reload(conf))
+
+		stats, err := clientSocket.Ping(ctx, "server", noisysockets.WithPingCount(2),
+			noisysockets.WithPingInterval(50*time.Millisecond), noisysockets.WithPingTimeout(100*time.Millisecond))
+		require.NoError(t, err)
+
+		require.Equal(t, 2, stats.Sent)
+		require.Zero(t, stats.Received)
+		require.Equal(t, 1.0, stats.PacketLoss)
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		_, err := clientSocket.Ping(ctx, "server")
+		require.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("Unknown Host", func(t *testing.T) {
+		_, err := clientSocket.Ping(ctx, "unknown")
+		require.Error(t, err)
+	})
+}
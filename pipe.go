@@ -0,0 +1,167 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/conn"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+// defaultPipePort is the port of the ends of a pipe, when their listen port
+// isn't configured.
+const defaultPipePort = 51820
+
+// Clock is a source of time, and timers. It is gVisor's tcpip.Clock, so that
+// the same clock can drive both the transport, and the network stack.
+type Clock = tcpip.Clock
+
+// PipeOptions configures the link between the two sockets of a pipe.
+type PipeOptions struct {
+	// Latency is how long packets take to reach the other socket.
+	Latency time.Duration
+	// Jitter is the most that the latency of each packet varies by, either
+	// way, at random. Packets can be reordered, by overtaking each other.
+	Jitter time.Duration
+	// Loss is the fraction of packets (between 0 and 1) that are dropped.
+	Loss float64
+	// Duplicate is the fraction of packets (between 0 and 1) that are
+	// delivered twice.
+	Duplicate float64
+	// Reorder is the fraction of packets (between 0 and 1) that are delivered
+	// straight away, ahead of the packets sent before them that are still
+	// delayed by the latency.
+	Reorder float64
+	// Seed seeds the random choices (eg. which packets are dropped), so that
+	// runs can be repeated. Zero picks a random seed.
+	Seed int64
+	// Clock, if set, drives the sockets' timers (eg. handshake retransmission,
+	// keepalives, and TCP retransmission), and the link's latency, in place
+	// of the system clock. See the simulation package for a fake clock.
+	Clock Clock
+}
+
+// Pipe creates a pair of NoisySockets, that exchange packets with each other
+// through an in-memory channel rather than UDP sockets, eg. so that tests of
+// applications built on noisy sockets run without network access. Each config
+// must include the other socket as a peer, endpoints needn't be configured.
+// The sockets appear to each other at 198.18.0.1 and 198.18.0.2 (a range
+// reserved for testing). Options may be nil, for an instant and lossless link,
+// or impair the link (much like netem) to test applications against a bad
+// network.
+func Pipe(logger *slog.Logger, confA, confB *v1alpha1.Config, opts *PipeOptions) (*NoisySocket, *NoisySocket, error) {
+	var pipeOpts conn.PipeOptions
+	if opts != nil {
+		if opts.Latency < 0 {
+			return nil, nil, fmt.Errorf("latency must not be negative")
+		}
+
+		if opts.Jitter < 0 {
+			return nil, nil, fmt.Errorf("jitter must not be negative")
+		}
+
+		if opts.Loss < 0 || opts.Loss > 1 {
+			return nil, nil, fmt.Errorf("loss must be between 0 and 1")
+		}
+
+		if opts.Duplicate < 0 || opts.Duplicate > 1 {
+			return nil, nil, fmt.Errorf("duplicate must be between 0 and 1")
+		}
+
+		if opts.Reorder < 0 || opts.Reorder > 1 {
+			return nil, nil, fmt.Errorf("reorder must be between 0 and 1")
+		}
+
+		pipeOpts = conn.PipeOptions{
+			Latency:   opts.Latency,
+			Jitter:    opts.Jitter,
+			Loss:      opts.Loss,
+			Duplicate: opts.Duplicate,
+			Reorder:   opts.Reorder,
+			Seed:      opts.Seed,
+			Clock:     opts.Clock,
+		}
+	}
+
+	bindA, bindB := conn.NewPipe(pipeAddr(netip.AddrFrom4([4]byte{198, 18, 0, 1}), confA.ListenPort),
+		pipeAddr(netip.AddrFrom4([4]byte{198, 18, 0, 2}), confB.ListenPort), pipeOpts)
+
+	// Each socket's peer, for the other, sends to the other end of the pipe.
+	pipeConfA, err := withPipeEndpoint(confA, confB, bindB.Addr())
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid first config: %w", err)
+	}
+
+	pipeConfB, err := withPipeEndpoint(confB, confA, bindA.Addr())
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid second config: %w", err)
+	}
+
+	socketA, err := newPipeSocket(logger, pipeConfA, bindA, pipeOpts.Clock)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create first socket: %w", err)
+	}
+
+	socketB, err := newPipeSocket(logger, pipeConfB, bindB, pipeOpts.Clock)
+	if err != nil {
+		_ = socketA.Close()
+		return nil, nil, fmt.Errorf("failed to create second socket: %w", err)
+	}
+
+	return socketA, socketB, nil
+}
+
+func newPipeSocket(logger *slog.Logger, conf *v1alpha1.Config, bind *conn.PipeBind, clock Clock) (*NoisySocket, error) {
+	return newNoisySocket(logger, conf, &underlay{
+		name: "pipe",
+		newBind: func(_ func(packet []byte) bool) conn.Bind {
+			return bind
+		},
+	}, clock)
+}
+
+// withPipeEndpoint returns a copy of the config, in which the peer for the
+// other socket has the endpoint of the other end of the pipe (unless one is
+// already configured).
+func withPipeEndpoint(conf, otherConf *v1alpha1.Config, addr netip.AddrPort) (*v1alpha1.Config, error) {
+	var otherPrivateKey transport.NoisePrivateKey
+	if err := otherPrivateKey.FromString(otherConf.PrivateKey); err != nil {
+		return nil, fmt.Errorf("failed to parse other private key: %w", err)
+	}
+	otherPublicKey := otherPrivateKey.PublicKey().String()
+
+	pipeConf := *conf
+	pipeConf.Peers = slices.Clone(conf.Peers)
+
+	for i := range pipeConf.Peers {
+		if pipeConf.Peers[i].PublicKey != otherPublicKey {
+			continue
+		}
+
+		if pipeConf.Peers[i].Endpoint == "" {
+			pipeConf.Peers[i].Endpoint = addr.String()
+		}
+
+		return &pipeConf, nil
+	}
+
+	return nil, fmt.Errorf("other socket is not a peer")
+}
+
+func pipeAddr(addr netip.Addr, port uint16) netip.AddrPort {
+	if port == 0 {
+		port = defaultPipePort
+	}
+
+	return netip.AddrPortFrom(addr, port)
+}
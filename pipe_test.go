@@ -0,0 +1,241 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipe(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverConf := &v1alpha1.Config{
+		Name:       "server",
+		PrivateKey: serverPrivateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "client",
+				PublicKey: clientPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.2"},
+			},
+		},
+	}
+
+	clientConf := &v1alpha1.Config{
+		Name:       "client",
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "server",
+				PublicKey: serverPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.1"},
+			},
+		},
+	}
+
+	// A lossy, jittery link, TCP should still deliver everything.
+	serverSocket, clientSocket, err := noisysockets.Pipe(logger, serverConf, clientConf, &noisysockets.PipeOptions{
+		Latency:   10 * time.Millisecond,
+		Jitter:    5 * time.Millisecond,
+		Loss:      0.05,
+		Duplicate: 0.01,
+		Reorder:   0.01,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+		require.NoError(t, clientSocket.Close())
+	})
+
+	lis, err := serverSocket.Listen("tcp", ":80")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, lis.Close())
+	})
+
+	data := make([]byte, 256*1024)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		_, _ = conn.Write(data)
+	}()
+
+	conn, err := clientSocket.DialTimeout("tcp", "server:80", 20*time.Second)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, conn.Close())
+	})
+
+	require.NoError(t, conn.SetDeadline(time.Now().Add(30*time.Second)))
+
+	buf, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data, buf))
+
+	status, err := clientSocket.PeerStatus("server")
+	require.NoError(t, err)
+	require.Equal(t, "198.18.0.1:51820", status.Endpoint)
+
+	t.Run("Not A Peer", func(t *testing.T) {
+		otherPrivateKey, err := transport.NewPrivateKey()
+		require.NoError(t, err)
+
+		_, _, err = noisysockets.Pipe(logger, serverConf, &v1alpha1.Config{
+			PrivateKey: otherPrivateKey.String(),
+			IPs:        []string{"10.7.0.3"},
+		}, nil)
+		require.ErrorContains(t, err, "other socket is not a peer")
+	})
+
+	t.Run("Invalid Options", func(t *testing.T) {
+		for _, opts := range []*noisysockets.PipeOptions{
+			{Latency: -time.Millisecond},
+			{Jitter: -time.Millisecond},
+			{Loss: 1.5},
+			{Duplicate: -0.5},
+			{Reorder: 2},
+		} {
+			_, _, err := noisysockets.Pipe(logger, serverConf, clientConf, opts)
+			require.Error(t, err)
+		}
+	})
+
+	t.Run("Queues", func(t *testing.T) {
+		queuesConf := *serverConf
+		queuesConf.Tuning = &v1alpha1.TuningConfig{Queues: 4}
+
+		serverSocket, clientSocket, err := noisysockets.Pipe(logger, &queuesConf, clientConf, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, serverSocket.Close())
+			require.NoError(t, clientSocket.Close())
+		})
+
+		lis, err := serverSocket.Listen("tcp", ":80")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, lis.Close())
+		})
+
+		go func() {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			_, _ = conn.Write(data)
+		}()
+
+		conn, err := clientSocket.DialTimeout("tcp", "server:80", 20*time.Second)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, conn.Close())
+		})
+
+		require.NoError(t, conn.SetDeadline(time.Now().Add(30*time.Second)))
+
+		buf, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(data, buf))
+	})
+
+	t.Run("Obfuscation", func(t *testing.T) {
+		obfuscation := &v1alpha1.ObfuscationConfig{
+			JunkPackets:       4,
+			JunkPacketMinSize: 64,
+			JunkPacketMaxSize: 256,
+			InitiationPadding: 24,
+			ResponsePadding:   48,
+			InitiationMagic:   0x3c5a9f17,
+			ResponseMagic:     0x8e21d04b,
+			CookieReplyMagic:  0x47b6e2a9,
+			TransportMagic:    0xd19c3f65,
+		}
+
+		obfuscatedServerConf := *serverConf
+		obfuscatedServerConf.Obfuscation = obfuscation
+
+		obfuscatedClientConf := *clientConf
+		obfuscatedClientConf.Obfuscation = obfuscation
+
+		serverSocket, clientSocket, err := noisysockets.Pipe(logger, &obfuscatedServerConf, &obfuscatedClientConf, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, serverSocket.Close())
+			require.NoError(t, clientSocket.Close())
+		})
+
+		lis, err := serverSocket.Listen("tcp", ":80")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, lis.Close())
+		})
+
+		go func() {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			_, _ = conn.Write(data)
+		}()
+
+		conn, err := clientSocket.DialTimeout("tcp", "server:80", 20*time.Second)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, conn.Close())
+		})
+
+		require.NoError(t, conn.SetDeadline(time.Now().Add(30*time.Second)))
+
+		buf, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(data, buf))
+
+		t.Run("Strict Interop", func(t *testing.T) {
+			strictConf := obfuscatedServerConf
+			strictConf.StrictInterop = true
+
+			_, _, err := noisysockets.Pipe(logger, &strictConf, &obfuscatedClientConf, nil)
+			require.ErrorContains(t, err, "not supported in strict interop mode")
+		})
+
+		t.Run("Invalid", func(t *testing.T) {
+			invalidConf := obfuscatedServerConf
+			invalidConf.Obfuscation = &v1alpha1.ObfuscationConfig{JunkPackets: 1000}
+
+			_, _, err := noisysockets.Pipe(logger, &invalidConf, &obfuscatedClientConf, nil)
+			require.ErrorContains(t, err, "invalid obfuscation")
+		})
+	})
+}
@@ -0,0 +1,485 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"context"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+const (
+	// minPathMTU is the smallest path MTU that will be discovered, it is the
+	// minimum MTU required by IPv6.
+	minPathMTU = header.IPv6MinimumMTU
+	// pathMTUCheckInterval is how often we check for peers that are due to
+	// have their path MTU probed.
+	pathMTUCheckInterval = 5 * time.Second
+	// pathMTUProbeInterval is how often the path MTU to a peer is probed, so
+	// that changes to the path are picked up.
+	pathMTUProbeInterval = 10 * time.Minute
+	// pathMTUProbeTimeout is how long to wait for a reply to a probe.
+	pathMTUProbeTimeout = time.Second
+	// pathMTUProbeAttempts is how many probes of each size are sent before
+	// concluding that the size doesn't fit, as packets might also be lost.
+	pathMTUProbeAttempts = 2
+	// pathMTUGranularity is the precision to which the path MTU is discovered.
+	pathMTUGranularity = 16
+	// defaultProbeTTL is the TTL (or hop limit) of probes.
+	defaultProbeTTL = 64
+)
+
+// SetPeerMTU sets the MTU of the path to a peer. Packets larger than it are
+// dropped, and an ICMP error is sent back to their source, so that it can lower
+// the size of its packets. A zero MTU means the MTU of the source sink.
+func (ss *sourceSink) SetPeerMTU(publicKey transport.NoisePublicKey, mtu int) {
+	ss.peersMu.Lock()
+	defer ss.peersMu.Unlock()
+
+	if mtu <= 0 || mtu >= ss.mtu {
+		delete(ss.peerMTUs, publicKey)
+		return
+	}
+
+	ss.peerMTUs[publicKey] = mtu
+}
+
+// PeerMTU returns the MTU of the path to a peer.
+func (ss *sourceSink) PeerMTU(publicKey transport.NoisePublicKey) int {
+	ss.peersMu.RLock()
+	defer ss.peersMu.RUnlock()
+
+	if mtu, ok := ss.peerMTUs[publicKey]; ok {
+		return mtu
+	}
+
+	return ss.mtu
+}
+
+// packetTooBig sends an ICMP fragmentation needed (or for IPv6, packet too
+// big) error back to the source of a packet that exceeds the MTU. It reports
+// whether the packet should be dropped, IPv4 packets that are being forwarded
+// on behalf of someone else, and which can be fragmented, are let through.
+func (ss *sourceSink) packetTooBig(protoNumber tcpip.NetworkProtocolNumber, pkt []byte, mtu int) bool {
+	var reply []byte
+	switch protoNumber {
+	case header.IPv4ProtocolNumber:
+		hdr := header.IPv4(pkt)
+		src := netip.AddrFrom4(hdr.SourceAddress().As4())
+		if hdr.Flags()&header.IPv4FlagDontFragment == 0 && !ss.isLocalAddr(src) {
+			return false
+		}
+
+		// As much of the original packet as fits in a minimum sized datagram.
+		original := pkt[:min(len(pkt), header.IPv4MinimumProcessableDatagramSize-header.IPv4MinimumSize-header.ICMPv4MinimumSize)]
+
+		reply = make([]byte, header.IPv4MinimumSize+header.ICMPv4MinimumSize+len(original))
+		replyHdr := header.IPv4(reply)
+		replyHdr.Encode(&header.IPv4Fields{
+			TotalLength: uint16(len(reply)),
+			TTL:         64,
+			Protocol:    uint8(header.ICMPv4ProtocolNumber),
+			SrcAddr:     hdr.DestinationAddress(),
+			DstAddr:     hdr.SourceAddress(),
+		})
+		replyHdr.SetChecksum(^replyHdr.CalculateChecksum())
+
+		icmpHdr := header.ICMPv4(reply[header.IPv4MinimumSize:])
+		icmpHdr.SetType(header.ICMPv4DstUnreachable)
+		icmpHdr.SetCode(header.ICMPv4FragmentationNeeded)
+		icmpHdr.SetMTU(uint16(mtu))
+		copy(icmpHdr.Payload(), original)
+		icmpHdr.SetChecksum(header.ICMPv4Checksum(icmpHdr[:header.ICMPv4MinimumSize], checksum.Checksum(original, 0)))
+	case header.IPv6ProtocolNumber:
+		hdr := header.IPv6(pkt)
+
+		original := pkt[:min(len(pkt), header.IPv6MinimumMTU-header.IPv6MinimumSize-header.ICMPv6PacketTooBigMinimumSize)]
+
+		reply = make([]byte, header.IPv6MinimumSize+header.ICMPv6PacketTooBigMinimumSize+len(original))
+		replyHdr := header.IPv6(reply)
+		replyHdr.Encode(&header.IPv6Fields{
+			PayloadLength:     uint16(len(reply) - header.IPv6MinimumSize),
+			TransportProtocol: header.ICMPv6ProtocolNumber,
+			HopLimit:          64,
+			SrcAddr:           hdr.DestinationAddress(),
+			DstAddr:           hdr.SourceAddress(),
+		})
+
+		icmpHdr := header.ICMPv6(reply[header.IPv6MinimumSize:])
+		icmpHdr.SetType(header.ICMPv6PacketTooBig)
+		icmpHdr.SetMTU(uint32(mtu))
+		copy(icmpHdr.Payload(), original)
+		icmpHdr.SetChecksum(header.ICMPv6Checksum(header.ICMPv6ChecksumParams{
+			Header:      icmpHdr[:header.ICMPv6PacketTooBigMinimumSize],
+			Src:         hdr.DestinationAddress(),
+			Dst:         hdr.SourceAddress(),
+			PayloadCsum: checksum.Checksum(original, 0),
+			PayloadLen:  len(original),
+		}))
+	default:
+		return true
+	}
+
+	replyPkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(reply)})
+	ss.ep.InjectInbound(protoNumber, replyPkt)
+	replyPkt.DecRef()
+
+	return true
+}
+
+func (ss *sourceSink) isLocalAddr(addr netip.Addr) bool {
+	for _, localAddr := range ss.localAddrs.load() {
+		if addr == localAddr {
+			return true
+		}
+	}
+
+	return false
+}
+
+// probeReply is a response to one of our probes.
+type probeReply struct {
+	// from is the address the response was sent from.
+	from netip.Addr
+	// timeExceeded is whether the response is an ICMP time exceeded error, from
+	// a router on the path, rather than an echo reply.
+	timeExceeded bool
+}
+
+// probe sends an ICMP echo request (that can't be fragmented) of the given
+// size from src to dst, and reports whether a reply was received within the
+// timeout.
+func (ss *sourceSink) probe(ctx context.Context, src, dst netip.Addr, size int, timeout time.Duration) bool {
+	reply, ok := ss.probeTTL(ctx, src, dst, size, defaultProbeTTL, timeout)
+	return ok && !reply.timeExceeded
+}
+
+// probeTTL sends an ICMP echo request, like probe, with the given TTL (or hop
+// limit), and returns the first response received within the timeout.
+func (ss *sourceSink) probeTTL(ctx context.Context, src, dst netip.Addr, size int, ttl uint8, timeout time.Duration) (probeReply, bool) {
+	seq := uint16(ss.probeSeq.Add(1))
+
+	replied := make(chan probeReply, 1)
+
+	ss.probesMu.Lock()
+	ss.probes[seq] = replied
+	ss.probesMu.Unlock()
+
+	defer func() {
+		ss.probesMu.Lock()
+		delete(ss.probes, seq)
+		ss.probesMu.Unlock()
+	}()
+
+	var pkt []byte
+	var protoNumber tcpip.NetworkProtocolNumber
+	var hdrLen int
+	if dst.Is4() {
+		protoNumber, hdrLen = header.IPv4ProtocolNumber, header.IPv4MinimumSize
+		size = max(size, hdrLen+header.ICMPv4MinimumSize)
+
+		pkt = make([]byte, size)
+		hdr := header.IPv4(pkt)
+		hdr.Encode(&header.IPv4Fields{
+			TotalLength: uint16(size),
+			TTL:         ttl,
+			Flags:       header.IPv4FlagDontFragment,
+			Protocol:    uint8(header.ICMPv4ProtocolNumber),
+			SrcAddr:     tcpip.AddrFrom4(src.As4()),
+			DstAddr:     tcpip.AddrFrom4(dst.As4()),
+		})
+		hdr.SetChecksum(^hdr.CalculateChecksum())
+
+		icmpHdr := header.ICMPv4(pkt[hdrLen:])
+		icmpHdr.SetType(header.ICMPv4Echo)
+		icmpHdr.SetIdent(ss.probeIdent)
+		icmpHdr.SetSequence(seq)
+		icmpHdr.SetChecksum(header.ICMPv4Checksum(icmpHdr[:header.ICMPv4MinimumSize], checksum.Checksum(icmpHdr.Payload(), 0)))
+	} else {
+		protoNumber, hdrLen = header.IPv6ProtocolNumber, header.IPv6MinimumSize
+		size = max(size, hdrLen+header.ICMPv6EchoMinimumSize)
+
+		pkt = make([]byte, size)
+		hdr := header.IPv6(pkt)
+		hdr.Encode(&header.IPv6Fields{
+			PayloadLength:     uint16(size - hdrLen),
+			TransportProtocol: header.ICMPv6ProtocolNumber,
+			HopLimit:          ttl,
+			SrcAddr:           tcpip.AddrFrom16(src.As16()),
+			DstAddr:           tcpip.AddrFrom16(dst.As16()),
+		})
+
+		icmpHdr := header.ICMPv6(pkt[hdrLen:])
+		icmpHdr.SetType(header.ICMPv6EchoRequest)
+		icmpHdr.SetIdent(ss.probeIdent)
+		icmpHdr.SetSequence(seq)
+		icmpHdr.SetChecksum(header.ICMPv6Checksum(header.ICMPv6ChecksumParams{
+			Header:      icmpHdr[:header.ICMPv6EchoMinimumSize],
+			Src:         hdr.SourceAddress(),
+			Dst:         hdr.DestinationAddress(),
+			PayloadCsum: checksum.Checksum(icmpHdr.Payload(), 0),
+			PayloadLen:  len(icmpHdr.Payload()),
+		}))
+	}
+
+	probePkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(pkt)})
+	probePkt.NetworkProtocolNumber = protoNumber
+	_, _ = probePkt.NetworkHeader().Consume(hdrLen)
+
+	ss.queueOutbound(probePkt)
+	probePkt.DecRef()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case reply := <-replied:
+		return reply, true
+	case <-timer.C:
+		return probeReply{}, false
+	case <-ctx.Done():
+		return probeReply{}, false
+	}
+}
+
+// isProbe reports whether the outbound packet is one of our probes, probes
+// are never rejected for being too large.
+func (ss *sourceSink) isProbe(protoNumber tcpip.NetworkProtocolNumber, pkt []byte) bool {
+	ident, _, ok := parseEcho(protoNumber, pkt, false)
+	return ok && ident == ss.probeIdent
+}
+
+// handleProbeReply reports whether the inbound packet is a reply (or a time
+// exceeded error) in response to one of our probes, if so it is consumed.
+func (ss *sourceSink) handleProbeReply(protoNumber tcpip.NetworkProtocolNumber, pkt []byte) bool {
+	var reply probeReply
+
+	ident, seq, ok := parseEcho(protoNumber, pkt, true)
+	if !ok {
+		ident, seq, ok = parseTimeExceeded(protoNumber, pkt)
+		reply.timeExceeded = true
+	}
+	if !ok || ident != ss.probeIdent {
+		return false
+	}
+
+	if protoNumber == header.IPv4ProtocolNumber {
+		reply.from = netip.AddrFrom4(header.IPv4(pkt).SourceAddress().As4())
+	} else {
+		reply.from = netip.AddrFrom16(header.IPv6(pkt).SourceAddress().As16())
+	}
+
+	ss.probesMu.Lock()
+	replied, ok := ss.probes[seq]
+	ss.probesMu.Unlock()
+
+	if ok {
+		select {
+		case replied <- reply:
+		default:
+		}
+	}
+
+	return true
+}
+
+// parseEcho returns the identifier and sequence number of an ICMP echo
+// request (or reply).
+func parseEcho(protoNumber tcpip.NetworkProtocolNumber, pkt []byte, reply bool) (ident, seq uint16, ok bool) {
+	switch protoNumber {
+	case header.IPv4ProtocolNumber:
+		hdr := header.IPv4(pkt)
+		if !hdr.IsValid(len(pkt)) || hdr.TransportProtocol() != header.ICMPv4ProtocolNumber || hdr.FragmentOffset() != 0 {
+			return 0, 0, false
+		}
+
+		wantType := header.ICMPv4Echo
+		if reply {
+			wantType = header.ICMPv4EchoReply
+		}
+
+		payload := hdr.Payload()
+		if len(payload) < header.ICMPv4MinimumSize || header.ICMPv4(payload).Type() != wantType {
+			return 0, 0, false
+		}
+
+		return header.ICMPv4(payload).Ident(), header.ICMPv4(payload).Sequence(), true
+	case header.IPv6ProtocolNumber:
+		hdr := header.IPv6(pkt)
+		if !hdr.IsValid(len(pkt)) || hdr.TransportProtocol() != header.ICMPv6ProtocolNumber {
+			return 0, 0, false
+		}
+
+		wantType := header.ICMPv6EchoRequest
+		if reply {
+			wantType = header.ICMPv6EchoReply
+		}
+
+		payload := hdr.Payload()
+		if len(payload) < header.ICMPv6EchoMinimumSize || header.ICMPv6(payload).Type() != wantType {
+			return 0, 0, false
+		}
+
+		return header.ICMPv6(payload).Ident(), header.ICMPv6(payload).Sequence(), true
+	}
+
+	return 0, 0, false
+}
+
+// pathMTUDiscovery periodically probes the path MTU to each peer, with which
+// we have a session.
+type pathMTUDiscovery struct {
+	logger *slog.Logger
+	s      *NoisySocket
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	probed map[transport.NoisePublicKey]time.Time
+}
+
+func newPathMTUDiscovery(logger *slog.Logger, s *NoisySocket) *pathMTUDiscovery {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	d := &pathMTUDiscovery{
+		logger: logger,
+		s:      s,
+		cancel: cancel,
+		probed: make(map[transport.NoisePublicKey]time.Time),
+	}
+
+	d.wg.Add(1)
+	go d.run(ctx)
+
+	return d
+}
+
+// Close stops probing.
+func (d *pathMTUDiscovery) Close() {
+	d.cancel()
+	d.wg.Wait()
+}
+
+func (d *pathMTUDiscovery) run(ctx context.Context) {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(pathMTUCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		d.s.peerConfigsMu.Lock()
+		publicKeys := make([]transport.NoisePublicKey, 0, len(d.s.peerConfigs))
+		for pk := range d.s.peerConfigs {
+			publicKeys = append(publicKeys, pk)
+		}
+		d.s.peerConfigsMu.Unlock()
+
+		for pk := range d.probed {
+			if !slices.Contains(publicKeys, pk) {
+				delete(d.probed, pk)
+			}
+		}
+
+		for _, pk := range publicKeys {
+			peer := d.s.transport.LookupPeer(pk)
+			if peer == nil {
+				continue
+			}
+
+			// Don't trigger handshakes with peers we aren't talking to.
+			if time.Since(peer.Stats().LastHandshake) > d.s.transport.Timers().RejectAfter {
+				continue
+			}
+
+			if time.Since(d.probed[pk]) < pathMTUProbeInterval {
+				continue
+			}
+
+			d.probePeer(ctx, pk)
+			d.probed[pk] = time.Now()
+
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}
+}
+
+// probePeer searches for the largest packet size that reaches the peer.
+func (d *pathMTUDiscovery) probePeer(ctx context.Context, pk transport.NoisePublicKey) {
+	ss := d.s.sourceSink
+
+	src, dst, ok := ss.probeAddrs(pk)
+	if !ok {
+		return
+	}
+
+	probe := func(size int) bool {
+		for i := 0; i < pathMTUProbeAttempts; i++ {
+			if ss.probe(ctx, src, dst, size, pathMTUProbeTimeout) {
+				return true
+			}
+		}
+		return false
+	}
+
+	lo, hi := minPathMTU, ss.mtu
+	if probe(hi) {
+		ss.SetPeerMTU(pk, 0)
+		return
+	}
+
+	// Either the peer isn't replying to pings, or the path is unusable.
+	if !probe(lo) {
+		d.logger.Debug("Peer did not respond to path MTU probes", "peer", dst)
+		return
+	}
+
+	for hi-lo > pathMTUGranularity {
+		mid := (lo + hi) / 2
+		if probe(mid) {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+
+	if lo != ss.PeerMTU(pk) {
+		d.logger.Info("Discovered path MTU", "peer", dst, "mtu", lo)
+	}
+
+	ss.SetPeerMTU(pk, lo)
+}
+
+// probeAddrs returns the addresses between which to send probes to a peer.
+func (ss *sourceSink) probeAddrs(publicKey transport.NoisePublicKey) (src, dst netip.Addr, ok bool) {
+	ss.peersMu.RLock()
+	defer ss.peersMu.RUnlock()
+
+	for _, dst := range ss.peerAddresses[publicKey] {
+		for _, src := range ss.localAddrs.load() {
+			if src.Is4() == dst.Is4() {
+				return src, dst, true
+			}
+		}
+	}
+
+	return netip.Addr{}, netip.Addr{}, false
+}
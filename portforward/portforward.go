@@ -0,0 +1,400 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+// Package portforward implements local and reverse TCP port forwards between
+// the host's network and the mesh.
+package portforward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// Network is a network on which connections can be accepted and dialed.
+// A noisy socket is one such network.
+type Network interface {
+	Listen(network, address string) (net.Listener, error)
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Direction is the direction of a port forward.
+type Direction int
+
+const (
+	// Local forwards connections accepted on the host to a destination on the mesh.
+	Local Direction = iota
+	// Reverse forwards connections accepted on the mesh to a destination on the host.
+	Reverse
+)
+
+func (d Direction) String() string {
+	switch d {
+	case Local:
+		return "local"
+	case Reverse:
+		return "reverse"
+	default:
+		return fmt.Sprintf("Direction(%d)", int(d))
+	}
+}
+
+// Config is the configuration of a port forward.
+type Config struct {
+	// Name uniquely identifies the forward.
+	Name string
+	// Direction is the direction of the forward.
+	Direction Direction
+	// ListenAddress is the address to accept connections on, eg. "127.0.0.1:8080"
+	// for a local forward, or ":2222" for a reverse forward.
+	ListenAddress string
+	// TargetAddress is the address to forward connections to, eg. "web:80" for
+	// a local forward, or "127.0.0.1:22" for a reverse forward.
+	TargetAddress string
+	// ProxyProtocol sends a PROXY protocol v2 header to the target, ahead of
+	// each connection's data, so that the target sees the original source
+	// address of the connection (and for reverse forwards, the identity of the
+	// peer it is from, see TLVTypePeerPublicKey and TLVTypePeerName).
+	ProxyProtocol bool
+}
+
+// Stats contains the statistics of a port forward.
+type Stats struct {
+	// Connections is the total number of connections accepted.
+	Connections uint64
+	// ActiveConnections is the number of connections currently being forwarded.
+	ActiveConnections int64
+	// BytesSent is the number of bytes forwarded to the target.
+	BytesSent uint64
+	// BytesReceived is the number of bytes forwarded from the target.
+	BytesReceived uint64
+}
+
+// Manager manages a set of port forwards.
+type Manager struct {
+	logger   *slog.Logger
+	mesh     Network
+	host     Network
+	mu       sync.Mutex
+	forwards map[string]*forward
+}
+
+// NewManager creates a new port forward manager, forwarding between the
+// host's network and the given mesh network.
+func NewManager(logger *slog.Logger, mesh Network) *Manager {
+	return &Manager{
+		logger:   logger,
+		mesh:     mesh,
+		host:     hostNetwork{},
+		forwards: make(map[string]*forward),
+	}
+}
+
+// Add starts a new port forward, it returns the address the forward is
+// listening on.
+func (m *Manager) Add(conf Config) (net.Addr, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if conf.Name == "" {
+		return nil, errors.New("forward name is required")
+	}
+
+	if _, ok := m.forwards[conf.Name]; ok {
+		return nil, fmt.Errorf("forward %q already exists", conf.Name)
+	}
+
+	var listenNet, targetNet Network
+	switch conf.Direction {
+	case Local:
+		listenNet, targetNet = m.host, m.mesh
+	case Reverse:
+		listenNet, targetNet = m.mesh, m.host
+	default:
+		return nil, fmt.Errorf("unknown forward direction: %s", conf.Direction)
+	}
+
+	lis, err := listenNet.Listen("tcp", conf.ListenAddress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", conf.ListenAddress, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	f := &forward{
+		logger: m.logger.With("forward", conf.Name, "direction", conf.Direction.String(),
+			"listen", conf.ListenAddress, "target", conf.TargetAddress),
+		conf:   conf,
+		lis:    lis,
+		target: targetNet,
+		ctx:    ctx,
+		cancel: cancel,
+		conns:  make(map[net.Conn]struct{}),
+	}
+
+	m.forwards[conf.Name] = f
+
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+
+		f.serve()
+	}()
+
+	return lis.Addr(), nil
+}
+
+// Remove gracefully stops a port forward. It stops accepting new connections
+// and waits for active connections to finish, or for the context to be done,
+// after which any remaining connections are closed.
+func (m *Manager) Remove(ctx context.Context, name string) error {
+	m.mu.Lock()
+	f, ok := m.forwards[name]
+	if ok {
+		delete(m.forwards, name)
+	}
+	m.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("unknown forward %q", name)
+	}
+
+	return f.shutdown(ctx)
+}
+
+// List returns the configuration of all port forwards.
+func (m *Manager) List() []Config {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	forwards := make([]Config, 0, len(m.forwards))
+	for _, f := range m.forwards {
+		forwards = append(forwards, f.conf)
+	}
+
+	return forwards
+}
+
+// Stats returns a snapshot of the statistics of a port forward.
+func (m *Manager) Stats(name string) (Stats, error) {
+	m.mu.Lock()
+	f, ok := m.forwards[name]
+	m.mu.Unlock()
+
+	if !ok {
+		return Stats{}, fmt.Errorf("unknown forward %q", name)
+	}
+
+	return Stats{
+		Connections:       f.connections.Load(),
+		ActiveConnections: f.activeConnections.Load(),
+		BytesSent:         f.bytesSent.Load(),
+		BytesReceived:     f.bytesReceived.Load(),
+	}, nil
+}
+
+// Shutdown gracefully stops all port forwards, see Remove.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	forwards := m.forwards
+	m.forwards = make(map[string]*forward)
+	m.mu.Unlock()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(forwards))
+	for _, f := range forwards {
+		wg.Add(1)
+		go func(f *forward) {
+			defer wg.Done()
+
+			errs <- f.shutdown(ctx)
+		}(f)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	var result *multierror.Error
+	for err := range errs {
+		if err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+
+	return result.ErrorOrNil()
+}
+
+type forward struct {
+	logger            *slog.Logger
+	conf              Config
+	lis               net.Listener
+	target            Network
+	ctx               context.Context
+	cancel            context.CancelFunc
+	mu                sync.Mutex
+	conns             map[net.Conn]struct{}
+	wg                sync.WaitGroup
+	connections       atomic.Uint64
+	activeConnections atomic.Int64
+	bytesSent         atomic.Uint64
+	bytesReceived     atomic.Uint64
+}
+
+func (f *forward) serve() {
+	for {
+		conn, err := f.lis.Accept()
+		if err != nil {
+			if f.ctx.Err() == nil && !errors.Is(err, net.ErrClosed) {
+				f.logger.Warn("Failed to accept connection", "error", err)
+			}
+			return
+		}
+
+		f.connections.Add(1)
+
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+
+			f.handleConn(conn)
+		}()
+	}
+}
+
+func (f *forward) handleConn(conn net.Conn) {
+	f.activeConnections.Add(1)
+	defer f.activeConnections.Add(-1)
+
+	f.trackConn(conn)
+	defer f.untrackConn(conn)
+
+	upstream, err := f.target.DialContext(f.ctx, "tcp", f.conf.TargetAddress)
+	if err != nil {
+		f.logger.Debug("Failed to dial target", "error", err)
+		_ = conn.Close()
+		return
+	}
+
+	f.trackConn(upstream)
+	defer f.untrackConn(upstream)
+
+	if f.conf.ProxyProtocol {
+		if _, err := upstream.Write(proxyProtocolHeader(conn)); err != nil {
+			f.logger.Debug("Failed to send PROXY protocol header", "error", err)
+			_ = conn.Close()
+			_ = upstream.Close()
+			return
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	copyConn := func(dst, src net.Conn, counter *atomic.Uint64) {
+		defer wg.Done()
+
+		_, _ = io.Copy(&countingWriter{w: dst, n: counter}, src)
+
+		// Signal to the other side that we're done writing.
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		} else {
+			_ = dst.Close()
+		}
+	}
+
+	go copyConn(upstream, conn, &f.bytesSent)
+	go copyConn(conn, upstream, &f.bytesReceived)
+
+	wg.Wait()
+
+	_ = conn.Close()
+	_ = upstream.Close()
+}
+
+// trackConn registers a connection to be closed if graceful shutdown times out.
+// If the forward has already been forcibly shut down, the connection is closed.
+func (f *forward) trackConn(conn net.Conn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.conns == nil {
+		_ = conn.Close()
+		return
+	}
+
+	f.conns[conn] = struct{}{}
+}
+
+func (f *forward) untrackConn(conn net.Conn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.conns, conn)
+}
+
+func (f *forward) shutdown(ctx context.Context) error {
+	err := f.lis.Close()
+
+	done := make(chan struct{})
+	go func() {
+		f.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		// Abort any pending dials and close all remaining connections.
+		f.cancel()
+
+		f.mu.Lock()
+		for conn := range f.conns {
+			_ = conn.Close()
+		}
+		f.conns = nil
+		f.mu.Unlock()
+
+		<-done
+	}
+
+	f.cancel()
+
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		return fmt.Errorf("failed to close listener: %w", err)
+	}
+
+	return nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Uint64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n.Add(uint64(n))
+	return n, err
+}
+
+// hostNetwork is the host's network.
+type hostNetwork struct{}
+
+func (hostNetwork) Listen(network, address string) (net.Listener, error) {
+	return net.Listen(network, address)
+}
+
+func (hostNetwork) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
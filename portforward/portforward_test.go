@@ -0,0 +1,303 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package portforward_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets/portforward"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeMesh stands in for a noisy socket, it resolves peer names to host addresses.
+type fakeMesh map[string]string
+
+func (m fakeMesh) Listen(network, address string) (net.Listener, error) {
+	return net.Listen(network, "127.0.0.1:0")
+}
+
+func (m fakeMesh) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	target, ok := m[address]
+	if !ok {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("no such host")}
+	}
+
+	var d net.Dialer
+	return d.DialContext(ctx, network, target)
+}
+
+func TestManager(t *testing.T) {
+	logger := slogt.New(t)
+
+	echoAddr := startEchoServer(t)
+
+	m := portforward.NewManager(logger, fakeMesh{"web:80": echoAddr})
+	t.Cleanup(func() {
+		require.NoError(t, m.Shutdown(context.Background()))
+	})
+
+	t.Run("Local", func(t *testing.T) {
+		addr, err := m.Add(portforward.Config{
+			Name:          "web",
+			Direction:     portforward.Local,
+			ListenAddress: "127.0.0.1:0",
+			TargetAddress: "web:80",
+		})
+		require.NoError(t, err)
+
+		echo(t, addr.String(), "Hello, world!")
+
+		require.Eventually(t, func() bool {
+			stats, err := m.Stats("web")
+			require.NoError(t, err)
+
+			return stats.ActiveConnections == 0
+		}, time.Second, 10*time.Millisecond)
+
+		stats, err := m.Stats("web")
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), stats.Connections)
+		require.Equal(t, uint64(len("Hello, world!")), stats.BytesSent)
+		require.Equal(t, uint64(len("Hello, world!")), stats.BytesReceived)
+	})
+
+	t.Run("Reverse", func(t *testing.T) {
+		addr, err := m.Add(portforward.Config{
+			Name:          "ssh",
+			Direction:     portforward.Reverse,
+			ListenAddress: ":2222",
+			TargetAddress: echoAddr,
+		})
+		require.NoError(t, err)
+
+		echo(t, addr.String(), "SSH-2.0-OpenSSH")
+	})
+
+	t.Run("Duplicate", func(t *testing.T) {
+		_, err := m.Add(portforward.Config{
+			Name:          "web",
+			Direction:     portforward.Local,
+			ListenAddress: "127.0.0.1:0",
+			TargetAddress: "web:80",
+		})
+		require.Error(t, err)
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		addr, err := m.Add(portforward.Config{
+			Name:          "graceful",
+			Direction:     portforward.Local,
+			ListenAddress: "127.0.0.1:0",
+			TargetAddress: "web:80",
+		})
+		require.NoError(t, err)
+
+		// Hold a connection open.
+		conn, err := net.Dial("tcp", addr.String())
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+
+		require.Eventually(t, func() bool {
+			stats, err := m.Stats("graceful")
+			require.NoError(t, err)
+
+			return stats.ActiveConnections == 1
+		}, time.Second, 10*time.Millisecond)
+
+		// The connection is still active, so the graceful shutdown will time out.
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		require.NoError(t, m.Remove(ctx, "graceful"))
+
+		// The connection should have been forcibly closed.
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		require.ErrorIs(t, err, io.EOF)
+
+		_, err = net.Dial("tcp", addr.String())
+		require.Error(t, err)
+
+		require.Error(t, m.Remove(context.Background(), "graceful"))
+
+		require.Len(t, m.List(), 2)
+	})
+}
+
+// peerMesh is a fakeMesh whose accepted connections identify the peer.
+type peerMesh struct {
+	fakeMesh
+}
+
+func (m peerMesh) Listen(network, address string) (net.Listener, error) {
+	lis, err := m.fakeMesh.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &peerListener{Listener: lis}, nil
+}
+
+type peerListener struct {
+	net.Listener
+}
+
+func (l *peerListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &peerConn{Conn: conn}, nil
+}
+
+type peerConn struct {
+	net.Conn
+}
+
+func (c *peerConn) PeerName() string {
+	return "web"
+}
+
+func (c *peerConn) PeerPublicKey() string {
+	return "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="
+}
+
+func TestManager_ProxyProtocol(t *testing.T) {
+	logger := slogt.New(t)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = lis.Close()
+	})
+
+	m := portforward.NewManager(logger, peerMesh{})
+	t.Cleanup(func() {
+		require.NoError(t, m.Shutdown(context.Background()))
+	})
+
+	addr, err := m.Add(portforward.Config{
+		Name:          "web",
+		Direction:     portforward.Reverse,
+		ListenAddress: ":80",
+		TargetAddress: lis.Addr().String(),
+		ProxyProtocol: true,
+	})
+	require.NoError(t, err)
+
+	client, err := net.Dial("tcp", addr.String())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+
+	_, err = client.Write([]byte("Hello, world!"))
+	require.NoError(t, err)
+
+	backend, err := lis.Accept()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = backend.Close()
+	})
+
+	r := bufio.NewReader(backend)
+
+	header := make([]byte, 16)
+	_, err = io.ReadFull(r, header)
+	require.NoError(t, err)
+
+	require.Equal(t, []byte("\r\n\r\n\x00\r\nQUIT\n"), header[:12])
+	require.Equal(t, byte(0x21), header[12], "version 2, PROXY command")
+	require.Equal(t, byte(0x11), header[13], "TCP over IPv4")
+
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	_, err = io.ReadFull(r, body)
+	require.NoError(t, err)
+
+	clientAddr := client.LocalAddr().(*net.TCPAddr).AddrPort()
+	forwardAddr := addr.(*net.TCPAddr).AddrPort()
+
+	src, _ := netip.AddrFromSlice(body[0:4])
+	dst, _ := netip.AddrFromSlice(body[4:8])
+	require.Equal(t, clientAddr, netip.AddrPortFrom(src, binary.BigEndian.Uint16(body[8:10])))
+	require.Equal(t, forwardAddr, netip.AddrPortFrom(dst, binary.BigEndian.Uint16(body[10:12])))
+
+	tlvs := map[byte]string{}
+	for tlv := bytes.NewReader(body[12:]); tlv.Len() > 0; {
+		var hdr [3]byte
+		_, err := io.ReadFull(tlv, hdr[:])
+		require.NoError(t, err)
+
+		value := make([]byte, binary.BigEndian.Uint16(hdr[1:]))
+		_, err = io.ReadFull(tlv, value)
+		require.NoError(t, err)
+
+		tlvs[hdr[0]] = string(value)
+	}
+	require.Equal(t, map[byte]string{
+		portforward.TLVTypePeerPublicKey: "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=",
+		portforward.TLVTypePeerName:      "web",
+	}, tlvs)
+
+	// The connection's data follows the header.
+	data := make([]byte, len("Hello, world!"))
+	_, err = io.ReadFull(r, data)
+	require.NoError(t, err)
+	require.Equal(t, "Hello, world!", string(data))
+}
+
+func startEchoServer(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = lis.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return lis.Addr().String()
+}
+
+func echo(t *testing.T, address, msg string) {
+	conn, err := net.Dial("tcp", address)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(msg))
+	require.NoError(t, err)
+
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+
+	reply, err := io.ReadAll(conn)
+	require.NoError(t, err)
+
+	require.Equal(t, msg, string(reply))
+}
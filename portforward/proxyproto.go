@@ -0,0 +1,101 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package portforward
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+)
+
+// Custom PROXY protocol v2 TLV types (within the range reserved for
+// applications) carrying the identity of the peer a connection is from.
+const (
+	// TLVTypePeerPublicKey is the type of the TLV holding the encoded public key of the peer.
+	TLVTypePeerPublicKey = 0xE0
+	// TLVTypePeerName is the type of the TLV holding the name of the peer.
+	TLVTypePeerName = 0xE1
+)
+
+// proxyProtocolSignature begins every PROXY protocol v2 header.
+var proxyProtocolSignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyProtocolVersion2 = 0x20
+	proxyProtocolLocal    = 0x00
+	proxyProtocolProxy    = 0x01
+	proxyProtocolTCP4     = 0x11
+	proxyProtocolTCP6     = 0x21
+)
+
+// peerConn is implemented by connections accepted from the mesh (see
+// noisysockets.PeerConn).
+type peerConn interface {
+	PeerName() string
+	PeerPublicKey() string
+}
+
+// proxyProtocolHeader builds a PROXY protocol v2 header describing the given
+// connection, accepted by a forward. The header carries the connection's
+// source and destination (the forward's listen address), and for connections
+// from peers, the peer's public key and name. Connections that aren't TCP are
+// described as LOCAL, so that the backend uses the connection's own addresses.
+func proxyProtocolHeader(conn net.Conn) []byte {
+	header := append([]byte(nil), proxyProtocolSignature...)
+
+	src, srcOK := tcpAddrPort(conn.RemoteAddr())
+	dst, dstOK := tcpAddrPort(conn.LocalAddr())
+	if !srcOK || !dstOK {
+		return append(header, proxyProtocolVersion2|proxyProtocolLocal, 0x00, 0x00, 0x00)
+	}
+
+	var body []byte
+	family := byte(proxyProtocolTCP4)
+	if src.Addr().Is4() && dst.Addr().Is4() {
+		srcAddr, dstAddr := src.Addr().As4(), dst.Addr().As4()
+		body = append(body, srcAddr[:]...)
+		body = append(body, dstAddr[:]...)
+	} else {
+		// Mixed families are described as IPv6 (with IPv4-mapped addresses).
+		family = proxyProtocolTCP6
+		srcAddr, dstAddr := src.Addr().As16(), dst.Addr().As16()
+		body = append(body, srcAddr[:]...)
+		body = append(body, dstAddr[:]...)
+	}
+	body = binary.BigEndian.AppendUint16(body, src.Port())
+	body = binary.BigEndian.AppendUint16(body, dst.Port())
+
+	if peer, ok := conn.(peerConn); ok {
+		if publicKey := peer.PeerPublicKey(); publicKey != "" {
+			body = appendTLV(body, TLVTypePeerPublicKey, publicKey)
+		}
+
+		if name := peer.PeerName(); name != "" {
+			body = appendTLV(body, TLVTypePeerName, name)
+		}
+	}
+
+	header = append(header, proxyProtocolVersion2|proxyProtocolProxy, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(body)))
+
+	return append(header, body...)
+}
+
+func appendTLV(b []byte, typ byte, value string) []byte {
+	b = append(b, typ)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+	return append(b, value...)
+}
+
+func tcpAddrPort(addr net.Addr) (netip.AddrPort, bool) {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return netip.AddrPort{}, false
+	}
+
+	addrPort := tcpAddr.AddrPort()
+	return netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port()), true
+}
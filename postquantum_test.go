@@ -0,0 +1,188 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets_test
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoisySocket_PostQuantum(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	newConfs := func(serverPostQuantum, clientPostQuantum bool) (*v1alpha1.Config, *v1alpha1.Config) {
+		serverConf := &v1alpha1.Config{
+			Name:       "server",
+			PrivateKey: serverPrivateKey.String(),
+			IPs:        []string{"10.7.0.1"},
+			Peers: []v1alpha1.WireGuardPeerConfig{
+				{
+					Name:        "client",
+					PublicKey:   clientPrivateKey.PublicKey().String(),
+					IPs:         []string{"10.7.0.2"},
+					PostQuantum: serverPostQuantum,
+				},
+			},
+		}
+
+		clientConf := &v1alpha1.Config{
+			Name:       "client",
+			PrivateKey: clientPrivateKey.String(),
+			IPs:        []string{"10.7.0.2"},
+			Peers: []v1alpha1.WireGuardPeerConfig{
+				{
+					Name:        "server",
+					PublicKey:   serverPrivateKey.PublicKey().String(),
+					IPs:         []string{"10.7.0.1"},
+					PostQuantum: clientPostQuantum,
+				},
+			},
+		}
+
+		return serverConf, clientConf
+	}
+
+	exchange := func(t *testing.T, serverSocket, clientSocket *noisysockets.NoisySocket, port string) {
+		lis, err := serverSocket.Listen("tcp", ":"+port)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, lis.Close())
+		})
+
+		go func() {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			_, _ = conn.Write([]byte("Hello, world!"))
+		}()
+
+		conn, err := clientSocket.DialTimeout("tcp", "server:"+port, 20*time.Second)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, conn.Close())
+		})
+
+		require.NoError(t, conn.SetDeadline(time.Now().Add(20*time.Second)))
+
+		buf, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		require.Equal(t, "Hello, world!", string(buf))
+	}
+
+	isPostQuantum := func(socket *noisysockets.NoisySocket, peerName string) bool {
+		status, err := socket.PeerStatus(peerName)
+		return err == nil && status.PostQuantum
+	}
+
+	t.Run("Enabled", func(t *testing.T) {
+		serverConf, clientConf := newConfs(true, true)
+
+		serverSocket, clientSocket, err := noisysockets.Pipe(logger, serverConf, clientConf, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, serverSocket.Close())
+			require.NoError(t, clientSocket.Close())
+		})
+
+		exchange(t, serverSocket, clientSocket, "80")
+
+		// A new handshake follows the key exchange.
+		require.Eventually(t, func() bool {
+			return isPostQuantum(serverSocket, "client") && isPostQuantum(clientSocket, "server")
+		}, 10*time.Second, 100*time.Millisecond)
+
+		exchange(t, serverSocket, clientSocket, "81")
+	})
+
+	t.Run("One Sided", func(t *testing.T) {
+		serverConf, clientConf := newConfs(false, true)
+
+		serverSocket, clientSocket, err := noisysockets.Pipe(logger, serverConf, clientConf, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, serverSocket.Close())
+			require.NoError(t, clientSocket.Close())
+		})
+
+		exchange(t, serverSocket, clientSocket, "80")
+
+		require.False(t, isPostQuantum(serverSocket, "client"))
+		require.False(t, isPostQuantum(clientSocket, "server"))
+	})
+
+	t.Run("Required", func(t *testing.T) {
+		serverConf, clientConf := newConfs(true, true)
+		serverConf.Peers[0].RequirePostQuantum = true
+		clientConf.Peers[0].RequirePostQuantum = true
+
+		serverSocket, clientSocket, err := noisysockets.Pipe(logger, serverConf, clientConf, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, serverSocket.Close())
+			require.NoError(t, clientSocket.Close())
+		})
+
+		// Data is only exchanged once there is a post-quantum session.
+		exchange(t, serverSocket, clientSocket, "80")
+
+		require.True(t, isPostQuantum(serverSocket, "client"))
+		require.True(t, isPostQuantum(clientSocket, "server"))
+	})
+
+	t.Run("Required One Sided", func(t *testing.T) {
+		serverConf, clientConf := newConfs(true, false)
+		serverConf.Peers[0].RequirePostQuantum = true
+
+		serverSocket, clientSocket, err := noisysockets.Pipe(logger, serverConf, clientConf, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, serverSocket.Close())
+			require.NoError(t, clientSocket.Close())
+		})
+
+		lis, err := serverSocket.Listen("tcp", ":80")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, lis.Close())
+		})
+
+		// The server refuses to exchange data without a post-quantum session.
+		_, err = clientSocket.DialTimeout("tcp", "server:80", 2*time.Second)
+		require.Error(t, err)
+	})
+
+	t.Run("Required Without Enabled", func(t *testing.T) {
+		serverConf, clientConf := newConfs(false, false)
+		serverConf.Peers[0].RequirePostQuantum = true
+
+		_, _, err := noisysockets.Pipe(logger, serverConf, clientConf, nil)
+		require.ErrorContains(t, err, "requires post-quantum key exchange")
+	})
+
+	t.Run("Strict Interop", func(t *testing.T) {
+		serverConf, clientConf := newConfs(true, false)
+		serverConf.StrictInterop = true
+
+		_, _, err := noisysockets.Pipe(logger, serverConf, clientConf, nil)
+		require.ErrorContains(t, err, "not supported in strict interop mode")
+	})
+}
@@ -0,0 +1,134 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"net/netip"
+)
+
+// prefixTrie is a binary trie mapping IP prefixes to values, supporting
+// longest prefix match lookups. It is not safe for concurrent use.
+type prefixTrie[V any] struct {
+	v4 *prefixTrieNode[V]
+	v6 *prefixTrieNode[V]
+}
+
+type prefixTrieNode[V any] struct {
+	children [2]*prefixTrieNode[V]
+	value    V
+	hasValue bool
+}
+
+func newPrefixTrie[V any]() *prefixTrie[V] {
+	return &prefixTrie[V]{
+		v4: &prefixTrieNode[V]{},
+		v6: &prefixTrieNode[V]{},
+	}
+}
+
+// Insert associates the prefix with the given value, replacing any existing value.
+func (t *prefixTrie[V]) Insert(prefix netip.Prefix, value V) {
+	prefix = prefix.Masked()
+	addr := prefix.Addr().AsSlice()
+
+	node := t.root(prefix.Addr())
+	for i := 0; i < prefix.Bits(); i++ {
+		b := bitAt(addr, i)
+		if node.children[b] == nil {
+			node.children[b] = &prefixTrieNode[V]{}
+		}
+		node = node.children[b]
+	}
+
+	node.value = value
+	node.hasValue = true
+}
+
+// Get returns the value associated with exactly the given prefix.
+func (t *prefixTrie[V]) Get(prefix netip.Prefix) (V, bool) {
+	prefix = prefix.Masked()
+	addr := prefix.Addr().AsSlice()
+
+	node := t.root(prefix.Addr())
+	for i := 0; i < prefix.Bits() && node != nil; i++ {
+		node = node.children[bitAt(addr, i)]
+	}
+
+	if node == nil || !node.hasValue {
+		var zero V
+		return zero, false
+	}
+
+	return node.value, true
+}
+
+// Delete removes the value associated with exactly the given prefix.
+func (t *prefixTrie[V]) Delete(prefix netip.Prefix) {
+	prefix = prefix.Masked()
+	addr := prefix.Addr().AsSlice()
+
+	// Keep track of the path so that we can prune empty branches.
+	path := make([]*prefixTrieNode[V], 0, prefix.Bits()+1)
+
+	node := t.root(prefix.Addr())
+	path = append(path, node)
+	for i := 0; i < prefix.Bits(); i++ {
+		node = node.children[bitAt(addr, i)]
+		if node == nil {
+			return
+		}
+		path = append(path, node)
+	}
+
+	var zero V
+	node.value = zero
+	node.hasValue = false
+
+	for i := len(path) - 1; i > 0; i-- {
+		n := path[i]
+		if n.hasValue || n.children[0] != nil || n.children[1] != nil {
+			break
+		}
+
+		path[i-1].children[bitAt(addr, i-1)] = nil
+	}
+}
+
+// Lookup returns the value associated with the longest prefix containing addr.
+func (t *prefixTrie[V]) Lookup(addr netip.Addr) (V, bool) {
+	addr = addr.Unmap()
+	bytes := addr.AsSlice()
+
+	var value V
+	var found bool
+
+	node := t.root(addr)
+	for i := 0; node != nil; i++ {
+		if node.hasValue {
+			value, found = node.value, true
+		}
+
+		if i == addr.BitLen() {
+			break
+		}
+
+		node = node.children[bitAt(bytes, i)]
+	}
+
+	return value, found
+}
+
+func (t *prefixTrie[V]) root(addr netip.Addr) *prefixTrieNode[V] {
+	if addr.Is4() {
+		return t.v4
+	}
+
+	return t.v6
+}
+
+func bitAt(addr []byte, i int) int {
+	return int(addr[i/8]>>(7-uint(i%8))) & 1
+}
@@ -0,0 +1,80 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefixTrie(t *testing.T) {
+	trie := newPrefixTrie[string]()
+
+	trie.Insert(netip.MustParsePrefix("10.8.0.0/16"), "wide")
+	trie.Insert(netip.MustParsePrefix("10.8.1.0/24"), "narrow")
+	trie.Insert(netip.MustParsePrefix("10.8.1.7/32"), "host")
+	trie.Insert(netip.MustParsePrefix("fd00::/64"), "v6")
+
+	for _, tc := range []struct {
+		addr     string
+		expected string
+		found    bool
+	}{
+		{"10.8.2.1", "wide", true},
+		{"10.8.1.1", "narrow", true},
+		{"10.8.1.7", "host", true},
+		{"10.9.0.1", "", false},
+		{"fd00::1", "v6", true},
+		{"fd01::1", "", false},
+		// IPv4-mapped IPv6 addresses resolve using the IPv4 trie.
+		{"::ffff:10.8.1.1", "narrow", true},
+	} {
+		value, ok := trie.Lookup(netip.MustParseAddr(tc.addr))
+		require.Equal(t, tc.found, ok, tc.addr)
+		require.Equal(t, tc.expected, value, tc.addr)
+	}
+
+	t.Run("Get", func(t *testing.T) {
+		value, ok := trie.Get(netip.MustParsePrefix("10.8.1.0/24"))
+		require.True(t, ok)
+		require.Equal(t, "narrow", value)
+
+		// Host bits are ignored.
+		value, ok = trie.Get(netip.MustParsePrefix("10.8.1.1/24"))
+		require.True(t, ok)
+		require.Equal(t, "narrow", value)
+
+		_, ok = trie.Get(netip.MustParsePrefix("10.8.0.0/23"))
+		require.False(t, ok)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		trie.Delete(netip.MustParsePrefix("10.8.1.0/24"))
+
+		value, ok := trie.Lookup(netip.MustParseAddr("10.8.1.1"))
+		require.True(t, ok)
+		require.Equal(t, "wide", value)
+
+		value, ok = trie.Lookup(netip.MustParseAddr("10.8.1.7"))
+		require.True(t, ok)
+		require.Equal(t, "host", value)
+
+		trie.Delete(netip.MustParsePrefix("10.8.1.7/32"))
+		trie.Delete(netip.MustParsePrefix("10.8.0.0/16"))
+
+		_, ok = trie.Lookup(netip.MustParseAddr("10.8.1.7"))
+		require.False(t, ok)
+
+		// All empty branches should have been pruned.
+		require.Nil(t, trie.v4.children[0])
+		require.Nil(t, trie.v4.children[1])
+
+		// Deleting a prefix that doesn't exist is a no-op.
+		trie.Delete(netip.MustParsePrefix("192.168.0.0/16"))
+	})
+}
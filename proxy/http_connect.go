@@ -0,0 +1,166 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// HTTPConnectOptions are the options for an HTTP CONNECT proxy.
+type HTTPConnectOptions struct {
+	// Username and Password, if set, require clients to authenticate with basic auth.
+	Username string
+	Password string
+	// Allow is an optional list of destinations that clients are allowed to
+	// connect to. Entries are of the form "host:port", "host:*" or "host" (any port).
+	// If empty, all destinations are allowed.
+	Allow []string
+}
+
+// HTTPConnectHandler is an http.Handler that implements an HTTP CONNECT proxy,
+// dialing all requests through the provided dialer. Host names are passed
+// through to the dialer unresolved, so the names of peers can be used as
+// destinations.
+type HTTPConnectHandler struct {
+	logger *slog.Logger
+	dialer Dialer
+	opts   HTTPConnectOptions
+}
+
+// NewHTTPConnectHandler creates a new HTTP CONNECT proxy handler.
+func NewHTTPConnectHandler(logger *slog.Logger, dialer Dialer, opts *HTTPConnectOptions) *HTTPConnectHandler {
+	h := &HTTPConnectHandler{
+		logger: logger,
+		dialer: dialer,
+	}
+
+	if opts != nil {
+		h.opts = *opts
+	}
+
+	return h
+}
+
+func (h *HTTPConnectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		w.Header().Set("Allow", http.MethodConnect)
+		http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.authenticate(r) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="proxy"`)
+		http.Error(w, http.StatusText(http.StatusProxyAuthRequired), http.StatusProxyAuthRequired)
+		return
+	}
+
+	address := r.Host
+	if !h.allowed(address) {
+		http.Error(w, "destination not allowed", http.StatusForbidden)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+
+	upstream, err := h.dialer.DialContext(r.Context(), "tcp", address)
+	if err != nil {
+		h.logger.Debug("Failed to dial", "address", address, "error", err)
+		http.Error(w, "failed to connect to destination", http.StatusBadGateway)
+		return
+	}
+
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		h.logger.Debug("Failed to hijack connection", "error", err)
+		_ = upstream.Close()
+		return
+	}
+
+	if _, err := brw.WriteString("HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		_ = conn.Close()
+		_ = upstream.Close()
+		return
+	}
+
+	if err := brw.Flush(); err != nil {
+		_ = conn.Close()
+		_ = upstream.Close()
+		return
+	}
+
+	// The client may have sent data before receiving our response.
+	if n := brw.Reader.Buffered(); n > 0 {
+		buffered, _ := brw.Reader.Peek(n)
+		if _, err := upstream.Write(buffered); err != nil {
+			_ = conn.Close()
+			_ = upstream.Close()
+			return
+		}
+	}
+
+	splice(conn, upstream)
+}
+
+func (h *HTTPConnectHandler) authenticate(r *http.Request) bool {
+	if h.opts.Username == "" && h.opts.Password == "" {
+		return true
+	}
+
+	auth := r.Header.Get("Proxy-Authorization")
+	encoded, ok := strings.CutPrefix(auth, "Basic ")
+	if !ok {
+		return false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return false
+	}
+
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return false
+	}
+
+	usernameMatch := subtle.ConstantTimeCompare([]byte(username), []byte(h.opts.Username)) == 1
+	passwordMatch := subtle.ConstantTimeCompare([]byte(password), []byte(h.opts.Password)) == 1
+
+	return usernameMatch && passwordMatch
+}
+
+func (h *HTTPConnectHandler) allowed(address string) bool {
+	if len(h.opts.Allow) == 0 {
+		return true
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+
+	for _, entry := range h.opts.Allow {
+		allowedHost, allowedPort, err := net.SplitHostPort(entry)
+		if err != nil {
+			// No port, so any port is allowed.
+			allowedHost, allowedPort = entry, "*"
+		}
+
+		if strings.EqualFold(allowedHost, host) && (allowedPort == "*" || allowedPort == port) {
+			return true
+		}
+	}
+
+	return false
+}
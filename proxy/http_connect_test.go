@@ -0,0 +1,109 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package proxy_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPConnectHandler(t *testing.T) {
+	logger := slogt.New(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "Hello, world!")
+	}))
+	t.Cleanup(srv.Close)
+
+	proxySrv := httptest.NewServer(proxy.NewHTTPConnectHandler(logger, staticDialer{
+		"web:80":   srv.Listener.Addr().String(),
+		"admin:80": srv.Listener.Addr().String(),
+	}, &proxy.HTTPConnectOptions{
+		Username: "user",
+		Password: "secret",
+		Allow:    []string{"web:80"},
+	}))
+	t.Cleanup(proxySrv.Close)
+
+	t.Run("Connect", func(t *testing.T) {
+		conn, resp := connect(t, proxySrv.Listener.Addr().String(), "web:80", "user", "secret")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		req, err := http.NewRequest(http.MethodGet, "http://web/", nil)
+		require.NoError(t, err)
+		require.NoError(t, req.Write(conn))
+
+		resp, err = http.ReadResponse(bufio.NewReader(conn), req)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, resp.Body.Close())
+		})
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		require.Equal(t, "Hello, world!", string(body))
+	})
+
+	t.Run("Bad Credentials", func(t *testing.T) {
+		_, resp := connect(t, proxySrv.Listener.Addr().String(), "web:80", "user", "wrong")
+		require.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+	})
+
+	t.Run("Not Allowed", func(t *testing.T) {
+		_, resp := connect(t, proxySrv.Listener.Addr().String(), "admin:80", "user", "secret")
+		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+
+	t.Run("Unknown Host", func(t *testing.T) {
+		openProxySrv := httptest.NewServer(proxy.NewHTTPConnectHandler(logger, staticDialer{}, nil))
+		t.Cleanup(openProxySrv.Close)
+
+		_, resp := connect(t, openProxySrv.Listener.Addr().String(), "unknown:80", "", "")
+		require.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	})
+
+	t.Run("Method Not Allowed", func(t *testing.T) {
+		resp, err := http.Get(proxySrv.URL)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+
+		require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	})
+}
+
+// connect issues a CONNECT request to the proxy and returns the connection and response.
+func connect(t *testing.T, proxyAddr, address, username, password string) (net.Conn, *http.Response) {
+	conn, err := net.Dial("tcp", proxyAddr)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	req, err := http.NewRequest(http.MethodConnect, "http://"+address, nil)
+	require.NoError(t, err)
+	req.Host = address
+	req.SetBasicAuth(username, password)
+	// SetBasicAuth sets the Authorization header, but proxies use Proxy-Authorization.
+	req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+	req.Header.Del("Authorization")
+
+	require.NoError(t, req.Write(conn))
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	require.NoError(t, err)
+
+	return conn, resp
+}
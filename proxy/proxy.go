@@ -0,0 +1,162 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+// Package proxy implements proxy servers that forward connections from the
+// host through a noisy socket, making the mesh usable by unmodified programs,
+// and that route connections from the mesh to services on the host.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// Dialer dials connections, typically through a noisy socket.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// splice copies data between the two connections until both directions are
+// finished, then closes both connections.
+func splice(a, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	copyConn := func(dst, src net.Conn) {
+		defer wg.Done()
+
+		_, _ = io.Copy(dst, src)
+
+		// Signal to the other side that we're done writing.
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		} else {
+			_ = dst.Close()
+		}
+	}
+
+	go copyConn(a, b)
+	go copyConn(b, a)
+
+	wg.Wait()
+
+	_ = a.Close()
+	_ = b.Close()
+}
+
+// server tracks the listeners and connections of a proxy server so that they
+// can be closed on shutdown.
+type server struct {
+	// ctx is cancelled when the server is closed.
+	ctx       context.Context
+	cancel    context.CancelFunc
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	wg        sync.WaitGroup
+}
+
+func newServer() *server {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &server{
+		ctx:       ctx,
+		cancel:    cancel,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// serve accepts connections from the listener and handles them until the
+// listener is closed.
+func (s *server) serve(lis net.Listener, handle func(conn net.Conn)) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		_ = lis.Close()
+		return net.ErrClosed
+	}
+	s.listeners[lis] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, lis)
+		s.mu.Unlock()
+	}()
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed || errors.Is(err, net.ErrClosed) {
+				return net.ErrClosed
+			}
+
+			return err
+		}
+
+		if !s.trackConn(conn) {
+			_ = conn.Close()
+			return net.ErrClosed
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.untrackConn(conn)
+
+			handle(conn)
+		}()
+	}
+}
+
+// trackConn registers a connection to be closed on shutdown, it returns false
+// if the server has already been closed.
+func (s *server) trackConn(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+
+	s.conns[conn] = struct{}{}
+
+	return true
+}
+
+func (s *server) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, conn)
+}
+
+// close closes all listeners and connections, and waits for the connection
+// handlers to return.
+func (s *server) close() error {
+	s.cancel()
+
+	s.mu.Lock()
+	s.closed = true
+	for lis := range s.listeners {
+		_ = lis.Close()
+	}
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+
+	return nil
+}
@@ -0,0 +1,152 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Headers added to requests forwarded by a reverse proxy, identifying the peer
+// the request is from. Any such headers sent by the client are removed.
+const (
+	// PeerNameHeader is the name of the peer, if it has one.
+	PeerNameHeader = "X-Noisysockets-Peer-Name"
+	// PeerPublicKeyHeader is the encoded public key of the peer.
+	PeerPublicKeyHeader = "X-Noisysockets-Peer-Public-Key"
+)
+
+// reverseProxyReadHeaderTimeout is the maximum time allowed for a client to
+// send the headers of a request.
+const reverseProxyReadHeaderTimeout = 30 * time.Second
+
+// peerConn is implemented by connections accepted from the mesh (see
+// noisysockets.PeerConn).
+type peerConn interface {
+	PeerName() string
+	PeerPublicKey() string
+}
+
+type peerConnContextKey struct{}
+
+// ReverseProxy is an HTTP reverse proxy that exposes local services (eg. a
+// development server) to the mesh. Requests are routed by their host and path,
+// and forwarded to the upstream of the matching route with headers identifying
+// the peer they are from (see PeerNameHeader and PeerPublicKeyHeader), so that
+// upstreams can authorize requests without handling authentication themselves.
+type ReverseProxy struct {
+	logger *slog.Logger
+	mux    *http.ServeMux
+	srv    *http.Server
+}
+
+// NewReverseProxy creates a new reverse proxy. Routes map patterns, of the form
+// "[host]/[path]" (see http.ServeMux), eg. "/" or "api.dev/v1/", to the URLs of
+// upstreams, eg. "http://127.0.0.1:3000". Request paths are forwarded as they
+// are, appended to the path of the upstream's URL.
+func NewReverseProxy(logger *slog.Logger, routes map[string]string) (*ReverseProxy, error) {
+	p := &ReverseProxy{
+		logger: logger,
+		mux:    http.NewServeMux(),
+	}
+
+	for pattern, upstream := range routes {
+		if !strings.Contains(pattern, "/") {
+			return nil, fmt.Errorf("invalid route pattern %q: must be of the form [host]/[path]", pattern)
+		}
+
+		target, err := url.Parse(upstream)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse upstream URL %q: %w", upstream, err)
+		}
+
+		if (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			return nil, fmt.Errorf("invalid upstream URL %q: must be an http:// or https:// URL", upstream)
+		}
+
+		p.mux.Handle(pattern, p.newUpstreamHandler(target))
+	}
+
+	p.srv = &http.Server{
+		Handler:           p.mux,
+		ReadHeaderTimeout: reverseProxyReadHeaderTimeout,
+		ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelDebug),
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			// Connections may be wrapped, eg. by TLS.
+			if netConn, ok := conn.(interface{ NetConn() net.Conn }); ok {
+				conn = netConn.NetConn()
+			}
+
+			if peer, ok := conn.(peerConn); ok {
+				return context.WithValue(ctx, peerConnContextKey{}, peer)
+			}
+
+			return ctx
+		},
+	}
+
+	return p, nil
+}
+
+// Serve accepts connections from the listener and serves requests, it blocks
+// until the listener or proxy is closed.
+func (p *ReverseProxy) Serve(lis net.Listener) error {
+	return p.srv.Serve(lis)
+}
+
+// Close stops the proxy, closing all listeners and active connections.
+func (p *ReverseProxy) Close() error {
+	return p.srv.Close()
+}
+
+// Shutdown gracefully stops the proxy, it closes all listeners and idle
+// connections, and then waits for active requests to complete (or the context
+// to be done).
+func (p *ReverseProxy) Shutdown(ctx context.Context) error {
+	return p.srv.Shutdown(ctx)
+}
+
+// ServeHTTP routes a request to its upstream. Requests served this way, rather
+// than by Serve, aren't identified as being from a peer.
+func (p *ReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mux.ServeHTTP(w, r)
+}
+
+func (p *ReverseProxy) newUpstreamHandler(target *url.URL) http.Handler {
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+			r.SetXForwarded()
+			// Keep the original host, as upstreams (eg. development servers)
+			// often generate links using it.
+			r.Out.Host = r.In.Host
+
+			r.Out.Header.Del(PeerNameHeader)
+			r.Out.Header.Del(PeerPublicKeyHeader)
+
+			if peer, ok := r.In.Context().Value(peerConnContextKey{}).(peerConn); ok {
+				if name := peer.PeerName(); name != "" {
+					r.Out.Header.Set(PeerNameHeader, name)
+				}
+
+				if publicKey := peer.PeerPublicKey(); publicKey != "" {
+					r.Out.Header.Set(PeerPublicKeyHeader, publicKey)
+				}
+			}
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			p.logger.Debug("Failed to proxy request", "upstream", target.String(), "error", err)
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		},
+	}
+}
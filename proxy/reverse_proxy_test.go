@@ -0,0 +1,75 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package proxy_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReverseProxy(t *testing.T) {
+	logger := slogt.New(t)
+
+	newUpstream := func(name string) string {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %s %q", name, r.URL.Path, r.Header.Get(proxy.PeerNameHeader))
+		}))
+		t.Cleanup(srv.Close)
+
+		return srv.URL
+	}
+
+	p, err := proxy.NewReverseProxy(logger, map[string]string{
+		"/":           newUpstream("web"),
+		"/api/":       newUpstream("api"),
+		"docs.dev/":   newUpstream("docs"),
+		"docs.dev/v1": newUpstream("docs-v1"),
+	})
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(p)
+	t.Cleanup(srv.Close)
+
+	get := func(host, path string) string {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		require.NoError(t, err)
+		req.Host = host
+		// Requests that aren't from peers have no identity.
+		req.Header.Set(proxy.PeerNameHeader, "admin")
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		return string(body)
+	}
+
+	require.Equal(t, `web /index.html ""`, get("dev", "/index.html"))
+	require.Equal(t, `api /api/users ""`, get("dev", "/api/users"))
+	require.Equal(t, `docs /index.html ""`, get("docs.dev", "/index.html"))
+	require.Equal(t, `docs-v1 /v1 ""`, get("docs.dev", "/v1"))
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, routes := range []map[string]string{
+			{"dev": "http://127.0.0.1:3000"},
+			{"/": "127.0.0.1:3000"},
+			{"/": "ftp://127.0.0.1"},
+		} {
+			_, err := proxy.NewReverseProxy(logger, routes)
+			require.Error(t, err, routes)
+		}
+	})
+}
@@ -0,0 +1,199 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// sniHandshakeTimeout is the maximum time allowed for a client to send
+	// its TLS ClientHello.
+	sniHandshakeTimeout = 10 * time.Second
+)
+
+// errClientHelloRead stops the TLS handshake once the ClientHello has been read.
+var errClientHelloRead = errors.New("client hello read")
+
+// SNIRouterOptions are the options for an SNI router.
+type SNIRouterOptions struct {
+	// DefaultBackend is an optional backend address for connections without a
+	// server name, or whose server name doesn't match any route. If empty,
+	// such connections are closed.
+	DefaultBackend string
+}
+
+// SNIRouter routes TLS connections to backends by the server name (SNI) of
+// their ClientHello, so that many TLS services can share a single port (eg.
+// port 443 of a noisy socket). TLS isn't terminated, connections are passed
+// through to the backend as they are, so backends serve their own certificates.
+type SNIRouter struct {
+	*server
+	logger *slog.Logger
+	dialer Dialer
+	routes map[string]string
+	opts   SNIRouterOptions
+}
+
+// NewSNIRouter creates a new SNI router, dialing backends through the provided
+// dialer. Routes map server names (eg. "grafana.example.com", or a wildcard
+// "*.example.com" that matches a single label) to backend addresses (eg.
+// "127.0.0.1:3000"). Exact matches take precedence over wildcards.
+func NewSNIRouter(logger *slog.Logger, dialer Dialer, routes map[string]string, opts *SNIRouterOptions) *SNIRouter {
+	r := &SNIRouter{
+		server: newServer(),
+		logger: logger,
+		dialer: dialer,
+		routes: make(map[string]string, len(routes)),
+	}
+
+	for name, backend := range routes {
+		r.routes[strings.ToLower(strings.TrimSuffix(name, "."))] = backend
+	}
+
+	if opts != nil {
+		r.opts = *opts
+	}
+
+	return r
+}
+
+// Serve accepts connections from the listener and routes them to backends,
+// it blocks until the listener or router is closed.
+func (r *SNIRouter) Serve(lis net.Listener) error {
+	return r.serve(lis, r.handleConn)
+}
+
+// Close stops the router, closing all listeners and active connections.
+func (r *SNIRouter) Close() error {
+	return r.close()
+}
+
+func (r *SNIRouter) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	logger := r.logger.With("client", conn.RemoteAddr().String())
+
+	_ = conn.SetReadDeadline(time.Now().Add(sniHandshakeTimeout))
+
+	serverName, hello, err := peekServerName(conn)
+	if err != nil {
+		logger.Debug("Failed to read ClientHello", "error", err)
+		return
+	}
+
+	_ = conn.SetReadDeadline(time.Time{})
+
+	backend, ok := r.route(serverName)
+	if !ok {
+		logger.Debug("No route for server name", "serverName", serverName)
+		return
+	}
+
+	upstream, err := r.dialer.DialContext(r.ctx, "tcp", backend)
+	if err != nil {
+		logger.Debug("Failed to dial backend", "serverName", serverName, "backend", backend, "error", err)
+		return
+	}
+
+	if !r.trackConn(upstream) {
+		_ = upstream.Close()
+		return
+	}
+	defer r.untrackConn(upstream)
+
+	// Replay the ClientHello to the backend.
+	if _, err := upstream.Write(hello); err != nil {
+		_ = upstream.Close()
+		return
+	}
+
+	splice(conn, upstream)
+}
+
+// route returns the backend for a server name.
+func (r *SNIRouter) route(serverName string) (string, bool) {
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+
+	if serverName != "" {
+		if backend, ok := r.routes[serverName]; ok {
+			return backend, true
+		}
+
+		if _, parent, ok := strings.Cut(serverName, "."); ok {
+			if backend, ok := r.routes["*."+parent]; ok {
+				return backend, true
+			}
+		}
+	}
+
+	return r.opts.DefaultBackend, r.opts.DefaultBackend != ""
+}
+
+// peekServerName reads the TLS ClientHello from the connection, returning
+// the server name it requested (if any), and the bytes that were read.
+func peekServerName(conn net.Conn) (string, []byte, error) {
+	var buf bytes.Buffer
+	var hello *tls.ClientHelloInfo
+
+	// Let crypto/tls parse the ClientHello, aborting the handshake before
+	// anything is written to the client.
+	err := tls.Server(readOnlyConn{r: io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = info
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	if hello == nil {
+		return "", nil, err
+	}
+
+	return hello.ServerName, buf.Bytes(), nil
+}
+
+// readOnlyConn is a connection that can only be read from.
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c readOnlyConn) Write(p []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+func (c readOnlyConn) Close() error {
+	return nil
+}
+
+func (c readOnlyConn) LocalAddr() net.Addr {
+	return nil
+}
+
+func (c readOnlyConn) RemoteAddr() net.Addr {
+	return nil
+}
+
+func (c readOnlyConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c readOnlyConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
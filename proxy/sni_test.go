@@ -0,0 +1,108 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package proxy_test
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSNIRouter(t *testing.T) {
+	logger := slogt.New(t)
+
+	newBackend := func(name string) string {
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "Hello from %s!", name)
+		}))
+		t.Cleanup(srv.Close)
+
+		return srv.Listener.Addr().String()
+	}
+
+	var d net.Dialer
+	r := proxy.NewSNIRouter(logger, &d, map[string]string{
+		"grafana.example.com": newBackend("grafana"),
+		"*.example.com":       newBackend("wildcard"),
+	}, &proxy.SNIRouterOptions{
+		DefaultBackend: newBackend("default"),
+	})
+	t.Cleanup(func() {
+		require.NoError(t, r.Close())
+	})
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		_ = r.Serve(lis)
+	}()
+
+	get := func(serverName string) (string, error) {
+		client := &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+					return d.DialContext(ctx, network, lis.Addr().String())
+				},
+				TLSClientConfig: &tls.Config{
+					ServerName:         serverName,
+					InsecureSkipVerify: true,
+				},
+				DisableKeepAlives: true,
+			},
+		}
+
+		resp, err := client.Get("https://router/")
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	for serverName, expected := range map[string]string{
+		"grafana.example.com": "Hello from grafana!",
+		"GRAFANA.example.com": "Hello from grafana!",
+		"wiki.example.com":    "Hello from wildcard!",
+		"a.b.example.com":     "Hello from default!",
+		"example.org":         "Hello from default!",
+	} {
+		body, err := get(serverName)
+		require.NoError(t, err, serverName)
+		require.Equal(t, expected, body, serverName)
+	}
+
+	t.Run("No Route", func(t *testing.T) {
+		r := proxy.NewSNIRouter(logger, &d, map[string]string{}, nil)
+		t.Cleanup(func() {
+			require.NoError(t, r.Close())
+		})
+
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		go func() {
+			_ = r.Serve(lis)
+		}()
+
+		_, err = tls.Dial("tcp", lis.Addr().String(), &tls.Config{
+			ServerName:         "grafana.example.com",
+			InsecureSkipVerify: true,
+		})
+		require.Error(t, err)
+	})
+}
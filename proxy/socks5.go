@@ -0,0 +1,242 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 protocol constants, see RFC 1928.
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone         = 0x00
+	socks5AuthNoAcceptable = 0xff
+
+	socks5CmdConnect = 0x01
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	socks5ReplySucceeded           = 0x00
+	socks5ReplyHostUnreachable     = 0x04
+	socks5ReplyCommandNotSupported = 0x07
+	socks5ReplyAddrNotSupported    = 0x08
+)
+
+const (
+	// socks5HandshakeTimeout is the maximum time allowed for a client to
+	// complete the SOCKS5 handshake.
+	socks5HandshakeTimeout = 30 * time.Second
+)
+
+var errUnsupportedAddressType = errors.New("unsupported address type")
+
+// SOCKS5Server is a SOCKS5 proxy server (RFC 1928) that dials all requests
+// through the provided dialer. Host names are passed through to the dialer
+// unresolved, so the names of peers can be used as destinations.
+// Only the CONNECT command, without authentication, is supported.
+type SOCKS5Server struct {
+	*server
+	logger *slog.Logger
+	dialer Dialer
+}
+
+// NewSOCKS5Server creates a new SOCKS5 proxy server.
+func NewSOCKS5Server(logger *slog.Logger, dialer Dialer) *SOCKS5Server {
+	return &SOCKS5Server{
+		server: newServer(),
+		logger: logger,
+		dialer: dialer,
+	}
+}
+
+// ListenAndServe listens on the given host address and serves SOCKS5 requests.
+func (s *SOCKS5Server) ListenAndServe(address string) error {
+	lis, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+
+	return s.Serve(lis)
+}
+
+// Serve accepts connections from the listener and serves SOCKS5 requests,
+// it blocks until the listener or server is closed.
+func (s *SOCKS5Server) Serve(lis net.Listener) error {
+	return s.serve(lis, s.handleConn)
+}
+
+// Close stops the server, closing all listeners and active connections.
+func (s *SOCKS5Server) Close() error {
+	return s.close()
+}
+
+func (s *SOCKS5Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	logger := s.logger.With("client", conn.RemoteAddr().String())
+
+	_ = conn.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+
+	br := bufio.NewReader(conn)
+
+	if err := s.negotiateAuth(br, conn); err != nil {
+		logger.Debug("Failed to negotiate authentication", "error", err)
+		return
+	}
+
+	address, err := s.readRequest(br, conn)
+	if err != nil {
+		logger.Debug("Failed to read request", "error", err)
+		return
+	}
+
+	upstream, err := s.dialer.DialContext(s.ctx, "tcp", address)
+	if err != nil {
+		logger.Debug("Failed to dial", "address", address, "error", err)
+		_ = writeSOCKS5Reply(conn, socks5ReplyHostUnreachable, nil)
+		return
+	}
+
+	if !s.trackConn(upstream) {
+		_ = upstream.Close()
+		return
+	}
+	defer s.untrackConn(upstream)
+
+	if err := writeSOCKS5Reply(conn, socks5ReplySucceeded, upstream.LocalAddr()); err != nil {
+		_ = upstream.Close()
+		return
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	// The client may have pipelined data after the request.
+	if n := br.Buffered(); n > 0 {
+		buffered, _ := br.Peek(n)
+		if _, err := upstream.Write(buffered); err != nil {
+			_ = upstream.Close()
+			return
+		}
+	}
+
+	splice(conn, upstream)
+}
+
+func (s *SOCKS5Server) negotiateAuth(r io.Reader, w io.Writer) error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return err
+	}
+
+	if hdr[0] != socks5Version {
+		return fmt.Errorf("unsupported version: %d", hdr[0])
+	}
+
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return err
+	}
+
+	for _, method := range methods {
+		if method == socks5AuthNone {
+			_, err := w.Write([]byte{socks5Version, socks5AuthNone})
+			return err
+		}
+	}
+
+	_, _ = w.Write([]byte{socks5Version, socks5AuthNoAcceptable})
+
+	return errors.New("no acceptable authentication methods")
+}
+
+// readRequest reads a SOCKS5 request, returning the requested destination address.
+func (s *SOCKS5Server) readRequest(r io.Reader, w io.Writer) (string, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return "", err
+	}
+
+	if hdr[0] != socks5Version {
+		return "", fmt.Errorf("unsupported version: %d", hdr[0])
+	}
+
+	var host string
+	switch hdr[3] {
+	case socks5AddrIPv4:
+		var addr [4]byte
+		if _, err := io.ReadFull(r, addr[:]); err != nil {
+			return "", err
+		}
+		host = netip.AddrFrom4(addr).String()
+	case socks5AddrIPv6:
+		var addr [16]byte
+		if _, err := io.ReadFull(r, addr[:]); err != nil {
+			return "", err
+		}
+		host = netip.AddrFrom16(addr).String()
+	case socks5AddrDomain:
+		var length [1]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return "", err
+		}
+
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		_ = writeSOCKS5Reply(w, socks5ReplyAddrNotSupported, nil)
+		return "", errUnsupportedAddressType
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+
+	if hdr[1] != socks5CmdConnect {
+		_ = writeSOCKS5Reply(w, socks5ReplyCommandNotSupported, nil)
+		return "", fmt.Errorf("unsupported command: %d", hdr[1])
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+func writeSOCKS5Reply(w io.Writer, reply byte, bindAddr net.Addr) error {
+	addrPort := netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+	if bindAddr != nil {
+		if parsed, err := netip.ParseAddrPort(bindAddr.String()); err == nil {
+			addrPort = parsed
+		}
+	}
+
+	msg := []byte{socks5Version, reply, 0x00}
+
+	addr := addrPort.Addr().Unmap()
+	if addr.Is4() {
+		msg = append(msg, socks5AddrIPv4)
+	} else {
+		msg = append(msg, socks5AddrIPv6)
+	}
+	msg = append(msg, addr.AsSlice()...)
+	msg = binary.BigEndian.AppendUint16(msg, addrPort.Port())
+
+	_, err := w.Write(msg)
+	return err
+}
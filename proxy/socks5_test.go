@@ -0,0 +1,87 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package proxy_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets/proxy"
+	"github.com/stretchr/testify/require"
+	netproxy "golang.org/x/net/proxy"
+)
+
+// staticDialer dials a fixed set of named hosts, standing in for a noisy socket.
+type staticDialer map[string]string
+
+func (d staticDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	target, ok := d[address]
+	if !ok {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("no such host")}
+	}
+
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, target)
+}
+
+func TestSOCKS5Server(t *testing.T) {
+	logger := slogt.New(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "Hello, world!")
+	}))
+	t.Cleanup(srv.Close)
+
+	s := proxy.NewSOCKS5Server(logger, staticDialer{
+		"web:80": srv.Listener.Addr().String(),
+	})
+	t.Cleanup(func() {
+		require.NoError(t, s.Close())
+	})
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		if err := s.Serve(lis); err != nil && !errors.Is(err, net.ErrClosed) {
+			logger.Error("Failed to serve", "error", err)
+		}
+	}()
+
+	dialer, err := netproxy.SOCKS5("tcp", lis.Addr().String(), nil, netproxy.Direct)
+	require.NoError(t, err)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial: dialer.Dial,
+		},
+	}
+
+	t.Run("Peer Name", func(t *testing.T) {
+		resp, err := client.Get("http://web")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, resp.Body.Close())
+		})
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		require.Equal(t, "Hello, world!", string(body))
+	})
+
+	t.Run("Unknown Host", func(t *testing.T) {
+		_, err := dialer.Dial("tcp", "unknown:80")
+		require.Error(t, err)
+	})
+}
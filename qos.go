@@ -0,0 +1,137 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"encoding/binary"
+
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// trafficClass is the priority of an outbound packet, packets of a class are
+// only sent once there are none of the classes before it waiting.
+type trafficClass int
+
+const (
+	// classPriority is latency sensitive traffic (eg. SSH, DNS, and VoIP).
+	classPriority trafficClass = iota
+	// classNormal is everything else.
+	classNormal
+	// classBulk is traffic that is only sent when there is nothing else to
+	// send (eg. backups).
+	classBulk
+	// numTrafficClasses is the number of traffic classes.
+	numTrafficClasses
+)
+
+// defaultPriorityPorts are the ports of traffic that is prioritized by default,
+// SSH, DNS, NTP, STUN, and SIP.
+var defaultPriorityPorts = []uint16{22, 53, 123, 3478, 5060, 5061}
+
+// DSCP code points used to classify packets.
+const (
+	dscpCS1  = 8  // lower effort
+	dscpAF41 = 34 // interactive video
+	dscpAF42 = 36
+	dscpAF43 = 38
+	dscpCS5  = 40 // signaling
+	dscpEF   = 46 // telephony
+	dscpCS6  = 48 // network control
+	dscpCS7  = 56
+)
+
+// classifier assigns outbound packets to traffic classes.
+type classifier struct {
+	ports      map[uint16]trafficClass
+	ignoreDSCP bool
+}
+
+// newClassifier creates a classifier from the socket's QoS configuration, or
+// returns nil if QoS isn't enabled.
+func newClassifier(conf *v1alpha1.QoSConfig) *classifier {
+	if conf == nil {
+		return nil
+	}
+
+	c := &classifier{
+		ports:      make(map[uint16]trafficClass),
+		ignoreDSCP: conf.IgnoreDSCP,
+	}
+
+	priorityPorts := conf.PriorityPorts
+	if len(priorityPorts) == 0 {
+		priorityPorts = defaultPriorityPorts
+	}
+
+	for _, port := range priorityPorts {
+		c.ports[port] = classPriority
+	}
+
+	for _, port := range conf.BulkPorts {
+		c.ports[port] = classBulk
+	}
+
+	return c
+}
+
+// classify returns the traffic class of a packet sent by the stack. Packets
+// are classified by their DSCP marking, if any, and then by their source or
+// destination port (if they differ, the lower priority wins).
+func (c *classifier) classify(pkt *stack.PacketBuffer) trafficClass {
+	netHdr := pkt.NetworkHeader().Slice()
+
+	var dscp uint8
+	switch pkt.NetworkProtocolNumber {
+	case header.IPv4ProtocolNumber:
+		if len(netHdr) < header.IPv4MinimumSize {
+			return classNormal
+		}
+		tos, _ := header.IPv4(netHdr).TOS()
+		dscp = tos >> 2
+	case header.IPv6ProtocolNumber:
+		if len(netHdr) < header.IPv6MinimumSize {
+			return classNormal
+		}
+		tc, _ := header.IPv6(netHdr).TOS()
+		dscp = tc >> 2
+	default:
+		return classNormal
+	}
+
+	if !c.ignoreDSCP {
+		switch dscp {
+		case dscpEF, dscpCS5, dscpCS6, dscpCS7, dscpAF41, dscpAF42, dscpAF43:
+			return classPriority
+		case dscpCS1:
+			return classBulk
+		}
+	}
+
+	switch pkt.TransportProtocolNumber {
+	case header.ICMPv4ProtocolNumber, header.ICMPv6ProtocolNumber:
+		// Pings, and errors, are small and are often used to measure latency.
+		return classPriority
+	case header.TCPProtocolNumber, header.UDPProtocolNumber:
+		// Both headers start with the source and destination ports.
+		transHdr := pkt.TransportHeader().Slice()
+		if len(transHdr) < 4 {
+			return classNormal
+		}
+
+		class := classNormal
+		for _, port := range []uint16{binary.BigEndian.Uint16(transHdr[0:]), binary.BigEndian.Uint16(transHdr[2:])} {
+			if portClass, ok := c.ports[port]; ok && (class == classNormal || portClass > class) {
+				class = portClass
+			}
+		}
+
+		return class
+	default:
+		return classNormal
+	}
+}
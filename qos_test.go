@@ -0,0 +1,137 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+func TestClassifier(t *testing.T) {
+	c := newClassifier(&v1alpha1.QoSConfig{BulkPorts: []uint16{873}})
+
+	src, dst := netip.MustParseAddr("10.7.0.1"), netip.MustParseAddr("10.7.0.2")
+
+	for _, tc := range []struct {
+		name    string
+		tos     uint8
+		srcPort uint16
+		dstPort uint16
+		class   trafficClass
+	}{
+		{name: "SSH", srcPort: 50000, dstPort: 22, class: classPriority},
+		{name: "SSH reply", srcPort: 22, dstPort: 50000, class: classPriority},
+		{name: "DNS", srcPort: 50000, dstPort: 53, class: classPriority},
+		{name: "HTTP", srcPort: 50000, dstPort: 80, class: classNormal},
+		{name: "rsync", srcPort: 50000, dstPort: 873, class: classBulk},
+		{name: "rsync over SSH port", srcPort: 22, dstPort: 873, class: classBulk},
+		{name: "EF", tos: dscpEF << 2, srcPort: 50000, dstPort: 80, class: classPriority},
+		{name: "CS1", tos: dscpCS1 << 2, srcPort: 50000, dstPort: 22, class: classBulk},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pkt := newTestUDPPacket(src, dst, tc.tos, tc.srcPort, tc.dstPort)
+			t.Cleanup(pkt.DecRef)
+
+			require.Equal(t, tc.class, c.classify(pkt))
+		})
+	}
+
+	require.Nil(t, newClassifier(nil))
+}
+
+func TestSourceSink_QoS(t *testing.T) {
+	privateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	localAddr := netip.MustParseAddr("10.7.0.1")
+
+	opts, err := configSourceSinkOptions(&v1alpha1.Config{
+		QoS: &v1alpha1.QoSConfig{BulkPorts: []uint16{873}},
+	})
+	require.NoError(t, err)
+
+	ss, _, err := newSourceSink("local", privateKey.PublicKey(), []netip.Addr{localAddr}, opts)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = ss.Close()
+	})
+
+	peerPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	peerAddr := netip.MustParseAddr("10.7.0.2")
+	require.NoError(t, ss.AddPeer("peer", peerPrivateKey.PublicKey(), []netip.Prefix{netip.PrefixFrom(peerAddr, peerAddr.BitLen())}))
+
+	// Queued behind a bulk transfer, and other traffic.
+	writeOutboundPacket(ss, newTestUDPPacket(localAddr, peerAddr, 0, 50000, 873))
+	writeOutboundPacket(ss, newTestUDPPacket(localAddr, peerAddr, 0, 50000, 80))
+	writeOutboundPacket(ss, newTestUDPPacket(localAddr, peerAddr, 0, 50000, 22))
+	require.Equal(t, 3, ss.nic.NumQueued())
+
+	bufs := make([][]byte, 16)
+	for i := range bufs {
+		bufs[i] = make([]byte, ss.mtu)
+	}
+	sizes := make([]int, len(bufs))
+	destinations := make([]transport.NoisePublicKey, len(bufs))
+
+	count, err := ss.Read(bufs, sizes, destinations, 0)
+	require.NoError(t, err)
+	require.Equal(t, 3, count)
+
+	var dstPorts []uint16
+	for i := 0; i < count; i++ {
+		dstPorts = append(dstPorts, header.UDP(bufs[i][header.IPv4MinimumSize:sizes[i]]).DestinationPort())
+	}
+	require.Equal(t, []uint16{22, 80, 873}, dstPorts)
+
+	// A blocked reader is woken by a packet in any band.
+	read := readPacket(ss)
+	writeOutboundPacket(ss, newTestUDPPacket(localAddr, peerAddr, 0, 50000, 53))
+
+	pkt, destination, err := read(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, peerPrivateKey.PublicKey(), destination)
+	require.Equal(t, uint16(53), header.UDP(pkt[header.IPv4MinimumSize:]).DestinationPort())
+}
+
+func newTestUDPPacket(src, dst netip.Addr, tos uint8, srcPort, dstPort uint16) *stack.PacketBuffer {
+	pkt := make([]byte, header.IPv4MinimumSize+header.UDPMinimumSize)
+
+	ipHdr := header.IPv4(pkt)
+	ipHdr.Encode(&header.IPv4Fields{
+		TOS:         tos,
+		TotalLength: uint16(len(pkt)),
+		TTL:         64,
+		Protocol:    uint8(header.UDPProtocolNumber),
+		SrcAddr:     tcpip.AddrFrom4(src.As4()),
+		DstAddr:     tcpip.AddrFrom4(dst.As4()),
+	})
+	ipHdr.SetChecksum(^ipHdr.CalculateChecksum())
+
+	header.UDP(pkt[header.IPv4MinimumSize:]).Encode(&header.UDPFields{
+		SrcPort: srcPort,
+		DstPort: dstPort,
+		Length:  header.UDPMinimumSize,
+	})
+
+	pktBuf := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(pkt)})
+	pktBuf.NetworkProtocolNumber = header.IPv4ProtocolNumber
+	pktBuf.TransportProtocolNumber = header.UDPProtocolNumber
+	_, _ = pktBuf.NetworkHeader().Consume(header.IPv4MinimumSize)
+	_, _ = pktBuf.TransportHeader().Consume(header.UDPMinimumSize)
+
+	return pktBuf
+}
@@ -0,0 +1,243 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"context"
+	"sync"
+
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// maxQueues is the largest number of outbound queues that can be configured.
+const maxQueues = 64
+
+var _ transport.MultiQueueSourceSink = (*sourceSink)(nil)
+
+// outboundQueue is one of the queues of packets sent by the stack, along with
+// the state of its reader.
+type outboundQueue struct {
+	ep *channel.Endpoint
+	// bands hold the packets of each traffic class, if QoS is enabled, ep
+	// holds the normal class.
+	bands     []*channel.Endpoint
+	ready     readyNotifier // signalled when a packet is written to any band
+	fanout    *fanout       // only accessed by the reader
+	segmenter tcpSegmenter  // only accessed by the reader
+}
+
+// readyNotifier wakes the reader of a queue with several bands, when a packet
+// is written to any of them.
+type readyNotifier chan struct{}
+
+func (r readyNotifier) WriteNotify() {
+	select {
+	case r <- struct{}{}:
+	default:
+	}
+}
+
+// tryRead returns the next packet, from the highest priority band with any,
+// or nil if the queue is empty.
+func (q *outboundQueue) tryRead() *stack.PacketBuffer {
+	if q.bands == nil {
+		return q.ep.Read()
+	}
+
+	for _, band := range q.bands {
+		if pkt := band.Read(); !pkt.IsNil() {
+			return pkt
+		}
+	}
+
+	return nil
+}
+
+// read is like tryRead, but blocks until there is a packet. It returns nil if
+// the context is done, or the queue is closed.
+func (q *outboundQueue) read(ctx context.Context, closed <-chan struct{}) *stack.PacketBuffer {
+	if q.bands == nil {
+		return q.ep.ReadContext(ctx)
+	}
+
+	for {
+		if pkt := q.tryRead(); !pkt.IsNil() {
+			return pkt
+		}
+
+		select {
+		case <-q.ready:
+		case <-ctx.Done():
+			return nil
+		case <-closed:
+			return nil
+		}
+	}
+}
+
+// outboundQueues is the link endpoint of the stack's NIC. It spreads the packets
+// sent by the stack across its queues, by destination peer, so that they can
+// be read in parallel while the packets to each peer stay in order. With QoS
+// enabled, each queue is split into bands by traffic class, so that latency
+// sensitive packets to a peer overtake bulk transfers.
+type outboundQueues struct {
+	// The endpoint of the first queue is also the NIC's.
+	*channel.Endpoint
+	queues []*outboundQueue
+	// queueFor returns the index of the queue a packet belongs in.
+	queueFor func(pkt *stack.PacketBuffer) int
+	// classifier assigns packets to bands, if QoS is enabled.
+	classifier *classifier
+	// closed is closed when the queues are closed.
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newOutboundQueues(n, queueSize, mtu int, queueFor func(pkt *stack.PacketBuffer) int, classifier *classifier) *outboundQueues {
+	q := &outboundQueues{
+		queues:     make([]*outboundQueue, n),
+		queueFor:   queueFor,
+		classifier: classifier,
+		closed:     make(chan struct{}),
+	}
+
+	for i := range q.queues {
+		queue := &outboundQueue{ep: channel.New(queueSize, uint32(mtu), "")}
+
+		if classifier != nil {
+			queue.ready = make(readyNotifier, 1)
+			queue.bands = make([]*channel.Endpoint, numTrafficClasses)
+			for class := range queue.bands {
+				if trafficClass(class) == classNormal {
+					queue.bands[class] = queue.ep
+				} else {
+					queue.bands[class] = channel.New(queueSize, uint32(mtu), "")
+				}
+				queue.bands[class].AddNotify(queue.ready)
+			}
+		}
+
+		q.queues[i] = queue
+	}
+	q.Endpoint = q.queues[0].ep
+
+	return q
+}
+
+// WritePackets queues packets sent by the stack. Like a single queue, it stops
+// at the first packet there is no room for.
+func (q *outboundQueues) WritePackets(pkts stack.PacketBufferList) (int, tcpip.Error) {
+	if len(q.queues) == 1 && q.classifier == nil {
+		return q.Endpoint.WritePackets(pkts)
+	}
+
+	single := packetBufferListPool.Get().(*stack.PacketBufferList)
+	defer packetBufferListPool.Put(single)
+
+	var n int
+	for _, pkt := range pkts.AsSlice() {
+		// The list releases a reference when it is reset.
+		single.PushBack(pkt.IncRef())
+
+		queue := q.queues[q.queueFor(pkt)]
+
+		ep := queue.ep
+		if q.classifier != nil {
+			ep = queue.bands[q.classifier.classify(pkt)]
+		}
+
+		written, err := ep.WritePackets(*single)
+		single.Reset()
+		if written == 0 {
+			if n == 0 && err != nil {
+				return 0, err
+			}
+			break
+		}
+
+		n++
+	}
+
+	return n, nil
+}
+
+// NumQueued returns the number of packets waiting in all of the queues.
+func (q *outboundQueues) NumQueued() int {
+	var n int
+	for _, queue := range q.queues {
+		if queue.bands == nil {
+			n += queue.ep.NumQueued()
+			continue
+		}
+
+		for _, band := range queue.bands {
+			n += band.NumQueued()
+		}
+	}
+
+	return n
+}
+
+// Close closes all of the queues.
+func (q *outboundQueues) Close() {
+	for _, queue := range q.queues {
+		for _, band := range queue.bands {
+			if band != queue.ep {
+				band.Close()
+			}
+		}
+		queue.ep.Close()
+	}
+
+	q.closeOnce.Do(func() {
+		close(q.closed)
+	})
+}
+
+// Queues returns the number of outbound queues.
+func (ss *sourceSink) Queues() int {
+	return len(ss.nic.queues)
+}
+
+// ReadQueue is like Read, but only reads packets from the given queue.
+func (ss *sourceSink) ReadQueue(queue int, bufs [][]byte, sizes []int, destinations []transport.NoisePublicKey, offset int) (int, error) {
+	return ss.readQueue(ss.nic.queues[queue], bufs, sizes, destinations, offset, 0)
+}
+
+// queueFor returns the queue of the peer a packet is sent to. Packets that
+// aren't sent to a single peer (eg. multicast), or that will be dropped, use
+// the first queue.
+func (ss *sourceSink) queueFor(pkt *stack.PacketBuffer) int {
+	peerAddr, err := outboundDestination(pkt.NetworkProtocolNumber, pkt.NetworkHeader().Slice(), pkt.Size())
+	if err != nil {
+		return 0
+	}
+
+	ss.peersMu.RLock()
+	defer ss.peersMu.RUnlock()
+
+	publicKey, ok := ss.fromPeerAddress.Lookup(peerAddr)
+	if !ok {
+		return 0
+	}
+
+	return ss.peerQueues[publicKey]
+}
+
+// assignQueueLocked assigns a peer to a queue, if it doesn't have one already.
+// Peers are assigned in turn, so that they are spread evenly.
+// Must hold ss.peersMu.
+func (ss *sourceSink) assignQueueLocked(publicKey transport.NoisePublicKey) {
+	if _, ok := ss.peerQueues[publicKey]; ok {
+		return
+	}
+
+	ss.peerQueues[publicKey] = ss.nextQueue
+	ss.nextQueue = (ss.nextQueue + 1) % len(ss.nic.queues)
+}
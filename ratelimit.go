@@ -0,0 +1,109 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"golang.org/x/time/rate"
+)
+
+// rateLimiter enforces optional packet and byte rate limits on traffic, either
+// for a single peer or for all peers combined.
+type rateLimiter struct {
+	packets        *rate.Limiter
+	bytes          *rate.Limiter
+	droppedPackets atomic.Uint64
+	droppedBytes   atomic.Uint64
+}
+
+// newRateLimiter creates a new rate limiter, a zero limit means unlimited.
+func newRateLimiter(packetsPerSecond, bytesPerSecond uint64) *rateLimiter {
+	var l rateLimiter
+
+	if packetsPerSecond > 0 {
+		// Allow up to a second's worth of packets to burst.
+		l.packets = rate.NewLimiter(rate.Limit(packetsPerSecond), int(packetsPerSecond))
+	}
+
+	if bytesPerSecond > 0 {
+		// The burst must be able to accommodate the largest possible packet.
+		burst := int(bytesPerSecond)
+		if burst < transport.MaxContentSize {
+			burst = transport.MaxContentSize
+		}
+
+		l.bytes = rate.NewLimiter(rate.Limit(bytesPerSecond), burst)
+	}
+
+	return &l
+}
+
+// allow reports whether a packet of the given size is within the rate
+// limit. Packets over the limit are counted as dropped, and don't use up any
+// of either limit (eg. an oversized packet doesn't use up a packet).
+func (l *rateLimiter) allow(size int) bool {
+	now := time.Now()
+
+	// Reserve from both limits, cancelling the reservations if either would
+	// have to wait.
+	var packets *rate.Reservation
+	if l.packets != nil {
+		packets = l.packets.ReserveN(now, 1)
+		if !packets.OK() || packets.DelayFrom(now) > 0 {
+			packets.CancelAt(now)
+			l.drop(size)
+			return false
+		}
+	}
+
+	if l.bytes != nil {
+		bytes := l.bytes.ReserveN(now, size)
+		if !bytes.OK() || bytes.DelayFrom(now) > 0 {
+			bytes.CancelAt(now)
+			if packets != nil {
+				packets.CancelAt(now)
+			}
+			l.drop(size)
+			return false
+		}
+	}
+
+	return true
+}
+
+// drop counts a packet as dropped.
+func (l *rateLimiter) drop(size int) {
+	l.droppedPackets.Add(1)
+	l.droppedBytes.Add(uint64(size))
+}
+
+// Must hold the lock protecting limiters.
+func setRateLimitLocked(limiters map[transport.NoisePublicKey]*rateLimiter, publicKey transport.NoisePublicKey, packetsPerSecond, bytesPerSecond uint64) {
+	if packetsPerSecond == 0 && bytesPerSecond == 0 {
+		delete(limiters, publicKey)
+		return
+	}
+
+	limiters[publicKey] = newRateLimiter(packetsPerSecond, bytesPerSecond)
+}
+
+func setGlobalRateLimit(limiter *atomic.Pointer[rateLimiter], packetsPerSecond, bytesPerSecond uint64) {
+	if packetsPerSecond == 0 && bytesPerSecond == 0 {
+		limiter.Store(nil)
+		return
+	}
+
+	limiter.Store(newRateLimiter(packetsPerSecond, bytesPerSecond))
+}
+
+// allowGlobal reports whether a packet is within an optional global rate limit.
+func allowGlobal(limiter *atomic.Pointer[rateLimiter], size int) bool {
+	l := limiter.Load()
+	return l == nil || l.allow(size)
+}
@@ -0,0 +1,45 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"testing"
+
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter(t *testing.T) {
+	t.Run("Byte Limit", func(t *testing.T) {
+		l := newRateLimiter(10, 1)
+
+		// Uses up the whole byte burst.
+		require.True(t, l.allow(transport.MaxContentSize))
+
+		for i := 0; i < 5; i++ {
+			require.False(t, l.allow(1000))
+		}
+
+		// Only the packet that was allowed used up a packet.
+		require.InDelta(t, 9, l.packets.Tokens(), 0.5)
+		require.Equal(t, uint64(5), l.droppedPackets.Load())
+		require.Equal(t, uint64(5*1000), l.droppedBytes.Load())
+	})
+
+	t.Run("Packet Limit", func(t *testing.T) {
+		l := newRateLimiter(1, 1_000_000)
+
+		require.True(t, l.allow(100))
+
+		for i := 0; i < 5; i++ {
+			require.False(t, l.allow(100))
+		}
+
+		// Only the packet that was allowed used up any bytes.
+		require.InDelta(t, 1_000_000-100, l.bytes.Tokens(), 50_000)
+		require.Equal(t, uint64(5), l.droppedPackets.Load())
+	})
+}
@@ -0,0 +1,208 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+// Package relay implements a relay, that forwards encrypted packets between
+// peers that have no direct path to each other (eg. because both are behind
+// NATs).
+//
+// Peers connect to the relay over a stream (TCP or WebSocket) and are
+// identified by their WireGuard public keys. Packets are forwarded as is, the
+// relay is unable to decrypt them. To prevent a client from receiving packets
+// addressed to the public key of another peer, clients must prove possession
+// of the corresponding private key when they connect.
+package relay
+
+import (
+	"crypto/hmac"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	// KeySize is the size of a public or private key.
+	KeySize = 32
+	// MaxPacketSize is the largest packet that can be relayed.
+	MaxPacketSize = maxFrameSize - KeySize
+
+	challengeSize    = 32
+	blake2sSize      = blake2s.Size
+	maxFrameSize     = 1<<16 - 1
+	handshakeTimeout = 10 * time.Second
+	writeTimeout     = 5 * time.Second
+)
+
+// Frame types.
+const (
+	// frameServerHello is sent by the server when a client connects, it
+	// carries the server's public key, and a challenge.
+	frameServerHello byte = 1
+	// frameClientHello is the client's response to the server hello, it
+	// carries the client's public key, and a MAC of the challenge.
+	frameClientHello byte = 2
+	// frameSendPacket is sent by a client, it carries the public key of the
+	// destination peer, and the packet.
+	frameSendPacket byte = 3
+	// frameRecvPacket is sent by the server, it carries the public key of the
+	// source peer, and the packet.
+	frameRecvPacket byte = 4
+)
+
+var ErrPacketTooLarge = errors.New("packet too large")
+
+// Client is a connection to a relay server.
+type Client struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+}
+
+// NewClient authenticates with the relay server, using the private key of
+// the peer, over the provided connection.
+func NewClient(conn net.Conn, privateKey [KeySize]byte) (*Client, error) {
+	publicKey, err := curve25519.X25519(privateKey[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, fmt.Errorf("could not compute public key: %w", err)
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return nil, err
+	}
+
+	typ, payload, err := readFrame(conn)
+	if err != nil {
+		return nil, fmt.Errorf("could not read server hello: %w", err)
+	}
+
+	if typ != frameServerHello || len(payload) != KeySize+challengeSize {
+		return nil, fmt.Errorf("unexpected server hello")
+	}
+
+	mac, err := challengeMAC(privateKey[:], payload[:KeySize], payload[KeySize:], publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeFrame(conn, frameClientHello, publicKey, mac); err != nil {
+		return nil, fmt.Errorf("could not write client hello: %w", err)
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+
+	return &Client{conn: conn}, nil
+}
+
+// Send sends a packet to the peer with the given public key, via the relay.
+// Packets for peers that are not connected to the relay are dropped.
+func (c *Client) Send(dst [KeySize]byte, packet []byte) error {
+	if len(packet) > MaxPacketSize {
+		return ErrPacketTooLarge
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if err := c.conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return err
+	}
+
+	return writeFrame(c.conn, frameSendPacket, dst[:], packet)
+}
+
+// Recv waits for the next packet relayed from a peer.
+func (c *Client) Recv() (src [KeySize]byte, packet []byte, err error) {
+	for {
+		typ, payload, err := readFrame(c.conn)
+		if err != nil {
+			return src, nil, err
+		}
+
+		// Ignore frames we don't understand, for forwards compatibility.
+		if typ != frameRecvPacket || len(payload) < KeySize {
+			continue
+		}
+
+		copy(src[:], payload[:KeySize])
+		return src, payload[KeySize:], nil
+	}
+}
+
+// Close closes the connection to the relay server.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// challengeMAC computes the MAC that proves the client has the private key
+// corresponding to its public key, it is keyed by the Diffie-Hellman shared
+// secret of the client and server keys.
+func challengeMAC(privateKey, peerPublicKey, challenge, clientPublicKey []byte) ([]byte, error) {
+	sharedSecret, err := curve25519.X25519(privateKey, peerPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not compute shared secret: %w", err)
+	}
+
+	mac, err := blake2s.New256(sharedSecret)
+	if err != nil {
+		return nil, err
+	}
+	_, _ = mac.Write(challenge)
+	_, _ = mac.Write(clientPublicKey)
+
+	return mac.Sum(nil), nil
+}
+
+func verifyChallengeMAC(privateKey, clientPublicKey, challenge, mac []byte) bool {
+	expected, err := challengeMAC(privateKey, clientPublicKey, challenge, clientPublicKey)
+	if err != nil {
+		return false
+	}
+
+	return hmac.Equal(expected, mac)
+}
+
+// writeFrame writes a frame, consisting of a type, a 16-bit big endian length,
+// and the concatenation of the given parts.
+func writeFrame(w io.Writer, typ byte, parts ...[]byte) error {
+	var size int
+	for _, part := range parts {
+		size += len(part)
+	}
+
+	if size > maxFrameSize {
+		return ErrPacketTooLarge
+	}
+
+	frame := make([]byte, 3, 3+size)
+	frame[0] = typ
+	binary.BigEndian.PutUint16(frame[1:], uint16(size))
+	for _, part := range parts {
+		frame = append(frame, part...)
+	}
+
+	_, err := w.Write(frame)
+	return err
+}
+
+func readFrame(r io.Reader) (byte, []byte, error) {
+	var hdr [3]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[1:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+
+	return hdr[0], payload, nil
+}
@@ -0,0 +1,112 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package relay
+
+import (
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/curve25519"
+)
+
+func TestRelay(t *testing.T) {
+	srv, err := NewServer(slogt.New(t))
+	require.NoError(t, err)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		_ = srv.Serve(lis)
+	}()
+	t.Cleanup(func() {
+		require.NoError(t, srv.Close())
+	})
+
+	alicePrivateKey, alicePublicKey := newKeyPair(t)
+	bobPrivateKey, bobPublicKey := newKeyPair(t)
+
+	alice := newClient(t, lis.Addr().String(), alicePrivateKey)
+	bob := newClient(t, lis.Addr().String(), bobPrivateKey)
+
+	// Wait for both clients to be registered.
+	require.Eventually(t, func() bool {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		return len(srv.clients) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, alice.Send(bobPublicKey, []byte("Hello, Bob!")))
+
+	src, packet, err := bob.Recv()
+	require.NoError(t, err)
+	require.Equal(t, alicePublicKey, src)
+	require.Equal(t, "Hello, Bob!", string(packet))
+
+	require.NoError(t, bob.Send(alicePublicKey, []byte("Hello, Alice!")))
+
+	src, packet, err = alice.Recv()
+	require.NoError(t, err)
+	require.Equal(t, bobPublicKey, src)
+	require.Equal(t, "Hello, Alice!", string(packet))
+
+	t.Run("Impersonation", func(t *testing.T) {
+		conn, err := net.Dial("tcp", lis.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+
+		typ, _, err := readFrame(conn)
+		require.NoError(t, err)
+		require.Equal(t, frameServerHello, typ)
+
+		// Claim to be Bob, without knowing Bob's private key.
+		var mac [blake2sSize]byte
+		require.NoError(t, writeFrame(conn, frameClientHello, bobPublicKey[:], mac[:]))
+
+		// The server should hang up.
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		_, _, err = readFrame(conn)
+		require.Error(t, err)
+
+		// And Bob should still be connected.
+		require.NoError(t, alice.Send(bobPublicKey, []byte("Still there?")))
+
+		_, packet, err := bob.Recv()
+		require.NoError(t, err)
+		require.Equal(t, "Still there?", string(packet))
+	})
+}
+
+func newKeyPair(t *testing.T) ([KeySize]byte, [KeySize]byte) {
+	var privateKey, publicKey [KeySize]byte
+	_, err := rand.Read(privateKey[:])
+	require.NoError(t, err)
+
+	pk, err := curve25519.X25519(privateKey[:], curve25519.Basepoint)
+	require.NoError(t, err)
+	copy(publicKey[:], pk)
+
+	return privateKey, publicKey
+}
+
+func newClient(t *testing.T, addr string, privateKey [KeySize]byte) *Client {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+
+	client, err := NewClient(conn, privateKey)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+
+	return client
+}
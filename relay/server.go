@@ -0,0 +1,244 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package relay
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/net/websocket"
+)
+
+// Server is a relay server, it forwards packets between connected clients.
+type Server struct {
+	logger     *slog.Logger
+	privateKey [KeySize]byte
+	publicKey  [KeySize]byte
+	conns      sync.WaitGroup
+
+	mu        sync.Mutex // protects all fields below
+	closed    bool
+	listeners map[net.Listener]struct{}
+	clients   map[[KeySize]byte]*serverConn
+}
+
+type serverConn struct {
+	net.Conn
+	writeMu sync.Mutex
+}
+
+// NewServer creates a new relay server. The server's key pair is only used
+// to authenticate clients, and is generated afresh each time.
+func NewServer(logger *slog.Logger) (*Server, error) {
+	s := &Server{
+		logger:    logger,
+		listeners: make(map[net.Listener]struct{}),
+		clients:   make(map[[KeySize]byte]*serverConn),
+	}
+
+	if _, err := rand.Read(s.privateKey[:]); err != nil {
+		return nil, fmt.Errorf("could not generate private key: %w", err)
+	}
+
+	publicKey, err := curve25519.X25519(s.privateKey[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, fmt.Errorf("could not compute public key: %w", err)
+	}
+	copy(s.publicKey[:], publicKey)
+
+	return s, nil
+}
+
+// Serve accepts TCP connections from clients, until the listener is closed.
+func (s *Server) Serve(lis net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return net.ErrClosed
+	}
+	s.listeners[lis] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, lis)
+		s.mu.Unlock()
+	}()
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.ServeConn(conn)
+	}
+}
+
+// Handler returns an http.Handler that accepts WebSocket connections from
+// clients, eg. so that the relay can be served alongside other endpoints.
+func (s *Server) Handler() http.Handler {
+	return websocket.Server{
+		// Clients are authenticated by their keys, not the origin.
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			ws.PayloadType = websocket.BinaryFrame
+			s.ServeConn(ws)
+		},
+	}
+}
+
+// ServeConn authenticates the client and forwards its packets, until the
+// connection is closed.
+func (s *Server) ServeConn(conn net.Conn) {
+	defer conn.Close()
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.conns.Add(1)
+	s.mu.Unlock()
+	defer s.conns.Done()
+
+	clientPublicKey, err := s.handshake(conn)
+	if err != nil {
+		s.logger.Debug("Failed to authenticate client",
+			"remoteAddr", conn.RemoteAddr(), "error", err)
+		return
+	}
+
+	sc := &serverConn{Conn: conn}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	// The most recent connection wins, eg. when a client reconnects before
+	// its previous connection has timed out.
+	if existing, ok := s.clients[clientPublicKey]; ok {
+		_ = existing.Close()
+	}
+	s.clients[clientPublicKey] = sc
+	s.mu.Unlock()
+
+	s.logger.Debug("Client connected", "remoteAddr", conn.RemoteAddr())
+
+	defer func() {
+		s.mu.Lock()
+		if s.clients[clientPublicKey] == sc {
+			delete(s.clients, clientPublicKey)
+		}
+		s.mu.Unlock()
+
+		s.logger.Debug("Client disconnected", "remoteAddr", conn.RemoteAddr())
+	}()
+
+	for {
+		typ, payload, err := readFrame(conn)
+		if err != nil {
+			return
+		}
+
+		if typ != frameSendPacket || len(payload) < KeySize {
+			continue
+		}
+
+		var dst [KeySize]byte
+		copy(dst[:], payload[:KeySize])
+
+		s.forward(clientPublicKey, dst, payload[KeySize:])
+	}
+}
+
+func (s *Server) handshake(conn net.Conn) ([KeySize]byte, error) {
+	var clientPublicKey [KeySize]byte
+
+	if err := conn.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return clientPublicKey, err
+	}
+
+	var challenge [challengeSize]byte
+	if _, err := rand.Read(challenge[:]); err != nil {
+		return clientPublicKey, err
+	}
+
+	if err := writeFrame(conn, frameServerHello, s.publicKey[:], challenge[:]); err != nil {
+		return clientPublicKey, fmt.Errorf("could not write server hello: %w", err)
+	}
+
+	typ, payload, err := readFrame(conn)
+	if err != nil {
+		return clientPublicKey, fmt.Errorf("could not read client hello: %w", err)
+	}
+
+	if typ != frameClientHello || len(payload) != KeySize+blake2sSize {
+		return clientPublicKey, fmt.Errorf("unexpected client hello")
+	}
+
+	if !verifyChallengeMAC(s.privateKey[:], payload[:KeySize], challenge[:], payload[KeySize:]) {
+		return clientPublicKey, errors.New("invalid challenge response")
+	}
+
+	copy(clientPublicKey[:], payload[:KeySize])
+
+	return clientPublicKey, conn.SetDeadline(time.Time{})
+}
+
+// forward sends a packet to the destination client, if it is connected.
+func (s *Server) forward(src, dst [KeySize]byte, packet []byte) {
+	s.mu.Lock()
+	sc, ok := s.clients[dst]
+	s.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+
+	if err := sc.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return
+	}
+
+	if err := writeFrame(sc, frameRecvPacket, src[:], packet); err != nil {
+		// The destination's read loop will clean up.
+		_ = sc.Close()
+	}
+}
+
+// Close stops accepting connections and disconnects all clients.
+func (s *Server) Close() error {
+	defer s.conns.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+
+	var errs []error
+	for lis := range s.listeners {
+		if err := lis.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, sc := range s.clients {
+		_ = sc.Close()
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,331 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"fmt"
+	"net/netip"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+)
+
+// reloadKeyRotationGracePeriod is how long handshakes addressed to the previous
+// private key are accepted after it is changed by a reload.
+const reloadKeyRotationGracePeriod = 5 * time.Minute
+
+// Reload applies a new configuration to the running socket. Peers are added,
+// removed, and updated, so that they match the configuration, and the private
+// key, addresses, access control rules, rate limits, echo replies, MSS
+// clamping, and multicast delivery are updated. Peers that are unchanged are
+// left alone, as are connections using addresses that are kept. Changing any
+// other setting (eg. the socket's name, or listen port) requires a restart,
+// and will cause Reload to fail without applying any changes.
+func (s *NoisySocket) Reload(conf *v1alpha1.Config) error {
+	s.confMu.Lock()
+	defer s.confMu.Unlock()
+
+	if err := checkReloadable(&s.conf, conf); err != nil {
+		return err
+	}
+
+	var privateKey transport.NoisePrivateKey
+	if err := privateKey.FromString(conf.PrivateKey); err != nil {
+		return fmt.Errorf("failed to parse private key: %w", err)
+	}
+
+	var addrs []netip.Addr
+	for _, ip := range conf.IPs {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			return fmt.Errorf("could not parse address: %w", err)
+		}
+		addrs = append(addrs, addr.Unmap())
+	}
+
+	// Validate all the peers before changing anything.
+	peerConfs := make(map[transport.NoisePublicKey]v1alpha1.WireGuardPeerConfig, len(conf.Peers))
+	for _, peerConf := range conf.Peers {
+		peerPublicKey, _, _, err := parsePeerConfig(&peerConf)
+		if err != nil {
+			return err
+		}
+
+		if _, err := parsePresharedKey(&peerConf); err != nil {
+			return err
+		}
+
+		if _, ok := peerConfs[peerPublicKey]; ok {
+			return fmt.Errorf("duplicate peer %s", peerConf.PublicKey)
+		}
+
+		peerConfs[peerPublicKey] = peerConf
+	}
+
+	if conf.PrivateKey != s.conf.PrivateKey {
+		s.rotatePrivateKeyLocked(privateKey, reloadKeyRotationGracePeriod)
+	}
+
+	s.peerConfigsMu.Lock()
+	var removed, updated []v1alpha1.WireGuardPeerConfig
+	for pk, peerConf := range s.peerConfigs {
+		newPeerConf, ok := peerConfs[pk]
+		if !ok {
+			removed = append(removed, peerConf)
+		} else if !reflect.DeepEqual(peerConf, newPeerConf) {
+			updated = append(updated, newPeerConf)
+		}
+	}
+
+	var added []v1alpha1.WireGuardPeerConfig
+	for _, peerConf := range conf.Peers {
+		peerPublicKey, _, _, _ := parsePeerConfig(&peerConf)
+		if _, ok := s.peerConfigs[peerPublicKey]; !ok {
+			// Peers that have expired (and been removed) stay that way.
+			if s.peerExpired(&peerConf) {
+				continue
+			}
+
+			added = append(added, peerConf)
+		}
+	}
+	s.peerConfigsMu.Unlock()
+
+	// Removals come first, so that addresses are freed up for other peers.
+	for _, peerConf := range removed {
+		if err := s.RemovePeer(peerConf.PublicKey); err != nil {
+			return fmt.Errorf("failed to remove peer %s: %w", peerConf.PublicKey, err)
+		}
+	}
+
+	// New addresses are added before old ones are removed, so that the socket
+	// can be renumbered. Peers may then claim the old addresses.
+	if len(addrs) > 0 {
+		current := s.sourceSink.localAddrs.load()
+		for _, addr := range addrs {
+			if !slices.Contains(current, addr) {
+				if err := s.addAddressLocked(addr); err != nil {
+					return fmt.Errorf("failed to add address %s: %w", addr, err)
+				}
+			}
+		}
+
+		for _, addr := range current {
+			if !slices.Contains(addrs, addr) {
+				if err := s.removeAddressLocked(addr); err != nil {
+					return fmt.Errorf("failed to remove address %s: %w", addr, err)
+				}
+			}
+		}
+	}
+
+	for _, peerConf := range directPeersFirst(updated) {
+		if err := s.UpdatePeer(peerConf); err != nil {
+			return fmt.Errorf("failed to update peer %s: %w", peerConf.PublicKey, err)
+		}
+	}
+
+	for _, peerConf := range directPeersFirst(added) {
+		if err := s.AddPeer(peerConf); err != nil {
+			return fmt.Errorf("failed to add peer %s: %w", peerConf.PublicKey, err)
+		}
+	}
+
+	// Rules are applied after the peers have been added so that names can be resolved.
+	if err := s.setACLLocked(conf.ACL); err != nil {
+		return fmt.Errorf("failed to set acl: %w", err)
+	}
+
+	s.setRateLimitLocked(conf.RateLimit, conf.OutboundRateLimit)
+	s.sourceSink.SetEchoReply(!conf.DisableEchoReply)
+	s.sourceSink.SetMSSClamping(conf.ClampMSS)
+	s.sourceSink.SetMulticast(conf.EnableMulticast)
+
+	s.conf = *conf
+
+	return nil
+}
+
+// Config returns a snapshot of the socket's current configuration, reflecting
+// any changes made since it was created (eg. peers that have been added).
+func (s *NoisySocket) Config() *v1alpha1.Config {
+	s.confMu.Lock()
+	conf := s.conf
+	s.confMu.Unlock()
+
+	conf.Listeners = slices.Clone(conf.Listeners)
+	conf.STUNServers = slices.Clone(conf.STUNServers)
+	conf.IPs = slices.Clone(conf.IPs)
+	conf.DNSServers = slices.Clone(conf.DNSServers)
+	conf.DNSRoutes = slices.Clone(conf.DNSRoutes)
+	conf.ReverseProxies = slices.Clone(conf.ReverseProxies)
+	conf.ACL = slices.Clone(conf.ACL)
+
+	s.peerConfigsMu.Lock()
+	conf.Peers = make([]v1alpha1.WireGuardPeerConfig, 0, len(s.peerConfigs))
+	for _, peerConf := range s.peerConfigs {
+		peerConf.IPs = slices.Clone(peerConf.IPs)
+		conf.Peers = append(conf.Peers, peerConf)
+	}
+	s.peerConfigsMu.Unlock()
+
+	// Give the peers a stable order.
+	slices.SortFunc(conf.Peers, func(a, b v1alpha1.WireGuardPeerConfig) int {
+		if c := strings.Compare(a.Name, b.Name); c != 0 {
+			return c
+		}
+		return strings.Compare(a.PublicKey, b.PublicKey)
+	})
+
+	return &conf
+}
+
+// setPeerConfig records the configuration of a peer, so that it can be compared
+// against when reloading.
+func (s *NoisySocket) setPeerConfig(publicKey transport.NoisePublicKey, peerConf *v1alpha1.WireGuardPeerConfig) {
+	s.peerConfigsMu.Lock()
+	defer s.peerConfigsMu.Unlock()
+
+	s.peerConfigs[publicKey] = *peerConf
+}
+
+// checkReloadable returns an error if the new configuration changes settings
+// that can only be applied when the socket is created.
+func checkReloadable(current, conf *v1alpha1.Config) error {
+	var changed []string
+	if conf.Name != current.Name {
+		changed = append(changed, "name")
+	}
+	if conf.ListenPort != current.ListenPort {
+		changed = append(changed, "listenPort")
+	}
+	if conf.Backend != current.Backend {
+		changed = append(changed, "backend")
+	}
+	if !slices.Equal(conf.Listeners, current.Listeners) {
+		changed = append(changed, "listeners")
+	}
+	if !reflect.DeepEqual(conf.SocketOptions, current.SocketOptions) {
+		changed = append(changed, "socketOptions")
+	}
+	if conf.RelayURL != current.RelayURL {
+		changed = append(changed, "relayURL")
+	}
+	if !slices.Equal(conf.STUNServers, current.STUNServers) {
+		changed = append(changed, "stunServers")
+	}
+	if conf.IntroducePeers != current.IntroducePeers {
+		changed = append(changed, "introducePeers")
+	}
+	if !reflect.DeepEqual(conf.LANDiscovery, current.LANDiscovery) {
+		changed = append(changed, "lanDiscovery")
+	}
+	if !reflect.DeepEqual(conf.Obfuscation, current.Obfuscation) {
+		changed = append(changed, "obfuscation")
+	}
+	if !reflect.DeepEqual(conf.Roaming, current.Roaming) {
+		changed = append(changed, "roaming")
+	}
+	if conf.MTU != current.MTU {
+		changed = append(changed, "mtu")
+	}
+	if conf.LoadBalancing != current.LoadBalancing {
+		changed = append(changed, "loadBalancing")
+	}
+	if !reflect.DeepEqual(conf.FloatingIPs, current.FloatingIPs) {
+		changed = append(changed, "floatingIPs")
+	}
+	if conf.PathMTUDiscovery != current.PathMTUDiscovery {
+		changed = append(changed, "pathMTUDiscovery")
+	}
+	if !reflect.DeepEqual(conf.HealthCheck, current.HealthCheck) {
+		changed = append(changed, "healthCheck")
+	}
+	if conf.PeerIdleTimeoutSeconds != current.PeerIdleTimeoutSeconds {
+		changed = append(changed, "peerIdleTimeoutSeconds")
+	}
+	if !reflect.DeepEqual(conf.Timers, current.Timers) {
+		changed = append(changed, "timers")
+	}
+	if !reflect.DeepEqual(conf.HandshakeLimits, current.HandshakeLimits) {
+		changed = append(changed, "handshakeLimits")
+	}
+	if !reflect.DeepEqual(conf.Tuning, current.Tuning) {
+		changed = append(changed, "tuning")
+	}
+	if !reflect.DeepEqual(conf.QoS, current.QoS) {
+		changed = append(changed, "qos")
+	}
+	if !reflect.DeepEqual(conf.Stack, current.Stack) {
+		changed = append(changed, "stack")
+	}
+	if conf.SessionStateFile != current.SessionStateFile {
+		changed = append(changed, "sessionStateFile")
+	}
+	// Addresses can be changed, but allocating (or deriving) them requires a
+	// restart.
+	if !slices.Equal(conf.IPs, current.IPs) && len(conf.IPs) == 0 {
+		changed = append(changed, "ips")
+	}
+	if !reflect.DeepEqual(conf.IPAM, current.IPAM) {
+		changed = append(changed, "ipam")
+	}
+	if conf.DeriveIPv6Addresses != current.DeriveIPv6Addresses {
+		changed = append(changed, "deriveIPv6Addresses")
+	}
+	if conf.Domain != current.Domain {
+		changed = append(changed, "domain")
+	}
+	if conf.DefaultGatewayPeerName != current.DefaultGatewayPeerName {
+		changed = append(changed, "defaultGatewayPeerName")
+	}
+	if !slices.Equal(conf.DNSServers, current.DNSServers) {
+		changed = append(changed, "dnsServers")
+	}
+	if !reflect.DeepEqual(conf.DNS, current.DNS) {
+		changed = append(changed, "dns")
+	}
+	if !reflect.DeepEqual(conf.DNSRoutes, current.DNSRoutes) {
+		changed = append(changed, "dnsRoutes")
+	}
+	if conf.UseHostResolver != current.UseHostResolver {
+		changed = append(changed, "useHostResolver")
+	}
+	if conf.EnableDNSServer != current.EnableDNSServer {
+		changed = append(changed, "enableDNSServer")
+	}
+	if conf.EnableMeasurementServer != current.EnableMeasurementServer {
+		changed = append(changed, "enableMeasurementServer")
+	}
+	if !reflect.DeepEqual(conf.ReverseProxies, current.ReverseProxies) {
+		changed = append(changed, "reverseProxies")
+	}
+	if conf.EnableForwarding != current.EnableForwarding {
+		changed = append(changed, "enableForwarding")
+	}
+	if conf.ForwardToHostNetwork != current.ForwardToHostNetwork {
+		changed = append(changed, "forwardToHostNetwork")
+	}
+	if conf.DisableDNSForwarder != current.DisableDNSForwarder {
+		changed = append(changed, "disableDNSForwarder")
+	}
+	if conf.NAT64Prefix != current.NAT64Prefix {
+		changed = append(changed, "nat64Prefix")
+	}
+	if conf.StrictInterop != current.StrictInterop {
+		changed = append(changed, "strictInterop")
+	}
+
+	if len(changed) > 0 {
+		return fmt.Errorf("changes to %v require a restart", changed)
+	}
+
+	return nil
+}
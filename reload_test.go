@@ -0,0 +1,138 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets_test
+
+import (
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoisySocket_Reload(t *testing.T) {
+	logger := slogt.New(t)
+
+	privateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	var peerPublicKeys []string
+	for i := 0; i < 3; i++ {
+		peerPrivateKey, err := transport.NewPrivateKey()
+		require.NoError(t, err)
+
+		peerPublicKeys = append(peerPublicKeys, peerPrivateKey.PublicKey().String())
+	}
+
+	conf := &v1alpha1.Config{
+		Name:       "node",
+		ListenPort: 12371,
+		PrivateKey: privateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "alice",
+				PublicKey: peerPublicKeys[0],
+				IPs:       []string{"10.7.0.2"},
+			},
+			{
+				Name:      "bob",
+				PublicKey: peerPublicKeys[1],
+				IPs:       []string{"10.7.0.3"},
+			},
+		},
+	}
+
+	socket, err := noisysockets.NewNoisySocket(logger, conf)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, socket.Close())
+	})
+
+	newPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	// Remove alice, rename bob, and give alice's address to a new peer.
+	reloadedConf := *conf
+	reloadedConf.PrivateKey = newPrivateKey.String()
+	reloadedConf.Peers = []v1alpha1.WireGuardPeerConfig{
+		{
+			Name:      "robert",
+			PublicKey: peerPublicKeys[1],
+			IPs:       []string{"10.7.0.3"},
+		},
+		{
+			Name:      "carol",
+			PublicKey: peerPublicKeys[2],
+			IPs:       []string{"10.7.0.2"},
+		},
+	}
+
+	require.NoError(t, socket.Reload(&reloadedConf))
+
+	_, err = socket.LookupHost("alice")
+	require.Error(t, err)
+
+	_, err = socket.LookupHost("bob")
+	require.Error(t, err)
+
+	addrs, err := socket.LookupHost("robert")
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.7.0.3"}, addrs)
+
+	addrs, err = socket.LookupHost("carol")
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.7.0.2"}, addrs)
+
+	// The current config should reflect the changes.
+	currentConf := socket.Config()
+	require.Equal(t, newPrivateKey.String(), currentConf.PrivateKey)
+	require.Len(t, currentConf.Peers, 2)
+	require.Equal(t, "carol", currentConf.Peers[0].Name)
+	require.Equal(t, "robert", currentConf.Peers[1].Name)
+
+	t.Run("Restart Required", func(t *testing.T) {
+		changedConf := reloadedConf
+		changedConf.ListenPort = 12372
+
+		err := socket.Reload(&changedConf)
+		require.ErrorContains(t, err, "listenPort")
+	})
+
+	t.Run("Duplicate Peer", func(t *testing.T) {
+		changedConf := reloadedConf
+		changedConf.Peers = append(changedConf.Peers, v1alpha1.WireGuardPeerConfig{
+			Name:      "dave",
+			PublicKey: peerPublicKeys[2],
+			IPs:       []string{"10.7.0.4"},
+		})
+
+		err := socket.Reload(&changedConf)
+		require.ErrorContains(t, err, "duplicate peer")
+
+		// Nothing should have changed.
+		_, err = socket.LookupHost("dave")
+		require.Error(t, err)
+	})
+	t.Run("Addresses", func(t *testing.T) {
+		changedConf := reloadedConf
+		changedConf.IPs = []string{"10.7.0.10", "fd00::10"}
+
+		require.NoError(t, socket.Reload(&changedConf))
+
+		addrs, err := socket.LookupHost("node")
+		require.NoError(t, err)
+		require.Equal(t, []string{"10.7.0.10", "fd00::10"}, addrs)
+
+		// Allocated addresses require a restart.
+		changedConf.IPs = nil
+
+		err = socket.Reload(&changedConf)
+		require.ErrorContains(t, err, "ips")
+	})
+}
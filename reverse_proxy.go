@@ -0,0 +1,67 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/proxy"
+)
+
+// startReverseProxy serves an HTTP reverse proxy on the socket, see
+// v1alpha1.ReverseProxyConfig.
+func (s *NoisySocket) startReverseProxy(conf *v1alpha1.ReverseProxyConfig) error {
+	if (conf.CertFile == "") != (conf.KeyFile == "") {
+		return fmt.Errorf("both a certificate and key file are required for TLS")
+	}
+
+	p, err := proxy.NewReverseProxy(s.logger, conf.Routes)
+	if err != nil {
+		return err
+	}
+
+	var tlsConfig *tls.Config
+	if conf.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return fmt.Errorf("could not load certificate: %w", err)
+		}
+
+		tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{"h2", "http/1.1"},
+		}
+	}
+
+	var lis net.Listener
+	lis, err = s.Listen("tcp", conf.ListenAddress)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+
+	if tlsConfig != nil {
+		lis = tls.NewListener(lis, tlsConfig)
+	}
+
+	s.reverseProxies = append(s.reverseProxies, p)
+
+	logger := s.logger.With("address", lis.Addr().String())
+
+	go func() {
+		if err := p.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+			logger.Error("Failed to serve reverse proxy", "error", err)
+		}
+	}()
+
+	logger.Debug("Serving reverse proxy")
+
+	return nil
+}
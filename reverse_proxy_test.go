@@ -0,0 +1,98 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/noisysockets/noisysockets/proxy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoisySocket_ReverseProxy(t *testing.T) {
+	logger := slogt.New(t)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s %s %s", r.Host, r.URL.Path,
+			r.Header.Get(proxy.PeerNameHeader), r.Header.Get(proxy.PeerPublicKeyHeader))
+	}))
+	t.Cleanup(upstream.Close)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverSocket, clientSocket, err := noisysockets.Pipe(logger, &v1alpha1.Config{
+		Name:       "server",
+		PrivateKey: serverPrivateKey.String(),
+		IPs:        []string{"100.64.0.1"},
+		ReverseProxies: []v1alpha1.ReverseProxyConfig{
+			{
+				ListenAddress: ":80",
+				Routes: map[string]string{
+					"/": upstream.URL,
+				},
+			},
+		},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "client",
+				PublicKey: clientPrivateKey.PublicKey().String(),
+				IPs:       []string{"100.64.0.2"},
+			},
+		},
+	}, &v1alpha1.Config{
+		Name:       "client",
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"100.64.0.2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "server",
+				PublicKey: serverPrivateKey.PublicKey().String(),
+				IPs:       []string{"100.64.0.1"},
+			},
+		},
+	}, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+		require.NoError(t, clientSocket.Close())
+	})
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext:       clientSocket.DialContext,
+			DisableKeepAlives: true,
+		},
+		Timeout: 5 * time.Second,
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://server/hello", nil)
+	require.NoError(t, err)
+	// Clients can't impersonate other peers.
+	req.Header.Set(proxy.PeerNameHeader, "admin")
+
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, resp.Body.Close())
+	})
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "server /hello client "+clientPrivateKey.PublicKey().String(), string(body))
+}
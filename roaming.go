@@ -0,0 +1,180 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+)
+
+// defaultRoamingInterval is how often the host's network interfaces are
+// checked for changes by default.
+const defaultRoamingInterval = 2 * time.Second
+
+// ListenPort returns the port the socket is listening on for incoming packets
+// (eg. the ephemeral port that was chosen, when no port was configured).
+func (s *NoisySocket) ListenPort() uint16 {
+	return s.transport.Port()
+}
+
+// Rebind closes, and reopens, the socket's underlying sockets (on the same
+// port), and re-initiates handshakes with its peers, so that sessions survive a
+// change to the host's network (eg. moving from Wi-Fi to LTE). It is called
+// automatically when roaming is enabled, but can also be called by applications
+// that are notified of network changes by the platform.
+func (s *NoisySocket) Rebind() error {
+	if err := s.transport.BindUpdate(); err != nil {
+		return fmt.Errorf("failed to rebind: %w", err)
+	}
+
+	s.peerConfigsMu.Lock()
+	publicKeys := make([]transport.NoisePublicKey, 0, len(s.peerConfigs))
+	for pk := range s.peerConfigs {
+		publicKeys = append(publicKeys, pk)
+	}
+	s.peerConfigsMu.Unlock()
+
+	// Peers, and any NATs in between, only learn our new address once we send
+	// them something from it.
+	for _, pk := range publicKeys {
+		peer := s.transport.LookupPeer(pk)
+		if peer == nil || peer.Stats().LastHandshake.IsZero() {
+			continue
+		}
+
+		// Failures are logged by the transport, and retried by its timers.
+		_ = peer.ForceHandshakeInitiation()
+	}
+
+	// Existing sessions can be used straight away, while the handshakes complete.
+	s.transport.SendKeepalivesToPeersWithCurrentKeypair()
+
+	return nil
+}
+
+func parseRoamingConfig(conf *v1alpha1.RoamingConfig) (time.Duration, error) {
+	if conf.IntervalSeconds < 0 {
+		return 0, fmt.Errorf("roaming interval must not be negative")
+	}
+
+	if conf.IntervalSeconds > 0 {
+		return time.Duration(conf.IntervalSeconds) * time.Second, nil
+	}
+
+	return defaultRoamingInterval, nil
+}
+
+// roamingMonitor rebinds the socket whenever the addresses of the host's
+// network interfaces change.
+type roamingMonitor struct {
+	logger   *slog.Logger
+	s        *NoisySocket
+	interval time.Duration
+	// interfaceAddrs returns the addresses of the host's network interfaces.
+	interfaceAddrs func() ([]string, error)
+	cancel         context.CancelFunc
+	wg             sync.WaitGroup
+}
+
+func newRoamingMonitor(logger *slog.Logger, s *NoisySocket, interval time.Duration) *roamingMonitor {
+	return &roamingMonitor{
+		logger:         logger,
+		s:              s,
+		interval:       interval,
+		interfaceAddrs: interfaceAddrs,
+	}
+}
+
+// Start starts watching for changes, from the current addresses.
+func (m *roamingMonitor) Start() {
+	addrs, err := m.interfaceAddrs()
+	if err != nil {
+		m.logger.Warn("Failed to list network interfaces", "error", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+
+	m.wg.Add(1)
+	go m.run(ctx, addrs)
+}
+
+// Close stops watching for changes.
+func (m *roamingMonitor) Close() {
+	m.cancel()
+	m.wg.Wait()
+}
+
+func (m *roamingMonitor) run(ctx context.Context, last []string) {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		addrs, err := m.interfaceAddrs()
+		if err != nil {
+			m.logger.Warn("Failed to list network interfaces", "error", err)
+			continue
+		}
+
+		if slices.Equal(addrs, last) {
+			continue
+		}
+
+		m.logger.Info("Network changed, rebinding", "addrs", addrs)
+
+		if err := m.s.Rebind(); err != nil {
+			m.logger.Warn("Failed to rebind", "error", err)
+			continue
+		}
+
+		last = addrs
+	}
+}
+
+// interfaceAddrs returns the sorted addresses of the host's network interfaces
+// that are up, excluding loopback interfaces.
+func interfaceAddrs() ([]string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		ifaceAddrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, addr := range ifaceAddrs {
+			addrs = append(addrs, iface.Name+"/"+addr.String())
+		}
+	}
+
+	slices.Sort(addrs)
+
+	return addrs, nil
+}
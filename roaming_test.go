@@ -0,0 +1,134 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoaming(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	server, err := NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "server",
+		ListenPort: 12436,
+		PrivateKey: serverPrivateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "client",
+				PublicKey: clientPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.2"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, server.Close())
+	})
+
+	// No listen port, so an ephemeral port is chosen.
+	client, err := NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "client",
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "server",
+				PublicKey: serverPrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12436",
+				IPs:       []string{"10.7.0.1"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, client.Close())
+	})
+
+	port := client.ListenPort()
+	require.NotZero(t, port)
+
+	lis, err := server.Listen("tcp", ":80")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, lis.Close())
+	})
+
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	conn, err := client.DialTimeout("tcp", "server:80", 10*time.Second)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, conn.Close())
+	})
+
+	echo := func() {
+		require.NoError(t, conn.SetDeadline(time.Now().Add(10*time.Second)))
+
+		_, err := conn.Write([]byte("Hello, world!"))
+		require.NoError(t, err)
+
+		buf := make([]byte, len("Hello, world!"))
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+		require.Equal(t, "Hello, world!", string(buf))
+	}
+
+	echo()
+
+	serverPeer := client.transport.LookupPeer(serverPrivateKey.PublicKey())
+	require.NotNil(t, serverPeer)
+	handshakes := serverPeer.Stats().HandshakesCompleted
+
+	// The host's interfaces can be listed.
+	_, err = interfaceAddrs()
+	require.NoError(t, err)
+
+	var addrs atomic.Value
+	addrs.Store([]string{"wlan0/192.168.1.2/24"})
+
+	m := newRoamingMonitor(logger, client, 50*time.Millisecond)
+	m.interfaceAddrs = func() ([]string, error) {
+		return addrs.Load().([]string), nil
+	}
+	m.Start()
+	t.Cleanup(m.Close)
+
+	// Move from Wi-Fi to LTE.
+	addrs.Store([]string{"rmnet0/100.64.0.2/32"})
+
+	require.Eventually(t, func() bool {
+		return serverPeer.Stats().HandshakesCompleted > handshakes
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// The socket is rebound to the same port, and the connection survives.
+	require.Equal(t, port, client.ListenPort())
+
+	echo()
+}
@@ -0,0 +1,481 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+)
+
+// serviceDiscoveryTimeout is how long to wait for each peer to answer, when
+// discovering services.
+const serviceDiscoveryTimeout = 2 * time.Second
+
+// Service is a service advertised by the local node, that peers can discover
+// (see DiscoverServices).
+type Service struct {
+	// Name is the name of the service (eg. "api").
+	Name string
+	// Protocol is the transport protocol of the service, either "tcp" (the
+	// default) or "udp".
+	Protocol string
+	// Port is the port the service listens on.
+	Port uint16
+	// Metadata is optional information about the service (eg. its version).
+	Metadata map[string]string
+}
+
+// DiscoveredService is a service advertised by a peer.
+type DiscoveredService struct {
+	Service
+	// Host is the name of the peer advertising the service.
+	Host string
+	// Addrs are the addresses of the peer.
+	Addrs []netip.Addr
+}
+
+// serviceRegistry holds the services advertised by the local node, they are
+// answered by the DNS server as SRV and TXT records (eg. "_api._tcp"), along
+// with those published by peers.
+type serviceRegistry struct {
+	mu       sync.RWMutex
+	services map[string]Service // by owner name
+}
+
+// AdvertiseService advertises a service, so that peers can discover it. The
+// DNS server (see Config.EnableDNSServer) must be enabled. Advertising a
+// service with the same name and protocol replaces it.
+func (s *NoisySocket) AdvertiseService(svc Service) error {
+	if s.dnsServer == nil {
+		return errors.New("advertising services requires the dns server to be enabled")
+	}
+
+	if s.localName == "" {
+		return errors.New("advertising services requires the socket to have a name")
+	}
+
+	svc, err := normalizeService(svc)
+	if err != nil {
+		return err
+	}
+
+	s.advertisedServices.mu.Lock()
+	defer s.advertisedServices.mu.Unlock()
+
+	if s.advertisedServices.services == nil {
+		s.advertisedServices.services = make(map[string]Service)
+	}
+	s.advertisedServices.services[serviceOwnerName(svc.Name, svc.Protocol)] = svc
+
+	return nil
+}
+
+// WithdrawService stops advertising a service.
+func (s *NoisySocket) WithdrawService(name, protocol string) {
+	if protocol == "" {
+		protocol = "tcp"
+	}
+
+	s.advertisedServices.mu.Lock()
+	defer s.advertisedServices.mu.Unlock()
+
+	delete(s.advertisedServices.services, serviceOwnerName(strings.ToLower(name), protocol))
+}
+
+// DiscoverServices asks each peer which runs a DNS server whether it
+// advertises a service, returning those that do, sorted by the name of the
+// peer. Peers that don't answer within a couple of seconds are skipped.
+func (n *noisyNet) DiscoverServices(ctx context.Context, name, protocol string) ([]DiscoveredService, error) {
+	if protocol == "" {
+		protocol = "tcp"
+	}
+
+	owner := dns.Fqdn(serviceOwnerName(strings.ToLower(name), protocol))
+	if _, ok := dns.IsDomainName(owner); !ok {
+		return nil, fmt.Errorf("invalid service name %q", name)
+	}
+
+	type peer struct {
+		name  string
+		addrs []netip.Addr
+	}
+
+	n.peersMu.RLock()
+	peers := make(map[transport.NoisePublicKey]*peer, len(n.peerAddresses))
+	for pk, addrs := range n.peerAddresses {
+		if len(addrs) > 0 {
+			peers[pk] = &peer{addrs: slices.Clone(addrs)}
+		}
+	}
+	for name, pk := range n.peerNames {
+		if p, ok := peers[pk]; ok {
+			p.name = name
+		}
+	}
+	n.peersMu.RUnlock()
+
+	var (
+		mu         sync.Mutex
+		discovered []DiscoveredService
+		wg         sync.WaitGroup
+	)
+	for _, p := range peers {
+		p := p
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			svc, ok := n.queryService(ctx, p.addrs[0], owner)
+			if !ok {
+				return
+			}
+
+			svc.Name = strings.ToLower(name)
+			svc.Protocol = protocol
+
+			mu.Lock()
+			discovered = append(discovered, DiscoveredService{Service: svc, Host: p.name, Addrs: p.addrs})
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(discovered, func(a, b DiscoveredService) int {
+		return strings.Compare(a.Host, b.Host)
+	})
+
+	return discovered, nil
+}
+
+// queryService asks the DNS server of a peer for the SRV record of a service
+// (and the TXT record holding its metadata).
+func (n *noisyNet) queryService(ctx context.Context, addr netip.Addr, owner string) (Service, bool) {
+	ctx, cancel := context.WithTimeout(ctx, serviceDiscoveryTimeout)
+	defer cancel()
+
+	client := dns.Client{
+		Net:                 "tcp",
+		DialContextOverride: n.DialContext,
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(owner, dns.TypeSRV)
+
+	resp, _, err := client.ExchangeContext(ctx, req, net.JoinHostPort(addr.String(), "53"))
+	if err != nil || resp.Rcode != dns.RcodeSuccess {
+		return Service{}, false
+	}
+
+	// The peer's DNS server may also answer for the services published by its
+	// own peers, so only the record targeting the peer is used. Each record's
+	// metadata is held by the TXT record in the same position.
+	targetAddrs := make(map[string][]netip.Addr)
+	var txts [][]string
+	for _, rr := range resp.Extra {
+		switch rr := rr.(type) {
+		case *dns.A:
+			if addr, ok := netip.AddrFromSlice(rr.A); ok {
+				targetAddrs[rr.Hdr.Name] = append(targetAddrs[rr.Hdr.Name], addr.Unmap())
+			}
+		case *dns.AAAA:
+			if addr, ok := netip.AddrFromSlice(rr.AAAA); ok {
+				targetAddrs[rr.Hdr.Name] = append(targetAddrs[rr.Hdr.Name], addr)
+			}
+		case *dns.TXT:
+			txts = append(txts, rr.Txt)
+		}
+	}
+
+	var svc Service
+	var found bool
+	var i int
+	for _, rr := range resp.Answer {
+		srv, ok := rr.(*dns.SRV)
+		if !ok {
+			continue
+		}
+
+		if slices.Contains(targetAddrs[srv.Target], addr) {
+			svc.Port = srv.Port
+			if i < len(txts) {
+				svc.Metadata = parseServiceMetadata(txts[i])
+			}
+			found = true
+			break
+		}
+		i++
+	}
+	if !found {
+		return Service{}, false
+	}
+
+	return svc, true
+}
+
+// lookupServiceRecords returns the hosts of the service with the given owner
+// name (eg. "_api._tcp", optionally qualified with the mesh's domain). The
+// local node comes first, if it advertises the service, followed by the peers
+// publishing it (see WireGuardPeerConfig.SRVRecords), sorted by name.
+// Unhealthy peers are skipped.
+func (n *noisyNet) lookupServiceRecords(owner string) []DiscoveredService {
+	owner, _ = n.trimDomain(owner)
+	owner = strings.ToLower(owner)
+
+	var services []DiscoveredService
+
+	n.advertisedServices.mu.RLock()
+	svc, ok := n.advertisedServices.services[owner]
+	n.advertisedServices.mu.RUnlock()
+	if ok {
+		services = append(services, DiscoveredService{Service: svc, Host: n.localName, Addrs: slices.Clone(n.localAddrs.load())})
+	}
+
+	var published []DiscoveredService
+
+	n.peersMu.RLock()
+	for name, pk := range n.peerNames {
+		if n.peerHealth != nil && n.peerHealth(pk) == Unhealthy {
+			continue
+		}
+
+		for _, svc := range n.peerSRVRecords[pk] {
+			if serviceOwnerName(svc.Name, svc.Protocol) == owner {
+				published = append(published, DiscoveredService{Service: svc, Host: name, Addrs: slices.Clone(n.peerAddresses[pk])})
+			}
+		}
+	}
+	n.peersMu.RUnlock()
+
+	slices.SortFunc(published, func(a, b DiscoveredService) int {
+		if c := strings.Compare(a.Host, b.Host); c != 0 {
+			return c
+		}
+		return int(a.Port) - int(b.Port)
+	})
+
+	return append(services, published...)
+}
+
+// lookupMeshTXT returns the TXT records of a service (the metadata of each of
+// its hosts), the local node, or a peer (see WireGuardPeerConfig.TXTRecords).
+func (n *noisyNet) lookupMeshTXT(name string) ([][]string, bool) {
+	if services := n.lookupServiceRecords(name); len(services) > 0 {
+		records := make([][]string, 0, len(services))
+		for _, svc := range services {
+			records = append(records, formatServiceMetadata(svc.Metadata))
+		}
+
+		return records, true
+	}
+
+	host, _ := n.trimDomain(name)
+	if host == "" {
+		return nil, false
+	}
+
+	if host == n.localName {
+		return nil, true
+	}
+
+	n.peersMu.RLock()
+	defer n.peersMu.RUnlock()
+
+	pk, ok := n.peerNames[host]
+	if !ok {
+		return nil, false
+	}
+
+	var records [][]string
+	for _, txt := range n.peerTXTRecords[pk] {
+		records = append(records, []string{txt})
+	}
+
+	return records, true
+}
+
+// answerSRV answers an SRV query for a service, with a record for each of its
+// hosts. The answer is accompanied by the TXT records holding the metadata of
+// each host's service (in the same order), and the addresses of the hosts.
+func (s *dnsServer) answerSRV(resp *dns.Msg, q dns.Question, services []DiscoveredService) {
+	targets := make(map[string]struct{})
+	for _, svc := range services {
+		target := dns.Fqdn(s.n.qualifyName(svc.Host))
+
+		resp.Answer = append(resp.Answer, &dns.SRV{
+			Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: dnsServerTTL},
+			Port:   svc.Port,
+			Target: target,
+		})
+
+		resp.Extra = append(resp.Extra, &dns.TXT{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: dnsServerTTL},
+			Txt: formatServiceMetadata(svc.Metadata),
+		})
+
+		if _, ok := targets[target]; ok {
+			continue
+		}
+		targets[target] = struct{}{}
+
+		for _, addr := range svc.Addrs {
+			hdr := dns.RR_Header{Name: target, Class: dns.ClassINET, Ttl: dnsServerTTL}
+			if addr.Is4() {
+				hdr.Rrtype = dns.TypeA
+				resp.Extra = append(resp.Extra, &dns.A{Hdr: hdr, A: addr.AsSlice()})
+			} else {
+				hdr.Rrtype = dns.TypeAAAA
+				resp.Extra = append(resp.Extra, &dns.AAAA{Hdr: hdr, AAAA: addr.AsSlice()})
+			}
+		}
+	}
+}
+
+// answerTXT answers a TXT query with the given records.
+func (s *dnsServer) answerTXT(resp *dns.Msg, q dns.Question, records [][]string) {
+	for _, txt := range records {
+		resp.Answer = append(resp.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: dnsServerTTL},
+			Txt: txt,
+		})
+	}
+}
+
+// parsePeerRecords validates the SRV, and TXT, records published by a peer,
+// returning the services of its SRV records.
+func parsePeerRecords(peerConf *v1alpha1.WireGuardPeerConfig) ([]Service, error) {
+	var services []Service
+	for _, record := range peerConf.SRVRecords {
+		svc, err := normalizeService(Service{
+			Name:     record.Service,
+			Protocol: record.Protocol,
+			Port:     record.Port,
+			Metadata: record.Metadata,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("invalid srv record of peer %s: %w", peerConf.PublicKey, err)
+		}
+
+		services = append(services, svc)
+	}
+
+	for _, txt := range peerConf.TXTRecords {
+		// The longest string a TXT record can hold (RFC 1035).
+		if len(txt) > 255 {
+			return nil, fmt.Errorf("txt record of peer %s is longer than 255 bytes", peerConf.PublicKey)
+		}
+	}
+
+	return services, nil
+}
+
+// SetPeerRecords replaces the services, and TXT records, published by a peer.
+func (ss *sourceSink) SetPeerRecords(publicKey transport.NoisePublicKey, services []Service, txt []string) {
+	ss.peersMu.Lock()
+	defer ss.peersMu.Unlock()
+
+	if len(services) == 0 {
+		delete(ss.peerSRVRecords, publicKey)
+	} else {
+		ss.peerSRVRecords[publicKey] = slices.Clone(services)
+	}
+
+	if len(txt) == 0 {
+		delete(ss.peerTXTRecords, publicKey)
+	} else {
+		ss.peerTXTRecords[publicKey] = slices.Clone(txt)
+	}
+}
+
+// normalizeService validates a service, filling in its default protocol.
+func normalizeService(svc Service) (Service, error) {
+	svc.Name = strings.ToLower(svc.Name)
+	if svc.Name == "" || strings.Contains(svc.Name, ".") {
+		return Service{}, fmt.Errorf("invalid service name %q", svc.Name)
+	}
+
+	if _, ok := dns.IsDomainName(serviceOwnerName(svc.Name, "tcp")); !ok {
+		return Service{}, fmt.Errorf("invalid service name %q", svc.Name)
+	}
+
+	switch svc.Protocol {
+	case "":
+		svc.Protocol = "tcp"
+	case "tcp", "udp":
+	default:
+		return Service{}, fmt.Errorf("unsupported service protocol %q", svc.Protocol)
+	}
+
+	if svc.Port == 0 {
+		return Service{}, fmt.Errorf("service %q must have a port", svc.Name)
+	}
+
+	for key := range svc.Metadata {
+		if key == "" || strings.Contains(key, "=") {
+			return Service{}, fmt.Errorf("invalid metadata key %q for service %q", key, svc.Name)
+		}
+	}
+	svc.Metadata = maps.Clone(svc.Metadata)
+
+	return svc, nil
+}
+
+// serviceOwnerName returns the DNS name of a service, eg. "_api._tcp" (RFC 2782).
+func serviceOwnerName(name, protocol string) string {
+	return "_" + name + "._" + protocol
+}
+
+// formatServiceMetadata encodes the metadata of a service as the strings of a
+// TXT record, "key=value", sorted by key (RFC 6763).
+func formatServiceMetadata(metadata map[string]string) []string {
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	txt := make([]string, 0, len(keys))
+	for _, key := range keys {
+		txt = append(txt, key+"="+metadata[key])
+	}
+
+	// A TXT record must have at least one string.
+	if len(txt) == 0 {
+		txt = append(txt, "")
+	}
+
+	return txt
+}
+
+func parseServiceMetadata(txt []string) map[string]string {
+	metadata := make(map[string]string)
+	for _, s := range txt {
+		if key, value, ok := strings.Cut(s, "="); ok && key != "" {
+			metadata[key] = value
+		}
+	}
+
+	if len(metadata) == 0 {
+		return nil
+	}
+
+	return metadata
+}
@@ -0,0 +1,281 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets_test
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoisySocket_ServiceRegistry(t *testing.T) {
+	logger := slogt.New(t)
+
+	newSocket := func(t *testing.T, conf *v1alpha1.Config) *noisysockets.NoisySocket {
+		socket, err := noisysockets.NewNoisySocket(logger, conf)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, socket.Close())
+		})
+
+		return socket
+	}
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	server1PrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	server2PrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	newServer := func(t *testing.T, name string, listenPort uint16, privateKey transport.NoisePrivateKey, ip string) *noisysockets.NoisySocket {
+		return newSocket(t, &v1alpha1.Config{
+			Name:            name,
+			ListenPort:      listenPort,
+			PrivateKey:      privateKey.String(),
+			IPs:             []string{ip},
+			EnableDNSServer: true,
+			Peers: []v1alpha1.WireGuardPeerConfig{{
+				Name:      "client",
+				PublicKey: clientPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.1"},
+			}},
+		})
+	}
+
+	server1Socket := newServer(t, "server1", 12453, server1PrivateKey, "10.7.0.2")
+	server2Socket := newServer(t, "server2", 12454, server2PrivateKey, "10.7.0.3")
+
+	clientSocket := newSocket(t, &v1alpha1.Config{
+		Name:       "client",
+		ListenPort: 12452,
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "server1",
+				PublicKey: server1PrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12453",
+				IPs:       []string{"10.7.0.2"},
+			},
+			{
+				Name:      "server2",
+				PublicKey: server2PrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12454",
+				IPs:       []string{"10.7.0.3"},
+			},
+		},
+	})
+
+	require.NoError(t, server1Socket.AdvertiseService(noisysockets.Service{
+		Name:     "api",
+		Port:     8080,
+		Metadata: map[string]string{"version": "v1"},
+	}))
+
+	require.NoError(t, server2Socket.AdvertiseService(noisysockets.Service{
+		Name: "API",
+		Port: 8443,
+	}))
+
+	require.NoError(t, server2Socket.AdvertiseService(noisysockets.Service{
+		Name:     "syslog",
+		Protocol: "udp",
+		Port:     514,
+	}))
+
+	ctx := context.Background()
+
+	t.Run("Discover", func(t *testing.T) {
+		services, err := clientSocket.DiscoverServices(ctx, "api", "")
+		require.NoError(t, err)
+
+		require.Equal(t, []noisysockets.DiscoveredService{
+			{
+				Service: noisysockets.Service{
+					Name:     "api",
+					Protocol: "tcp",
+					Port:     8080,
+					Metadata: map[string]string{"version": "v1"},
+				},
+				Host:  "server1",
+				Addrs: []netip.Addr{netip.MustParseAddr("10.7.0.2")},
+			},
+			{
+				Service: noisysockets.Service{
+					Name:     "api",
+					Protocol: "tcp",
+					Port:     8443,
+				},
+				Host:  "server2",
+				Addrs: []netip.Addr{netip.MustParseAddr("10.7.0.3")},
+			},
+		}, services)
+
+		services, err = clientSocket.DiscoverServices(ctx, "syslog", "udp")
+		require.NoError(t, err)
+		require.Len(t, services, 1)
+		require.Equal(t, "server2", services[0].Host)
+		require.Equal(t, uint16(514), services[0].Port)
+
+		// The protocol is part of the service.
+		services, err = clientSocket.DiscoverServices(ctx, "syslog", "tcp")
+		require.NoError(t, err)
+		require.Empty(t, services)
+	})
+
+	t.Run("Withdraw", func(t *testing.T) {
+		server1Socket.WithdrawService("api", "tcp")
+
+		services, err := clientSocket.DiscoverServices(ctx, "api", "tcp")
+		require.NoError(t, err)
+		require.Len(t, services, 1)
+		require.Equal(t, "server2", services[0].Host)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		// The client doesn't run a DNS server.
+		require.Error(t, clientSocket.AdvertiseService(noisysockets.Service{Name: "api", Port: 80}))
+
+		for _, svc := range []noisysockets.Service{
+			{Port: 80},
+			{Name: "api.v1", Port: 80},
+			{Name: "api", Protocol: "sctp", Port: 80},
+			{Name: "api"},
+			{Name: "api", Port: 80, Metadata: map[string]string{"a=b": "c"}},
+		} {
+			require.Error(t, server1Socket.AdvertiseService(svc), svc)
+		}
+	})
+}
+
+func TestNoisySocket_PublishedRecords(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverSocket, clientSocket, err := noisysockets.Pipe(logger, &v1alpha1.Config{
+		Name:            "server",
+		PrivateKey:      serverPrivateKey.String(),
+		IPs:             []string{"10.7.0.1"},
+		EnableDNSServer: true,
+		Peers: []v1alpha1.WireGuardPeerConfig{{
+			Name:      "client",
+			PublicKey: clientPrivateKey.PublicKey().String(),
+			IPs:       []string{"10.7.0.2"},
+			SRVRecords: []v1alpha1.SRVRecordConfig{{
+				Service:  "api",
+				Port:     8443,
+				Metadata: map[string]string{"version": "v2"},
+			}},
+			TXTRecords: []string{"role=worker", "zone=a"},
+		}},
+	}, &v1alpha1.Config{
+		Name:       "client",
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{{
+			Name:      "server",
+			PublicKey: serverPrivateKey.PublicKey().String(),
+			IPs:       []string{"10.7.0.1"},
+		}},
+	}, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+		require.NoError(t, clientSocket.Close())
+	})
+
+	require.NoError(t, serverSocket.AdvertiseService(noisysockets.Service{
+		Name:     "api",
+		Port:     8080,
+		Metadata: map[string]string{"version": "v1"},
+	}))
+
+	ctx := context.Background()
+
+	t.Run("LookupSRV", func(t *testing.T) {
+		cname, srvs, err := serverSocket.LookupSRV("api", "tcp", "")
+		require.NoError(t, err)
+		require.Equal(t, "_api._tcp.", cname)
+		require.Equal(t, []*net.SRV{
+			{Target: "server.", Port: 8080},
+			{Target: "client.", Port: 8443},
+		}, srvs)
+
+		_, _, err = serverSocket.LookupSRV("db", "tcp", "")
+		require.Error(t, err)
+	})
+
+	t.Run("LookupTXT", func(t *testing.T) {
+		txt, err := serverSocket.LookupTXT("client")
+		require.NoError(t, err)
+		require.Equal(t, []string{"role=worker", "zone=a"}, txt)
+
+		txt, err = serverSocket.LookupTXT("_api._tcp")
+		require.NoError(t, err)
+		require.Equal(t, []string{"version=v1", "version=v2"}, txt)
+	})
+
+	t.Run("DNS Server", func(t *testing.T) {
+		client := dns.Client{
+			Net:                 "tcp",
+			DialContextOverride: clientSocket.DialContext,
+		}
+
+		req := new(dns.Msg)
+		req.SetQuestion("_api._tcp.", dns.TypeSRV)
+
+		resp, _, err := client.ExchangeContext(ctx, req, "10.7.0.1:53")
+		require.NoError(t, err)
+		require.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		require.Len(t, resp.Answer, 2)
+		require.Equal(t, "client.", resp.Answer[1].(*dns.SRV).Target)
+		require.Equal(t, uint16(8443), resp.Answer[1].(*dns.SRV).Port)
+
+		req = new(dns.Msg)
+		req.SetQuestion("client.", dns.TypeTXT)
+
+		resp, _, err = client.ExchangeContext(ctx, req, "10.7.0.1:53")
+		require.NoError(t, err)
+		require.Len(t, resp.Answer, 2)
+		require.Equal(t, []string{"role=worker"}, resp.Answer[0].(*dns.TXT).Txt)
+	})
+
+	t.Run("Discover", func(t *testing.T) {
+		// Only the server's own service is discovered, not those it publishes
+		// on behalf of its peers.
+		services, err := clientSocket.DiscoverServices(ctx, "api", "tcp")
+		require.NoError(t, err)
+		require.Len(t, services, 1)
+		require.Equal(t, uint16(8080), services[0].Port)
+		require.Equal(t, map[string]string{"version": "v1"}, services[0].Metadata)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		err := serverSocket.UpdatePeer(v1alpha1.WireGuardPeerConfig{
+			Name:       "client",
+			PublicKey:  clientPrivateKey.PublicKey().String(),
+			IPs:        []string{"10.7.0.2"},
+			SRVRecords: []v1alpha1.SRVRecordConfig{{Service: "api"}},
+		})
+		require.ErrorContains(t, err, "must have a port")
+	})
+}
@@ -0,0 +1,162 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// sessionStateLabel separates the key that encrypts saved sessions from any
+// other use of the private key.
+const sessionStateLabel = "noisysockets session state v1"
+
+// sessionStateKey derives the key that encrypts saved sessions from the
+// socket's private key, so that only the same socket can restore them.
+func sessionStateKey(privateKey transport.NoisePrivateKey) [blake2s.Size]byte {
+	return blake2s.Sum256(append([]byte(sessionStateLabel), privateKey[:]...))
+}
+
+// saveSessions encrypts the sessions of peers, and atomically replaces the
+// file holding them. The transport must be down, so that the sessions' counters
+// are final.
+func saveSessions(path string, privateKey transport.NoisePrivateKey, sessions []transport.SessionState) error {
+	plaintext, err := json.Marshal(sessions)
+	if err != nil {
+		return err
+	}
+
+	key := sessionStateKey(privateKey)
+	aead, err := chacha20poly1305.NewX(key[:])
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	buf := aead.Seal(nonce, nonce, plaintext, []byte(sessionStateLabel))
+
+	// Temporary files are only readable by their owner.
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(buf); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// loadSessions reads, and decrypts, the saved sessions of peers. The file is
+// removed before the sessions are returned, as restoring the same sessions
+// twice would reuse their nonces.
+func loadSessions(path string, privateKey transport.NoisePrivateKey) ([]transport.SessionState, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	if err := os.Remove(path); err != nil {
+		return nil, fmt.Errorf("could not remove %s: %w", path, err)
+	}
+
+	key := sessionStateKey(privateKey)
+	aead, err := chacha20poly1305.NewX(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	if len(buf) < aead.NonceSize() {
+		return nil, fmt.Errorf("could not decrypt %s: truncated", path)
+	}
+
+	plaintext, err := aead.Open(nil, buf[:aead.NonceSize()], buf[aead.NonceSize():], []byte(sessionStateLabel))
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt %s: %w", path, err)
+	}
+
+	var sessions []transport.SessionState
+	if err := json.Unmarshal(plaintext, &sessions); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", path, err)
+	}
+
+	return sessions, nil
+}
+
+// restoreSessions restores the sessions saved when the socket was last
+// closed. Sessions that can't be restored (eg. they have since expired, or
+// the peer was removed) are skipped, and will handshake as usual.
+func (s *NoisySocket) restoreSessions(privateKey transport.NoisePrivateKey) {
+	sessions, err := loadSessions(s.sessionStateFile, privateKey)
+	if err != nil {
+		s.logger.Warn("Failed to load saved sessions", "error", err)
+		return
+	}
+
+	var restored int
+	for i := range sessions {
+		if err := s.transport.ImportSession(&sessions[i]); err != nil {
+			s.logger.Debug("Skipping saved session",
+				"peer", sessions[i].PublicKey.String(), "error", err)
+			continue
+		}
+
+		restored++
+	}
+
+	if len(sessions) > 0 {
+		s.logger.Info("Restored saved sessions", "restored", restored, "saved", len(sessions))
+	}
+}
+
+// persistSessions takes the transport down, and saves the sessions of peers,
+// so that they can be restored when the socket is next created.
+func (s *NoisySocket) persistSessions() {
+	if err := s.transport.Down(); err != nil {
+		s.logger.Warn("Failed to take transport down", "error", err)
+		return
+	}
+
+	s.confMu.Lock()
+	var privateKey transport.NoisePrivateKey
+	err := privateKey.FromString(s.conf.PrivateKey)
+	s.confMu.Unlock()
+	if err != nil {
+		s.logger.Warn("Failed to save sessions", "error", err)
+		return
+	}
+
+	sessions := s.transport.ExportSessions()
+	if err := saveSessions(s.sessionStateFile, privateKey, sessions); err != nil {
+		s.logger.Warn("Failed to save sessions", "error", err)
+		return
+	}
+
+	s.logger.Debug("Saved sessions", "sessions", len(sessions))
+}
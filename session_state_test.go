@@ -0,0 +1,132 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets_test
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoisySocket_SessionState(t *testing.T) {
+	logger := slogt.New(t)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	gatewayPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	sessionStateFile := filepath.Join(t.TempDir(), "sessions")
+
+	gatewayConf := &v1alpha1.Config{
+		Name:             "gateway",
+		ListenPort:       12459,
+		PrivateKey:       gatewayPrivateKey.String(),
+		IPs:              []string{"10.7.0.1"},
+		SessionStateFile: sessionStateFile,
+		Peers: []v1alpha1.WireGuardPeerConfig{{
+			Name:      "client",
+			PublicKey: clientPrivateKey.PublicKey().String(),
+			IPs:       []string{"10.7.0.2"},
+		}},
+	}
+
+	// startGateway starts the gateway, with an echo server on port 7.
+	startGateway := func(t *testing.T) *noisysockets.NoisySocket {
+		socket, err := noisysockets.NewNoisySocket(logger, gatewayConf)
+		require.NoError(t, err)
+
+		lis, err := socket.Listen("tcp", ":7")
+		require.NoError(t, err)
+
+		go func() {
+			for {
+				conn, err := lis.Accept()
+				if err != nil {
+					return
+				}
+
+				go func() {
+					defer conn.Close()
+
+					_, _ = io.Copy(conn, conn)
+				}()
+			}
+		}()
+
+		return socket
+	}
+
+	clientSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "client",
+		ListenPort: 12458,
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{{
+			Name:      "gateway",
+			PublicKey: gatewayPrivateKey.PublicKey().String(),
+			Endpoint:  "localhost:12459",
+			IPs:       []string{"10.7.0.1"},
+		}},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, clientSocket.Close())
+	})
+
+	echo := func(t *testing.T) {
+		conn, err := clientSocket.Dial("tcp", "gateway:7")
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("Hello, gateway!"))
+		require.NoError(t, err)
+
+		buf := make([]byte, len("Hello, gateway!"))
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+
+		require.Equal(t, "Hello, gateway!", string(buf))
+	}
+
+	handshakes := func() uint64 {
+		stats := clientSocket.Stats()
+		require.Len(t, stats.Peers, 1)
+
+		return stats.Peers[0].HandshakesCompleted
+	}
+
+	gatewaySocket := startGateway(t)
+	echo(t)
+	require.Equal(t, uint64(1), handshakes())
+
+	require.NoError(t, gatewaySocket.Close())
+
+	info, err := os.Stat(sessionStateFile)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	// The restarted gateway carries on with the same session.
+	gatewaySocket = startGateway(t)
+	t.Cleanup(func() {
+		require.NoError(t, gatewaySocket.Close())
+	})
+
+	// The saved sessions can only be restored once.
+	_, err = os.Stat(sessionStateFile)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	echo(t)
+	require.Equal(t, uint64(1), handshakes())
+}
@@ -0,0 +1,54 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/conn"
+)
+
+// SharedPort is a UDP port shared by several NoisySockets, each with its own
+// keys, addresses, and peers (ie. a separate network). This allows a gateway to
+// bridge several meshes, without needing a port for each of them. Received
+// packets are delivered to the socket whose private key (or session) they're
+// addressed to.
+type SharedPort struct {
+	bind *conn.SharedBind
+}
+
+// NewSharedPort creates a new SharedPort. The port is opened along with the
+// first socket using it, and closed along with the last.
+func NewSharedPort() *SharedPort {
+	return &SharedPort{
+		bind: conn.NewSharedBind(conn.NewStdNetBind()),
+	}
+}
+
+// NewNoisySocket creates a new NoisySocket that exchanges UDP packets with its
+// peers over the shared port. The socket's listen port must either be zero, or
+// the same as that of the other sockets sharing the port. Endpoint discovery
+// (STUN), and obfuscation, are not supported.
+func (p *SharedPort) NewNoisySocket(logger *slog.Logger, conf *v1alpha1.Config) (*NoisySocket, error) {
+	// Packets are dispatched to sockets before they could be revealed.
+	if conf.Obfuscation != nil {
+		return nil, fmt.Errorf("obfuscation is not supported on a shared port")
+	}
+
+	return newNoisySocket(logger, conf, &underlay{
+		name: "shared port",
+		newBind: func(accept func(packet []byte) bool) conn.Bind {
+			return p.bind.Attach(accept)
+		},
+	}, nil)
+}
+
+// Port returns the port that is being shared, or zero if no sockets are using it.
+func (p *SharedPort) Port() uint16 {
+	return p.bind.Port()
+}
@@ -0,0 +1,130 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSharedPort(t *testing.T) {
+	logger := slogt.New(t)
+
+	sharedPort := noisysockets.NewSharedPort()
+
+	// Two separate networks, with overlapping address spaces, share the gateway's port.
+	for i, network := range []string{"red", "blue"} {
+		gatewayPrivateKey, err := transport.NewPrivateKey()
+		require.NoError(t, err)
+
+		clientPrivateKey, err := transport.NewPrivateKey()
+		require.NoError(t, err)
+
+		gatewaySocket, err := sharedPort.NewNoisySocket(logger, &v1alpha1.Config{
+			Name:       "gateway",
+			ListenPort: 12394,
+			PrivateKey: gatewayPrivateKey.String(),
+			IPs:        []string{"10.7.0.1"},
+			Peers: []v1alpha1.WireGuardPeerConfig{
+				{
+					PublicKey: clientPrivateKey.PublicKey().String(),
+					IPs:       []string{"10.7.0.2"},
+				},
+			},
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, gatewaySocket.Close())
+		})
+
+		require.Equal(t, uint16(12394), sharedPort.Port())
+
+		pc, err := gatewaySocket.ListenPacket("udp", ":53")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = pc.Close()
+		})
+
+		// Reply with the name of the network.
+		go func() {
+			buf := make([]byte, 1500)
+			for {
+				_, addr, err := pc.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+
+				if _, err := pc.WriteTo([]byte(network), addr); err != nil {
+					logger.Error("Failed to write", "error", err)
+					return
+				}
+			}
+		}()
+
+		clientSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+			Name:       "client",
+			ListenPort: uint16(12395 + i),
+			PrivateKey: clientPrivateKey.String(),
+			IPs:        []string{"10.7.0.2"},
+			Peers: []v1alpha1.WireGuardPeerConfig{
+				{
+					Name:      "gateway",
+					PublicKey: gatewayPrivateKey.PublicKey().String(),
+					Endpoint:  "localhost:12394",
+					IPs:       []string{"10.7.0.1"},
+				},
+			},
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, clientSocket.Close())
+		})
+
+		t.Run(fmt.Sprintf("Network=%s", network), func(t *testing.T) {
+			conn, err := clientSocket.Dial("udp", "gateway:53")
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				_ = conn.Close()
+			})
+
+			// The first datagrams may be dropped while the handshake completes, so retry.
+			buf := make([]byte, 1500)
+			var n int
+			for i := 0; i < 10; i++ {
+				_, err = conn.Write([]byte("Hello, world!"))
+				require.NoError(t, err)
+
+				require.NoError(t, conn.SetReadDeadline(time.Now().Add(500*time.Millisecond)))
+
+				n, err = conn.Read(buf)
+				if err == nil {
+					break
+				}
+			}
+			require.NoError(t, err)
+
+			require.Equal(t, network, string(buf[:n]))
+		})
+	}
+
+	// Sockets sharing the port must agree on which port it is.
+	privateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	_, err = sharedPort.NewNoisySocket(logger, &v1alpha1.Config{
+		ListenPort: 12397,
+		PrivateKey: privateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+	})
+	require.Error(t, err)
+}
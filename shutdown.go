@@ -0,0 +1,108 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+// shutdownPollInterval is how often Shutdown checks whether connections are
+// still active.
+const shutdownPollInterval = 100 * time.Millisecond
+
+// Shutdown gracefully closes the socket. It stops accepting new connections
+// (closing all of the socket's TCP listeners), and handshakes from peers that
+// don't already have a session, then waits for active TCP connections to
+// finish, before closing the socket. If the context is done first, the socket
+// is closed anyway (aborting any remaining connections), and the context's
+// error is returned.
+func (s *NoisySocket) Shutdown(ctx context.Context) error {
+	s.transport.SetDraining(true)
+
+	// Reverse proxies wait for their own requests to complete, connections
+	// kept alive between requests would otherwise never finish.
+	var wg sync.WaitGroup
+	for _, p := range s.reverseProxies {
+		wg.Add(1)
+		go func(shutdown func(context.Context) error) {
+			defer wg.Done()
+
+			_ = shutdown(ctx)
+		}(p.Shutdown)
+	}
+
+	s.closeListeners()
+
+	err := s.waitForConnections(ctx)
+	wg.Wait()
+
+	if err != nil {
+		s.logger.Warn("Closing socket with active connections", "connections", len(s.activeConnections()))
+	}
+
+	return errors.Join(err, s.Close())
+}
+
+// closeListeners closes the stack's TCP listeners, so that no new connections
+// are accepted. Accepting from any of the socket's listeners returns an error.
+func (n *noisyNet) closeListeners() {
+	for _, ep := range n.stack.RegisteredEndpoints() {
+		tep, ok := ep.(tcpip.Endpoint)
+		if !ok {
+			continue
+		}
+
+		info, ok := tep.Info().(*stack.TransportEndpointInfo)
+		if !ok || info.TransProto != tcp.ProtocolNumber {
+			continue
+		}
+
+		if tcp.EndpointState(tep.State()) == tcp.StateListen {
+			tep.Close()
+		}
+	}
+}
+
+// waitForConnections waits until there are no active TCP connections, or the
+// context is done.
+func (n *noisyNet) waitForConnections(ctx context.Context) error {
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for len(n.activeConnections()) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+// activeConnections returns the TCP connections that haven't yet finished
+// (connections in TIME-WAIT are finished).
+func (n *noisyNet) activeConnections() []ConnectionStats {
+	return n.connections(func(transProto tcpip.TransportProtocolNumber, state uint32) bool {
+		if transProto != tcp.ProtocolNumber {
+			return false
+		}
+
+		switch tcp.EndpointState(state) {
+		case tcp.StateInitial, tcp.StateBound, tcp.StateListen, tcp.StateTimeWait, tcp.StateClose, tcp.StateError:
+			return false
+		default:
+			return true
+		}
+	})
+}
@@ -0,0 +1,134 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+// Package simulation is a harness for testing the timing dependent behavior of
+// noisy sockets (eg. handshake retransmission, keepalives, and TCP
+// retransmission) deterministically, and much faster than real time.
+//
+// Sockets are connected in pairs by in-memory pipes, and their timers, along
+// with the latency of the pipes, are driven by a fake clock that only moves
+// when the simulation is advanced. Deadlines and contexts passed to the
+// sockets (eg. to DialContext) still use the system clock.
+package simulation
+
+import (
+	"log/slog"
+	"runtime"
+	"time"
+
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"gvisor.dev/gvisor/pkg/tcpip/faketime"
+)
+
+const (
+	// DefaultStep is the default amount of simulated time that passes at once.
+	DefaultStep = 10 * time.Millisecond
+	// DefaultSettle is the default amount of real time the sockets are given
+	// to process packets between steps.
+	DefaultSettle = 200 * time.Microsecond
+)
+
+// Epoch is the simulated time at which every simulation starts.
+var Epoch = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Options configures a simulation.
+type Options struct {
+	// Step is the amount of simulated time that passes at once, when the
+	// simulation is advanced. Defaults to DefaultStep.
+	Step time.Duration
+	// Settle is the amount of real time the sockets are given to process
+	// packets between steps. Defaults to DefaultSettle.
+	Settle time.Duration
+}
+
+// Simulation drives the timers of its sockets off a fake clock.
+type Simulation struct {
+	clock  *faketime.ManualClock
+	step   time.Duration
+	settle time.Duration
+}
+
+// New creates a new simulation, the options may be nil.
+func New(opts *Options) *Simulation {
+	s := &Simulation{
+		clock:  faketime.NewManualClock(),
+		step:   DefaultStep,
+		settle: DefaultSettle,
+	}
+
+	if opts != nil {
+		if opts.Step > 0 {
+			s.step = opts.Step
+		}
+
+		if opts.Settle > 0 {
+			s.settle = opts.Settle
+		}
+	}
+
+	// Nothing is scheduled yet, so this happens instantly.
+	s.clock.Advance(Epoch.Sub(s.clock.Now()))
+
+	return s
+}
+
+// Clock returns the simulation's clock.
+func (s *Simulation) Clock() noisysockets.Clock {
+	return s.clock
+}
+
+// Now returns the current simulated time.
+func (s *Simulation) Now() time.Time {
+	return s.clock.Now()
+}
+
+// Pipe creates a pair of sockets, connected to each other by an in-memory
+// pipe, whose timers are driven by the simulation's clock (see
+// noisysockets.Pipe). Any clock in the options is ignored.
+func (s *Simulation) Pipe(logger *slog.Logger, confA, confB *v1alpha1.Config, opts *noisysockets.PipeOptions) (*noisysockets.NoisySocket, *noisysockets.NoisySocket, error) {
+	var pipeOpts noisysockets.PipeOptions
+	if opts != nil {
+		pipeOpts = *opts
+	}
+	pipeOpts.Clock = s.clock
+
+	return noisysockets.Pipe(logger, confA, confB, &pipeOpts)
+}
+
+// Advance moves simulated time forward by d, a step at a time, running any
+// timers that expire along the way.
+func (s *Simulation) Advance(d time.Duration) {
+	until := s.clock.Now().Add(d)
+	for s.clock.Now().Before(until) {
+		s.clock.Advance(min(s.step, until.Sub(s.clock.Now())))
+		s.wait()
+	}
+}
+
+// AdvanceUntil moves simulated time forward, a step at a time, until cond
+// returns true, or limit has passed. It reports whether cond was satisfied.
+func (s *Simulation) AdvanceUntil(cond func() bool, limit time.Duration) bool {
+	until := s.clock.Now().Add(limit)
+	for !cond() {
+		if !s.clock.Now().Before(until) {
+			return false
+		}
+
+		s.clock.Advance(min(s.step, until.Sub(s.clock.Now())))
+		s.wait()
+	}
+
+	return true
+}
+
+// wait gives the sockets' goroutines a chance to process packets. Sleeping is
+// far less precise than the settle time, so it yields instead.
+func (s *Simulation) wait() {
+	deadline := time.Now().Add(s.settle)
+	for time.Now().Before(deadline) {
+		runtime.Gosched()
+	}
+}
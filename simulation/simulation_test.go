@@ -0,0 +1,294 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package simulation_test
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/noisysockets/noisysockets/simulation"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSimulation(t *testing.T) {
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	newConfigs := func(persistentKeepalive uint16) (*v1alpha1.Config, *v1alpha1.Config) {
+		return &v1alpha1.Config{
+			Name:       "server",
+			PrivateKey: serverPrivateKey.String(),
+			IPs:        []string{"10.7.0.1"},
+			Peers: []v1alpha1.WireGuardPeerConfig{
+				{
+					Name:      "client",
+					PublicKey: clientPrivateKey.PublicKey().String(),
+					IPs:       []string{"10.7.0.2"},
+				},
+			},
+		}, &v1alpha1.Config{
+			Name:       "client",
+			PrivateKey: clientPrivateKey.String(),
+			IPs:        []string{"10.7.0.2"},
+			Peers: []v1alpha1.WireGuardPeerConfig{
+				{
+					Name:                "server",
+					PublicKey:           serverPrivateKey.PublicKey().String(),
+					IPs:                 []string{"10.7.0.1"},
+					PersistentKeepalive: persistentKeepalive,
+				},
+			},
+		}
+	}
+
+	t.Run("Keepalives", func(t *testing.T) {
+		logger := slogt.New(t)
+
+		sim := simulation.New(nil)
+
+		serverConf, clientConf := newConfigs(25)
+		serverSocket, clientSocket, err := sim.Pipe(logger, serverConf, clientConf, &noisysockets.PipeOptions{
+			Latency: 50 * time.Millisecond,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, serverSocket.Close())
+			require.NoError(t, clientSocket.Close())
+		})
+
+		// The first keepalive brings up the session.
+		require.True(t, sim.AdvanceUntil(func() bool {
+			status, err := serverSocket.PeerStatus("client")
+			return err == nil && !status.LastHandshake.IsZero()
+		}, time.Second))
+
+		// The handshake takes a round trip (processing may take a few more steps).
+		clientStatus, err := clientSocket.PeerStatus("server")
+		require.NoError(t, err)
+		require.WithinRange(t, clientStatus.LastHandshake, simulation.Epoch.Add(100*time.Millisecond), simulation.Epoch.Add(200*time.Millisecond))
+
+		status, err := serverSocket.PeerStatus("client")
+		require.NoError(t, err)
+
+		rxBytes := status.RxBytes
+
+		// A few minutes pass in no time at all, with a keepalive every 25 seconds.
+		start := time.Now()
+		sim.Advance(100 * time.Second)
+		require.Less(t, time.Since(start), 30*time.Second)
+
+		status, err = serverSocket.PeerStatus("client")
+		require.NoError(t, err)
+		// Keepalives are 32 bytes.
+		require.GreaterOrEqual(t, status.RxBytes-rxBytes, uint64(4*32))
+	})
+
+	t.Run("Handshake Retransmission", func(t *testing.T) {
+		logger := slogt.New(t)
+
+		// Nothing gets through, so there are only timers to run.
+		sim := simulation.New(&simulation.Options{Step: 100 * time.Millisecond})
+
+		serverConf, clientConf := newConfigs(25)
+		serverSocket, clientSocket, err := sim.Pipe(logger, serverConf, clientConf, &noisysockets.PipeOptions{
+			Loss: 1,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, serverSocket.Close())
+			require.NoError(t, clientSocket.Close())
+		})
+
+		events, unsubscribe := clientSocket.Subscribe()
+		t.Cleanup(unsubscribe)
+
+		var unreachableAt time.Time
+		require.True(t, sim.AdvanceUntil(func() bool {
+			select {
+			case ev := <-events:
+				if ev.Type == noisysockets.PeerUnreachable {
+					unreachableAt = sim.Now()
+					return true
+				}
+			default:
+			}
+			return false
+		}, 5*time.Minute))
+
+		// Handshakes are retried every 5 seconds (plus jitter), before giving up
+		// after 90 seconds or so.
+		elapsed := unreachableAt.Sub(simulation.Epoch)
+		require.Greater(t, elapsed, 90*time.Second)
+		require.Less(t, elapsed, 2*time.Minute)
+	})
+
+	t.Run("Handshake Retry Interval", func(t *testing.T) {
+		logger := slogt.New(t)
+
+		sim := simulation.New(&simulation.Options{Step: 100 * time.Millisecond})
+
+		// Keepalives start a new round of handshakes, so they are sent less
+		// often than handshakes are retried.
+		serverConf, clientConf := newConfigs(60)
+		clientConf.Timers = &v1alpha1.TimersConfig{HandshakeRetrySeconds: 30}
+
+		serverSocket, clientSocket, err := sim.Pipe(logger, serverConf, clientConf, &noisysockets.PipeOptions{
+			Loss: 1,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, serverSocket.Close())
+			require.NoError(t, clientSocket.Close())
+		})
+
+		events, unsubscribe := clientSocket.Subscribe()
+		t.Cleanup(unsubscribe)
+
+		var unreachableAt time.Time
+		require.True(t, sim.AdvanceUntil(func() bool {
+			select {
+			case ev := <-events:
+				if ev.Type == noisysockets.PeerUnreachable {
+					unreachableAt = sim.Now()
+					return true
+				}
+			default:
+			}
+			return false
+		}, 5*time.Minute))
+
+		// Handshakes are retried every 30 seconds, so a few retries take longer
+		// than the usual 90 seconds or so.
+		elapsed := unreachableAt.Sub(simulation.Epoch)
+		require.Greater(t, elapsed, 2*time.Minute)
+		require.Less(t, elapsed, 3*time.Minute)
+	})
+
+	t.Run("Rekey Interval", func(t *testing.T) {
+		logger := slogt.New(t)
+
+		sim := simulation.New(nil)
+
+		serverConf, clientConf := newConfigs(25)
+		clientConf.Timers = &v1alpha1.TimersConfig{RekeyAfterSeconds: 30, RejectAfterSeconds: 60}
+		serverConf.Timers = clientConf.Timers
+
+		serverSocket, clientSocket, err := sim.Pipe(logger, serverConf, clientConf, &noisysockets.PipeOptions{
+			Latency: 50 * time.Millisecond,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, serverSocket.Close())
+			require.NoError(t, clientSocket.Close())
+		})
+
+		require.True(t, sim.AdvanceUntil(func() bool {
+			status, err := clientSocket.PeerStatus("server")
+			return err == nil && !status.LastHandshake.IsZero()
+		}, time.Second))
+
+		// The keepalive sent after the session is 30 seconds old rekeys it.
+		sim.Advance(time.Minute)
+
+		status, err := clientSocket.PeerStatus("server")
+		require.NoError(t, err)
+		require.True(t, status.LastHandshake.After(simulation.Epoch.Add(30*time.Second)))
+	})
+
+	t.Run("Invalid Timers", func(t *testing.T) {
+		logger := slogt.New(t)
+
+		sim := simulation.New(nil)
+
+		serverConf, clientConf := newConfigs(0)
+		clientConf.Timers = &v1alpha1.TimersConfig{RekeyAfterSeconds: 170}
+
+		_, _, err := sim.Pipe(logger, serverConf, clientConf, nil)
+		require.ErrorContains(t, err, "reject after time must be between")
+	})
+
+	t.Run("TCP Retransmission", func(t *testing.T) {
+		logger := slogt.New(t)
+
+		sim := simulation.New(nil)
+
+		serverConf, clientConf := newConfigs(0)
+		serverSocket, clientSocket, err := sim.Pipe(logger, serverConf, clientConf, &noisysockets.PipeOptions{
+			Latency: 20 * time.Millisecond,
+			Loss:    0.1,
+			Seed:    1,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, serverSocket.Close())
+			require.NoError(t, clientSocket.Close())
+		})
+
+		lis, err := serverSocket.Listen("tcp", ":80")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, lis.Close())
+		})
+
+		data := make([]byte, 64*1024)
+		for i := range data {
+			data[i] = byte(i)
+		}
+
+		go func() {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			_, _ = conn.Write(data)
+		}()
+
+		type result struct {
+			buf []byte
+			err error
+		}
+
+		results := make(chan result, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			conn, err := clientSocket.DialContext(ctx, "tcp", "server:80")
+			if err != nil {
+				results <- result{err: err}
+				return
+			}
+			defer conn.Close()
+
+			buf, err := io.ReadAll(conn)
+			results <- result{buf: buf, err: err}
+		}()
+
+		var res result
+		require.True(t, sim.AdvanceUntil(func() bool {
+			select {
+			case res = <-results:
+				return true
+			default:
+				return false
+			}
+		}, 5*time.Minute))
+
+		require.NoError(t, res.err)
+		require.Equal(t, data, res.buf)
+	})
+}
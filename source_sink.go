@@ -7,10 +7,18 @@
 package noisysockets
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
 	"net"
 	"net/netip"
-	"syscall"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/noisysockets/noisysockets/internal/conn"
 	"github.com/noisysockets/noisysockets/internal/transport"
@@ -23,248 +31,1355 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
 )
 
 const (
-	queueSize = 1024
+	// defaultQueueSize is the default number of outbound packets the stack can queue.
+	defaultQueueSize = 1024
+	// maxStackBufferSize is the largest TCP send, or receive, buffer that can be
+	// configured.
+	maxStackBufferSize = 64 << 20
 )
 
 var (
 	_ transport.SourceSink = (*sourceSink)(nil)
 )
 
+// packetBufferListPool holds the single packet lists used to queue outbound
+// packets, so that queueing a packet doesn't allocate.
+var packetBufferListPool = sync.Pool{
+	New: func() any {
+		return new(stack.PacketBufferList)
+	},
+}
+
+var _ transport.PacketSourceSink = (*sourceSink)(nil)
+
 type sourceSink struct {
-	stack           *stack.Stack
-	ep              *channel.Endpoint
-	incoming        chan *stack.PacketBuffer
-	peerNames       map[string]transport.NoisePublicKey
-	peerAddresses   map[transport.NoisePublicKey][]netip.Addr
-	fromPeerAddress map[netip.Addr]transport.NoisePublicKey
-	publicKey       transport.NoisePublicKey
-	defaultGateway  *transport.NoisePublicKey
+	stack                     *stack.Stack
+	ep                        *channel.Endpoint // the NIC's endpoint, and the first of its queues
+	nic                       *outboundQueues
+	localAddrs                *localAddrSet
+	mtu                       int
+	peersMu                   sync.RWMutex // protects peerNames, peerAddresses, peerPrefixes, fromPeerAddress, peerVia, viaPrefixes, rateLimiters, outboundRateLimiters, spoofedPackets, peerRejectedConnections, peerMTUs, noMulticastPeers, peerTags, peerServices, peerSRVRecords, peerTXTRecords, floatingIPs, peerQueues, and nextQueue
+	peerNames                 map[string]transport.NoisePublicKey
+	peerAddresses             map[transport.NoisePublicKey][]netip.Addr
+	peerPrefixes              map[transport.NoisePublicKey][]netip.Prefix
+	fromPeerAddress           *prefixTrie[transport.NoisePublicKey]
+	peerVia                   map[transport.NoisePublicKey]transport.NoisePublicKey // the intermediate peer through which a peer is reached
+	viaPrefixes               map[netip.Prefix]transport.NoisePublicKey             // the peer owning each prefix that is routed via another peer
+	rateLimiters              map[transport.NoisePublicKey]*rateLimiter
+	outboundRateLimiters      map[transport.NoisePublicKey]*rateLimiter
+	spoofedPackets            map[transport.NoisePublicKey]*atomic.Uint64 // inbound packets from addresses not routed to the peer
+	peerRejectedConnections   map[transport.NoisePublicKey]*atomic.Uint64 // connection attempts from the peer reset for exceeding the connection limits
+	peerMTUs                  map[transport.NoisePublicKey]int
+	globalRateLimiter         atomic.Pointer[rateLimiter]
+	globalOutboundRateLimiter atomic.Pointer[rateLimiter]
+	publicKey                 transport.NoisePublicKey
+	noEchoReply               atomic.Bool
+	clampMSS                  atomic.Bool
+	multicast                 atomic.Bool
+	forwarding                atomic.Bool
+	noMulticastPeers          map[transport.NoisePublicKey]struct{}
+	peerTags                  map[transport.NoisePublicKey][]string
+	peerServices              map[transport.NoisePublicKey][]string
+	peerSRVRecords            map[transport.NoisePublicKey][]Service
+	peerTXTRecords            map[transport.NoisePublicKey][]string
+	floatingIPs               map[netip.Prefix]transport.NoisePublicKey // the peer currently claiming each floating IP
+	peerQueues                map[transport.NoisePublicKey]int
+	nextQueue                 int
+	offload                   bool
+	hostForwarder             *hostForwarder
+	maxConnections            int           // the maximum number of TCP connections with peers, zero is unlimited
+	maxConnectionsPerPeer     int           // the maximum number of TCP connections with each peer, zero is unlimited
+	rejectedConnections       atomic.Uint64 // connection attempts reset for exceeding the connection limits
+	readDropped               atomic.Uint64 // outbound packets that couldn't be sent to a peer
+	writeDropped              atomic.Uint64 // inbound packets that were discarded
+	capturesMu                sync.Mutex    // serializes updates to captures
+	captures                  atomic.Pointer[[]*capture]
+	acl                       atomic.Pointer[acl]
+	listenerFilters           listenerFilters
+	ipConns                   ipConns
+	udpConns                  udpConns
+	udpFlowsMu                sync.Mutex // protects udpFlows
+	udpFlows                  map[udpFlow]time.Time
+	unknownDestination        atomic.Pointer[func(netip.Addr)]
+	probeIdent                uint16 // identifies our probes (path MTU and health checks)
+	probeSeq                  atomic.Uint32
+	probesMu                  sync.Mutex // protects probes
+	probes                    map[uint16]chan probeReply
+	queueSize                 int
+	batchSize                 int
+	addressConflicts          addressConflicts
+	addressTakenOver          func(prefix netip.Prefix, from, to transport.NoisePublicKey) // called with each prefix a peer takes over from another, if set
+	logger                    *slog.Logger
+	ctx                       context.Context // done once the sink is closing, waking blocked reads
+	cancel                    context.CancelFunc
+	closeMu                   sync.RWMutex // held for reading by writes, so that closing waits for them to drain
+	closeOnce                 sync.Once
+}
+
+// sourceSinkOptions are the options of a source sink, zero values mean the
+// default.
+type sourceSinkOptions struct {
+	// logger, if set, is used to log packets that are dropped, and routing
+	// decisions, at the debug level.
+	logger *slog.Logger
+	// mtu is the MTU of the stack's interface.
+	mtu int
+	// queueSize is the number of outbound packets the stack can queue, in each
+	// of its queues.
+	queueSize int
+	// queues is the number of outbound queues, each is read by its own reader.
+	queues int
+	// batchSize is the maximum number of packets read, or written, at once.
+	batchSize int
+	// stack adjusts the TCP behavior of the network stack.
+	stack stackOptions
+	// clock, if set, drives the network stack's timers (eg. TCP retransmission).
+	clock tcpip.Clock
+	// disableOffload disables segmentation, and receive, offload of TCP.
+	disableOffload bool
+	// classifier prioritizes outbound packets by traffic class, if set.
+	classifier *classifier
+	// addressConflicts is how prefixes that conflict with those of another
+	// peer are handled.
+	addressConflicts addressConflicts
+}
+
+// stackOptions are the TCP options of a source sink's network stack, zero
+// values mean the default.
+type stackOptions struct {
+	// sendBufferSize is the size of each connection's send buffer.
+	sendBufferSize int
+	// receiveBufferSize is the size each connection's receive buffer can grow to.
+	receiveBufferSize int
+	// congestionControl is the name of the congestion control algorithm.
+	congestionControl string
+	// disableSACK disables selective acknowledgements.
+	disableSACK bool
+	// maxEndpoints is the maximum number of open endpoints.
+	maxEndpoints int
+	// maxConnections is the maximum number of TCP connections with peers.
+	maxConnections int
+	// maxConnectionsPerPeer is the maximum number of TCP connections with
+	// each peer.
+	maxConnectionsPerPeer int
+	// memoryLimit is the budget for the buffers of endpoints.
+	memoryLimit int
+}
+
+// endpointLimit returns the maximum number of open endpoints, it is the
+// lesser of maxEndpoints and the number of endpoints whose buffers fit within
+// the memory limit. Zero means unlimited.
+func (opts *stackOptions) endpointLimit() int {
+	limit := opts.maxEndpoints
+	if opts.memoryLimit != 0 {
+		byMemory := opts.memoryLimit / opts.endpointMemory()
+		if limit == 0 || byMemory < limit {
+			limit = byMemory
+		}
+	}
+
+	return limit
+}
+
+// endpointMemory returns the most memory that the buffers of a single endpoint
+// can use, once the memory limit is applied.
+func (opts *stackOptions) endpointMemory() int {
+	sendBufferSize := opts.sendBufferSize
+	if sendBufferSize == 0 {
+		sendBufferSize = tcp.DefaultSendBufferSize
+	}
+
+	receiveBufferSize := opts.receiveBufferSize
+	if receiveBufferSize == 0 {
+		receiveBufferSize = tcp.MaxBufferSize
+	}
+
+	return sendBufferSize + receiveBufferSize
+}
+
+// apply sets the TCP protocol options of the stack, they apply to connections
+// created afterwards.
+func (opts *stackOptions) apply(s *stack.Stack) error {
+	sackEnabled := tcpip.TCPSACKEnabled(!opts.disableSACK)
+	if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, &sackEnabled); err != nil {
+		return fmt.Errorf("could not set sack: %v", err)
+	}
+
+	if opts.sendBufferSize != 0 || opts.memoryLimit != 0 {
+		sendBufferSize := tcpip.TCPSendBufferSizeRangeOption{
+			Min:     tcp.MinBufferSize,
+			Default: opts.sendBufferSize,
+			Max:     max(opts.sendBufferSize, tcp.MaxBufferSize),
+		}
+		if sendBufferSize.Default == 0 {
+			sendBufferSize.Default = tcp.DefaultSendBufferSize
+		}
+		// Within a memory budget, connections can't grow their send buffers.
+		if opts.memoryLimit != 0 {
+			sendBufferSize.Max = sendBufferSize.Default
+		}
+		if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, &sendBufferSize); err != nil {
+			return fmt.Errorf("could not set send buffer size: %v", err)
+		}
+	}
+
+	if opts.receiveBufferSize != 0 {
+		receiveBufferSize := tcpip.TCPReceiveBufferSizeRangeOption{
+			Min:     tcp.MinBufferSize,
+			Default: min(opts.receiveBufferSize, tcp.DefaultReceiveBufferSize),
+			Max:     opts.receiveBufferSize,
+		}
+		if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, &receiveBufferSize); err != nil {
+			return fmt.Errorf("could not set receive buffer size: %v", err)
+		}
+	}
+
+	if opts.congestionControl != "" {
+		congestionControl := tcpip.CongestionControlOption(opts.congestionControl)
+		if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, &congestionControl); err != nil {
+			return fmt.Errorf("could not set congestion control: %v", err)
+		}
+	}
+
+	return nil
 }
 
-func newSourceSink(localName string, publicKey transport.NoisePublicKey, localAddrs []netip.Addr, defaultGateway *transport.NoisePublicKey, defaultGatewayAddrs []netip.Addr, dnsServers []netip.Addr) (*sourceSink, *noisyNet, error) {
+func newSourceSink(localName string, publicKey transport.NoisePublicKey, localAddrs []netip.Addr, opts sourceSinkOptions) (*sourceSink, *noisyNet, error) {
+	if opts.mtu == 0 {
+		opts.mtu = transport.DefaultMTU
+	}
+
+	if opts.queueSize == 0 {
+		opts.queueSize = defaultQueueSize
+	}
+
+	if opts.batchSize == 0 {
+		opts.batchSize = conn.IdealBatchSize
+	}
+
+	if opts.queues == 0 {
+		opts.queues = 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
 	ss := &sourceSink{
 		stack: stack.New(stack.Options{
 			NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
-			TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, icmp.NewProtocol6},
+			TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4, icmp.NewProtocol6},
 			HandleLocal:        true,
+			Clock:              opts.clock,
 		}),
-		ep:              channel.New(queueSize, uint32(transport.DefaultMTU), ""),
-		incoming:        make(chan *stack.PacketBuffer),
-		peerNames:       make(map[string]transport.NoisePublicKey),
-		peerAddresses:   make(map[transport.NoisePublicKey][]netip.Addr),
-		fromPeerAddress: make(map[netip.Addr]transport.NoisePublicKey),
-		publicKey:       publicKey,
-		defaultGateway:  defaultGateway,
+		mtu:                     opts.mtu,
+		queueSize:               opts.queueSize,
+		batchSize:               opts.batchSize,
+		addressConflicts:        opts.addressConflicts,
+		maxConnections:          opts.stack.maxConnections,
+		maxConnectionsPerPeer:   opts.stack.maxConnectionsPerPeer,
+		logger:                  opts.logger,
+		localAddrs:              newLocalAddrSet(localAddrs),
+		offload:                 !opts.disableOffload,
+		peerNames:               make(map[string]transport.NoisePublicKey),
+		peerAddresses:           make(map[transport.NoisePublicKey][]netip.Addr),
+		peerPrefixes:            make(map[transport.NoisePublicKey][]netip.Prefix),
+		fromPeerAddress:         newPrefixTrie[transport.NoisePublicKey](),
+		peerVia:                 make(map[transport.NoisePublicKey]transport.NoisePublicKey),
+		viaPrefixes:             make(map[netip.Prefix]transport.NoisePublicKey),
+		rateLimiters:            make(map[transport.NoisePublicKey]*rateLimiter),
+		outboundRateLimiters:    make(map[transport.NoisePublicKey]*rateLimiter),
+		spoofedPackets:          make(map[transport.NoisePublicKey]*atomic.Uint64),
+		peerRejectedConnections: make(map[transport.NoisePublicKey]*atomic.Uint64),
+		peerMTUs:                make(map[transport.NoisePublicKey]int),
+		noMulticastPeers:        make(map[transport.NoisePublicKey]struct{}),
+		peerTags:                make(map[transport.NoisePublicKey][]string),
+		peerServices:            make(map[transport.NoisePublicKey][]string),
+		peerSRVRecords:          make(map[transport.NoisePublicKey][]Service),
+		peerTXTRecords:          make(map[transport.NoisePublicKey][]string),
+		floatingIPs:             make(map[netip.Prefix]transport.NoisePublicKey),
+		peerQueues:              make(map[transport.NoisePublicKey]int),
+		publicKey:               publicKey,
+		udpFlows:                make(map[udpFlow]time.Time),
+		probeIdent:              uint16(rand.Uint32()),
+		probes:                  make(map[uint16]chan probeReply),
+		ctx:                     ctx,
+		cancel:                  cancel,
+	}
+
+	ss.nic = newOutboundQueues(opts.queues, opts.queueSize, opts.mtu, ss.queueFor, opts.classifier)
+	ss.ep = ss.nic.Endpoint
+
+	if err := opts.stack.apply(ss.stack); err != nil {
+		return nil, nil, err
 	}
 
-	ss.ep.AddNotify(ss)
+	// The stack's TCP builds super-packets, that are segmented in readPacket.
+	if ss.offload {
+		ss.ep.SupportedGSOKind = stack.HostGSOSupported
+	}
 
-	if err := ss.stack.CreateNIC(1, ss.ep); err != nil {
+	if err := ss.stack.CreateNIC(1, ss.nic); err != nil {
 		return nil, nil, fmt.Errorf("could not create NIC: %v", err)
 	}
 
-	var hasV4, hasV6 bool
 	for _, addr := range localAddrs {
-		var protoNumber tcpip.NetworkProtocolNumber
-		if addr.Is4() {
-			protoNumber = ipv4.ProtocolNumber
-		} else if addr.Is6() {
-			protoNumber = ipv6.ProtocolNumber
+		if err := ss.stack.AddProtocolAddress(1, localProtocolAddress(addr), stack.AddressProperties{}); err != nil {
+			return nil, nil, fmt.Errorf("could not add protocol address: %v", err)
 		}
+	}
+
+	n := &noisyNet{
+		stack:                   ss.stack,
+		ep:                      ss.nic,
+		peersMu:                 &ss.peersMu,
+		localName:               localName,
+		localAddrs:              ss.localAddrs,
+		peerNames:               ss.peerNames,
+		peerAddresses:           ss.peerAddresses,
+		peerServices:            ss.peerServices,
+		peerSRVRecords:          ss.peerSRVRecords,
+		peerTXTRecords:          ss.peerTXTRecords,
+		fromPeerAddress:         ss.fromPeerAddress,
+		rateLimiters:            ss.rateLimiters,
+		outboundRateLimiters:    ss.outboundRateLimiters,
+		spoofedPackets:          ss.spoofedPackets,
+		peerRejectedConnections: ss.peerRejectedConnections,
+		rejectedConnections:     &ss.rejectedConnections,
+		acl:                     &ss.acl,
+		unknownDestination:      &ss.unknownDestination,
+		listenerFilters:         &ss.listenerFilters,
+		ipConns:                 &ss.ipConns,
+		udpConns:                &ss.udpConns,
+		queueOutbound:           ss.queueOutbound,
+		maxEndpoints:            opts.stack.endpointLimit(),
+	}
+
+	return ss, n, nil
+}
+
+// AddPeer adds a peer with the given name and allowed prefixes. Packets
+// destined for any address within one of the prefixes will be routed to the
+// peer, the most specific prefix wins if prefixes of multiple peers overlap.
+func (ss *sourceSink) AddPeer(name string, publicKey transport.NoisePublicKey, prefixes []netip.Prefix) error {
+	return ss.AddPeerVia(name, publicKey, nil, prefixes)
+}
+
+// AddPeerVia is like AddPeer, but if via is set, packets destined for the
+// peer's prefixes are routed to the intermediate peer with that public key
+// (which forwards them on), and packets from the peer's addresses are accepted
+// from it. The intermediate peer must be reached directly.
+func (ss *sourceSink) AddPeerVia(name string, publicKey transport.NoisePublicKey, via *transport.NoisePublicKey, prefixes []netip.Prefix) error {
+	ss.peersMu.Lock()
+
+	if err := ss.validatePeerLocked(name, publicKey, via, prefixes); err != nil {
+		ss.peersMu.Unlock()
+		return err
+	}
+
+	takenOver := ss.addPeerLocked(name, publicKey, via, prefixes)
+	ss.peersMu.Unlock()
+
+	ss.notifyTakenOver(publicKey, takenOver)
+
+	return nil
+}
+
+// RemovePeer removes a peer and all of its prefixes.
+func (ss *sourceSink) RemovePeer(publicKey transport.NoisePublicKey) {
+	ss.peersMu.Lock()
+	defer ss.peersMu.Unlock()
+
+	// Tags are forgotten first, so that the acl is re-indexed without them.
+	delete(ss.peerTags, publicKey)
+	ss.removePeerLocked(publicKey)
+	delete(ss.rateLimiters, publicKey)
+	delete(ss.outboundRateLimiters, publicKey)
+	delete(ss.spoofedPackets, publicKey)
+	delete(ss.peerRejectedConnections, publicKey)
+	delete(ss.peerMTUs, publicKey)
+	delete(ss.noMulticastPeers, publicKey)
+	delete(ss.peerServices, publicKey)
+	delete(ss.peerSRVRecords, publicKey)
+	delete(ss.peerTXTRecords, publicKey)
+	delete(ss.peerQueues, publicKey)
+}
+
+// UpdatePeer atomically replaces the name and prefixes of an existing peer.
+func (ss *sourceSink) UpdatePeer(name string, publicKey transport.NoisePublicKey, prefixes []netip.Prefix) error {
+	return ss.UpdatePeerVia(name, publicKey, nil, prefixes)
+}
+
+// UpdatePeerVia is like UpdatePeer, but also replaces the intermediate peer
+// through which the peer is reached (see AddPeerVia).
+func (ss *sourceSink) UpdatePeerVia(name string, publicKey transport.NoisePublicKey, via *transport.NoisePublicKey, prefixes []netip.Prefix) error {
+	ss.peersMu.Lock()
+
+	if err := ss.validatePeerLocked(name, publicKey, via, prefixes); err != nil {
+		ss.peersMu.Unlock()
+		return err
+	}
 
-		protoAddr := tcpip.ProtocolAddress{
-			Protocol:          protoNumber,
-			AddressWithPrefix: tcpip.AddrFromSlice(addr.AsSlice()).WithPrefix(),
+	ss.removePeerLocked(publicKey)
+	takenOver := ss.addPeerLocked(name, publicKey, via, prefixes)
+	ss.peersMu.Unlock()
+
+	ss.notifyTakenOver(publicKey, takenOver)
+
+	return nil
+}
+
+// notifyTakenOver reports the prefixes a peer has taken over from other peers.
+func (ss *sourceSink) notifyTakenOver(publicKey transport.NoisePublicKey, takenOver map[netip.Prefix]transport.NoisePublicKey) {
+	if ss.addressTakenOver == nil {
+		return
+	}
+
+	for prefix, from := range takenOver {
+		ss.addressTakenOver(prefix, from, publicKey)
+	}
+}
+
+// SetPeerRateLimit limits the rate of inbound traffic from a peer. Packets
+// exceeding the limit are dropped. A zero limit means unlimited.
+func (ss *sourceSink) SetPeerRateLimit(publicKey transport.NoisePublicKey, packetsPerSecond, bytesPerSecond uint64) {
+	ss.peersMu.Lock()
+	defer ss.peersMu.Unlock()
+
+	setRateLimitLocked(ss.rateLimiters, publicKey, packetsPerSecond, bytesPerSecond)
+}
+
+// SetPeerOutboundRateLimit limits the rate of outbound traffic to a peer.
+// Packets exceeding the limit are dropped. A zero limit means unlimited.
+func (ss *sourceSink) SetPeerOutboundRateLimit(publicKey transport.NoisePublicKey, packetsPerSecond, bytesPerSecond uint64) {
+	ss.peersMu.Lock()
+	defer ss.peersMu.Unlock()
+
+	setRateLimitLocked(ss.outboundRateLimiters, publicKey, packetsPerSecond, bytesPerSecond)
+}
+
+// SetGlobalRateLimit limits the combined rate of inbound traffic from all
+// peers, it is applied after any per peer limits. A zero limit means unlimited.
+func (ss *sourceSink) SetGlobalRateLimit(packetsPerSecond, bytesPerSecond uint64) {
+	setGlobalRateLimit(&ss.globalRateLimiter, packetsPerSecond, bytesPerSecond)
+}
+
+// SetGlobalOutboundRateLimit limits the combined rate of outbound traffic to
+// all peers, it is applied after any per peer limits. A zero limit means unlimited.
+func (ss *sourceSink) SetGlobalOutboundRateLimit(packetsPerSecond, bytesPerSecond uint64) {
+	setGlobalRateLimit(&ss.globalOutboundRateLimiter, packetsPerSecond, bytesPerSecond)
+}
+
+// Must hold ss.peersMu.
+func (ss *sourceSink) validatePeerLocked(name string, publicKey transport.NoisePublicKey, via *transport.NoisePublicKey, prefixes []netip.Prefix) error {
+	if via != nil {
+		if *via == publicKey {
+			return fmt.Errorf("peer %s can't be reached via itself", ss.peerDisplayName(name, publicKey))
 		}
 
-		if err := ss.stack.AddProtocolAddress(1, protoAddr, stack.AddressProperties{}); err != nil {
-			return nil, nil, fmt.Errorf("could not add protocol address: %v", err)
+		if _, ok := ss.peerAddresses[*via]; !ok {
+			return fmt.Errorf("peer %s is reached via unknown peer %s", ss.peerDisplayName(name, publicKey), via)
+		}
+
+		// Only a single intermediate hop is routed, the intermediate peer
+		// routes any further hops itself.
+		if _, ok := ss.peerVia[*via]; ok {
+			return fmt.Errorf("peer %s is reached via peer %s, which is itself reached via another peer",
+				ss.peerDisplayName(name, publicKey), ss.peerDisplayName("", *via))
 		}
-		if addr.Is4() {
-			hasV4 = true
-		} else if addr.Is6() {
-			hasV6 = true
+
+		for routedPeer, routedVia := range ss.peerVia {
+			if routedVia == publicKey && routedPeer != publicKey {
+				return fmt.Errorf("peer %s can't be reached via another peer, as peer %s is reached via it",
+					ss.peerDisplayName(name, publicKey), ss.peerDisplayName("", routedPeer))
+			}
 		}
 	}
-	if hasV4 {
-		var gatewayV4 tcpip.Address
-		if defaultGateway != nil {
-			for _, addr := range defaultGatewayAddrs {
-				if addr.Is4() {
-					gatewayV4 = tcpip.AddrFromSlice(addr.AsSlice())
-					break
+
+	for _, prefix := range prefixes {
+		// Local addresses always take precedence over routes, so only a peer
+		// address that exactly matches a local address is ambiguous.
+		if prefix.IsSingleIP() {
+			for _, localAddr := range ss.localAddrs.load() {
+				if prefix.Addr() == localAddr {
+					return fmt.Errorf("peer %s address %s collides with a local address", ss.peerDisplayName(name, publicKey), prefix)
 				}
 			}
 		}
 
-		ss.stack.AddRoute(tcpip.Route{
-			Destination: header.IPv4EmptySubnet,
-			NIC:         1,
-			Gateway:     gatewayV4,
-		})
+		if _, ok := ss.floatingIPs[prefix.Masked()]; ok {
+			return fmt.Errorf("peer %s address %s collides with a floating IP", ss.peerDisplayName(name, publicKey), prefix)
+		}
+
+		if ss.addressConflicts == addressConflictsStrict {
+			if err := ss.checkOverlapLocked(name, publicKey, prefix); err != nil {
+				return err
+			}
+		}
+
+		existingPublicKey, ok := ss.prefixOwner(prefix)
+		if ok && existingPublicKey != publicKey && ss.addressConflicts != addressConflictsReplace {
+			return fmt.Errorf("peer %s address %s is already claimed by peer %s",
+				ss.peerDisplayName(name, publicKey), prefix, ss.peerDisplayName("", existingPublicKey))
+		}
+	}
+
+	return nil
+}
+
+// addPeerLocked adds a validated peer, it returns the prefixes taken over
+// from other peers, and their previous owners.
+// Must hold ss.peersMu.
+func (ss *sourceSink) addPeerLocked(name string, publicKey transport.NoisePublicKey, via *transport.NoisePublicKey, prefixes []netip.Prefix) map[netip.Prefix]transport.NoisePublicKey {
+	if name != "" {
+		ss.peerNames[name] = publicKey
+	}
+
+	// Make sure the peer is known even if it only routes subnets.
+	if _, ok := ss.peerAddresses[publicKey]; !ok {
+		ss.peerAddresses[publicKey] = nil
+	}
+
+	if _, ok := ss.spoofedPackets[publicKey]; !ok {
+		ss.spoofedPackets[publicKey] = new(atomic.Uint64)
+	}
+
+	if _, ok := ss.peerRejectedConnections[publicKey]; !ok {
+		ss.peerRejectedConnections[publicKey] = new(atomic.Uint64)
 	}
-	if hasV6 {
-		var gatewayV6 tcpip.Address
-		if defaultGateway != nil {
-			for _, addr := range defaultGatewayAddrs {
-				if addr.Is6() {
-					gatewayV6 = tcpip.AddrFromSlice(addr.AsSlice())
-					break
+
+	ss.assignQueueLocked(publicKey)
+
+	// Packets are routed to the peer, or to the peer it is reached via.
+	nextHop := publicKey
+	if via != nil {
+		nextHop = *via
+		ss.peerVia[publicKey] = *via
+	}
+
+	var takenOver map[netip.Prefix]transport.NoisePublicKey
+	for _, prefix := range prefixes {
+		prefix = prefix.Masked()
+		if ss.addressConflicts == addressConflictsReplace {
+			if owner, ok := ss.takeOverPrefixLocked(publicKey, prefix); ok {
+				if takenOver == nil {
+					takenOver = make(map[netip.Prefix]transport.NoisePublicKey)
 				}
+				takenOver[prefix] = owner
 			}
 		}
 
+		if _, ok := ss.fromPeerAddress.Get(prefix); ok {
+			continue
+		}
+
+		// Only single addresses are resolvable from the peer's name.
+		if prefix.IsSingleIP() {
+			ss.peerAddresses[publicKey] = append(ss.peerAddresses[publicKey], prefix.Addr())
+		}
+
+		ss.peerPrefixes[publicKey] = append(ss.peerPrefixes[publicKey], prefix)
+		ss.fromPeerAddress.Insert(prefix, nextHop)
+		if via != nil {
+			ss.viaPrefixes[prefix] = publicKey
+		}
+
+		// Routes are installed for each peer prefix, including the catch-all
+		// prefixes of a default gateway.
 		ss.stack.AddRoute(tcpip.Route{
-			Destination: header.IPv6EmptySubnet,
+			Destination: prefixToSubnet(prefix),
 			NIC:         1,
-			Gateway:     gatewayV6,
 		})
 	}
 
-	n := &noisyNet{
-		stack:         ss.stack,
-		localName:     localName,
-		localAddrs:    localAddrs,
-		peerNames:     ss.peerNames,
-		peerAddresses: ss.peerAddresses,
-		dnsServers:    dnsServers,
+	ss.resolveACLLocked()
+
+	return takenOver
+}
+
+// PeerPrefixes returns the prefixes routed to a peer.
+func (ss *sourceSink) PeerPrefixes(publicKey transport.NoisePublicKey) []netip.Prefix {
+	ss.peersMu.RLock()
+	defer ss.peersMu.RUnlock()
+
+	return slices.Clone(ss.peerPrefixes[publicKey])
+}
+
+// Must hold ss.peersMu.
+func (ss *sourceSink) removePeerLocked(publicKey transport.NoisePublicKey) {
+	for name, pk := range ss.peerNames {
+		if pk == publicKey {
+			delete(ss.peerNames, name)
+		}
 	}
 
-	return ss, n, nil
+	for _, prefix := range ss.peerPrefixes[publicKey] {
+		ss.fromPeerAddress.Delete(prefix)
+		delete(ss.viaPrefixes, prefix)
+
+		// The catch-all routes are still needed to catch unknown destinations.
+		if prefix.Bits() == 0 && ss.unknownDestination.Load() != nil {
+			continue
+		}
+
+		subnet := prefixToSubnet(prefix)
+		ss.stack.RemoveRoutes(func(r tcpip.Route) bool {
+			return r.Destination == subnet && r.Gateway.Len() == 0
+		})
+	}
+
+	delete(ss.peerAddresses, publicKey)
+	delete(ss.peerPrefixes, publicKey)
+	delete(ss.peerVia, publicKey)
+
+	ss.resolveACLLocked()
 }
 
-func (ss *sourceSink) AddPeer(name string, publicKey transport.NoisePublicKey, addrs []netip.Addr) {
-	if name != "" {
-		ss.peerNames[name] = publicKey
+// SetForwarding controls whether the stack will forward packets between peers,
+// turning this node into a router for any prefixes it has been assigned by them.
+func (ss *sourceSink) SetForwarding(enabled bool) error {
+	for _, protoNumber := range []tcpip.NetworkProtocolNumber{ipv4.ProtocolNumber, ipv6.ProtocolNumber} {
+		if err := ss.stack.SetForwardingDefaultAndAllNICs(protoNumber, enabled); err != nil {
+			return fmt.Errorf("could not set forwarding: %v", err)
+		}
+	}
+
+	ss.forwarding.Store(enabled)
+
+	return nil
+}
+
+// EnableHostForwarding forwards TCP and UDP traffic from peers, that is not
+// destined for this node or another peer, to the host's network.
+func (ss *sourceSink) EnableHostForwarding(logger *slog.Logger) error {
+	if ss.hostForwarder != nil {
+		return nil
 	}
 
-	for _, addr := range addrs {
-		ss.peerAddresses[publicKey] = append(ss.peerAddresses[publicKey], addr)
-		ss.fromPeerAddress[addr] = publicKey
+	var err error
+	ss.hostForwarder, err = newHostForwarder(logger, ss.mtu, ss.queueSize, ss.batchSize, ss.deliverFromHost)
+	if err != nil {
+		return fmt.Errorf("could not create host forwarder: %w", err)
+	}
+
+	return nil
+}
+
+// SetUnknownDestinationHandler sets a function that is called (synchronously,
+// so it must not block) with the destination address of any outbound packet
+// that doesn't belong to a peer, the packet itself is dropped. Catch-all routes
+// are installed so that such packets reach the sink. A nil handler restores
+// the default behavior.
+func (ss *sourceSink) SetUnknownDestinationHandler(handler func(netip.Addr)) {
+	ss.peersMu.Lock()
+	defer ss.peersMu.Unlock()
+
+	hadHandler := ss.unknownDestination.Load() != nil
+	if handler != nil {
+		ss.unknownDestination.Store(&handler)
+	} else {
+		ss.unknownDestination.Store(nil)
+	}
+
+	for _, prefix := range defaultRoutePrefixes {
+		// A default gateway peer has its own catch-all routes.
+		if _, ok := ss.fromPeerAddress.Get(prefix); ok {
+			continue
+		}
+
+		subnet := prefixToSubnet(prefix)
+		if handler != nil && !hadHandler {
+			ss.stack.AddRoute(tcpip.Route{
+				Destination: subnet,
+				NIC:         1,
+			})
+		} else if handler == nil && hadHandler {
+			ss.stack.RemoveRoutes(func(r tcpip.Route) bool {
+				return r.Destination == subnet && r.Gateway.Len() == 0
+			})
+		}
 	}
 }
 
+// SetEchoReply controls whether the stack will respond to ICMP echo requests (pings).
+func (ss *sourceSink) SetEchoReply(enabled bool) {
+	ss.noEchoReply.Store(!enabled)
+}
+
+// peerDisplayName returns a human readable identifier for a peer, for use in error messages.
+// Must hold ss.peersMu.
+func (ss *sourceSink) peerDisplayName(name string, publicKey transport.NoisePublicKey) string {
+	if name == "" {
+		for peerName, pk := range ss.peerNames {
+			if pk == publicKey {
+				name = peerName
+				break
+			}
+		}
+	}
+
+	if name != "" {
+		return fmt.Sprintf("%q (%s)", name, publicKey)
+	}
+
+	return publicKey.String()
+}
+
+// Close closes the sink, and its network stack. Blocked reads are woken, and
+// return net.ErrClosed (as do later reads and writes), while in-flight writes
+// are allowed to finish first. It is safe to call concurrently, and more than
+// once.
 func (ss *sourceSink) Close() error {
-	ss.stack.RemoveNIC(1)
-	ss.stack.Close()
-	ss.ep.Close()
-	close(ss.incoming)
+	ss.closeOnce.Do(func() {
+		ss.cancel()
+
+		// Wait for in-flight writes to the stack.
+		ss.closeMu.Lock()
+		defer ss.closeMu.Unlock()
+
+		ss.ipConns.closeAll()
+
+		if ss.hostForwarder != nil {
+			_ = ss.hostForwarder.Close()
+		}
+
+		ss.stack.RemoveNIC(1)
+		ss.stack.Close()
+		ss.nic.Close()
+	})
 
 	return nil
 }
 
+// Read reads outbound packets from the first queue (see ReadQueue).
 func (ss *sourceSink) Read(bufs [][]byte, sizes []int, destinations []transport.NoisePublicKey, offset int) (int, error) {
-	packetFn := func(idx int, pkt *stack.PacketBuffer) error {
-		defer pkt.DecRef()
-
-		// Extract the destination IP address from the packet
-		var peerAddr netip.Addr
-		switch pkt.NetworkProtocolNumber {
-		case header.IPv4ProtocolNumber:
-			hdr := header.IPv4(pkt.NetworkHeader().View().AsSlice())
-			if !hdr.IsValid(pkt.Size()) {
-				return fmt.Errorf("invalid IPv4 header")
-			}
+	return ss.ReadBatch(bufs, sizes, destinations, offset, 0)
+}
 
-			peerAddr = netip.AddrFrom4(hdr.DestinationAddress().As4())
-		case header.IPv6ProtocolNumber:
-			hdr := header.IPv6(pkt.NetworkHeader().View().AsSlice())
-			if !hdr.IsValid(pkt.Size()) {
-				return fmt.Errorf("invalid IPv6 header")
+// ReadBatch is like Read, but once the first packet has arrived it will linger
+// for up to the given duration waiting for more packets to fill the batch.
+// It returns early if the batch fills or the sink is closed. A zero linger
+// returns as soon as no more packets are immediately available. Like Read, it
+// only reads from the first queue.
+func (ss *sourceSink) ReadBatch(bufs [][]byte, sizes []int, destinations []transport.NoisePublicKey, offset int, linger time.Duration) (int, error) {
+	return ss.readQueue(ss.nic.queues[0], bufs, sizes, destinations, offset, linger)
+}
+
+// readQueue is like ReadBatch, but reads from the given queue.
+func (ss *sourceSink) readQueue(q *outboundQueue, bufs [][]byte, sizes []int, destinations []transport.NoisePublicKey, offset int, linger time.Duration) (int, error) {
+	// Always block until we have at least one packet, packets are read straight
+	// from the stack's queue so that the rest of the batch can be filled
+	// without waiting for the stack to hand over each packet.
+	var count int
+	for count == 0 {
+		if q.segmenter.pending() {
+			sent, err := ss.readSegment(q, bufs[count], &sizes[count], &destinations[count], offset)
+			if err != nil {
+				ss.dropInvalidOutbound(err)
+			} else if sent {
+				count++
 			}
+			continue
+		}
+
+		if q.fanout != nil {
+			count += ss.readFanout(q, bufs, sizes, destinations, offset)
+			continue
+		}
 
-			peerAddr = netip.AddrFrom16(hdr.DestinationAddress().As16())
-		default:
-			return fmt.Errorf("unknown network protocol")
+		pkt := q.read(ss.ctx, ss.nic.closed)
+		if pkt.IsNil() {
+			return 0, net.ErrClosed
 		}
 
-		var ok bool
-		destinations[idx], ok = ss.fromPeerAddress[peerAddr]
-		if !ok {
-			if ss.defaultGateway == nil {
-				return fmt.Errorf("unknown destination address")
+		sent, err := ss.readPacket(q, pkt, bufs[count], &sizes[count], &destinations[count], offset)
+		if err != nil {
+			ss.dropInvalidOutbound(err)
+			continue
+		}
+
+		if sent {
+			count++
+		}
+	}
+
+	ctx := ss.ctx
+	if linger > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, linger)
+		defer cancel()
+	}
+
+	for count < len(bufs) {
+		if q.segmenter.pending() {
+			sent, err := ss.readSegment(q, bufs[count], &sizes[count], &destinations[count], offset)
+			if err != nil {
+				ss.dropInvalidOutbound(err)
+			} else if sent {
+				count++
 			}
+			continue
+		}
+
+		if q.fanout != nil {
+			count += ss.readFanout(q, bufs[count:], sizes[count:], destinations[count:], offset)
+			continue
+		}
 
-			destinations[idx] = *ss.defaultGateway
+		var pkt *stack.PacketBuffer
+		if linger > 0 {
+			pkt = q.read(ctx, ss.nic.closed)
+		} else {
+			pkt = q.tryRead()
+		}
+		// Either the queue is empty (or we have lingered long enough), or the
+		// sink has been closed, which the next read will report.
+		if pkt.IsNil() {
+			return count, nil
 		}
 
-		view := pkt.ToView()
-		n, err := view.Read(bufs[idx][offset:])
-		view.Release()
+		sent, err := ss.readPacket(q, pkt, bufs[count], &sizes[count], &destinations[count], offset)
 		if err != nil {
-			return fmt.Errorf("could not read packet: %w", err)
+			ss.dropInvalidOutbound(err)
+			continue
+		}
+
+		if sent {
+			count++
 		}
+	}
 
-		sizes[idx] = n
+	return count, nil
+}
 
-		return nil
+// dropInvalidOutbound records an outbound packet that was dropped because it
+// couldn't be sent to a peer. A single bad packet (eg. a malformed header, or
+// an unroutable destination) shouldn't abort the rest of the batch, as the
+// transport treats any read error as fatal.
+func (ss *sourceSink) dropInvalidOutbound(err error) {
+	ss.readDropped.Add(1)
+
+	if ss.logger != nil {
+		ss.logger.Debug("Dropping invalid outbound packet", "error", err)
 	}
+}
 
-	// Always block until we have at least one packet.
-	var count int
-	pkt, ok := <-ss.incoming
+// logDropped logs a packet that was dropped. Drops are expected (eg. when rate
+// limited), so they are only logged at the debug level.
+func (ss *sourceSink) logDropped(msg string, args ...any) {
+	if ss.logger != nil {
+		ss.logger.Debug(msg, args...)
+	}
+}
+
+// outboundDestination returns the destination address of a packet sent by the
+// stack, hdr is its network header, and size the size of the whole packet.
+func outboundDestination(protoNumber tcpip.NetworkProtocolNumber, hdr []byte, size int) (netip.Addr, error) {
+	switch protoNumber {
+	case header.IPv4ProtocolNumber:
+		ipHdr := header.IPv4(hdr)
+		if !ipHdr.IsValid(size) {
+			return netip.Addr{}, fmt.Errorf("invalid IPv4 header")
+		}
+
+		return netip.AddrFrom4(ipHdr.DestinationAddress().As4()), nil
+	case header.IPv6ProtocolNumber:
+		ipHdr := header.IPv6(hdr)
+		if !ipHdr.IsValid(size) {
+			return netip.Addr{}, fmt.Errorf("invalid IPv6 header")
+		}
+
+		return netip.AddrFrom16(ipHdr.DestinationAddress().As16()), nil
+	default:
+		return netip.Addr{}, fmt.Errorf("unknown network protocol")
+	}
+}
+
+func (ss *sourceSink) readPacket(q *outboundQueue, pkt *stack.PacketBuffer, buf []byte, size *int, destination *transport.NoisePublicKey, offset int) (bool, error) {
+	defer pkt.DecRef()
+
+	peerAddr, err := outboundDestination(pkt.NetworkProtocolNumber, pkt.NetworkHeader().View().AsSlice(), pkt.Size())
+	if err != nil {
+		return false, err
+	}
+
+	// Broadcast and multicast packets are sent to every peer, rather than routed.
+	if ss.multicast.Load() && isGroupAddress(peerAddr) {
+		if !isGroupManagementPacket(pkt.NetworkProtocolNumber, pkt.NetworkHeader().View().AsSlice()) {
+			ss.queueFanout(q, pkt)
+		}
+
+		return false, nil
+	}
+
+	// Super-packets are sent a segment at a time, by readSegment.
+	if isSuperPacket(pkt) {
+		if !q.segmenter.reset(pkt, peerAddr) {
+			return false, fmt.Errorf("could not segment packet")
+		}
+
+		return false, nil
+	}
+
+	// Copy straight out of the packet's views, rather than flattening it first.
+	data := pkt.ToBuffer()
+	n, err := data.ReadAt(buf[offset:], 0)
+	data.Release()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false, fmt.Errorf("could not read packet: %w", err)
+	}
+
+	return ss.sendOutbound(pkt.NetworkProtocolNumber, peerAddr, buf, size, destination, offset, n)
+}
+
+// readSegment is like readPacket, but for the next segment of the super-packet
+// being split by the segmenter.
+func (ss *sourceSink) readSegment(q *outboundQueue, buf []byte, size *int, destination *transport.NoisePublicKey, offset int) (bool, error) {
+	n := q.segmenter.next(buf[offset:])
+	return ss.sendOutbound(q.segmenter.protoNumber, q.segmenter.peerAddr, buf, size, destination, offset, n)
+}
+
+// sendOutbound decides whether an outbound packet, of n bytes at offset in buf,
+// is sent to the peer that peerAddr belongs to. Packets that are sent may have
+// been modified (eg. to clamp their MSS).
+func (ss *sourceSink) sendOutbound(protoNumber tcpip.NetworkProtocolNumber, peerAddr netip.Addr, buf []byte, size *int, destination *transport.NoisePublicKey, offset, n int) (bool, error) {
+	var ok bool
+	ss.peersMu.RLock()
+	*destination, ok = ss.fromPeerAddress.Lookup(peerAddr)
+	limiter := ss.outboundRateLimiters[*destination]
+	mtu := ss.peerMTUs[*destination]
+	ss.peersMu.RUnlock()
 	if !ok {
-		return 0, net.ErrClosed
+		if handler := ss.unknownDestination.Load(); handler != nil {
+			(*handler)(peerAddr)
+			ss.readDropped.Add(1)
+			ss.logDropped("Dropping outbound packet while resolving unknown destination", "destination", peerAddr)
+			return false, nil
+		}
+
+		return false, fmt.Errorf("%w: unknown destination address %s", ErrNoRouteToPeer, peerAddr)
 	}
 
-	if err := packetFn(count, pkt); err != nil {
-		return count, err
+	// Packets exceeding the outbound rate limits are dropped, the peer's own
+	// limit is applied first so that its excess traffic doesn't consume the
+	// global limit.
+	if (limiter != nil && !limiter.allow(n)) || !allowGlobal(&ss.globalOutboundRateLimiter, n) {
+		ss.readDropped.Add(1)
+		ss.logDropped("Dropping outbound packet exceeding rate limit", "peer", *destination)
+		return false, nil
 	}
 
-	count++
+	pkt := buf[offset : offset+n]
 
-	for count < len(bufs) {
-		select {
-		case pkt, ok := <-ss.incoming:
-			if !ok {
-				return count, net.ErrClosed
-			}
+	// Packets too large for the path to the peer are rejected, so that the
+	// sender can reduce the size of its packets.
+	if mtu > 0 && n > mtu && !ss.isProbe(protoNumber, pkt) && ss.packetTooBig(protoNumber, pkt, mtu) {
+		ss.readDropped.Add(1)
+		ss.logDropped("Dropping outbound packet exceeding path MTU", "peer", *destination, "size", n, "mtu", mtu)
+		return false, nil
+	}
 
-			if err := packetFn(count, pkt); err != nil {
-				return count, err
-			}
+	if ss.clampMSS.Load() {
+		pathMTU := ss.mtu
+		if mtu > 0 {
+			pathMTU = mtu
+		}
 
-			count++
-		default:
-			return count, nil
+		clampMSS(protoNumber, pkt, maxMSS(protoNumber, pathMTU))
+	}
+
+	*size = n
+
+	if ss.acl.Load() != nil {
+		ss.trackOutbound(*destination, protoNumber, pkt)
+	}
+
+	ss.capturePacket(CaptureOutbound, *destination, pkt)
+
+	return true, nil
+}
+
+// errTruncatedPacket is returned for packets too short to hold an IP header.
+var errTruncatedPacket = errors.New("truncated header")
+
+// inboundProtocol returns the network protocol of a packet received from a
+// peer. Packets must have a complete, and self consistent, IPv4 or IPv6 header
+// (the stack can't reassemble fragments it can't parse), so that the rest of
+// the inbound path can rely on the lengths the header claims.
+func inboundProtocol(pkt []byte) (tcpip.NetworkProtocolNumber, error) {
+	if len(pkt) == 0 {
+		return 0, fmt.Errorf("empty packet")
+	}
+
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < header.IPv4MinimumSize {
+			return 0, fmt.Errorf("%w: IPv4", errTruncatedPacket)
+		}
+
+		if !header.IPv4(pkt).IsValid(len(pkt)) {
+			return 0, fmt.Errorf("invalid IPv4 header")
+		}
+
+		return header.IPv4ProtocolNumber, nil
+	case 6:
+		if len(pkt) < header.IPv6MinimumSize {
+			return 0, fmt.Errorf("%w: IPv6", errTruncatedPacket)
+		}
+
+		if !header.IPv6(pkt).IsValid(len(pkt)) {
+			return 0, fmt.Errorf("invalid IPv6 header")
+		}
+
+		return header.IPv6ProtocolNumber, nil
+	default:
+		return 0, fmt.Errorf("unsupported IP version %d", pkt[0]>>4)
+	}
+}
+
+// inboundSource returns the source address of a packet, whose header has been
+// validated by inboundProtocol.
+func inboundSource(protoNumber tcpip.NetworkProtocolNumber, pkt []byte) netip.Addr {
+	if protoNumber == header.IPv4ProtocolNumber {
+		return netip.AddrFrom4(header.IPv4(pkt).SourceAddress().As4())
+	}
+
+	return netip.AddrFrom16(header.IPv6(pkt).SourceAddress().As16())
+}
+
+// allowSource reports whether a peer is allowed to send a packet, ie. its
+// source address is routed to the peer (cryptokey routing). So that a peer
+// can't impersonate other peers, or the local node.
+func (ss *sourceSink) allowSource(batch *inboundBatch, publicKey transport.NoisePublicKey, protoNumber tcpip.NetworkProtocolNumber, pkt []byte) bool {
+	src := inboundSource(protoNumber, pkt).Unmap()
+
+	// Consecutive packets from a peer usually share the same source address.
+	if src == batch.allowedSource {
+		return true
+	}
+
+	for _, localAddr := range ss.localAddrs.load() {
+		if src == localAddr.Unmap() {
+			return false
 		}
 	}
 
-	return count, nil
+	ss.peersMu.RLock()
+	owner, ok := ss.fromPeerAddress.Lookup(src)
+	ss.peersMu.RUnlock()
+	if !ok || owner != publicKey {
+		return false
+	}
+
+	batch.allowedSource = src
+	return true
 }
 
-func (ss *sourceSink) Write(bufs [][]byte, _ []transport.NoisePublicKey, offset int) (int, error) {
-	for _, buf := range bufs {
+func (ss *sourceSink) Write(bufs [][]byte, sources []transport.NoisePublicKey, offset int) (int, error) {
+	ss.closeMu.RLock()
+	defer ss.closeMu.RUnlock()
+
+	if ss.ctx.Err() != nil {
+		return 0, net.ErrClosed
+	}
+
+	batch := ss.newInboundBatch()
+
+	for i, buf := range bufs {
 		if len(buf) <= offset {
 			continue
 		}
 
-		pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(buf[offset:])})
-		switch buf[offset] >> 4 {
-		case 4:
-			ss.ep.InjectInbound(header.IPv4ProtocolNumber, pkt)
-		case 6:
-			ss.ep.InjectInbound(header.IPv6ProtocolNumber, pkt)
-		default:
-			return 0, syscall.EAFNOSUPPORT
+		protoNumber, ok := ss.filterInbound(&batch, sources, i, buf[offset:])
+		if !ok {
+			continue
 		}
+
+		ss.deliverInbound(&batch, protoNumber, buffer.NewViewWithData(buf[offset:]))
 	}
 
+	batch.flush(ss)
+
 	return len(bufs), nil
 }
 
+// NewPacket allocates the memory for an inbound packet, of the given size, from
+// the stack's own buffers. So that the transport can decrypt packets directly
+// into memory that WritePackets hands to the stack without copying.
+func (ss *sourceSink) NewPacket(size int) transport.Packet {
+	return buffer.NewViewSize(size)
+}
+
+// WritePackets is like Write, but for packets allocated by NewPacket, that it
+// takes ownership of.
+func (ss *sourceSink) WritePackets(pkts []transport.Packet, sources []transport.NoisePublicKey) (int, error) {
+	ss.closeMu.RLock()
+	defer ss.closeMu.RUnlock()
+
+	if ss.ctx.Err() != nil {
+		for _, pkt := range pkts {
+			pkt.(*buffer.View).Release()
+		}
+		return 0, net.ErrClosed
+	}
+
+	batch := ss.newInboundBatch()
+
+	for i, pkt := range pkts {
+		view := pkt.(*buffer.View)
+
+		protoNumber, ok := ss.filterInbound(&batch, sources, i, view.AsSlice())
+		if !ok {
+			view.Release()
+			continue
+		}
+
+		ss.deliverInbound(&batch, protoNumber, view)
+	}
+
+	batch.flush(ss)
+
+	return len(pkts), nil
+}
+
+// inboundBatch holds the state needed to filter a batch of inbound packets, so
+// that it is looked up once per batch (or run of packets from the same peer),
+// rather than once per packet.
+type inboundBatch struct {
+	acl        *acl
+	filters    *[]*listenerFilter
+	forwarding bool
+	clampMSS   bool
+
+	// The peer the previous packet came from, and its state.
+	hasSource bool
+	source    transport.NoisePublicKey
+	limiter   *rateLimiter
+	spoofed   *atomic.Uint64
+	pathMTU   int
+	// The most recent source address the peer was allowed to send from.
+	allowedSource netip.Addr
+
+	// Consecutive segments are merged, if offload is enabled.
+	offload   bool
+	coalescer tcpCoalescer
+}
+
+func (ss *sourceSink) newInboundBatch() inboundBatch {
+	return inboundBatch{
+		acl:        ss.acl.Load(),
+		filters:    ss.listenerFilters.filters.Load(),
+		forwarding: ss.forwarding.Load(),
+		clampMSS:   ss.clampMSS.Load(),
+		pathMTU:    ss.mtu,
+		offload:    ss.offload,
+		coalescer:  tcpCoalescer{localAddrs: ss.localAddrs},
+	}
+}
+
+// flush delivers any segments the batch's coalescer is still holding.
+func (batch *inboundBatch) flush(ss *sourceSink) {
+	batch.coalescer.flush(ss.injectInbound)
+}
+
+// filterInbound decides whether an inbound packet, from the i'th source, is
+// delivered to the stack, and returns its network protocol. Packets that are
+// delivered may have been modified (eg. to clamp their MSS).
+func (ss *sourceSink) filterInbound(batch *inboundBatch, sources []transport.NoisePublicKey, i int, pkt []byte) (tcpip.NetworkProtocolNumber, bool) {
+	hasSource := i < len(sources)
+	if hasSource {
+		ss.capturePacket(CaptureInbound, sources[i], pkt)
+
+		if !batch.hasSource || batch.source != sources[i] {
+			batch.hasSource = true
+			batch.source = sources[i]
+
+			// Replies to the peer must fit within the MTU of the path back to it.
+			ss.peersMu.RLock()
+			batch.limiter = ss.rateLimiters[sources[i]]
+			batch.spoofed = ss.spoofedPackets[sources[i]]
+			batch.allowedSource = netip.Addr{}
+			batch.pathMTU = ss.mtu
+			if mtu, ok := ss.peerMTUs[sources[i]]; ok {
+				batch.pathMTU = mtu
+			}
+			ss.peersMu.RUnlock()
+		}
+
+		if batch.limiter != nil && !batch.limiter.allow(len(pkt)) {
+			ss.writeDropped.Add(1)
+			ss.logDropped("Dropping inbound packet exceeding rate limit", "peer", sources[i])
+			return 0, false
+		}
+	}
+
+	if !allowGlobal(&ss.globalRateLimiter, len(pkt)) {
+		ss.writeDropped.Add(1)
+		ss.logDropped("Dropping inbound packet exceeding global rate limit")
+		return 0, false
+	}
+
+	// A malformed packet from one peer shouldn't stop the rest of the batch
+	// from being delivered.
+	protoNumber, err := inboundProtocol(pkt)
+	if err != nil {
+		ss.writeDropped.Add(1)
+		if errors.Is(err, errTruncatedPacket) {
+			ss.logDropped("Dropping truncated inbound packet", "size", len(pkt))
+		} else {
+			ss.logDropped("Dropping malformed inbound packet", "size", len(pkt), "error", err)
+		}
+		return 0, false
+	}
+
+	if hasSource && !ss.allowSource(batch, sources[i], protoNumber, pkt) {
+		ss.writeDropped.Add(1)
+		if batch.spoofed != nil {
+			batch.spoofed.Add(1)
+		}
+		ss.logDropped("Dropping inbound packet from address not allowed for peer",
+			"peer", sources[i], "source", inboundSource(protoNumber, pkt))
+		return 0, false
+	}
+
+	if ss.handleProbeReply(protoNumber, pkt) {
+		return 0, false
+	}
+
+	if ss.noEchoReply.Load() && isEchoRequest(protoNumber, pkt) {
+		ss.writeDropped.Add(1)
+		ss.logDropped("Dropping inbound echo request")
+		return 0, false
+	}
+
+	if batch.acl != nil && hasSource && !ss.allowInbound(batch.acl, sources[i], protoNumber, pkt) {
+		ss.writeDropped.Add(1)
+		ss.logDropped("Dropping inbound packet denied by ACL", "peer", sources[i])
+		return 0, false
+	}
+
+	if batch.filters != nil && hasSource && !ss.allowListener(*batch.filters, sources[i], protoNumber, pkt) {
+		ss.writeDropped.Add(1)
+		ss.logDropped("Dropping connection attempt from peer not allowed by listener", "peer", sources[i])
+		return 0, false
+	}
+
+	if hasSource && !ss.allowConnection(sources[i], protoNumber, pkt) {
+		ss.writeDropped.Add(1)
+		ss.logDropped("Resetting connection attempt exceeding the connection limits", "peer", sources[i])
+		return 0, false
+	}
+
+	if ss.handleIPConnPacket(protoNumber, pkt) {
+		return 0, false
+	}
+
+	ss.handleICMPError(protoNumber, pkt)
+
+	if batch.forwarding && ss.ttlExceeded(protoNumber, pkt) {
+		ss.writeDropped.Add(1)
+		ss.logDropped("Dropping inbound packet that has exceeded its TTL")
+		return 0, false
+	}
+
+	if batch.clampMSS {
+		pathMTU := ss.mtu
+		if hasSource {
+			pathMTU = batch.pathMTU
+		}
+
+		clampMSS(protoNumber, pkt, maxMSS(protoNumber, pathMTU))
+	}
+
+	return protoNumber, true
+}
+
+// deliverInbound delivers a filtered inbound packet to the stack, merging it
+// with the segments before it if it can. It takes ownership of the view.
+func (ss *sourceSink) deliverInbound(batch *inboundBatch, protoNumber tcpip.NetworkProtocolNumber, view *buffer.View) {
+	if batch.offload {
+		if batch.coalescer.add(protoNumber, view, ss.injectInbound) {
+			return
+		}
+
+		// Packets mustn't overtake the segments held by the coalescer.
+		batch.coalescer.flush(ss.injectInbound)
+	}
+
+	data := view.AsSlice()
+	ss.injectInbound(protoNumber, stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: buffer.MakeWithView(view),
+	}), data)
+}
+
+// injectInbound delivers a packet, whose contents are data, to the stack (or
+// the host forwarder), and releases our reference to it.
+func (ss *sourceSink) injectInbound(protoNumber tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer, data []byte) {
+	// The stack takes its own reference to any fragments it holds for reassembly.
+	defer pkt.DecRef()
+
+	if ss.hostForwarder != nil {
+		ss.peersMu.RLock()
+		forwardToHost := ss.forwardToHostLocked(protoNumber, data)
+		ss.peersMu.RUnlock()
+		if forwardToHost {
+			ss.hostForwarder.InjectInbound(protoNumber, pkt)
+			return
+		}
+	}
+
+	ss.ep.InjectInbound(protoNumber, pkt)
+}
+
 func (ss *sourceSink) BatchSize() int {
-	return conn.IdealBatchSize
+	return ss.batchSize
 }
 
-func (ss *sourceSink) WriteNotify() {
-	pkt := ss.ep.Read()
-	if pkt.IsNil() {
-		return
+// queueOutbound queues a packet to be read, as if it had been sent by the
+// stack. It reports whether there was room for the packet, either way the
+// caller retains its reference to the packet.
+func (ss *sourceSink) queueOutbound(pkt *stack.PacketBuffer) bool {
+	pkts := packetBufferListPool.Get().(*stack.PacketBufferList)
+	defer packetBufferListPool.Put(pkts)
+
+	// The list releases a reference when it is reset.
+	pkts.PushBack(pkt.IncRef())
+
+	n, _ := ss.nic.WritePackets(*pkts)
+	pkts.Reset()
+
+	return n == 1
+}
+
+// isEchoRequest reports whether the packet is an ICMP echo request.
+func isEchoRequest(protoNumber tcpip.NetworkProtocolNumber, pkt []byte) bool {
+	switch protoNumber {
+	case header.IPv4ProtocolNumber:
+		hdr := header.IPv4(pkt)
+		if !hdr.IsValid(len(pkt)) || hdr.TransportProtocol() != header.ICMPv4ProtocolNumber || hdr.FragmentOffset() != 0 {
+			return false
+		}
+
+		payload := hdr.Payload()
+		return len(payload) >= header.ICMPv4MinimumSize && header.ICMPv4(payload).Type() == header.ICMPv4Echo
+	case header.IPv6ProtocolNumber:
+		hdr := header.IPv6(pkt)
+		if !hdr.IsValid(len(pkt)) || hdr.TransportProtocol() != header.ICMPv6ProtocolNumber {
+			return false
+		}
+
+		payload := hdr.Payload()
+		return len(payload) >= header.ICMPv6MinimumSize && header.ICMPv6(payload).Type() == header.ICMPv6EchoRequest
 	}
 
-	ss.incoming <- pkt
+	return false
+}
+
+func prefixToSubnet(prefix netip.Prefix) tcpip.Subnet {
+	return tcpip.AddressWithPrefix{
+		Address:   tcpip.AddrFromSlice(prefix.Addr().AsSlice()),
+		PrefixLen: prefix.Bits(),
+	}.Subnet()
 }
@@ -0,0 +1,1377 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+func TestSourceSink_FragmentReassembly(t *testing.T) {
+	localAddr := netip.MustParseAddr("10.7.0.1")
+	peerAddr := netip.MustParseAddr("10.7.0.2")
+
+	ss, n := newTestSourceSink(t, []netip.Addr{localAddr})
+
+	peerPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	peerPublicKey := peerPrivateKey.PublicKey()
+	require.NoError(t, ss.AddPeer("peer", peerPublicKey, []netip.Prefix{netip.PrefixFrom(peerAddr, peerAddr.BitLen())}))
+
+	lis, err := n.Listen("tcp", "10.7.0.1:80")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = lis.Close()
+	})
+
+	// A TCP SYN (with an MSS option) split across two IPv4 fragments.
+	src := tcpip.AddrFrom4(peerAddr.As4())
+	dst := tcpip.AddrFrom4(localAddr.As4())
+
+	segment := make([]byte, header.TCPMinimumSize+4)
+	tcpHdr := header.TCP(segment)
+	tcpHdr.Encode(&header.TCPFields{
+		SrcPort:    40000,
+		DstPort:    80,
+		SeqNum:     1,
+		DataOffset: uint8(len(segment)),
+		Flags:      header.TCPFlagSyn,
+		WindowSize: 65535,
+	})
+	copy(segment[header.TCPMinimumSize:], []byte{header.TCPOptionMSS, 4, 0x05, 0x78})
+	xsum := header.PseudoHeaderChecksum(header.TCPProtocolNumber, src, dst, uint16(len(segment)))
+	tcpHdr.SetChecksum(^tcpHdr.CalculateChecksum(xsum))
+
+	const fragmentSplit = 16
+	first := newIPv4Fragment(src, dst, 1234, 0, true, segment[:fragmentSplit])
+	second := newIPv4Fragment(src, dst, 1234, fragmentSplit, false, segment[fragmentSplit:])
+
+	waitForReply := readPacket(ss)
+
+	_, err = ss.Write([][]byte{first}, nil, 0)
+	require.NoError(t, err)
+
+	_, err = ss.Write([][]byte{second}, nil, 0)
+	require.NoError(t, err)
+
+	// The reassembled SYN should be answered with a SYN-ACK to the peer.
+	reply, destination, err := waitForReply(5 * time.Second)
+	require.NoError(t, err)
+
+	require.Equal(t, peerPublicKey, destination)
+
+	ipHdr := header.IPv4(reply)
+	require.Equal(t, uint8(header.TCPProtocolNumber), ipHdr.Protocol())
+
+	tcpReply := header.TCP(ipHdr.Payload())
+	require.Equal(t, header.TCPFlagSyn|header.TCPFlagAck, tcpReply.Flags())
+	require.Equal(t, uint32(2), tcpReply.AckNumber())
+}
+
+func TestSourceSink_WritePackets(t *testing.T) {
+	localAddr := netip.MustParseAddr("10.7.0.1")
+	peerAddr := netip.MustParseAddr("10.7.0.2")
+
+	ss, n := newTestSourceSink(t, []netip.Addr{localAddr})
+
+	peerPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	peerPublicKey := peerPrivateKey.PublicKey()
+	require.NoError(t, ss.AddPeer("peer", peerPublicKey, []netip.Prefix{netip.PrefixFrom(peerAddr, peerAddr.BitLen())}))
+
+	lis, err := n.Listen("tcp", "10.7.0.1:80")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = lis.Close()
+	})
+
+	newPacket := func(data []byte) transport.Packet {
+		pkt := ss.NewPacket(len(data))
+		require.Len(t, pkt.AsSlice(), len(data))
+		copy(pkt.AsSlice(), data)
+		return pkt
+	}
+
+	waitForReply := readPacket(ss)
+
+	// A malformed packet doesn't stop the rest of the batch from being delivered.
+	syn := newTestTCPSegment(peerAddr, localAddr, header.TCPFlagSyn, 1460)
+	pkts := []transport.Packet{newPacket([]byte{0x45, 0x00}), newPacket(syn)}
+
+	written, err := ss.WritePackets(pkts, []transport.NoisePublicKey{peerPublicKey, peerPublicKey})
+	require.NoError(t, err)
+	require.Equal(t, 2, written)
+	require.Equal(t, uint64(1), ss.writeDropped.Load())
+
+	reply, destination, err := waitForReply(5 * time.Second)
+	require.NoError(t, err)
+	require.Equal(t, peerPublicKey, destination)
+
+	tcpReply := header.TCP(header.IPv4(reply).Payload())
+	require.Equal(t, header.TCPFlagSyn|header.TCPFlagAck, tcpReply.Flags())
+}
+
+func TestSourceSink_EchoReply(t *testing.T) {
+	localAddr := netip.MustParseAddr("10.7.0.1")
+	peerAddr := netip.MustParseAddr("10.7.0.2")
+
+	ss, n := newTestSourceSink(t, []netip.Addr{localAddr})
+
+	peerPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	peerPublicKey := peerPrivateKey.PublicKey()
+	require.NoError(t, ss.AddPeer("peer", peerPublicKey, []netip.Prefix{netip.PrefixFrom(peerAddr, peerAddr.BitLen())}))
+
+	icmpPayload := make([]byte, header.ICMPv4MinimumSize+4)
+	icmpHdr := header.ICMPv4(icmpPayload)
+	icmpHdr.SetType(header.ICMPv4Echo)
+	icmpHdr.SetIdent(1)
+	icmpHdr.SetSequence(1)
+	copy(icmpHdr.Payload(), []byte("ping"))
+	icmpHdr.SetChecksum(^checksum.Checksum(icmpPayload, 0))
+
+	echoRequest := newIPv4Packet(tcpip.AddrFrom4(peerAddr.As4()), tcpip.AddrFrom4(localAddr.As4()), header.ICMPv4ProtocolNumber, icmpPayload)
+
+	t.Run("Enabled", func(t *testing.T) {
+		waitForReply := readPacket(ss)
+
+		_, err = ss.Write([][]byte{echoRequest}, nil, 0)
+		require.NoError(t, err)
+
+		reply, destination, err := waitForReply(5 * time.Second)
+		require.NoError(t, err)
+
+		require.Equal(t, peerPublicKey, destination)
+
+		ipHdr := header.IPv4(reply)
+		require.Equal(t, uint8(header.ICMPv4ProtocolNumber), ipHdr.Protocol())
+
+		icmpReply := header.ICMPv4(ipHdr.Payload())
+		require.Equal(t, header.ICMPv4EchoReply, icmpReply.Type())
+		require.Equal(t, "ping", string(icmpReply.Payload()))
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		ss.SetEchoReply(false)
+		t.Cleanup(func() {
+			ss.SetEchoReply(true)
+		})
+
+		packetsReceived := n.StackStats().IP.PacketsReceived
+
+		waitForReply := readPacket(ss)
+
+		_, err = ss.Write([][]byte{echoRequest}, nil, 0)
+		require.NoError(t, err)
+
+		_, _, err := waitForReply(100 * time.Millisecond)
+		require.Error(t, err)
+
+		require.Equal(t, packetsReceived, n.StackStats().IP.PacketsReceived)
+	})
+}
+
+func TestSourceSink_ReadBatch(t *testing.T) {
+	ss, _ := newTestSourceSink(t, []netip.Addr{netip.MustParseAddr("10.7.0.1")})
+
+	peerPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	peerAddr := netip.MustParseAddr("10.7.0.2")
+	require.NoError(t, ss.AddPeer("peer", peerPrivateKey.PublicKey(), []netip.Prefix{netip.PrefixFrom(peerAddr, peerAddr.BitLen())}))
+
+	const batchSize = 4
+	bufs := make([][]byte, batchSize)
+	for i := range bufs {
+		bufs[i] = make([]byte, transport.DefaultMTU)
+	}
+	sizes := make([]int, batchSize)
+	destinations := make([]transport.NoisePublicKey, batchSize)
+
+	t.Run("Linger", func(t *testing.T) {
+		go func() {
+			for i := 0; i < batchSize; i++ {
+				writeOutboundPacket(ss, newTestOutboundPacket(netip.MustParseAddr("10.7.0.1"), peerAddr))
+				time.Sleep(time.Millisecond)
+			}
+		}()
+
+		count, err := ss.ReadBatch(bufs, sizes, destinations, 0, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, batchSize, count)
+
+		for i := 0; i < count; i++ {
+			require.Equal(t, peerPrivateKey.PublicKey(), destinations[i])
+			require.Equal(t, header.IPv4MinimumSize, sizes[i])
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		go func() {
+			writeOutboundPacket(ss, newTestOutboundPacket(netip.MustParseAddr("10.7.0.1"), peerAddr))
+		}()
+
+		start := time.Now()
+		count, err := ss.ReadBatch(bufs, sizes, destinations, 0, 10*time.Millisecond)
+		require.NoError(t, err)
+		require.Equal(t, 1, count)
+		require.GreaterOrEqual(t, time.Since(start), 10*time.Millisecond)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		readDropped := ss.readDropped.Load()
+
+		// Packets that can't be sent are dropped, without failing the rest of the batch.
+		writeOutboundPacket(ss, newTestOutboundPacket(netip.MustParseAddr("10.7.0.1"), netip.MustParseAddr("10.7.0.99")))
+		writeOutboundPacket(ss, newTestOutboundPacket(netip.MustParseAddr("10.7.0.1"), peerAddr))
+
+		count, err := ss.ReadBatch(bufs, sizes, destinations, 0, 0)
+		require.NoError(t, err)
+		require.Equal(t, 1, count)
+		require.Equal(t, peerPrivateKey.PublicKey(), destinations[0])
+
+		require.Equal(t, readDropped+1, ss.readDropped.Load())
+	})
+
+	t.Run("Closed", func(t *testing.T) {
+		privateKey, err := transport.NewPrivateKey()
+		require.NoError(t, err)
+
+		ss, _, err := newSourceSink("local", privateKey.PublicKey(), []netip.Addr{netip.MustParseAddr("10.7.0.1")}, sourceSinkOptions{})
+		require.NoError(t, err)
+
+		result := make(chan error, 1)
+		go func() {
+			_, err := ss.ReadBatch(bufs, sizes, destinations, 0, 0)
+			result <- err
+		}()
+
+		// Blocked reads are woken up.
+		time.Sleep(10 * time.Millisecond)
+		require.NoError(t, ss.Close())
+
+		select {
+		case err := <-result:
+			require.ErrorIs(t, err, net.ErrClosed)
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for read to return")
+		}
+	})
+}
+
+func BenchmarkSourceSink_Read(b *testing.B) {
+	for _, linger := range []time.Duration{0, 50 * time.Microsecond} {
+		b.Run(fmt.Sprintf("Linger=%s", linger), func(b *testing.B) {
+			privateKey, err := transport.NewPrivateKey()
+			require.NoError(b, err)
+
+			localAddr := netip.MustParseAddr("10.7.0.1")
+			ss, _, err := newSourceSink("local", privateKey.PublicKey(), []netip.Addr{localAddr}, sourceSinkOptions{})
+			require.NoError(b, err)
+
+			peerAddr := netip.MustParseAddr("10.7.0.2")
+			require.NoError(b, ss.AddPeer("peer", privateKey.PublicKey(), []netip.Prefix{netip.PrefixFrom(peerAddr, peerAddr.BitLen())}))
+
+			batchSize := ss.BatchSize()
+			bufs := make([][]byte, batchSize)
+			for i := range bufs {
+				bufs[i] = make([]byte, transport.DefaultMTU)
+			}
+			sizes := make([]int, batchSize)
+			destinations := make([]transport.NoisePublicKey, batchSize)
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for i := 0; i < b.N; i++ {
+					pkt := newTestOutboundPacket(localAddr, peerAddr)
+					// Wait for room in the queue, rather than dropping packets.
+					for !ss.queueOutbound(pkt) {
+						runtime.Gosched()
+					}
+					pkt.DecRef()
+				}
+			}()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			var packets, calls int
+			for packets < b.N {
+				count, err := ss.ReadBatch(bufs, sizes, destinations, 0, linger)
+				require.NoError(b, err)
+
+				packets += count
+				calls++
+			}
+
+			b.StopTimer()
+			<-done
+
+			b.ReportMetric(float64(packets)/float64(calls), "packets/call")
+
+			require.NoError(b, ss.Close())
+		})
+	}
+}
+
+func BenchmarkSourceSink_Write(b *testing.B) {
+	privateKey, err := transport.NewPrivateKey()
+	require.NoError(b, err)
+
+	localAddr := netip.MustParseAddr("10.7.0.1")
+	ss, n, err := newSourceSink("local", privateKey.PublicKey(), []netip.Addr{localAddr}, sourceSinkOptions{})
+	require.NoError(b, err)
+	b.Cleanup(func() {
+		_ = ss.Close()
+	})
+
+	peerAddr := netip.MustParseAddr("10.7.0.2")
+	require.NoError(b, ss.AddPeer("peer", privateKey.PublicKey(), []netip.Prefix{netip.PrefixFrom(peerAddr, peerAddr.BitLen())}))
+
+	pc, err := n.ListenPacket("udp", "10.7.0.1:5000")
+	require.NoError(b, err)
+
+	// Drain the socket so that its receive buffer doesn't fill up.
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+
+		buf := make([]byte, transport.DefaultMTU)
+		for {
+			if _, _, err := pc.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	payload := make([]byte, 1024)
+	udpPkt := make([]byte, header.UDPMinimumSize+len(payload))
+	udpHdr := header.UDP(udpPkt)
+	udpHdr.Encode(&header.UDPFields{
+		SrcPort: 5000,
+		DstPort: 5000,
+		Length:  uint16(len(udpPkt)),
+	})
+	copy(udpPkt[header.UDPMinimumSize:], payload)
+
+	src, dst := tcpip.AddrFrom4(peerAddr.As4()), tcpip.AddrFrom4(localAddr.As4())
+	xsum := header.PseudoHeaderChecksum(header.UDPProtocolNumber, src, dst, uint16(len(udpPkt)))
+	udpHdr.SetChecksum(^udpHdr.CalculateChecksum(checksum.Checksum(payload, xsum)))
+
+	pkt := newIPv4Packet(src, dst, header.UDPProtocolNumber, udpPkt)
+
+	const batchSize = 16
+	bufs := make([][]byte, batchSize)
+	for i := range bufs {
+		bufs[i] = pkt
+	}
+	sources := make([]transport.NoisePublicKey, batchSize)
+	for i := range sources {
+		sources[i] = privateKey.PublicKey()
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(pkt)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i += batchSize {
+		count := min(batchSize, b.N-i)
+		_, err := ss.Write(bufs[:count], sources[:count], 0)
+		require.NoError(b, err)
+	}
+
+	b.StopTimer()
+
+	require.NoError(b, pc.Close())
+	<-drained
+}
+
+func TestSourceSink_AddPeerAddressConflicts(t *testing.T) {
+	ss, _ := newTestSourceSink(t, []netip.Addr{netip.MustParseAddr("10.7.0.1")})
+
+	alicePrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	bobPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	t.Run("Local Address", func(t *testing.T) {
+		err := ss.AddPeer("alice", alicePrivateKey.PublicKey(), []netip.Prefix{netip.MustParsePrefix("10.7.0.1/32")})
+		require.ErrorContains(t, err, "peer \"alice\"")
+		require.ErrorContains(t, err, "address 10.7.0.1/32 collides with a local address")
+	})
+
+	t.Run("Claimed By Another Peer", func(t *testing.T) {
+		require.NoError(t, ss.AddPeer("alice", alicePrivateKey.PublicKey(), []netip.Prefix{netip.MustParsePrefix("10.7.0.2/32")}))
+
+		err := ss.AddPeer("bob", bobPrivateKey.PublicKey(), []netip.Prefix{netip.MustParsePrefix("10.7.0.3/32"), netip.MustParsePrefix("10.7.0.2/32")})
+		require.ErrorContains(t, err, "peer \"bob\"")
+		require.ErrorContains(t, err, "address 10.7.0.2/32 is already claimed by peer \"alice\"")
+
+		// Nothing should have been added for the rejected peer.
+		_, ok := ss.fromPeerAddress.Lookup(netip.MustParseAddr("10.7.0.3"))
+		require.False(t, ok)
+		require.NotContains(t, ss.peerNames, "bob")
+	})
+
+	t.Run("Same Peer", func(t *testing.T) {
+		require.NoError(t, ss.AddPeer("alice", alicePrivateKey.PublicKey(), []netip.Prefix{netip.MustParsePrefix("10.7.0.2/32")}))
+		require.Len(t, ss.peerAddresses[alicePrivateKey.PublicKey()], 1)
+	})
+
+	newSourceSinkWithConflicts := func(t *testing.T, conflicts addressConflicts) *sourceSink {
+		privateKey, err := transport.NewPrivateKey()
+		require.NoError(t, err)
+
+		ss, _, err := newSourceSink("local", privateKey.PublicKey(), []netip.Addr{netip.MustParseAddr("10.7.0.1")},
+			sourceSinkOptions{addressConflicts: conflicts})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = ss.Close()
+		})
+
+		return ss
+	}
+
+	t.Run("Strict", func(t *testing.T) {
+		ss := newSourceSinkWithConflicts(t, addressConflictsStrict)
+
+		require.NoError(t, ss.AddPeer("alice", alicePrivateKey.PublicKey(), []netip.Prefix{
+			netip.MustParsePrefix("10.7.0.2/32"),
+			netip.MustParsePrefix("10.8.0.0/24"),
+		}))
+
+		err := ss.AddPeer("bob", bobPrivateKey.PublicKey(), []netip.Prefix{netip.MustParsePrefix("10.8.0.100/32")})
+		require.ErrorContains(t, err, "prefix 10.8.0.100/32 overlaps prefix 10.8.0.0/24 of peer \"alice\"")
+
+		err = ss.AddPeer("bob", bobPrivateKey.PublicKey(), []netip.Prefix{netip.MustParsePrefix("10.7.0.0/24")})
+		require.ErrorContains(t, err, "prefix 10.7.0.0/24 contains local address 10.7.0.1")
+
+		// The default route of a default gateway overlaps everything.
+		require.NoError(t, ss.AddPeer("bob", bobPrivateKey.PublicKey(), []netip.Prefix{
+			netip.MustParsePrefix("10.7.0.3/32"),
+			netip.MustParsePrefix("0.0.0.0/0"),
+		}))
+
+		// A peer's own prefixes don't conflict.
+		require.NoError(t, ss.UpdatePeer("alice", alicePrivateKey.PublicKey(), []netip.Prefix{
+			netip.MustParsePrefix("10.7.0.2/32"),
+			netip.MustParsePrefix("10.8.0.0/16"),
+		}))
+	})
+
+	t.Run("Replace", func(t *testing.T) {
+		ss := newSourceSinkWithConflicts(t, addressConflictsReplace)
+
+		type takeover struct {
+			prefix   netip.Prefix
+			from, to transport.NoisePublicKey
+		}
+		var takeovers []takeover
+		ss.addressTakenOver = func(prefix netip.Prefix, from, to transport.NoisePublicKey) {
+			takeovers = append(takeovers, takeover{prefix: prefix, from: from, to: to})
+		}
+
+		require.NoError(t, ss.AddPeer("alice", alicePrivateKey.PublicKey(), []netip.Prefix{
+			netip.MustParsePrefix("10.7.0.2/32"),
+			netip.MustParsePrefix("10.7.0.3/32"),
+		}))
+
+		require.NoError(t, ss.AddPeer("bob", bobPrivateKey.PublicKey(), []netip.Prefix{netip.MustParsePrefix("10.7.0.3/32")}))
+
+		require.Equal(t, []takeover{{
+			prefix: netip.MustParsePrefix("10.7.0.3/32"),
+			from:   alicePrivateKey.PublicKey(),
+			to:     bobPrivateKey.PublicKey(),
+		}}, takeovers)
+
+		owner, ok := ss.fromPeerAddress.Lookup(netip.MustParseAddr("10.7.0.3"))
+		require.True(t, ok)
+		require.Equal(t, bobPrivateKey.PublicKey(), owner)
+
+		require.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.7.0.2/32")}, ss.PeerPrefixes(alicePrivateKey.PublicKey()))
+		require.Equal(t, []netip.Addr{netip.MustParseAddr("10.7.0.2")}, ss.peerAddresses[alicePrivateKey.PublicKey()])
+
+		// Local addresses still can't be claimed.
+		err := ss.AddPeer("bob", bobPrivateKey.PublicKey(), []netip.Prefix{netip.MustParsePrefix("10.7.0.1/32")})
+		require.ErrorContains(t, err, "collides with a local address")
+	})
+}
+
+func TestSourceSink_SubnetRouting(t *testing.T) {
+	localAddr := netip.MustParseAddr("10.7.0.1")
+
+	ss, _ := newTestSourceSink(t, []netip.Addr{localAddr})
+
+	routerPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	hostPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	require.NoError(t, ss.AddPeer("router", routerPrivateKey.PublicKey(), []netip.Prefix{
+		netip.MustParsePrefix("10.7.0.2/32"),
+		netip.MustParsePrefix("10.8.0.0/24"),
+	}))
+
+	// A more specific prefix within the router's subnet.
+	require.NoError(t, ss.AddPeer("host", hostPrivateKey.PublicKey(), []netip.Prefix{
+		netip.MustParsePrefix("10.8.0.100/32"),
+	}))
+
+	// Only single addresses are resolvable by name.
+	require.Equal(t, []netip.Addr{netip.MustParseAddr("10.7.0.2")}, ss.peerAddresses[routerPrivateKey.PublicKey()])
+
+	bufs := [][]byte{make([]byte, transport.DefaultMTU)}
+	sizes := make([]int, 1)
+	destinations := make([]transport.NoisePublicKey, 1)
+
+	for _, tc := range []struct {
+		dst      string
+		expected transport.NoisePublicKey
+	}{
+		{"10.8.0.5", routerPrivateKey.PublicKey()},
+		{"10.8.0.100", hostPrivateKey.PublicKey()},
+	} {
+		go func() {
+			writeOutboundPacket(ss, newTestOutboundPacket(localAddr, netip.MustParseAddr(tc.dst)))
+		}()
+
+		_, err := ss.Read(bufs, sizes, destinations, 0)
+		require.NoError(t, err)
+		require.Equal(t, tc.expected, destinations[0], tc.dst)
+	}
+
+	readDropped := ss.readDropped.Load()
+
+	// Packets to unroutable destinations are dropped.
+	writeOutboundPacket(ss, newTestOutboundPacket(localAddr, netip.MustParseAddr("10.9.0.1")))
+
+	_, _, err = readPacket(ss)(100 * time.Millisecond)
+	require.Error(t, err)
+	require.Equal(t, readDropped+1, ss.readDropped.Load())
+}
+
+func TestSourceSink_DefaultGateway(t *testing.T) {
+	localAddr := netip.MustParseAddr("10.7.0.1")
+
+	ss, _ := newTestSourceSink(t, []netip.Addr{localAddr})
+
+	gatewayPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	peerPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	require.NoError(t, ss.AddPeer("gateway", gatewayPrivateKey.PublicKey(), []netip.Prefix{
+		netip.MustParsePrefix("10.7.0.254/32"),
+		netip.MustParsePrefix("0.0.0.0/0"),
+	}))
+
+	require.NoError(t, ss.AddPeer("peer", peerPrivateKey.PublicKey(), []netip.Prefix{
+		netip.MustParsePrefix("10.7.0.2/32"),
+	}))
+
+	bufs := [][]byte{make([]byte, transport.DefaultMTU)}
+	sizes := make([]int, 1)
+	destinations := make([]transport.NoisePublicKey, 1)
+
+	for _, tc := range []struct {
+		dst      string
+		expected transport.NoisePublicKey
+	}{
+		{"1.1.1.1", gatewayPrivateKey.PublicKey()},
+		{"10.7.0.2", peerPrivateKey.PublicKey()},
+	} {
+		go func() {
+			writeOutboundPacket(ss, newTestOutboundPacket(localAddr, netip.MustParseAddr(tc.dst)))
+		}()
+
+		_, err := ss.Read(bufs, sizes, destinations, 0)
+		require.NoError(t, err)
+		require.Equal(t, tc.expected, destinations[0], tc.dst)
+	}
+
+	ss.RemovePeer(gatewayPrivateKey.PublicKey())
+
+	readDropped := ss.readDropped.Load()
+
+	// Once the gateway is removed, there's nowhere to send the packet.
+	writeOutboundPacket(ss, newTestOutboundPacket(localAddr, netip.MustParseAddr("1.1.1.1")))
+
+	_, _, err = readPacket(ss)(100 * time.Millisecond)
+	require.Error(t, err)
+	require.Equal(t, readDropped+1, ss.readDropped.Load())
+}
+
+func TestSourceSink_UnknownDestination(t *testing.T) {
+	localAddr := netip.MustParseAddr("10.7.0.1")
+
+	ss, _ := newTestSourceSink(t, []netip.Addr{localAddr})
+
+	peerPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	require.NoError(t, ss.AddPeer("peer", peerPrivateKey.PublicKey(), []netip.Prefix{
+		netip.MustParsePrefix("10.7.0.2/32"),
+	}))
+
+	unknownAddrs := make(chan netip.Addr, 1)
+	ss.SetUnknownDestinationHandler(func(addr netip.Addr) {
+		unknownAddrs <- addr
+	})
+
+	bufs := [][]byte{make([]byte, transport.DefaultMTU)}
+	sizes := make([]int, 1)
+	destinations := make([]transport.NoisePublicKey, 1)
+
+	// The packet to the unknown destination is dropped, rather than failing the read.
+	go func() {
+		writeOutboundPacket(ss, newTestOutboundPacket(localAddr, netip.MustParseAddr("10.7.0.3")))
+		writeOutboundPacket(ss, newTestOutboundPacket(localAddr, netip.MustParseAddr("10.7.0.2")))
+	}()
+
+	n, err := ss.Read(bufs, sizes, destinations, 0)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Equal(t, peerPrivateKey.PublicKey(), destinations[0])
+	require.Equal(t, netip.MustParseAddr("10.7.0.3"), <-unknownAddrs)
+
+	ss.SetUnknownDestinationHandler(nil)
+
+	readDropped := ss.readDropped.Load()
+
+	// Without a handler, the packet is just dropped.
+	writeOutboundPacket(ss, newTestOutboundPacket(localAddr, netip.MustParseAddr("10.7.0.3")))
+
+	_, _, err = readPacket(ss)(100 * time.Millisecond)
+	require.Error(t, err)
+	require.Equal(t, readDropped+1, ss.readDropped.Load())
+}
+
+func TestSourceSink_LogDropped(t *testing.T) {
+	localAddr := netip.MustParseAddr("10.7.0.1")
+
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	privateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	ss, _, err := newSourceSink("local", privateKey.PublicKey(), []netip.Addr{localAddr}, sourceSinkOptions{logger: logger})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = ss.Close()
+	})
+
+	peerPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	require.NoError(t, ss.AddPeer("peer", peerPrivateKey.PublicKey(), []netip.Prefix{
+		netip.MustParsePrefix("10.7.0.2/32"),
+	}))
+
+	bufs := [][]byte{make([]byte, transport.DefaultMTU)}
+	sizes := make([]int, 1)
+	destinations := make([]transport.NoisePublicKey, 1)
+
+	writeOutboundPacket(ss, newTestOutboundPacket(localAddr, netip.MustParseAddr("10.7.0.3")))
+	writeOutboundPacket(ss, newTestOutboundPacket(localAddr, netip.MustParseAddr("10.7.0.2")))
+
+	_, err = ss.Read(bufs, sizes, destinations, 0)
+	require.NoError(t, err)
+
+	require.Contains(t, logs.String(), "unknown destination address 10.7.0.3")
+
+	_, err = ss.Write([][]byte{{0x45, 0x00}}, []transport.NoisePublicKey{peerPrivateKey.PublicKey()}, 0)
+	require.NoError(t, err)
+
+	require.Contains(t, logs.String(), "Dropping truncated inbound packet")
+}
+
+func TestSourceSink_PeerMTU(t *testing.T) {
+	localAddr := netip.MustParseAddr("10.7.0.1")
+
+	ss, _ := newTestSourceSink(t, []netip.Addr{localAddr})
+
+	peerPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+	peerPublicKey := peerPrivateKey.PublicKey()
+
+	require.NoError(t, ss.AddPeer("peer", peerPublicKey, []netip.Prefix{
+		netip.MustParsePrefix("10.7.0.2/32"),
+		netip.MustParsePrefix("10.8.0.0/24"),
+	}))
+
+	require.Equal(t, transport.DefaultMTU, ss.PeerMTU(peerPublicKey))
+
+	ss.SetPeerMTU(peerPublicKey, 1280)
+	require.Equal(t, 1280, ss.PeerMTU(peerPublicKey))
+
+	bufs := [][]byte{make([]byte, transport.DefaultMTU)}
+	sizes := make([]int, 1)
+	destinations := make([]transport.NoisePublicKey, 1)
+
+	// The oversized packet is dropped, and the stack is told to send smaller packets.
+	go func() {
+		writeOutboundPacket(ss, newTestOutboundPacketWithSize(localAddr, netip.MustParseAddr("10.7.0.2"), 1400, true))
+		writeOutboundPacket(ss, newTestOutboundPacket(localAddr, netip.MustParseAddr("10.7.0.2")))
+	}()
+
+	n, err := ss.Read(bufs, sizes, destinations, 0)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Equal(t, header.IPv4MinimumSize, sizes[0])
+
+	require.Eventually(t, func() bool {
+		return ss.stack.Stats().ICMP.V4.PacketsReceived.DstUnreachable.Value() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// Forwarded packets that can be fragmented are sent anyway.
+	go func() {
+		writeOutboundPacket(ss, newTestOutboundPacketWithSize(netip.MustParseAddr("10.9.0.1"), netip.MustParseAddr("10.8.0.1"), 1400, false))
+	}()
+
+	_, err = ss.Read(bufs, sizes, destinations, 0)
+	require.NoError(t, err)
+	require.Equal(t, 1400, sizes[0])
+
+	ss.SetPeerMTU(peerPublicKey, 0)
+	require.Equal(t, transport.DefaultMTU, ss.PeerMTU(peerPublicKey))
+}
+
+func TestSourceSink_Options(t *testing.T) {
+	privateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	localAddr := netip.MustParseAddr("10.7.0.1")
+
+	opts, err := configSourceSinkOptions(&v1alpha1.Config{
+		MTU: 1280,
+		Tuning: &v1alpha1.TuningConfig{
+			QueueSize:      16,
+			BatchSize:      4,
+			DisableOffload: true,
+		},
+		Stack: &v1alpha1.StackConfig{
+			SendBufferSize:    2 << 20,
+			ReceiveBufferSize: 8 << 20,
+			CongestionControl: "cubic",
+		},
+	})
+	require.NoError(t, err)
+
+	ss, _, err := newSourceSink("local", privateKey.PublicKey(), []netip.Addr{localAddr}, opts)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = ss.Close()
+	})
+
+	require.Equal(t, 1280, ss.mtu)
+	require.Equal(t, 4, ss.BatchSize())
+	require.Equal(t, uint32(1280), ss.ep.MTU())
+	require.Equal(t, stack.GSONotSupported, ss.ep.SupportedGSO())
+
+	var sackEnabled tcpip.TCPSACKEnabled
+	require.Nil(t, ss.stack.TransportProtocolOption(tcp.ProtocolNumber, &sackEnabled))
+	require.True(t, bool(sackEnabled))
+
+	var sendBufferSize tcpip.TCPSendBufferSizeRangeOption
+	require.Nil(t, ss.stack.TransportProtocolOption(tcp.ProtocolNumber, &sendBufferSize))
+	require.Equal(t, 2<<20, sendBufferSize.Default)
+
+	var receiveBufferSize tcpip.TCPReceiveBufferSizeRangeOption
+	require.Nil(t, ss.stack.TransportProtocolOption(tcp.ProtocolNumber, &receiveBufferSize))
+	require.Equal(t, 8<<20, receiveBufferSize.Max)
+
+	var congestionControl tcpip.CongestionControlOption
+	require.Nil(t, ss.stack.TransportProtocolOption(tcp.ProtocolNumber, &congestionControl))
+	require.Equal(t, tcpip.CongestionControlOption("cubic"), congestionControl)
+
+	peerPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	require.NoError(t, ss.AddPeer("peer", peerPrivateKey.PublicKey(), []netip.Prefix{netip.MustParsePrefix("10.7.0.2/32")}))
+
+	// Packets are queued until they're read, or dropped once the queue is full.
+	for i := 0; i <= 16; i++ {
+		pkt := newTestOutboundPacket(localAddr, netip.MustParseAddr("10.7.0.2"))
+		require.Equal(t, i < 16, ss.queueOutbound(pkt))
+		pkt.DecRef()
+	}
+
+	bufs := make([][]byte, ss.BatchSize())
+	for i := range bufs {
+		bufs[i] = make([]byte, ss.mtu)
+	}
+	sizes := make([]int, len(bufs))
+	destinations := make([]transport.NoisePublicKey, len(bufs))
+
+	n, err := ss.Read(bufs, sizes, destinations, 0)
+	require.NoError(t, err)
+	require.Equal(t, 4, n)
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := configSourceSinkOptions(&v1alpha1.Config{Tuning: &v1alpha1.TuningConfig{BatchSize: 1024}})
+		require.Error(t, err)
+
+		_, err = configSourceSinkOptions(&v1alpha1.Config{Tuning: &v1alpha1.TuningConfig{QueueSize: -1}})
+		require.Error(t, err)
+
+		_, err = configSourceSinkOptions(&v1alpha1.Config{Tuning: &v1alpha1.TuningConfig{Queues: 65}})
+		require.Error(t, err)
+
+		_, err = configSourceSinkOptions(&v1alpha1.Config{MTU: 100})
+		require.Error(t, err)
+
+		_, err = configSourceSinkOptions(&v1alpha1.Config{Stack: &v1alpha1.StackConfig{ReceiveBufferSize: 1024}})
+		require.Error(t, err)
+
+		_, err = configSourceSinkOptions(&v1alpha1.Config{Stack: &v1alpha1.StackConfig{CongestionControl: "bbr"}})
+		require.Error(t, err)
+	})
+}
+
+func TestSourceSink_Queues(t *testing.T) {
+	privateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	localAddr := netip.MustParseAddr("10.7.0.1")
+
+	opts, err := configSourceSinkOptions(&v1alpha1.Config{
+		Tuning: &v1alpha1.TuningConfig{Queues: 2},
+	})
+	require.NoError(t, err)
+
+	ss, _, err := newSourceSink("local", privateKey.PublicKey(), []netip.Addr{localAddr}, opts)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = ss.Close()
+	})
+
+	require.Equal(t, 2, ss.Queues())
+
+	// Peers are spread across the queues.
+	peerAddrs := []netip.Addr{
+		netip.MustParseAddr("10.7.0.2"),
+		netip.MustParseAddr("10.7.0.3"),
+		netip.MustParseAddr("10.7.0.4"),
+	}
+	peerPublicKeys := make([]transport.NoisePublicKey, len(peerAddrs))
+	for i, peerAddr := range peerAddrs {
+		peerPrivateKey, err := transport.NewPrivateKey()
+		require.NoError(t, err)
+
+		peerPublicKeys[i] = peerPrivateKey.PublicKey()
+		require.NoError(t, ss.AddPeer(fmt.Sprintf("peer%d", i), peerPublicKeys[i], []netip.Prefix{netip.PrefixFrom(peerAddr, peerAddr.BitLen())}))
+	}
+
+	for size := header.IPv4MinimumSize; size < header.IPv4MinimumSize+3; size++ {
+		for _, peerAddr := range peerAddrs {
+			writeOutboundPacket(ss, newTestOutboundPacketWithSize(localAddr, peerAddr, size, false))
+		}
+	}
+
+	bufs := make([][]byte, 16)
+	for i := range bufs {
+		bufs[i] = make([]byte, ss.mtu)
+	}
+	sizes := make([]int, len(bufs))
+	destinations := make([]transport.NoisePublicKey, len(bufs))
+
+	for queue, queuePeers := range [][]transport.NoisePublicKey{
+		{peerPublicKeys[0], peerPublicKeys[2]},
+		{peerPublicKeys[1]},
+	} {
+		count, err := ss.ReadQueue(queue, bufs, sizes, destinations, 0)
+		require.NoError(t, err)
+		require.Equal(t, 3*len(queuePeers), count)
+
+		// Each peer's packets are read in the order they were sent.
+		nextSize := make(map[transport.NoisePublicKey]int)
+		for i := 0; i < count; i++ {
+			require.Contains(t, queuePeers, destinations[i])
+
+			if nextSize[destinations[i]] == 0 {
+				nextSize[destinations[i]] = header.IPv4MinimumSize
+			}
+			require.Equal(t, nextSize[destinations[i]], sizes[i])
+			nextSize[destinations[i]]++
+		}
+	}
+
+	require.Zero(t, ss.nic.NumQueued())
+}
+
+func TestSourceSink_PeerRateLimit(t *testing.T) {
+	localAddr := netip.MustParseAddr("10.7.0.1")
+	peerAddr := netip.MustParseAddr("10.7.0.2")
+
+	ss, n := newTestSourceSink(t, []netip.Addr{localAddr})
+
+	peerPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	peerPublicKey := peerPrivateKey.PublicKey()
+	require.NoError(t, ss.AddPeer("peer", peerPublicKey, []netip.Prefix{netip.PrefixFrom(peerAddr, peerAddr.BitLen())}))
+
+	ss.SetPeerRateLimit(peerPublicKey, 2, 0)
+
+	pkt := newIPv4Fragment(tcpip.AddrFrom4(peerAddr.As4()), tcpip.AddrFrom4(localAddr.As4()), 1, 0, false, make([]byte, header.TCPMinimumSize))
+
+	bufs := make([][]byte, 5)
+	sources := make([]transport.NoisePublicKey, len(bufs))
+	for i := range bufs {
+		bufs[i] = pkt
+		sources[i] = peerPublicKey
+	}
+
+	_, err = ss.Write(bufs, sources, 0)
+	require.NoError(t, err)
+
+	require.Equal(t, uint64(2), n.StackStats().IP.PacketsReceived)
+
+	stats := peerCounters(n, "peer")
+
+	require.Equal(t, uint64(3), stats.RateLimitedPackets)
+	require.Equal(t, uint64(3*len(pkt)), stats.RateLimitedBytes)
+
+	// Traffic without a source (or from other peers) is not limited.
+	_, err = ss.Write(bufs, nil, 0)
+	require.NoError(t, err)
+
+	require.Equal(t, uint64(7), n.StackStats().IP.PacketsReceived)
+}
+
+func TestSourceSink_GlobalRateLimit(t *testing.T) {
+	localAddr := netip.MustParseAddr("10.7.0.1")
+	aliceAddr := netip.MustParseAddr("10.7.0.2")
+	bobAddr := netip.MustParseAddr("10.7.0.3")
+
+	ss, n := newTestSourceSink(t, []netip.Addr{localAddr})
+	s := &NoisySocket{noisyNet: n, sourceSink: ss}
+
+	alicePrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+	alicePublicKey := alicePrivateKey.PublicKey()
+
+	bobPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+	bobPublicKey := bobPrivateKey.PublicKey()
+
+	require.NoError(t, ss.AddPeer("alice", alicePublicKey, []netip.Prefix{netip.PrefixFrom(aliceAddr, aliceAddr.BitLen())}))
+	require.NoError(t, ss.AddPeer("bob", bobPublicKey, []netip.Prefix{netip.PrefixFrom(bobAddr, bobAddr.BitLen())}))
+
+	// Alice's excess traffic is dropped by her own limit, so it doesn't consume the global limit.
+	ss.SetPeerRateLimit(alicePublicKey, 1, 0)
+	s.SetRateLimit(&v1alpha1.RateLimitConfig{PacketsPerSecond: 3}, nil)
+
+	write := func(src netip.Addr, publicKey transport.NoisePublicKey) {
+		pkt := newIPv4Fragment(tcpip.AddrFrom4(src.As4()), tcpip.AddrFrom4(localAddr.As4()), 1, 0, false, make([]byte, header.TCPMinimumSize))
+
+		bufs := make([][]byte, 3)
+		sources := make([]transport.NoisePublicKey, len(bufs))
+		for i := range bufs {
+			bufs[i] = pkt
+			sources[i] = publicKey
+		}
+
+		_, err := ss.Write(bufs, sources, 0)
+		require.NoError(t, err)
+	}
+
+	write(aliceAddr, alicePublicKey)
+	write(bobAddr, bobPublicKey)
+
+	require.Equal(t, uint64(3), n.StackStats().IP.PacketsReceived)
+
+	aliceStats := peerCounters(n, "alice")
+	require.Equal(t, uint64(2), aliceStats.RateLimitedPackets)
+
+	require.Equal(t, uint64(1), s.RateLimitStats().RateLimitedPackets)
+
+	s.SetRateLimit(nil, nil)
+	require.Zero(t, s.RateLimitStats())
+}
+
+func TestSourceSink_OutboundRateLimit(t *testing.T) {
+	localAddr := netip.MustParseAddr("10.7.0.1")
+	peerAddr := netip.MustParseAddr("10.7.0.2")
+
+	ss, n := newTestSourceSink(t, []netip.Addr{localAddr})
+
+	peerPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	peerPublicKey := peerPrivateKey.PublicKey()
+	require.NoError(t, ss.AddPeer("peer", peerPublicKey, []netip.Prefix{netip.PrefixFrom(peerAddr, peerAddr.BitLen())}))
+
+	ss.SetPeerOutboundRateLimit(peerPublicKey, 1, 0)
+
+	wait := readPacket(ss)
+	writeOutboundPacket(ss, newTestOutboundPacket(localAddr, peerAddr))
+	_, _, err = wait(time.Second)
+	require.NoError(t, err)
+
+	// The second packet exceeds the limit and is dropped, without interrupting the read.
+	wait = readPacket(ss)
+	writeOutboundPacket(ss, newTestOutboundPacket(localAddr, peerAddr))
+
+	_, _, err = wait(100 * time.Millisecond)
+	require.Error(t, err)
+
+	stats := peerCounters(n, "peer")
+	require.Equal(t, uint64(1), stats.OutboundRateLimitedPackets)
+
+	// Once the bucket has refilled packets are sent again.
+	time.Sleep(time.Second)
+
+	writeOutboundPacket(ss, newTestOutboundPacket(localAddr, peerAddr))
+	_, dst, err := wait(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, peerPublicKey, dst)
+}
+
+func TestSourceSink_RemoveAndUpdatePeer(t *testing.T) {
+	ss, _ := newTestSourceSink(t, []netip.Addr{netip.MustParseAddr("10.7.0.1")})
+
+	alicePrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+	alicePublicKey := alicePrivateKey.PublicKey()
+
+	bobPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+	bobPublicKey := bobPrivateKey.PublicKey()
+
+	require.NoError(t, ss.AddPeer("alice", alicePublicKey, []netip.Prefix{netip.MustParsePrefix("10.7.0.2/32")}))
+	require.NoError(t, ss.AddPeer("bob", bobPublicKey, []netip.Prefix{netip.MustParsePrefix("10.7.0.3/32")}))
+
+	t.Run("Update", func(t *testing.T) {
+		require.NoError(t, ss.UpdatePeer("alice2", alicePublicKey, []netip.Prefix{netip.MustParsePrefix("10.7.0.4/32")}))
+
+		require.NotContains(t, ss.peerNames, "alice")
+		require.Equal(t, alicePublicKey, ss.peerNames["alice2"])
+		require.Equal(t, []netip.Addr{netip.MustParseAddr("10.7.0.4")}, ss.peerAddresses[alicePublicKey])
+		_, ok := ss.fromPeerAddress.Lookup(netip.MustParseAddr("10.7.0.2"))
+		require.False(t, ok)
+
+		pk, ok := ss.fromPeerAddress.Lookup(netip.MustParseAddr("10.7.0.4"))
+		require.True(t, ok)
+		require.Equal(t, alicePublicKey, pk)
+	})
+
+	t.Run("Update Conflict", func(t *testing.T) {
+		err := ss.UpdatePeer("alice2", alicePublicKey, []netip.Prefix{netip.MustParsePrefix("10.7.0.3/32")})
+		require.ErrorContains(t, err, "already claimed by peer \"bob\"")
+
+		// The existing configuration should be left untouched.
+		require.Equal(t, []netip.Addr{netip.MustParseAddr("10.7.0.4")}, ss.peerAddresses[alicePublicKey])
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		ss.SetPeerRateLimit(bobPublicKey, 10, 0)
+
+		ss.RemovePeer(bobPublicKey)
+
+		require.NotContains(t, ss.peerNames, "bob")
+		require.NotContains(t, ss.peerAddresses, bobPublicKey)
+		_, ok := ss.fromPeerAddress.Lookup(netip.MustParseAddr("10.7.0.3"))
+		require.False(t, ok)
+		require.NotContains(t, ss.rateLimiters, bobPublicKey)
+
+		// The address is now free to be claimed by another peer.
+		require.NoError(t, ss.AddPeer("alice2", alicePublicKey, []netip.Prefix{netip.MustParsePrefix("10.7.0.3/32")}))
+	})
+}
+
+func TestSourceSink_SpoofedSource(t *testing.T) {
+	localAddr := netip.MustParseAddr("10.7.0.1")
+	aliceAddr := netip.MustParseAddr("10.7.0.2")
+	bobAddr := netip.MustParseAddr("10.7.0.3")
+
+	ss, n := newTestSourceSink(t, []netip.Addr{localAddr})
+
+	alicePrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+	alicePublicKey := alicePrivateKey.PublicKey()
+
+	bobPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+	bobPublicKey := bobPrivateKey.PublicKey()
+
+	require.NoError(t, ss.AddPeer("alice", alicePublicKey, []netip.Prefix{
+		netip.PrefixFrom(aliceAddr, aliceAddr.BitLen()),
+		netip.MustParsePrefix("192.168.1.0/24"),
+	}))
+	require.NoError(t, ss.AddPeer("bob", bobPublicKey, []netip.Prefix{netip.PrefixFrom(bobAddr, bobAddr.BitLen())}))
+
+	var bufs [][]byte
+	for _, src := range []string{
+		"10.7.0.2",    // alice's address
+		"192.168.1.5", // within a subnet routed to alice
+		"10.7.0.3",    // bob's address
+		"10.7.0.1",    // the local address
+		"172.16.0.1",  // not routed to any peer
+	} {
+		bufs = append(bufs, newIPv4Fragment(tcpip.AddrFrom4(netip.MustParseAddr(src).As4()),
+			tcpip.AddrFrom4(localAddr.As4()), 1, 0, false, make([]byte, header.TCPMinimumSize)))
+	}
+
+	sources := make([]transport.NoisePublicKey, len(bufs))
+	for i := range sources {
+		sources[i] = alicePublicKey
+	}
+
+	_, err = ss.Write(bufs, sources, 0)
+	require.NoError(t, err)
+
+	require.Equal(t, uint64(2), n.StackStats().IP.PacketsReceived)
+	require.Equal(t, uint64(3), ss.writeDropped.Load())
+
+	aliceStats := peerCounters(n, "alice")
+	require.Equal(t, uint64(3), aliceStats.SpoofedPackets)
+
+	bobStats := peerCounters(n, "bob")
+	require.Zero(t, bobStats.SpoofedPackets)
+}
+
+func TestSourceSink_Close(t *testing.T) {
+	localAddr := netip.MustParseAddr("10.7.0.1")
+	peerAddr := netip.MustParseAddr("10.7.0.2")
+
+	ss, _ := newTestSourceSink(t, []netip.Addr{localAddr})
+
+	peerPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	peerPublicKey := peerPrivateKey.PublicKey()
+	require.NoError(t, ss.AddPeer("peer", peerPublicKey, []netip.Prefix{netip.PrefixFrom(peerAddr, peerAddr.BitLen())}))
+
+	newReadBufs := func() ([][]byte, []int, []transport.NoisePublicKey) {
+		return [][]byte{make([]byte, transport.DefaultMTU)}, make([]int, 1), make([]transport.NoisePublicKey, 1)
+	}
+
+	// Reads blocked waiting for packets (eg. the resets of the writes).
+	readErrs := make(chan error, 2)
+	for _, linger := range []time.Duration{0, time.Hour} {
+		linger := linger
+		go func() {
+			bufs, sizes, destinations := newReadBufs()
+			for {
+				if _, err := ss.ReadBatch(bufs, sizes, destinations, 0, linger); err != nil {
+					readErrs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	// Writes in flight.
+	stopWriting := make(chan struct{})
+	writeErrs := make(chan error, 1)
+	go func() {
+		syn := newTestTCPSegment(peerAddr, localAddr, header.TCPFlagSyn, 1460)
+		for {
+			select {
+			case <-stopWriting:
+				writeErrs <- nil
+				return
+			default:
+			}
+
+			if _, err := ss.Write([][]byte{syn}, []transport.NoisePublicKey{peerPublicKey}, 0); err != nil {
+				writeErrs <- err
+				return
+			}
+		}
+	}()
+
+	// Closed concurrently, and repeatedly.
+	closeErrs := make(chan error, 3)
+	for i := 0; i < cap(closeErrs); i++ {
+		go func() {
+			closeErrs <- ss.Close()
+		}()
+	}
+
+	for i := 0; i < cap(closeErrs); i++ {
+		require.NoError(t, <-closeErrs)
+	}
+	require.NoError(t, ss.Close())
+
+	for i := 0; i < cap(readErrs); i++ {
+		select {
+		case err := <-readErrs:
+			require.ErrorIs(t, err, net.ErrClosed)
+		case <-time.After(5 * time.Second):
+			t.Fatal("read wasn't woken by close")
+		}
+	}
+
+	close(stopWriting)
+	if err := <-writeErrs; err != nil {
+		require.ErrorIs(t, err, net.ErrClosed)
+	}
+
+	bufs, sizes, destinations := newReadBufs()
+	_, err = ss.Read(bufs, sizes, destinations, 0)
+	require.ErrorIs(t, err, net.ErrClosed)
+
+	_, err = ss.Write([][]byte{newTestTCPSegment(peerAddr, localAddr, header.TCPFlagSyn, 1460)}, []transport.NoisePublicKey{peerPublicKey}, 0)
+	require.ErrorIs(t, err, net.ErrClosed)
+
+	_, err = ss.WritePackets([]transport.Packet{ss.NewPacket(header.IPv4MinimumSize)}, []transport.NoisePublicKey{peerPublicKey})
+	require.ErrorIs(t, err, net.ErrClosed)
+}
+
+func newTestSourceSink(t *testing.T, localAddrs []netip.Addr) (*sourceSink, *noisyNet) {
+	privateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	ss, n, err := newSourceSink("local", privateKey.PublicKey(), localAddrs, sourceSinkOptions{})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = ss.Close()
+	})
+
+	return ss, n
+}
+
+func newIPv4Packet(src, dst tcpip.Address, protocol tcpip.TransportProtocolNumber, payload []byte) []byte {
+	pkt := make([]byte, header.IPv4MinimumSize+len(payload))
+
+	ipHdr := header.IPv4(pkt)
+	ipHdr.Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(pkt)),
+		TTL:         64,
+		Protocol:    uint8(protocol),
+		SrcAddr:     src,
+		DstAddr:     dst,
+	})
+	ipHdr.SetChecksum(^ipHdr.CalculateChecksum())
+	copy(pkt[header.IPv4MinimumSize:], payload)
+
+	return pkt
+}
+
+func newIPv4Fragment(src, dst tcpip.Address, id, fragmentOffset uint16, moreFragments bool, payload []byte) []byte {
+	pkt := make([]byte, header.IPv4MinimumSize+len(payload))
+
+	var flags uint8
+	if moreFragments {
+		flags = header.IPv4FlagMoreFragments
+	}
+
+	ipHdr := header.IPv4(pkt)
+	ipHdr.Encode(&header.IPv4Fields{
+		TotalLength:    uint16(len(pkt)),
+		ID:             id,
+		Flags:          flags,
+		FragmentOffset: fragmentOffset,
+		TTL:            64,
+		Protocol:       uint8(header.TCPProtocolNumber),
+		SrcAddr:        src,
+		DstAddr:        dst,
+	})
+	ipHdr.SetChecksum(^ipHdr.CalculateChecksum())
+	copy(pkt[header.IPv4MinimumSize:], payload)
+
+	return pkt
+}
+
+func newTestOutboundPacket(src, dst netip.Addr) *stack.PacketBuffer {
+	return newTestOutboundPacketWithSize(src, dst, header.IPv4MinimumSize, false)
+}
+
+func newTestOutboundPacketWithSize(src, dst netip.Addr, size int, dontFragment bool) *stack.PacketBuffer {
+	pkt := make([]byte, size)
+
+	var flags uint8
+	if dontFragment {
+		flags = header.IPv4FlagDontFragment
+	}
+
+	ipHdr := header.IPv4(pkt)
+	ipHdr.Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(pkt)),
+		Flags:       flags,
+		TTL:         64,
+		Protocol:    uint8(header.UDPProtocolNumber),
+		SrcAddr:     tcpip.AddrFrom4(src.As4()),
+		DstAddr:     tcpip.AddrFrom4(dst.As4()),
+	})
+	ipHdr.SetChecksum(^ipHdr.CalculateChecksum())
+
+	pktBuf := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(pkt)})
+	pktBuf.NetworkProtocolNumber = header.IPv4ProtocolNumber
+	_, _ = pktBuf.NetworkHeader().Consume(header.IPv4MinimumSize)
+
+	return pktBuf
+}
+
+// writeOutboundPacket queues a packet to be read from the source sink, as if
+// it had been sent by the stack.
+func writeOutboundPacket(ss *sourceSink, pkt *stack.PacketBuffer) {
+	ss.queueOutbound(pkt)
+	pkt.DecRef()
+}
+
+// readPacket starts reading a single outbound packet from the source sink.
+// The returned function waits for the packet to arrive.
+func readPacket(ss *sourceSink) func(timeout time.Duration) ([]byte, transport.NoisePublicKey, error) {
+	bufs := [][]byte{make([]byte, transport.DefaultMTU)}
+	sizes := make([]int, 1)
+	destinations := make([]transport.NoisePublicKey, 1)
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := ss.Read(bufs, sizes, destinations, 0)
+		result <- err
+	}()
+
+	return func(timeout time.Duration) ([]byte, transport.NoisePublicKey, error) {
+		select {
+		case err := <-result:
+			if err != nil {
+				return nil, transport.NoisePublicKey{}, err
+			}
+
+			return bufs[0][:sizes[0]], destinations[0], nil
+		case <-time.After(timeout):
+			return nil, transport.NoisePublicKey{}, fmt.Errorf("timed out waiting for packet")
+		}
+	}
+}
+
+// peerCounters returns the counters, kept by the network stack, of a peer.
+func peerCounters(n *noisyNet, name string) PeerStatus {
+	n.peersMu.RLock()
+	defer n.peersMu.RUnlock()
+
+	var status PeerStatus
+	n.peerCountersLocked(n.peerNames[name], &status)
+	return status
+}
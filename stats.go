@@ -0,0 +1,515 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"cmp"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+// StackStats is a point in time snapshot of the userspace network stack's
+// counters. All counters are cumulative since the stack was created.
+type StackStats struct {
+	// QueuedPackets is the number of outbound packets currently waiting in the
+	// endpoint queue to be read by the transport.
+	QueuedPackets int
+	// DroppedPackets is the number of packets dropped by the transport layer.
+	DroppedPackets uint64
+	// NIC contains statistics for the stack's network interface.
+	NIC NICStats
+	// IP contains statistics for the IPv4 and IPv6 network layers.
+	IP IPStats
+	// TCP contains statistics for the TCP transport layer.
+	TCP TCPStats
+}
+
+// NICStats contains network interface statistics.
+type NICStats struct {
+	// PacketsReceived is the number of packets received by the interface.
+	PacketsReceived uint64
+	// BytesReceived is the number of bytes received by the interface.
+	BytesReceived uint64
+	// PacketsSent is the number of packets sent by the interface.
+	PacketsSent uint64
+	// BytesSent is the number of bytes sent by the interface.
+	BytesSent uint64
+	// TxPacketsDroppedNoBufferSpace is the number of outbound packets dropped
+	// because the endpoint queue was full.
+	TxPacketsDroppedNoBufferSpace uint64
+	// MalformedL4PacketsReceived is the number of packets received with a
+	// malformed transport layer header.
+	MalformedL4PacketsReceived uint64
+}
+
+// IPStats contains network layer statistics.
+type IPStats struct {
+	// PacketsReceived is the number of IP packets received.
+	PacketsReceived uint64
+	// PacketsDelivered is the number of IP packets delivered to the transport layer.
+	PacketsDelivered uint64
+	// PacketsSent is the number of IP packets sent.
+	PacketsSent uint64
+	// MalformedPacketsReceived is the number of IP packets dropped due to a
+	// malformed header.
+	MalformedPacketsReceived uint64
+	// MalformedFragmentsReceived is the number of IP fragments dropped due to
+	// a malformed header.
+	MalformedFragmentsReceived uint64
+	// InvalidDestinationAddressesReceived is the number of IP packets received
+	// with an unknown or invalid destination address.
+	InvalidDestinationAddressesReceived uint64
+	// OutgoingPacketErrors is the number of IP packets which failed to send.
+	OutgoingPacketErrors uint64
+}
+
+// TCPStats contains TCP statistics.
+type TCPStats struct {
+	// ActiveConnectionOpenings is the number of connections opened by dialing.
+	ActiveConnectionOpenings uint64
+	// PassiveConnectionOpenings is the number of connections opened by accepting.
+	PassiveConnectionOpenings uint64
+	// CurrentEstablished is the number of connections currently established.
+	CurrentEstablished uint64
+	// FailedConnectionAttempts is the number of dials that failed.
+	FailedConnectionAttempts uint64
+	// Retransmits is the number of retransmitted segments.
+	Retransmits uint64
+	// Timeouts is the number of retransmission timeouts.
+	Timeouts uint64
+	// ResetsSent is the number of RST segments sent.
+	ResetsSent uint64
+	// ResetsReceived is the number of RST segments received.
+	ResetsReceived uint64
+	// InvalidSegmentsReceived is the number of segments dropped due to being invalid.
+	InvalidSegmentsReceived uint64
+	// ListenOverflowSynDrop is the number of SYNs dropped due to a full accept queue.
+	ListenOverflowSynDrop uint64
+	// RejectedConnections is the number of connection attempts from peers that
+	// were reset for exceeding the connection limits (see
+	// StackConfig.MaxConnections and StackConfig.MaxConnectionsPerPeer).
+	RejectedConnections uint64
+}
+
+// StackStats returns a snapshot of the network stack's statistics.
+func (n *noisyNet) StackStats() StackStats {
+	s := n.stack.Stats()
+
+	return StackStats{
+		QueuedPackets:  n.ep.NumQueued(),
+		DroppedPackets: s.DroppedPackets.Value(),
+		NIC: NICStats{
+			PacketsReceived:               s.NICs.Rx.Packets.Value(),
+			BytesReceived:                 s.NICs.Rx.Bytes.Value(),
+			PacketsSent:                   s.NICs.Tx.Packets.Value(),
+			BytesSent:                     s.NICs.Tx.Bytes.Value(),
+			TxPacketsDroppedNoBufferSpace: s.NICs.TxPacketsDroppedNoBufferSpace.Value(),
+			MalformedL4PacketsReceived:    s.NICs.MalformedL4RcvdPackets.Value(),
+		},
+		IP: IPStats{
+			PacketsReceived:                     s.IP.PacketsReceived.Value(),
+			PacketsDelivered:                    s.IP.PacketsDelivered.Value(),
+			PacketsSent:                         s.IP.PacketsSent.Value(),
+			MalformedPacketsReceived:            s.IP.MalformedPacketsReceived.Value(),
+			MalformedFragmentsReceived:          s.IP.MalformedFragmentsReceived.Value(),
+			InvalidDestinationAddressesReceived: s.IP.InvalidDestinationAddressesReceived.Value(),
+			OutgoingPacketErrors:                s.IP.OutgoingPacketErrors.Value(),
+		},
+		TCP: TCPStats{
+			ActiveConnectionOpenings:  s.TCP.ActiveConnectionOpenings.Value(),
+			PassiveConnectionOpenings: s.TCP.PassiveConnectionOpenings.Value(),
+			CurrentEstablished:        s.TCP.CurrentEstablished.Value(),
+			FailedConnectionAttempts:  s.TCP.FailedConnectionAttempts.Value(),
+			Retransmits:               s.TCP.Retransmits.Value(),
+			Timeouts:                  s.TCP.Timeouts.Value(),
+			ResetsSent:                s.TCP.ResetsSent.Value(),
+			ResetsReceived:            s.TCP.ResetsReceived.Value(),
+			InvalidSegmentsReceived:   s.TCP.InvalidSegmentsReceived.Value(),
+			ListenOverflowSynDrop:     s.TCP.ListenOverflowSynDrop.Value(),
+			RejectedConnections:       n.rejectedConnections.Load(),
+		},
+	}
+}
+
+// peerCountersLocked fills in the counters of a peer kept by the network
+// stack (eg. of the packets dropped by its rate limits). peersMu must be held.
+func (n *noisyNet) peerCountersLocked(pk transport.NoisePublicKey, status *PeerStatus) {
+	if limiter, ok := n.rateLimiters[pk]; ok {
+		status.RateLimitedPackets = limiter.droppedPackets.Load()
+		status.RateLimitedBytes = limiter.droppedBytes.Load()
+	}
+
+	if limiter, ok := n.outboundRateLimiters[pk]; ok {
+		status.OutboundRateLimitedPackets = limiter.droppedPackets.Load()
+		status.OutboundRateLimitedBytes = limiter.droppedBytes.Load()
+	}
+
+	if spoofed, ok := n.spoofedPackets[pk]; ok {
+		status.SpoofedPackets = spoofed.Load()
+	}
+
+	if rejected, ok := n.peerRejectedConnections[pk]; ok {
+		status.RejectedConnections = rejected.Load()
+	}
+}
+
+// PeerStatus describes how a peer is currently being reached, along with its
+// counters. Counters are cumulative since the peer was added.
+type PeerStatus struct {
+	// Name is the name of the peer, if it has one.
+	Name string
+	// PublicKey is the encoded public key of the peer.
+	PublicKey string
+	// Tags are the peer's tags, if any.
+	Tags []string
+	// AllowedIPs are the prefixes routed to the peer (ie. its addresses, and
+	// any subnets it routes for).
+	AllowedIPs []netip.Prefix
+	// Endpoint is the endpoint packets are currently sent to, if any.
+	Endpoint string
+	// Relayed is whether packets are currently sent via the relay.
+	Relayed bool
+	// CandidateEndpoints are the endpoints the peer has told us it might be
+	// reachable at (eg. its public endpoints, discovered using STUN).
+	CandidateEndpoints []netip.AddrPort
+	// LastHandshake is the time of the most recent completed handshake, or the
+	// zero time if no handshake has completed.
+	LastHandshake time.Time
+	// HandshakesCompleted is the number of handshakes completed with the peer.
+	HandshakesCompleted uint64
+	// HandshakesFailed is the number of handshake attempts that timed out.
+	HandshakesFailed uint64
+	// RxBytes is the number of bytes received from the peer (of the encrypted
+	// messages exchanged with it).
+	RxBytes uint64
+	// TxBytes is the number of bytes sent to the peer.
+	TxBytes uint64
+	// RxPackets is the number of messages received from the peer.
+	RxPackets uint64
+	// TxPackets is the number of messages sent to the peer.
+	TxPackets uint64
+	// RateLimitedPackets is the number of inbound packets from the peer that
+	// were dropped for exceeding its rate limit.
+	RateLimitedPackets uint64
+	// RateLimitedBytes is the number of inbound bytes from the peer that
+	// were dropped for exceeding its rate limit.
+	RateLimitedBytes uint64
+	// OutboundRateLimitedPackets is the number of outbound packets to the peer
+	// that were dropped for exceeding its outbound rate limit.
+	OutboundRateLimitedPackets uint64
+	// OutboundRateLimitedBytes is the number of outbound bytes to the peer
+	// that were dropped for exceeding its outbound rate limit.
+	OutboundRateLimitedBytes uint64
+	// SpoofedPackets is the number of inbound packets from the peer that were
+	// dropped as their source address isn't routed to the peer.
+	SpoofedPackets uint64
+	// RejectedConnections is the number of connection attempts from the peer
+	// that were reset for exceeding the connection limits.
+	RejectedConnections uint64
+	// PersistentKeepalive is the interval at which keepalives are sent to the
+	// peer regardless of other traffic, or zero if they are disabled.
+	PersistentKeepalive time.Duration
+	// Compression contains counters for the packets compressed, if
+	// compression is enabled for the peer.
+	Compression CompressionStats
+	// PostQuantum is whether a post-quantum shared secret was mixed into the
+	// handshake of the current session with the peer.
+	PostQuantum bool
+	// SessionActive is whether there is a current session with the peer, it
+	// is false before the first handshake, and once an idle session expires.
+	SessionActive bool
+	// MTU is the MTU of the path to the peer, this is the socket's MTU unless
+	// path MTU discovery has found a smaller one.
+	MTU int
+	// Health is the result of actively checking the health of the peer, it is
+	// always HealthUnknown unless health checking is enabled.
+	Health Health
+	// HealthCheckRTT is the round trip time of the most recently answered
+	// health check ping.
+	HealthCheckRTT time.Duration
+}
+
+// CompressionStats contains counters for the packets exchanged with a peer
+// while compression was agreed with it.
+type CompressionStats struct {
+	// UncompressedTxBytes is the size of the packets sent, before compression.
+	UncompressedTxBytes uint64
+	// CompressedTxBytes is the size of the packets sent, after compression.
+	CompressedTxBytes uint64
+	// UncompressedRxBytes is the size of the packets received, after
+	// decompression.
+	UncompressedRxBytes uint64
+	// CompressedRxBytes is the size of the packets received, before
+	// decompression.
+	CompressedRxBytes uint64
+}
+
+// TxRatio returns the ratio of the uncompressed size of the packets sent to
+// their compressed size (eg. 2 if they were halved), or zero if none have been
+// sent.
+func (c CompressionStats) TxRatio() float64 {
+	if c.CompressedTxBytes == 0 {
+		return 0
+	}
+
+	return float64(c.UncompressedTxBytes) / float64(c.CompressedTxBytes)
+}
+
+// RxRatio is like TxRatio, but for the packets received.
+func (c CompressionStats) RxRatio() float64 {
+	if c.CompressedRxBytes == 0 {
+		return 0
+	}
+
+	return float64(c.UncompressedRxBytes) / float64(c.CompressedRxBytes)
+}
+
+// PeerStatus returns the status of a peer, identified by its name or encoded
+// public key.
+func (s *NoisySocket) PeerStatus(peer string) (PeerStatus, error) {
+	pk, err := s.lookupPeer(peer)
+	if err != nil {
+		return PeerStatus{}, err
+	}
+
+	status, ok := s.peerStatus(pk)
+	if !ok {
+		return PeerStatus{}, fmt.Errorf("%w %q", ErrUnknownPeer, peer)
+	}
+
+	return status, nil
+}
+
+// PeerStatuses returns the status of every peer, ordered by name and then
+// public key (much like `wg show`).
+func (s *NoisySocket) PeerStatuses() []PeerStatus {
+	s.peerConfigsMu.Lock()
+	publicKeys := make([]transport.NoisePublicKey, 0, len(s.peerConfigs))
+	for pk := range s.peerConfigs {
+		publicKeys = append(publicKeys, pk)
+	}
+	s.peerConfigsMu.Unlock()
+
+	statuses := make([]PeerStatus, 0, len(publicKeys))
+	for _, pk := range publicKeys {
+		if status, ok := s.peerStatus(pk); ok {
+			statuses = append(statuses, status)
+		}
+	}
+
+	slices.SortFunc(statuses, func(a, b PeerStatus) int {
+		if c := strings.Compare(a.Name, b.Name); c != 0 {
+			return c
+		}
+		return strings.Compare(a.PublicKey, b.PublicKey)
+	})
+
+	return statuses
+}
+
+func (s *NoisySocket) peerStatus(pk transport.NoisePublicKey) (PeerStatus, bool) {
+	p := s.transport.LookupPeer(pk)
+	if p == nil {
+		return PeerStatus{}, false
+	}
+
+	s.peerConfigsMu.Lock()
+	name := s.peerConfigs[pk].Name
+	tags := slices.Clone(s.peerConfigs[pk].Tags)
+	s.peerConfigsMu.Unlock()
+
+	stats := p.Stats()
+
+	var health Health
+	var healthCheckRTT time.Duration
+	if s.healthChecker != nil {
+		health, healthCheckRTT = s.healthChecker.status(pk)
+	}
+
+	status := PeerStatus{
+		Name:                name,
+		PublicKey:           pk.String(),
+		Tags:                tags,
+		AllowedIPs:          s.sourceSink.PeerPrefixes(pk),
+		Endpoint:            stats.Endpoint,
+		Relayed:             stats.Relayed,
+		CandidateEndpoints:  stats.CandidateEndpoints,
+		LastHandshake:       stats.LastHandshake,
+		HandshakesCompleted: stats.HandshakesCompleted,
+		HandshakesFailed:    stats.HandshakesFailed,
+		RxBytes:             stats.RxBytes,
+		TxBytes:             stats.TxBytes,
+		RxPackets:           stats.RxPackets,
+		TxPackets:           stats.TxPackets,
+		PersistentKeepalive: stats.PersistentKeepaliveInterval,
+		Compression: CompressionStats{
+			UncompressedTxBytes: stats.UncompressedTxBytes,
+			CompressedTxBytes:   stats.CompressedTxBytes,
+			UncompressedRxBytes: stats.UncompressedRxBytes,
+			CompressedRxBytes:   stats.CompressedRxBytes,
+		},
+		PostQuantum:    stats.PostQuantum,
+		SessionActive:  stats.SessionActive,
+		MTU:            s.sourceSink.PeerMTU(pk),
+		Health:         health,
+		HealthCheckRTT: healthCheckRTT,
+	}
+
+	s.peersMu.RLock()
+	s.peerCountersLocked(pk, &status)
+	s.peersMu.RUnlock()
+
+	return status, true
+}
+
+// PublicEndpoints returns the socket's public endpoints, as most recently
+// discovered using the configured STUN servers.
+func (s *NoisySocket) PublicEndpoints() []netip.AddrPort {
+	if s.endpointDiscovery == nil {
+		return nil
+	}
+
+	return s.endpointDiscovery.Endpoints()
+}
+
+// RateLimitStats contains counters for the global rate limits.
+type RateLimitStats struct {
+	// RateLimitedPackets is the number of inbound packets dropped for
+	// exceeding the global rate limit.
+	RateLimitedPackets uint64
+	// RateLimitedBytes is the number of inbound bytes dropped for exceeding
+	// the global rate limit.
+	RateLimitedBytes uint64
+	// OutboundRateLimitedPackets is the number of outbound packets dropped for
+	// exceeding the global outbound rate limit.
+	OutboundRateLimitedPackets uint64
+	// OutboundRateLimitedBytes is the number of outbound bytes dropped for
+	// exceeding the global outbound rate limit.
+	OutboundRateLimitedBytes uint64
+}
+
+// RateLimitStats returns a snapshot of the statistics for the global rate
+// limits. Counters are reset whenever the limits are changed.
+func (s *NoisySocket) RateLimitStats() RateLimitStats {
+	var stats RateLimitStats
+
+	if limiter := s.sourceSink.globalRateLimiter.Load(); limiter != nil {
+		stats.RateLimitedPackets = limiter.droppedPackets.Load()
+		stats.RateLimitedBytes = limiter.droppedBytes.Load()
+	}
+
+	if limiter := s.sourceSink.globalOutboundRateLimiter.Load(); limiter != nil {
+		stats.OutboundRateLimitedPackets = limiter.droppedPackets.Load()
+		stats.OutboundRateLimitedBytes = limiter.droppedBytes.Load()
+	}
+
+	return stats
+}
+
+// HandshakeStats contains counters for the protection against floods of
+// handshake messages (see v1alpha1.HandshakeLimitsConfig).
+type HandshakeStats struct {
+	// CookieReplies is the number of cookie replies sent to handshake messages
+	// without a valid cookie.
+	CookieReplies uint64
+	// RateLimited is the number of handshake messages dropped for exceeding
+	// the per source rate limit.
+	RateLimited uint64
+	// ConcurrencyLimited is the number of handshake messages dropped as too
+	// many were already queued, or being processed.
+	ConcurrencyLimited uint64
+}
+
+// HandshakeStats returns a snapshot of the statistics for the handshake flood
+// protection. Counters are cumulative since the socket was created.
+func (s *NoisySocket) HandshakeStats() HandshakeStats {
+	stats := s.transport.HandshakeStats()
+
+	return HandshakeStats{
+		CookieReplies:      stats.CookieReplies,
+		RateLimited:        stats.RateLimited,
+		ConcurrencyLimited: stats.ConcurrencyLimited,
+	}
+}
+
+// Stats is a point in time snapshot of a socket's traffic counters.
+type Stats struct {
+	// Peers contains the status, and counters, of each peer, as returned by
+	// PeerStatuses().
+	Peers []PeerStatus
+	// Connections contains the counters of each active TCP connection in the
+	// network stack, ordered by local and then remote address.
+	Connections []ConnectionStats
+}
+
+// ConnectionStats contains the counters of a TCP or UDP endpoint (eg. a
+// connection, or a listener).
+type ConnectionStats struct {
+	// Network is either "tcp" or "udp".
+	Network string
+	// LocalAddr is the local address of the connection, the address is
+	// unspecified if it is bound to all of the socket's addresses.
+	LocalAddr netip.AddrPort
+	// RemoteAddr is the remote address of the connection, or the zero value if
+	// it isn't connected (eg. a listener).
+	RemoteAddr netip.AddrPort
+	// PeerName is the name of the peer responsible for the remote address, if
+	// it has one.
+	PeerName string
+	// PeerPublicKey is the encoded public key of the peer responsible for the
+	// remote address, or an empty string if it doesn't belong to a peer.
+	PeerPublicKey string
+	// State is the state of the connection, eg. "ESTABLISHED" or "LISTEN" for
+	// TCP, and "BOUND" or "CONNECTED" for UDP.
+	State string
+	// BytesReceived is the number of bytes read from the connection.
+	BytesReceived uint64
+	// BytesSent is the number of bytes written to the connection.
+	BytesSent uint64
+	// RTT is the smoothed round trip time, of TCP connections.
+	RTT time.Duration
+}
+
+// Stats returns a snapshot of the traffic counters of the socket's peers, and
+// of its active TCP connections.
+func (s *NoisySocket) Stats() Stats {
+	var stats Stats
+
+	stats.Peers = s.PeerStatuses()
+	stats.Connections = s.noisyNet.connectionStats()
+
+	return stats
+}
+
+func (n *noisyNet) connectionStats() []ConnectionStats {
+	return n.connections(func(transProto tcpip.TransportProtocolNumber, state uint32) bool {
+		if transProto != tcp.ProtocolNumber {
+			return false
+		}
+
+		// Only connections, not listeners (or sockets that are yet to connect).
+		switch tcp.EndpointState(state) {
+		case tcp.StateInitial, tcp.StateBound, tcp.StateListen, tcp.StateConnecting, tcp.StateClose, tcp.StateError:
+			return false
+		}
+
+		return true
+	})
+}
+
+func compareAddrPort(a, b netip.AddrPort) int {
+	if c := a.Addr().Compare(b.Addr()); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.Port(), b.Port())
+}
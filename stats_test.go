@@ -0,0 +1,40 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+func TestStackStats(t *testing.T) {
+	localAddr := netip.MustParseAddr("10.7.0.1")
+	peerAddr := netip.MustParseAddr("10.7.0.2")
+
+	ss, n := newTestSourceSink(t, []netip.Addr{localAddr})
+
+	stats := n.StackStats()
+	require.Zero(t, stats.IP.PacketsReceived)
+	require.Zero(t, stats.IP.MalformedPacketsReceived)
+
+	// An IPv4 packet with a corrupt header checksum.
+	pkt := newIPv4Fragment(tcpip.AddrFrom4(peerAddr.As4()), tcpip.AddrFrom4(localAddr.As4()), 1, 0, false, make([]byte, header.TCPMinimumSize))
+	header.IPv4(pkt).SetChecksum(0xdead)
+
+	_, err := ss.Write([][]byte{pkt}, nil, 0)
+	require.NoError(t, err)
+
+	stats = n.StackStats()
+	require.Equal(t, uint64(1), stats.NIC.PacketsReceived)
+	require.Equal(t, uint64(1), stats.IP.PacketsReceived)
+	require.Equal(t, uint64(1), stats.IP.MalformedPacketsReceived)
+	require.Zero(t, stats.IP.PacketsDelivered)
+	require.Zero(t, stats.QueuedPackets)
+}
@@ -0,0 +1,488 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"errors"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// copyBufferSize is the size of the buffers that data is copied through, to,
+// or from, a TCP connection. It matches the largest super-packet the stack
+// builds.
+const copyBufferSize = 64 << 10
+
+var copyBufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, copyBufferSize)
+		return &buf
+	},
+}
+
+var (
+	_ io.ReaderFrom = (*tcpConn)(nil)
+	_ io.WriterTo   = (*tcpConn)(nil)
+)
+
+// errShortFile is returned to the stack, in place of io.EOF, when a file ends
+// before its expected size. The stack expects payloads to be as long as they
+// claim, and would otherwise keep reading forever.
+var errShortFile = errors.New("file is shorter than expected")
+
+// tcpConn is a TCP connection that can be copied to, and from, efficiently.
+// It implements io.ReaderFrom and io.WriterTo, so that io.Copy uses a pooled
+// buffer (or for regular files, no intermediate buffer at all), and
+// WriteBuffers, for vectored writes.
+type tcpConn struct {
+	*gonet.TCPConn
+	ep tcpip.Endpoint
+	wq *waiter.Queue
+	// The deadlines of reads, and writes, that bypass gonet.
+	readDeadline  connDeadline
+	writeDeadline connDeadline
+}
+
+func newTCPConn(wq *waiter.Queue, ep tcpip.Endpoint) *tcpConn {
+	return &tcpConn{
+		TCPConn: gonet.NewTCPConn(wq, ep),
+		ep:      ep,
+		wq:      wq,
+	}
+}
+
+// SetKeepAlive sets whether keepalive probes are sent, once the connection
+// has been idle for the keepalive period, so that a peer that has gone away
+// (eg. behind a NAT that dropped its mapping) is detected.
+func (c *tcpConn) SetKeepAlive(keepalive bool) error {
+	c.ep.SocketOptions().SetKeepAlive(keepalive)
+	return nil
+}
+
+// SetKeepAlivePeriod sets how long the connection must be idle before the
+// first keepalive probe is sent, and the interval between probes. Like
+// *net.TCPConn, it's rounded up to a whole number of seconds.
+func (c *tcpConn) SetKeepAlivePeriod(d time.Duration) error {
+	d = max((d+time.Second-1)/time.Second, 1) * time.Second
+
+	idle := tcpip.KeepaliveIdleOption(d)
+	if err := c.ep.SetSockOpt(&idle); err != nil {
+		return c.opError("set", mapTCPIPErr(err))
+	}
+
+	interval := tcpip.KeepaliveIntervalOption(d)
+	if err := c.ep.SetSockOpt(&interval); err != nil {
+		return c.opError("set", mapTCPIPErr(err))
+	}
+
+	return nil
+}
+
+// SetNoDelay sets whether writes are sent straight away (the default), or
+// delayed so that small writes can be coalesced (Nagle's algorithm).
+func (c *tcpConn) SetNoDelay(noDelay bool) error {
+	c.ep.SocketOptions().SetDelayOption(!noDelay)
+	return nil
+}
+
+// SetLinger sets how Close behaves when there is data still waiting to be
+// sent, or acknowledged. Like *net.TCPConn, if sec < 0 (the default) it is
+// sent in the background, if sec == 0 it is discarded and the connection is
+// reset. Otherwise, the data is sent in the background, as if sec < 0.
+func (c *tcpConn) SetLinger(sec int) error {
+	var linger tcpip.LingerOption
+	if sec >= 0 {
+		linger.Enabled = true
+		linger.Timeout = time.Duration(sec) * time.Second
+	}
+
+	c.ep.SocketOptions().SetLinger(linger)
+	return nil
+}
+
+func (c *tcpConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return c.TCPConn.SetDeadline(t)
+}
+
+func (c *tcpConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return c.TCPConn.SetReadDeadline(t)
+}
+
+func (c *tcpConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return c.TCPConn.SetWriteDeadline(t)
+}
+
+// ReadFrom implements io.ReaderFrom. Regular files are read straight into
+// the connection's send buffer, other readers are copied through a pooled
+// buffer.
+func (c *tcpConn) ReadFrom(r io.Reader) (int64, error) {
+	var limit int64 = math.MaxInt64
+	src := r
+	if lr, ok := r.(*io.LimitedReader); ok {
+		limit, src = lr.N, lr.R
+	}
+
+	var total int64
+	if f, ok := src.(file); ok {
+		var err error
+		total, err = c.readFromFile(f, limit)
+		if err != nil || total == limit {
+			if lr, ok := r.(*io.LimitedReader); ok {
+				lr.N -= total
+			}
+			return total, err
+		}
+
+		// The file couldn't be sent directly (eg. it's a pipe), or it changed
+		// size while being sent, copy what's left over.
+		if lr, ok := r.(*io.LimitedReader); ok {
+			lr.N -= total
+		}
+	}
+
+	bufp := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(bufp)
+
+	for {
+		nr, err := r.Read(*bufp)
+		if nr > 0 {
+			nw, err := c.Write((*bufp)[:nr])
+			total += int64(nw)
+			if err != nil {
+				return total, err
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			return total, nil
+		} else if err != nil {
+			return total, err
+		}
+	}
+}
+
+// readFromFile writes up to limit bytes, from a regular file's current
+// offset, into the connection's send buffer. It stops early, without an
+// error, if the file is shorter than expected (or isn't a regular file), and
+// leaves the file's offset after the bytes that were written.
+func (c *tcpConn) readFromFile(f file, limit int64) (int64, error) {
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return 0, nil
+	}
+
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, nil
+	}
+
+	p := &filePayload{f: f, offset: offset, n: min(info.Size()-offset, limit)}
+	if p.n <= 0 {
+		return 0, nil
+	}
+
+	waitEntry, notifyCh := waiter.NewChannelEntry(waiter.WritableEvents)
+	c.wq.EventRegister(&waitEntry)
+	defer c.wq.EventUnregister(&waitEntry)
+
+	var total int64
+	var writeErr error
+	for p.n > 0 && !p.short {
+		// Data the stack didn't take (eg. as it was read past a short file,
+		// or a concurrent write filled the buffer) is read again.
+		start, remaining := p.offset, p.n
+
+		n, tcpErr := c.ep.Write(p, tcpip.WriteOptions{})
+		total += n
+		p.offset, p.n = start+n, remaining-n
+
+		if tcpErr == nil {
+			continue
+		}
+
+		if _, ok := tcpErr.(*tcpip.ErrWouldBlock); ok {
+			if err := c.writeDeadline.wait(notifyCh); err != nil {
+				writeErr = c.opError("write", err)
+				break
+			}
+			continue
+		}
+
+		if _, ok := tcpErr.(*tcpip.ErrBadBuffer); ok && p.short {
+			break
+		}
+
+		writeErr = c.opError("write", mapTCPIPErr(tcpErr))
+		break
+	}
+
+	if _, err := f.Seek(p.offset, io.SeekStart); err != nil && writeErr == nil {
+		writeErr = err
+	}
+
+	return total, writeErr
+}
+
+// WriteTo implements io.WriterTo. Data is written straight from the
+// connection's receive buffer into regular files, other writers are copied
+// to through a pooled buffer (the connection can't receive while it is
+// written from, so a writer that blocks, eg. on the network, mustn't hold it).
+func (c *tcpConn) WriteTo(w io.Writer) (int64, error) {
+	if f, ok := w.(*os.File); ok {
+		if info, err := f.Stat(); err == nil && info.Mode().IsRegular() {
+			return c.writeToFile(f)
+		}
+	}
+
+	bufp := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(bufp)
+
+	var total int64
+	for {
+		nr, err := c.Read(*bufp)
+		if nr > 0 {
+			nw, err := w.Write((*bufp)[:nr])
+			total += int64(nw)
+			if err != nil {
+				return total, err
+			}
+			if nw != nr {
+				return total, io.ErrShortWrite
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			return total, nil
+		} else if err != nil {
+			return total, err
+		}
+	}
+}
+
+func (c *tcpConn) writeToFile(f *os.File) (int64, error) {
+	waitEntry, notifyCh := waiter.NewChannelEntry(waiter.ReadableEvents)
+	c.wq.EventRegister(&waitEntry)
+	defer c.wq.EventUnregister(&waitEntry)
+
+	dst := &fileWriter{f: f}
+
+	var total int64
+	for {
+		res, tcpErr := c.ep.Read(dst, tcpip.ReadOptions{})
+		total += int64(res.Count)
+
+		// The stack only reports errors writing to the file if nothing was
+		// written.
+		if dst.err != nil {
+			return total, dst.err
+		}
+
+		switch tcpErr.(type) {
+		case nil:
+		case *tcpip.ErrClosedForReceive:
+			return total, nil
+		case *tcpip.ErrWouldBlock:
+			if err := c.readDeadline.wait(notifyCh); err != nil {
+				return total, c.opError("read", err)
+			}
+		default:
+			return total, c.opError("read", mapTCPIPErr(tcpErr))
+		}
+	}
+}
+
+// WriteBuffers writes the contents of bufs, as if they had been concatenated
+// (like writev). The buffers are copied straight into the connection's send
+// buffer, so that they are sent in as few segments as possible, without first
+// being concatenated.
+func (c *tcpConn) WriteBuffers(bufs net.Buffers) (int64, error) {
+	p := &buffersPayload{bufs: bufs}
+	for _, buf := range bufs {
+		p.n += len(buf)
+	}
+
+	waitEntry, notifyCh := waiter.NewChannelEntry(waiter.WritableEvents)
+	c.wq.EventRegister(&waitEntry)
+	defer c.wq.EventUnregister(&waitEntry)
+
+	var total int64
+	for p.n > 0 {
+		n, tcpErr := c.ep.Write(p, tcpip.WriteOptions{})
+		total += n
+
+		switch tcpErr.(type) {
+		case nil:
+		case *tcpip.ErrWouldBlock:
+			if err := c.writeDeadline.wait(notifyCh); err != nil {
+				return total, c.opError("write", err)
+			}
+		default:
+			return total, c.opError("write", mapTCPIPErr(tcpErr))
+		}
+	}
+
+	return total, nil
+}
+
+func (c *tcpConn) opError(op string, err error) *net.OpError {
+	return &net.OpError{Op: op, Net: "tcp", Source: c.LocalAddr(), Addr: c.RemoteAddr(), Err: err}
+}
+
+// file is a file that can be read from at any offset, eg. an *os.File (even
+// once os.File.WriteTo has wrapped it, to hide that method from io.Copy).
+type file interface {
+	io.ReaderAt
+	io.Seeker
+	Stat() (os.FileInfo, error)
+}
+
+// filePayload is a tcpip.Payloader that reads the next n bytes of a file,
+// from offset.
+type filePayload struct {
+	f      file
+	offset int64
+	n      int64
+	// short is set if the file ended before n bytes were read.
+	short bool
+}
+
+func (p *filePayload) Len() int {
+	return int(min(p.n, math.MaxInt32))
+}
+
+func (p *filePayload) Read(b []byte) (int, error) {
+	if p.n <= 0 {
+		return 0, io.EOF
+	}
+
+	if int64(len(b)) > p.n {
+		b = b[:p.n]
+	}
+
+	n, err := p.f.ReadAt(b, p.offset)
+	p.offset += int64(n)
+	p.n -= int64(n)
+
+	if errors.Is(err, io.EOF) {
+		if p.n > 0 {
+			p.short = true
+			return n, errShortFile
+		}
+		err = nil
+	}
+
+	return n, err
+}
+
+// buffersPayload is a tcpip.Payloader that reads across a list of buffers.
+type buffersPayload struct {
+	bufs net.Buffers
+	n    int
+}
+
+func (p *buffersPayload) Len() int {
+	return p.n
+}
+
+func (p *buffersPayload) Read(b []byte) (int, error) {
+	if p.n == 0 {
+		return 0, io.EOF
+	}
+
+	var n int
+	for n < len(b) && len(p.bufs) > 0 {
+		copied := copy(b[n:], p.bufs[0])
+		n += copied
+
+		p.bufs[0] = p.bufs[0][copied:]
+		if len(p.bufs[0]) == 0 {
+			p.bufs = p.bufs[1:]
+		}
+	}
+	p.n -= n
+
+	return n, nil
+}
+
+// fileWriter records the error that stopped a write to a file, which the
+// stack would otherwise replace.
+type fileWriter struct {
+	f   *os.File
+	err error
+}
+
+func (w *fileWriter) Write(b []byte) (int, error) {
+	n, err := w.f.Write(b)
+	if err != nil {
+		w.err = err
+	}
+
+	return n, err
+}
+
+// connDeadline is the deadline of a connection's reads, or writes.
+type connDeadline struct {
+	mu       sync.Mutex // protects deadline and changed
+	deadline time.Time
+	changed  chan struct{} // closed when the deadline is changed
+}
+
+func (d *connDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.deadline = t
+
+	// Wake up any pending waits, so that they pick up the new deadline.
+	if d.changed != nil {
+		close(d.changed)
+		d.changed = nil
+	}
+}
+
+// wait waits until notifyCh is notified, or the deadline is changed. It
+// returns os.ErrDeadlineExceeded once the deadline has passed.
+func (d *connDeadline) wait(notifyCh <-chan struct{}) error {
+	d.mu.Lock()
+	if d.changed == nil {
+		d.changed = make(chan struct{})
+	}
+	deadline, changed := d.deadline, d.changed
+	d.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timeLeft := time.Until(deadline)
+		if timeLeft <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+
+		timer := time.NewTimer(timeLeft)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-notifyCh:
+	case <-changed:
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+
+	return nil
+}
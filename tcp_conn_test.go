@@ -0,0 +1,319 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoisySocket_TCPConnCopy(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverSocket, clientSocket, err := noisysockets.Pipe(logger, &v1alpha1.Config{
+		Name:       "server",
+		PrivateKey: serverPrivateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{{
+			Name:      "client",
+			PublicKey: clientPrivateKey.PublicKey().String(),
+			IPs:       []string{"10.7.0.2"},
+		}},
+	}, &v1alpha1.Config{
+		Name:       "client",
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{{
+			Name:      "server",
+			PublicKey: serverPrivateKey.PublicKey().String(),
+			IPs:       []string{"10.7.0.1"},
+		}},
+	}, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+		require.NoError(t, clientSocket.Close())
+	})
+
+	lis, err := serverSocket.Listen("tcp", ":80")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = lis.Close()
+	})
+
+	// connect returns both ends of a new connection.
+	connect := func(t *testing.T) (net.Conn, net.Conn) {
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			conn, err := lis.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- conn
+		}()
+
+		clientConn, err := clientSocket.Dial("tcp", "server:80")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = clientConn.Close()
+		})
+
+		serverConn, ok := <-accepted
+		require.True(t, ok)
+		t.Cleanup(func() {
+			_ = serverConn.Close()
+		})
+
+		return clientConn, serverConn
+	}
+
+	// receive returns everything read from conn, until it is closed.
+	receive := func(conn net.Conn) <-chan []byte {
+		received := make(chan []byte, 1)
+		go func() {
+			var buf bytes.Buffer
+			_, _ = buf.ReadFrom(conn)
+			received <- buf.Bytes()
+		}()
+
+		return received
+	}
+
+	data := make([]byte, 4<<20)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "data")
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+
+	t.Run("ReadFrom File", func(t *testing.T) {
+		clientConn, serverConn := connect(t)
+		received := receive(serverConn)
+
+		f, err := os.Open(path)
+		require.NoError(t, err)
+		defer f.Close()
+
+		// Start part way through, the file's offset is respected.
+		_, err = f.Seek(1000, io.SeekStart)
+		require.NoError(t, err)
+
+		n, err := io.Copy(clientConn, f)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(data)-1000), n)
+
+		offset, err := f.Seek(0, io.SeekCurrent)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(data)), offset)
+
+		require.NoError(t, clientConn.Close())
+		require.Equal(t, data[1000:], <-received)
+	})
+
+	t.Run("ReadFrom Limited File", func(t *testing.T) {
+		clientConn, serverConn := connect(t)
+		received := receive(serverConn)
+
+		f, err := os.Open(path)
+		require.NoError(t, err)
+		defer f.Close()
+
+		n, err := io.CopyN(clientConn, f, 100_000)
+		require.NoError(t, err)
+		require.Equal(t, int64(100_000), n)
+
+		require.NoError(t, clientConn.Close())
+		require.Equal(t, data[:100_000], <-received)
+	})
+
+	t.Run("ReadFrom Reader", func(t *testing.T) {
+		clientConn, serverConn := connect(t)
+		received := receive(serverConn)
+
+		n, err := clientConn.(io.ReaderFrom).ReadFrom(io.MultiReader(bytes.NewReader(data[:1000]), bytes.NewReader(data[1000:])))
+		require.NoError(t, err)
+		require.Equal(t, int64(len(data)), n)
+
+		require.NoError(t, clientConn.Close())
+		require.Equal(t, data, <-received)
+	})
+
+	t.Run("WriteTo File", func(t *testing.T) {
+		clientConn, serverConn := connect(t)
+
+		go func() {
+			_, _ = serverConn.Write(data)
+			_ = serverConn.Close()
+		}()
+
+		f, err := os.Create(filepath.Join(t.TempDir(), "received"))
+		require.NoError(t, err)
+		defer f.Close()
+
+		n, err := io.Copy(f, clientConn)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(data)), n)
+
+		received, err := os.ReadFile(f.Name())
+		require.NoError(t, err)
+		require.Equal(t, data, received)
+	})
+
+	t.Run("WriteTo Writer", func(t *testing.T) {
+		clientConn, serverConn := connect(t)
+
+		go func() {
+			_, _ = serverConn.Write(data)
+			_ = serverConn.Close()
+		}()
+
+		var buf bytes.Buffer
+		n, err := clientConn.(io.WriterTo).WriteTo(&buf)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(data)), n)
+		require.Equal(t, data, buf.Bytes())
+	})
+
+	t.Run("WriteTo Deadline", func(t *testing.T) {
+		clientConn, _ := connect(t)
+
+		f, err := os.Create(filepath.Join(t.TempDir(), "received"))
+		require.NoError(t, err)
+		defer f.Close()
+
+		require.NoError(t, clientConn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+
+		_, err = io.Copy(f, clientConn)
+		require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	})
+
+	t.Run("WriteBuffers", func(t *testing.T) {
+		clientConn, serverConn := connect(t)
+		received := receive(serverConn)
+
+		vw, ok := clientConn.(interface {
+			WriteBuffers(bufs net.Buffers) (int64, error)
+		})
+		require.True(t, ok)
+
+		n, err := vw.WriteBuffers(net.Buffers{data[:10], data[10:100_000], nil, data[100_000:]})
+		require.NoError(t, err)
+		require.Equal(t, int64(len(data)), n)
+
+		require.NoError(t, clientConn.Close())
+		require.Equal(t, data, <-received)
+	})
+}
+
+func TestNoisySocket_TCPConnOptions(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverSocket, clientSocket, err := noisysockets.Pipe(logger, &v1alpha1.Config{
+		Name:       "server",
+		PrivateKey: serverPrivateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{{
+			Name:      "client",
+			PublicKey: clientPrivateKey.PublicKey().String(),
+			IPs:       []string{"10.7.0.2"},
+		}},
+	}, &v1alpha1.Config{
+		Name:       "client",
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{{
+			Name:      "server",
+			PublicKey: serverPrivateKey.PublicKey().String(),
+			IPs:       []string{"10.7.0.1"},
+		}},
+	}, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+		require.NoError(t, clientSocket.Close())
+	})
+
+	lis, err := serverSocket.Listen("tcp", ":80")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = lis.Close()
+	})
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		defer close(accepted)
+
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn
+	}()
+
+	clientConn, err := clientSocket.Dial("tcp", "server:80")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = clientConn.Close()
+	})
+
+	serverConn, ok := <-accepted
+	require.True(t, ok)
+	t.Cleanup(func() {
+		_ = serverConn.Close()
+	})
+
+	conn, ok := clientConn.(interface {
+		SetKeepAlive(keepalive bool) error
+		SetKeepAlivePeriod(d time.Duration) error
+		SetNoDelay(noDelay bool) error
+		SetLinger(sec int) error
+	})
+	require.True(t, ok)
+
+	require.NoError(t, conn.SetKeepAlive(true))
+	require.NoError(t, conn.SetKeepAlivePeriod(1500*time.Millisecond))
+	require.NoError(t, conn.SetNoDelay(false))
+
+	_, err = clientConn.Write([]byte("Hello, server!"))
+	require.NoError(t, err)
+
+	buf := make([]byte, len("Hello, server!"))
+	_, err = io.ReadFull(serverConn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "Hello, server!", string(buf))
+
+	// With a zero linger, closing resets the connection.
+	require.NoError(t, conn.SetLinger(0))
+	require.NoError(t, clientConn.Close())
+
+	_, err = serverConn.Read(buf)
+	require.ErrorContains(t, err, "connection reset by peer")
+}
@@ -0,0 +1,330 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+const (
+	// defaultTracerouteMaxHops is the number of hops probed by default.
+	defaultTracerouteMaxHops = 30
+	// defaultTracerouteTimeout is how long to wait for a response from each hop
+	// by default.
+	defaultTracerouteTimeout = 2 * time.Second
+)
+
+// TracerouteOption configures a call to Traceroute().
+type TracerouteOption func(*tracerouteOptions)
+
+type tracerouteOptions struct {
+	maxHops int
+	timeout time.Duration
+}
+
+// WithTracerouteMaxHops sets the maximum number of hops to probe, it defaults
+// to 30.
+func WithTracerouteMaxHops(maxHops int) TracerouteOption {
+	return func(opts *tracerouteOptions) {
+		opts.maxHops = maxHops
+	}
+}
+
+// WithTracerouteTimeout sets how long to wait for a response from each hop,
+// it defaults to two seconds.
+func WithTracerouteTimeout(timeout time.Duration) TracerouteOption {
+	return func(opts *tracerouteOptions) {
+		opts.timeout = timeout
+	}
+}
+
+// TracerouteHop is a hop on the path to a host.
+type TracerouteHop struct {
+	// TTL is the TTL (or hop limit) of the probe that this hop responded to.
+	TTL int
+	// Addr is the address of the hop, it is invalid if the hop didn't respond.
+	Addr netip.Addr
+	// PeerName is the name of the peer that the hop's address is routed to, if
+	// any.
+	PeerName string
+	// RTT is the round trip time of the hop's response.
+	RTT time.Duration
+}
+
+// Traceroute discovers the path to a host (eg. the name of a peer) through the
+// mesh, by sending ICMP echo requests with increasing TTLs. Routers on the path
+// (ie. peers with forwarding enabled) respond with ICMP time exceeded errors.
+// The last hop is the host itself, if it was reached within the maximum number
+// of hops.
+func (s *NoisySocket) Traceroute(ctx context.Context, host string, opts ...TracerouteOption) ([]TracerouteHop, error) {
+	options := tracerouteOptions{
+		maxHops: defaultTracerouteMaxHops,
+		timeout: defaultTracerouteTimeout,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	if options.maxHops <= 0 || options.maxHops > 255 {
+		return nil, fmt.Errorf("maximum hops must be between 1 and 255")
+	}
+
+	addrs, err := s.LookupHostContext(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve host %q: %w", host, err)
+	}
+
+	dst, ok := s.pingAddr(addrs)
+	if !ok {
+		return nil, errNoSuitableAddress
+	}
+
+	ss := s.sourceSink
+
+	src, ok := ss.localAddrFor(dst)
+	if !ok {
+		return nil, errNoSuitableAddress
+	}
+
+	var hops []TracerouteHop
+	for ttl := 1; ttl <= options.maxHops; ttl++ {
+		hop := TracerouteHop{TTL: ttl}
+
+		start := time.Now()
+		reply, ok := ss.probeTTL(ctx, src, dst, 0, uint8(ttl), options.timeout)
+		if err := ctx.Err(); err != nil {
+			return hops, err
+		}
+
+		if ok {
+			hop.Addr = reply.from
+			hop.RTT = time.Since(start)
+
+			ss.peersMu.RLock()
+			pk, isPeer := ss.fromPeerAddress.Lookup(reply.from)
+			ss.peersMu.RUnlock()
+			if isPeer {
+				hop.PeerName = ss.peerName(pk)
+			}
+		}
+
+		hops = append(hops, hop)
+
+		if ok && !reply.timeExceeded {
+			break
+		}
+	}
+
+	return hops, nil
+}
+
+// localAddrFor returns a local address, of the same family as dst, from which
+// to send packets to it.
+func (ss *sourceSink) localAddrFor(dst netip.Addr) (netip.Addr, bool) {
+	for _, localAddr := range ss.localAddrs.load() {
+		if localAddr.Is4() == dst.Is4() {
+			return localAddr, true
+		}
+	}
+
+	return netip.Addr{}, false
+}
+
+// ttlExceeded reports whether an inbound packet, that would be forwarded, has
+// run out of hops. If so, an ICMP time exceeded error is sent back to its
+// source (so that traceroute can discover this hop). The stack would
+// otherwise forward IPv4 packets with a TTL of one, resulting in hops being
+// invisible.
+func (ss *sourceSink) ttlExceeded(protoNumber tcpip.NetworkProtocolNumber, pkt []byte) bool {
+	var src, dst netip.Addr
+	var ttl uint8
+	switch protoNumber {
+	case header.IPv4ProtocolNumber:
+		hdr := header.IPv4(pkt)
+		src = netip.AddrFrom4(hdr.SourceAddress().As4())
+		dst = netip.AddrFrom4(hdr.DestinationAddress().As4())
+		ttl = hdr.TTL()
+	case header.IPv6ProtocolNumber:
+		hdr := header.IPv6(pkt)
+		src = netip.AddrFrom16(hdr.SourceAddress().As16())
+		dst = netip.AddrFrom16(hdr.DestinationAddress().As16())
+		ttl = hdr.HopLimit()
+	default:
+		return false
+	}
+
+	if ttl > 1 || ss.isLocalAddr(dst) || isGroupAddress(dst) {
+		return false
+	}
+
+	localAddr, ok := ss.localAddrFor(src)
+	if ok && !isICMPError(protoNumber, pkt) {
+		ss.sendTimeExceeded(protoNumber, pkt, localAddr, src)
+	}
+
+	return true
+}
+
+// sendTimeExceeded queues an ICMP time exceeded error, about the packet, to
+// be sent from src to dst.
+func (ss *sourceSink) sendTimeExceeded(protoNumber tcpip.NetworkProtocolNumber, pkt []byte, src, dst netip.Addr) {
+	var reply []byte
+	var hdrLen int
+	if protoNumber == header.IPv4ProtocolNumber {
+		hdrLen = header.IPv4MinimumSize
+
+		// As much of the original packet as fits in a minimum sized datagram.
+		original := pkt[:min(len(pkt), header.IPv4MinimumProcessableDatagramSize-header.IPv4MinimumSize-header.ICMPv4MinimumSize)]
+
+		reply = make([]byte, header.IPv4MinimumSize+header.ICMPv4MinimumSize+len(original))
+		replyHdr := header.IPv4(reply)
+		replyHdr.Encode(&header.IPv4Fields{
+			TotalLength: uint16(len(reply)),
+			TTL:         defaultProbeTTL,
+			Protocol:    uint8(header.ICMPv4ProtocolNumber),
+			SrcAddr:     tcpip.AddrFrom4(src.As4()),
+			DstAddr:     tcpip.AddrFrom4(dst.As4()),
+		})
+		replyHdr.SetChecksum(^replyHdr.CalculateChecksum())
+
+		icmpHdr := header.ICMPv4(reply[header.IPv4MinimumSize:])
+		icmpHdr.SetType(header.ICMPv4TimeExceeded)
+		icmpHdr.SetCode(header.ICMPv4TTLExceeded)
+		copy(icmpHdr.Payload(), original)
+		icmpHdr.SetChecksum(header.ICMPv4Checksum(icmpHdr[:header.ICMPv4MinimumSize], checksum.Checksum(original, 0)))
+	} else {
+		hdrLen = header.IPv6MinimumSize
+
+		original := pkt[:min(len(pkt), header.IPv6MinimumMTU-header.IPv6MinimumSize-header.ICMPv6ErrorHeaderSize)]
+
+		reply = make([]byte, header.IPv6MinimumSize+header.ICMPv6ErrorHeaderSize+len(original))
+		replyHdr := header.IPv6(reply)
+		replyHdr.Encode(&header.IPv6Fields{
+			PayloadLength:     uint16(len(reply) - header.IPv6MinimumSize),
+			TransportProtocol: header.ICMPv6ProtocolNumber,
+			HopLimit:          defaultProbeTTL,
+			SrcAddr:           tcpip.AddrFrom16(src.As16()),
+			DstAddr:           tcpip.AddrFrom16(dst.As16()),
+		})
+
+		icmpHdr := header.ICMPv6(reply[header.IPv6MinimumSize:])
+		icmpHdr.SetType(header.ICMPv6TimeExceeded)
+		icmpHdr.SetCode(header.ICMPv6HopLimitExceeded)
+		copy(icmpHdr.Payload(), original)
+		icmpHdr.SetChecksum(header.ICMPv6Checksum(header.ICMPv6ChecksumParams{
+			Header:      icmpHdr[:header.ICMPv6ErrorHeaderSize],
+			Src:         replyHdr.SourceAddress(),
+			Dst:         replyHdr.DestinationAddress(),
+			PayloadCsum: checksum.Checksum(original, 0),
+			PayloadLen:  len(original),
+		}))
+	}
+
+	replyPkt := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(reply)})
+	replyPkt.NetworkProtocolNumber = protoNumber
+	_, _ = replyPkt.NetworkHeader().Consume(hdrLen)
+
+	ss.queueOutbound(replyPkt)
+	replyPkt.DecRef()
+}
+
+// isICMPError reports whether the packet is an ICMP error, errors are never
+// sent about errors.
+func isICMPError(protoNumber tcpip.NetworkProtocolNumber, pkt []byte) bool {
+	switch protoNumber {
+	case header.IPv4ProtocolNumber:
+		hdr := header.IPv4(pkt)
+		if hdr.TransportProtocol() != header.ICMPv4ProtocolNumber || hdr.FragmentOffset() != 0 {
+			return false
+		}
+
+		payload := hdr.Payload()
+		if len(payload) < header.ICMPv4MinimumSize {
+			return false
+		}
+
+		switch header.ICMPv4(payload).Type() {
+		case header.ICMPv4DstUnreachable, header.ICMPv4SrcQuench, header.ICMPv4Redirect,
+			header.ICMPv4TimeExceeded, header.ICMPv4ParamProblem:
+			return true
+		}
+	case header.IPv6ProtocolNumber:
+		hdr := header.IPv6(pkt)
+		if hdr.TransportProtocol() != header.ICMPv6ProtocolNumber {
+			return false
+		}
+
+		payload := hdr.Payload()
+		return len(payload) >= header.ICMPv6MinimumSize && header.ICMPv6(payload).Type().IsErrorType()
+	}
+
+	return false
+}
+
+// parseTimeExceeded returns the identifier and sequence number of the ICMP
+// echo request that an ICMP time exceeded error was sent about.
+func parseTimeExceeded(protoNumber tcpip.NetworkProtocolNumber, pkt []byte) (ident, seq uint16, ok bool) {
+	switch protoNumber {
+	case header.IPv4ProtocolNumber:
+		hdr := header.IPv4(pkt)
+		if !hdr.IsValid(len(pkt)) || hdr.TransportProtocol() != header.ICMPv4ProtocolNumber || hdr.FragmentOffset() != 0 {
+			return 0, 0, false
+		}
+
+		payload := hdr.Payload()
+		if len(payload) < header.ICMPv4MinimumSize || header.ICMPv4(payload).Type() != header.ICMPv4TimeExceeded {
+			return 0, 0, false
+		}
+
+		// The original packet is truncated, so its payload is found using its
+		// header length rather than its total length.
+		original := header.IPv4(payload[header.ICMPv4MinimumSize:])
+		if len(original) < header.IPv4MinimumSize || len(original) < int(original.HeaderLength()) ||
+			original.TransportProtocol() != header.ICMPv4ProtocolNumber {
+			return 0, 0, false
+		}
+
+		echo := header.ICMPv4(original[original.HeaderLength():])
+		if len(echo) < header.ICMPv4MinimumSize || echo.Type() != header.ICMPv4Echo {
+			return 0, 0, false
+		}
+
+		return echo.Ident(), echo.Sequence(), true
+	case header.IPv6ProtocolNumber:
+		hdr := header.IPv6(pkt)
+		if !hdr.IsValid(len(pkt)) || hdr.TransportProtocol() != header.ICMPv6ProtocolNumber {
+			return 0, 0, false
+		}
+
+		payload := hdr.Payload()
+		if len(payload) < header.ICMPv6ErrorHeaderSize || header.ICMPv6(payload).Type() != header.ICMPv6TimeExceeded {
+			return 0, 0, false
+		}
+
+		original := header.IPv6(payload[header.ICMPv6ErrorHeaderSize:])
+		if len(original) < header.IPv6MinimumSize || original.TransportProtocol() != header.ICMPv6ProtocolNumber {
+			return 0, 0, false
+		}
+
+		echo := header.ICMPv6(original[header.IPv6MinimumSize:])
+		if len(echo) < header.ICMPv6EchoMinimumSize || echo.Type() != header.ICMPv6EchoRequest {
+			return 0, 0, false
+		}
+
+		return echo.Ident(), echo.Sequence(), true
+	}
+
+	return 0, 0, false
+}
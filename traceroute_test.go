@@ -0,0 +1,146 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets_test
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoisySocket_Traceroute(t *testing.T) {
+	logger := slogt.New(t)
+
+	newSocket := func(t *testing.T, conf *v1alpha1.Config) *noisysockets.NoisySocket {
+		socket, err := noisysockets.NewNoisySocket(logger, conf)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, socket.Close())
+		})
+
+		return socket
+	}
+
+	routerPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	alicePrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	bobPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	_ = newSocket(t, &v1alpha1.Config{
+		Name:             "router",
+		ListenPort:       12421,
+		PrivateKey:       routerPrivateKey.String(),
+		IPs:              []string{"10.7.0.1", "fdff:7061:ac89::1"},
+		EnableForwarding: true,
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "alice",
+				PublicKey: alicePrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12422",
+				IPs:       []string{"10.7.0.2", "fdff:7061:ac89::2"},
+			},
+			{
+				Name:      "bob",
+				PublicKey: bobPrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12423",
+				IPs:       []string{"10.7.0.3", "fdff:7061:ac89::3"},
+			},
+		},
+	})
+
+	// Alice reaches bob via the router.
+	aliceSocket := newSocket(t, &v1alpha1.Config{
+		Name:       "alice",
+		ListenPort: 12422,
+		PrivateKey: alicePrivateKey.String(),
+		IPs:        []string{"10.7.0.2", "fdff:7061:ac89::2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "router",
+				PublicKey: routerPrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12421",
+				IPs:       []string{"10.7.0.1", "10.7.0.3", "fdff:7061:ac89::1", "fdff:7061:ac89::3"},
+			},
+		},
+	})
+
+	_ = newSocket(t, &v1alpha1.Config{
+		Name:       "bob",
+		ListenPort: 12423,
+		PrivateKey: bobPrivateKey.String(),
+		IPs:        []string{"10.7.0.3", "fdff:7061:ac89::3"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "router",
+				PublicKey: routerPrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12421",
+				IPs:       []string{"10.7.0.1", "10.7.0.2", "fdff:7061:ac89::1", "fdff:7061:ac89::2"},
+			},
+		},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	t.Cleanup(cancel)
+
+	for _, family := range []struct {
+		name   string
+		router netip.Addr
+		bob    netip.Addr
+	}{
+		{"IPv4", netip.MustParseAddr("10.7.0.1"), netip.MustParseAddr("10.7.0.3")},
+		{"IPv6", netip.MustParseAddr("fdff:7061:ac89::1"), netip.MustParseAddr("fdff:7061:ac89::3")},
+	} {
+		t.Run(family.name, func(t *testing.T) {
+			// Wait for the handshakes to complete, so that probes aren't lost.
+			_, err := aliceSocket.Ping(ctx, family.bob.String(), noisysockets.WithPingCount(1), noisysockets.WithPingTimeout(10*time.Second))
+			require.NoError(t, err)
+
+			hops, err := aliceSocket.Traceroute(ctx, family.bob.String(), noisysockets.WithTracerouteTimeout(5*time.Second))
+			require.NoError(t, err)
+
+			require.Len(t, hops, 2)
+
+			require.Equal(t, 1, hops[0].TTL)
+			require.Equal(t, family.router, hops[0].Addr)
+			require.Equal(t, "router", hops[0].PeerName)
+			require.NotZero(t, hops[0].RTT)
+
+			require.Equal(t, 2, hops[1].TTL)
+			require.Equal(t, family.bob, hops[1].Addr)
+		})
+	}
+
+	t.Run("Direct", func(t *testing.T) {
+		hops, err := aliceSocket.Traceroute(ctx, "router")
+		require.NoError(t, err)
+
+		require.Len(t, hops, 1)
+		require.Equal(t, netip.MustParseAddr("10.7.0.1"), hops[0].Addr)
+	})
+
+	t.Run("Unreachable", func(t *testing.T) {
+		hops, err := aliceSocket.Traceroute(ctx, "10.7.0.4", noisysockets.WithTracerouteMaxHops(2),
+			noisysockets.WithTracerouteTimeout(100*time.Millisecond))
+		require.NoError(t, err)
+
+		// No hops responded.
+		require.Len(t, hops, 2)
+		for _, hop := range hops {
+			require.False(t, hop.Addr.IsValid())
+		}
+	})
+}
@@ -0,0 +1,263 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the name of the instrumentation library.
+const tracerName = "github.com/noisysockets/noisysockets"
+
+// SetTracerProvider enables tracing of dials, listeners, accepted connections,
+// and handshakes with peers, using tracers from the provider. Spans of
+// connections end when the connection is closed, and record the number of
+// bytes exchanged. Handshake spans cover the initiation (and any retries) to
+// its completion. A nil provider disables tracing, which is the default.
+func (s *NoisySocket) SetTracerProvider(tp trace.TracerProvider) {
+	if tp == nil {
+		s.noisyNet.tracer.Store(nil)
+		return
+	}
+
+	tracer := tp.Tracer(tracerName)
+	s.noisyNet.tracer.Store(&tracer)
+}
+
+// loadTracer returns the tracer, or nil if tracing is disabled.
+func (n *noisyNet) loadTracer() trace.Tracer {
+	if tracer := n.tracer.Load(); tracer != nil {
+		return *tracer
+	}
+
+	return nil
+}
+
+func peerAttributes(identity *peerIdentity) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("noisysockets.peer.name", identity.PeerName()),
+		attribute.String("noisysockets.peer.public_key", identity.PeerPublicKey()),
+	}
+}
+
+// traceDial instruments a dial, the span ends when the returned connection is
+// closed (or the dial fails).
+func (n *noisyNet) traceDial(ctx context.Context, tracer trace.Tracer, network, address string) (net.Conn, error) {
+	ctx, span := tracer.Start(ctx, "noisysockets.Dial",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("network.transport", network),
+			attribute.String("server.address", address),
+		))
+
+	start := time.Now()
+	conn, err := n.dialContext(ctx, network, address)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		return nil, err
+	}
+
+	span.AddEvent("connected")
+	span.SetAttributes(attribute.Int64("noisysockets.dial.latency_ms", time.Since(start).Milliseconds()))
+
+	return newTracedConn(conn, span), nil
+}
+
+// traceAccept instruments an accepted connection, the span ends when the
+// connection is closed.
+func (l *peerListener) traceAccept(tracer trace.Tracer, conn *tcpPeerConn) net.Conn {
+	_, span := tracer.Start(context.Background(), "noisysockets.Accept",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("network.transport", "tcp"),
+			attribute.String("server.address", conn.LocalAddr().String()),
+			attribute.String("client.address", conn.RemoteAddr().String()),
+		))
+
+	return newTracedConn(conn, span)
+}
+
+// traceListen records the creation of a listener.
+func (n *noisyNet) traceListen(tracer trace.Tracer, network, address string, err error) {
+	_, span := tracer.Start(context.Background(), "noisysockets.Listen",
+		trace.WithAttributes(
+			attribute.String("network.transport", network),
+			attribute.String("server.address", address),
+		))
+	defer span.End()
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// connSpan is the span of a connection.
+type connSpan struct {
+	span          trace.Span
+	bytesSent     atomic.Uint64
+	bytesReceived atomic.Uint64
+	endOnce       sync.Once
+}
+
+func (cs *connSpan) end() {
+	cs.endOnce.Do(func() {
+		cs.span.SetAttributes(
+			attribute.Int64("noisysockets.bytes_sent", int64(cs.bytesSent.Load())),
+			attribute.Int64("noisysockets.bytes_received", int64(cs.bytesReceived.Load())),
+		)
+		cs.span.End()
+	})
+}
+
+// tracedTCPConn is a TCP connection that records the bytes exchanged in its
+// span. It still implements PeerConn, CloseRead, CloseWrite, and the copy
+// fast paths of tcpConn.
+type tracedTCPConn struct {
+	*tcpPeerConn
+	*connSpan
+}
+
+func (c *tracedTCPConn) Read(b []byte) (int, error) {
+	n, err := c.tcpPeerConn.Read(b)
+	c.bytesReceived.Add(uint64(n))
+	return n, err
+}
+
+func (c *tracedTCPConn) Write(b []byte) (int, error) {
+	n, err := c.tcpPeerConn.Write(b)
+	c.bytesSent.Add(uint64(n))
+	return n, err
+}
+
+func (c *tracedTCPConn) ReadFrom(r io.Reader) (int64, error) {
+	n, err := c.tcpPeerConn.ReadFrom(r)
+	c.bytesSent.Add(uint64(n))
+	return n, err
+}
+
+func (c *tracedTCPConn) WriteTo(w io.Writer) (int64, error) {
+	n, err := c.tcpPeerConn.WriteTo(w)
+	c.bytesReceived.Add(uint64(n))
+	return n, err
+}
+
+func (c *tracedTCPConn) WriteBuffers(bufs net.Buffers) (int64, error) {
+	n, err := c.tcpPeerConn.WriteBuffers(bufs)
+	c.bytesSent.Add(uint64(n))
+	return n, err
+}
+
+func (c *tracedTCPConn) Close() error {
+	err := c.tcpPeerConn.Close()
+	c.end()
+	return err
+}
+
+// tracedUDPConn is a UDP connection that records the bytes exchanged in its
+// span.
+type tracedUDPConn struct {
+	*udpPeerConn
+	*connSpan
+}
+
+func (c *tracedUDPConn) Read(b []byte) (int, error) {
+	n, err := c.udpPeerConn.Read(b)
+	c.bytesReceived.Add(uint64(n))
+	return n, err
+}
+
+func (c *tracedUDPConn) Write(b []byte) (int, error) {
+	n, err := c.udpPeerConn.Write(b)
+	c.bytesSent.Add(uint64(n))
+	return n, err
+}
+
+func (c *tracedUDPConn) Close() error {
+	err := c.udpPeerConn.Close()
+	c.end()
+	return err
+}
+
+func newTracedConn(conn net.Conn, span trace.Span) net.Conn {
+	cs := &connSpan{span: span}
+
+	switch c := conn.(type) {
+	case *tcpPeerConn:
+		span.SetAttributes(peerAttributes(&c.peerIdentity)...)
+		return &tracedTCPConn{tcpPeerConn: c, connSpan: cs}
+	case *udpPeerConn:
+		span.SetAttributes(peerAttributes(&c.peerIdentity)...)
+		return &tracedUDPConn{udpPeerConn: c, connSpan: cs}
+	default:
+		span.End()
+		return conn
+	}
+}
+
+// handshakeTracer records a span for each handshake initiated with a peer.
+type handshakeTracer struct {
+	mu      sync.Mutex // protects started
+	started map[transport.NoisePublicKey]time.Time
+}
+
+// traceHandshake records handshake events reported by the transport.
+func (s *NoisySocket) traceHandshake(ev transport.PeerEvent) {
+	tracer := s.noisyNet.loadTracer()
+	if tracer == nil {
+		return
+	}
+
+	ht := &s.handshakeTracer
+
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+
+	if ht.started == nil {
+		ht.started = make(map[transport.NoisePublicKey]time.Time)
+	}
+
+	switch ev.Type {
+	case transport.PeerEventHandshakeInitiated:
+		// Retries are part of the same handshake.
+		if _, ok := ht.started[ev.PublicKey]; !ok {
+			ht.started[ev.PublicKey] = time.Now()
+		}
+	case transport.PeerEventHandshakeCompleted, transport.PeerEventUnreachable:
+		start, ok := ht.started[ev.PublicKey]
+		if !ok {
+			// Handshakes initiated by the peer aren't traced.
+			return
+		}
+		delete(ht.started, ev.PublicKey)
+
+		_, span := tracer.Start(context.Background(), "noisysockets.Handshake",
+			trace.WithTimestamp(start),
+			trace.WithAttributes(
+				attribute.String("noisysockets.peer.name", s.sourceSink.peerName(ev.PublicKey)),
+				attribute.String("noisysockets.peer.public_key", ev.PublicKey.String()),
+				attribute.String("noisysockets.peer.endpoint", ev.Endpoint),
+			))
+
+		if ev.Type == transport.PeerEventUnreachable {
+			span.SetStatus(codes.Error, "handshake did not complete")
+		}
+
+		span.End()
+	}
+}
@@ -0,0 +1,172 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets_test
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestNoisySocket_Tracing(t *testing.T) {
+	logger := slogt.New(t)
+
+	serverPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	clientPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	serverSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "server",
+		ListenPort: 12412,
+		PrivateKey: serverPrivateKey.String(),
+		IPs:        []string{"10.7.0.1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "client",
+				PublicKey: clientPrivateKey.PublicKey().String(),
+				IPs:       []string{"10.7.0.2"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, serverSocket.Close())
+	})
+
+	serverSpans := tracetest.NewSpanRecorder()
+	serverSocket.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(serverSpans)))
+
+	lis, err := serverSocket.Listen("tcp", ":80")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = lis.Close()
+	})
+
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	clientSocket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "client",
+		ListenPort: 12413,
+		PrivateKey: clientPrivateKey.String(),
+		IPs:        []string{"10.7.0.2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "server",
+				PublicKey: serverPrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12412",
+				IPs:       []string{"10.7.0.1"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, clientSocket.Close())
+	})
+
+	clientSpans := tracetest.NewSpanRecorder()
+	clientSocket.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(clientSpans)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	conn, err := clientSocket.DialContext(ctx, "tcp", "server:80")
+	require.NoError(t, err)
+
+	// Tracing doesn't hide the identity of the peer.
+	require.Equal(t, "server", conn.(noisysockets.PeerConn).PeerName())
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+
+	require.NoError(t, conn.Close())
+
+	_, err = clientSocket.DialContext(ctx, "tcp", "unknown:80")
+	require.Error(t, err)
+
+	findSpan := func(spans *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+		var found sdktrace.ReadOnlySpan
+		require.Eventually(t, func() bool {
+			for _, span := range spans.Ended() {
+				if span.Name() == name {
+					found = span
+					return true
+				}
+			}
+			return false
+		}, 5*time.Second, 10*time.Millisecond, "span %q not found", name)
+
+		return found
+	}
+
+	attributes := func(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+		attrs := make(map[attribute.Key]attribute.Value)
+		for _, kv := range span.Attributes() {
+			attrs[kv.Key] = kv.Value
+		}
+		return attrs
+	}
+
+	t.Run("Dial", func(t *testing.T) {
+		var dials []sdktrace.ReadOnlySpan
+		findSpan(clientSpans, "noisysockets.Dial")
+		for _, span := range clientSpans.Ended() {
+			if span.Name() == "noisysockets.Dial" {
+				dials = append(dials, span)
+			}
+		}
+		require.Len(t, dials, 2)
+
+		attrs := attributes(dials[0])
+		require.Equal(t, "server:80", attrs["server.address"].AsString())
+		require.Equal(t, "server", attrs["noisysockets.peer.name"].AsString())
+		require.Equal(t, int64(5), attrs["noisysockets.bytes_sent"].AsInt64())
+		require.Equal(t, int64(5), attrs["noisysockets.bytes_received"].AsInt64())
+
+		require.Equal(t, codes.Error, dials[1].Status().Code)
+	})
+
+	t.Run("Handshake", func(t *testing.T) {
+		attrs := attributes(findSpan(clientSpans, "noisysockets.Handshake"))
+		require.Equal(t, "server", attrs["noisysockets.peer.name"].AsString())
+		require.Equal(t, "127.0.0.1:12412", attrs["noisysockets.peer.endpoint"].AsString())
+	})
+
+	t.Run("Listen", func(t *testing.T) {
+		attrs := attributes(findSpan(serverSpans, "noisysockets.Listen"))
+		require.Equal(t, ":80", attrs["server.address"].AsString())
+	})
+
+	t.Run("Accept", func(t *testing.T) {
+		attrs := attributes(findSpan(serverSpans, "noisysockets.Accept"))
+		require.Equal(t, "client", attrs["noisysockets.peer.name"].AsString())
+		require.Equal(t, int64(5), attrs["noisysockets.bytes_received"].AsInt64())
+	})
+}
@@ -0,0 +1,326 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/conn"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/noisysockets/noisysockets/internal/tun"
+)
+
+// TUNBridge exposes the mesh as an operating system network interface, so that
+// any program on the host (not just those using a NoisySocket) can reach peers.
+//
+// The interface is assigned the configured IPv4 addresses, these may be given
+// in CIDR notation (eg. 10.7.0.1/24) to have the kernel route the whole subnet
+// via the interface. Routes for any other peer prefixes can be added with
+// RoutePeers, and the DNS configuration of the interface set with SetDNS.
+// Creating a TUN device requires elevated privileges (eg. CAP_NET_ADMIN), and
+// is supported on Linux, macOS (utun), and Windows (Wintun, wintun.dll must be
+// installed alongside the executable).
+type TUNBridge struct {
+	dev        tun.Device
+	addrs      []netip.Prefix
+	sourceSink *tunSourceSink
+	transport  *transport.Transport
+	dnsSet     atomic.Bool
+}
+
+// TUNDevice is a TUN device created by the platform, rather than by the bridge
+// (eg. the interface of an Android VpnService, or an iOS packet tunnel). It
+// reads and writes raw IP packets, a packet at a time.
+type TUNDevice interface {
+	// Name returns the name of the network interface.
+	Name() string
+	// Read reads a single packet into buf, starting at offset.
+	Read(buf []byte, offset int) (int, error)
+	// Write writes a single packet from buf, starting at offset.
+	Write(buf []byte, offset int) (int, error)
+	// Close closes the device, unblocking any pending reads.
+	Close() error
+}
+
+// NewTUNBridge creates a TUN device with the given name (or a kernel generated
+// name if empty) and bridges it to the mesh described by conf.
+func NewTUNBridge(logger *slog.Logger, conf *v1alpha1.Config, name string) (*TUNBridge, error) {
+	addrs, mtu, err := checkTUNBridgeConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	dev, err := tun.Open(name, mtu, addrs)
+	if err != nil {
+		return nil, fmt.Errorf("could not open tun device: %w", err)
+	}
+
+	b, err := newTUNBridge(logger, conf, dev, mtu)
+	if err != nil {
+		return nil, err
+	}
+	b.addrs = addrs
+
+	return b, nil
+}
+
+// NewTUNBridgeFromDevice bridges an existing TUN device to the mesh described by
+// conf. The platform is responsible for configuring the addresses, MTU, and
+// routes of the device. The bridge takes ownership of the device, and closes
+// it when the bridge is closed.
+func NewTUNBridgeFromDevice(logger *slog.Logger, conf *v1alpha1.Config, dev TUNDevice) (*TUNBridge, error) {
+	_, mtu, err := checkTUNBridgeConfig(conf)
+	if err != nil {
+		_ = dev.Close()
+		return nil, err
+	}
+
+	return newTUNBridge(logger, conf, dev, mtu)
+}
+
+// checkTUNBridgeConfig checks that conf doesn't use any features that aren't
+// supported by the bridge, and returns the addresses and MTU of the device.
+func checkTUNBridgeConfig(conf *v1alpha1.Config) ([]netip.Prefix, int, error) {
+	var addrs []netip.Prefix
+	for _, ip := range conf.IPs {
+		prefix, err := parseAddrOrPrefix(ip)
+		if err != nil {
+			return nil, 0, fmt.Errorf("could not parse address: %w", err)
+		}
+		addrs = append(addrs, prefix)
+	}
+
+	if conf.IPAM != nil {
+		return nil, 0, fmt.Errorf("address pools are not supported by the tun bridge")
+	}
+
+	// The kernel does its own path MTU discovery.
+	if conf.PathMTUDiscovery {
+		return nil, 0, fmt.Errorf("path mtu discovery is not supported by the tun bridge")
+	}
+
+	// Broadcast and multicast packets are routed by the kernel.
+	if conf.EnableMulticast {
+		return nil, 0, fmt.Errorf("multicast is not supported by the tun bridge")
+	}
+
+	// The kernel has its own queues, and the device is read a packet at a time.
+	if conf.Tuning != nil {
+		return nil, 0, fmt.Errorf("tuning is not supported by the tun bridge")
+	}
+
+	// TCP connections are terminated by the kernel's stack.
+	if conf.Stack != nil {
+		return nil, 0, fmt.Errorf("stack options are not supported by the tun bridge")
+	}
+
+	if len(conf.STUNServers) > 0 {
+		return nil, 0, fmt.Errorf("endpoint discovery is not supported by the tun bridge")
+	}
+
+	if introductionsEnabled(conf) {
+		return nil, 0, fmt.Errorf("introductions are not supported by the tun bridge")
+	}
+
+	mtu, err := configMTU(conf)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return addrs, mtu, nil
+}
+
+func newTUNBridge(logger *slog.Logger, conf *v1alpha1.Config, dev tun.Device, mtu int) (*TUNBridge, error) {
+	var privateKey transport.NoisePrivateKey
+	if err := privateKey.FromString(conf.PrivateKey); err != nil {
+		_ = dev.Close()
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+
+	timers, err := configTimers(conf)
+	if err != nil {
+		_ = dev.Close()
+		return nil, err
+	}
+
+	sourceSink := newTUNSourceSink(dev)
+	if conf.ClampMSS {
+		sourceSink.clampMTU = mtu
+	}
+
+	bind, err := newBind(logger, conf, privateKey, nil, nil)
+	if err != nil {
+		_ = dev.Close()
+		return nil, err
+	}
+
+	t := transport.NewTransport(sourceSink, bind, logger)
+
+	t.SetPrivateKey(privateKey)
+	t.SetMTU(mtu)
+
+	if err := t.SetTimers(timers); err != nil {
+		_ = t.Close()
+		return nil, fmt.Errorf("failed to set timers: %w", err)
+	}
+
+	if err := t.SetHandshakeLimits(configHandshakeLimits(conf)); err != nil {
+		_ = t.Close()
+		return nil, fmt.Errorf("failed to set handshake limits: %w", err)
+	}
+
+	if err := t.UpdatePort(conf.ListenPort); err != nil {
+		_ = t.Close()
+		return nil, fmt.Errorf("failed to update port: %w", err)
+	}
+
+	for _, peerConf := range conf.Peers {
+		peerPublicKey, peerAddrs, peerEndpoints, err := parsePeerConfig(&peerConf)
+		if err != nil {
+			_ = t.Close()
+			return nil, err
+		}
+
+		peerPresharedKey, err := parsePresharedKey(&peerConf)
+		if err != nil {
+			_ = t.Close()
+			return nil, err
+		}
+
+		if err := checkStrictInteropEndpoints(conf.StrictInterop, peerEndpoints); err != nil {
+			_ = t.Close()
+			return nil, err
+		}
+
+		if err := checkStrictInteropPeer(conf.StrictInterop, &peerConf); err != nil {
+			_ = t.Close()
+			return nil, err
+		}
+
+		if peerConf.DefaultGateway || (peerConf.Name != "" && peerConf.Name == conf.DefaultGatewayPeerName) {
+			peerAddrs = append(peerAddrs, defaultRoutePrefixes...)
+		}
+
+		if err := sourceSink.AddPeer(peerPublicKey, peerAddrs); err != nil {
+			_ = t.Close()
+			return nil, fmt.Errorf("failed to add peer: %w", err)
+		}
+
+		peer, err := t.NewPeer(peerPublicKey)
+		if err != nil {
+			_ = t.Close()
+			return nil, fmt.Errorf("failed to create peer: %w", err)
+		}
+
+		peer.SetPresharedKey(peerPresharedKey)
+
+		if err := peer.SetCompression(peerConf.Compression); err != nil {
+			_ = t.Close()
+			return nil, fmt.Errorf("failed to set compression: %w", err)
+		}
+
+		if err := peer.SetPostQuantum(peerConf.PostQuantum); err != nil {
+			_ = t.Close()
+			return nil, fmt.Errorf("failed to set post-quantum key exchange: %w", err)
+		}
+
+		setPeerEndpoints(peer, peerEndpoints)
+
+		if bind.relay != nil {
+			peer.SetRelayEndpoint(conn.NewRelayEndpoint(peerPublicKey))
+		}
+
+		if err := peer.SetPersistentKeepaliveInterval(time.Duration(peerConf.PersistentKeepalive) * time.Second); err != nil {
+			_ = t.Close()
+			return nil, fmt.Errorf("failed to set persistent keepalive: %w", err)
+		}
+
+		if err := peer.SetIdleTimeout(peerIdleTimeout(conf.PeerIdleTimeoutSeconds, &peerConf)); err != nil {
+			_ = t.Close()
+			return nil, fmt.Errorf("failed to set idle timeout: %w", err)
+		}
+	}
+
+	if err := t.Up(); err != nil {
+		_ = t.Close()
+		return nil, fmt.Errorf("failed to bring transport up: %w", err)
+	}
+
+	return &TUNBridge{
+		dev:        dev,
+		sourceSink: sourceSink,
+		transport:  t,
+	}, nil
+}
+
+// Name returns the name of the network interface.
+func (b *TUNBridge) Name() string {
+	return b.dev.Name()
+}
+
+// RoutePeers routes the prefixes of every peer via the network interface, so
+// that the operator doesn't have to. Prefixes covered by the subnet of one of
+// the interface's addresses are already routed, and default routes are never
+// added, as they would also capture the traffic of the transport itself.
+func (b *TUNBridge) RoutePeers() error {
+	b.sourceSink.peersMu.RLock()
+	var prefixes []netip.Prefix
+	for _, peerPrefixes := range b.sourceSink.peerPrefixes {
+		for _, prefix := range peerPrefixes {
+			prefix = prefix.Masked()
+			if prefix.Bits() == 0 || slices.Contains(prefixes, prefix) {
+				continue
+			}
+
+			if slices.ContainsFunc(b.addrs, func(addr netip.Prefix) bool {
+				return addr.Bits() <= prefix.Bits() && addr.Contains(prefix.Addr())
+			}) {
+				continue
+			}
+
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	b.sourceSink.peersMu.RUnlock()
+
+	slices.SortFunc(prefixes, func(a, b netip.Prefix) int {
+		return a.Addr().Compare(b.Addr())
+	})
+
+	if err := tun.AddRoutes(b.dev.Name(), prefixes); err != nil {
+		return fmt.Errorf("could not route peers: %w", err)
+	}
+
+	return nil
+}
+
+// SetDNS configures the network interface to use the given DNS servers, for
+// names in the given search domains (eg. the domain of the mesh). The DNS
+// configuration is removed when the bridge is closed.
+func (b *TUNBridge) SetDNS(servers []netip.Addr, domains ...string) error {
+	b.dnsSet.Store(true)
+
+	if err := tun.SetDNS(b.dev.Name(), servers, domains); err != nil {
+		return fmt.Errorf("could not set dns: %w", err)
+	}
+
+	return nil
+}
+
+// Close closes the bridge, removing the network interface.
+func (b *TUNBridge) Close() error {
+	if b.dnsSet.Load() {
+		_ = tun.ResetDNS(b.dev.Name())
+	}
+
+	return b.transport.Close()
+}
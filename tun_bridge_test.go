@@ -0,0 +1,196 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets_test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/noisysockets/noisysockets"
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTUNBridge(t *testing.T) {
+	logger := slogt.New(t)
+
+	bridgePrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	socketPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	bridge, err := noisysockets.NewTUNBridge(logger, &v1alpha1.Config{
+		Name:       "bridge",
+		ListenPort: 12360,
+		PrivateKey: bridgePrivateKey.String(),
+		// The kernel will route the whole subnet via the tun device.
+		IPs: []string{"10.9.0.1/24"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "socket",
+				PublicKey: socketPrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12361",
+				IPs:       []string{"10.9.0.2"},
+			},
+		},
+	}, "")
+	if err != nil {
+		t.Skipf("tun devices unavailable: %v", err)
+	}
+	t.Cleanup(func() {
+		require.NoError(t, bridge.Close())
+	})
+
+	require.NotEmpty(t, bridge.Name())
+
+	socket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "socket",
+		ListenPort: 12361,
+		PrivateKey: socketPrivateKey.String(),
+		IPs:        []string{"10.9.0.2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "bridge",
+				PublicKey: bridgePrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12360",
+				IPs:       []string{"10.9.0.1"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, socket.Close())
+	})
+
+	lis, err := socket.Listen("tcp", "10.9.0.2:80")
+	require.NoError(t, err)
+
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "Hello, world!")
+		}),
+	}
+	t.Cleanup(func() {
+		_ = srv.Close()
+	})
+
+	go func() {
+		_ = srv.Serve(lis)
+	}()
+
+	// Use the host network stack, packets will be routed via the tun device.
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial:              (&net.Dialer{}).Dial,
+			DisableKeepAlives: true,
+		},
+		Timeout: 5 * time.Second,
+	}
+
+	resp, err := client.Get("http://10.9.0.2")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, resp.Body.Close())
+	})
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	require.Equal(t, "Hello, world!", string(body))
+}
+
+func TestTUNBridge_RoutePeers(t *testing.T) {
+	logger := slogt.New(t)
+
+	bridgePrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	socketPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	bridge, err := noisysockets.NewTUNBridge(logger, &v1alpha1.Config{
+		Name:       "bridge",
+		ListenPort: 12466,
+		PrivateKey: bridgePrivateKey.String(),
+		// No subnet, so the kernel won't route anything via the tun device.
+		IPs: []string{"10.10.0.1"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "socket",
+				PublicKey: socketPrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12467",
+				IPs:       []string{"10.10.0.2", "10.11.0.0/24"},
+			},
+		},
+	}, "")
+	if err != nil {
+		t.Skipf("tun devices unavailable: %v", err)
+	}
+	t.Cleanup(func() {
+		require.NoError(t, bridge.Close())
+	})
+
+	if err := bridge.RoutePeers(); err != nil {
+		t.Skipf("routes unavailable: %v", err)
+	}
+
+	socket, err := noisysockets.NewNoisySocket(logger, &v1alpha1.Config{
+		Name:       "socket",
+		ListenPort: 12467,
+		PrivateKey: socketPrivateKey.String(),
+		IPs:        []string{"10.10.0.2"},
+		Peers: []v1alpha1.WireGuardPeerConfig{
+			{
+				Name:      "bridge",
+				PublicKey: bridgePrivateKey.PublicKey().String(),
+				Endpoint:  "localhost:12466",
+				IPs:       []string{"10.10.0.1"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, socket.Close())
+	})
+
+	lis, err := socket.Listen("tcp", "10.10.0.2:7")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = lis.Close()
+	})
+
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	// Use the host network stack, the peer is only reachable via its route.
+	conn, err := net.DialTimeout("tcp", "10.10.0.2:7", 5*time.Second)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, conn.Close())
+	})
+
+	_, err = conn.Write([]byte("Hello, world!"))
+	require.NoError(t, err)
+
+	buf := make([]byte, len("Hello, world!"))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "Hello, world!", string(buf))
+}
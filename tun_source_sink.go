@@ -0,0 +1,182 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/noisysockets/noisysockets/internal/tun"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// tunSourceSink is a transport.SourceSink that exchanges packets with an
+// operating system TUN device, rather than a userspace network stack.
+type tunSourceSink struct {
+	dev             tun.Device
+	peersMu         sync.RWMutex
+	peerPrefixes    map[transport.NoisePublicKey][]netip.Prefix
+	fromPeerAddress *prefixTrie[transport.NoisePublicKey]
+	// clampMTU is the MTU that the MSS of TCP SYN segments is clamped to, or
+	// zero if MSS clamping is disabled.
+	clampMTU int
+}
+
+func newTUNSourceSink(dev tun.Device) *tunSourceSink {
+	return &tunSourceSink{
+		dev:             dev,
+		peerPrefixes:    make(map[transport.NoisePublicKey][]netip.Prefix),
+		fromPeerAddress: newPrefixTrie[transport.NoisePublicKey](),
+	}
+}
+
+// AddPeer routes packets destined for any of the given prefixes to the peer.
+func (ss *tunSourceSink) AddPeer(publicKey transport.NoisePublicKey, prefixes []netip.Prefix) error {
+	ss.peersMu.Lock()
+	defer ss.peersMu.Unlock()
+
+	for _, prefix := range prefixes {
+		if existingPublicKey, ok := ss.fromPeerAddress.Get(prefix); ok && existingPublicKey != publicKey {
+			return fmt.Errorf("peer %s address %s is already claimed by peer %s",
+				publicKey.String(), prefix, existingPublicKey.String())
+		}
+	}
+
+	for _, prefix := range prefixes {
+		prefix = prefix.Masked()
+		if _, ok := ss.fromPeerAddress.Get(prefix); ok {
+			continue
+		}
+
+		ss.peerPrefixes[publicKey] = append(ss.peerPrefixes[publicKey], prefix)
+		ss.fromPeerAddress.Insert(prefix, publicKey)
+	}
+
+	return nil
+}
+
+// RemovePeer removes all routes to the peer.
+func (ss *tunSourceSink) RemovePeer(publicKey transport.NoisePublicKey) {
+	ss.peersMu.Lock()
+	defer ss.peersMu.Unlock()
+
+	for _, prefix := range ss.peerPrefixes[publicKey] {
+		ss.fromPeerAddress.Delete(prefix)
+	}
+
+	delete(ss.peerPrefixes, publicKey)
+}
+
+func (ss *tunSourceSink) Close() error {
+	return ss.dev.Close()
+}
+
+func (ss *tunSourceSink) Read(bufs [][]byte, sizes []int, destinations []transport.NoisePublicKey, offset int) (int, error) {
+	for {
+		n, err := ss.dev.Read(bufs[0], offset)
+		if err != nil {
+			return 0, err
+		}
+
+		pkt := bufs[0][offset : offset+n]
+
+		var dst netip.Addr
+		var protoNumber tcpip.NetworkProtocolNumber
+		switch {
+		case len(pkt) >= header.IPv4MinimumSize && pkt[0]>>4 == 4:
+			hdr := header.IPv4(pkt)
+			if !hdr.IsValid(len(pkt)) {
+				continue
+			}
+
+			dst = netip.AddrFrom4(hdr.DestinationAddress().As4())
+			protoNumber = header.IPv4ProtocolNumber
+		case len(pkt) >= header.IPv6MinimumSize && pkt[0]>>4 == 6:
+			hdr := header.IPv6(pkt)
+			if !hdr.IsValid(len(pkt)) {
+				continue
+			}
+
+			dst = netip.AddrFrom16(hdr.DestinationAddress().As16())
+			protoNumber = header.IPv6ProtocolNumber
+		default:
+			continue
+		}
+
+		// The host may route packets to us that aren't destined for any peer
+		// (eg. multicast), these are silently dropped.
+		ss.peersMu.RLock()
+		destination, ok := ss.fromPeerAddress.Lookup(dst)
+		ss.peersMu.RUnlock()
+		if !ok {
+			continue
+		}
+
+		if ss.clampMTU > 0 {
+			clampMSS(protoNumber, pkt, maxMSS(protoNumber, ss.clampMTU))
+		}
+
+		sizes[0] = n
+		destinations[0] = destination
+
+		return 1, nil
+	}
+}
+
+func (ss *tunSourceSink) Write(bufs [][]byte, sources []transport.NoisePublicKey, offset int) (int, error) {
+	for i, buf := range bufs {
+		if len(buf) <= offset {
+			continue
+		}
+
+		if i < len(sources) && !ss.allowSource(sources[i], buf[offset:]) {
+			continue
+		}
+
+		if ss.clampMTU > 0 {
+			switch buf[offset] >> 4 {
+			case 4:
+				clampMSS(header.IPv4ProtocolNumber, buf[offset:], maxMSS(header.IPv4ProtocolNumber, ss.clampMTU))
+			case 6:
+				clampMSS(header.IPv6ProtocolNumber, buf[offset:], maxMSS(header.IPv6ProtocolNumber, ss.clampMTU))
+			}
+		}
+
+		if _, err := ss.dev.Write(buf, offset); err != nil {
+			return i, fmt.Errorf("could not write packet: %w", err)
+		}
+	}
+
+	return len(bufs), nil
+}
+
+// allowSource reports whether a peer is allowed to send a packet, ie. its
+// source address is routed to the peer (cryptokey routing). So that a peer
+// can't inject packets into the host on behalf of other peers.
+func (ss *tunSourceSink) allowSource(publicKey transport.NoisePublicKey, pkt []byte) bool {
+	var src netip.Addr
+	switch {
+	case len(pkt) >= header.IPv4MinimumSize && pkt[0]>>4 == 4:
+		src = netip.AddrFrom4(header.IPv4(pkt).SourceAddress().As4())
+	case len(pkt) >= header.IPv6MinimumSize && pkt[0]>>4 == 6:
+		src = netip.AddrFrom16(header.IPv6(pkt).SourceAddress().As16())
+	default:
+		return false
+	}
+
+	ss.peersMu.RLock()
+	owner, ok := ss.fromPeerAddress.Lookup(src)
+	ss.peersMu.RUnlock()
+
+	return ok && owner == publicKey
+}
+
+func (ss *tunSourceSink) BatchSize() int {
+	return 1
+}
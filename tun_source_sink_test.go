@@ -0,0 +1,126 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"io"
+	"net/netip"
+	"testing"
+
+	"github.com/noisysockets/noisysockets/internal/transport"
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+func TestTUNSourceSink(t *testing.T) {
+	dev := &fakeTUNDevice{}
+	ss := newTUNSourceSink(dev)
+
+	peerPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	peerPublicKey := peerPrivateKey.PublicKey()
+	require.NoError(t, ss.AddPeer(peerPublicKey, []netip.Prefix{netip.MustParsePrefix("10.7.1.0/24")}))
+
+	otherPrivateKey, err := transport.NewPrivateKey()
+	require.NoError(t, err)
+
+	err = ss.AddPeer(otherPrivateKey.PublicKey(), []netip.Prefix{netip.MustParsePrefix("10.7.1.0/24")})
+	require.ErrorContains(t, err, "already claimed")
+
+	t.Run("Read", func(t *testing.T) {
+		// The first packet has no route and should be dropped.
+		dev.inbound = [][]byte{
+			newTestIPv4Packet(netip.MustParseAddr("10.7.0.1"), netip.MustParseAddr("10.7.2.1")),
+			newTestIPv4Packet(netip.MustParseAddr("10.7.0.1"), netip.MustParseAddr("10.7.1.1")),
+		}
+
+		bufs := [][]byte{make([]byte, 1500)}
+		sizes := make([]int, 1)
+		destinations := make([]transport.NoisePublicKey, 1)
+
+		n, err := ss.Read(bufs, sizes, destinations, 16)
+		require.NoError(t, err)
+		require.Equal(t, 1, n)
+		require.Equal(t, header.IPv4MinimumSize, sizes[0])
+		require.Equal(t, peerPublicKey, destinations[0])
+
+		_, err = ss.Read(bufs, sizes, destinations, 16)
+		require.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("Write", func(t *testing.T) {
+		pkt := newTestIPv4Packet(netip.MustParseAddr("10.7.1.1"), netip.MustParseAddr("10.7.0.1"))
+		buf := append(make([]byte, 16), pkt...)
+
+		// The second packet's source address isn't routed to the peer, and
+		// should be dropped.
+		spoofed := append(make([]byte, 16), newTestIPv4Packet(netip.MustParseAddr("10.7.2.1"), netip.MustParseAddr("10.7.0.1"))...)
+
+		n, err := ss.Write([][]byte{buf, spoofed}, []transport.NoisePublicKey{peerPublicKey, peerPublicKey}, 16)
+		require.NoError(t, err)
+		require.Equal(t, 2, n)
+
+		require.Equal(t, [][]byte{pkt}, dev.outbound)
+	})
+
+	t.Run("RemovePeer", func(t *testing.T) {
+		ss.RemovePeer(peerPublicKey)
+
+		dev.inbound = [][]byte{
+			newTestIPv4Packet(netip.MustParseAddr("10.7.0.1"), netip.MustParseAddr("10.7.1.1")),
+		}
+
+		_, err := ss.Read([][]byte{make([]byte, 1500)}, make([]int, 1), make([]transport.NoisePublicKey, 1), 0)
+		require.ErrorIs(t, err, io.EOF)
+	})
+}
+
+type fakeTUNDevice struct {
+	inbound  [][]byte
+	outbound [][]byte
+}
+
+func (d *fakeTUNDevice) Name() string {
+	return "tun0"
+}
+
+func (d *fakeTUNDevice) Read(buf []byte, offset int) (int, error) {
+	if len(d.inbound) == 0 {
+		return 0, io.EOF
+	}
+
+	pkt := d.inbound[0]
+	d.inbound = d.inbound[1:]
+
+	return copy(buf[offset:], pkt), nil
+}
+
+func (d *fakeTUNDevice) Write(buf []byte, offset int) (int, error) {
+	d.outbound = append(d.outbound, append([]byte(nil), buf[offset:]...))
+	return len(buf) - offset, nil
+}
+
+func (d *fakeTUNDevice) Close() error {
+	return nil
+}
+
+func newTestIPv4Packet(src, dst netip.Addr) []byte {
+	pkt := make([]byte, header.IPv4MinimumSize)
+
+	hdr := header.IPv4(pkt)
+	hdr.Encode(&header.IPv4Fields{
+		TotalLength: header.IPv4MinimumSize,
+		TTL:         64,
+		Protocol:    uint8(header.UDPProtocolNumber),
+		SrcAddr:     tcpip.AddrFrom4(src.As4()),
+		DstAddr:     tcpip.AddrFrom4(dst.As4()),
+	})
+	hdr.SetChecksum(^hdr.CalculateChecksum())
+
+	return pkt
+}
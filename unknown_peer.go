@@ -0,0 +1,176 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ */
+
+package noisysockets
+
+import (
+	"context"
+	"log/slog"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/noisysockets/noisysockets/config/v1alpha1"
+)
+
+const (
+	// unknownPeerTimeout is how long an UnknownPeerFunc has to return.
+	unknownPeerTimeout = 10 * time.Second
+	// unknownPeerNegativeTTL is how long to wait before looking up an address
+	// again, after a lookup didn't find a peer (or failed).
+	unknownPeerNegativeTTL = 30 * time.Second
+	// maxPendingPeerLookups is the maximum number of concurrent lookups.
+	maxPendingPeerLookups = 64
+)
+
+// UnknownPeerFunc is called when a packet is sent to an address that doesn't
+// belong to any known peer, eg. to fetch the peer's configuration from a
+// control plane. It returns the configuration of the peer that the address
+// belongs to, or nil if there is no such peer.
+type UnknownPeerFunc func(ctx context.Context, addr netip.Addr) (*v1alpha1.WireGuardPeerConfig, error)
+
+// SetUnknownPeerFunc sets a function used to look up peers on demand, so that
+// peers can be provisioned lazily. Packets sent to an address that doesn't
+// belong to a known peer trigger a lookup, and the peer that is returned is
+// added to the socket. The packet that triggered the lookup is dropped, as its
+// retransmission (eg. of a TCP SYN) will be delivered once the peer has been
+// added. A nil function disables lookups.
+//
+// Peers found this way are not part of the socket's original configuration,
+// so will be removed by a Reload() with a configuration that doesn't include
+// them. Lookups have no effect if the socket has a default gateway peer.
+func (s *NoisySocket) SetUnknownPeerFunc(fn UnknownPeerFunc) {
+	if fn == nil {
+		s.sourceSink.SetUnknownDestinationHandler(nil)
+		s.unknownPeers.setFunc(nil)
+		return
+	}
+
+	s.unknownPeers.setFunc(fn)
+	s.sourceSink.SetUnknownDestinationHandler(s.unknownPeers.lookup)
+}
+
+// unknownPeerResolver looks up unknown peers, in the background, using an
+// UnknownPeerFunc.
+type unknownPeerResolver struct {
+	logger  *slog.Logger
+	addPeer func(v1alpha1.WireGuardPeerConfig) error
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+
+	mu       sync.Mutex // protects all fields below
+	fn       UnknownPeerFunc
+	pending  map[netip.Addr]struct{}
+	notFound map[netip.Addr]time.Time
+}
+
+func newUnknownPeerResolver(logger *slog.Logger, addPeer func(v1alpha1.WireGuardPeerConfig) error) *unknownPeerResolver {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &unknownPeerResolver{
+		logger:   logger,
+		addPeer:  addPeer,
+		ctx:      ctx,
+		cancel:   cancel,
+		pending:  make(map[netip.Addr]struct{}),
+		notFound: make(map[netip.Addr]time.Time),
+	}
+}
+
+// Close cancels any pending lookups, and waits for them to return.
+func (r *unknownPeerResolver) Close() {
+	r.cancel()
+	r.wg.Wait()
+}
+
+func (r *unknownPeerResolver) setFunc(fn UnknownPeerFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.fn = fn
+	clear(r.notFound)
+}
+
+// lookup starts looking up the peer the address belongs to, unless a lookup is
+// already pending, or has recently failed. It doesn't block.
+func (r *unknownPeerResolver) lookup(addr netip.Addr) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.fn == nil || r.ctx.Err() != nil {
+		return
+	}
+
+	if _, ok := r.pending[addr]; ok || len(r.pending) >= maxPendingPeerLookups {
+		return
+	}
+
+	if expiry, ok := r.notFound[addr]; ok {
+		if time.Now().Before(expiry) {
+			return
+		}
+		delete(r.notFound, addr)
+	}
+
+	r.pending[addr] = struct{}{}
+
+	r.wg.Add(1)
+	go func(fn UnknownPeerFunc) {
+		defer r.wg.Done()
+
+		found := r.resolve(fn, addr)
+
+		r.mu.Lock()
+		delete(r.pending, addr)
+		if !found {
+			r.notFound[addr] = time.Now().Add(unknownPeerNegativeTTL)
+		}
+		r.mu.Unlock()
+	}(r.fn)
+}
+
+// resolve looks up, and adds, the peer the address belongs to. It reports
+// whether a peer was added.
+func (r *unknownPeerResolver) resolve(fn UnknownPeerFunc, addr netip.Addr) bool {
+	ctx, cancel := context.WithTimeout(r.ctx, unknownPeerTimeout)
+	defer cancel()
+
+	peerConf, err := fn(ctx, addr)
+	if err != nil {
+		r.logger.Warn("Failed to look up unknown peer", "addr", addr, "error", err)
+		return false
+	}
+
+	if peerConf == nil {
+		r.logger.Debug("No peer found for address", "addr", addr)
+		return false
+	}
+
+	// Otherwise we'd keep on looking up the same address.
+	var routed bool
+	for _, ip := range peerConf.IPs {
+		if prefix, err := parseAddrOrPrefix(ip); err == nil && prefix.Contains(addr) {
+			routed = true
+			break
+		}
+	}
+
+	if !routed {
+		r.logger.Warn("Looked up peer does not have the address",
+			"addr", addr, "peer", peerConf.PublicKey)
+		return false
+	}
+
+	if err := r.addPeer(*peerConf); err != nil {
+		r.logger.Warn("Failed to add looked up peer",
+			"addr", addr, "peer", peerConf.PublicKey, "error", err)
+		return false
+	}
+
+	r.logger.Info("Added peer on demand", "addr", addr, "peer", peerConf.PublicKey)
+
+	return true
+}